@@ -0,0 +1,227 @@
+// Copyright (c) DFINITY Foundation
+
+// Package acctest contains helpers for writing acceptance tests against a local
+// replica, for this provider and for Terraform modules built on top of it.
+package acctest
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-testing/config"
+	"github.com/hashicorp/terraform-plugin-testing/terraform"
+)
+
+// The endpoint of the local replica (as started by `dfx start`), unless set otherwise with
+// UseEndpoint.
+var LocalEndpoint = "http://localhost:4943"
+
+// Provider config with local replica.
+var ProviderConfig = providerConfig(LocalEndpoint)
+
+func providerConfig(endpoint string) string {
+	return `
+provider "ic" {
+    endpoint = "` + endpoint + `"
+}
+`
+}
+
+// Makes the tests target another local network (e.g. a PocketIC instance) instead of the
+// local replica, by setting LocalEndpoint and ProviderConfig. Must be called before the
+// tests run, e.g. in TestMain.
+func UseEndpoint(endpoint string) {
+	LocalEndpoint = endpoint
+	ProviderConfig = providerConfig(endpoint)
+}
+
+// Variables set by `NewTestEnv`.
+var VariablesConfig = `
+variable "provider_controller" {
+    type = string
+}
+`
+
+// Struct carrying test-related data.
+type TestEnv struct {
+	PemPath         string
+	Identity        identity.Identity
+	ConfigVariables map[string]config.Variable
+}
+
+// Creates a new test env containing data used in tests.
+// NOTE: this sets the IC_PEM_IDENTITY_PATH environment variable to a new identity
+// (which is accessible from the TestEnv struct).
+func NewTestEnv(t *testing.T) TestEnv {
+
+	pemPath, id := CreateTestPEM(t)
+
+	t.Setenv("IC_PEM_IDENTITY_PATH", pemPath)
+	t.Setenv("IC_PEM_IDENTITY", "") // which would take precedence
+
+	configVariables := map[string]config.Variable{}
+
+	// Use a temporary PEM as identity and inject it into the terraform config
+	providerController := id.Sender().Encode()
+	configVariables["provider_controller"] = config.StringVariable(providerController)
+
+	return TestEnv{
+		PemPath:         pemPath,
+		Identity:        id,
+		ConfigVariables: configVariables,
+	}
+}
+
+// Creates a PEM file in a temporary directory.
+func CreateTestPEM(t *testing.T) (string, identity.Identity) {
+
+	id, err := identity.NewRandomEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpdir := t.TempDir()
+	pemPath := path.Join(tmpdir, "pem")
+
+	data, err := id.ToPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(pemPath, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pemPath, id
+}
+
+// Agent configuration targeting the local replica. If the identity is nil, the
+// anonymous identity is used.
+func LocalhostConfig(id identity.Identity) agent.Config {
+	u, _ := url.Parse(LocalEndpoint)
+	return agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: u},
+		FetchRootKey: true,
+		Identity:     id,
+	}
+}
+
+// Returns the canister ID of the given resource.
+func resourceCanisterId(s *terraform.State, resourceName string) (principal.Principal, error) {
+	rs, ok := s.RootModule().Resources[resourceName]
+	if !ok {
+		return principal.Principal{}, fmt.Errorf("No canister exists")
+	}
+
+	canisterId := rs.Primary.ID
+
+	if canisterId == "" {
+		return principal.Principal{}, fmt.Errorf("Canister does not have an ID")
+	}
+
+	canisterIdP, err := principal.Decode(canisterId)
+	if err != nil {
+		return principal.Principal{}, fmt.Errorf("Could not decode principal %s: %w", canisterId, err)
+	}
+
+	return canisterIdP, nil
+}
+
+// Check that the update call to the canister with the given resource name returns a string with
+// the expected value.
+func CheckCanisterReplyString(s *terraform.State, resourceName string, methodName string, args []any, expected string) error {
+	canisterId, err := resourceCanisterId(s, resourceName)
+	if err != nil {
+		return err
+	}
+
+	agent, err := agent.New(LocalhostConfig(nil))
+	if err != nil {
+		return fmt.Errorf("Could not create agent: %w", err)
+	}
+
+	var result string
+	err = agent.Call(canisterId, methodName, args, []any{&result})
+	if err != nil {
+		return fmt.Errorf("Could not call %s on canister %s: %w", methodName, canisterId.Encode(), err)
+	}
+
+	if result != expected {
+		return fmt.Errorf("Mismatched reply: %s != %s", result, expected)
+	}
+
+	return nil
+}
+
+// Check that the module hash of the given canister matches the (hex-encoded) expected value.
+func CheckCanisterModuleHash(s *terraform.State, resourceName string, expected string) error {
+	canisterId, err := resourceCanisterId(s, resourceName)
+	if err != nil {
+		return err
+	}
+
+	agent, err := agent.New(LocalhostConfig(nil))
+	if err != nil {
+		return fmt.Errorf("Could not create agent: %w", err)
+	}
+
+	moduleHash, err := agent.GetCanisterModuleHash(canisterId)
+	if err != nil {
+		return fmt.Errorf("could not get canister module hash: %w", err)
+	}
+
+	moduleHashString := hex.EncodeToString(moduleHash)
+	if moduleHashString != expected {
+		return fmt.Errorf("module hash mismatch: '%s' != '%s'", moduleHashString, expected)
+	}
+
+	return nil
+}
+
+// Creates a canister outside of Terraform (e.g. to test imports) with the given Wasm
+// module installed and returns its ID. The canister is controlled by the given identity.
+func CreateCanisterFromWasmPath(id identity.Identity, wasmFilePath string) (string, error) {
+	agent, err := icMgmt.NewAgent(ic.MANAGEMENT_CANISTER_PRINCIPAL, LocalhostConfig(id))
+	if err != nil {
+		return "", fmt.Errorf("Could not create agent: %w", err)
+	}
+
+	createCanisterArgs := icMgmt.ProvisionalCreateCanisterWithCyclesArgs{}
+	res, err := agent.ProvisionalCreateCanisterWithCycles(createCanisterArgs)
+	if err != nil {
+		return "", fmt.Errorf("Could not create canister: %w", err)
+	}
+
+	wasmModule, err := os.ReadFile(wasmFilePath)
+	if err != nil {
+		return "", fmt.Errorf("Could not read wasm module: %w", err)
+	}
+	argRaw := []byte{}
+
+	canisterId := res.CanisterId
+
+	installCodeArgs := icMgmt.InstallCodeArgs{
+		Mode:       icMgmt.CanisterInstallMode{Install: &idl.Null{}},
+		CanisterId: canisterId,
+		WasmModule: wasmModule,
+		Arg:        argRaw,
+	}
+
+	err = agent.InstallCode(installCodeArgs)
+	if err != nil {
+		return "", fmt.Errorf("Could not install code: %w", err)
+	}
+
+	return canisterId.Encode(), nil
+}
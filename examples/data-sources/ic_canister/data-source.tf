@@ -0,0 +1,7 @@
+data "ic_canister" "backend" {
+  id = ic_canister.backend.id
+}
+
+output "backend_team" {
+  value = data.ic_canister.backend.labels["team"]
+}
@@ -0,0 +1,7 @@
+data "ic_cketh_deposit" "mine" {
+  minter_id = "sv3dd-oaaaa-aaaar-qacoa-cai"
+}
+
+output "deposit" {
+  value = "Call deposit(${data.ic_cketh_deposit.mine.principal_bytes32}) on ${data.ic_cketh_deposit.mine.helper_contract_address}"
+}
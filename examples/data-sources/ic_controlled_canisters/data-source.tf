@@ -0,0 +1,7 @@
+data "ic_controlled_canisters" "mine" {}
+
+import {
+  for_each = toset(data.ic_controlled_canisters.mine.canister_ids)
+  id       = each.value
+  to       = ic_canister.imported[each.value]
+}
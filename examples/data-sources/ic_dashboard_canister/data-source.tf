@@ -0,0 +1,3 @@
+data "ic_dashboard_canister" "ledger" {
+  canister_id = "ryjl3-tyaaa-aaaaa-aaaba-cai"
+}
@@ -0,0 +1,7 @@
+data "ic_expired_canisters" "previews" {
+  apply_summary_files = tolist(fileset(path.root, "previews/*/apply-summary.json"))
+}
+
+output "expired_preview_canisters" {
+  value = data.ic_expired_canisters.previews.canister_ids
+}
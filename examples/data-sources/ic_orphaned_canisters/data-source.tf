@@ -0,0 +1,12 @@
+data "ic_orphaned_canisters" "fleet" {
+  apply_summary_files = tolist(fileset(path.root, "environments/*/apply-summary.json"))
+  scan_transfers      = true
+}
+
+output "orphaned_canisters" {
+  value = data.ic_orphaned_canisters.fleet.canister_ids
+}
+
+output "create_transfers" {
+  value = data.ic_orphaned_canisters.fleet.create_transfers
+}
@@ -0,0 +1,10 @@
+data "ic_self" "provider" {}
+
+# Keep the provider in control of the canister, alongside the team's principal
+resource "ic_canister" "app" {
+  controllers = [data.ic_self.provider.controller, var.team_principal]
+}
+
+output "provider_principal" {
+  value = data.ic_self.provider.principal
+}
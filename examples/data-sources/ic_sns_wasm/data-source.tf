@@ -0,0 +1,11 @@
+data "ic_sns_wasm" "nns" {
+  sns_governance_canister_id = var.sns_governance_canister_id
+}
+
+# Only upgrade the dapp once its SNS runs the latest blessed governance
+check "sns_up_to_date" {
+  assert {
+    condition     = data.ic_sns_wasm.nns.next_version == null
+    error_message = "The SNS can still be upgraded to ${jsonencode(data.ic_sns_wasm.nns.next_version)}"
+  }
+}
@@ -0,0 +1,5 @@
+# Canisters can be imported by their id. If the canister advertises its init arguments in
+# the `icp:public init_arg` metadata section (candid-encoded), or their hex-encoded sha256
+# in the `icp:public init_arg_sha256` metadata section, they are used for `arg_hex` and
+# `arg_sha256` so that the canister is not reinstalled after the import.
+terraform import ic_canister.hello_world ryjl3-tyaaa-aaaaa-aaaba-cai
@@ -0,0 +1,11 @@
+resource "ic_canister_call" "set_fee" {
+  canister_id = ic_canister.ledger.id
+  candid_file = "${path.module}/ledger.did"
+  method      = "set_config"
+
+  # set_config : (record { fee : nat64; mode : variant { Open; Restricted : vec principal } }) -> ()
+  args = [{
+    fee  = 10000
+    mode = { Restricted = [var.admin] }
+  }]
+}
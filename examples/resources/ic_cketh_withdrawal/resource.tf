@@ -0,0 +1,6 @@
+resource "ic_cketh_withdrawal" "payout" {
+  minter_id = "sv3dd-oaaaa-aaaar-qacoa-cai"
+  ledger_id = "ss2fx-dyaaa-aaaar-qacoq-cai"
+  amount    = 30000000000000000 # 0.03 ETH, in wei
+  recipient = var.eth_address
+}
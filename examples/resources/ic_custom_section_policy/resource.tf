@@ -0,0 +1,10 @@
+resource "ic_custom_section_policy" "supply_chain" {
+  wasm_files = [
+    ic_canister.hello_world.wasm_file,
+  ]
+
+  required_sections = [
+    "git_commit_id",
+    "icp:public sbom_sha256",
+  ]
+}
@@ -0,0 +1,5 @@
+resource "ic_cycles_deposit" "backend" {
+  from_wallet_id = var.wallet_id
+  to_canister_id = ic_canister.backend.id
+  amount         = 2000000000000
+}
@@ -0,0 +1,39 @@
+# A backend configured with the id of its ledger, and a frontend configured with the id of
+# the backend: the ledger is installed first, then the backend and the frontend
+resource "ic_dapp" "app" {
+  canisters = {
+    ledger = {
+      wasm_file   = "${path.module}/ledger.wasm"
+      wasm_sha256 = filesha256("${path.module}/ledger.wasm")
+      candid_file = "${path.module}/ledger.did"
+      arg = jsonencode([{
+        Init = {
+          minting_account = { owner = var.minting_principal }
+          transfer_fee    = 10000
+          token_name      = "Example"
+          token_symbol    = "EXP"
+          # ... the other fields of the ledger's InitArgs
+        }
+      }])
+    }
+    backend = {
+      wasm_file   = "${path.module}/backend.wasm"
+      wasm_sha256 = filesha256("${path.module}/backend.wasm")
+      candid_file = "${path.module}/backend.did"
+      arg         = jsonencode([{ ledger = "{{ledger}}" }])
+    }
+    frontend = {
+      wasm_file   = "${path.module}/assetstorage.wasm"
+      wasm_sha256 = filesha256("${path.module}/assetstorage.wasm")
+      candid_file = "${path.module}/frontend.did"
+      arg         = jsonencode([{ backend = "{{backend}}" }])
+      controllers = [data.ic_self.provider.controller, var.frontend_deployer]
+    }
+  }
+}
+
+data "ic_self" "provider" {}
+
+output "backend_canister_id" {
+  value = ic_dapp.app.canister_ids["backend"]
+}
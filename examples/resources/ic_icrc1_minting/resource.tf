@@ -0,0 +1,5 @@
+resource "ic_icrc1_minting" "alice" {
+  ledger_id = var.ledger_id
+  to_owner  = var.alice_principal
+  amount    = 100000000
+}
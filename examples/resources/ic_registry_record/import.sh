@@ -0,0 +1,2 @@
+# Records of the default registry canister can be imported by their key.
+terraform import ic_registry_record.subnet subnet_record_<subnet id>
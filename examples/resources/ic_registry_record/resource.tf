@@ -0,0 +1,7 @@
+resource "ic_registry_record" "subnet" {
+  registry_canister_id = var.registry_canister_id
+  key                  = "subnet_record_${var.subnet_id}"
+
+  # Protobuf-encoded SubnetRecord, e.g. produced by a build step
+  value_hex = var.subnet_record_hex
+}
@@ -0,0 +1,8 @@
+# Deploys an SNS on a testnet, where the provider's principal is allowed by SNS-W
+resource "ic_sns_deployment" "testnet" {
+  sns_wasm_canister_id = var.sns_wasm_canister_id
+
+  # Candid-encoded (record { sns_init_payload = opt record { ... } }), e.g. from
+  # `didc encode -d sns_wasm.did -t '(DeployNewSnsRequest)' "$(cat sns_init.candid)"`
+  arg_hex = file("${path.module}/deploy_new_sns.hex")
+}
@@ -0,0 +1,43 @@
+# Wait for the upgrade of the first wave before upgrading the second one
+resource "ic_wait" "wave_1" {
+  canister_id = ic_canister.wave_1.id
+  query = {
+    method   = "status"
+    expected = "(variant { Ready })"
+  }
+  timeout = "10m"
+
+  triggers = {
+    wasm_sha256 = ic_canister.wave_1.wasm_sha256
+  }
+}
+
+resource "ic_canister" "wave_2" {
+  wasm_file   = var.wasm_file
+  wasm_sha256 = filesha256(var.wasm_file)
+
+  depends_on = [ic_wait.wave_1]
+}
+
+# Wait for an NNS proposal upgrading a system canister to be executed
+resource "ic_wait" "proposal" {
+  proposal_id = var.upgrade_proposal_id
+  timeout     = "1h"
+  interval    = "1m"
+}
+
+# Check the security headers of a frontend once its assets are synced
+resource "ic_wait" "frontend_headers" {
+  canister_id = ic_canister.frontend.id
+  security_headers = {
+    expected = {
+      x-frame-options = "DENY"
+    }
+  }
+
+  triggers = {
+    assets = var.assets_sha256
+  }
+
+  depends_on = [terraform_data.sync_assets]
+}
@@ -0,0 +1,62 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-framework/function"
+)
+
+const accountIdValidateSummary = "Validate an ICP account identifier"
+
+const accountIdValidateDescription = "The `account_id_validate` function checks that a string is a valid (hex-encoded) ICP account identifier, i.e. that it is 32 bytes long and that its leading CRC32 checksum matches the rest of the identifier. " +
+	"The account identifier is returned (lowercased) if valid, and an error is raised otherwise.\n\n" +
+	"To validate a variable without failing, use `can(provider::ic::account_id_validate(var.account_id))` in a `validation` block."
+
+// Ensure the implementation satisfies the desired interfaces.
+var _ function.Function = &AccountIdValidateFunction{}
+
+type AccountIdValidateFunction struct{}
+
+func (f *AccountIdValidateFunction) Metadata(ctx context.Context, req function.MetadataRequest, resp *function.MetadataResponse) {
+	resp.Name = "account_id_validate"
+}
+
+func (f *AccountIdValidateFunction) Definition(ctx context.Context, req function.DefinitionRequest, resp *function.DefinitionResponse) {
+
+	resp.Definition = function.Definition{
+		Summary:             accountIdValidateSummary,
+		Description:         accountIdValidateDescription,
+		MarkdownDescription: accountIdValidateDescription,
+
+		Parameters: []function.Parameter{
+			function.StringParameter{
+				Name:        "account_id",
+				Description: "The hex-encoded account identifier to validate",
+			},
+		},
+		Return: function.StringReturn{},
+	}
+}
+
+func (f *AccountIdValidateFunction) Run(ctx context.Context, req function.RunRequest, resp *function.RunResponse) {
+	var input string
+
+	// Read Terraform argument data into the variable
+	resp.Error = function.ConcatFuncErrors(resp.Error, req.Arguments.Get(ctx, &input))
+	if resp.Error != nil {
+		return
+	}
+
+	accountId, err := principal.DecodeAccountID(strings.ToLower(input))
+	if err != nil {
+		resp.Error = function.NewArgumentFuncError(0, fmt.Sprintf("Invalid account identifier %q: %s", input, err.Error()))
+		return
+	}
+
+	resp.Error = function.ConcatFuncErrors(resp.Error, resp.Result.Set(ctx, accountId.Encode()))
+}
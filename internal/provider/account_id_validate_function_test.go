@@ -0,0 +1,59 @@
+package provider
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/knownvalue"
+	"github.com/hashicorp/terraform-plugin-testing/statecheck"
+	"github.com/hashicorp/terraform-plugin-testing/tfversion"
+)
+
+func TestAccountIdValidateFunction(t *testing.T) {
+	t.Parallel()
+
+	accountId := principal.NewAccountID(principal.MustDecode("aaaaa-aa"), principal.DefaultSubAccount).Encode()
+
+	// Same account id with the last hex digit changed (checksum mismatch)
+	last := accountId[len(accountId)-1]
+	typo := "0"
+	if last == '0' {
+		typo = "1"
+	}
+	badChecksum := accountId[:len(accountId)-1] + typo
+
+	resource.UnitTest(t, resource.TestCase{
+		TerraformVersionChecks: []tfversion.TerraformVersionCheck{
+			// Provider functions are only supports in 1.8.0+
+			tfversion.SkipBelow(tfversion.Version1_8_0),
+		},
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::account_id_validate("` + accountId + `")
+                }`,
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownOutputValue("test", knownvalue.StringExact(accountId)),
+				},
+			},
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::account_id_validate("` + badChecksum + `")
+                }`,
+				ExpectError: regexp.MustCompile("invalid checksum"),
+			},
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::account_id_validate("abcd")
+                }`,
+				ExpectError: regexp.MustCompile("invalid length"),
+			},
+		},
+	})
+}
@@ -0,0 +1,407 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/certification/hashtree"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+)
+
+// agentFixture is the traffic of the provider's agents recorded by a test (see
+// testFixtureProviderFactories), which other tests can replay so that the resources
+// (including their error paths, e.g. CMC refunds) are tested deterministically without a
+// network.
+//
+// Fixtures can also be written by hand: the argument of the calls and queries is optional
+// (any argument matches), and the interactions matching a request are replayed in order,
+// the last one being repeated once all have been replayed.
+type agentFixture struct {
+	Interactions []agentInteraction `json:"interactions"`
+
+	// Whether the interactions were replayed
+	replayed []bool
+}
+
+type agentInteraction struct {
+	// call, query or read_state
+	Type       string   `json:"type"`
+	CanisterId string   `json:"canister_id"`
+	Method     string   `json:"method,omitempty"`
+	Arg        hexBytes `json:"arg,omitempty"`
+
+	// The outcome of calls and queries
+	Reply         hexBytes `json:"reply,omitempty"`
+	RejectCode    uint64   `json:"reject_code,omitempty"`
+	RejectMessage string   `json:"reject_message,omitempty"`
+	ErrorCode     string   `json:"error_code,omitempty"`
+
+	// The path read by read_state below canister/<canister_id>, e.g. `module_hash` or
+	// `metadata/candid:service`, and its value (missing if absent)
+	Path  string    `json:"path,omitempty"`
+	Value *hexBytes `json:"value,omitempty"`
+}
+
+// hexBytes are bytes encoded in hex in fixtures.
+type hexBytes []byte
+
+func (b hexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func (b *hexBytes) UnmarshalText(text []byte) error {
+	data, err := hex.DecodeString(string(text))
+	*b = data
+	return err
+}
+
+// Returns the interaction of the request to replay, marking it as replayed.
+func (f *agentFixture) replay(match func(agentInteraction) bool) (agentInteraction, bool) {
+	last := -1
+	for i, interaction := range f.Interactions {
+		if !match(interaction) {
+			continue
+		}
+		if !f.replayed[i] {
+			f.replayed[i] = true
+			return interaction, true
+		}
+		last = i
+	}
+	if last < 0 {
+		return agentInteraction{}, false
+	}
+	return f.Interactions[last], true
+}
+
+// Returns the recorded outcome of the call or query.
+func (f *agentFixture) outcome(request mockRequest) *mockRequestStatus {
+	canisterId := principal.Principal{Raw: request.CanisterId}.Encode()
+	interaction, ok := f.replay(func(interaction agentInteraction) bool {
+		return interaction.Type == request.Type && interaction.CanisterId == canisterId && interaction.Method == request.MethodName &&
+			(interaction.Arg == nil || bytes.Equal(interaction.Arg, request.Arg))
+	})
+	if !ok {
+		return mockReject(5, "No recorded %s of %s on %s in the fixture", request.Type, request.MethodName, canisterId)
+	}
+	if interaction.RejectCode != 0 {
+		return &mockRequestStatus{RejectCode: interaction.RejectCode, RejectMessage: interaction.RejectMessage, ErrorCode: interaction.ErrorCode}
+	}
+	return &mockRequestStatus{Reply: interaction.Reply}
+}
+
+// Returns the recorded value of the path of the canister (nil if absent, or not recorded).
+func (f *agentFixture) value(canisterId string, path string) []byte {
+	interaction, ok := f.replay(func(interaction agentInteraction) bool {
+		return interaction.Type == string(agent.RequestTypeReadState) && interaction.CanisterId == canisterId && interaction.Path == path
+	})
+	if !ok || interaction.Value == nil {
+		return nil
+	}
+	return *interaction.Value
+}
+
+// The backend replaying the fixture, if any.
+var replayedFixture = struct {
+	sync.Mutex
+	file    string
+	backend *mockBackend
+}{}
+
+// Returns the backend replaying the fixture (nil if empty). The fixture of a previous
+// configuration keeps being replayed in order.
+func replayAgentFixture(file string) (*mockBackend, error) {
+	replayedFixture.Lock()
+	defer replayedFixture.Unlock()
+
+	if file == replayedFixture.file {
+		return replayedFixture.backend, nil
+	}
+	if len(file) == 0 {
+		replayedFixture.file, replayedFixture.backend = "", nil
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var fixture agentFixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("could not read the fixture %s: %w", file, err)
+	}
+	fixture.replayed = make([]bool, len(fixture.Interactions))
+
+	backend, err := newMockBackend("", mockState{})
+	if err != nil {
+		return nil, err
+	}
+	backend.replay = &fixture
+
+	replayedFixture.file, replayedFixture.backend = file, backend
+	return backend, nil
+}
+
+// The fixture recorded by recordTransport (see recordAgentFixture).
+var recordedFixture = struct {
+	sync.Mutex
+	file    string
+	fixture agentFixture
+	// The calls whose outcome is not known yet, by request id
+	calls map[string]agentInteraction
+}{}
+
+// recordTransport records the calls, queries and reads of canister paths (with their
+// outcome) to the fixture. It wraps the transport sending the
+// requests of the endpoint, so that only the attempts that got a response are recorded.
+type recordTransport struct {
+	base http.RoundTripper
+}
+
+// Records the traffic of all agents to the fixture (none if empty). The fixture of a
+// previous configuration keeps being recorded to.
+func recordAgentFixture(file string) {
+	recordedFixture.Lock()
+	defer recordedFixture.Unlock()
+
+	if file != recordedFixture.file {
+		recordedFixture.file = file
+		recordedFixture.fixture = agentFixture{Interactions: []agentInteraction{}}
+		recordedFixture.calls = map[string]agentInteraction{}
+	}
+	if len(file) == 0 {
+		return
+	}
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recordedFixture.Lock()
+	recording := len(recordedFixture.file) > 0
+	recordedFixture.Unlock()
+	if !recording || req.Method != http.MethodPost || !strings.HasPrefix(req.URL.Path, "/api/v2/canister/") || req.GetBody == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	envelope, ok := readRequestEnvelope(req)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+
+	content := envelope.Content
+	if content.RequestType == agent.RequestTypeCall {
+		if res.StatusCode == http.StatusAccepted {
+			recordCall(envelope)
+		}
+		return res, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return res, nil
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	switch content.RequestType {
+	case agent.RequestTypeQuery:
+		err = recordQuery(envelope, body)
+	case agent.RequestTypeReadState:
+		err = recordReadState(envelope, body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not record the fixture: %w", err)
+	}
+	return res, nil
+}
+
+// Returns the interaction of the call or query, without its outcome.
+func newAgentInteraction(envelope requestEnvelope) agentInteraction {
+	content := envelope.Content
+	return agentInteraction{
+		Type:       string(content.RequestType),
+		CanisterId: principal.Principal{Raw: content.CanisterId}.Encode(),
+		Method:     content.MethodName,
+		Arg:        content.Arg,
+	}
+}
+
+// Records the call, whose outcome is recorded once read (see recordReadState).
+func recordCall(envelope requestEnvelope) {
+	recordedFixture.Lock()
+	defer recordedFixture.Unlock()
+
+	recordedFixture.calls[envelope.requestId()] = newAgentInteraction(envelope)
+}
+
+// Records the query with its outcome.
+func recordQuery(envelope requestEnvelope, body []byte) error {
+	var response queryResponse
+	if cbor.Unmarshal(body, &response) != nil {
+		return nil
+	}
+
+	interaction := newAgentInteraction(envelope)
+	if response.Status == "rejected" {
+		interaction.RejectCode, interaction.RejectMessage, interaction.ErrorCode = response.RejectCode, response.RejectMessage, response.ErrorCode
+	} else {
+		interaction.Reply = response.Reply["arg"]
+	}
+
+	recordedFixture.Lock()
+	defer recordedFixture.Unlock()
+	return appendRecordedInteractions(interaction)
+}
+
+// Records the outcome of the calls whose status was read, and the values of the canister
+// paths that were read.
+func recordReadState(envelope requestEnvelope, body []byte) error {
+	tree, ok := readStateTree(body)
+	if !ok {
+		return nil
+	}
+
+	recordedFixture.Lock()
+	defer recordedFixture.Unlock()
+
+	var interactions []agentInteraction
+	for _, path := range envelope.Content.Paths {
+		labels := make([]hashtree.Label, len(path))
+		for i, label := range path {
+			labels[i] = label
+		}
+
+		switch {
+		case len(path) >= 2 && string(path[0]) == "request_status":
+			requestId := hex.EncodeToString(path[1])
+			interaction, ok := recordedFixture.calls[requestId]
+			if !ok {
+				continue
+			}
+			lookup := func(label string) []byte {
+				value, _ := tree.Lookup(hashtree.Label("request_status"), path[1], hashtree.Label(label))
+				return value
+			}
+			switch string(lookup("status")) {
+			case "replied":
+				interaction.Reply = lookup("reply")
+			case "rejected":
+				interaction.RejectCode = new(big.Int).SetBytes(lookup("reject_code")).Uint64()
+				interaction.RejectMessage = string(lookup("reject_message"))
+				interaction.ErrorCode = string(lookup("error_code"))
+			default:
+				continue
+			}
+			delete(recordedFixture.calls, requestId)
+			interactions = append(interactions, interaction)
+		case len(path) >= 3 && string(path[0]) == "canister":
+			interaction := agentInteraction{
+				Type:       string(agent.RequestTypeReadState),
+				CanisterId: principal.Principal{Raw: path[1]}.Encode(),
+			}
+			subpath := make([]string, len(path)-2)
+			for i, label := range path[2:] {
+				subpath[i] = string(label)
+			}
+			interaction.Path = strings.Join(subpath, "/")
+
+			value, err := tree.Lookup(labels...)
+			var lookupErr hashtree.LookupError
+			if err == nil {
+				interaction.Value = (*hexBytes)(&value)
+			} else if !errors.As(err, &lookupErr) || lookupErr.Type != hashtree.LookupResultAbsent {
+				continue
+			}
+			interactions = append(interactions, interaction)
+		}
+	}
+
+	return appendRecordedInteractions(interactions...)
+}
+
+// Appends the interactions to the recorded fixture, and saves it.
+func appendRecordedInteractions(interactions ...agentInteraction) error {
+	if len(interactions) == 0 {
+		return nil
+	}
+	recordedFixture.fixture.Interactions = append(recordedFixture.fixture.Interactions, interactions...)
+
+	data, err := json.MarshalIndent(recordedFixture.fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(recordedFixture.file, data, 0600)
+}
+
+// Records the traffic of the agents to the fixture record, or replays the fixture replay
+// (none if empty), returning the wrapper of the transport sending the requests of the
+// endpoint (nil if none). Replaying serves the endpoint with a backend certifying the
+// recorded values with its own root key, which is therefore fetched.
+func applyAgentFixtures(config *agent.Config, replay string, record string) (func(http.RoundTripper) http.RoundTripper, error) {
+	// The agents of the provider are created again with the root key of the backend, since
+	// configuring the provider gives its endpoint a new transport (see newAgent)
+	backend, err := replayAgentFixture(replay)
+	if err != nil {
+		return nil, err
+	}
+	recordAgentFixture(record)
+
+	if backend != nil {
+		config.FetchRootKey = true
+		return func(http.RoundTripper) http.RoundTripper {
+			return &mockTransport{backend: backend}
+		}, nil
+	}
+	if len(record) > 0 {
+		return func(base http.RoundTripper) http.RoundTripper {
+			return &recordTransport{base: base}
+		}, nil
+	}
+	return nil, nil
+}
+
+// Stops recording and replaying fixtures at the end of the test.
+func cleanupAgentFixtures(t *testing.T) {
+	t.Cleanup(func() {
+		if _, err := applyAgentFixtures(&agent.Config{}, "", ""); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// Returns the provider factories of a test recording the traffic of the agents to the
+// fixture record, or replaying the fixture replay (see agentFixture).
+func testFixtureProviderFactories(t *testing.T, replay string, record string) map[string]func() (tfprotov6.ProviderServer, error) {
+	cleanupAgentFixtures(t)
+	return map[string]func() (tfprotov6.ProviderServer, error){
+		"ic": providerserver.NewProtocol6WithError(&IcProvider{
+			version: "test",
+			agentFixture: func(config *agent.Config) (func(http.RoundTripper) http.RoundTripper, error) {
+				return applyAgentFixtures(config, replay, record)
+			},
+		}),
+	}
+}
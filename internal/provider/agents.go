@@ -0,0 +1,111 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/identity"
+)
+
+// agentKey identifies the agents created with equivalent configurations.
+type agentKey struct {
+	host          string
+	sender        string
+	publicKey     string // hex-encoded, so that identities with the same principal but different keys differ
+	ingressExpiry time.Duration
+	fetchRootKey  bool
+	pollDelay     time.Duration
+	pollTimeout   time.Duration
+}
+
+func newAgentKey(config agent.Config) agentKey {
+	key := agentKey{
+		ingressExpiry: config.IngressExpiry,
+		fetchRootKey:  config.FetchRootKey,
+		pollDelay:     config.PollDelay,
+		pollTimeout:   config.PollTimeout,
+	}
+	if config.ClientConfig != nil && config.ClientConfig.Host != nil {
+		key.host = config.ClientConfig.Host.String()
+	}
+
+	var id identity.Identity = identity.AnonymousIdentity{}
+	if config.Identity != nil {
+		id = config.Identity
+	}
+	key.sender = id.Sender().Encode()
+	key.publicKey = hex.EncodeToString(id.PublicKey())
+
+	return key
+}
+
+// agentCache holds the agents of a provider instance by configuration, shared by all its
+// operations (see newAgent).
+type agentCache struct {
+	mu     sync.Mutex
+	agents map[agentKey]*cachedAgent
+}
+
+// cachedAgent is an agent of the cache, which is ready once created.
+type cachedAgent struct {
+	ready chan struct{}
+	agent *agent.Agent
+	err   error
+}
+
+func newAgentCache() *agentCache {
+	return &agentCache{agents: map[agentKey]*cachedAgent{}}
+}
+
+// Returns an agent with the configuration, reusing the agent created for an equivalent
+// configuration if any. Creating an agent fetches the root key (except on mainnet), which
+// would otherwise be fetched again by every call of every resource.
+//
+// Agents are cached by provider instance, with the transport of its endpoint (see
+// endpointTransport), so that configuring the provider again (e.g. with another root key)
+// creates new agents. Agents are immutable once created and can be used concurrently.
+// Configurations with a logger (which is not part of agentKey), or whose endpoint is not
+// configured, get a fresh agent.
+func newAgent(config agent.Config) (*agent.Agent, error) {
+	transport, ok := configuredEndpointTransport(config)
+	if config.Logger != nil || !ok {
+		return agent.New(config)
+	}
+	return transport.agents.get(config)
+}
+
+// Returns the agent of the cache with the configuration, creating it if needed. Agents are
+// created outside of the lock, so that the creation of an agent (which may wait for a slow
+// endpoint) doesn't hold up the operations using other agents. Concurrent operations
+// needing the same agent wait for its creation, and share its outcome.
+func (c *agentCache) get(config agent.Config) (*agent.Agent, error) {
+	key := newAgentKey(config)
+
+	c.mu.Lock()
+	cached, ok := c.agents[key]
+	if !ok {
+		cached = &cachedAgent{ready: make(chan struct{})}
+		c.agents[key] = cached
+	}
+	c.mu.Unlock()
+
+	if ok {
+		<-cached.ready
+		return cached.agent, cached.err
+	}
+
+	cached.agent, cached.err = agent.New(config)
+	if cached.err != nil {
+		// Failures (e.g. the status endpoint being unreachable) are not cached
+		c.mu.Lock()
+		delete(c.agents, key)
+		c.mu.Unlock()
+	}
+	close(cached.ready)
+
+	return cached.agent, cached.err
+}
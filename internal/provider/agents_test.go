@@ -0,0 +1,106 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Creates agents concurrently for an endpoint whose root key is slow to fetch, checking
+// that the root key is only fetched once per configuration of the endpoint, that failures
+// are not cached, and that creating an agent doesn't hold up the agents of other endpoints.
+func TestNewAgent(t *testing.T) {
+	var statusRequests atomic.Int32
+	var unavailable atomic.Bool
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		statusRequests.Add(1)
+		<-release
+		if unavailable.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		status, _ := cbor.Marshal(map[string]any{"root_key": []byte{1, 2, 3}})
+		w.Write(status)
+	}))
+	defer slow.Close()
+
+	host, _ := url.Parse(slow.URL)
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, nil))
+	config := agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		FetchRootKey: true,
+	}
+
+	var wg sync.WaitGroup
+	agents := make([]*agent.Agent, 5)
+	for i := range agents {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a, err := newAgent(config)
+			if err != nil {
+				t.Error(err)
+			}
+			agents[i] = a
+		}(i)
+	}
+
+	// The agents of other endpoints are created meanwhile
+	fastHost, _ := url.Parse("mock://" + strings.ToLower(t.Name()))
+	setEndpointTransport(fastHost, newEndpointTransport(fastHost, transportSettings{}, nil))
+	done := make(chan error)
+	go func() {
+		_, err := newAgent(agent.Config{ClientConfig: &agent.ClientConfig{Host: fastHost}, FetchRootKey: true})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the agent of another endpoint to be created while the root key is fetched")
+	}
+
+	close(release)
+	wg.Wait()
+	if n := statusRequests.Load(); n != 1 {
+		t.Errorf("expected the root key to be fetched once, got %d requests", n)
+	}
+	for _, a := range agents[1:] {
+		if a != agents[0] {
+			t.Fatal("expected the agents to be shared")
+		}
+	}
+
+	// Configuring the endpoint again creates new agents, e.g. for a new root key
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, nil))
+	unavailable.Store(true)
+	if _, err := newAgent(config); err == nil {
+		t.Fatal("expected the root key not to be fetched")
+	}
+	unavailable.Store(false)
+	a, err := newAgent(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == agents[0] {
+		t.Error("expected a new agent once the endpoint is configured again")
+	}
+	if n := statusRequests.Load(); n != 3 {
+		t.Errorf("expected the root key to be fetched again after the failure, got %d requests", n)
+	}
+}
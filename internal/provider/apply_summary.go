@@ -0,0 +1,155 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ApplySummary maintains a JSON manifest describing the canisters managed by the
+// provider, for consumption by release tooling and audit trails.
+// The manifest is updated every time a canister is created, updated or deleted. A nil
+// *ApplySummary is valid and does nothing.
+type ApplySummary struct {
+	mu       sync.Mutex
+	path     string
+	network  string
+	identity string
+}
+
+// The JSON manifest written to disk.
+type ApplySummaryManifest struct {
+	Network   string                          `json:"network"`
+	Identity  string                          `json:"identity"`
+	UpdatedAt string                          `json:"updated_at"`
+	Canisters map[string]ApplySummaryCanister `json:"canisters"`
+
+	// Refunds issued by the CMC, which are kept when the canisters are replaced or deleted
+	// (unlike the canisters' cmc_refunds), for reconciliation
+	CmcRefunds []ApplySummaryCmcRefund `json:"cmc_refunds,omitempty"`
+}
+
+// A canister entry in the manifest, keyed by canister ID.
+type ApplySummaryCanister struct {
+	Id          string   `json:"id"`
+	Controllers []string `json:"controllers"`
+	WasmSha256  string   `json:"wasm_sha256"`
+	ArgSha256   string   `json:"arg_sha256"`
+	ExpiresAt   string   `json:"expires_at,omitempty"` // RFC 3339, if set
+}
+
+// A refund in the manifest (see CmcRefund).
+type ApplySummaryCmcRefund struct {
+	TransferBlockIndex uint64  `json:"transfer_block_index"`
+	RefundBlockIndex   *uint64 `json:"refund_block_index,omitempty"`
+	RefundE8s          uint64  `json:"refund_e8s"`
+	Reason             string  `json:"reason"`
+	CanisterId         string  `json:"canister_id,omitempty"` // the canister being topped up or migrated, if any
+	RefundedAt         string  `json:"refunded_at"`           // RFC 3339
+}
+
+func NewApplySummary(path string, network string, identity string) *ApplySummary {
+	return &ApplySummary{path: path, network: network, identity: identity}
+}
+
+// Records (or replaces) the canister entry in the manifest.
+func (s *ApplySummary) RecordCanister(canister ApplySummaryCanister) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.update(func(m *ApplySummaryManifest) {
+		m.Canisters[canister.Id] = canister
+	})
+}
+
+// Removes the canister entry from the manifest (if any).
+func (s *ApplySummary) RemoveCanister(canisterId string) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.update(func(m *ApplySummaryManifest) {
+		delete(m.Canisters, canisterId)
+	})
+}
+
+// Records the refund in the manifest, replacing the refund of the same transfer (if any).
+func (s *ApplySummary) RecordCmcRefund(refund ApplySummaryCmcRefund) error {
+	if s == nil {
+		return nil
+	}
+
+	return s.update(func(m *ApplySummaryManifest) {
+		for i, recorded := range m.CmcRefunds {
+			if recorded.TransferBlockIndex == refund.TransferBlockIndex {
+				m.CmcRefunds[i] = refund
+				return
+			}
+		}
+		m.CmcRefunds = append(m.CmcRefunds, refund)
+	})
+}
+
+func (s *ApplySummary) update(f func(m *ApplySummaryManifest)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	manifest := ApplySummaryManifest{Canisters: map[string]ApplySummaryCanister{}}
+
+	// Keep the entries recorded by previous applies
+	data, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not read apply summary: %w", err)
+	}
+
+	if err == nil {
+		err = json.Unmarshal(data, &manifest)
+		if err != nil {
+			return fmt.Errorf("could not parse apply summary %s: %w", s.path, err)
+		}
+
+		if manifest.Canisters == nil {
+			manifest.Canisters = map[string]ApplySummaryCanister{}
+		}
+	}
+
+	manifest.Network = s.network
+	manifest.Identity = s.identity
+	manifest.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	f(&manifest)
+
+	data, err = json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode apply summary: %w", err)
+	}
+
+	// Write to a temporary file first so that readers never see a partial manifest
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("could not write apply summary: %w", err)
+	}
+
+	_, err = tmp.Write(append(data, '\n'))
+	closeErr := tmp.Close()
+	if err = errors.Join(err, closeErr); err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("could not write apply summary: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("could not write apply summary: %w", err)
+	}
+
+	return nil
+}
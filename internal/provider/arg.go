@@ -3,8 +3,14 @@
 package provider
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"strings"
 
+	"github.com/aviate-labs/agent-go/candid"
+	"github.com/aviate-labs/agent-go/candid/idl"
 	"github.com/hashicorp/terraform-plugin-go/tftypes"
 )
 
@@ -14,7 +20,8 @@ import (
 //   - If the value is an object with fields __didType & __didValue, use __didType
 //     as the type for __didValue
 //   - Otherwise, use the corresponding candid value (candid 'text' for Terraform strings,
-//     candid 'record' for Terraform objects, etc)
+//     candid 'record' for Terraform objects and maps, candid 'vec' for Terraform lists,
+//     tuples and sets, etc)
 func TFValToCandid(val tftypes.Value) (any, error) {
 
 	// First, we try to read a wrapped value ( { __didType = ..., __didValue = ... })
@@ -34,7 +41,12 @@ func TFValToCandid(val tftypes.Value) (any, error) {
 		return res, nil
 	}
 
-	return nil, fmt.Errorf("cannot encode value %v: %w; %w; %w", val.String(), errWrapped, errText, errRec)
+	res, errVec := readVecValue(val)
+	if errVec == nil {
+		return res, nil
+	}
+
+	return nil, fmt.Errorf("cannot encode value %v: %w; %w; %w; %w", val.String(), errWrapped, errText, errRec, errVec)
 }
 
 // Read a wrapped value. Returns an error if not a wrapped value (i.e. if does not contain
@@ -71,6 +83,8 @@ func readWrappedValue(val tftypes.Value) (any, error) {
 		return readTextValue(idlValue)
 	case "record":
 		return readRecordValue(idlValue)
+	case "blob":
+		return readBlobValue(idlValue)
 
 	default:
 		return nil, fmt.Errorf("unknown idl type %s for val %v", idlType.String(), val)
@@ -88,6 +102,21 @@ func readTextValue(val tftypes.Value) (string, error) {
 	return "", fmt.Errorf("not a string: %v", val)
 }
 
+// read 'val' as a blob value (from a hex string).
+func readBlobValue(val tftypes.Value) ([]byte, error) {
+	str, err := readTextValue(val)
+	if err != nil {
+		return nil, fmt.Errorf("not a blob: %w", err)
+	}
+
+	blob, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, fmt.Errorf("not a hex-encoded blob: %w", err)
+	}
+
+	return blob, nil
+}
+
 // read 'val' as a record value.
 func readRecordValue(val tftypes.Value) (map[string]any, error) {
 	var m map[string]tftypes.Value
@@ -107,3 +136,104 @@ func readRecordValue(val tftypes.Value) (map[string]any, error) {
 	return ret, nil
 
 }
+
+// read 'val' as a vec value. Lists and tuples keep their order. Sets are sorted (by
+// candid encoding) so that the encoding is deterministic, and elements that encode to
+// the same candid value are deduplicated.
+func readVecValue(val tftypes.Value) ([]any, error) {
+	var elems []tftypes.Value
+
+	err := val.As(&elems)
+	if err != nil {
+		return nil, fmt.Errorf("not a vec: %s", val.String())
+	}
+
+	// NOTE: agent-go infers the type of a vec from its first element, so we can't
+	// encode empty collections.
+	if len(elems) == 0 {
+		return nil, fmt.Errorf("cannot infer element type of empty collection: %s", val.String())
+	}
+
+	ret := make([]any, len(elems))
+	for i, elem := range elems {
+		ret[i], err = TFValToCandid(elem)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !val.Type().Is(tftypes.Set{}) {
+		return ret, nil
+	}
+
+	type encodedElem struct {
+		value   any
+		encoded []byte
+	}
+
+	encodedElems := make([]encodedElem, len(ret))
+	for i, v := range ret {
+		encoded, err := idl.Marshal([]any{v})
+		if err != nil {
+			return nil, err
+		}
+		encodedElems[i] = encodedElem{value: v, encoded: encoded}
+	}
+
+	sort.Slice(encodedElems, func(i, j int) bool {
+		return bytes.Compare(encodedElems[i].encoded, encodedElems[j].encoded) < 0
+	})
+
+	deduped := []any{}
+	for i, elem := range encodedElems {
+		if i > 0 && bytes.Equal(elem.encoded, encodedElems[i-1].encoded) {
+			continue
+		}
+		deduped = append(deduped, elem.value)
+	}
+
+	return deduped, nil
+}
+
+// Returns true if both hex-encoded arguments represent the same candid values. Encodings
+// of the same values may differ (e.g. in the order of the type table), in which case the
+// decoded values are compared.
+func ArgsEquivalent(argHexA string, argHexB string) bool {
+	if strings.EqualFold(argHexA, argHexB) {
+		return true
+	}
+
+	canonicalA, errA := canonicalArg(argHexA)
+	canonicalB, errB := canonicalArg(argHexB)
+	if errA != nil || errB != nil {
+		return false
+	}
+
+	return canonicalA == canonicalB
+}
+
+// Returns a canonical textual representation of the hex-encoded candid arguments,
+// including types (so that e.g. empty vectors of different types differ).
+func canonicalArg(argHex string) (string, error) {
+	raw, err := hex.DecodeString(argHex)
+	if err != nil {
+		return "", err
+	}
+
+	tys, values, err := idl.Decode(raw)
+	if err != nil {
+		return "", err
+	}
+
+	tyStrs := make([]string, len(tys))
+	for i, ty := range tys {
+		tyStrs[i] = ty.String()
+	}
+
+	valuesStr, err := candid.DecodeValuesString(tys, values)
+	if err != nil {
+		return "", err
+	}
+
+	return "(" + strings.Join(tyStrs, ", ") + ") " + valuesStr, nil
+}
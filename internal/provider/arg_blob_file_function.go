@@ -0,0 +1,85 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/function"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+const argBlobFileSummary = "Mark the content of a file as a candid blob"
+
+const argBlobFileDescription = "The `did_blob_file` function reads a (binary) file and marks its content as a candid blob, so that arguments embedding binary payloads (e.g. Wasm modules passed to SNS-W, asset bundles) can reference files directly. " +
+	"It can be used with `did_encode` and in the `arg`s of resources typed with a candid file (where a `blob` is expected). " +
+	"The file is read when the function is called, so changes to the file are detected on plan.\n\n" +
+	"See the documentation for `did_encode`."
+
+// Ensure the implementation satisfies the desired interfaces.
+var _ function.Function = &ArgBlobFileFunction{}
+
+type ArgBlobFileFunction struct{}
+
+func (f *ArgBlobFileFunction) Metadata(ctx context.Context, req function.MetadataRequest, resp *function.MetadataResponse) {
+	resp.Name = "did_blob_file"
+}
+
+var didBlobFileReturnAttrTypes = map[string]attr.Type{
+	"__didType":  types.StringType, /* the string constant "blob" */
+	"__didValue": types.StringType, /* the hex-encoded content of the file */
+}
+
+func (f *ArgBlobFileFunction) Definition(ctx context.Context, req function.DefinitionRequest, resp *function.DefinitionResponse) {
+
+	resp.Definition = function.Definition{
+		Summary:             argBlobFileSummary,
+		Description:         argBlobFileDescription,
+		MarkdownDescription: argBlobFileDescription,
+
+		Parameters: []function.Parameter{
+			function.StringParameter{
+				Name:        "path",
+				Description: "Path to the file to candid-encode as candid blob",
+			},
+		},
+		Return: function.ObjectReturn{
+			AttributeTypes: didBlobFileReturnAttrTypes,
+		},
+	}
+}
+
+func (f *ArgBlobFileFunction) Run(ctx context.Context, req function.RunRequest, resp *function.RunResponse) {
+	var path string
+
+	// Read Terraform argument data into the variable
+	resp.Error = function.ConcatFuncErrors(resp.Error, req.Arguments.Get(ctx, &path))
+	if resp.Error != nil {
+		return
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		resp.Error = function.NewArgumentFuncError(0, fmt.Sprintf("Could not read file: %s", err.Error()))
+		return
+	}
+
+	wrapped, diags := types.ObjectValue(
+		didBlobFileReturnAttrTypes,
+		map[string]attr.Value{
+			"__didType":  types.StringValue("blob"),
+			"__didValue": types.StringValue(hex.EncodeToString(content)),
+		},
+	)
+
+	resp.Error = function.FuncErrorFromDiags(ctx, diags)
+	if resp.Error != nil {
+		return
+	}
+
+	resp.Error = function.ConcatFuncErrors(resp.Error, resp.Result.Set(ctx, wrapped))
+}
@@ -0,0 +1,77 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/hex"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/knownvalue"
+	"github.com/hashicorp/terraform-plugin-testing/statecheck"
+	"github.com/hashicorp/terraform-plugin-testing/tfversion"
+)
+
+// Check that files are encoded as blobs, including inside records.
+func TestArgBlobFileFunction(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	content := []byte{0x00, 'a', 's', 'm', 0x01, 0xff}
+	err := os.WriteFile(path.Join(dir, "payload.bin"), content, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := idl.Marshal([]any{content})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := idl.Marshal([]any{map[string]any{"wasm": content}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := path.Join(dir, "payload.bin")
+
+	resource.UnitTest(t, resource.TestCase{
+		TerraformVersionChecks: []tfversion.TerraformVersionCheck{
+			// Provider functions are only supports in 1.8.0+
+			tfversion.SkipBelow(tfversion.Version1_8_0),
+		},
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::did_encode(provider::ic::did_blob_file("` + file + `"))
+                }`,
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownOutputValue("test", knownvalue.StringExact(hex.EncodeToString(blob))),
+				},
+			},
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::did_encode({ wasm = provider::ic::did_blob_file("` + file + `") })
+                }`,
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownOutputValue("test", knownvalue.StringExact(hex.EncodeToString(record))),
+				},
+			},
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::did_blob_file("` + path.Join(dir, "missing.bin") + `")
+                }`,
+				ExpectError: regexp.MustCompile("Could not read file"),
+			},
+		},
+	})
+}
@@ -0,0 +1,344 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/aviate-labs/agent-go/candid/did"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/function"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+const argDecodeSummary = "Decode candid values into Terraform values."
+
+const argDecodeDescription = "The `did_decode` function transforms hex-encoded candid values (e.g. the `reply_hex` of an `ic_canister_call`) into Terraform values, so that they can be used in HCL expressions. " +
+	"Texts are decoded as strings, numbers as numbers, principals as their textual representation, blobs as hex strings, `opt` values as null (none) or the value itself, `vec` values as tuples, records as objects and variants as an object with a single attribute, the case, or as a string for cases without value. " +
+	"When the candid value holds several values (e.g. the results of a method), they are returned as a tuple.\n\n" +
+
+	"On the wire, record fields and variant cases are only identified by the hash of their name, which is what they are named after unless a type hint is given. " +
+	"The type hint is either a textual candid type (e.g. `record { owner : principal; amount : nat }`, or `(text, nat)` for several values) or a reference to a .did file, `<path>.did:<method>` for the results of a method or `<path>.did:<type>` for a type defined in the file. " +
+	"Fields and cases that the type hint doesn't describe keep their hash.\n\n" +
+
+	"`did_decode(\"4449444c016c01d8a38ca80d7d01002a\", \"record { amount : nat }\")` = `{ amount = 42 }`\n"
+
+// References to .did files in type hints, `<path>.did:<method or type>`.
+var didHintReferenceRegex = regexp.MustCompile(`^(.+\.did):([A-Za-z_][A-Za-z0-9_]*)$`)
+
+// Ensure the implementation satisfies the desired interfaces.
+var _ function.Function = &ArgDecodeFunction{}
+
+type ArgDecodeFunction struct{}
+
+func (f *ArgDecodeFunction) Metadata(ctx context.Context, req function.MetadataRequest, resp *function.MetadataResponse) {
+	resp.Name = "did_decode"
+}
+
+func (f *ArgDecodeFunction) Definition(ctx context.Context, req function.DefinitionRequest, resp *function.DefinitionResponse) {
+
+	resp.Definition = function.Definition{
+		Summary:             argDecodeSummary,
+		Description:         argDecodeDescription,
+		MarkdownDescription: argDecodeDescription,
+
+		Parameters: []function.Parameter{
+			function.StringParameter{
+				Name:        "input",
+				Description: "The hex-encoded candid value to decode",
+			},
+		},
+		VariadicParameter: function.StringParameter{
+			Name:        "type_hint",
+			Description: "Optional textual candid type or .did reference (`<path>.did:<method or type>`) naming the record fields and variant cases",
+		},
+		Return: function.DynamicReturn{},
+	}
+}
+
+func (f *ArgDecodeFunction) Run(ctx context.Context, req function.RunRequest, resp *function.RunResponse) {
+	var input string
+	var typeHints []string
+
+	// Read Terraform argument data into the variables
+	resp.Error = function.ConcatFuncErrors(resp.Error, req.Arguments.Get(ctx, &input, &typeHints))
+	if resp.Error != nil {
+		return
+	}
+
+	raw, err := hex.DecodeString(input)
+	if err != nil {
+		resp.Error = function.NewArgumentFuncError(0, "Input is not hex-encoded: "+err.Error())
+		return
+	}
+
+	tys, values, err := idl.Decode(raw)
+	if err != nil {
+		resp.Error = function.NewArgumentFuncError(0, "Could not decode candid value: "+err.Error())
+		return
+	}
+
+	service := &didService{}
+	var hints []did.Data
+	switch len(typeHints) {
+	case 0:
+	case 1:
+		service, hints, err = readDidTypeHint(typeHints[0])
+		if err != nil {
+			resp.Error = function.NewArgumentFuncError(1, "Invalid type hint: "+err.Error())
+			return
+		}
+	default:
+		resp.Error = function.NewArgumentFuncError(2, "At most one type hint can be given")
+		return
+	}
+
+	elems := make([]attr.Value, len(values))
+	elemTypes := make([]attr.Type, len(values))
+	for i := range values {
+		var hint did.Data
+		if i < len(hints) {
+			hint = hints[i]
+		}
+
+		elems[i], err = service.tfValue(tys[i], values[i], hint)
+		if err != nil {
+			resp.Error = function.NewFuncError(fmt.Sprintf("Could not decode value %d: %s", i, err.Error()))
+			return
+		}
+		elemTypes[i] = elems[i].Type(ctx)
+	}
+
+	var result attr.Value
+	if len(elems) == 1 {
+		result = elems[0]
+	} else {
+		tuple, diags := types.TupleValue(elemTypes, elems)
+		resp.Error = function.FuncErrorFromDiags(ctx, diags)
+		if resp.Error != nil {
+			return
+		}
+		result = tuple
+	}
+
+	resp.Error = function.ConcatFuncErrors(resp.Error, resp.Result.Set(ctx, types.DynamicValue(result)))
+}
+
+// Returns the declared types of the values described by the type hint, either a .did
+// reference or a textual candid type (or a parenthesized list of types, one per value),
+// along with the types the declared types may refer to.
+func readDidTypeHint(hint string) (*didService, []did.Data, error) {
+	if m := didHintReferenceRegex.FindStringSubmatch(hint); m != nil {
+		didFile, name := m[1], m[2]
+
+		raw, err := os.ReadFile(didFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not read candid file: %w", err)
+		}
+
+		desc, err := parseDid(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not parse candid file %s: %w", didFile, err)
+		}
+
+		// Files with only type definitions are fine too
+		var service *didService
+		if len(desc.Services) > 0 {
+			service, err = readDidService(didFile)
+		} else {
+			service, err = newDidTypes(desc, didFile)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if method, ok := service.methods[name]; ok {
+			return service, argumentsData(method.ResTypes), nil
+		}
+		if _, ok := service.types[name]; ok {
+			return service, []did.Data{did.DataId(name)}, nil
+		}
+		return nil, nil, fmt.Errorf("candid file %s declares no method or type %s", didFile, name)
+	}
+
+	results := strings.TrimSpace(hint)
+	if !strings.HasPrefix(results, "(") {
+		results = "(" + results + ")"
+	}
+
+	desc, err := parseDid([]byte("type hint = func () -> " + results + ";"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	service, err := newDidTypes(desc, "hint")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, ok := service.types["hint"].(did.Func)
+	if !ok {
+		return nil, nil, fmt.Errorf("%s is not a candid type", hint)
+	}
+
+	return service, argumentsData(f.ResTypes), nil
+}
+
+func argumentsData(tuple did.Tuple) []did.Data {
+	data := make([]did.Data, len(tuple))
+	for i, arg := range tuple {
+		data[i] = arg.Data
+	}
+	return data
+}
+
+// Returns the fields of the declared record or variant by the hash of their name (as
+// record fields and variant cases are identified on the wire). Unnamed fields are left out.
+func didFieldsByHash(fields []did.Field) map[string]did.Field {
+	byHash := make(map[string]did.Field, len(fields))
+	for _, field := range fields {
+		name, err := didFieldName(field)
+		if err != nil {
+			continue
+		}
+		byHash[idl.HashString(name)] = field
+	}
+	return byHash
+}
+
+// Converts the decoded candid value of type ty to a Terraform value (see did_decode). Record
+// fields and variant cases are named after the declared type hint, if any and if it has the
+// same structure, and after the hash of their name otherwise.
+func (s *didService) tfValue(ty idl.Type, value any, hint did.Data) (attr.Value, error) {
+	if hint != nil {
+		var err error
+		hint, err = s.resolve(hint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch t := ty.(type) {
+	case *idl.NullType, *idl.ReservedType, *idl.EmptyType:
+		return types.DynamicNull(), nil
+	case *idl.BoolType:
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("expected bool, got %T", value)
+		}
+		return types.BoolValue(b), nil
+	case *idl.TextType:
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected text, got %T", value)
+		}
+		return types.StringValue(str), nil
+	case *idl.PrincipalType:
+		p, ok := value.(principal.Principal)
+		if !ok {
+			return nil, fmt.Errorf("expected principal, got %T", value)
+		}
+		return types.StringValue(p.Encode()), nil
+	case *idl.NatType, *idl.IntType, *idl.FloatType:
+		// idl.Nat and idl.Int print as decimal numbers, like the fixed-size types
+		f, ok := new(big.Float).SetString(fmt.Sprint(value))
+		if !ok {
+			return nil, fmt.Errorf("expected %s, got %v", ty.String(), value)
+		}
+		return types.NumberValue(f), nil
+	case *idl.OptionalType:
+		if value == nil {
+			return types.DynamicNull(), nil
+		}
+		var inner did.Data
+		if h, ok := hint.(did.Optional); ok {
+			inner = h.Data
+		}
+		return s.tfValue(t.Type, value, inner)
+	case *idl.VectorType:
+		if t.Type.String() == "nat8" {
+			return types.StringValue(hex.EncodeToString(candidBlob(value))), nil
+		}
+		values, _ := value.([]any)
+		var inner did.Data
+		if h, ok := hint.(did.Vector); ok {
+			inner = h.Data
+		}
+		elems := make([]attr.Value, len(values))
+		elemTypes := make([]attr.Type, len(values))
+		for i, v := range values {
+			var err error
+			elems[i], err = s.tfValue(t.Type, v, inner)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			elemTypes[i] = elems[i].Type(context.Background())
+		}
+		tuple, diags := types.TupleValue(elemTypes, elems)
+		if diags.HasError() {
+			return nil, fmt.Errorf("could not create tuple: %v", diags)
+		}
+		return tuple, nil
+	case *idl.RecordType:
+		// Empty records are decoded as nil
+		record, _ := value.(map[string]any)
+		var declared map[string]did.Field
+		if h, ok := hint.(did.Record); ok {
+			declared = didFieldsByHash(h)
+		}
+		attrs := make(map[string]attr.Value, len(t.Fields))
+		attrTypes := make(map[string]attr.Type, len(t.Fields))
+		for _, f := range t.Fields {
+			name, fieldHint := f.Name, did.Data(nil)
+			if field, ok := declared[f.Name]; ok {
+				name, _ = didFieldName(field)
+				fieldHint = didFieldData(field)
+			}
+			v, err := s.tfValue(f.Type, record[f.Name], fieldHint)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			attrs[name] = v
+			attrTypes[name] = v.Type(context.Background())
+		}
+		object, diags := types.ObjectValue(attrTypes, attrs)
+		if diags.HasError() {
+			return nil, fmt.Errorf("could not create object: %v", diags)
+		}
+		return object, nil
+	case *idl.VariantType:
+		variant, ok := value.(*idl.Variant)
+		if !ok {
+			return nil, fmt.Errorf("expected variant, got %T", value)
+		}
+		name, caseHint := variant.Name, did.Data(nil)
+		if h, ok := hint.(did.Variant); ok {
+			if field, ok := didFieldsByHash(h)[variant.Name]; ok {
+				name, _ = didFieldName(field)
+				caseHint = didFieldData(field)
+			}
+		}
+		if _, ok := variant.Type.(*idl.NullType); ok {
+			return types.StringValue(name), nil
+		}
+		v, err := s.tfValue(variant.Type, variant.Value, caseHint)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		object, diags := types.ObjectValue(map[string]attr.Type{name: v.Type(context.Background())}, map[string]attr.Value{name: v})
+		if diags.HasError() {
+			return nil, fmt.Errorf("could not create object: %v", diags)
+		}
+		return object, nil
+	default:
+		return nil, fmt.Errorf("type %s is not supported", ty.String())
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/hex"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/knownvalue"
+	"github.com/hashicorp/terraform-plugin-testing/statecheck"
+	"github.com/hashicorp/terraform-plugin-testing/tfversion"
+)
+
+// Checks that decoded records and variants are named after the type hint, and after the
+// hash of their names without one.
+func TestDecodeFunction(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	didFile := path.Join(dir, "service.did")
+	err := os.WriteFile(didFile, []byte(`type Result = variant { Ok : nat; Err : variant { NotFound; Other : text } };
+service : { get : (text) -> (Result) query }`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resultType := idl.NewVariantType(map[string]idl.Type{
+		"Ok":  new(idl.NatType),
+		"Err": idl.NewVariantType(map[string]idl.Type{"NotFound": new(idl.NullType), "Other": new(idl.TextType)}),
+	})
+	ok, err := idl.Encode([]idl.Type{resultType}, []any{idl.Variant{Name: "Ok", Value: idl.NewNat(uint(42))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notFound, err := idl.Encode([]idl.Type{resultType}, []any{idl.Variant{Name: "Err", Value: idl.Variant{Name: "NotFound"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		TerraformVersionChecks: []tfversion.TerraformVersionCheck{
+			// Provider functions are only supports in 1.8.0+
+			tfversion.SkipBelow(tfversion.Version1_8_0),
+		},
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::did_decode(provider::ic::did_encode({ owner = "alice", tags = ["a", "b"] }), "record { owner : text; tags : vec text }")
+                }`,
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownOutputValue("test", knownvalue.ObjectExact(map[string]knownvalue.Check{
+						"owner": knownvalue.StringExact("alice"),
+						"tags":  knownvalue.ListExact([]knownvalue.Check{knownvalue.StringExact("a"), knownvalue.StringExact("b")}),
+					})),
+				},
+			},
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::did_decode(provider::ic::did_encode({ owner = "alice" }))
+                }`,
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownOutputValue("test", knownvalue.ObjectExact(map[string]knownvalue.Check{
+						idl.HashString("owner"): knownvalue.StringExact("alice"),
+					})),
+				},
+			},
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::did_decode("` + hex.EncodeToString(ok) + `", "` + didFile + `:get")
+                }`,
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownOutputValue("test", knownvalue.ObjectExact(map[string]knownvalue.Check{
+						"Ok": knownvalue.NumberExact(big.NewFloat(42)),
+					})),
+				},
+			},
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::did_decode("` + hex.EncodeToString(notFound) + `", "` + didFile + `:Result")
+                }`,
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownOutputValue("test", knownvalue.ObjectExact(map[string]knownvalue.Check{
+						"Err": knownvalue.StringExact("NotFound"),
+					})),
+				},
+			},
+		},
+	})
+}
@@ -12,12 +12,14 @@ const argEncodeSummary = "Encode Terraform values into candid values."
 
 const argEncodeDescription = "The `did_encode` function transforms Terraform values into hex-encoded candid values. It takes a single argument and applies heuristics to generate a candid value.\n" +
 
-	"For primitive values (strings, etc) will be encoded as the equivalent candid type. HCL maps and objects will be encoded as records unless they contain the fields `__didType` or `__didValue`. When those fields are set, `__didValue` is the actual value to be encoded, and `__didType` must be a tag defining the type of the value. These fields however should be treated as implementation details and the various helpers (`did_text`, `did_record`) should be used instead.\n\n" +
+	"For primitive values (strings, etc) will be encoded as the equivalent candid type. HCL lists, tuples and sets will be encoded as vecs (set elements are sorted and deduplicated so that the encoding is deterministic). HCL maps and objects will be encoded as records unless they contain the fields `__didType` or `__didValue`. When those fields are set, `__didValue` is the actual value to be encoded, and `__didType` must be a tag defining the type of the value. These fields however should be treated as implementation details and the various helpers (`did_text`, `did_record`, `did_blob_file`) should be used instead.\n\n" +
 
 	"Here are some equivalences between HCL values and textual candid value:\n\n" +
 
 	"`" + `"hello"` + "` = `" + `("hello")` + "`" + "\n" +
-	"`" + `{ foo = "bar" }` + "` = `" + `(record { foo = "bar" })` + "`" + "\n"
+	"`" + `{ foo = "bar" }` + "` = `" + `(record { foo = "bar" })` + "`" + "\n" +
+	"`" + `toset(["b", "a"])` + "` = `" + `(vec { "a"; "b" })` + "`" + "\n" +
+	"`" + `did_blob_file("hello.txt")` + "` = `" + `(blob "hello")` + "` (if `hello.txt` contains `hello`)" + "\n"
 
 // Ensure the implementation satisfies the desired interfaces.
 var _ function.Function = &ArgEncodeFunction{}
@@ -30,6 +30,9 @@ func TestEncodeFunction_DidcEquivalence(t *testing.T) {
 			hcl:    `{ param1 = "val1", param2 = { param21 = "innerVal" } }`,
 			candid: `(record { param1 = "val1"; param2 = record { param21 = "innerVal" } })`,
 		},
+		{hcl: `tomap({ foo = "bar" })`, candid: `(record { foo = "bar" })`},
+		{hcl: `["b", "a"]`, candid: `(vec { "b"; "a" })`},
+		{hcl: `toset(["b", "a", "b"])`, candid: `(vec { "a"; "b" })`},
 	}
 
 	testSteps := make([]resource.TestStep, len(goldens))
@@ -0,0 +1,152 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/function"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+)
+
+const argMergeSummary = "Deep-merge two candid records"
+
+const argMergeDescription = "The `did_merge` function deep-merges two records (HCL objects, maps or `did_record` values) before they are candid-encoded. " +
+	"Fields of `override` replace fields of `base`; when a field is a record in both values, the records are merged recursively. " +
+	"This is useful to express environment-specific overlays on top of shared init arguments:\n\n" +
+	"`" + `did_merge({ mode = "prod", limits = { max = "10", min = "1" } }, { limits = { max = "100" } })` + "` = `" +
+	`{ mode = "prod", limits = { max = "100", min = "1" } }` + "`\n"
+
+// Ensure the implementation satisfies the desired interfaces.
+var _ function.Function = &ArgMergeFunction{}
+
+type ArgMergeFunction struct{}
+
+func (f *ArgMergeFunction) Metadata(ctx context.Context, req function.MetadataRequest, resp *function.MetadataResponse) {
+	resp.Name = "did_merge"
+}
+
+func (f *ArgMergeFunction) Definition(ctx context.Context, req function.DefinitionRequest, resp *function.DefinitionResponse) {
+
+	resp.Definition = function.Definition{
+		Summary:             argMergeSummary,
+		Description:         argMergeDescription,
+		MarkdownDescription: argMergeDescription,
+
+		Parameters: []function.Parameter{
+			function.DynamicParameter{
+				Name:        "base",
+				Description: "The record holding the default values",
+			},
+			function.DynamicParameter{
+				Name:        "override",
+				Description: "The record whose fields take precedence over those of base",
+			},
+		},
+		Return: function.DynamicReturn{},
+	}
+}
+
+func (f *ArgMergeFunction) Run(ctx context.Context, req function.RunRequest, resp *function.RunResponse) {
+	var base, override attr.Value
+
+	// Read Terraform argument data into the variables
+	resp.Error = function.ConcatFuncErrors(resp.Error, req.Arguments.Get(ctx, &base, &override))
+	if resp.Error != nil {
+		return
+	}
+
+	if _, ok := readRecordAttributes(base); !ok {
+		resp.Error = function.NewArgumentFuncError(0, "base is not a record")
+		return
+	}
+
+	if _, ok := readRecordAttributes(override); !ok {
+		resp.Error = function.NewArgumentFuncError(1, "override is not a record")
+		return
+	}
+
+	merged, err := mergeRecordValues(ctx, base, override)
+	if err != nil {
+		resp.Error = function.NewFuncError(err.Error())
+		return
+	}
+
+	resp.Error = function.ConcatFuncErrors(resp.Error, resp.Result.Set(ctx, types.DynamicValue(merged)))
+}
+
+// Deep-merges two values. If both values are records, then the fields are merged
+// recursively; otherwise the override is returned.
+func mergeRecordValues(ctx context.Context, base attr.Value, override attr.Value) (attr.Value, error) {
+	baseAttrs, baseOk := readRecordAttributes(base)
+	overrideAttrs, overrideOk := readRecordAttributes(override)
+
+	if !baseOk || !overrideOk {
+		return override, nil
+	}
+
+	attrs := make(map[string]attr.Value, len(baseAttrs)+len(overrideAttrs))
+	for k, v := range baseAttrs {
+		attrs[k] = v
+	}
+
+	for k, v := range overrideAttrs {
+		baseValue, ok := attrs[k]
+		if !ok {
+			attrs[k] = v
+			continue
+		}
+
+		merged, err := mergeRecordValues(ctx, baseValue, v)
+		if err != nil {
+			return nil, fmt.Errorf("could not merge field %s: %w", k, err)
+		}
+		attrs[k] = merged
+	}
+
+	attrTypes := make(map[string]attr.Type, len(attrs))
+	for k, v := range attrs {
+		attrTypes[k] = v.Type(ctx)
+	}
+
+	merged, diags := types.ObjectValue(attrTypes, attrs)
+	if diags.HasError() {
+		return nil, fmt.Errorf("could not create merged record: %v", diags)
+	}
+
+	return merged, nil
+}
+
+// Returns the fields of a record-like value (object, map or wrapped record). The boolean
+// is false if the value is not a record.
+func readRecordAttributes(val attr.Value) (map[string]attr.Value, bool) {
+	if val == nil || val.IsNull() || val.IsUnknown() {
+		return nil, false
+	}
+
+	switch v := val.(type) {
+	case basetypes.DynamicValue:
+		return readRecordAttributes(v.UnderlyingValue())
+	case basetypes.MapValue:
+		return v.Elements(), true
+	case basetypes.ObjectValue:
+		attrs := v.Attributes()
+
+		didType, isWrapped := attrs["__didType"]
+		if !isWrapped {
+			return attrs, true
+		}
+
+		// This is a wrapped value ({ __didType = ..., __didValue = ... }), only
+		// wrapped records are records
+		didTypeStr, ok := didType.(basetypes.StringValue)
+		if !ok || didTypeStr.ValueString() != "record" {
+			return nil, false
+		}
+
+		return readRecordAttributes(attrs["__didValue"])
+	default:
+		return nil, false
+	}
+}
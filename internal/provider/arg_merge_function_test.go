@@ -0,0 +1,71 @@
+package provider
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/aviate-labs/agent-go/candid"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/knownvalue"
+	"github.com/hashicorp/terraform-plugin-testing/statecheck"
+	"github.com/hashicorp/terraform-plugin-testing/tfversion"
+)
+
+// Checks that merged records encode to the expected candid values.
+func TestMergeFunction(t *testing.T) {
+	t.Parallel()
+
+	goldens := []struct {
+		base     string
+		override string
+		candid   string
+	}{
+		{base: `{ a = "x" }`, override: `{ b = "y" }`, candid: `(record { a = "x"; b = "y" })`},
+		{base: `{ a = "x" }`, override: `{ a = "y" }`, candid: `(record { a = "y" })`},
+		{
+			base:     `{ a = "x", b = { c = "y", d = "z" } }`,
+			override: `{ b = { d = "w" } }`,
+			candid:   `(record { a = "x"; b = record { c = "y"; d = "w" } })`,
+		},
+		{
+			base:     `provider::ic::did_record({ a = "x", b = "y" })`,
+			override: `tomap({ b = "z" })`,
+			candid:   `(record { a = "x"; b = "z" })`,
+		},
+	}
+
+	testSteps := make([]resource.TestStep, len(goldens))
+
+	for i := 0; i < len(goldens); i++ {
+
+		encoded, err := candid.EncodeValueString(goldens[i].candid)
+		if err != nil {
+			t.Fatalf("Could not encode candid: %s", err.Error())
+		}
+		didStr := hex.EncodeToString(encoded)
+		hcl := fmt.Sprintf(`
+                output "test" {
+                    value = provider::ic::did_encode(provider::ic::did_merge(%s, %s))
+                }`,
+			goldens[i].base,
+			goldens[i].override,
+		)
+
+		testSteps[i] = resource.TestStep{
+			Config: hcl,
+			ConfigStateChecks: []statecheck.StateCheck{
+				statecheck.ExpectKnownOutputValue("test", knownvalue.StringExact(didStr)),
+			},
+		}
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		TerraformVersionChecks: []tfversion.TerraformVersionCheck{
+			// Provider functions are only supports in 1.8.0+
+			tfversion.SkipBelow(tfversion.Version1_8_0),
+		},
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps:                    testSteps,
+	})
+}
@@ -0,0 +1,157 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// trackedCall is a call submitted to the IC whose outcome is not known yet, e.g. because
+// polling its status timed out. Submitting the same call again (e.g. when applying again)
+// polls the status of the tracked call instead, so that calls which did go through are not
+// executed twice (e.g. installing code or transferring tokens).
+//
+// Tracked calls are recorded in the user's cache directory (see trackedCallsDir), so that
+// subsequent runs find them. They are forgotten once their outcome is known, and expire
+// trackedCallRetention after their ingress expiry, when their outcome can't be known
+// anymore. Identical calls are serialized within the provider process (see
+// lockTrackedCall), but not across processes: concurrent runs with the same identity making
+// the same call may resume each other's call rather than both executing it.
+type trackedCall struct {
+	RequestId     string `json:"request_id"`     // hex-encoded
+	IngressExpiry int64  `json:"ingress_expiry"` // nanoseconds since the epoch
+}
+
+// How long tracked calls are kept after their ingress expiry. The IC only keeps the status
+// of requests for a few minutes after their expiry.
+const trackedCallRetention = time.Hour
+
+// Returns the fingerprint of the call: the same sender calling the same method with the
+// same argument.
+func callFingerprint(sender principal.Principal, effectiveCanisterId principal.Principal, canisterId principal.Principal, methodName string, arg []byte) string {
+	h := sha256.New()
+	for _, part := range [][]byte{sender.Raw, effectiveCanisterId.Raw, canisterId.Raw, []byte(methodName), arg} {
+		// Length-prefixed, so that the parts can't run into each other
+		h.Write([]byte{byte(len(part) >> 24), byte(len(part) >> 16), byte(len(part) >> 8), byte(len(part))})
+		h.Write(part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the directory of the tracked calls: terraform-provider-ic/calls in the user's
+// cache directory (e.g. $XDG_CACHE_HOME), or in the temporary directory without one.
+func trackedCallsDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "terraform-provider-ic", "calls")
+}
+
+func trackedCallFile(fingerprint string) string {
+	return filepath.Join(trackedCallsDir(), fingerprint+".json")
+}
+
+// Locks of the calls being made by the provider, by fingerprint.
+var trackedCallLocks sync.Map
+
+// Locks the calls with the fingerprint until the returned function is called, so that an
+// identical call is only made (or resumed) once the outcome of the previous one is known.
+func lockTrackedCall(fingerprint string) func() {
+	mu, _ := trackedCallLocks.LoadOrStore(fingerprint, new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// Returns the id of the tracked call with the fingerprint, if any. Expired calls are
+// forgotten.
+func resumeTrackedCall(fingerprint string) (_ agent.RequestID, ingressExpiry time.Time, ok bool) {
+	data, err := os.ReadFile(trackedCallFile(fingerprint))
+	if err != nil {
+		return agent.RequestID{}, time.Time{}, false
+	}
+
+	var call trackedCall
+	if json.Unmarshal(data, &call) != nil {
+		forgetTrackedCall(fingerprint)
+		return agent.RequestID{}, time.Time{}, false
+	}
+
+	raw, err := hex.DecodeString(call.RequestId)
+	var requestId agent.RequestID
+	if err != nil || len(raw) != len(requestId) {
+		forgetTrackedCall(fingerprint)
+		return agent.RequestID{}, time.Time{}, false
+	}
+	copy(requestId[:], raw)
+
+	ingressExpiry = time.Unix(0, call.IngressExpiry)
+	if time.Since(ingressExpiry) > trackedCallRetention {
+		forgetTrackedCall(fingerprint)
+		return agent.RequestID{}, time.Time{}, false
+	}
+
+	return requestId, ingressExpiry, true
+}
+
+// Records the submitted call until its outcome is known (see forgetTrackedCall), removing
+// the expired calls of previous runs. Failing to record it only means that it can't be
+// resumed.
+func trackCall(fingerprint string, requestId agent.RequestID, ingressExpiry time.Time) {
+	data, err := json.Marshal(trackedCall{RequestId: hex.EncodeToString(requestId[:]), IngressExpiry: ingressExpiry.UnixNano()})
+	if err != nil {
+		return
+	}
+
+	dir := trackedCallsDir()
+	if os.MkdirAll(dir, 0700) != nil {
+		return
+	}
+	pruneTrackedCalls(dir)
+
+	// Written to a temporary file first, so that the call is never read partially written
+	tmp, err := os.CreateTemp(dir, fingerprint+".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil || os.Rename(tmp.Name(), trackedCallFile(fingerprint)) != nil {
+		_ = os.Remove(tmp.Name())
+	}
+}
+
+func forgetTrackedCall(fingerprint string) {
+	_ = os.Remove(trackedCallFile(fingerprint))
+}
+
+// Removes the calls of the directory written before their retention, which were
+// necessarily expired: e.g. calls of runs that were interrupted and never applied again.
+func pruneTrackedCalls(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") && !strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) <= trackedCallRetention {
+			continue
+		}
+		_ = os.Remove(filepath.Join(dir, entry.Name()))
+	}
+}
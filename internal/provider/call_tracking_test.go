@@ -0,0 +1,151 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+func TestTrackCall(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	fingerprint := callFingerprint(principal.AnonymousID, principal.AnonymousID, principal.AnonymousID, "transfer", []byte{1})
+	if _, _, ok := resumeTrackedCall(fingerprint); ok {
+		t.Fatal("expected no tracked call")
+	}
+
+	requestId := agent.RequestID{1, 2, 3}
+	expiry := time.Now().Add(10 * time.Second)
+	trackCall(fingerprint, requestId, expiry)
+
+	resumedId, resumedExpiry, ok := resumeTrackedCall(fingerprint)
+	switch {
+	case !ok:
+		t.Fatal("expected the tracked call")
+	case resumedId != requestId:
+		t.Errorf("expected request 0x%x, got 0x%x", requestId[:], resumedId[:])
+	case !resumedExpiry.Equal(time.Unix(0, expiry.UnixNano())):
+		t.Errorf("expected ingress expiry %s, got %s", expiry, resumedExpiry)
+	}
+
+	// Other calls are not resumed
+	other := callFingerprint(principal.AnonymousID, principal.AnonymousID, principal.AnonymousID, "transfer", []byte{2})
+	if _, _, ok := resumeTrackedCall(other); ok {
+		t.Error("expected a call with another argument not to be resumed")
+	}
+
+	forgetTrackedCall(fingerprint)
+	if _, _, ok := resumeTrackedCall(fingerprint); ok {
+		t.Error("expected the forgotten call not to be resumed")
+	}
+}
+
+func TestTrackedCallExpiry(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	// Calls expired for longer than the retention are forgotten when resumed
+	expired := callFingerprint(principal.AnonymousID, principal.AnonymousID, principal.AnonymousID, "expired", nil)
+	trackCall(expired, agent.RequestID{1}, time.Now().Add(-trackedCallRetention-time.Minute))
+	if _, _, ok := resumeTrackedCall(expired); ok {
+		t.Error("expected the expired call not to be resumed")
+	}
+	if _, err := os.Stat(trackedCallFile(expired)); !os.IsNotExist(err) {
+		t.Errorf("expected the expired call to be removed, got %v", err)
+	}
+
+	// Calls recently expired are resumed, so that their status is checked
+	recent := callFingerprint(principal.AnonymousID, principal.AnonymousID, principal.AnonymousID, "recent", nil)
+	trackCall(recent, agent.RequestID{2}, time.Now().Add(-time.Minute))
+	if _, _, ok := resumeTrackedCall(recent); !ok {
+		t.Error("expected the recently expired call to be resumed")
+	}
+
+	// Files of calls that were never resumed (or partially written) are pruned when calls are
+	// tracked
+	stale := callFingerprint(principal.AnonymousID, principal.AnonymousID, principal.AnonymousID, "stale", nil)
+	trackCall(stale, agent.RequestID{3}, time.Now())
+	partial := filepath.Join(trackedCallsDir(), stale+".123.tmp")
+	if err := os.WriteFile(partial, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-trackedCallRetention - time.Minute)
+	for _, file := range []string{trackedCallFile(stale), partial} {
+		if err := os.Chtimes(file, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trackCall(expired, agent.RequestID{4}, time.Now())
+	for _, file := range []string{trackedCallFile(stale), partial} {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be pruned, got %v", filepath.Base(file), err)
+		}
+	}
+	if _, _, ok := resumeTrackedCall(recent); !ok {
+		t.Error("expected the recent call not to be pruned")
+	}
+}
+
+// Times a top-up of the mock out, checking that calling again resumes the call rather than
+// topping the canister up twice.
+func TestCallRawResumesTrackedCall(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	name := strings.ToLower(t.Name())
+	host, _ := url.Parse("mock://" + name)
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, nil))
+	backend, err := loadMockBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const canisterId = "ryjl3-tyaaa-aaaaa-aaaba-cai"
+	backend.mu.Lock()
+	backend.State.Canisters[canisterId] = &mockCanister{Controllers: []string{principal.AnonymousID.Encode()}, Status: "running", Cycles: 0}
+	backend.mu.Unlock()
+
+	config := agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		FetchRootKey: true,
+		PollDelay:    10 * time.Millisecond,
+		PollTimeout:  time.Nanosecond,
+	}
+	arg, err := idl.Marshal([]any{icMgmt.ProvisionalTopUpCanisterArgs{CanisterId: principal.MustDecode(canisterId), Amount: idl.NewNat(uint64(1000))}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = CallRawWithEffectiveId(config, principal.MustDecode(canisterId), ic.MANAGEMENT_CANISTER_PRINCIPAL, "provisional_top_up_canister", arg)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected the call to time out, got %v", err)
+	}
+	fingerprint := callFingerprint(principal.AnonymousID, principal.MustDecode(canisterId), ic.MANAGEMENT_CANISTER_PRINCIPAL, "provisional_top_up_canister", arg)
+	if _, _, ok := resumeTrackedCall(fingerprint); !ok {
+		t.Fatal("expected the call to be tracked")
+	}
+
+	config.PollTimeout = 10 * time.Second
+	if _, err := CallRawWithEffectiveId(config, principal.MustDecode(canisterId), ic.MANAGEMENT_CANISTER_PRINCIPAL, "provisional_top_up_canister", arg); err != nil {
+		t.Fatal(err)
+	}
+	backend.mu.Lock()
+	cycles := backend.State.Canisters[canisterId].Cycles
+	backend.mu.Unlock()
+	if cycles != 1000 {
+		t.Errorf("expected the canister to be topped up once, got %d cycles", cycles)
+	}
+	if _, _, ok := resumeTrackedCall(fingerprint); ok {
+		t.Error("expected the call to be forgotten once replied")
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid"
+	"github.com/aviate-labs/agent-go/candid/did"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &CanisterCallResource{}
+var _ resource.ResourceWithModifyPlan = &CanisterCallResource{}
+
+func NewCanisterCallResource() resource.Resource {
+	return &CanisterCallResource{}
+}
+
+// CanisterCallResource calls a canister method with arguments typed according to the
+// canister's .did file, e.g. to configure ledgers, indexes or registries.
+type CanisterCallResource struct {
+	config *agent.Config
+
+	readOnly readOnlyMode // read_only is set, or mainnet is not allowed
+}
+
+// CanisterCallResourceModel describes the resource data model.
+type CanisterCallResourceModel struct {
+	Id         types.String  `tfsdk:"id"`
+	CanisterId types.String  `tfsdk:"canister_id"`
+	CandidFile types.String  `tfsdk:"candid_file"`
+	Method     types.String  `tfsdk:"method"`
+	Args       types.Dynamic `tfsdk:"args"`
+	ArgHex     types.String  `tfsdk:"arg_hex"`
+	Reply      types.String  `tfsdk:"reply"`
+	ReplyHex   types.String  `tfsdk:"reply_hex"`
+}
+
+func (r *CanisterCallResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_canister_call"
+}
+
+func (r *CanisterCallResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Calls a canister method, e.g. a configuration method of a ledger, index or registry canister. " +
+			"The arguments are plain Terraform values that are converted to candid according to the method's signature in the canister's .did file, so that structured values can be used instead of candid blobs; type errors are reported when planning. " +
+			"The method is called again whenever `method` or the encoded arguments change. Destroying the resource only removes it from the state.",
+
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Identifier of the call (`<canister_id>:<method>`)",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"canister_id": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Canister to call",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"candid_file": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Path to the .did file describing the canister's interface. Imports and recursive types are not supported.",
+			},
+			"method": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Name of the method to call. Query methods are called as queries; oneway methods are not supported.",
+			},
+			"args": schema.DynamicAttribute{
+				Optional: true,
+				MarkdownDescription: "List of the method's arguments. Each argument is converted according to its candid type: " +
+					"numbers from Terraform numbers (or decimal strings for large values), `text` from strings, `principal` from textual principals, `blob` from hex strings, " +
+					"`opt` values from null (none) or the value itself, `vec` from lists, records from objects (fields that are not set must be `opt`) and variants from an object with a single attribute, the case, or from a string for cases without value. " +
+					"Record fields and variant cases must be named.",
+			},
+			"arg_hex": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Hex representation of the candid-encoded arguments",
+			},
+			"reply": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Reply of the method, in the candid textual representation. Record fields and variant cases are identified by the hash of their name.",
+			},
+			"reply_hex": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Hex representation of the candid-encoded reply of the method, e.g. to decode with `did_decode` using the candid file as type hint (`<candid_file>:<method>`), so that record fields and variant cases are named.",
+			},
+		},
+	}
+}
+
+func (r *CanisterCallResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	r.config = providerData.Config
+	r.readOnly = providerData.ReadOnly
+}
+
+// Returns the method and the encoded arguments, according to the candid file.
+func (data *CanisterCallResourceModel) EncodeArgs(ctx context.Context) (did.Func, string, error) {
+	service, err := readDidService(data.CandidFile.ValueString())
+	if err != nil {
+		return did.Func{}, "", err
+	}
+
+	method, err := service.Method(data.Method.ValueString())
+	if err != nil {
+		return did.Func{}, "", err
+	}
+
+	args, err := data.Args.ToTerraformValue(ctx)
+	if err != nil {
+		return did.Func{}, "", err
+	}
+
+	encoded, err := service.EncodeArgs(method, args)
+	if err != nil {
+		return did.Func{}, "", fmt.Errorf("Could not encode arguments of %s: %w", data.Method.ValueString(), err)
+	}
+
+	return method, hex.EncodeToString(encoded), nil
+}
+
+// Encodes the arguments when planning, so that type errors are reported before applying,
+// and plans a new call if the method or the arguments changed.
+func (r *CanisterCallResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	// Nothing to do on destroy
+	if req.Plan.Raw.IsNull() {
+		return
+	}
+
+	var data CanisterCallResourceModel
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	data.ArgHex = types.StringUnknown()
+	if !data.CandidFile.IsUnknown() && !data.Method.IsUnknown() && !data.Args.IsUnknown() && !data.Args.IsUnderlyingValueUnknown() {
+		args, err := data.Args.ToTerraformValue(ctx)
+		if err == nil && args.IsFullyKnown() {
+			_, argHex, err := data.EncodeArgs(ctx)
+			if err != nil {
+				resp.Diagnostics.AddAttributeError(path.Root("args"), "Invalid arguments", err.Error())
+				return
+			}
+			data.ArgHex = types.StringValue(argHex)
+		}
+	}
+
+	data.Reply = types.StringUnknown()
+	data.ReplyHex = types.StringUnknown()
+	if !req.State.Raw.IsNull() {
+		var state CanisterCallResourceModel
+		resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+
+		if data.Method.Equal(state.Method) && data.ArgHex.Equal(state.ArgHex) {
+			data.Reply = state.Reply
+			data.ReplyHex = state.ReplyHex
+		}
+	}
+
+	resp.Diagnostics.Append(resp.Plan.Set(ctx, &data)...)
+}
+
+// Calls the method and sets the arguments and reply.
+func (r *CanisterCallResource) call(ctx context.Context, data *CanisterCallResourceModel) error {
+	canisterId, err := principal.Decode(data.CanisterId.ValueString())
+	if err != nil {
+		return fmt.Errorf("Could not decode canister id: %w", err)
+	}
+
+	method, argHex, err := data.EncodeArgs(ctx)
+	if err != nil {
+		return err
+	}
+
+	arg, err := hex.DecodeString(argHex)
+	if err != nil {
+		return err
+	}
+
+	methodName := data.Method.ValueString()
+	tflog.Info(ctx, fmt.Sprintf("Calling %s on %s", methodName, canisterId.Encode()))
+
+	var raw []byte
+	switch {
+	case method.Annotation != nil && *method.Annotation == did.AnnOneWay:
+		return fmt.Errorf("%s is a oneway method, which is not supported", methodName)
+	case method.Annotation != nil && *method.Annotation == did.AnnQuery:
+		raw, err = QueryRaw(*r.config, canisterId, methodName, arg)
+	default:
+		raw, err = CallRaw(*r.config, canisterId, methodName, arg)
+	}
+	if err != nil {
+		return fmt.Errorf("Could not call %s: %w", methodName, err)
+	}
+
+	tys, values, err := idl.Decode(raw)
+	if err != nil {
+		return fmt.Errorf("Could not decode reply of %s: %w", methodName, err)
+	}
+
+	reply, err := candid.DecodeValuesString(tys, values)
+	if err != nil {
+		return fmt.Errorf("Could not decode reply of %s: %w", methodName, err)
+	}
+
+	data.Id = types.StringValue(canisterId.Encode() + ":" + methodName)
+	data.ArgHex = types.StringValue(argHex)
+	data.Reply = types.StringValue(reply)
+	data.ReplyHex = types.StringValue(hex.EncodeToString(raw))
+
+	return nil
+}
+
+func (r *CanisterCallResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data CanisterCallResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.readOnly != readWrite {
+		resp.Diagnostics.Append(r.readOnly.diagnostic("call " + data.Method.ValueString()))
+		return
+	}
+
+	err := r.call(ctx, &data)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("", err))
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *CanisterCallResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data CanisterCallResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Save updated data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Calls the method again if the method or the arguments changed (in which case the reply
+// is unknown in the plan).
+func (r *CanisterCallResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data CanisterCallResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if data.Reply.IsUnknown() {
+		if r.readOnly != readWrite {
+			resp.Diagnostics.Append(r.readOnly.diagnostic("call " + data.Method.ValueString()))
+			return
+		}
+
+		err := r.call(ctx, &data)
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("", err))
+			return
+		}
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Calls cannot be undone, so this only removes the resource from the state.
+func (r *CanisterCallResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	var data CanisterCallResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	tflog.Info(ctx, "Forgetting about call "+data.Id.ValueString())
+}
@@ -0,0 +1,90 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+)
+
+// Check that arguments are encoded according to the .did file, and that type errors are
+// reported when planning.
+func TestAccCanisterCallResource(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	candidFile := path.Join(GetRepoRoot(t), "test/testdata/canisters/hello_world/hello-world.did")
+
+	call := func(args string) string {
+		return fmt.Sprintf(`
+resource "ic_canister" "test" {
+            wasm_file = var.hello_world_wasm
+            wasm_sha256 = filesha256(var.hello_world_wasm)
+}
+
+resource "ic_canister_call" "test" {
+            canister_id = ic_canister.test.id
+            candid_file = "%s"
+            method = "hello"
+            args = %s
+}
+`, candidFile, args)
+	}
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config:          ProviderConfig + VariablesConfig + call(`["terraform"]`),
+				Check:           resource.TestCheckResourceAttr("ic_canister_call.test", "reply", `("Hello, terraform!")`),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config:          ProviderConfig + VariablesConfig + call(`[null]`),
+				Check:           resource.TestCheckResourceAttr("ic_canister_call.test", "reply", `("Hello, World!")`),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config:          ProviderConfig + VariablesConfig + call(`[42]`),
+				PlanOnly:        true,
+				ExpectError:     regexp.MustCompile("expected a string"),
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
+}
+
+// Check that rejects are reported with their reject code, error code, request id and
+// canister.
+func TestAccCanisterCallResourceReject(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	candidFile := path.Join(GetRepoRoot(t), "test/testdata/canisters/hello_world/hello-world.did")
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + fmt.Sprintf(`
+resource "ic_canister" "test" {}
+
+resource "ic_canister_call" "test" {
+            canister_id = ic_canister.test.id
+            candid_file = "%s"
+            method = "hello"
+            args = ["terraform"]
+}
+`, candidFile),
+				// The canister has no code
+				ExpectError: regexp.MustCompile(`(?s)Request Rejected.*IC0537.*Request ID: 0x[0-9a-f]{64}.*Method: hello`),
+			},
+		},
+	})
+}
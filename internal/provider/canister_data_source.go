@@ -0,0 +1,343 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &CanisterDataSource{}
+
+func NewCanisterDataSource() datasource.DataSource {
+	return &CanisterDataSource{}
+}
+
+// CanisterDataSource reads the state of a canister from the IC.
+type CanisterDataSource struct {
+	config         *agent.Config
+	certifiedReads bool
+}
+
+// CanisterDataSourceModel describes the data source data model.
+type CanisterDataSourceModel struct {
+	Id             types.String `tfsdk:"id"`
+	Controllers    types.List   `tfsdk:"controllers"`
+	ModuleHash     types.String `tfsdk:"module_hash"`
+	Labels         types.Map    `tfsdk:"labels"`
+	PublicMetadata types.Object `tfsdk:"public_metadata"`
+	ReadStrategy   types.String `tfsdk:"read_strategy"`
+
+	IncludeStatus  types.Bool   `tfsdk:"include_status"`
+	Cycles         types.Number `tfsdk:"cycles"`
+	ReservedCycles types.Number `tfsdk:"reserved_cycles"`
+	MemorySize     types.Number `tfsdk:"memory_size"`
+	MemoryMetrics  types.Object `tfsdk:"memory_metrics"`
+}
+
+// The memory_metrics of canister_status, in bytes.
+var canisterMemoryMetricsAttrTypes = map[string]attr.Type{
+	"wasm_memory_size":      types.NumberType,
+	"stable_memory_size":    types.NumberType,
+	"global_memory_size":    types.NumberType,
+	"wasm_binary_size":      types.NumberType,
+	"custom_sections_size":  types.NumberType,
+	"canister_history_size": types.NumberType,
+	"wasm_chunk_store_size": types.NumberType,
+	"snapshots_size":        types.NumberType,
+}
+
+func (d *CanisterDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_canister"
+}
+
+func (d *CanisterDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Reads the controllers, module hash, labels (see the `labels` of `ic_canister`) and public metadata of a canister from the IC, and optionally its status (see `include_status`), e.g. to drive capacity planning from outputs. " +
+			"The labels are private metadata, so they can only be read if the provider's principal controls the canister.",
+
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Canister identifier",
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"controllers": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Controllers of the canister",
+			},
+			"module_hash": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Sha256 sum of the installed Wasm module (hex encoded). Null if no code is installed.",
+			},
+			"labels": schema.MapAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Labels of the canister. Null if the canister has no labels or if they cannot be read.",
+			},
+			"public_metadata": schema.SingleNestedAttribute{
+				Computed:            true,
+				MarkdownDescription: "Public metadata of the canister (see the `public_metadata` of `ic_canister`), read from its `icp:public name`, `icp:public description` and `icp:public logo` metadata sections. Null if the canister has none of them; the attributes of the missing sections are null.",
+				Attributes: map[string]schema.Attribute{
+					"name": schema.StringAttribute{
+						Computed:            true,
+						MarkdownDescription: "Display name of the canister",
+					},
+					"description": schema.StringAttribute{
+						Computed:            true,
+						MarkdownDescription: "Description of the canister",
+					},
+					"logo": schema.StringAttribute{
+						Computed:            true,
+						MarkdownDescription: "Logo of the canister",
+					},
+				},
+			},
+			"read_strategy": readStrategyAttribute("How the controllers and module hash are read: `certified` reads them from certificates verified against the root key, `query` reads them without verifying the certificates (faster, e.g. for development loops, but only as trustworthy as the endpoint). Defaults to `certified`, unless the provider's `certified_reads` is `false`."),
+			"include_status": schema.BoolAttribute{
+				Optional:            true,
+				MarkdownDescription: "Whether the status of the canister (`cycles`, `reserved_cycles`, `memory_size` and `memory_metrics`) is read with the management canister's `canister_status`, which requires the provider's principal to control the canister. Defaults to `false`.",
+			},
+			"cycles": schema.NumberAttribute{
+				Computed:            true,
+				MarkdownDescription: "Cycles balance of the canister. Null unless `include_status` is set.",
+			},
+			"reserved_cycles": schema.NumberAttribute{
+				Computed:            true,
+				MarkdownDescription: "Cycles reserved by the canister for future storage payments. Null unless `include_status` is set.",
+			},
+			"memory_size": schema.NumberAttribute{
+				Computed:            true,
+				MarkdownDescription: "Total memory used by the canister, in bytes. Null unless `include_status` is set.",
+			},
+			"memory_metrics": schema.SingleNestedAttribute{
+				Computed:            true,
+				MarkdownDescription: "Breakdown of the memory used by the canister, in bytes. Null unless `include_status` is set, or if the replica doesn't report it.",
+				Attributes: map[string]schema.Attribute{
+					"wasm_memory_size": schema.NumberAttribute{
+						Computed:            true,
+						MarkdownDescription: "Size of the Wasm (heap) memory",
+					},
+					"stable_memory_size": schema.NumberAttribute{
+						Computed:            true,
+						MarkdownDescription: "Size of the stable memory",
+					},
+					"global_memory_size": schema.NumberAttribute{
+						Computed:            true,
+						MarkdownDescription: "Size of the Wasm globals",
+					},
+					"wasm_binary_size": schema.NumberAttribute{
+						Computed:            true,
+						MarkdownDescription: "Size of the installed Wasm module",
+					},
+					"custom_sections_size": schema.NumberAttribute{
+						Computed:            true,
+						MarkdownDescription: "Size of the custom sections (metadata) of the installed Wasm module",
+					},
+					"canister_history_size": schema.NumberAttribute{
+						Computed:            true,
+						MarkdownDescription: "Size of the canister history",
+					},
+					"wasm_chunk_store_size": schema.NumberAttribute{
+						Computed:            true,
+						MarkdownDescription: "Size of the chunk store (chunks uploaded to install large Wasm modules)",
+					},
+					"snapshots_size": schema.NumberAttribute{
+						Computed:            true,
+						MarkdownDescription: "Size of the canister snapshots",
+					},
+				},
+			},
+		},
+	}
+}
+
+func (d *CanisterDataSource) Configure(ctx context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.config = providerData.Config
+	d.certifiedReads = providerData.CertifiedReads
+}
+
+func (d *CanisterDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data CanisterDataSourceModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	canisterId, err := principal.Decode(data.Id.ValueString())
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode canister id", err))
+		return
+	}
+
+	certified, diags := certifiedReadStrategy(ctx, canisterId.Encode(), data.ReadStrategy, d.certifiedReads)
+	resp.Diagnostics.Append(diags...)
+
+	a, err := newAgent(*d.config)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not create agent", err))
+		return
+	}
+
+	controllers, err := readCanisterControllers(a, canisterId, certified)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not read controllers", err))
+		return
+	}
+
+	controllerIds := []string{}
+	for _, controller := range controllers {
+		controllerIds = append(controllerIds, controller.Encode())
+	}
+
+	controllersValue, diags := types.ListValueFrom(ctx, types.StringType, controllerIds)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	data.Controllers = controllersValue
+
+	// The module hash is absent if no code is installed
+	data.ModuleHash = types.StringNull()
+	moduleHash, err := readCanisterModuleHash(a, canisterId, certified)
+	if err == nil && len(moduleHash) > 0 {
+		data.ModuleHash = types.StringValue(hex.EncodeToString(moduleHash))
+	}
+
+	// The metadata may simply not exist (or not be readable), so errors are not fatal
+	data.Labels = types.MapNull(types.StringType)
+	labels, err := readCanisterLabels(*d.config, canisterId)
+	if err != nil {
+		tflog.Info(ctx, "Could not read labels metadata: "+err.Error())
+	} else if len(labels) > 0 {
+		labelsValue, diags := types.MapValueFrom(ctx, types.StringType, labels)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		data.Labels = labelsValue
+	}
+
+	data.PublicMetadata = types.ObjectNull(canisterPublicMetadataAttrTypes)
+	publicMetadata, err := readCanisterPublicMetadata(*d.config, canisterId)
+	if err != nil {
+		tflog.Info(ctx, "Could not read public metadata: "+err.Error())
+	} else {
+		data.PublicMetadata = publicMetadataValue(publicMetadata)
+	}
+
+	data.Cycles = types.NumberNull()
+	data.ReservedCycles = types.NumberNull()
+	data.MemorySize = types.NumberNull()
+	data.MemoryMetrics = types.ObjectNull(canisterMemoryMetricsAttrTypes)
+	if data.IncludeStatus.ValueBool() {
+		resp.Diagnostics.Append(data.readStatus(*d.config, canisterId)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Reads the cycles and memory of the canister with canister_status.
+//
+// The status is decoded generically rather than into icMgmt.CanisterStatusResult, which
+// lacks the fields added to canister_status after agent-go's release (e.g. memory_metrics).
+func (data *CanisterDataSourceModel) readStatus(config agent.Config, canisterId principal.Principal) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	arg, err := idl.Marshal([]any{icMgmt.CanisterStatusArgs{CanisterId: canisterId}})
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not encode canister_status argument", err))
+		return diags
+	}
+
+	raw, err := CallRawWithEffectiveId(config, canisterId, ic.MANAGEMENT_CANISTER_PRINCIPAL, "canister_status", arg)
+	if err != nil {
+		diags.Append(clientErrorDiagnostic(fmt.Sprintf("Could not read the status of %s (the provider's principal must control the canister)", canisterId.Encode()), err))
+		return diags
+	}
+
+	_, values, err := idl.Decode(raw)
+	if err != nil || len(values) == 0 {
+		diags.Append(clientErrorDiagnostic(fmt.Sprintf("Could not decode the status of %s", canisterId.Encode()), err))
+		return diags
+	}
+	status := values[0]
+
+	numberValue := func(value any) types.Number {
+		n := candidNat(value)
+		if n == nil {
+			return types.NumberNull()
+		}
+		return types.NumberValue(new(big.Float).SetInt(n))
+	}
+
+	data.Cycles = numberValue(candidField(status, "cycles"))
+	data.ReservedCycles = numberValue(candidField(status, "reserved_cycles"))
+	data.MemorySize = numberValue(candidField(status, "memory_size"))
+
+	if metrics := candidField(status, "memory_metrics"); metrics != nil {
+		attrs := map[string]attr.Value{}
+		for name := range canisterMemoryMetricsAttrTypes {
+			attrs[name] = numberValue(candidField(metrics, name))
+		}
+		var objectDiags diag.Diagnostics
+		data.MemoryMetrics, objectDiags = types.ObjectValue(canisterMemoryMetricsAttrTypes, attrs)
+		diags.Append(objectDiags...)
+	}
+
+	return diags
+}
+
+// Returns a generically decoded candid nat (nil if not a nat).
+func candidNat(value any) *big.Int {
+	switch n := value.(type) {
+	case idl.Nat:
+		return n.BigInt()
+	case uint64:
+		return new(big.Int).SetUint64(n)
+	case uint32:
+		return big.NewInt(int64(n))
+	default:
+		return nil
+	}
+}
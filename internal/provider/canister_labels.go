@@ -0,0 +1,76 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Name of the (private) metadata section holding the canister's labels, as a JSON object.
+// The section is injected into the Wasm module when the code is installed.
+const canisterLabelsMetadata = "terraform:labels"
+
+// Returns the labels to inject into the Wasm module, or nil if there are none.
+func (data *CanisterResourceModel) StringLabels(ctx context.Context) (map[string]string, diag.Diagnostics) {
+	if data.Labels.IsNull() || data.Labels.IsUnknown() {
+		return nil, nil
+	}
+
+	var labels map[string]string
+	diags := data.Labels.ElementsAs(ctx, &labels, false)
+	if len(labels) == 0 {
+		return nil, diags
+	}
+
+	return labels, diags
+}
+
+// Returns true if metadata (labels or public metadata) is injected into the Wasm module, which
+// then differs from wasm_file.
+func (data *CanisterResourceModel) InjectsMetadata() bool {
+	return !data.Labels.IsNull() || !data.PublicMetadata.IsNull()
+}
+
+// Returns the module with the labels injected as an icp:private custom section (or the
+// module as is if there are no labels).
+func wasmModuleWithLabels(module []byte, labels map[string]string) ([]byte, error) {
+	if len(labels) == 0 {
+		return module, nil
+	}
+
+	content, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	return wasmWithCustomSection(module, "icp:private "+canisterLabelsMetadata, content)
+}
+
+// Reads the labels of the canister from its metadata. The metadata is private, so only
+// controllers can read it.
+func readCanisterLabels(config agent.Config, canisterId principal.Principal) (map[string]string, error) {
+	a, err := newAgent(config)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := a.GetCanisterMetadata(canisterId, canisterLabelsMetadata)
+	if err != nil {
+		return nil, err
+	}
+
+	var labels map[string]string
+	err = json.Unmarshal(content, &labels)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s metadata: %w", canisterLabelsMetadata, err)
+	}
+
+	return labels, nil
+}
@@ -0,0 +1,164 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Values of the visibility of log_visibility, named after the cases of the setting:
+//
+//	type log_visibility = variant { controllers; public; allowed_viewers : vec principal };
+const (
+	logVisibilityControllers    = "controllers"
+	logVisibilityPublic         = "public"
+	logVisibilityAllowedViewers = "allowed_viewers"
+)
+
+var logVisibilityAttrTypes = map[string]attr.Type{
+	"visibility":      types.StringType,
+	"allowed_viewers": types.ListType{ElemType: types.StringType},
+}
+
+// NOTE: agent-go (v0.4.4) predates log_visibility, so the setting is encoded (and decoded)
+// generically.
+var logVisibilityType = idl.NewVariantType(map[string]idl.Type{
+	logVisibilityControllers:    new(idl.NullType),
+	logVisibilityPublic:         new(idl.NullType),
+	logVisibilityAllowedViewers: idl.NewVectorType(new(idl.PrincipalType)),
+})
+
+// Returns the visibility and allowed viewers of log_visibility, or ok = false if it is not
+// set (or unknown).
+func (data *CanisterResourceModel) StringLogVisibility(ctx context.Context) (visibility string, allowedViewers []string, ok bool, diags diag.Diagnostics) {
+	if data.LogVisibility.IsNull() || data.LogVisibility.IsUnknown() {
+		return "", nil, false, nil
+	}
+
+	var value struct {
+		Visibility     types.String `tfsdk:"visibility"`
+		AllowedViewers types.List   `tfsdk:"allowed_viewers"`
+	}
+	diags = data.LogVisibility.As(ctx, &value, basetypes.ObjectAsOptions{})
+	if diags.HasError() || value.Visibility.IsUnknown() || value.AllowedViewers.IsUnknown() {
+		return "", nil, false, diags
+	}
+	if !value.AllowedViewers.IsNull() {
+		diags.Append(value.AllowedViewers.ElementsAs(ctx, &allowedViewers, false)...)
+	}
+	return value.Visibility.ValueString(), allowedViewers, true, diags
+}
+
+// Checks that allowed_viewers is set exactly when the visibility is allowed_viewers.
+func (data *CanisterResourceModel) ValidateLogVisibility(ctx context.Context) diag.Diagnostics {
+	visibility, allowedViewers, ok, diags := data.StringLogVisibility(ctx)
+	if !ok || diags.HasError() {
+		return diags
+	}
+
+	attributePath := path.Root("log_visibility").AtName("allowed_viewers")
+	if visibility == logVisibilityAllowedViewers && allowedViewers == nil {
+		diags.AddAttributeError(attributePath, "Missing allowed viewers", "allowed_viewers must be set when the visibility is allowed_viewers.")
+	} else if visibility != logVisibilityAllowedViewers && allowedViewers != nil {
+		diags.AddAttributeError(attributePath, "Unexpected allowed viewers", fmt.Sprintf("allowed_viewers can only be set when the visibility is allowed_viewers, not %s.", visibility))
+	}
+	return diags
+}
+
+// Returns log_visibility as a raw setting (hex-encoded candid variant), unless it is not set
+// or unchanged from prior (unless nil).
+func (data *CanisterResourceModel) logVisibilityRawSettings(ctx context.Context, prior *CanisterResourceModel) (map[string]string, diag.Diagnostics) {
+	visibility, allowedViewers, ok, diags := data.StringLogVisibility(ctx)
+	if !ok || diags.HasError() {
+		return nil, diags
+	}
+	if prior != nil && data.LogVisibility.Equal(prior.LogVisibility) {
+		return nil, diags
+	}
+
+	variant := idl.Variant{Name: visibility, Value: nil}
+	if visibility == logVisibilityAllowedViewers {
+		viewers := make([]any, len(allowedViewers))
+		for i, viewer := range allowedViewers {
+			p, err := principal.Decode(viewer)
+			if err != nil {
+				diags.Append(clientErrorDiagnostic("Could not decode allowed viewer", err))
+				return nil, diags
+			}
+			viewers[i] = p
+		}
+		variant.Value = viewers
+	}
+
+	raw, err := idl.Encode([]idl.Type{logVisibilityType}, []any{variant})
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not encode log_visibility", err))
+		return nil, diags
+	}
+	return map[string]string{"log_visibility": hex.EncodeToString(raw)}, diags
+}
+
+// Updates log_visibility with the canister's actual one, given the decoded canister_status
+// result, unless it is not set (or the replica doesn't report it).
+func (data *CanisterResourceModel) refreshLogVisibility(ctx context.Context, status any) diag.Diagnostics {
+	_, configuredViewers, ok, diags := data.StringLogVisibility(ctx)
+	if !ok || diags.HasError() {
+		return diags
+	}
+
+	current, ok := candidField(candidField(status, "settings"), "log_visibility").(*idl.Variant)
+	if !ok {
+		return diags
+	}
+
+	var visibility string
+	for _, name := range []string{logVisibilityControllers, logVisibilityPublic, logVisibilityAllowedViewers} {
+		if current.Name == name || current.Name == idl.HashString(name) {
+			visibility = name
+		}
+	}
+	if visibility == "" {
+		return diags
+	}
+
+	allowedViewers := types.ListNull(types.StringType)
+	if visibility == logVisibilityAllowedViewers {
+		viewers := []string{}
+		values, _ := current.Value.([]any)
+		for _, value := range values {
+			if p, ok := value.(principal.Principal); ok {
+				viewers = append(viewers, p.Encode())
+			}
+		}
+		// The order of the viewers is not significant
+		if sameStrings(viewers, configuredViewers) {
+			viewers = configuredViewers
+		}
+		var d diag.Diagnostics
+		allowedViewers, d = types.ListValueFrom(ctx, types.StringType, viewers)
+		diags.Append(d...)
+	}
+
+	refreshed, d := types.ObjectValue(logVisibilityAttrTypes, map[string]attr.Value{
+		"visibility":      types.StringValue(visibility),
+		"allowed_viewers": allowedViewers,
+	})
+	diags.Append(d...)
+	if !diags.HasError() && !refreshed.Equal(data.LogVisibility) {
+		tflog.Info(ctx, fmt.Sprintf("Setting log_visibility changed to %s", visibility))
+		data.LogVisibility = refreshed
+	}
+	return diags
+}
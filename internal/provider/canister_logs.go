@@ -0,0 +1,112 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// How often logs are fetched while code is being installed
+const canisterLogsPollInterval = 2 * time.Second
+
+type fetchCanisterLogsArgs struct {
+	CanisterId principal.Principal `ic:"canister_id"`
+}
+
+type canisterLogRecord struct {
+	Idx            uint64 `ic:"idx"`
+	TimestampNanos uint64 `ic:"timestamp_nanos"`
+	Content        []byte `ic:"content"`
+}
+
+type fetchCanisterLogsResult struct {
+	CanisterLogRecords []canisterLogRecord `ic:"canister_log_records"`
+}
+
+// Fetches the logs of the canister. Only controllers can read the logs (unless the
+// canister's logs are public).
+// NOTE: agent-go (v0.4.4) does not implement fetch_canister_logs.
+func fetchCanisterLogs(config agent.Config, canisterId principal.Principal) ([]canisterLogRecord, error) {
+	arg, err := idl.Marshal([]any{fetchCanisterLogsArgs{CanisterId: canisterId}})
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := QueryRawWithEffectiveId(config, canisterId, ic.MANAGEMENT_CANISTER_PRINCIPAL, "fetch_canister_logs", arg)
+	if err != nil {
+		return nil, err
+	}
+
+	var result fetchCanisterLogsResult
+	err = idl.Unmarshal(raw, []any{&result})
+	if err != nil {
+		return nil, fmt.Errorf("could not decode logs: %w", err)
+	}
+
+	return result.CanisterLogRecords, nil
+}
+
+// Periodically mirrors the canister logs to tflog until the returned function is called.
+// The logs are fetched one last time when stopping, so that e.g. traps during init are
+// included.
+func streamCanisterLogs(ctx context.Context, config agent.Config, canisterId principal.Principal) func() {
+	var nextIdx uint64
+	var mu sync.Mutex
+
+	// Skip the logs that predate the install
+	records, err := fetchCanisterLogs(config, canisterId)
+	if err == nil && len(records) > 0 {
+		nextIdx = records[len(records)-1].Idx + 1
+	}
+
+	mirror := func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		records, err := fetchCanisterLogs(config, canisterId)
+		if err != nil {
+			tflog.Debug(ctx, fmt.Sprintf("Could not fetch logs of %s: %s", canisterId.Encode(), err.Error()))
+			return
+		}
+
+		for _, record := range records {
+			if record.Idx < nextIdx {
+				continue
+			}
+
+			timestamp := time.Unix(0, int64(record.TimestampNanos)).UTC().Format(time.RFC3339Nano)
+			tflog.Info(ctx, fmt.Sprintf("[%s] [%s] %s", canisterId.Encode(), timestamp, string(record.Content)))
+			nextIdx = record.Idx + 1
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(canisterLogsPollInterval):
+				mirror()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		mirror()
+	}
+}
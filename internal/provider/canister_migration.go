@@ -0,0 +1,610 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aviate-labs/agent-go/candid/idl"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// The private state key of a migration to another subnet that was interrupted (see
+// migrateCanister), which the next apply resumes rather than paying for another canister.
+const privateKeySubnetMigration = "subnet_migration"
+
+// Size of the chunks in which snapshots are copied between canisters, within the 2 MiB
+// limit of messages.
+const snapshotChunkSize = 1 << 20
+
+// A migration to another subnet that was interrupted.
+type subnetMigration struct {
+	SnapshotId string `json:"snapshot_id"`           // hex-encoded snapshot of the migrated canister
+	Running    bool   `json:"running"`               // whether the canister was running before the migration
+	CanisterId string `json:"canister_id,omitempty"` // canister created on the subnet, if any
+
+	// The claim of the canister paid for on the subnet, if it could not be claimed yet
+	Claim *PendingClaim `json:"claim,omitempty"`
+}
+
+// Arguments of the management canister's snapshot methods, see
+// https://internetcomputer.org/docs/references/ic-interface-spec#ic-take_canister_snapshot
+type takeSnapshotArgs struct {
+	CanisterId      principal.Principal `ic:"canister_id"`
+	ReplaceSnapshot *[]byte             `ic:"replace_snapshot,omitempty"`
+}
+
+type snapshotArgs struct {
+	CanisterId principal.Principal `ic:"canister_id"`
+	SnapshotId []byte              `ic:"snapshot_id"`
+}
+
+type loadSnapshotArgs struct {
+	CanisterId            principal.Principal `ic:"canister_id"`
+	SnapshotId            []byte              `ic:"snapshot_id"`
+	SenderCanisterVersion *uint64             `ic:"sender_canister_version,omitempty"`
+}
+
+type readSnapshotDataArgs struct {
+	CanisterId principal.Principal `ic:"canister_id"`
+	SnapshotId []byte              `ic:"snapshot_id"`
+	Kind       snapshotDataKind    `ic:"kind"`
+}
+
+type snapshotDataKind struct {
+	WasmModule   *snapshotDataRange `ic:"wasm_module,variant"`
+	MainMemory   *snapshotDataRange `ic:"main_memory,variant"`
+	StableMemory *snapshotDataRange `ic:"stable_memory,variant"`
+	WasmChunk    *snapshotChunkHash `ic:"wasm_chunk,variant"`
+}
+
+type snapshotDataRange struct {
+	Offset uint64 `ic:"offset"`
+	Size   uint64 `ic:"size"`
+}
+
+type snapshotChunkHash struct {
+	Hash []byte `ic:"hash"`
+}
+
+type uploadSnapshotDataArgs struct {
+	CanisterId principal.Principal    `ic:"canister_id"`
+	SnapshotId []byte                 `ic:"snapshot_id"`
+	Kind       snapshotUploadDataKind `ic:"kind"`
+	Chunk      []byte                 `ic:"chunk"`
+}
+
+type snapshotUploadDataKind struct {
+	WasmModule   *snapshotDataOffset `ic:"wasm_module,variant"`
+	MainMemory   *snapshotDataOffset `ic:"main_memory,variant"`
+	StableMemory *snapshotDataOffset `ic:"stable_memory,variant"`
+	WasmChunk    *idl.Null           `ic:"wasm_chunk,variant"`
+}
+
+type snapshotDataOffset struct {
+	Offset uint64 `ic:"offset"`
+}
+
+type uploadSnapshotMetadataArgs struct {
+	CanisterId                principal.Principal  `ic:"canister_id"`
+	ReplaceSnapshot           *[]byte              `ic:"replace_snapshot,omitempty"`
+	WasmModuleSize            uint64               `ic:"wasm_module_size"`
+	ExportedGlobals           []snapshotGlobal     `ic:"exported_globals"`
+	WasmMemorySize            uint64               `ic:"wasm_memory_size"`
+	StableMemorySize          uint64               `ic:"stable_memory_size"`
+	CertifiedData             []byte               `ic:"certified_data"`
+	GlobalTimer               *snapshotGlobalTimer `ic:"global_timer,omitempty"`
+	OnLowWasmMemoryHookStatus *snapshotHookStatus  `ic:"on_low_wasm_memory_hook_status,omitempty"`
+}
+
+type snapshotGlobal struct {
+	I32  *int32   `ic:"i32,variant"`
+	I64  *int64   `ic:"i64,variant"`
+	F32  *float32 `ic:"f32,variant"`
+	F64  *float64 `ic:"f64,variant"`
+	V128 *idl.Nat `ic:"v128,variant"`
+}
+
+type snapshotGlobalTimer struct {
+	Inactive *idl.Null `ic:"inactive,variant"`
+	Active   *uint64   `ic:"active,variant"`
+}
+
+type snapshotHookStatus struct {
+	ConditionNotSatisfied *idl.Null `ic:"condition_not_satisfied,variant"`
+	Ready                 *idl.Null `ic:"ready,variant"`
+	Executed              *idl.Null `ic:"executed,variant"`
+}
+
+// Plans a change of the subnet_id of an existing canister. Removing it (or leaving it unset)
+// only updates the state, as does setting it to the subnet the canister is on according to
+// the registry (e.g. after an import). Otherwise, the canister is planned to be migrated to
+// the subnet (see migrateCanister), which gives it a new id.
+func (r *CanisterResource) planSubnetChange(ctx context.Context, data *CanisterResourceModel, state *CanisterResourceModel, plan *tfsdk.Plan) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if data.SubnetId.IsNull() || data.SubnetId.IsUnknown() || state.SubnetId.Equal(data.SubnetId) {
+		return diags
+	}
+
+	canisterId, err := principal.Decode(state.Id.ValueString())
+	if err != nil {
+		return diags
+	}
+	subnetId, err := subnetForCanister(*r.config, canisterId)
+	if err != nil {
+		if state.SubnetId.IsNull() {
+			diags.AddAttributeWarning(path.Root("subnet_id"), "Could not check subnet",
+				fmt.Sprintf("Could not look up the subnet of canister %s, subnet_id is recorded as is: %s", canisterId.Encode(), err.Error()))
+			return diags
+		}
+		diags.AddAttributeError(path.Root("subnet_id"), "Could not check subnet",
+			fmt.Sprintf("Could not look up the subnet of canister %s to migrate it to subnet '%s': %s", canisterId.Encode(), data.SubnetId.ValueString(), err.Error()))
+		return diags
+	}
+	if subnetId.Encode() == data.SubnetId.ValueString() {
+		return diags
+	}
+
+	if r.proxy != nil && r.proxy.Orbit {
+		diags.AddAttributeError(path.Root("subnet_id"), "Subnet migration not supported",
+			fmt.Sprintf("Canister %s is on subnet '%s': canisters controlled by an Orbit station can't be migrated to other subnets by the provider, "+
+				"since every call of the migration would have to be approved.", canisterId.Encode(), subnetId.Encode()))
+		return diags
+	}
+	if !data.DeletionGuard.IsNull() {
+		diags.AddAttributeError(path.Root("subnet_id"), "Subnet migration not supported",
+			fmt.Sprintf("Canister %s is on subnet '%s': canisters with a deletion_guard can't be migrated to other subnets, since the migration deletes them. "+
+				"Remove deletion_guard first.", canisterId.Encode(), subnetId.Encode()))
+		return diags
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("Planning to migrate canister %s from subnet %s to subnet %s", canisterId.Encode(), subnetId.Encode(), data.SubnetId.ValueString()))
+	diags.AddAttributeWarning(path.Root("subnet_id"), "Canister migration",
+		fmt.Sprintf("Canister %s is on subnet '%s' and will be migrated to subnet '%s': it is stopped and snapshotted, "+
+			"and the snapshot is loaded into a new canister created on subnet '%s' (paid for like on creation, see initial_cycles), which gets a new id. "+
+			"The cycles of canister %s are then withdrawn to the new canister, and canister %s is deleted.",
+			canisterId.Encode(), subnetId.Encode(), data.SubnetId.ValueString(), data.SubnetId.ValueString(), canisterId.Encode(), canisterId.Encode()))
+
+	for name, value := range map[string]any{
+		"id":            types.StringUnknown(),
+		"created_at":    types.StringUnknown(),
+		"created_by":    types.StringUnknown(),
+		"output_values": types.MapUnknown(types.StringType),
+	} {
+		diags.Append(plan.SetAttribute(ctx, path.Root(name), value)...)
+	}
+	if !data.MinimumCycles.IsNull() {
+		diags.Append(plan.SetAttribute(ctx, path.Root("cycles_balance"), types.Int64Unknown())...)
+	}
+	return diags
+}
+
+// Migrates the canister to the subnet, returning the new canister: the canister is stopped
+// and snapshotted, and its snapshot is copied to a canister created on the subnet (see
+// copySnapshot) and loaded into it, which is started if the canister was running. The
+// cycles of the canister are then withdrawn to the new canister, and the canister is
+// deleted.
+//
+// The migration is recorded in the private state (see subnetMigration) as it goes, so
+// that if it fails the canister is started again, and the next apply resumes the migration
+// with the snapshot and the canister already created.
+func (r *CanisterResource) migrateCanister(ctx context.Context, data *CanisterResourceModel, canisterId principal.Principal, subnetId principal.Principal, private privateState) (principal.Principal, diag.Diagnostics) {
+	migration, diags := readSubnetMigration(ctx, private)
+	if diags.HasError() {
+		return principal.Principal{}, diags
+	}
+
+	agent, err := newManagementAgent(ctx, *r.config, r.proxy)
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not create agent", err))
+		return principal.Principal{}, diags
+	}
+
+	if migration == nil {
+		status, err := agent.CanisterStatusRaw(canisterId)
+		if err != nil {
+			diags.Append(clientErrorDiagnostic(fmt.Sprintf("Could not read the status of canister %s", canisterId.Encode()), err))
+			return principal.Principal{}, diags
+		}
+		running, _ := candidVariant(candidField(status, "status"), "running")
+		migration = &subnetMigration{Running: running == "running"}
+	} else {
+		tflog.Info(ctx, fmt.Sprintf("Resuming the migration of canister %s to subnet %s", canisterId.Encode(), subnetId.Encode()))
+	}
+
+	// The canister is restarted if the migration fails, so that it only stops for the time
+	// of the migration
+	failed := func(summary string, err error) (principal.Principal, diag.Diagnostics) {
+		if migration.Running {
+			if errStart := agent.StartCanister(icMgmt.StartCanisterArgs{CanisterId: canisterId}); errStart != nil {
+				diags.AddWarning("Canister not restarted", fmt.Sprintf("Canister %s could not be started again after its migration failed: %s", canisterId.Encode(), errStart.Error()))
+			}
+		}
+		diags.Append(clientErrorDiagnostic(summary, fmt.Errorf("%w. The migration of canister %s to subnet %s can be resumed by applying again", err, canisterId.Encode(), subnetId.Encode())))
+		return principal.Principal{}, diags
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("Stopping canister %s to migrate it to subnet %s", canisterId.Encode(), subnetId.Encode()))
+	err = agent.StopCanister(icMgmt.StopCanisterArgs{CanisterId: canisterId})
+	if err != nil {
+		return failed("Could not stop canister", err)
+	}
+
+	// The snapshot of an interrupted migration is replaced, since the canister may have run
+	// since it was taken
+	var replaceSnapshot *[]byte
+	if migration.SnapshotId != "" {
+		snapshotId, err := hex.DecodeString(migration.SnapshotId)
+		if err != nil {
+			return failed("Could not read migration from private state", err)
+		}
+		replaceSnapshot = &snapshotId
+	}
+	reply, err := agent.callManagement(canisterId, "take_canister_snapshot", takeSnapshotArgs{CanisterId: canisterId, ReplaceSnapshot: replaceSnapshot})
+	if err != nil {
+		return failed("Could not take snapshot", err)
+	}
+	snapshotId, err := decodeSnapshotId(reply)
+	if err != nil {
+		return failed("Could not take snapshot", err)
+	}
+	migration.SnapshotId = hex.EncodeToString(snapshotId)
+	diags.Append(writeSubnetMigration(ctx, private, migration)...)
+
+	var targetId principal.Principal
+	if migration.CanisterId != "" {
+		targetId, err = principal.Decode(migration.CanisterId)
+		if err != nil {
+			return failed("Could not read migration from private state", err)
+		}
+	} else {
+		if migration.Claim != nil {
+			targetId, err = notifyCreateCanister(ctx, *r.config, *migration.Claim)
+		} else {
+			targetId, err = r.createCanister(ctx, &subnetId, uint64(data.InitialCycles.ValueInt64()))
+		}
+		migration.Claim = nil
+
+		// As on creation, a canister that was paid for is claimed by the next apply
+		var pendingClaimErr *PendingClaimError
+		if errors.As(err, &pendingClaimErr) {
+			migration.Claim = &pendingClaimErr.Claim
+		}
+		var refundErr *CmcRefundError
+		if errors.As(err, &refundErr) {
+			diags.Append(r.appendCmcRefund(data, canisterId.Encode(), refundErr.Refund)...)
+		}
+		if err != nil {
+			diags.Append(writeSubnetMigration(ctx, private, migration)...)
+			return failed("Could not create canister on subnet "+subnetId.Encode(), err)
+		}
+		tflog.Info(ctx, fmt.Sprintf("Created canister %s to migrate canister %s to", targetId.Encode(), canisterId.Encode()))
+		migration.CanisterId = targetId.Encode()
+		diags.Append(writeSubnetMigration(ctx, private, migration)...)
+	}
+
+	// The snapshot is loaded into the stopped canister, which is left stopped if the
+	// canister was
+	err = agent.StopCanister(icMgmt.StopCanisterArgs{CanisterId: targetId})
+	if err != nil {
+		return failed("Could not stop canister "+targetId.Encode(), err)
+	}
+	err = copySnapshot(ctx, agent, canisterId, snapshotId, targetId)
+	if err != nil {
+		return failed(fmt.Sprintf("Could not copy the snapshot of canister %s to canister %s", canisterId.Encode(), targetId.Encode()), err)
+	}
+
+	if migration.Running {
+		err = agent.StartCanister(icMgmt.StartCanisterArgs{CanisterId: targetId})
+		if err != nil {
+			return failed("Could not start canister "+targetId.Encode(), err)
+		}
+	}
+
+	// From here on the new canister holds the canister's state, so failures are warnings
+	diags.Append(writeSubnetMigration(ctx, private, nil)...)
+	tflog.Info(ctx, fmt.Sprintf("Migrated canister %s to canister %s on subnet %s", canisterId.Encode(), targetId.Encode(), subnetId.Encode()))
+
+	// The cycles would be lost with the canister
+	err = withdrawCycles(ctx, *r.config, r.proxy, canisterId, targetId)
+	if err != nil {
+		diags.AddWarning("Canister not deleted",
+			fmt.Sprintf("Canister %s was migrated to canister %s, but its cycles could not be withdrawn to it, so it was left stopped rather than deleted: %s",
+				canisterId.Encode(), targetId.Encode(), err.Error()))
+		return targetId, diags
+	}
+	err = agent.DeleteCanister(icMgmt.DeleteCanisterArgs{CanisterId: canisterId})
+	if err != nil && !isCanisterNotFound(err) {
+		diags.AddWarning("Canister not deleted",
+			fmt.Sprintf("Canister %s was migrated to canister %s, but could not be deleted: %s", canisterId.Encode(), targetId.Encode(), err.Error()))
+	}
+	return targetId, diags
+}
+
+// Copies the snapshot of the canister to the target canister and loads it: its metadata
+// and data are read from the canister and uploaded to the target in chunks, as a snapshot
+// replacing the ones the target may have (e.g. from an interrupted copy).
+func copySnapshot(ctx context.Context, agent *managementAgent, canisterId principal.Principal, snapshotId []byte, targetId principal.Principal) error {
+	reply, err := agent.callManagement(canisterId, "read_canister_snapshot_metadata", snapshotArgs{CanisterId: canisterId, SnapshotId: snapshotId})
+	if err != nil {
+		return fmt.Errorf("could not read snapshot metadata: %w", err)
+	}
+	_, values, err := idl.Decode(reply)
+	if err != nil || len(values) == 0 {
+		return fmt.Errorf("could not decode snapshot metadata: %v", err)
+	}
+	metadata := values[0]
+
+	upload, err := snapshotMetadataUpload(targetId, metadata)
+	if err != nil {
+		return err
+	}
+
+	reply, err = agent.callManagement(targetId, "list_canister_snapshots", icMgmt.CanisterStatusArgs{CanisterId: targetId})
+	if err != nil {
+		return fmt.Errorf("could not list the snapshots of canister %s: %w", targetId.Encode(), err)
+	}
+	_, values, err = idl.Decode(reply)
+	if err != nil || len(values) == 0 {
+		return fmt.Errorf("could not decode the snapshots of canister %s: %v", targetId.Encode(), err)
+	}
+	snapshots, _ := values[0].([]any)
+	for _, snapshot := range snapshots {
+		if id := candidBlob(candidField(snapshot, "id")); id != nil {
+			upload.ReplaceSnapshot = &id
+		}
+	}
+
+	reply, err = agent.callManagement(targetId, "upload_canister_snapshot_metadata", upload)
+	if err != nil {
+		return fmt.Errorf("could not upload snapshot metadata: %w", err)
+	}
+	_, values, err = idl.Decode(reply)
+	if err != nil || len(values) == 0 {
+		return fmt.Errorf("could not decode the uploaded snapshot: %v", err)
+	}
+	targetSnapshotId := candidBlob(candidField(values[0], "snapshot_id"))
+	if targetSnapshotId == nil {
+		return fmt.Errorf("unexpected uploaded snapshot %v", values[0])
+	}
+
+	copyData := func(kind string, size uint64) error {
+		for offset := uint64(0); offset < size; offset += snapshotChunkSize {
+			dataRange := &snapshotDataRange{Offset: offset, Size: min(snapshotChunkSize, size-offset)}
+			read := readSnapshotDataArgs{CanisterId: canisterId, SnapshotId: snapshotId}
+			write := uploadSnapshotDataArgs{CanisterId: targetId, SnapshotId: targetSnapshotId}
+			switch kind {
+			case "wasm_module":
+				read.Kind.WasmModule, write.Kind.WasmModule = dataRange, &snapshotDataOffset{Offset: offset}
+			case "main_memory":
+				read.Kind.MainMemory, write.Kind.MainMemory = dataRange, &snapshotDataOffset{Offset: offset}
+			default:
+				read.Kind.StableMemory, write.Kind.StableMemory = dataRange, &snapshotDataOffset{Offset: offset}
+			}
+
+			chunk, err := readSnapshotChunk(agent, canisterId, read)
+			if err != nil {
+				return fmt.Errorf("could not read %s of snapshot at offset %d: %w", kind, offset, err)
+			}
+			write.Chunk = chunk
+			_, err = agent.callManagement(targetId, "upload_canister_snapshot_data", write)
+			if err != nil {
+				return fmt.Errorf("could not upload %s of snapshot at offset %d: %w", kind, offset, err)
+			}
+		}
+		return nil
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("Copying snapshot of canister %s to canister %s (module of %d bytes, %d bytes of memory, %d bytes of stable memory)",
+		canisterId.Encode(), targetId.Encode(), upload.WasmModuleSize, upload.WasmMemorySize, upload.StableMemorySize))
+	if err := copyData("wasm_module", upload.WasmModuleSize); err != nil {
+		return err
+	}
+	if err := copyData("main_memory", upload.WasmMemorySize); err != nil {
+		return err
+	}
+	if err := copyData("stable_memory", upload.StableMemorySize); err != nil {
+		return err
+	}
+
+	chunks, _ := candidField(metadata, "wasm_chunk_store").([]any)
+	for _, entry := range chunks {
+		hash := candidBlob(candidField(entry, "hash"))
+		read := readSnapshotDataArgs{CanisterId: canisterId, SnapshotId: snapshotId, Kind: snapshotDataKind{WasmChunk: &snapshotChunkHash{Hash: hash}}}
+		chunk, err := readSnapshotChunk(agent, canisterId, read)
+		if err != nil {
+			return fmt.Errorf("could not read chunk %x of snapshot: %w", hash, err)
+		}
+		_, err = agent.callManagement(targetId, "upload_canister_snapshot_data", uploadSnapshotDataArgs{
+			CanisterId: targetId, SnapshotId: targetSnapshotId, Kind: snapshotUploadDataKind{WasmChunk: new(idl.Null)}, Chunk: chunk,
+		})
+		if err != nil {
+			return fmt.Errorf("could not upload chunk %x of snapshot: %w", hash, err)
+		}
+	}
+
+	_, err = agent.callManagement(targetId, "load_canister_snapshot", loadSnapshotArgs{CanisterId: targetId, SnapshotId: targetSnapshotId})
+	if err != nil {
+		return fmt.Errorf("could not load snapshot: %w", err)
+	}
+
+	// The snapshot was only needed to restore the canister, and is charged for
+	_, err = agent.callManagement(targetId, "delete_canister_snapshot", snapshotArgs{CanisterId: targetId, SnapshotId: targetSnapshotId})
+	if err != nil {
+		tflog.Warn(ctx, fmt.Sprintf("Could not delete the snapshot %x loaded into canister %s: %s", targetSnapshotId, targetId.Encode(), err.Error()))
+	}
+	return nil
+}
+
+// Reads a chunk of snapshot data with read_canister_snapshot_data.
+func readSnapshotChunk(agent *managementAgent, canisterId principal.Principal, arg readSnapshotDataArgs) ([]byte, error) {
+	reply, err := agent.callManagement(canisterId, "read_canister_snapshot_data", arg)
+	if err != nil {
+		return nil, err
+	}
+	_, values, err := idl.Decode(reply)
+	if err != nil || len(values) == 0 {
+		return nil, fmt.Errorf("could not decode snapshot data: %v", err)
+	}
+	chunk := candidBlob(candidField(values[0], "chunk"))
+	if chunk == nil {
+		return nil, fmt.Errorf("unexpected snapshot data %v", values[0])
+	}
+	return chunk, nil
+}
+
+// Returns the argument of upload_canister_snapshot_metadata uploading the snapshot with the
+// metadata (the generically decoded result of read_canister_snapshot_metadata) to the
+// canister.
+func snapshotMetadataUpload(canisterId principal.Principal, metadata any) (*uploadSnapshotMetadataArgs, error) {
+	upload := &uploadSnapshotMetadataArgs{CanisterId: canisterId, ExportedGlobals: []snapshotGlobal{}}
+
+	for name, size := range map[string]*uint64{
+		"wasm_module_size":   &upload.WasmModuleSize,
+		"wasm_memory_size":   &upload.WasmMemorySize,
+		"stable_memory_size": &upload.StableMemorySize,
+	} {
+		n := candidNat(candidField(metadata, name))
+		if n == nil || !n.IsUint64() {
+			return nil, fmt.Errorf("unexpected %s in snapshot metadata %v", name, metadata)
+		}
+		*size = n.Uint64()
+	}
+
+	upload.CertifiedData = candidBlob(candidField(metadata, "certified_data"))
+	if upload.CertifiedData == nil {
+		upload.CertifiedData = []byte{}
+	}
+
+	globals, _ := candidField(metadata, "exported_globals").([]any)
+	for _, value := range globals {
+		var global snapshotGlobal
+		name, v := candidVariant(value, "i32", "i64", "f32", "f64", "v128")
+		switch v := v.(type) {
+		case int32:
+			global.I32 = &v
+		case int64:
+			global.I64 = &v
+		case float32:
+			global.F32 = &v
+		case float64:
+			global.F64 = &v
+		case idl.Nat:
+			global.V128 = &v
+		default:
+			return nil, fmt.Errorf("unexpected exported global %s %v in snapshot metadata", name, value)
+		}
+		upload.ExportedGlobals = append(upload.ExportedGlobals, global)
+	}
+
+	if timer := candidField(metadata, "global_timer"); timer != nil {
+		upload.GlobalTimer = &snapshotGlobalTimer{}
+		switch name, v := candidVariant(timer, "inactive", "active"); name {
+		case "inactive":
+			upload.GlobalTimer.Inactive = new(idl.Null)
+		case "active":
+			deadline, ok := v.(uint64)
+			if !ok {
+				return nil, fmt.Errorf("unexpected global timer %v in snapshot metadata", timer)
+			}
+			upload.GlobalTimer.Active = &deadline
+		default:
+			return nil, fmt.Errorf("unexpected global timer %v in snapshot metadata", timer)
+		}
+	}
+
+	if hookStatus := candidField(metadata, "on_low_wasm_memory_hook_status"); hookStatus != nil {
+		upload.OnLowWasmMemoryHookStatus = &snapshotHookStatus{}
+		switch name, _ := candidVariant(hookStatus, "condition_not_satisfied", "ready", "executed"); name {
+		case "condition_not_satisfied":
+			upload.OnLowWasmMemoryHookStatus.ConditionNotSatisfied = new(idl.Null)
+		case "ready":
+			upload.OnLowWasmMemoryHookStatus.Ready = new(idl.Null)
+		case "executed":
+			upload.OnLowWasmMemoryHookStatus.Executed = new(idl.Null)
+		default:
+			return nil, fmt.Errorf("unexpected low wasm memory hook status %v in snapshot metadata", hookStatus)
+		}
+	}
+
+	return upload, nil
+}
+
+// Returns the id of the snapshot taken with take_canister_snapshot, given its reply.
+func decodeSnapshotId(reply []byte) ([]byte, error) {
+	_, values, err := idl.Decode(reply)
+	if err != nil || len(values) == 0 {
+		return nil, fmt.Errorf("could not decode snapshot: %v", err)
+	}
+	id := candidBlob(candidField(values[0], "id"))
+	if id == nil {
+		return nil, fmt.Errorf("unexpected snapshot %v", values[0])
+	}
+	return id, nil
+}
+
+// Returns the name of a generically decoded candid variant, if it is one of names (the
+// empty string otherwise), and its value.
+func candidVariant(value any, names ...string) (string, any) {
+	variant, ok := value.(*idl.Variant)
+	if !ok {
+		return "", nil
+	}
+	for _, name := range names {
+		if variant.Name == name || variant.Name == idl.HashString(name) {
+			return name, variant.Value
+		}
+	}
+	return "", variant.Value
+}
+
+func readSubnetMigration(ctx context.Context, private privateState) (*subnetMigration, diag.Diagnostics) {
+	data, diags := private.GetKey(ctx, privateKeySubnetMigration)
+	if diags.HasError() || data == nil {
+		return nil, diags
+	}
+
+	var migration subnetMigration
+	err := json.Unmarshal(data, &migration)
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not read subnet migration from private state", err))
+		return nil, diags
+	}
+
+	return &migration, diags
+}
+
+// Writes the migration to the private state. A nil migration removes it.
+func writeSubnetMigration(ctx context.Context, private privateState, migration *subnetMigration) diag.Diagnostics {
+	if migration == nil {
+		return private.SetKey(ctx, privateKeySubnetMigration, nil)
+	}
+
+	data, err := json.Marshal(migration)
+	if err != nil {
+		var diags diag.Diagnostics
+		diags.Append(clientErrorDiagnostic("Could not write subnet migration to private state", err))
+		return diags
+	}
+
+	return private.SetKey(ctx, privateKeySubnetMigration, data)
+}
+
+// Sets the attributes of the canister the canister was migrated to (see migrateCanister).
+func (data *CanisterResourceModel) setMigratedCanister(canisterId principal.Principal, createdBy string) {
+	data.Id = types.StringValue(canisterId.Encode())
+	data.CreatedAt = types.StringValue(time.Now().UTC().Format(time.RFC3339))
+	data.CreatedBy = types.StringValue(createdBy)
+}
@@ -0,0 +1,273 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// testPrivateState is a private state in memory.
+type testPrivateState map[string][]byte
+
+func (s testPrivateState) GetKey(_ context.Context, key string) ([]byte, diag.Diagnostics) {
+	return s[key], nil
+}
+
+func (s testPrivateState) SetKey(_ context.Context, key string, value []byte) diag.Diagnostics {
+	if value == nil {
+		delete(s, key)
+	} else {
+		s[key] = value
+	}
+	return nil
+}
+
+// Migrates canisters of the mock, checking that their module and stable memory are moved to
+// the new canister, that failed migrations restart the canister, and that interrupted
+// migrations are resumed with the canister created for them.
+func TestMigrateCanister(t *testing.T) {
+	name := strings.ToLower(t.Name())
+	host, _ := url.Parse("mock://" + name)
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, nil))
+	backend, err := loadMockBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &CanisterResource{config: &agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		FetchRootKey: true,
+		PollDelay:    10 * time.Millisecond,
+	}}
+	ctx := context.Background()
+	subnetId := principal.MustDecode("pzp6e-ekpqk-3c5x7-2h6so-njoeq-mt45d-h3h6c-q3mxf-vpeq5-fk5o7-yae")
+
+	module := wasmModuleWithCustomSections("icp:public git_commit_id")
+	stableMemory := make([]byte, 2*snapshotChunkSize+100)
+	for i := range stableMemory {
+		stableMemory[i] = byte(i % 251)
+	}
+
+	// Adds a canister controlled by the provider to the mock. The cycles are below the
+	// margin of cycles withdrawals, which the mock can't execute.
+	addCanister := func(id string, status string) {
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+		backend.State.Canisters[id] = &mockCanister{
+			Controllers:  []string{principal.AnonymousID.Encode()},
+			Status:       status,
+			Module:       module,
+			ModuleHash:   []byte{1},
+			StableMemory: stableMemory,
+			Cycles:       50_000_000_000,
+		}
+	}
+	canister := func(id string) *mockCanister {
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+		return backend.State.Canisters[id]
+	}
+	nextCanister := func() uint64 {
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+		return backend.State.NextCanister
+	}
+	// Checks that the canister was migrated to the target, with the status
+	checkMigrated := func(t *testing.T, canisterId string, targetId principal.Principal, status string) {
+		t.Helper()
+		if canister(canisterId) != nil {
+			t.Errorf("expected canister %s to be deleted", canisterId)
+		}
+		target := canister(targetId.Encode())
+		switch {
+		case target == nil:
+			t.Fatalf("expected canister %s", targetId.Encode())
+		case target.Status != status:
+			t.Errorf("expected canister %s to be %s, got %s", targetId.Encode(), status, target.Status)
+		case !bytes.Equal(target.Module, module) || !bytes.Equal(target.StableMemory, stableMemory):
+			t.Errorf("expected the module and stable memory of canister %s to be migrated", targetId.Encode())
+		case len(target.Snapshots) > 0:
+			t.Errorf("expected the loaded snapshot to be deleted, got %d snapshots", len(target.Snapshots))
+		}
+	}
+	// Returns the id of a canister which the mock doesn't create
+	canisterIdAt := func(index uint64) string {
+		raw := binary.BigEndian.AppendUint64(nil, 1_000_000+index)
+		return principal.Principal{Raw: append(raw, 0x01, 0x01)}.Encode()
+	}
+	data := CanisterResourceModel{InitialCycles: types.Int64Value(50_000_000_000)}
+
+	t.Run("running", func(t *testing.T) {
+		canisterId := canisterIdAt(0)
+		addCanister(canisterId, "running")
+		private := testPrivateState{}
+
+		targetId, diags := r.migrateCanister(ctx, &data, principal.MustDecode(canisterId), subnetId, private)
+		if diags.HasError() || diags.WarningsCount() > 0 {
+			t.Fatal(diags)
+		}
+		checkMigrated(t, canisterId, targetId, "running")
+		if len(private) > 0 {
+			t.Errorf("expected the migration to be removed from the private state, got %v", private)
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		canisterId := canisterIdAt(1)
+		addCanister(canisterId, "stopped")
+
+		targetId, diags := r.migrateCanister(ctx, &data, principal.MustDecode(canisterId), subnetId, testPrivateState{})
+		if diags.HasError() {
+			t.Fatal(diags)
+		}
+		checkMigrated(t, canisterId, targetId, "stopped")
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		canisterId := canisterIdAt(2)
+		addCanister(canisterId, "running")
+		backend.mu.Lock()
+		backend.State.Canisters[canisterId].Snapshots = map[string]*mockSnapshot{}
+		for i := 0; i < mockMaxSnapshots; i++ {
+			backend.State.Canisters[canisterId].Snapshots[hex.EncodeToString([]byte{byte(i)})] = &mockSnapshot{}
+		}
+		backend.mu.Unlock()
+		created := nextCanister()
+
+		_, diags := r.migrateCanister(ctx, &data, principal.MustDecode(canisterId), subnetId, testPrivateState{})
+		if !diags.HasError() || !strings.Contains(diags.Errors()[0].Detail(), "maximum number of snapshots") {
+			t.Fatalf("expected the snapshot to fail, got %v", diags)
+		}
+		if source := canister(canisterId); source == nil || source.Status != "running" {
+			t.Fatalf("expected canister %s to be restarted, got %v", canisterId, source)
+		}
+		if nextCanister() != created {
+			t.Fatal("expected no canister to be created")
+		}
+	})
+
+	t.Run("resumed", func(t *testing.T) {
+		canisterId := canisterIdAt(3)
+		targetId := canisterIdAt(4)
+		addCanister(canisterId, "running")
+
+		// The target was created by the interrupted migration, which may have uploaded a
+		// snapshot to it
+		backend.mu.Lock()
+		backend.State.Canisters[targetId] = &mockCanister{
+			Controllers: []string{principal.AnonymousID.Encode()},
+			Status:      "running",
+			Snapshots:   map[string]*mockSnapshot{"00": {}},
+		}
+		backend.mu.Unlock()
+		private := testPrivateState{}
+		diags := writeSubnetMigration(ctx, private, &subnetMigration{Running: true, CanisterId: targetId})
+		if diags.HasError() {
+			t.Fatal(diags)
+		}
+		created := nextCanister()
+
+		migratedId, diags := r.migrateCanister(ctx, &data, principal.MustDecode(canisterId), subnetId, private)
+		if diags.HasError() {
+			t.Fatal(diags)
+		}
+		if migratedId.Encode() != targetId {
+			t.Fatalf("expected the migration to canister %s to be resumed, got %s", targetId, migratedId.Encode())
+		}
+		if nextCanister() != created {
+			t.Fatal("expected no canister to be created")
+		}
+		checkMigrated(t, canisterId, migratedId, "running")
+	})
+}
+
+func TestSnapshotMetadataUpload(t *testing.T) {
+	canisterId := principal.MustDecode("ryjl3-tyaaa-aaaaa-aaaba-cai")
+	i32, f64, deadline := int32(-7), 1.5, uint64(1_700_000_000)
+
+	// Encodes the metadata, which is then decoded generically (like the replies)
+	decoded := func(metadata any) any {
+		raw, err := idl.Marshal([]any{metadata})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, values, err := idl.Decode(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return values[0]
+	}
+
+	type metadata struct {
+		WasmModuleSize   uint64               `ic:"wasm_module_size"`
+		ExportedGlobals  []snapshotGlobal     `ic:"exported_globals"`
+		WasmMemorySize   uint64               `ic:"wasm_memory_size"`
+		StableMemorySize uint64               `ic:"stable_memory_size"`
+		WasmChunkStore   []snapshotChunkHash  `ic:"wasm_chunk_store"`
+		CertifiedData    []byte               `ic:"certified_data"`
+		GlobalTimer      *snapshotGlobalTimer `ic:"global_timer,omitempty"`
+		HookStatus       *snapshotHookStatus  `ic:"on_low_wasm_memory_hook_status,omitempty"`
+	}
+
+	upload, err := snapshotMetadataUpload(canisterId, decoded(metadata{
+		WasmModuleSize:   10,
+		ExportedGlobals:  []snapshotGlobal{{I32: &i32}, {F64: &f64}},
+		WasmMemorySize:   65536,
+		StableMemorySize: 3,
+		WasmChunkStore:   []snapshotChunkHash{},
+		CertifiedData:    []byte{1, 2},
+		GlobalTimer:      &snapshotGlobalTimer{Active: &deadline},
+		HookStatus:       &snapshotHookStatus{Ready: new(idl.Null)},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case upload.WasmModuleSize != 10 || upload.WasmMemorySize != 65536 || upload.StableMemorySize != 3:
+		t.Errorf("unexpected sizes %d, %d, %d", upload.WasmModuleSize, upload.WasmMemorySize, upload.StableMemorySize)
+	case len(upload.ExportedGlobals) != 2 || upload.ExportedGlobals[0].I32 == nil || *upload.ExportedGlobals[0].I32 != i32 ||
+		upload.ExportedGlobals[1].F64 == nil || *upload.ExportedGlobals[1].F64 != f64:
+		t.Errorf("unexpected exported globals %v", upload.ExportedGlobals)
+	case !bytes.Equal(upload.CertifiedData, []byte{1, 2}):
+		t.Errorf("unexpected certified data %x", upload.CertifiedData)
+	case upload.GlobalTimer == nil || upload.GlobalTimer.Active == nil || *upload.GlobalTimer.Active != deadline:
+		t.Errorf("unexpected global timer %v", upload.GlobalTimer)
+	case upload.OnLowWasmMemoryHookStatus == nil || upload.OnLowWasmMemoryHookStatus.Ready == nil:
+		t.Errorf("unexpected hook status %v", upload.OnLowWasmMemoryHookStatus)
+	}
+	// The argument can be encoded
+	if _, err := idl.Marshal([]any{upload}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the optional fields
+	upload, err = snapshotMetadataUpload(canisterId, decoded(metadata{ExportedGlobals: []snapshotGlobal{}, WasmChunkStore: []snapshotChunkHash{}, CertifiedData: []byte{}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload.GlobalTimer != nil || upload.OnLowWasmMemoryHookStatus != nil {
+		t.Errorf("expected no global timer and hook status, got %v and %v", upload.GlobalTimer, upload.OnLowWasmMemoryHookStatus)
+	}
+
+	// Without sizes
+	if _, err := snapshotMetadataUpload(canisterId, decoded(struct {
+		CertifiedData []byte `ic:"certified_data"`
+	}{[]byte{}})); err == nil {
+		t.Error("expected metadata without sizes to be rejected")
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// CanisterOutputsModel describes the query used to read values from the canister.
+type CanisterOutputsModel struct {
+	Method types.String `tfsdk:"method"`
+	Fields types.List   `tfsdk:"fields"`
+}
+
+// Reads the output values of the canister if outputs are declared and code is installed,
+// and sets them to null otherwise.
+func (r *CanisterResource) readOutputValues(ctx context.Context, data *CanisterResourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	data.OutputValues = types.MapNull(types.StringType)
+
+	if data.Outputs.IsNull() || data.Outputs.IsUnknown() || data.WasmFile.IsNull() {
+		return diags
+	}
+
+	var outputs CanisterOutputsModel
+	diags.Append(data.Outputs.As(ctx, &outputs, basetypes.ObjectAsOptions{})...)
+	if diags.HasError() {
+		return diags
+	}
+
+	var fields []string
+	diags.Append(outputs.Fields.ElementsAs(ctx, &fields, false)...)
+	if diags.HasError() {
+		return diags
+	}
+
+	canisterId, err := principal.Decode(data.Id.ValueString())
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not decode canister id", err))
+		return diags
+	}
+
+	values, err := QueryCanisterOutputs(ctx, *r.config, canisterId, outputs.Method.ValueString(), fields)
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not read outputs", err))
+		return diags
+	}
+
+	outputValues, d := types.MapValueFrom(ctx, types.StringType, values)
+	diags.Append(d...)
+	if diags.HasError() {
+		return diags
+	}
+
+	data.OutputValues = outputValues
+	return diags
+}
+
+// Updates the output values with the ones the canister currently returns, so that values
+// that changed outside of Terraform (e.g. keys rotated by the canister) are refreshed. The
+// values in the state are kept if they can't be read.
+func (r *CanisterResource) refreshOutputValues(ctx context.Context, data *CanisterResourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if data.Outputs.IsNull() || data.Outputs.IsUnknown() || data.WasmFile.IsNull() {
+		return diags
+	}
+
+	refreshed := *data
+	d := r.readOutputValues(ctx, &refreshed)
+	if d.HasError() {
+		for _, err := range d.Errors() {
+			diags.AddWarning("Could not refresh output values", fmt.Sprintf("Could not read the output values of canister %s, the values in the state are kept: %s", data.Id.ValueString(), err.Detail()))
+		}
+		return diags
+	}
+	diags.Append(d...)
+
+	data.OutputValues = refreshed.OutputValues
+	return diags
+}
+
+// Calls the (argument-less) query method and returns the requested fields of the record
+// it returns, converted to strings.
+func QueryCanisterOutputs(ctx context.Context, config agent.Config, canisterId principal.Principal, method string, fields []string) (map[string]string, error) {
+
+	tflog.Info(ctx, fmt.Sprintf("Querying outputs with %s on %s", method, canisterId.Encode()))
+
+	// We don't know the types in advance, so we read the raw reply and decode it
+	// ourselves
+	raw, err := QueryRaw(config, canisterId, method, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not query %s: %w", method, err)
+	}
+
+	tys, values, err := idl.Decode(raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode reply of %s: %w", method, err)
+	}
+
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%s returned no value", method)
+	}
+
+	recordType, ok := tys[0].(*idl.RecordType)
+	if !ok {
+		return nil, fmt.Errorf("expected %s to return a record, got %s", method, tys[0].String())
+	}
+
+	record, _ := values[0].(map[string]any)
+
+	outputs := make(map[string]string, len(fields))
+	for _, field := range fields {
+		// On the wire, record fields are identified by the hash of their name
+		hash := idl.HashString(field)
+
+		var fieldType idl.Type
+		for _, f := range recordType.Fields {
+			if f.Name == hash || f.Name == field {
+				fieldType = f.Type
+				break
+			}
+		}
+
+		if fieldType == nil {
+			return nil, fmt.Errorf("field %s not found in reply of %s (%s)", field, method, recordType.String())
+		}
+
+		value, ok := record[hash]
+		if !ok {
+			value = record[field]
+		}
+
+		str, err := candidValueToString(fieldType, value)
+		if err != nil {
+			return nil, fmt.Errorf("could not read field %s: %w", field, err)
+		}
+
+		outputs[field] = str
+	}
+
+	return outputs, nil
+}
+
+// Converts a decoded candid value to a string suitable for Terraform: texts are used as
+// is, principals are textually encoded, blobs are hex encoded and numbers are printed
+// in decimal. Other values use the textual candid representation.
+func candidValueToString(ty idl.Type, value any) (string, error) {
+	switch t := ty.(type) {
+	case *idl.TextType:
+		str, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("expected text, got %T", value)
+		}
+		return str, nil
+	case *idl.PrincipalType:
+		p, ok := value.(principal.Principal)
+		if !ok {
+			return "", fmt.Errorf("expected principal, got %T", value)
+		}
+		return p.Encode(), nil
+	case *idl.BoolType:
+		return fmt.Sprintf("%t", value), nil
+	case *idl.NatType, *idl.IntType:
+		switch v := value.(type) {
+		case idl.Nat:
+			return v.String(), nil
+		case idl.Int:
+			return v.String(), nil
+		case *big.Int:
+			return v.String(), nil
+		default:
+			return fmt.Sprintf("%d", v), nil
+		}
+	case *idl.OptionalType:
+		if value == nil {
+			return "", nil
+		}
+		return candidValueToString(t.Type, value)
+	case *idl.VectorType:
+		if _, isByte := t.Type.(*idl.NatType); isByte && t.Type.String() == "nat8" {
+			elems, ok := value.([]any)
+			if !ok {
+				return "", fmt.Errorf("expected blob, got %T", value)
+			}
+			blob := make([]byte, len(elems))
+			for i, e := range elems {
+				b, ok := e.(uint8)
+				if !ok {
+					return "", fmt.Errorf("expected byte, got %T", e)
+				}
+				blob[i] = b
+			}
+			return hex.EncodeToString(blob), nil
+		}
+	}
+
+	return candid.DecodeValuesString([]idl.Type{ty}, []any{value})
+}
@@ -0,0 +1,94 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Names of the public metadata sections describing the canister to wallets and
+// dashboards, e.g. `icp:public name`.
+var canisterPublicMetadataNames = []string{"name", "description", "logo"}
+
+var canisterPublicMetadataAttrTypes = map[string]attr.Type{
+	"name":        types.StringType,
+	"description": types.StringType,
+	"logo":        types.StringType,
+}
+
+// Returns the public metadata to inject into the Wasm module, by section name (without
+// the `icp:public` prefix), or nil if there is none.
+func (data *CanisterResourceModel) StringPublicMetadata() map[string]string {
+	if data.PublicMetadata.IsNull() || data.PublicMetadata.IsUnknown() {
+		return nil
+	}
+
+	metadata := map[string]string{}
+	for name, value := range data.PublicMetadata.Attributes() {
+		if s, ok := value.(types.String); ok && !s.IsNull() && !s.IsUnknown() {
+			metadata[name] = s.ValueString()
+		}
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+
+	return metadata
+}
+
+// Returns the module with the metadata injected as icp:public custom sections (or the
+// module as is if there is no metadata).
+func wasmModuleWithPublicMetadata(module []byte, metadata map[string]string) ([]byte, error) {
+	var err error
+	for _, name := range canisterPublicMetadataNames {
+		if value, ok := metadata[name]; ok {
+			module, err = wasmWithCustomSection(module, "icp:public "+name, []byte(value))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return module, nil
+}
+
+// Reads the public metadata sections of the canister, by name. Only the sections the
+// canister has are returned.
+func readCanisterPublicMetadata(config agent.Config, canisterId principal.Principal) (map[string]string, error) {
+	a, err := newAgent(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// The sections may simply not exist, so lookup errors are not fatal
+	metadata := map[string]string{}
+	for _, name := range canisterPublicMetadataNames {
+		content, err := a.GetCanisterMetadata(canisterId, name)
+		if err == nil {
+			metadata[name] = string(content)
+		}
+	}
+
+	return metadata, nil
+}
+
+// Returns the public_metadata attribute with the sections, whose attributes are null for
+// the sections that are missing, or null if there are no sections.
+func publicMetadataValue(metadata map[string]string) types.Object {
+	if len(metadata) == 0 {
+		return types.ObjectNull(canisterPublicMetadataAttrTypes)
+	}
+
+	values := map[string]attr.Value{}
+	for _, name := range canisterPublicMetadataNames {
+		values[name] = types.StringNull()
+		if value, ok := metadata[name]; ok {
+			values[name] = types.StringValue(value)
+		}
+	}
+
+	return types.ObjectValueMust(canisterPublicMetadataAttrTypes, values)
+}
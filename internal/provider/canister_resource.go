@@ -7,16 +7,31 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"os"
-
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/listvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/mapvalidator"
 	"github.com/hashicorp/terraform-plugin-framework-validators/resourcevalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
 	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/listplanmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
@@ -24,7 +39,6 @@ import (
 	"github.com/aviate-labs/agent-go"
 	"github.com/aviate-labs/agent-go/candid/idl"
 	"github.com/aviate-labs/agent-go/ic"
-	cmc "github.com/aviate-labs/agent-go/ic/cmc"
 	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
 	ledger "github.com/aviate-labs/agent-go/ic/icpledger"
 	"github.com/aviate-labs/agent-go/principal"
@@ -43,29 +57,204 @@ func NewCanisterResource() resource.Resource {
 
 // CanisterResource defines the resource implementation.
 type CanisterResource struct {
-	config *agent.Config
+	config       *agent.Config
+	applySummary *ApplySummary
+	cmcSettings  CmcSettings
+
+	maxInlineArgSize int64 // 0 means no limit
+
+	lock *AdvisoryLock // nil if locking is disabled
+
+	streamCanisterLogs bool
+
+	managementEffectiveCanisterId *principal.Principal // nil to let the agent decide
+
+	refreshMode string // one of the refreshMode* values
+
+	metrics *Metrics // nil if metrics_file is not set (operations are still logged)
+
+	preflight *Preflight // nil if preflight_checks is not set
+
+	rollout *Rollout // nil unless the upgrade_* rollout controls are set
+
+	policy CanisterPolicy // required_labels, forbidden_controllers
+
+	certifiedReads bool // whether canister info is read from verified certificates
+
+	proxy *managementProxy // nil unless wallet_canister_id or proxy_canister_id is set
+
+	proxyCreateCanisterCycles uint64
+
+	readOnly readOnlyMode // read_only is set, or mainnet is not allowed
+
+	registry *registryCache // registry values read by the provider instance
 }
 
+// Returns the principal managing canisters on behalf of Terraform: the cycles wallet or proxy
+// canister if wallet_canister_id or proxy_canister_id is set, and the identity's principal
+// otherwise.
 func (r *CanisterResource) ProviderPrincipal() string {
+	if r.proxy != nil {
+		return r.proxy.CanisterId.Encode()
+	}
 	return r.config.Identity.Sender().Encode()
 }
 
+// Returns the resource to manage the canister with: either r itself, or a copy of r using
+// the identity (identity_pem_file or identity_name), polling settings (call_timeout and
+// poll_interval) and funding subaccount of the canister instead of the provider's.
+func (r *CanisterResource) withOverrides(data *CanisterResourceModel) (*CanisterResource, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	var pem []byte
+	var err error
+	switch {
+	case !data.IdentityPemFile.IsNull() && !data.IdentityPemFile.IsUnknown():
+		pem, err = os.ReadFile(data.IdentityPemFile.ValueString())
+		if err != nil {
+			diags.AddAttributeError(path.Root("identity_pem_file"), "Could not read identity PEM file", err.Error())
+			return nil, diags
+		}
+	case !data.IdentityName.IsNull() && !data.IdentityName.IsUnknown():
+		pem, err = readDfxIdentityPem(data.IdentityName.ValueString(), "")
+		if err != nil {
+			diags.AddAttributeError(path.Root("identity_name"), "Could not read dfx identity", err.Error())
+			return nil, diags
+		}
+	}
+
+	pollingOverridden := !data.CallTimeout.IsNull() || !data.PollInterval.IsNull()
+	fundingOverridden := !data.FundingSubaccount.IsNull() && !data.FundingSubaccount.IsUnknown()
+	if pem == nil && !pollingOverridden && !fundingOverridden {
+		return r, diags
+	}
+
+	config := *r.config
+
+	if pem != nil {
+		config.Identity, err = NewIdentityFromPEM(pem)
+		if err != nil {
+			diags.AddError("Invalid identity", fmt.Sprintf("Could not read an Ed25519, secp256k1 or prime256v1 identity: %s", err.Error()))
+			return nil, diags
+		}
+	}
+
+	diags.Append(applyPollingSettings(&config, data.CallTimeout, data.PollInterval)...)
+	if diags.HasError() {
+		return nil, diags
+	}
+
+	resource := *r
+	resource.config = &config
+
+	if fundingOverridden {
+		// Checked by the validator
+		resource.cmcSettings.FundingSubaccount, _ = decodeSubaccount(data.FundingSubaccount.ValueString())
+	}
+
+	return &resource, diags
+}
+
 // CanisterResourceModel describes the resource data model.
 type CanisterResourceModel struct {
-	Id          types.String  `tfsdk:"id"`
-	Controllers types.List    `tfsdk:"controllers"`
-	Arg         types.Dynamic `tfsdk:"arg"`
-	ArgHex      types.String  `tfsdk:"arg_hex"`     // Hex-represented didc-encoded arguments
-	WasmFile    types.String  `tfsdk:"wasm_file"`   // path to Wasm module
-	WasmSha256  types.String  `tfsdk:"wasm_sha256"` // base64-encoded Wasm module
+	Id                  types.String  `tfsdk:"id"`
+	Controllers         types.List    `tfsdk:"controllers"`
+	Arg                 types.Dynamic `tfsdk:"arg"`
+	ArgHex              types.String  `tfsdk:"arg_hex"`               // Hex-represented didc-encoded arguments
+	ArgFile             types.String  `tfsdk:"arg_file"`              // path to didc-encoded arguments
+	ArgSha256           types.String  `tfsdk:"arg_sha256"`            // hex-encoded sha256 of the encoded arguments
+	WasmFile            types.String  `tfsdk:"wasm_file"`             // path to Wasm module
+	WasmSha256          types.String  `tfsdk:"wasm_sha256"`           // base64-encoded Wasm module
+	SubnetId            types.String  `tfsdk:"subnet_id"`             // subnet to create the canister on
+	InitialCycles       types.Int64   `tfsdk:"initial_cycles"`        // cycles the canister is created with
+	MinimumCycles       types.Int64   `tfsdk:"minimum_cycles"`        // balance below which the canister is topped up
+	TopUpTo             types.Int64   `tfsdk:"top_up_to"`             // balance the canister is topped up to
+	TopUpSource         types.String  `tfsdk:"top_up_source"`         // source of the top-up cycles
+	CyclesBalance       types.Int64   `tfsdk:"cycles_balance"`        // balance of the canister when last checked
+	CmcRefunds          types.List    `tfsdk:"cmc_refunds"`           // refunds issued by the CMC
+	Outputs             types.Object  `tfsdk:"outputs"`               // query to read output values with
+	OutputValues        types.Map     `tfsdk:"output_values"`         // values read with the outputs query
+	MinControllers      types.Int64   `tfsdk:"min_controllers"`       // minimum number of controllers
+	ThresholdKeyIds     types.List    `tfsdk:"threshold_key_ids"`     // threshold keys used by the canister
+	CyclesBeneficiary   types.String  `tfsdk:"cycles_beneficiary"`    // canister receiving the cycles on deletion
+	DeletionGuard       types.String  `tfsdk:"deletion_guard"`        // controller time-locking the deletion
+	CreatedAt           types.String  `tfsdk:"created_at"`            // RFC 3339 timestamp of the canister creation
+	CreatedBy           types.String  `tfsdk:"created_by"`            // principal that created the canister
+	ExpiresAt           types.String  `tfsdk:"expires_at"`            // RFC 3339 timestamp of the intended teardown
+	Labels              types.Map     `tfsdk:"labels"`                // labels injected as canister metadata
+	PublicMetadata      types.Object  `tfsdk:"public_metadata"`       // name, description and logo injected as public metadata
+	RawSettings         types.Map     `tfsdk:"raw_settings"`          // hex-encoded candid values of settings without attributes
+	Quotas              types.Map     `tfsdk:"quotas"`                // nat settings set where the network supports them
+	FreezingThreshold   types.Int64   `tfsdk:"freezing_threshold"`    // seconds of idle cycles consumption the canister keeps
+	ReservedCyclesLimit types.Int64   `tfsdk:"reserved_cycles_limit"` // cycles the canister may reserve for storage
+	WasmMemoryThreshold types.Int64   `tfsdk:"wasm_memory_threshold"` // remaining Wasm memory triggering the low-memory hook
+	LogVisibility       types.Object  `tfsdk:"log_visibility"`        // who can read the canister's logs
+	CandidFile          types.String  `tfsdk:"candid_file"`           // path to the expected candid interface
+	IdentityPemFile     types.String  `tfsdk:"identity_pem_file"`     // identity overriding the provider's
+	IdentityName        types.String  `tfsdk:"identity_name"`         // dfx identity overriding the provider's
+	CallTimeout         types.String  `tfsdk:"call_timeout"`          // overrides the provider's call_timeout
+	PollInterval        types.String  `tfsdk:"poll_interval"`         // overrides the provider's poll_interval
+	FundingSubaccount   types.String  `tfsdk:"funding_subaccount"`    // overrides the provider's funding_subaccount
+
+	RequireExplicitControllers types.Bool `tfsdk:"require_explicit_controllers"` // overrides the provider's require_explicit_controllers
+}
+
+var cmcRefundAttrTypes = map[string]attr.Type{
+	"transfer_block_index": types.Int64Type,
+	"refund_block_index":   types.Int64Type,
+	"refund_e8s":           types.Int64Type,
+	"reason":               types.StringType,
+}
+
+// Appends the refund to the resource's refunds.
+func (data *CanisterResourceModel) AppendCmcRefund(refund CmcRefund) diag.Diagnostics {
+	refundBlockIndex := types.Int64Null()
+	if refund.RefundBlockIndex != nil {
+		refundBlockIndex = types.Int64Value(int64(*refund.RefundBlockIndex))
+	}
+
+	refundValue, diags := types.ObjectValue(cmcRefundAttrTypes, map[string]attr.Value{
+		"transfer_block_index": types.Int64Value(int64(refund.TransferBlockIndex)),
+		"refund_block_index":   refundBlockIndex,
+		"refund_e8s":           types.Int64Value(int64(refund.RefundE8s)),
+		"reason":               types.StringValue(refund.Reason),
+	})
+	if diags.HasError() {
+		return diags
+	}
+
+	refunds := []attr.Value{}
+	if !data.CmcRefunds.IsNull() && !data.CmcRefunds.IsUnknown() {
+		refunds = append(refunds, data.CmcRefunds.Elements()...)
+	}
+	refunds = append(refunds, refundValue)
+
+	data.CmcRefunds, diags = types.ListValue(types.ObjectType{AttrTypes: cmcRefundAttrTypes}, refunds)
+	return diags
+}
+
+// Ensures the refunds are known (they are only unknown before the first apply).
+func (data *CanisterResourceModel) InferCmcRefunds() {
+	if data.CmcRefunds.IsUnknown() || data.CmcRefunds.IsNull() {
+		data.CmcRefunds = types.ListValueMust(types.ObjectType{AttrTypes: cmcRefundAttrTypes}, []attr.Value{})
+	}
 }
 
 func (r CanisterResource) ConfigValidators(ctx context.Context) []resource.ConfigValidator {
 	return []resource.ConfigValidator{
-		// arg & arg_hex cannot be both set.
+		// arg, arg_hex & arg_file cannot be set together.
 		resourcevalidator.Conflicting(
 			path.MatchRoot("arg"),
 			path.MatchRoot("arg_hex"),
+			path.MatchRoot("arg_file"),
+		),
+		resourcevalidator.Conflicting(
+			path.MatchRoot("identity_pem_file"),
+			path.MatchRoot("identity_name"),
+		),
+		resourcevalidator.RequiredTogether(
+			path.MatchRoot("minimum_cycles"),
+			path.MatchRoot("top_up_to"),
 		),
 	}
 }
@@ -86,14 +275,46 @@ func (r CanisterResource) ValidateConfig(ctx context.Context, req resource.Valid
 				"The resource may return unexpected results.",
 		)
 	}
+
+	rawSettings, diags := data.StringRawSettings(ctx)
+	resp.Diagnostics.Append(diags...)
+	for name, value := range rawSettings {
+		if slices.Contains(firstClassCanisterSettings, name) {
+			resp.Diagnostics.AddAttributeError(path.Root("raw_settings").AtMapKey(name), "Invalid raw setting",
+				fmt.Sprintf("%s has a dedicated attribute, set it with %s instead.", name, name))
+			continue
+		}
+		if _, err := parseRawSetting(name, value); err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("raw_settings").AtMapKey(name), "Invalid raw setting", err.Error())
+		}
+	}
+
+	resp.Diagnostics.Append(data.ValidateLogVisibility(ctx)...)
+
+	if !data.MinimumCycles.IsNull() && !data.MinimumCycles.IsUnknown() && !data.TopUpTo.IsNull() && !data.TopUpTo.IsUnknown() &&
+		data.TopUpTo.ValueInt64() <= data.MinimumCycles.ValueInt64() {
+		resp.Diagnostics.AddAttributeError(path.Root("top_up_to"), "Invalid top-up target",
+			fmt.Sprintf("top_up_to (%d) must be greater than minimum_cycles (%d).", data.TopUpTo.ValueInt64(), data.MinimumCycles.ValueInt64()))
+	}
+
+	quotas, diags := data.Int64Quotas(ctx)
+	resp.Diagnostics.Append(diags...)
+	for name := range quotas {
+		if slices.Contains(firstClassCanisterSettings, name) {
+			resp.Diagnostics.AddAttributeError(path.Root("quotas").AtMapKey(name), "Invalid quota",
+				fmt.Sprintf("%s has a dedicated attribute, set it with %s instead.", name, name))
+		} else if _, ok := rawSettings[name]; ok {
+			resp.Diagnostics.AddAttributeError(path.Root("quotas").AtMapKey(name), "Invalid quota",
+				fmt.Sprintf("%s is also set in raw_settings.", name))
+		}
+	}
 }
 
 // If the Controllers are Unknown or Null, update them (default) to the currently configured provider
 // principal. After this function has been called, the controllers are not null or unknown.
-func (data *CanisterResourceModel) InferDefaultControllers(ctx context.Context, config *agent.Config) error {
+func (data *CanisterResourceModel) InferDefaultControllers(ctx context.Context, providerController string) error {
 
 	tflog.Info(ctx, "Inferring controllers")
-	providerController := config.Identity.Sender().Encode()
 
 	if data.Controllers.IsNull() {
 		elements := []attr.Value{types.StringValue(providerController)}
@@ -148,6 +369,210 @@ func (data *CanisterResourceModel) StringControllers(ctx context.Context, config
 	return controllers, nil
 }
 
+// Checks that the threshold keys used by the canister are enabled on the canister's
+// subnet (or on any subnet, if the subnet is not known yet). If the registry cannot be
+// read (e.g. on local replicas without NNS), only a warning is issued.
+func (r *CanisterResource) checkThresholdKeys(ctx context.Context, data *CanisterResourceModel, state *CanisterResourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if data.ThresholdKeyIds.IsNull() || data.ThresholdKeyIds.IsUnknown() {
+		return diags
+	}
+
+	var keyIds []types.String
+	diags.Append(data.ThresholdKeyIds.ElementsAs(ctx, &keyIds, false)...)
+	if diags.HasError() {
+		return diags
+	}
+
+	// Figure out which subnet the canister is (or will be) on, if possible
+	var subnetId *principal.Principal
+	if !data.SubnetId.IsNull() && !data.SubnetId.IsUnknown() {
+		subnet, err := principal.Decode(data.SubnetId.ValueString())
+		if err != nil {
+			diags.AddAttributeError(path.Root("subnet_id"), "Invalid subnet", err.Error())
+			return diags
+		}
+		subnetId = &subnet
+	} else if state != nil && !state.Id.IsNull() {
+		canisterId, err := principal.Decode(state.Id.ValueString())
+		if err == nil {
+			subnet, err := r.registry.subnetForCanister(*r.config, canisterId)
+			if err != nil {
+				diags.AddWarning("Client Warning", "Could not look up the subnet of the canister: "+err.Error())
+			} else {
+				subnetId = &subnet
+			}
+		}
+	}
+
+	for _, keyId := range keyIds {
+		if keyId.IsUnknown() {
+			continue
+		}
+
+		subnets, err := r.registry.chainKeyEnabledSubnets(*r.config, keyId.ValueString())
+		if err != nil {
+			diags.AddWarning("Client Warning", fmt.Sprintf("Could not check threshold key %s: %s", keyId.ValueString(), err.Error()))
+			continue
+		}
+
+		if len(subnets) == 0 {
+			diags.AddAttributeError(path.Root("threshold_key_ids"), "Threshold key not available",
+				fmt.Sprintf("The threshold key %s is not enabled on any subnet", keyId.ValueString()))
+			continue
+		}
+
+		if subnetId != nil && !slices.ContainsFunc(subnets, subnetId.Equal) {
+			diags.AddAttributeError(path.Root("threshold_key_ids"), "Threshold key not available",
+				fmt.Sprintf("The threshold key %s is not enabled on subnet %s", keyId.ValueString(), subnetId.Encode()))
+		}
+	}
+
+	return diags
+}
+
+// Plans wasm_sha256 as the hash of the content of wasm_file when it is not set, so that
+// whether the code is installed again depends on the module rather than on its path (e.g.
+// renaming a file with the same content does not upgrade the canister). The hash is left
+// unknown (i.e. read back after installing) if the file cannot be read yet, e.g. because
+// it is built during the apply, or if metadata is injected, since the installed module
+// then differs from wasm_file.
+func (data *CanisterResourceModel) planWasmSha256(ctx context.Context, config tfsdk.Config, plan *tfsdk.Plan) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if !data.WasmSha256.IsUnknown() || data.WasmFile.IsNull() || data.WasmFile.IsUnknown() || data.InjectsMetadata() {
+		return diags
+	}
+
+	var configWasmSha256 types.String
+	diags.Append(config.GetAttribute(ctx, path.Root("wasm_sha256"), &configWasmSha256)...)
+	if diags.HasError() || !configWasmSha256.IsNull() {
+		return diags
+	}
+
+	module, err := os.ReadFile(data.WasmFile.ValueString())
+	if err != nil {
+		tflog.Info(ctx, fmt.Sprintf("Could not read %s, the module hash is read back after installing it: %s", data.WasmFile.ValueString(), err.Error()))
+		return diags
+	}
+
+	moduleSha256 := sha256.Sum256(module)
+	data.WasmSha256 = types.StringValue(hex.EncodeToString(moduleSha256[:]))
+	diags.Append(plan.SetAttribute(ctx, path.Root("wasm_sha256"), data.WasmSha256)...)
+
+	return diags
+}
+
+// Plans arg and arg_hex as configured, unless they are equivalent to the arguments in the
+// state (see ArgsEquivalent), e.g. after switching from arg_hex to arg or after importing a
+// canister, in which case the state's values are planned so that the plan shows no change.
+// arg and arg_hex are only computed for this reason: the framework would otherwise plan
+// them as unknown when they are not set.
+func (data *CanisterResourceModel) planArg(ctx context.Context, config tfsdk.Config, state *CanisterResourceModel, plan *tfsdk.Plan) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	diags.Append(config.GetAttribute(ctx, path.Root("arg"), &data.Arg)...)
+	diags.Append(config.GetAttribute(ctx, path.Root("arg_hex"), &data.ArgHex)...)
+	if diags.HasError() {
+		return diags
+	}
+
+	if state != nil && data.ArgFile.IsNull() && state.ArgFile.IsNull() && data.ArgIsKnown(ctx) {
+		argHex, err := data.GetArgHex(ctx)
+		if err == nil && (!state.Arg.IsNull() || !state.ArgHex.IsNull()) {
+			stateArgHex, err := state.GetArgHex(ctx)
+			if err == nil && ArgsEquivalent(argHex, stateArgHex) {
+				data.Arg = state.Arg
+				data.ArgHex = state.ArgHex
+			}
+		}
+	}
+
+	diags.Append(plan.SetAttribute(ctx, path.Root("arg"), data.Arg)...)
+	diags.Append(plan.SetAttribute(ctx, path.Root("arg_hex"), data.ArgHex)...)
+	return diags
+}
+
+// Checks that the candid interface embedded in the Wasm module (candid:service metadata)
+// matches candid_file, if both are set. Modules without candid:service metadata cannot be
+// checked, in which case only a warning is issued.
+func (data *CanisterResourceModel) checkCandidInterface() diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if data.CandidFile.IsNull() || data.CandidFile.IsUnknown() || data.WasmFile.IsNull() || data.WasmFile.IsUnknown() {
+		return diags
+	}
+
+	expected, err := os.ReadFile(data.CandidFile.ValueString())
+	if err != nil {
+		diags.AddAttributeError(path.Root("candid_file"), "Could not read candid file", err.Error())
+		return diags
+	}
+
+	module, err := os.ReadFile(data.WasmFile.ValueString())
+	if err != nil {
+		diags.AddAttributeError(path.Root("wasm_file"), "Could not read wasm file", err.Error())
+		return diags
+	}
+
+	var embedded []byte
+	for _, name := range []string{"icp:public candid:service", "icp:private candid:service"} {
+		embedded, err = wasmCustomSection(module, name)
+		if err != nil {
+			diags.AddAttributeError(path.Root("wasm_file"), "Could not read wasm file", err.Error())
+			return diags
+		}
+		if embedded != nil {
+			break
+		}
+	}
+
+	if embedded == nil {
+		diags.AddAttributeWarning(path.Root("candid_file"), "Candid interface not checked",
+			fmt.Sprintf("The module %s has no candid:service metadata to check %s against", data.WasmFile.ValueString(), data.CandidFile.ValueString()))
+		return diags
+	}
+
+	if canonicalDid(embedded) != canonicalDid(expected) {
+		diags.AddAttributeError(path.Root("candid_file"), "Candid interface mismatch",
+			fmt.Sprintf("The candid interface embedded in %s (candid:service metadata) differs from %s; the module was probably built from different sources than the interface", data.WasmFile.ValueString(), data.CandidFile.ValueString()))
+	}
+
+	return diags
+}
+
+// Returns an error if min_controllers is set and the given set of controllers is smaller.
+func (data *CanisterResourceModel) CheckMinControllers(controllers []string) error {
+	if data.MinControllers.IsNull() || data.MinControllers.IsUnknown() {
+		return nil
+	}
+
+	minControllers := data.MinControllers.ValueInt64()
+	if int64(len(controllers)) < minControllers {
+		return fmt.Errorf("Canister would have %d controller(s) but min_controllers is %d", len(controllers), minControllers)
+	}
+
+	return nil
+}
+
+// Returns a warning if deletion_guard is set but is not one of the controllers, since the
+// guard could then not delete the canister.
+func (data *CanisterResourceModel) CheckDeletionGuard(controllers []string) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if data.DeletionGuard.IsNull() || data.DeletionGuard.IsUnknown() {
+		return diags
+	}
+
+	if !slices.Contains(controllers, data.DeletionGuard.ValueString()) {
+		diags.AddAttributeWarning(path.Root("deletion_guard"), "Deletion guard is not a controller",
+			fmt.Sprintf("The deletion guard %s is not one of the controllers of the canister, so it won't be able to delete it.", data.DeletionGuard.ValueString()))
+	}
+
+	return diags
+}
+
 // Generate a warning if the planned modifications for the canister do not include the controller that is used by terraform.
 func (r *CanisterResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
 
@@ -162,11 +587,138 @@ func (r *CanisterResource) ModifyPlan(ctx context.Context, req resource.ModifyPl
 		return
 	}
 
-	// If terraform passed a null value (deletion) then there's nothing to do
+	// If terraform passed a null value (deletion) then there's nothing to do (besides
+	// checking that the canister can be deleted)
 	if data == nil {
+		if r.preflight != nil {
+			resp.Diagnostics.Append(r.preflightDelete(ctx, req)...)
+		}
+		return
+	}
+
+	r, diags := r.withOverrides(data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	var state *CanisterResourceModel
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// A failed creation that was checkpointed is resumed with an update, even if the
+	// configuration did not change
+	if state != nil {
+		resume, diags := hasCreationCheckpoint(ctx, req.Private)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		if resume {
+			tflog.Info(ctx, "Creation of canister "+state.Id.ValueString()+" was interrupted, planning to resume it")
+			resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("output_values"), types.MapUnknown(types.StringType))...)
+			if resp.Diagnostics.HasError() {
+				return
+			}
+		}
+	}
+
+	if r.preflight != nil {
+		if state == nil && r.proxy == nil {
+			resp.Diagnostics.Append(r.preflight.CheckCreation(ctx, *r.config, r.cmcSettings, uint64(data.InitialCycles.ValueInt64()))...)
+		} else if !req.Plan.Raw.Equal(req.State.Raw) {
+			resp.Diagnostics.Append(r.preflight.CheckControl(ctx, *r.config, state.Id.ValueString(), r.ProviderPrincipal())...)
+		}
+	}
+
+	resp.Diagnostics.Append(data.planArg(ctx, req.Config, state, &resp.Plan)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(data.planCyclesBalance(ctx, state, &resp.Plan)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if state != nil {
+		resp.Diagnostics.Append(r.planSubnetChange(ctx, data, state, &resp.Plan)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	// If the argument references values that are not known yet (e.g. the id of a canister
+	// created in the same apply), encoding is deferred to apply. Otherwise we encode it
+	// now so that invalid arguments are reported during plan.
+	if data.ArgIsKnown(ctx) {
+		argHex, err := data.GetArgHex(ctx)
+		if err != nil {
+			argPath := path.Root("arg")
+			if !data.ArgFile.IsNull() {
+				argPath = path.Root("arg_file")
+			}
+			resp.Diagnostics.AddAttributeError(argPath, "Invalid argument", "Could not encode argument: "+err.Error())
+			return
+		}
+
+		// Inline arguments end up in the state, so we guard against large ones
+		argSize := int64(len(argHex) / 2)
+		if data.ArgFile.IsNull() && r.maxInlineArgSize > 0 && argSize > r.maxInlineArgSize {
+			resp.Diagnostics.AddAttributeError(path.Root("arg"), "Argument too large",
+				fmt.Sprintf("The encoded argument is %d bytes, which exceeds max_inline_arg_size (%d bytes). "+
+					"Use arg_file to avoid storing the argument in the state.", argSize, r.maxInlineArgSize))
+			return
+		}
+
+		// Set the hash so that changes to arg_file show up in the plan. The arguments are
+		// only used if a module is installed.
+		if data.WasmFile.IsNull() {
+			resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("arg_sha256"), types.StringNull())...)
+		} else if !data.WasmFile.IsUnknown() {
+			resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("arg_sha256"), ArgSha256(argHex))...)
+		}
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	} else {
+		tflog.Info(ctx, "Argument is not known yet, deferring encoding to apply")
+	}
+
+	resp.Diagnostics.Append(data.planWasmSha256(ctx, req.Config, &resp.Plan)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(data.checkCandidInterface()...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(r.checkThresholdKeys(ctx, data, state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(r.policy.CheckLabels(ctx, data)...)
+	if resp.Diagnostics.HasError() {
 		return
 	}
 
+	if state == nil {
+		var configControllers types.List
+		resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root("controllers"), &configControllers)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		resp.Diagnostics.Append(r.policy.CheckExplicitControllers(configControllers, data.RequireExplicitControllers, path.Root("controllers"), r.ProviderPrincipal())...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
 	controllers, err := data.StringControllers(ctx, r.config)
 
 	if err != nil {
@@ -180,9 +732,45 @@ func (r *CanisterResource) ModifyPlan(ctx context.Context, req resource.ModifyPl
 	// The controllers being nil means we haven't yet figured out what controllers
 	// to set (will be set to the provider's principal during creation)
 	if controllers == nil {
+		// Unless set explicitly, the controllers are either the provider's principal
+		// (on creation) or the current controllers (on update)
+		var configControllers types.List
+		resp.Diagnostics.Append(req.Config.GetAttribute(ctx, path.Root("controllers"), &configControllers)...)
+		if resp.Diagnostics.HasError() || !configControllers.IsNull() {
+			return
+		}
+
+		resultingControllers := []string{r.ProviderPrincipal()}
+		if state != nil {
+			resultingControllers, err = state.StringControllers(ctx, r.config)
+			if err != nil || resultingControllers == nil {
+				return
+			}
+		}
+
+		resp.Diagnostics.Append(r.policy.CheckControllers(resultingControllers)...)
+
+		err = data.CheckMinControllers(resultingControllers)
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("min_controllers"), "Not enough controllers", err.Error())
+		}
+
+		return
+	}
+
+	resp.Diagnostics.Append(r.policy.CheckControllers(controllers)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	err = data.CheckMinControllers(controllers)
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("controllers"), "Not enough controllers", err.Error())
 		return
 	}
 
+	resp.Diagnostics.Append(data.CheckDeletionGuard(controllers)...)
+
 	// Check if the identity used to terraform is amongst the controllers
 	hasOurPrincipal := false
 	ourPrincipal := r.ProviderPrincipal()
@@ -198,6 +786,24 @@ func (r *CanisterResource) ModifyPlan(ctx context.Context, req resource.ModifyPl
 	}
 }
 
+// Checks that the canister being deleted is controlled by the identity deleting it.
+func (r *CanisterResource) preflightDelete(ctx context.Context, req resource.ModifyPlanRequest) diag.Diagnostics {
+	var state *CanisterResourceModel
+	diags := req.State.Get(ctx, &state)
+	if diags.HasError() || state == nil {
+		return diags
+	}
+
+	r, overrideDiags := r.withOverrides(state)
+	diags.Append(overrideDiags...)
+	if diags.HasError() {
+		return diags
+	}
+
+	diags.Append(r.preflight.CheckControl(ctx, *r.config, state.Id.ValueString(), r.ProviderPrincipal())...)
+	return diags
+}
+
 func (r *CanisterResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
 	resp.TypeName = req.ProviderTypeName + "_canister"
 }
@@ -206,7 +812,8 @@ func (r *CanisterResource) Schema(ctx context.Context, req resource.SchemaReques
 
 	// XXX: at this point, CanisterResource is not initialized yet
 
-	var argDefaultDescription = "If neither `arg` nor `arg_hex` is set, the argument defaults to the empty blob (and not for instance to a Candid `null`)."
+	var argDefaultDescription = "If none of `arg`, `arg_hex` and `arg_file` is set, the argument defaults to the empty blob (and not for instance to a Candid `null`). " +
+		"Changes that do not affect the decoded Candid value (e.g. switching between `arg` and `arg_hex`) are not planned: the arguments are kept as they are in the state, and the code is not upgraded."
 	resp.Schema = schema.Schema{
 		// This description is used by the documentation generator and the language server.
 		MarkdownDescription: "Canister resource",
@@ -220,8 +827,12 @@ func (r *CanisterResource) Schema(ctx context.Context, req resource.SchemaReques
 				},
 			},
 			"controllers": schema.ListAttribute{
-				ElementType:         types.StringType,
-				MarkdownDescription: "Canister controllers. When creating a new canister, defaults to the principal used by the provider.",
+				ElementType: types.StringType,
+				MarkdownDescription: "Canister controllers. When creating a new canister, defaults to the principal used by the provider. " +
+					"Controllers must be valid principals in their canonical textual form; planning warns about the anonymous principal (`2vxsx-fae`) and the management canister (`aaaaa-aa`), which are almost certainly mistakes.",
+				Validators: []validator.List{
+					controllersValidator{},
+				},
 
 				// the controllers can either be fetched from the replica, or
 				// set directly if necessary.
@@ -233,116 +844,422 @@ func (r *CanisterResource) Schema(ctx context.Context, req resource.SchemaReques
 			},
 			"arg": schema.DynamicAttribute{
 				Optional: true,
+				Computed: true, // only to plan equivalent arguments as they are in the state, see planArg
 
 				MarkdownDescription: "Init & post_upgrade arguments for the canister. Heuristics are used to convert it to candid. " + "The Terraform value is automatically candid-encoded using the heurstics describe in the `did_encode` function. You should not call `did_encode` when using `arg`. " + argDefaultDescription,
 			},
 			"arg_hex": schema.StringAttribute{
 				Optional: true,
+				Computed: true, // see arg
 
 				MarkdownDescription: "Hex representation of candid-encoded arguments. This is helpful if you generate a (hex) candid-encoded strings using didc or by using `did_encode` directly. " + argDefaultDescription,
 			},
+			"arg_file": schema.StringAttribute{
+				Optional: true,
+
+				MarkdownDescription: "Path to a file containing the candid-encoded (binary) arguments. Unlike `arg` and `arg_hex`, only the path and the hash of the arguments are stored in the state, which is recommended for large arguments (see the provider's `max_inline_arg_size`). " + argDefaultDescription,
+			},
+			"arg_sha256": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Sha256 sum (hex encoded) of the candid-encoded arguments",
+			},
 			"wasm_file": schema.StringAttribute{
 				Optional:            true,
-				MarkdownDescription: "Path to Wasm module to install",
+				MarkdownDescription: "Path to Wasm module to install. Only the content of the module matters: changing the path to a file with the same content (e.g. after moving or renaming it) does not reinstall the code.",
 			},
 			"wasm_sha256": schema.StringAttribute{
 				Optional:            true,
 				Computed:            true,
-				MarkdownDescription: "Sha256 sum of Wasm module (hex encoded). Recommended if `wasm_file` is specified.",
+				MarkdownDescription: "Sha256 sum of Wasm module (hex encoded). Recommended if `wasm_file` is specified. If not set, defaults to the hash of the content of `wasm_file` when planning (unless `labels` are set or the file does not exist yet, in which case the hash is read from the canister after installing the code).",
 			},
-		},
-	}
-}
-
-func (r *CanisterResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
-	tflog.Info(ctx, "Configuring canister resource")
-	// Prevent panic if the provider has not been configured.
-	if req.ProviderData == nil {
-		return
-	}
-
-	config, ok := req.ProviderData.(*agent.Config)
-
-	if !ok {
-		resp.Diagnostics.AddError(
-			"Unexpected Resource Configure Type",
-			fmt.Sprintf("Expected *agent.Agent, got: %T. Please report this issue to the provider developers.", req.ProviderData),
-		)
-
-		return
-	}
-
-	r.config = config
+			"cmc_refunds": schema.ListNestedAttribute{
+				Computed:            true,
+				MarkdownDescription: "Refunds issued by the cycles minting canister (CMC) when it could not create (or top up) the canister, for reconciliation purposes. Refunds are dropped from this attribute when the resource is replaced, which includes the next apply after a refund (the refund taints the resource): Terraform doesn't pass anything from the replaced resource to its replacement. Set the provider's `apply_summary_file` to keep a record of every refund across replacements (or record them before applying again, e.g. from the error reporting the refund, which includes the same block indexes).",
+				PlanModifiers: []planmodifier.List{
+					listplanmodifier.UseStateForUnknown(),
+				},
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"transfer_block_index": schema.Int64Attribute{
+							Computed:            true,
+							MarkdownDescription: "Ledger block index of the ICP transfer to the CMC",
+						},
+						"refund_block_index": schema.Int64Attribute{
+							Computed:            true,
+							MarkdownDescription: "Ledger block index of the refund (if known)",
+						},
+						"refund_e8s": schema.Int64Attribute{
+							Computed:            true,
+							MarkdownDescription: "Amount refunded, in e8s (amount transferred minus the transfer fee)",
+						},
+						"reason": schema.StringAttribute{
+							Computed:            true,
+							MarkdownDescription: "Reason given by the CMC for the refund",
+						},
+					},
+				},
+			},
+			"threshold_key_ids": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Optional:            true,
+				MarkdownDescription: "Threshold keys (ECDSA or Schnorr) the canister is expected to use, e.g. `ecdsa:Secp256k1:key_1` or `schnorr:Ed25519:key_1`. Planning fails if a key is not enabled on the canister's subnet (or on any subnet if the subnet is not known yet), according to the registry.",
+				Validators: []validator.List{
+					listvalidator.ValueStringsAre(
+						stringvalidator.RegexMatches(regexp.MustCompile(`^(ecdsa:Secp256k1|schnorr:Bip340Secp256k1|schnorr:Ed25519):.+$`),
+							"must be of the form <ecdsa|schnorr>:<curve>:<name>, e.g. ecdsa:Secp256k1:key_1"),
+					),
+				},
+			},
+			"created_at": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Time (RFC 3339) at which the canister was created by the provider. Null for imported canisters.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"created_by": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Principal (i.e. the provider's identity) that created the canister. Null for imported canisters.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"cycles_beneficiary": schema.StringAttribute{
+				Optional: true,
+				MarkdownDescription: "Canister receiving the remaining cycles when the canister is deleted (which would otherwise burn them). " +
+					"Before deletion, the canister's code is replaced with a module that sends all cycles but a small margin (0.1T cycles, which pay for the withdrawal) to the beneficiary with the management canister's `deposit_cycles`.",
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"deletion_guard": schema.StringAttribute{
+				Optional: true,
+				MarkdownDescription: "Controller of the canister (a guard canister) through which the canister is deleted, so that its deletion (e.g. by `terraform destroy` or a replacement) is time-locked and can be cancelled before it happens. " +
+					"On deletion, the provider calls the guard's `request_deletion`, which returns when the deletion is unlocked: until then, the canister is left running and deleting it fails, and applying again once it is unlocked stops the canister and deletes it with the guard's `delete_canister`. " +
+					"The guard sets the delay, refuses `delete_canister` for deletions that were not requested or are still locked, and lets deletions be cancelled (e.g. by a different principal than the provider's). " +
+					"Its interface: `request_deletion : (record { canister_id : principal }) -> (variant { Ok : record { unlocks_at : nat64 }; Err : text })`, with `unlocks_at` in nanoseconds since the epoch, and `delete_canister : (record { canister_id : principal }) -> (variant { Ok; Err : text })`. " +
+					"Since the other controllers can still delete the canister, the guard protects against unintended deletions by Terraform; make the guard the only controller that can delete canisters (e.g. the provider's `proxy_canister_id`) to protect against the other controllers too.",
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"expires_at": schema.StringAttribute{
+				Optional: true,
+				MarkdownDescription: "Time (RFC 3339) at which the canister is intended to be torn down, e.g. for ephemeral environments. " +
+					"The provider does not delete expired canisters: the time is recorded in the apply summary (see the provider's `apply_summary_file`) so that expired canisters can be listed with the `ic_expired_canisters` data source.",
+				Validators: []validator.String{
+					rfc3339Validator{},
+				},
+			},
+			"public_metadata": schema.SingleNestedAttribute{
+				Optional: true,
+				MarkdownDescription: "Public metadata describing the canister to wallets and dashboards, following the emerging conventions: each attribute that is set is injected into the Wasm module's `icp:public <attribute>` metadata section (e.g. `icp:public name`) when the code is installed, replacing the section of the module if any, so that anyone can read it (see the `ic_canister` data source). " +
+					"Changing the metadata reinstalls (upgrades) the code; `wasm_sha256` remains the hash of `wasm_file`, while the module installed differs from it when metadata is set.",
+				Attributes: map[string]schema.Attribute{
+					"name": schema.StringAttribute{
+						Optional:            true,
+						MarkdownDescription: "Display name of the canister",
+					},
+					"description": schema.StringAttribute{
+						Optional:            true,
+						MarkdownDescription: "Description of the canister",
+					},
+					"logo": schema.StringAttribute{
+						Optional:            true,
+						MarkdownDescription: "Logo of the canister, e.g. a URL or a `data:` URI",
+					},
+				},
+			},
+			"labels": schema.MapAttribute{
+				ElementType: types.StringType,
+				Optional:    true,
+				MarkdownDescription: "Labels of the canister, e.g. to group canisters of a fleet. The labels are injected (as a JSON object) into the Wasm module's `icp:private " + canisterLabelsMetadata + "` metadata section when the code is installed, " +
+					"so they can be read by the canister's controllers (see the `ic_canister` data source). Changing the labels reinstalls (upgrades) the code; `wasm_sha256` remains the hash of `wasm_file`, while the module installed differs from it when labels are set.",
+			},
+			"raw_settings": schema.MapAttribute{
+				ElementType: types.StringType,
+				Optional:    true,
+				MarkdownDescription: "Canister settings without a dedicated attribute (e.g. settings introduced after this version of the provider), by name, as hex-encoded candid values (e.g. encoded with `didc encode` or `did_encode`). " +
+					"The values are passed as is to `update_settings`, along with nothing but the listed settings, so that the other settings of the canister are left unchanged. Removing a setting from the map leaves it as is on the canister. " +
+					"Changes made outside of Terraform are detected on refresh when the provider controls the canister directly; values which can't be encoded again (records and variants) are then refreshed as the empty string. " +
+					"The settings with a dedicated attribute (e.g. `controllers`, `freezing_threshold`, `reserved_cycles_limit` or `log_visibility`) can't be set here.",
+			},
+			"freezing_threshold": schema.Int64Attribute{
+				Optional: true,
+				MarkdownDescription: "Freezing threshold of the canister, in seconds: the canister is frozen (i.e. rejects calls) when its cycles balance would only pay for its idle consumption for less than this long, which leaves operators time to top it up before it runs out of cycles. " +
+					"Set with `update_settings` and refreshed from `canister_status` when the provider controls the canister directly, so changes made outside of Terraform show up in the plan. Removing the attribute leaves the threshold as is on the canister (the IC's default is 30 days).",
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"reserved_cycles_limit": schema.Int64Attribute{
+				Optional: true,
+				MarkdownDescription: "Upper limit of the cycles the canister can reserve for future storage payments, which application subnets require when the canister allocates memory while the subnet's usage is above the storage reservation threshold: operations that would reserve more cycles fail. " +
+					"Setting it to `0` disables the reservations, so that the canister can't allocate memory on subnets above the threshold. " +
+					"Set with `update_settings` and refreshed from `canister_status` when the provider controls the canister directly. Removing the attribute leaves the limit as is on the canister (the IC's default is 5T cycles).",
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"wasm_memory_threshold": schema.Int64Attribute{
+				Optional: true,
+				MarkdownDescription: "Threshold of the remaining Wasm memory (heap) of the canister, in bytes, below which the canister's `on_low_wasm_memory` hook is run, e.g. to stop accepting writes or to alert operators before the canister runs out of memory. " +
+					"Set with `update_settings` and refreshed from `canister_status` when the provider controls the canister directly. Removing the attribute leaves the threshold as is on the canister (the IC's default is `0`, i.e. the hook is never run).",
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"log_visibility": schema.SingleNestedAttribute{
+				Optional: true,
+				MarkdownDescription: "Who can read the logs of the canister (with the management canister's `fetch_canister_logs`), e.g. to grant log access to the principals of observability tools. " +
+					"Set with `update_settings` and refreshed from `canister_status` when the provider controls the canister directly. Removing the attribute leaves the visibility as is on the canister (the IC's default is `controllers`).",
+				Attributes: map[string]schema.Attribute{
+					"visibility": schema.StringAttribute{
+						Required:            true,
+						MarkdownDescription: "One of `controllers` (only the controllers can read the logs), `public` (anyone can) or `allowed_viewers` (only the principals listed in `allowed_viewers` can, besides the controllers)",
+						Validators: []validator.String{
+							stringvalidator.OneOf(logVisibilityControllers, logVisibilityPublic, logVisibilityAllowedViewers),
+						},
+					},
+					"allowed_viewers": schema.ListAttribute{
+						ElementType:         types.StringType,
+						Optional:            true,
+						MarkdownDescription: "Principals allowed to read the logs. Required when `visibility` is `allowed_viewers`, and not allowed otherwise.",
+						Validators: []validator.List{
+							listvalidator.ValueStringsAre(principalValidator{}),
+						},
+					},
+				},
+			},
+			"quotas": schema.MapAttribute{
+				ElementType: types.Int64Type,
+				Optional:    true,
+				MarkdownDescription: "Quota and priority settings of the canister (natural numbers, e.g. `compute_allocation`, or the per-canister quotas being introduced in the management canister), by name. " +
+					"Each setting is only set on networks that support it, as detected from the settings reported by `canister_status`: the others are skipped with a warning (rather than failing on older replicas), and set by the first apply after the network supports them. " +
+					"Through a wallet or proxy canister, which can't be used to detect support, all the settings are sent, and ignored by networks that don't support them. Removing a setting from the map leaves it as is on the canister.",
+				Validators: []validator.Map{
+					mapvalidator.ValueInt64sAre(int64validator.AtLeast(0)),
+				},
+			},
+			"candid_file": schema.StringAttribute{
+				Optional: true,
+				MarkdownDescription: "Path to the .did file of the canister's interface. When `wasm_file` is set, planning fails if the interface embedded in the module (`candid:service` metadata) differs from it, " +
+					"which catches modules built from different sources than the interface before any call to the IC. Type definitions may be ordered differently, but must otherwise be identical.",
+			},
+			"identity_pem_file": schema.StringAttribute{
+				Optional: true,
+				MarkdownDescription: "Path to the PEM file of the identity used to manage this canister, instead of the provider's identity. " +
+					"This allows managing canisters controlled by different principals without provider aliases. Changing the identity does not change the canister's controllers.",
+			},
+			"identity_name": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Name of the dfx identity used to manage this canister, instead of the provider's identity. Encrypted identities and identities stored in the system keyring are not supported.",
+			},
+			"call_timeout": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "How long to wait for the calls managing this canister (e.g. `10m` for long installs), overriding the provider's `call_timeout`.",
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"poll_interval": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Interval at which the status of the calls managing this canister is polled, overriding the provider's `poll_interval`.",
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"require_explicit_controllers": schema.BoolAttribute{
+				Optional:            true,
+				MarkdownDescription: "Whether creating this canister fails when planning if `controllers` is not set, instead of defaulting to the provider's principal, overriding the provider's `require_explicit_controllers`.",
+			},
+			"funding_subaccount": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Subaccount (hex encoded, 32 bytes) funding the creation of this canister through the CMC, overriding the provider's `funding_subaccount`.",
+				Validators: []validator.String{
+					subaccountValidator{},
+				},
+			},
+			"min_controllers": schema.Int64Attribute{
+				Optional:            true,
+				MarkdownDescription: "Minimum number of controllers. Planning fails if the resulting set of controllers is smaller, e.g. to avoid locking out the canister when rotating controllers.",
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"outputs": schema.SingleNestedAttribute{
+				Optional:            true,
+				MarkdownDescription: "Query method to call after the code is installed to read output values from the canister (e.g. principals or keys generated at init). The method must take no arguments and return a record.",
+				Attributes: map[string]schema.Attribute{
+					"method": schema.StringAttribute{
+						Required:            true,
+						MarkdownDescription: "Name of the query method, e.g. `get_config`",
+					},
+					"fields": schema.ListAttribute{
+						ElementType:         types.StringType,
+						Required:            true,
+						MarkdownDescription: "Record fields to read",
+					},
+				},
+			},
+			"output_values": schema.MapAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Values of the `outputs` fields, converted to strings: texts are used as is, principals are textually encoded, blobs are hex encoded and numbers are in decimal. Other values use the Candid textual representation. Optional fields that are not set are empty strings. Refreshed whenever the resource is read, unless the provider's `refresh_mode` is `off`.",
+			},
+			"subnet_id": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Subnet to create the canister on (mainnet only). Setting it to another subnet than the one an existing canister is on according to the registry migrates the canister: it is stopped and snapshotted, and the snapshot is loaded into a canister created on the subnet (paid for like on creation), which gets the settings and cycles of the canister, and replaces it (with a new `id`). A failed migration restarts the canister and is resumed by the next apply. Canisters managed through an Orbit station, or with a deletion guard, can't be migrated. Removing it only updates the state.",
+			},
+			"initial_cycles": schema.Int64Attribute{
+				Optional: true,
+				MarkdownDescription: "Cycles the canister is created with, including the creation fee charged by the network. " +
+					"On mainnet, the ICP transferred to the CMC are derived from the current conversion rate (and are at least the provider's `cmc_min_amount_e8s`); on other networks, this is the `amount` of the provisional creation; through a wallet or proxy canister, this overrides the provider's `wallet_create_canister_cycles`. " +
+					"Only used on creation: changing it doesn't affect existing canisters (use `ic_cycles_deposit` or `minimum_cycles` to top them up). Defaults to 1T cycles (or to the provider's `wallet_create_canister_cycles`).",
+				Validators: []validator.Int64{
+					int64validator.AtLeast(1),
+				},
+			},
+			"minimum_cycles": schema.Int64Attribute{
+				Optional: true,
+				MarkdownDescription: "Cycles balance below which the canister is topped up to `top_up_to`. The balance is read with `canister_status` on every refresh (so the provider must control the canister, directly or through its wallet or proxy canister), and a balance below the minimum plans an update of `cycles_balance` that tops the canister up. " +
+					"Requires `top_up_to`. Removing the attribute stops the top-ups.",
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"top_up_to": schema.Int64Attribute{
+				Optional:            true,
+				MarkdownDescription: "Cycles balance the canister is topped up to when its balance is below `minimum_cycles`. Must be greater than `minimum_cycles`.",
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"top_up_source": schema.StringAttribute{
+				Optional: true,
+				MarkdownDescription: "Source of the cycles topping up the canister: `cmc` (ICP of the provider's funding account, transferred to the CMC and converted with `notify_top_up`: a transfer whose notification fails is resumed by the next apply, and refunds are recorded in `cmc_refunds`), `cycles_ledger` (cycles of the provider's identity, withdrawn from the cycles ledger) or `provisional` (cycles minted with `provisional_top_up_canister`, on test networks). " +
+					"Defaults to `cmc` on mainnet and `provisional` on other networks.",
+				Validators: []validator.String{
+					stringvalidator.OneOf(topUpSourceCmc, topUpSourceCyclesLedger, topUpSourceProvisional),
+				},
+			},
+			"cycles_balance": schema.Int64Attribute{
+				Computed:            true,
+				MarkdownDescription: "Cycles balance of the canister when last checked (after the last top-up, if any). Null unless `minimum_cycles` is set.",
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.UseStateForUnknown(),
+				},
+			},
+		},
+	}
 }
 
-func createCanisterProvisional(config agent.Config) (principal.Principal, error) {
-
-	agent, err := icMgmt.NewAgent(ic.MANAGEMENT_CANISTER_PRINCIPAL, config)
-	if err != nil {
-		return principal.Principal{}, err
+func (r *CanisterResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	tflog.Info(ctx, "Configuring canister resource")
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
 	}
 
-	createCanisterArgs := icMgmt.ProvisionalCreateCanisterWithCyclesArgs{}
-	res, err := agent.ProvisionalCreateCanisterWithCycles(createCanisterArgs)
+	providerData, ok := req.ProviderData.(*IcProviderData)
 
-	if err != nil {
-		return principal.Principal{}, err
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
 	}
 
-	return res.CanisterId, nil
+	r.config = providerData.Config
+	r.readOnly = providerData.ReadOnly
+	r.applySummary = providerData.ApplySummary
+	r.cmcSettings = providerData.Cmc
+	r.maxInlineArgSize = providerData.MaxInlineArgSize
+	r.policy = providerData.CanisterPolicy
+	r.certifiedReads = providerData.CertifiedReads
+	r.lock = providerData.Lock
+	r.streamCanisterLogs = providerData.StreamCanisterLogs
+	r.managementEffectiveCanisterId = providerData.ManagementEffectiveCanisterId
+	r.refreshMode = providerData.RefreshMode
+	r.metrics = providerData.Metrics
+	r.preflight = providerData.Preflight
+	r.rollout = providerData.Rollout
+	r.proxy = providerData.ManagementProxy
+	r.proxyCreateCanisterCycles = providerData.ProxyCreateCanisterCycles
+	r.registry = providerData.Registry
 }
 
-var MEMO_CREATE_CANISTER uint64 = 0x41455243
-
-func createCanisterCMC(ctx context.Context, config agent.Config) (principal.Principal, error) {
+// If effectiveCanisterId is not nil, it is used as the effective canister id of the call.
+// Otherwise the agent uses the management canister, which some endpoints (e.g. PocketIC)
+// cannot route.
+func createCanisterProvisional(config agent.Config, effectiveCanisterId *principal.Principal, cycles uint64) (principal.Principal, error) {
 
-	ledgerAgent, err := ledger.NewAgent(ic.LEDGER_PRINCIPAL, config)
+	a, err := newAgent(config)
 	if err != nil {
-		return principal.Principal{}, fmt.Errorf("Could not create ledger agent: %w", err)
+		return principal.Principal{}, err
 	}
+	agent := &icMgmt.Agent{Agent: a, CanisterId: ic.MANAGEMENT_CANISTER_PRINCIPAL}
 
-	// Prepare the subaccount to send ICP to
+	createCanisterArgs := icMgmt.ProvisionalCreateCanisterWithCyclesArgs{}
+	if cycles > 0 {
+		amount := idl.NewNat(cycles)
+		createCanisterArgs.Amount = &amount
+	}
 
-	myController := config.Identity.Sender().Raw
-	subaccount := [32]byte{}
-	subaccount[0] = byte(len(myController))
+	if effectiveCanisterId == nil {
+		res, err := agent.ProvisionalCreateCanisterWithCycles(createCanisterArgs)
+		if err != nil {
+			return principal.Principal{}, err
+		}
 
-	for i := 0; i < len(myController); i++ {
-		subaccount[i+1] = myController[i]
+		return res.CanisterId, nil
 	}
 
-	cmcDestAccount := principal.NewAccountID(ic.CYCLES_MINTING_PRINCIPAL, subaccount)
-
-	// Figure out how much ICP to send by checking the cycles conversion rate on the CMC
-	cmcAgent, err := cmc.NewAgent(ic.CYCLES_MINTING_PRINCIPAL, config)
+	call, err := agent.ProvisionalCreateCanisterWithCyclesCall(createCanisterArgs)
 	if err != nil {
-		return principal.Principal{}, fmt.Errorf("Could not create CMC agent: %w", err)
+		return principal.Principal{}, err
 	}
 
-	conversionRate, err := cmcAgent.GetIcpXdrConversionRate()
+	var res icMgmt.ProvisionalCreateCanisterWithCyclesResult
+	err = call.WithEffectiveCanisterID(*effectiveCanisterId).CallAndWait(&res)
 	if err != nil {
-		return principal.Principal{}, fmt.Errorf("Could not get cycles conversion rate from CMC: %w", err)
+		return principal.Principal{}, err
 	}
 
-	if conversionRate == nil {
-		return principal.Principal{}, fmt.Errorf("Got no conversion rate from CMC")
-	}
+	return res.CanisterId, nil
+}
+
+var MEMO_CREATE_CANISTER uint64 = 0x41455243
 
-	// XdrPermyriadPerIcp == price of 1e8s in cycles
-	// => price of cycles in 1e8s = 1 / XdrPermyriadPerIcp
-	nE8s := 1_000_000_000_000 /* 1T cycles (0.1 creation + 0.9 running costs) */ / conversionRate.Data.XdrPermyriadPerIcp
+func createCanisterCMC(ctx context.Context, config agent.Config, settings CmcSettings, subnetId *principal.Principal, cycles uint64) (principal.Principal, error) {
+
+	cmcDestAccount := cmcCreateCanisterAccount(config.Identity.Sender())
+
+	nE8s, err := cmcCreateCanisterAmountE8s(config, settings, cycles)
+	if err != nil {
+		return principal.Principal{}, err
+	}
+	feeE8s := settings.TransferFeeE8s
 
 	tflog.Info(ctx, fmt.Sprintf("Creating canister with %d e8s", nE8s))
 
 	transferArgs := ledger.TransferArgs{
 		Amount: ledger.Tokens{E8s: nE8s},
-		Fee:    ledger.Tokens{E8s: 10_000},
+		Fee:    ledger.Tokens{E8s: feeE8s},
 		// FromSubaccount: default to default (null) subaccount
 		To:   cmcDestAccount.Bytes(),
-		Memo: MEMO_CREATE_CANISTER,
+		Memo: settings.CreateCanisterMemo,
+	}
+
+	if settings.FundingSubaccount != nil {
+		transferArgs.FromSubaccount = &settings.FundingSubaccount
 	}
 
-	res, err := ledgerAgent.Transfer(transferArgs)
+	// Tracked, so that a transfer that timed out is not made again when retried
+	var res ledger.TransferResult
+	err = callAndWait(config, ic.LEDGER_PRINCIPAL, "transfer", transferArgs, &res)
 	if err != nil {
 		return principal.Principal{}, fmt.Errorf("Could not transfer funds to create canister: %w", err)
 	}
@@ -354,34 +1271,39 @@ func createCanisterCMC(ctx context.Context, config agent.Config) (principal.Prin
 
 	blockId := *res.Ok
 
-	notifyCreateCanisterArg := cmc.NotifyCreateCanisterArg{
-		BlockIndex: blockId,
-		Controller: config.Identity.Sender(),
-	}
-
-	resCreate, err := cmcAgent.NotifyCreateCanister(notifyCreateCanisterArg)
-	if err != nil {
-		return principal.Principal{}, fmt.Errorf("Could not create canister on CMC: %w", err)
-	}
-
-	if resCreate.Ok == nil {
-		str, _ := json.Marshal(res.Err)
-		return principal.Principal{}, fmt.Errorf("Error when creating canister: %s", string(str))
+	claim := PendingClaim{BlockIndex: blockId, AmountE8s: nE8s, FeeE8s: feeE8s}
+	if subnetId != nil {
+		subnetIdStr := subnetId.Encode()
+		claim.SubnetId = &subnetIdStr
 	}
 
-	canisterId := *resCreate.Ok
+	return notifyCreateCanister(ctx, config, claim)
+}
 
-	return canisterId, nil
+// Creates a canister with the given cycles (0 for the default amount).
+func (r *CanisterResource) createCanister(ctx context.Context, subnetId *principal.Principal, cycles uint64) (_ principal.Principal, err error) {
+	defer r.metrics.Time(ctx, "create_canister", "")(&err)
 
-}
+	if r.proxy != nil {
+		// The wallet or proxy canister pays for the canister with its cycles
+		if subnetId != nil {
+			tflog.Warn(ctx, "Ignoring subnet_id with canister creation through "+r.proxy.CanisterId.Encode()+": "+subnetId.Encode())
+		}
+		if cycles == 0 {
+			cycles = r.proxyCreateCanisterCycles
+		}
+		return createCanisterProxy(ctx, *r.config, *r.proxy, cycles)
+	}
 
-func (r *CanisterResource) createCanister(ctx context.Context) (principal.Principal, error) {
-	if r.config.ClientConfig.Host.String() == icpApi.String() {
+	if withoutEndpointAlias(r.config.ClientConfig.Host).String() == icpApi.String() {
 		// If we're on mainnet, use the CMC to create canisters
-		return createCanisterCMC(ctx, *r.config)
+		return createCanisterCMC(ctx, *r.config, r.cmcSettings, subnetId, cycles)
 	} else {
 		// otherwise, assume some test setup and use provisional creation
-		return createCanisterProvisional(*r.config)
+		if subnetId != nil {
+			tflog.Warn(ctx, "Ignoring subnet_id with provisional canister creation: "+subnetId.Encode())
+		}
+		return createCanisterProvisional(*r.config, r.managementEffectiveCanisterId, cycles)
 	}
 }
 
@@ -395,25 +1317,156 @@ func (r *CanisterResource) Create(ctx context.Context, req resource.CreateReques
 		return
 	}
 
-	canisterId, err := r.createCanister(ctx)
+	if r.readOnly != readWrite {
+		resp.Diagnostics.Append(r.readOnly.diagnostic("create canister"))
+		return
+	}
+
+	r, diags := r.withOverrides(&data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// The raw settings and quotas may only be known at apply time: they are checked before the
+	// canister is paid for, so that an invalid value doesn't fail its creation halfway
+	rawSettings, diags := data.StringRawSettings(ctx)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	for name, value := range rawSettings {
+		if _, err := parseRawSetting(name, value); err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("raw_settings").AtMapKey(name), "Invalid raw setting", err.Error())
+		}
+	}
+	quotas, diags := data.Int64Quotas(ctx)
+	resp.Diagnostics.Append(diags...)
+	for name, value := range quotas {
+		if _, ok := rawSettings[name]; ok {
+			resp.Diagnostics.AddAttributeError(path.Root("quotas").AtMapKey(name), "Invalid quota",
+				fmt.Sprintf("%s is also set in raw_settings.", name))
+		} else if value < 0 {
+			resp.Diagnostics.AddAttributeError(path.Root("quotas").AtMapKey(name), "Invalid quota",
+				fmt.Sprintf("%s must be a natural number, got %d.", name, value))
+		}
+	}
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	var subnetId *principal.Principal
+	if !data.SubnetId.IsNull() {
+		subnetIdP, err := principal.Decode(data.SubnetId.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("subnet_id"), "Client Error", "Could not decode subnet id: "+err.Error())
+			return
+		}
+		subnetId = &subnetIdP
+	}
+
+	canisterId, err := r.createCanister(ctx, subnetId, uint64(data.InitialCycles.ValueInt64()))
+
+	var pendingClaimErr *PendingClaimError
+	if errors.As(err, &pendingClaimErr) {
+		// The ICP were transferred but the canister could not be claimed yet. We save
+		// the block index in the private state so that the claim can be resumed, and
+		// make sure the state doesn't contain unknown values.
+		resp.Diagnostics.Append(writePendingClaim(ctx, resp.Private, &pendingClaimErr.Claim)...)
+
+		data.Id = types.StringNull()
+		if data.WasmSha256.IsUnknown() {
+			data.WasmSha256 = types.StringNull()
+		}
+		if data.Controllers.IsUnknown() {
+			data.Controllers = types.ListNull(types.StringType)
+		}
+		data.OutputValues = types.MapNull(types.StringType)
+		if data.ArgSha256.IsUnknown() {
+			data.ArgSha256 = types.StringNull()
+		}
+		data.CreatedAt = types.StringNull()
+		data.CreatedBy = types.StringNull()
+		data.CyclesBalance = types.Int64Null()
+		data.InferCmcRefunds()
+
+		resp.Diagnostics.Append(clientErrorDiagnostic("", fmt.Errorf("%w. "+
+			"The canister creation can be resumed by running `terraform untaint` on this resource and applying again.", err)))
+		resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+		return
+	}
+
+	var refundErr *CmcRefundError
+	if errors.As(err, &refundErr) {
+		// Record the refund in the (tainted) state so that it can be reconciled
+		data.Id = types.StringNull()
+		if data.WasmSha256.IsUnknown() {
+			data.WasmSha256 = types.StringNull()
+		}
+		if data.Controllers.IsUnknown() {
+			data.Controllers = types.ListNull(types.StringType)
+		}
+		data.OutputValues = types.MapNull(types.StringType)
+		if data.ArgSha256.IsUnknown() {
+			data.ArgSha256 = types.StringNull()
+		}
+		data.CreatedAt = types.StringNull()
+		data.CreatedBy = types.StringNull()
+		data.CyclesBalance = types.Int64Null()
+		data.InferCmcRefunds()
+		resp.Diagnostics.Append(r.appendCmcRefund(&data, "", refundErr.Refund)...)
+
+		resp.Diagnostics.Append(clientErrorDiagnostic("", err))
+		resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+		return
+	}
+
 	if err != nil {
-		resp.Diagnostics.AddError("Client Error", err.Error())
+		resp.Diagnostics.Append(clientErrorDiagnostic("", err))
 		return
 	}
 
+	data.InferCmcRefunds()
 	data.Id = types.StringValue(canisterId.Encode())
+	data.CreatedAt = types.StringValue(time.Now().UTC().Format(time.RFC3339))
+	data.CreatedBy = types.StringValue(r.ProviderPrincipal())
 	tflog.Info(ctx, "Created canister: "+canisterId.Encode())
 
+	// From here on the canister exists, so failures are checkpointed in the state to be
+	// resumed instead of orphaning the canister
+	codeInstalled := false
+
+	// The canister is locked while it is set up, like on updates and deletions, so that
+	// other applies (e.g. one resuming a checkpointed creation) wait for it
+	err = r.lock.Acquire(ctx, canisterId.Encode())
+	if err != nil {
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, err)
+		return
+	}
+	defer r.releaseLock(ctx, canisterId.Encode(), &resp.Diagnostics)
+
 	// Code install & args
 
 	argHex, err := data.GetArgHex(ctx)
 	if err != nil {
-		resp.Diagnostics.AddError("Client Error", "Could not read argument: "+err.Error())
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, fmt.Errorf("Could not read argument: %w", err))
 		return
 	}
 
 	doInstallCode := !data.WasmFile.IsNull()
 
+	labels, diags := data.StringLabels(ctx)
+	if diags.HasError() {
+		resp.Diagnostics.Append(diags...)
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, errors.New("Could not read labels"))
+		return
+	}
+
+	data.ArgSha256 = types.StringNull()
+	if doInstallCode {
+		data.ArgSha256 = types.StringValue(ArgSha256(argHex))
+	}
+
 	// This may be the empty string (if sha256 was not set). `setCanisterCode` handles
 	// it appropriately.
 	wasmSha256 := data.WasmSha256.ValueString()
@@ -424,117 +1477,603 @@ func (r *CanisterResource) Create(ctx context.Context, req resource.CreateReques
 		wasmFile := data.WasmFile.ValueString()
 
 		// We're creating a new canister, so we always use "install"
-		err = r.setCanisterCode(ctx, canisterId.Encode(), argHex, wasmFile, wasmSha256)
+		err = r.setCanisterCode(ctx, canisterId.Encode(), argHex, wasmFile, wasmSha256, labels, data.StringPublicMetadata())
 		if err != nil {
-			resp.Diagnostics.AddError("Client Error", "Could not update code: "+err.Error())
+			r.checkpointCreation(ctx, &data, resp, codeInstalled, fmt.Errorf("Could not update code: %w", err))
+			return
+		}
+		codeInstalled = true
+	}
+
+	canisterInfo, err := r.ReadCanisterInfo(ctx, canisterId)
+	if err != nil {
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, fmt.Errorf("Could not read canister info: %w", err))
+		return
+	}
+
+	if doInstallCode {
+		// If we installed the code, and wasm_sha256 was set, we expect it to match
+		// that of the newly created canister (unless metadata was injected).
+
+		if len(wasmSha256) > 0 && !data.InjectsMetadata() && wasmSha256 != canisterInfo.WasmSha256 {
+			resp.Diagnostics.AddWarning("Client Warning", fmt.Sprintf("Expected Wasm module sha %s does not match canister info sha %s. Please inspect canister", wasmSha256, canisterInfo.WasmSha256))
+		}
+	}
+
+	// If the sha wasn't specified by the user (or technically also if set to the empty string), then we set it here.
+	if len(wasmSha256) == 0 {
+		data.WasmSha256 = types.StringValue(canisterInfo.WasmSha256)
+	}
+
+	// XXX: we set controllers at the very end so that e.g. blackhole code can be installed beforehand
+	// NOTE: we do not test the creation of blackhole canisters because the terraform testing framework
+	// does not support resources that can't be deleted, so this is really best effort:
+	//   * https://github.com/hashicorp/terraform-plugin-testing/issues/85
+
+	// Controllers
+
+	err = data.InferDefaultControllers(ctx, r.ProviderPrincipal())
+	if err != nil {
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, fmt.Errorf("Could not update controllers: %w", err))
+		return
+	}
+
+	controllers, err := data.StringControllers(ctx, r.config)
+	if err != nil {
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, fmt.Errorf("Could not update controllers: %w", err))
+		return
+	}
+
+	// We did just call InferDefaultControllers, so if the controllers are not set this is a bad bug
+	if controllers == nil {
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, errors.New("Controllers not set"))
+		return
+	}
+
+	// Controllers may only be known at apply time, so check again
+	err = data.CheckMinControllers(controllers)
+	if err != nil {
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, fmt.Errorf("Could not update controllers: %w", err))
+		return
+	}
+
+	// Settings are updated before the controllers, which may not include the provider anymore
+	quotaSettings, diags := r.supportedQuotaRawSettings(canisterId, quotas)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, errors.New("Settings not updated"))
+		return
+	}
+	natSettings, diags := data.natRawSettings(nil)
+	resp.Diagnostics.Append(diags...)
+	logVisibility, diags := data.logVisibilityRawSettings(ctx, nil)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, errors.New("Settings not updated"))
+		return
+	}
+	if rawSettings == nil {
+		rawSettings = map[string]string{}
+	}
+	maps.Copy(rawSettings, quotaSettings)
+	maps.Copy(rawSettings, natSettings)
+	maps.Copy(rawSettings, logVisibility)
+
+	err = r.setCanisterRawSettings(ctx, canisterId, rawSettings)
+	if err != nil {
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, fmt.Errorf("Could not update settings: %w", err))
+		return
+	}
+
+	// The balance is read (and topped up) while the provider still controls the canister
+	resp.Diagnostics.Append(r.ensureCyclesBalance(ctx, &data, canisterId, resp.Private)...)
+	if resp.Diagnostics.HasError() {
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, errors.New("Cycles balance not checked"))
+		return
+	}
+
+	err = r.setCanisterControllers(ctx, canisterId.Encode(), controllers)
+	if err != nil {
+		r.checkpointCreation(ctx, &data, resp, codeInstalled, fmt.Errorf("Could not update controllers: %w", err))
+		return
+	}
+
+	// Outputs are read last, once the canister is fully set up. The canister exists
+	// at this point so the state is saved even if reading the outputs fails.
+	resp.Diagnostics.Append(r.readOutputValues(ctx, &data)...)
+
+	r.recordApplySummary(ctx, &data, &resp.Diagnostics)
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *CanisterResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data CanisterResourceModel
+	tflog.Info(ctx, "Reading canister")
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	r, diags := r.withOverrides(&data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Imported canisters (and canisters created by older versions of the provider)
+	// don't have refunds recorded
+	data.InferCmcRefunds()
+
+	// If a previous creation could not claim the canister from the CMC, try again
+	if data.Id.IsNull() && r.refreshMode != refreshModeOff {
+		resp.Diagnostics.Append(r.resumePendingClaim(ctx, &data, resp.Private)...)
+		if resp.Diagnostics.HasError() {
 			return
 		}
+	}
+
+	if !data.Id.IsNull() && r.refreshMode == refreshModeFull {
+		resp.Diagnostics.Append(r.refreshCanisterInfo(ctx, &data)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	// The balance is refreshed in every refresh mode but off, so that canisters running
+	// low on cycles are topped up on the next apply. So are the output values, which are
+	// read with a single query.
+	if !data.Id.IsNull() && r.refreshMode != refreshModeOff {
+		resp.Diagnostics.Append(r.refreshCyclesBalance(ctx, &data)...)
+		resp.Diagnostics.Append(r.refreshOutputValues(ctx, &data)...)
+	}
+
+	// Save updated data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Updates the controllers and module hash with the canister's actual ones, so that changes
+// made outside of Terraform show up in the plan. The module hash is left as is when
+// metadata is injected, since the installed module then differs from wasm_file.
+func (r *CanisterResource) refreshCanisterInfo(ctx context.Context, data *CanisterResourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
 
+	canisterId, err := principal.Decode(data.Id.ValueString())
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not decode canister id", err))
+		return diags
 	}
 
 	canisterInfo, err := r.ReadCanisterInfo(ctx, canisterId)
 	if err != nil {
-		resp.Diagnostics.AddError("Client Error", "Could not read canister info: "+err.Error())
+		diags.AddWarning("Could not refresh canister", fmt.Sprintf("Could not read the controllers and module hash of canister %s, drift is not detected: %s", canisterId.Encode(), err.Error()))
+		return diags
+	}
+
+	if !data.Controllers.IsNull() && !data.Controllers.IsUnknown() {
+		var controllers []string
+		diags.Append(data.Controllers.ElementsAs(ctx, &controllers, false)...)
+		if diags.HasError() {
+			return diags
+		}
+
+		// Only the set of controllers matters, so the order in the state is kept if possible
+		if !sameStrings(controllers, canisterInfo.Controllers) {
+			tflog.Info(ctx, fmt.Sprintf("Controllers of %s changed to %v", canisterId.Encode(), canisterInfo.Controllers))
+			var d diag.Diagnostics
+			data.Controllers, d = types.ListValueFrom(ctx, types.StringType, canisterInfo.Controllers)
+			diags.Append(d...)
+		}
+	}
+
+	if !data.WasmSha256.IsNull() && !data.WasmSha256.IsUnknown() && !data.InjectsMetadata() &&
+		!strings.EqualFold(data.WasmSha256.ValueString(), canisterInfo.WasmSha256) {
+		tflog.Info(ctx, fmt.Sprintf("Module hash of %s changed to %s", canisterId.Encode(), canisterInfo.WasmSha256))
+		data.WasmSha256 = types.StringValue(canisterInfo.WasmSha256)
+	}
+
+	// Only controllers can read the settings, which proxies (and not the provider) are
+	hasRawSettings := !data.RawSettings.IsNull() && !data.RawSettings.IsUnknown()
+	hasQuotas := !data.Quotas.IsNull() && !data.Quotas.IsUnknown()
+	hasLogVisibility := !data.LogVisibility.IsNull() && !data.LogVisibility.IsUnknown()
+	if (hasRawSettings || hasQuotas || hasLogVisibility || data.hasNatSettings()) && r.proxy == nil {
+		diags.Append(r.refreshSettings(ctx, data, canisterId)...)
+	}
+
+	return diags
+}
+
+// Reads the status of the canister with canister_status, decoded generically so that the
+// settings unknown to agent-go are included.
+func (r *CanisterResource) readCanisterStatusRaw(canisterId principal.Principal) (idl.Type, any, error) {
+	arg, err := idl.Marshal([]any{icMgmt.CanisterStatusArgs{CanisterId: canisterId}})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not encode canister_status argument: %w", err)
+	}
+
+	raw, err := CallRawWithEffectiveId(*r.config, canisterId, ic.MANAGEMENT_CANISTER_PRINCIPAL, "canister_status", arg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tys, values, err := idl.Decode(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(values) == 0 {
+		return nil, nil, fmt.Errorf("empty canister_status result")
+	}
+	return tys[0], values[0], nil
+}
+
+// Updates the raw settings, quotas and first-class settings with the canister's actual
+// ones, read with canister_status.
+func (r *CanisterResource) refreshSettings(ctx context.Context, data *CanisterResourceModel, canisterId principal.Principal) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	statusType, status, err := r.readCanisterStatusRaw(canisterId)
+	if err != nil {
+		diags.AddWarning("Could not refresh canister settings", fmt.Sprintf("Could not read the settings of canister %s, drift of the settings is not detected: %s", canisterId.Encode(), err.Error()))
+		return diags
+	}
+
+	diags.Append(data.refreshRawSettings(ctx, canisterId, statusType, status)...)
+	diags.Append(data.refreshQuotas(ctx, statusType, status)...)
+	data.refreshNatSettings(ctx, status)
+	diags.Append(data.refreshLogVisibility(ctx, status)...)
+	return diags
+}
+
+// Updates the raw settings with the canister's actual ones, given the decoded
+// canister_status result.
+func (data *CanisterResourceModel) refreshRawSettings(ctx context.Context, canisterId principal.Principal, statusType idl.Type, status any) diag.Diagnostics {
+	rawSettings, diags := data.StringRawSettings(ctx)
+	if diags.HasError() || len(rawSettings) == 0 {
+		return diags
+	}
+
+	for name, value := range rawSettings {
+		if current, ok := currentRawSetting(statusType, status, name, value); ok && current != value {
+			tflog.Info(ctx, fmt.Sprintf("Setting %s of %s changed to %s", name, canisterId.Encode(), current))
+			rawSettings[name] = current
+		}
+	}
+
+	var d diag.Diagnostics
+	data.RawSettings, d = types.MapValueFrom(ctx, types.StringType, rawSettings)
+	diags.Append(d...)
+	return diags
+}
+
+// Returns the raw settings setting the quotas that the network supports, warning about the
+// others. Support is detected with canister_status, except through proxies, which are
+// controllers instead of the provider: all quotas are then sent, and ignored by networks
+// that don't support them.
+func (r *CanisterResource) supportedQuotaRawSettings(canisterId principal.Principal, quotas map[string]int64) (map[string]string, diag.Diagnostics) {
+	if len(quotas) == 0 {
+		return nil, nil
+	}
+
+	var statusType idl.Type
+	if r.proxy == nil {
+		var err error
+		statusType, _, err = r.readCanisterStatusRaw(canisterId)
+		if err != nil {
+			var diags diag.Diagnostics
+			diags.Append(clientErrorDiagnostic(fmt.Sprintf("Could not read the settings supported by the network (with the status of canister %s)", canisterId.Encode()), err))
+			return nil, diags
+		}
+	}
+
+	return quotaRawSettings(statusType, quotas)
+}
+
+// Returns true if a and b contain the same strings, regardless of their order.
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := map[string]int{}
+	for _, s := range a {
+		counts[s]++
+	}
+	for _, s := range b {
+		counts[s]--
+		if counts[s] < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The private state key marking a canister whose creation failed after the canister was
+// created (e.g. while installing the code), and which must be resumed with an update.
+const privateKeyCreationCheckpoint = "creation_checkpoint"
+
+// Saves the canister whose creation failed with err in the (tainted) state, so that
+// the creation can be resumed instead of orphaning the canister. The state reflects what
+// was actually done: the controllers are not set yet (they are set last) and the code is
+// only installed if codeInstalled is true.
+func (r *CanisterResource) checkpointCreation(ctx context.Context, data *CanisterResourceModel, resp *resource.CreateResponse, codeInstalled bool, err error) {
+	if !codeInstalled {
+		data.WasmSha256 = types.StringValue("")
+		data.ArgSha256 = types.StringNull()
+	} else if data.WasmSha256.IsUnknown() {
+		// Installed, but not read back; the code is installed again when resuming
+		data.WasmSha256 = types.StringValue("")
+	}
+	if data.ArgSha256.IsUnknown() {
+		data.ArgSha256 = types.StringNull()
+	}
+
+	data.Controllers = types.ListValueMust(types.StringType, []attr.Value{types.StringValue(r.ProviderPrincipal())})
+	data.OutputValues = types.MapNull(types.StringType)
+	if data.CyclesBalance.IsUnknown() {
+		data.CyclesBalance = types.Int64Null()
+	}
+
+	checkpoint, errCheckpoint := json.Marshal(map[string]string{"canister_id": data.Id.ValueString()})
+	if errCheckpoint != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not write creation checkpoint to private state", errCheckpoint))
+	} else {
+		resp.Diagnostics.Append(resp.Private.SetKey(ctx, privateKeyCreationCheckpoint, checkpoint)...)
+	}
+
+	resp.Diagnostics.Append(clientErrorDiagnostic("", fmt.Errorf("%w. Canister %s was created and saved in the state; "+
+		"the creation can be resumed by running `terraform untaint` on this resource and applying again.", err, data.Id.ValueString())))
+	resp.Diagnostics.Append(resp.State.Set(ctx, data)...)
+}
+
+// Returns true if the creation of the canister must be resumed (see checkpointCreation).
+func hasCreationCheckpoint(ctx context.Context, private privateState) (bool, diag.Diagnostics) {
+	checkpoint, diags := private.GetKey(ctx, privateKeyCreationCheckpoint)
+	return checkpoint != nil, diags
+}
+
+// Resumes the canister claim stored in the private state (if any) and sets the canister
+// id on success. Failing to claim the canister is only reported as a warning.
+func (r *CanisterResource) resumePendingClaim(ctx context.Context, data *CanisterResourceModel, private privateState) diag.Diagnostics {
+	claim, diags := readPendingClaim(ctx, private)
+	if diags.HasError() || claim == nil {
+		return diags
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("Resuming canister claim for block %d", claim.BlockIndex))
+
+	canisterId, err := notifyCreateCanister(ctx, *r.config, *claim)
+
+	var refundErr *CmcRefundError
+	if errors.As(err, &refundErr) {
+		// The claim is over, the ICP were refunded
+		diags.AddWarning("Client Warning", "Could not resume canister creation: "+err.Error())
+		diags.Append(r.appendCmcRefund(data, "", refundErr.Refund)...)
+		diags.Append(writePendingClaim(ctx, private, nil)...)
+		return diags
+	}
+
+	if err != nil {
+		diags.AddWarning("Client Warning", "Could not resume canister creation: "+err.Error())
+		return diags
+	}
+
+	tflog.Info(ctx, "Claimed canister: "+canisterId.Encode())
+	data.Id = types.StringValue(canisterId.Encode())
+
+	diags.Append(writePendingClaim(ctx, private, nil)...)
+	return diags
+}
+
+// XXX: this is NOT atomic.
+func (r *CanisterResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data CanisterResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.readOnly != readWrite {
+		resp.Diagnostics.Append(r.readOnly.diagnostic("update canister " + data.Id.ValueString()))
+		return
+	}
+
+	r, diags := r.withOverrides(&data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("Updating to new data: %s", data))
+
+	var state CanisterResourceModel
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	if resp.Diagnostics.HasError() {
 		return
 	}
 
-	if doInstallCode {
-		// If we installed the code, and wasm_sha256 was set, we expect it to match
-		// that of the newly created canister.
+	// A change of subnet planned the id of the canister it is migrated to (see
+	// planSubnetChange)
+	migrate := data.Id.IsUnknown() && !state.Id.IsNull()
+	if migrate {
+		data.Id = state.Id
+	}
 
-		if len(wasmSha256) > 0 && wasmSha256 != canisterInfo.WasmSha256 {
-			resp.Diagnostics.AddWarning("Client Warning", fmt.Sprintf("Expected Wasm module sha %s does not match canister info sha %s. Please inspect canister", wasmSha256, canisterInfo.WasmSha256))
+	// If the canister could not be claimed during creation (and not during refresh
+	// either), try one last time
+	if data.Id.IsNull() || data.Id.IsUnknown() {
+		data.Id = types.StringNull()
+		resp.Diagnostics.Append(r.resumePendingClaim(ctx, &data, resp.Private)...)
+		if resp.Diagnostics.HasError() {
+			return
 		}
-	}
 
-	// If the sha wasn't specified by the user (or technically also if set to the empty string), then we set it here.
-	if len(wasmSha256) == 0 {
-		data.WasmSha256 = types.StringValue(canisterInfo.WasmSha256)
+		if data.Id.IsNull() {
+			resp.Diagnostics.AddError("Client Error", "Canister was not created and cannot be updated")
+			return
+		}
 	}
 
-	// XXX: we set controllers at the very end so that e.g. blackhole code can be installed beforehand
-	// NOTE: we do not test the creation of blackhole canisters because the terraform testing framework
-	// does not support resources that can't be deleted, so this is really best effort:
-	//   * https://github.com/hashicorp/terraform-plugin-testing/issues/85
+	canisterId := data.Id.ValueString()
 
-	// Controllers
+	data.InferCmcRefunds()
 
-	err = data.InferDefaultControllers(ctx, r.config)
+	err := r.lock.Acquire(ctx, canisterId)
 	if err != nil {
-		resp.Diagnostics.AddError("Client Error", "Could not update controllers: "+err.Error())
+		resp.Diagnostics.Append(clientErrorDiagnostic("", err))
 		return
 	}
+	defer r.releaseLock(ctx, canisterId, &resp.Diagnostics)
+
+	// Controllers
 
 	controllers, err := data.StringControllers(ctx, r.config)
 	if err != nil {
-		resp.Diagnostics.AddError("Client Error", "Could not update controllers: "+err.Error())
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not update controllers", err))
 		return
 	}
 
-	// We did just call InferDefaultControllers, so if the controllers are not set this is a bad bug
+	// Here we don't expect nil (unknown/null) controllers. We only expect unknown or null controllers
+	// during the initial creation.
 	if controllers == nil {
 		resp.Diagnostics.AddError("Client Error", "Controllers not set")
 		return
 	}
 
-	err = r.setCanisterControllers(canisterId.Encode(), controllers)
+	err = data.CheckMinControllers(controllers)
 	if err != nil {
-		resp.Diagnostics.AddError("Client Error", "Could not update controllers: "+err.Error())
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not update controllers", err))
 		return
 	}
 
-	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
-}
-
-func (r *CanisterResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
-	var data CanisterResourceModel
-	tflog.Info(ctx, "Reading canister")
-
-	// Read Terraform prior state data into the model
-	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
-
+	// Only the settings that changed are sent to update_settings, which leaves the others as
+	// they are. Everything is sent when resuming an interrupted creation, which may have
+	// failed before the settings were updated.
+	resume, diags := hasCreationCheckpoint(ctx, req.Private)
+	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
+	resume = resume || state.Id.IsNull()
 
-	// Save updated data into Terraform state
-	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
-}
+	if migrate {
+		canisterIdP, err := principal.Decode(canisterId)
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode canister id", err))
+			return
+		}
+		subnetId, err := principal.Decode(data.SubnetId.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("subnet_id"), "Client Error", "Could not decode subnet id: "+err.Error())
+			return
+		}
 
-// XXX: this is NOT atomic.
-func (r *CanisterResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
-	var data CanisterResourceModel
+		migratedId, diags := r.migrateCanister(ctx, &data, canisterIdP, subnetId, resp.Private)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			// The canister is unchanged, but the CMC may have refunded the ICP paid for the
+			// new canister
+			state.CmcRefunds = data.CmcRefunds
+			resp.Diagnostics.Append(resp.State.Set(ctx, &state)...)
+			return
+		}
+		r.removeFromApplySummary(canisterId, &resp.Diagnostics)
 
-	// Read Terraform plan data into the model
-	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+		// The new canister is set up like a new one, with all the settings and controllers
+		data.setMigratedCanister(migratedId, r.ProviderPrincipal())
+		canisterId = migratedId.Encode()
+		resume = true
+	}
 
+	rawSettings, diags := data.StringRawSettings(ctx)
+	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
+	if !resume {
+		priorRawSettings, diags := state.StringRawSettings(ctx)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		rawSettings = changedRawSettings(rawSettings, priorRawSettings)
+	}
 
-	tflog.Info(ctx, fmt.Sprintf("Updating to new data: %s", data))
+	quotas, diags := data.Int64Quotas(ctx)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	if !resume {
+		priorQuotas, diags := state.Int64Quotas(ctx)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		quotas = changedQuotas(quotas, priorQuotas)
+	}
 
-	canisterId := data.Id.ValueString()
+	var priorState *CanisterResourceModel
+	if !resume {
+		priorState = &state
+	}
+	natSettings, diags := data.natRawSettings(priorState)
+	resp.Diagnostics.Append(diags...)
+	logVisibility, diags := data.logVisibilityRawSettings(ctx, priorState)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
 
-	// Controllers
+	// Settings are updated before the controllers, which may not include the provider anymore
+	if len(rawSettings) > 0 || len(quotas) > 0 || len(natSettings) > 0 || len(logVisibility) > 0 {
+		canisterIdP, err := principal.Decode(canisterId)
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode canister id", err))
+			return
+		}
 
-	controllers, err := data.StringControllers(ctx, r.config)
-	if err != nil {
-		resp.Diagnostics.AddError("Client Error", "Could not update controllers: "+err.Error())
-		return
+		quotaSettings, diags := r.supportedQuotaRawSettings(canisterIdP, quotas)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		if rawSettings == nil {
+			rawSettings = map[string]string{}
+		}
+		maps.Copy(rawSettings, quotaSettings)
+		maps.Copy(rawSettings, natSettings)
+		maps.Copy(rawSettings, logVisibility)
+
+		err = r.setCanisterRawSettings(ctx, canisterIdP, rawSettings)
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not update settings", err))
+			return
+		}
 	}
 
-	// Here we don't expect nil (unknown/null) controllers. We only expect unknown or null controllers
-	// during the initial creation.
-	if controllers == nil {
-		resp.Diagnostics.AddError("Client Error", "Controllers not set")
-		return
+	var priorControllers []string
+	if !resume && !state.Controllers.IsNull() && !state.Controllers.IsUnknown() {
+		resp.Diagnostics.Append(state.Controllers.ElementsAs(ctx, &priorControllers, false)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
 	}
 
-	err = r.setCanisterControllers(canisterId, controllers)
-	if err != nil {
-		resp.Diagnostics.AddError("Client Error", "Could not update controllers: "+err.Error())
-		return
+	if priorControllers != nil && sameStrings(controllers, priorControllers) {
+		tflog.Info(ctx, "Controllers are unchanged, skipping update_settings")
+	} else {
+		err = r.setCanisterControllers(ctx, canisterId, controllers)
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not update controllers", err))
+			return
+		}
 	}
 
 	// Code install & args
@@ -542,33 +2081,101 @@ func (r *CanisterResource) Update(ctx context.Context, req resource.UpdateReques
 	if data.WasmFile.IsNull() {
 		// If there is no wasm, then we uninstall the canister (idempotent)
 
-		err = r.setCanisterEmpty(canisterId)
+		err = r.setCanisterEmpty(ctx, canisterId)
 		if err != nil {
-			resp.Diagnostics.AddError("Client Error", "Could not uninstall code: "+err.Error())
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not uninstall code", err))
 			return
 		}
 
 		// Update the value (instead of keeping it potentially "unknown")
 		data.WasmSha256 = types.StringValue("")
+		data.ArgSha256 = types.StringNull()
 
 	} else {
 		// If wasm is set, then install it with the given args (idempotent)
 
 		argHex, err := data.GetArgHex(ctx)
 		if err != nil {
-			resp.Diagnostics.AddError("Client Error", "Could not read argument: "+err.Error())
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not read argument", err))
 			return
 		}
 
-		wasmFile := data.WasmFile.ValueString()
-		wasmSha256 := data.WasmSha256.ValueString()
-		err = r.setCanisterCode(ctx, canisterId, argHex, wasmFile, wasmSha256)
+		data.ArgSha256 = types.StringValue(ArgSha256(argHex))
+
+		if data.CodeUnchanged(ctx, &state, argHex) {
+			// Different spellings of the same argument (e.g. wrapped vs unwrapped) should not
+			// trigger an upgrade
+			tflog.Info(ctx, "Module and argument are unchanged, skipping install")
+		} else {
+			labels, diags := data.StringLabels(ctx)
+			resp.Diagnostics.Append(diags...)
+			if resp.Diagnostics.HasError() {
+				return
+			}
+
+			wasmFile := data.WasmFile.ValueString()
+			wasmSha256 := data.WasmSha256.ValueString()
+			upgrade := func() error {
+				return r.setCanisterCode(ctx, canisterId, argHex, wasmFile, wasmSha256, labels, data.StringPublicMetadata())
+			}
+			if r.rollout != nil {
+				// Upgrades of the fleet are paced (and halted on failure) by the rollout
+				var canisterIdP principal.Principal
+				canisterIdP, err = principal.Decode(canisterId)
+				if err == nil {
+					err = r.rollout.Upgrade(ctx, canisterIdP, upgrade)
+				}
+			} else {
+				err = upgrade()
+			}
+			if err != nil {
+				resp.Diagnostics.Append(clientErrorDiagnostic("Could not update code", err))
+				return
+			}
+
+			// As on creation, the sha is read back if it wasn't specified (e.g. when
+			// resuming an interrupted creation)
+			if len(wasmSha256) == 0 {
+				canisterIdP, err := principal.Decode(canisterId)
+				if err != nil {
+					resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode canister id", err))
+					return
+				}
+
+				canisterInfo, err := r.ReadCanisterInfo(ctx, canisterIdP)
+				if err != nil {
+					resp.Diagnostics.Append(clientErrorDiagnostic("Could not read canister info", err))
+					return
+				}
+				data.WasmSha256 = types.StringValue(canisterInfo.WasmSha256)
+			}
+		}
+	}
+
+	// The balance is only planned as unknown when minimum_cycles is added, or when the
+	// refreshed balance is below minimum_cycles; otherwise the planned balance is kept
+	if data.CyclesBalance.IsUnknown() {
+		canisterIdP, err := principal.Decode(canisterId)
 		if err != nil {
-			resp.Diagnostics.AddError("Client Error", "Could not update code: "+err.Error())
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode canister id", err))
+			return
+		}
+		resp.Diagnostics.Append(r.ensureCyclesBalance(ctx, &data, canisterIdP, resp.Private)...)
+		if resp.Diagnostics.HasError() {
+			// The prior state is kept, with the refund of the top-up (if any)
+			state.CmcRefunds = data.CmcRefunds
+			resp.Diagnostics.Append(resp.State.Set(ctx, &state)...)
 			return
 		}
 	}
 
+	resp.Diagnostics.Append(r.readOutputValues(ctx, &data)...)
+
+	// The creation (if it was interrupted) is now complete
+	resp.Diagnostics.Append(resp.Private.SetKey(ctx, privateKeyCreationCheckpoint, nil)...)
+
+	r.recordApplySummary(ctx, &data, &resp.Diagnostics)
+
 	// Save updated data into Terraform state
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 
@@ -576,9 +2183,10 @@ func (r *CanisterResource) Update(ctx context.Context, req resource.UpdateReques
 }
 
 // Ensures the canister is empty (no code installed).
-func (r *CanisterResource) setCanisterEmpty(canisterId string) error {
+func (r *CanisterResource) setCanisterEmpty(ctx context.Context, canisterId string) (err error) {
+	defer r.metrics.Time(ctx, "uninstall_code", canisterId)(&err)
 
-	agent, err := icMgmt.NewAgent(ic.MANAGEMENT_CANISTER_PRINCIPAL, *r.config)
+	agent, err := newManagementAgent(ctx, *r.config, r.proxy)
 	if err != nil {
 		return fmt.Errorf("Uninstalling canister: Could not create agent: %w", err)
 	}
@@ -620,14 +2228,90 @@ func CanisterInstallModeUpgrade() icMgmt.CanisterInstallMode {
 	}
 }
 
+// Returns true if the code installed according to the state is the same as the planned
+// code, i.e. if the module and injected metadata are the same and the arguments (argHex,
+// the planned hex-encoded arguments) are semantically equal. If the module hash is not
+// known (not specified by the user) the code is assumed to have changed.
+func (data *CanisterResourceModel) CodeUnchanged(ctx context.Context, state *CanisterResourceModel, argHex string) bool {
+	// NOTE: we don't compare wasm_file, since the hash identifies the module (see
+	// planWasmSha256): moving or renaming the file doesn't change the code
+	if data.WasmSha256.IsUnknown() || data.WasmSha256.ValueString() == "" || !data.WasmSha256.Equal(state.WasmSha256) {
+		return false
+	}
+
+	// The labels and public metadata are part of the installed module
+	if !data.Labels.Equal(state.Labels) || !data.PublicMetadata.Equal(state.PublicMetadata) {
+		return false
+	}
+
+	// The content of arg_file may have changed since the last apply (and imported canisters
+	// may only advertise the hash of their arguments), so we compare the hash of the
+	// arguments that were installed instead
+	stateArgInline := !state.Arg.IsNull() || !state.ArgHex.IsNull()
+	if !state.ArgFile.IsNull() || !data.ArgFile.IsNull() || (!stateArgInline && !state.ArgSha256.IsNull()) {
+		return !state.ArgSha256.IsNull() && state.ArgSha256.ValueString() == ArgSha256(argHex)
+	}
+
+	stateArgHex, err := state.GetArgHex(ctx)
+	if err != nil {
+		return false
+	}
+
+	return ArgsEquivalent(argHex, stateArgHex)
+}
+
+// Returns the (hex-encoded) sha256 of the hex-encoded arguments.
+func ArgSha256(argHex string) string {
+	argRaw, err := hex.DecodeString(argHex)
+	if err != nil {
+		// Invalid hex is reported when installing the code
+		argRaw = []byte(argHex)
+	}
+
+	argSha256 := sha256.Sum256(argRaw)
+	return hex.EncodeToString(argSha256[:])
+}
+
+// Returns true if the argument is fully known. Arguments may reference values that are
+// only known at apply time, like the id of another canister created in the same apply.
+func (data *CanisterResourceModel) ArgIsKnown(ctx context.Context) bool {
+	if data.ArgHex.IsUnknown() || data.Arg.IsUnknown() || data.ArgFile.IsUnknown() {
+		return false
+	}
+
+	if data.Arg.IsNull() {
+		return true
+	}
+
+	tfVal, err := data.Arg.ToTerraformValue(ctx)
+	if err != nil {
+		return false
+	}
+
+	return tfVal.IsFullyKnown()
+}
+
 // Returns the candid argument, hex-encoded.
 func (data *CanisterResourceModel) GetArgHex(ctx context.Context) (string, error) {
 
+	// Unknown values cannot be encoded; this should only happen during planning
+	if !data.ArgIsKnown(ctx) {
+		return "", fmt.Errorf("argument is not known yet")
+	}
+
 	// If encoded arguments were provided, use that
 	if !data.ArgHex.IsNull() {
 		return data.ArgHex.ValueString(), nil
 	}
 
+	if !data.ArgFile.IsNull() {
+		argRaw, err := os.ReadFile(data.ArgFile.ValueString())
+		if err != nil {
+			return "", fmt.Errorf("Could not read arg_file: %w", err)
+		}
+		return hex.EncodeToString(argRaw), nil
+	}
+
 	// If no args are set, use the empty bytestring (hex encoding: empty string)
 	if data.Arg.IsNull() {
 		return "", nil
@@ -656,14 +2340,15 @@ func (data *CanisterResourceModel) GetArgHex(ctx context.Context) (string, error
 
 // NOTE: this checks that the wasm file contents have the given checksum and returns an error
 // otherwise.
-func (r *CanisterResource) setCanisterCode(ctx context.Context, canisterId string, argHex string, wasmFile string, wasmSha256 string) error {
+func (r *CanisterResource) setCanisterCode(ctx context.Context, canisterId string, argHex string, wasmFile string, wasmSha256 string, labels map[string]string, publicMetadata map[string]string) (err error) {
+	defer r.metrics.Time(ctx, "install_code", canisterId)(&err)
 
 	installMode, err := r.InferInstallMode(ctx, canisterId)
 	if err != nil {
 		return fmt.Errorf("Could not infer install mode: %w", err)
 	}
 
-	agent, err := icMgmt.NewAgent(ic.MANAGEMENT_CANISTER_PRINCIPAL, *r.config)
+	agent, err := newManagementAgent(ctx, *r.config, r.proxy)
 	if err != nil {
 		return fmt.Errorf("Could not create agent: %w", err)
 	}
@@ -687,6 +2372,16 @@ func (r *CanisterResource) setCanisterCode(ctx context.Context, canisterId strin
 		}
 	}
 
+	wasmModule, err = wasmModuleWithLabels(wasmModule, labels)
+	if err != nil {
+		return fmt.Errorf("Could not add labels to wasm module: %w", err)
+	}
+
+	wasmModule, err = wasmModuleWithPublicMetadata(wasmModule, publicMetadata)
+	if err != nil {
+		return fmt.Errorf("Could not add public metadata to wasm module: %w", err)
+	}
+
 	argRaw, err := hex.DecodeString(argHex)
 	if err != nil {
 		return err
@@ -699,6 +2394,11 @@ func (r *CanisterResource) setCanisterCode(ctx context.Context, canisterId strin
 		Arg:        argRaw,
 	}
 
+	if r.streamCanisterLogs {
+		stop := streamCanisterLogs(ctx, *r.config, canisterIdP)
+		defer stop()
+	}
+
 	err = agent.InstallCode(installCodeArgs)
 	if err != nil {
 		return fmt.Errorf("Could not install code: %w", err)
@@ -707,9 +2407,10 @@ func (r *CanisterResource) setCanisterCode(ctx context.Context, canisterId strin
 	return nil
 }
 
-func (r *CanisterResource) setCanisterControllers(canisterId string, controllers []string) error {
+func (r *CanisterResource) setCanisterControllers(ctx context.Context, canisterId string, controllers []string) (err error) {
+	defer r.metrics.Time(ctx, "update_settings", canisterId)(&err)
 
-	agent, err := icMgmt.NewAgent(ic.MANAGEMENT_CANISTER_PRINCIPAL, *r.config)
+	agent, err := newManagementAgent(ctx, *r.config, r.proxy)
 	if err != nil {
 		return err
 	}
@@ -745,6 +2446,28 @@ func (r *CanisterResource) setCanisterControllers(canisterId string, controllers
 	return nil
 }
 
+// Sets the settings of the canister without a dedicated attribute to their raw values, if
+// any. The other settings are left unchanged.
+func (r *CanisterResource) setCanisterRawSettings(ctx context.Context, canisterId principal.Principal, settings map[string]string) (err error) {
+	if len(settings) == 0 {
+		return nil
+	}
+
+	defer r.metrics.Time(ctx, "update_settings", canisterId.Encode())(&err)
+
+	agent, err := newManagementAgent(ctx, *r.config, r.proxy)
+	if err != nil {
+		return err
+	}
+
+	arg, err := encodeRawUpdateSettings(canisterId, settings)
+	if err != nil {
+		return err
+	}
+
+	return agent.UpdateSettingsRaw(canisterId, arg)
+}
+
 func (r *CanisterResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
 	var data CanisterResourceModel
 
@@ -755,29 +2478,223 @@ func (r *CanisterResource) Delete(ctx context.Context, req resource.DeleteReques
 		return
 	}
 
+	if r.readOnly != readWrite {
+		resp.Diagnostics.Append(r.readOnly.diagnostic("delete canister " + data.Id.ValueString()))
+		return
+	}
+
+	r, diags := r.withOverrides(&data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if data.Id.IsNull() {
+		// The canister was never claimed from the CMC. Refuse to forget about it, since
+		// this would strand the ICP that were transferred.
+		claim, diags := readPendingClaim(ctx, req.Private)
+		resp.Diagnostics.Append(diags...)
+		if claim != nil {
+			resp.Diagnostics.AddError("Client Error", fmt.Sprintf("The canister paid for by the ICP transfer at block %d was never claimed. "+
+				"Run `terraform untaint` on this resource and apply again to resume the creation, or remove the resource from the state to abandon it.", claim.BlockIndex))
+		}
+		return
+	}
+
 	canisterId, err := principal.Decode(data.Id.ValueString())
 	if err != nil {
-		resp.Diagnostics.AddError("Client Error", fmt.Errorf("Could not parse canister ID: %w", err).Error())
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not parse canister ID", err))
 		return
 	}
 
-	agent, err := icMgmt.NewAgent(ic.MANAGEMENT_CANISTER_PRINCIPAL, *r.config)
+	err = r.lock.Acquire(ctx, canisterId.Encode())
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("", err))
+		return
+	}
+	defer r.releaseLock(ctx, canisterId.Encode(), &resp.Diagnostics)
+
+	var guard *principal.Principal
+	if !data.DeletionGuard.IsNull() {
+		guardId, err := principal.Decode(data.DeletionGuard.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("deletion_guard"), "Client Error", "Could not decode deletion guard: "+err.Error())
+			return
+		}
+
+		// The canister is left running until its deletion is unlocked, so that it can
+		// still be cancelled without an outage
+		unlocksAt, err := requestGuardedDeletion(*r.config, guardId, canisterId)
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not request deletion from deletion guard (the canister was not deleted)", err))
+			return
+		}
+		if time.Now().Before(unlocksAt) {
+			resp.Diagnostics.AddError("Deletion locked",
+				fmt.Sprintf("The deletion of canister %s was requested from its deletion guard %s, which unlocks it at %s. "+
+					"Apply again after that time to delete the canister, or cancel the deletion with the guard to keep it. The canister was left running.",
+					canisterId.Encode(), guardId.Encode(), unlocksAt.UTC().Format(time.RFC3339)))
+			return
+		}
+		guard = &guardId
+	}
+
+	agent, err := newManagementAgent(ctx, *r.config, r.proxy)
 	if err != nil {
-		resp.Diagnostics.AddError("Client Error", fmt.Errorf("Could not create agent: %w", err).Error())
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not create agent", err))
 		return
 	}
 
+	// Stopping a stopped canister succeeds, so only canisters that were already deleted
+	// (e.g. by an operator) need special handling
 	err = agent.StopCanister(icMgmt.StopCanisterArgs{CanisterId: canisterId})
+	if isCanisterNotFound(err) {
+		tflog.Warn(ctx, "Canister "+canisterId.Encode()+" was already deleted: "+err.Error())
+		resp.Diagnostics.AddWarning("Canister already deleted",
+			fmt.Sprintf("Canister %s does not exist anymore, it is removed from the state.", canisterId.Encode()))
+		r.removeFromApplySummary(canisterId.Encode(), &resp.Diagnostics)
+		return
+	}
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not stop canister before deletion", err))
+		return
+	}
+
+	if !data.CyclesBeneficiary.IsNull() {
+		beneficiary, err := principal.Decode(data.CyclesBeneficiary.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("cycles_beneficiary"), "Client Error", "Could not decode cycles beneficiary: "+err.Error())
+			return
+		}
+
+		// Don't delete the canister if the cycles could not be withdrawn, since they would be lost
+		err = withdrawCycles(ctx, *r.config, r.proxy, canisterId, beneficiary)
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not withdraw cycles before deletion (the canister was not deleted)", err))
+			return
+		}
+	}
+
+	done := r.metrics.Time(ctx, "delete_canister", canisterId.Encode())
+	if guard != nil {
+		err = guardedDeleteCanister(*r.config, *guard, canisterId)
+	} else {
+		err = agent.DeleteCanister(icMgmt.DeleteCanisterArgs{CanisterId: canisterId})
+	}
+	done(&err)
+	if isCanisterNotFound(err) {
+		// Deleted concurrently, e.g. by a retried request
+		tflog.Warn(ctx, "Canister "+canisterId.Encode()+" was already deleted: "+err.Error())
+		err = nil
+	}
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not delete canister", err))
+		return
+	}
+
+	r.removeFromApplySummary(canisterId.Encode(), &resp.Diagnostics)
+}
+
+// Returns true if the error is the rejection of a call to a canister that doesn't exist:
+// a reject with code 3 (DESTINATION_INVALID) and error code IC0301 (or, without error code,
+// the message of IC0301), the same reject forwarded by a cycles wallet, or the error of the
+// boundary nodes, which don't route calls to canisters that don't exist.
+func isCanisterNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if reject := findReject(err); reject != nil {
+		if reject.RejectCode != 3 {
+			return false
+		}
+		if len(reject.ErrorCode) > 0 {
+			return reject.ErrorCode == "IC0301"
+		}
+		return canisterNotFoundRegexp.MatchString(reject.Message)
+	}
+
+	message := err.Error()
+	return walletCanisterNotFoundRegexp.MatchString(message) || boundaryNodeCanisterNotFoundRegexp.MatchString(message)
+}
+
+// The message of IC0301 rejects
+var canisterNotFoundRegexp = regexp.MustCompile(`^Canister [a-z0-9-]+ not found\b`)
+
+// Rejects forwarded by cycles wallets, "An error happened during the call: <code>: <message>"
+var walletCanisterNotFoundRegexp = regexp.MustCompile(`An error happened during the call: 3: Canister [a-z0-9-]+ not found\b`)
+
+// HTTP errors formatted by agent-go, "(<status code>) <status>: <body>", with the error of
+// the boundary nodes in the body
+var boundaryNodeCanisterNotFoundRegexp = regexp.MustCompile(`\((?:400|404)\) \d{3} [^:]*: (?:error: )?canister_not_found\b`)
+
+// Removes the canister from the apply summary (if enabled). The canister was already
+// deleted at this point, so failures are only reported as warnings.
+func (r *CanisterResource) removeFromApplySummary(canisterId string, diags *diag.Diagnostics) {
+	err := r.applySummary.RemoveCanister(canisterId)
+	if err != nil {
+		diags.AddWarning("Client Warning", "Could not update apply summary: "+err.Error())
+	}
+}
+
+// Releases the lock on the canister (if locking is enabled). The lock expires eventually,
+// so failures are only reported as warnings.
+func (r *CanisterResource) releaseLock(ctx context.Context, canisterId string, diags *diag.Diagnostics) {
+	err := r.lock.Release(ctx, canisterId)
+	if err != nil {
+		diags.AddWarning("Client Warning", err.Error())
+	}
+}
+
+// Appends the refund to the canister's refunds, and records it in the apply summary (if
+// enabled), which keeps it when the canister is replaced. Failing to update the summary is
+// only reported as a warning, since the refund is in the state.
+func (r *CanisterResource) appendCmcRefund(data *CanisterResourceModel, canisterId string, refund CmcRefund) diag.Diagnostics {
+	diags := data.AppendCmcRefund(refund)
+
+	err := r.applySummary.RecordCmcRefund(ApplySummaryCmcRefund{
+		TransferBlockIndex: refund.TransferBlockIndex,
+		RefundBlockIndex:   refund.RefundBlockIndex,
+		RefundE8s:          refund.RefundE8s,
+		Reason:             refund.Reason,
+		CanisterId:         canisterId,
+		RefundedAt:         time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		diags.AddWarning("Client Warning", "Could not record the CMC refund in the apply summary: "+err.Error())
+	}
+	return diags
+}
+
+// Records the canister in the apply summary (if enabled). The canister was already
+// applied at this point, so failures are only reported as warnings.
+func (r *CanisterResource) recordApplySummary(ctx context.Context, data *CanisterResourceModel, diags *diag.Diagnostics) {
+	if r.applySummary == nil {
+		return
+	}
+
+	controllers, err := data.StringControllers(ctx, r.config)
 	if err != nil {
-		resp.Diagnostics.AddError("Client Error", fmt.Errorf("Could not stop canister before deletion: %w", err).Error())
+		diags.AddWarning("Client Warning", "Could not update apply summary: "+err.Error())
 		return
 	}
 
-	err = agent.DeleteCanister(icMgmt.DeleteCanisterArgs{CanisterId: canisterId})
+	argHex, err := data.GetArgHex(ctx)
 	if err != nil {
-		resp.Diagnostics.AddError("Client Error", fmt.Errorf("Could not delete canister: %w", err).Error())
+		diags.AddWarning("Client Warning", "Could not update apply summary: "+err.Error())
 		return
 	}
+
+	err = r.applySummary.RecordCanister(ApplySummaryCanister{
+		Id:          data.Id.ValueString(),
+		Controllers: controllers,
+		WasmSha256:  data.WasmSha256.ValueString(),
+		ArgSha256:   ArgSha256(argHex),
+		ExpiresAt:   data.ExpiresAt.ValueString(),
+	})
+	if err != nil {
+		diags.AddWarning("Client Warning", "Could not update apply summary: "+err.Error())
+	}
 }
 
 type CanisterInfo struct {
@@ -805,6 +2722,59 @@ func (r *CanisterResource) ImportState(ctx context.Context, req resource.ImportS
 	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("wasm_sha256"), canisterInfo.WasmSha256)...)
 	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("controllers"),
 		canisterInfo.Controllers)...)
+
+	// If the canister advertises its init arguments (or their hash), use them so that the
+	// imported canister isn't reinstalled needlessly
+	argHex, argSha256 := r.ReadImportedArg(ctx, canisterId)
+	if argHex != "" {
+		resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("arg_hex"), argHex)...)
+	}
+	if argSha256 != "" {
+		resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("arg_sha256"), argSha256)...)
+	}
+
+	// The metadata may simply not exist, so errors are not fatal
+	labels, err := readCanisterLabels(*r.config, canisterId)
+	if err != nil {
+		tflog.Info(ctx, "Could not read labels metadata: "+err.Error())
+	} else if len(labels) > 0 {
+		resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("labels"), labels)...)
+	}
+
+	publicMetadata, err := readCanisterPublicMetadata(*r.config, canisterId)
+	if err != nil {
+		tflog.Info(ctx, "Could not read public metadata: "+err.Error())
+	} else if len(publicMetadata) > 0 {
+		resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("public_metadata"), publicMetadataValue(publicMetadata))...)
+	}
+}
+
+// Reads the canister's init arguments from its public metadata. By convention, the
+// candid-encoded arguments are stored in the `icp:public init_arg` custom section, or
+// only their (hex-encoded) sha256 in the `icp:public init_arg_sha256` custom section.
+// Returns the hex-encoded arguments (if available) and their sha256 (if available).
+func (r *CanisterResource) ReadImportedArg(ctx context.Context, canisterId principal.Principal) (string, string) {
+	agent, err := newAgent(*r.config)
+	if err != nil {
+		tflog.Info(ctx, "Could not create agent to read init arguments: "+err.Error())
+		return "", ""
+	}
+
+	// The metadata may simply not exist, so errors are not fatal
+	initArg, err := agent.GetCanisterMetadata(canisterId, "init_arg")
+	if err == nil {
+		argHex := hex.EncodeToString(initArg)
+		return argHex, ArgSha256(argHex)
+	}
+	tflog.Info(ctx, "Could not read init_arg metadata: "+err.Error())
+
+	initArgSha256, err := agent.GetCanisterMetadata(canisterId, "init_arg_sha256")
+	if err == nil {
+		return "", strings.ToLower(strings.TrimSpace(string(initArgSha256)))
+	}
+	tflog.Info(ctx, "Could not read init_arg_sha256 metadata: "+err.Error())
+
+	return "", ""
 }
 
 func (r *CanisterResource) InferInstallMode(ctx context.Context, canisterIdS string) (icMgmt.CanisterInstallMode, error) {
@@ -818,13 +2788,13 @@ func (r *CanisterResource) InferInstallMode(ctx context.Context, canisterIdS str
 
 	tflog.Info(ctx, "Reading canister info for canister: "+canisterId.Encode())
 
-	agent, err := agent.New(*r.config)
+	agent, err := newAgent(*r.config)
 	if err != nil {
 		return installMode, fmt.Errorf("could not create agent: %w", err)
 	}
 
 	tflog.Info(ctx, "Reading canister module hash for "+canisterId.Encode())
-	moduleHash, err := agent.GetCanisterModuleHash(canisterId)
+	moduleHash, err := readCanisterModuleHash(agent, canisterId, r.certifiedReads)
 	if err != nil {
 		return installMode, fmt.Errorf("could not get canister module hash: %w", err)
 	}
@@ -838,17 +2808,18 @@ func (r *CanisterResource) InferInstallMode(ctx context.Context, canisterIdS str
 	return installMode, nil
 }
 
-func (r *CanisterResource) ReadCanisterInfo(ctx context.Context, canisterId principal.Principal) (CanisterInfo, error) {
+func (r *CanisterResource) ReadCanisterInfo(ctx context.Context, canisterId principal.Principal) (_ CanisterInfo, err error) {
+	defer r.metrics.Time(ctx, "read_canister_info", canisterId.Encode())(&err)
 
 	tflog.Info(ctx, "Reading canister info for canister: "+canisterId.Encode())
 
-	agent, err := agent.New(*r.config)
+	agent, err := newAgent(*r.config)
 	if err != nil {
 		return CanisterInfo{}, fmt.Errorf("could not create agent: %w", err)
 	}
 
 	tflog.Info(ctx, "Reading canister module hash for "+canisterId.Encode())
-	moduleHash, err := agent.GetCanisterModuleHash(canisterId)
+	moduleHash, err := readCanisterModuleHash(agent, canisterId, r.certifiedReads)
 	if err != nil {
 		return CanisterInfo{}, fmt.Errorf("could not get canister module hash: %w", err)
 	}
@@ -857,7 +2828,7 @@ func (r *CanisterResource) ReadCanisterInfo(ctx context.Context, canisterId prin
 	moduleHashString := hex.EncodeToString(moduleHash)
 
 	tflog.Info(ctx, "Reading canister controllers for "+canisterId.Encode())
-	controllers, err := agent.GetCanisterControllers(canisterId)
+	controllers, err := readCanisterControllers(agent, canisterId, r.certifiedReads)
 	if err != nil {
 		return CanisterInfo{}, fmt.Errorf("could not get canister controllers: %w", err)
 	}
@@ -3,23 +3,43 @@
 package provider
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
 	"github.com/aviate-labs/agent-go/ic"
-	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	cmc "github.com/aviate-labs/agent-go/ic/cmc"
+	ledger "github.com/aviate-labs/agent-go/ic/icpledger"
 	"github.com/aviate-labs/agent-go/identity"
 	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	tfpath "github.com/hashicorp/terraform-plugin-framework/path"
+	fwresource "github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+	"github.com/hashicorp/terraform-plugin-testing/config"
 	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
 	"github.com/hashicorp/terraform-plugin-testing/terraform"
-)
 
-func LocalhostConfig() (agent.Config, error) {
-	return EndpointConfig("http://localhost:4943")
-}
+	"terraform-provider-ic/acctest"
+)
 
 func TestAccCanisterResource(t *testing.T) {
 
@@ -58,7 +78,7 @@ func TestAccCanisterResource(t *testing.T) {
 				ConfigVariables: testEnv.ConfigVariables,
 				Config:          ProviderConfig + VariablesConfig + helloWorldWithArg("", false),
 				Check: func(s *terraform.State) error {
-					return checkCanisterModuleHash(s, "ic_canister.test", "")
+					return acctest.CheckCanisterModuleHash(s, "ic_canister.test", "")
 				},
 			},
 			// Install Wasm + play with args
@@ -67,7 +87,7 @@ func TestAccCanisterResource(t *testing.T) {
 				Config:          ProviderConfig + VariablesConfig + helloWorldWithArg("Salut", true),
 				Check: func(s *terraform.State) error {
 					expected := fmt.Sprintf("Salut, %s!", greeted)
-					return checkCanisterReplyString(s, "ic_canister.test", "hello", []any{greeted}, expected)
+					return acctest.CheckCanisterReplyString(s, "ic_canister.test", "hello", []any{greeted}, expected)
 				},
 			},
 			{
@@ -75,7 +95,7 @@ func TestAccCanisterResource(t *testing.T) {
 				Config:          ProviderConfig + VariablesConfig + helloWorldWithArg("Hello", true),
 				Check: func(s *terraform.State) error {
 					expected := fmt.Sprintf("Hello, %s!", greeted)
-					return checkCanisterReplyString(s, "ic_canister.test", "hello", []any{greeted}, expected)
+					return acctest.CheckCanisterReplyString(s, "ic_canister.test", "hello", []any{greeted}, expected)
 				},
 			},
 			// Uninstall Wasm
@@ -83,7 +103,7 @@ func TestAccCanisterResource(t *testing.T) {
 				ConfigVariables: testEnv.ConfigVariables,
 				Config:          ProviderConfig + VariablesConfig + helloWorldWithArg("", false),
 				Check: func(s *terraform.State) error {
-					return checkCanisterModuleHash(s, "ic_canister.test", "")
+					return acctest.CheckCanisterModuleHash(s, "ic_canister.test", "")
 				},
 			},
 			// Delete testing automatically occurs in TestCase
@@ -167,7 +187,7 @@ func TestAccCanisterResourceImport(t *testing.T) {
 
 	testEnv := NewTestEnv(t)
 
-	canisterId, err := createCanisterFromWasmPath(testEnv.HelloWorldWasmPath)
+	canisterId, err := acctest.CreateCanisterFromWasmPath(testEnv.Identity, testEnv.HelloWorldWasmPath)
 
 	if err != nil {
 		t.Fatalf("Could not create canister: %s", err.Error())
@@ -218,128 +238,2159 @@ resource "ic_canister" "test" {}
 	})
 }
 
-//	Check that the update call to the canister with the given resource name returns a string with
-//
-// the expected value.
-func checkCanisterReplyString(s *terraform.State, resourceName string, methodName string, args []any, expected string) error {
-	rs, ok := s.RootModule().Resources[resourceName]
-	if !ok {
-		return fmt.Errorf("No canister exists")
-	}
+// Check that the canister is recorded in the apply summary.
+func TestAccCanisterResourceApplySummary(t *testing.T) {
 
-	canisterId := rs.Primary.ID
+	testEnv := NewTestEnv(t)
 
-	if canisterId == "" {
-		return fmt.Errorf("Canister does not have an ID")
-	}
+	summaryPath := path.Join(t.TempDir(), "summary.json")
 
-	config, err := LocalhostConfig()
-	if err != nil {
-		return fmt.Errorf("Could not get config")
-	}
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: fmt.Sprintf(`
+provider "ic" {
+    endpoint = "%s"
+    apply_summary_file = "%s"
+}
+`, acctest.LocalEndpoint, summaryPath) + VariablesConfig + `
+resource "ic_canister" "test" {
+            wasm_file = var.hello_world_wasm
+}
+`,
+				Check: func(s *terraform.State) error {
+					data, err := os.ReadFile(summaryPath)
+					if err != nil {
+						return err
+					}
 
-	agent, err := agent.New(config)
-	if err != nil {
-		return fmt.Errorf("Could not create agent: %w", err)
-	}
+					var manifest ApplySummaryManifest
+					err = json.Unmarshal(data, &manifest)
+					if err != nil {
+						return err
+					}
 
-	canisterIdP, err := principal.Decode(canisterId)
-	if err != nil {
-		return fmt.Errorf("Could not decode principal %s: %w", canisterId, err)
-	}
+					canisterId := s.RootModule().Resources["ic_canister.test"].Primary.ID
+					canister, ok := manifest.Canisters[canisterId]
+					if !ok {
+						return fmt.Errorf("Canister %s not found in apply summary", canisterId)
+					}
 
-	var result string
-	err = agent.Call(canisterIdP, methodName, args, []any{&result})
-	if err != nil {
-		return fmt.Errorf("Could not call %s on canister %s: %w", methodName, canisterId, err)
-	}
+					if canister.WasmSha256 != testEnv.HelloWorldWasmSha256 {
+						return fmt.Errorf("Unexpected wasm_sha256 in apply summary: %s", canister.WasmSha256)
+					}
 
-	if result != expected {
-		return fmt.Errorf("Mismatched reply: %s != %s", result, expected)
-	}
+					if manifest.Identity != testEnv.Identity.Sender().Encode() {
+						return fmt.Errorf("Unexpected identity in apply summary: %s", manifest.Identity)
+					}
 
-	return nil
+					return nil
+				},
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
 }
 
-func createCanisterFromWasmPath(wasmFilePath string) (string, error) {
-	config, err := LocalhostConfig()
-	if err != nil {
-		return "", fmt.Errorf("Could not get config")
-	}
+// Check that arguments can reference the id of a canister created in the same apply.
+func TestAccCanisterResourceArgUnknownId(t *testing.T) {
 
-	agent, err := icMgmt.NewAgent(ic.MANAGEMENT_CANISTER_PRINCIPAL, config)
-	if err != nil {
-		return "", fmt.Errorf("Could not create agent: %w", err)
-	}
+	testEnv := NewTestEnv(t)
 
-	createCanisterArgs := icMgmt.ProvisionalCreateCanisterWithCyclesArgs{}
-	res, err := agent.ProvisionalCreateCanisterWithCycles(createCanisterArgs)
-	if err != nil {
-		return "", fmt.Errorf("Could not create canister: %w", err)
-	}
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + `
+resource "ic_canister" "backend" {}
 
-	wasmModule, err := os.ReadFile(wasmFilePath)
-	if err != nil {
-		return "", fmt.Errorf("Could not read wasm module: %w", err)
-	}
-	argRaw := []byte{}
+resource "ic_canister" "test" {
+            arg = ic_canister.backend.id
+            wasm_file = var.hello_world_wasm
+            wasm_sha256 = filesha256(var.hello_world_wasm)
+}
+`,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttrPair("ic_canister.test", "arg", "ic_canister.backend", "id"),
+				),
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
+}
 
-	canisterId := res.CanisterId
-	installMode := CanisterInstallModeInstall()
+// Check that plans dropping below min_controllers fail.
+func TestAccCanisterResourceMinControllers(t *testing.T) {
 
-	installCodeArgs := icMgmt.InstallCodeArgs{
-		Mode:       installMode,
-		CanisterId: canisterId,
-		WasmModule: wasmModule,
-		Arg:        argRaw,
-	}
+	testEnv := NewTestEnv(t)
 
-	err = agent.InstallCode(installCodeArgs)
-	if err != nil {
-		return "", fmt.Errorf("Could not install code: %w", err)
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + `
+resource "ic_canister" "test" {
+            min_controllers = 2
+}
+`,
+				ExpectError: regexp.MustCompile("Not enough controllers"),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + `
+resource "ic_canister" "test" {
+            min_controllers = 2
+            controllers = [ var.provider_controller, "aaaaa-aa" ]
+}
+`,
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + `
+resource "ic_canister" "test" {
+            min_controllers = 2
+            controllers = [ var.provider_controller ]
+}
+`,
+				ExpectError: regexp.MustCompile("Not enough controllers"),
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
+}
+
+// Check that cycles are withdrawn to the beneficiary when the canister is deleted.
+func TestAccCanisterResourceCyclesBeneficiary(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	const beneficiaryConfig = `
+resource "ic_canister" "beneficiary" {}
+
+data "ic_canister" "beneficiary" {
+            id = ic_canister.beneficiary.id
+            include_status = true
+}
+`
+
+	// Balance of the beneficiary before the deletion
+	var before *big.Int
+	recordBalance := func(value string) error {
+		var ok bool
+		before, ok = new(big.Int).SetString(value, 10)
+		if !ok {
+			return fmt.Errorf("invalid balance %q", value)
+		}
+		return nil
 	}
+	checkBalanceIncreased := func(value string) error {
+		after, ok := new(big.Int).SetString(value, 10)
+		if !ok {
+			return fmt.Errorf("invalid balance %q", value)
+		}
+		if after.Cmp(before) <= 0 {
+			return fmt.Errorf("balance of the beneficiary did not increase: %s before the deletion, %s after", before, after)
+		}
+		return nil
+	}
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + beneficiaryConfig + `
+resource "ic_canister" "test" {
+            cycles_beneficiary = ic_canister.beneficiary.id
+}
+`,
+				Check: resource.TestCheckResourceAttrWith("data.ic_canister.beneficiary", "cycles", recordBalance),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config:          ProviderConfig + VariablesConfig + beneficiaryConfig,
+			},
+			{
+				// The data source is read again, now that the canister was deleted
+				ConfigVariables: testEnv.ConfigVariables,
+				Config:          ProviderConfig + VariablesConfig + beneficiaryConfig,
+				Check:           resource.TestCheckResourceAttrWith("data.ic_canister.beneficiary", "cycles", checkBalanceIncreased),
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
+}
+
+// Check that labels are injected in the module and read back by the data source.
+func TestAccCanisterResourceLabels(t *testing.T) {
 
-	return canisterId.Encode(), nil
+	testEnv := NewTestEnv(t)
 
+	withLabels := func(team string) string {
+		return fmt.Sprintf(`
+resource "ic_canister" "test" {
+            wasm_file = var.hello_world_wasm
+            wasm_sha256 = filesha256(var.hello_world_wasm)
+            labels = { team = "%s" }
 }
 
-// Check that the module has of the given canister matches the (hex-encoded) expected value.
-func checkCanisterModuleHash(s *terraform.State, resourceName string, expected string) error {
-	rs, ok := s.RootModule().Resources[resourceName]
-	if !ok {
-		return fmt.Errorf("No canister exists")
+data "ic_canister" "test" {
+            id = ic_canister.test.id
+}
+`, team)
 	}
 
-	canisterId := rs.Primary.ID
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config:          ProviderConfig + VariablesConfig + withLabels("infra"),
+				Check:           resource.TestCheckResourceAttr("data.ic_canister.test", "labels.team", "infra"),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config:          ProviderConfig + VariablesConfig + withLabels("sales"),
+				Check:           resource.TestCheckResourceAttr("data.ic_canister.test", "labels.team", "sales"),
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
+}
+
+// Check that a module whose embedded candid interface differs from candid_file is rejected
+// at plan time.
+func TestAccCanisterResourceCandidFile(t *testing.T) {
 
-	if canisterId == "" {
-		return fmt.Errorf("Canister does not have an ID")
-	}
+	testEnv := NewTestEnv(t)
 
-	config, err := LocalhostConfig()
-	if err != nil {
-		return fmt.Errorf("Could not get config")
-	}
+	dir := t.TempDir()
+	wasmFile := path.Join(dir, "module.wasm")
+	candidFile := path.Join(dir, "service.did")
 
-	agent, err := agent.New(config)
+	module := append([]byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00},
+		wasmSection(0, append(wasmName("icp:public candid:service"), []byte("service : { hello : (text) -> (text) query }")...))...)
+	err := os.WriteFile(wasmFile, module, 0644)
 	if err != nil {
-		return fmt.Errorf("Could not create agent: %w", err)
+		t.Fatal(err)
 	}
 
-	canisterIdP, err := principal.Decode(canisterId)
+	err = os.WriteFile(candidFile, []byte("service : { hello : (opt text) -> (text) query }"), 0644)
 	if err != nil {
-		return fmt.Errorf("Could not decode principal %s: %w", canisterId, err)
+		t.Fatal(err)
 	}
 
-	moduleHash, err := agent.GetCanisterModuleHash(canisterIdP)
-	if err != nil {
-		return fmt.Errorf("could not get canister module hash: %w", err)
-	}
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + fmt.Sprintf(`
+resource "ic_canister" "test" {
+            wasm_file = "%s"
+            candid_file = "%s"
+}
+`, wasmFile, candidFile),
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile("Candid interface mismatch"),
+			},
+		},
+	})
+}
+
+// Check that malformed controllers are rejected at plan time.
+func TestAccCanisterResourceInvalidControllers(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + `
+resource "ic_canister" "test" {
+            controllers = [ var.provider_controller, "2vxsx-fa" ]
+}
+`,
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile("Invalid controller"),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + `
+resource "ic_canister" "test" {
+            controllers = [ var.provider_controller, "2VXSX-FAE" ]
+}
+`,
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile("not in canonical form"),
+			},
+		},
+	})
+}
+
+// Check that the provider's policy (required_labels, forbidden_controllers) is enforced at
+// plan time.
+func TestAccCanisterResourcePolicy(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
 
-	moduleHashString := hex.EncodeToString(moduleHash)
-	if moduleHashString != expected {
-		return fmt.Errorf("module hash mismatch: '%s' != '%s'", moduleHashString, expected)
+	providerConfig := fmt.Sprintf(`
+provider "ic" {
+    endpoint = "%s"
+    required_labels = [ "team" ]
+    forbidden_controllers = [ "aaaaa-aa" ]
+}
+`, acctest.LocalEndpoint)
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: providerConfig + VariablesConfig + `
+resource "ic_canister" "test" {
+            labels = { owner = "alice" }
+}
+`,
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile("Missing required labels"),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: providerConfig + VariablesConfig + `
+resource "ic_canister" "test" {
+            labels = { team = "infra" }
+            controllers = [ var.provider_controller, "aaaaa-aa" ]
+}
+`,
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile("Forbidden controller"),
+			},
+		},
+	})
+}
+
+// Check that require_explicit_controllers rejects canisters without controllers, unless
+// overridden by the canister.
+func TestAccCanisterResourceRequireExplicitControllers(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	providerConfig := fmt.Sprintf(`
+provider "ic" {
+    endpoint = "%s"
+    require_explicit_controllers = true
+}
+`, acctest.LocalEndpoint)
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: providerConfig + VariablesConfig + `
+resource "ic_canister" "test" {
+}
+`,
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile("Missing controllers"),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: providerConfig + VariablesConfig + `
+resource "ic_canister" "test" {
+            require_explicit_controllers = false
+}
+`,
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: providerConfig + VariablesConfig + `
+resource "ic_canister" "test" {
+            controllers = [ var.provider_controller ]
+}
+`,
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
+
+// Check that settings without attributes are passed through raw_settings, and that the
+// settings with attributes are rejected.
+func TestAccCanisterResourceRawSettings(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	// freezing_threshold, as candid nats
+	withFreezingThreshold := func(thresholdHex string) string {
+		return fmt.Sprintf(`
+resource "ic_canister" "test" {
+            raw_settings = { freezing_threshold = "%s" }
+}
+`, thresholdHex)
 	}
 
-	return nil
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + `
+resource "ic_canister" "test" {
+            raw_settings = { controllers = "4449444c00017d00" }
+}
+`,
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile("Invalid raw setting"),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config:          ProviderConfig + VariablesConfig + withFreezingThreshold("4449444c00017d809a9e01"),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config:          ProviderConfig + VariablesConfig + withFreezingThreshold("4449444c00017d80b4bc02"),
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
+}
+
+// Checks the nat settings with a first-class attribute (see canisterNatSettings) against the
+// replica, changing them with update_settings outside of Terraform.
+func TestAccCanisterResourceNatSettings(t *testing.T) {
+	for _, setting := range canisterNatSettings {
+		t.Run(setting.name, func(t *testing.T) {
+			testEnv := NewTestEnv(t)
+
+			withValue := func(value uint64) string {
+				return fmt.Sprintf(`
+provider "ic" {
+    endpoint = "%s"
+    refresh_mode = "full"
+}
+
+resource "ic_canister" "test" {
+            %s = %d
+}
+`, acctest.LocalEndpoint, setting.name, value) + VariablesConfig
+			}
+
+			changeSetting := func(id string, value uint64) error {
+				canisterId, err := principal.Decode(id)
+				if err != nil {
+					return err
+				}
+				raw, err := idl.Marshal([]any{idl.NewNat(value)})
+				if err != nil {
+					return err
+				}
+				arg, err := encodeRawUpdateSettings(canisterId, map[string]string{setting.name: hex.EncodeToString(raw)})
+				if err != nil {
+					return err
+				}
+				_, err = CallRawWithEffectiveId(acctest.LocalhostConfig(testEnv.Identity), canisterId, ic.MANAGEMENT_CANISTER_PRINCIPAL, "update_settings", arg)
+				return err
+			}
+
+			resource.Test(t, resource.TestCase{
+				ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+				Steps:                    testCanisterNatSettingSteps(t, withValue, testEnv.ConfigVariables, setting.name, changeSetting),
+			})
+		})
+	}
+}
+
+// Check that quotas are set where supported, and skipped (with a warning) otherwise.
+func TestAccCanisterResourceQuotas(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	withQuotas := func(quotas string) string {
+		return fmt.Sprintf(`
+resource "ic_canister" "test" {
+            quotas = %s
+}
+`, quotas)
+	}
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config:          ProviderConfig + VariablesConfig + withQuotas(`{ controllers = 1 }`),
+				PlanOnly:        true,
+				ExpectError:     regexp.MustCompile("Invalid quota"),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config:          ProviderConfig + VariablesConfig + withQuotas(`{ compute_allocation = 0, not_yet_a_quota = 5 }`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("ic_canister.test", "quotas.compute_allocation", "0"),
+					resource.TestCheckResourceAttr("ic_canister.test", "quotas.not_yet_a_quota", "5"),
+				),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config:          ProviderConfig + VariablesConfig + withQuotas(`{ compute_allocation = 1, not_yet_a_quota = 5 }`),
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
+}
+
+// Check that arguments can be read from a file, and that large inline arguments are rejected.
+func TestAccCanisterResourceArgFile(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	greeted := "terraform"
+
+	arg, err := idl.Marshal([]any{"Salut"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argFile := path.Join(t.TempDir(), "arg.bin")
+	err = os.WriteFile(argFile, arg, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	providerConfig := fmt.Sprintf(`
+provider "ic" {
+    endpoint = "%s"
+    max_inline_arg_size = 8
+}
+`, acctest.LocalEndpoint)
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: providerConfig + VariablesConfig + `
+resource "ic_canister" "test" {
+            arg = "A greeting that is too large to be stored in the state"
+            wasm_file = var.hello_world_wasm
+            wasm_sha256 = filesha256(var.hello_world_wasm)
+}
+`,
+				ExpectError: regexp.MustCompile("Argument too large"),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: providerConfig + VariablesConfig + fmt.Sprintf(`
+resource "ic_canister" "test" {
+            arg_file = "%s"
+            wasm_file = var.hello_world_wasm
+            wasm_sha256 = filesha256(var.hello_world_wasm)
+}
+`, argFile),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("ic_canister.test", "arg_sha256", ArgSha256(hex.EncodeToString(arg))),
+					func(s *terraform.State) error {
+						expected := fmt.Sprintf("Salut, %s!", greeted)
+						return acctest.CheckCanisterReplyString(s, "ic_canister.test", "hello", []any{greeted}, expected)
+					},
+				),
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
+}
+
+// Check that canisters can be managed on the in-memory backend, without a replica.
+func TestCanisterResourceMock(t *testing.T) {
+
+	dir := t.TempDir()
+	wasmFile := path.Join(dir, "canister.wasm")
+	upgradedWasmFile := path.Join(dir, "upgraded.wasm")
+
+	err := os.WriteFile(wasmFile, wasmModuleWithCustomSections("icp:public git_commit_id"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(upgradedWasmFile, wasmModuleWithCustomSections("icp:public git_commit_id", "icp:public candid:service"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withWasm := func(wasmFile string) string {
+		return fmt.Sprintf(`
+provider "ic" {
+    endpoint = "mock://%s"
+    poll_interval = "10ms"
+}
+
+resource "ic_canister" "test" {
+            wasm_file = "%s"
+}
+`, strings.ToLower(t.Name()), wasmFile)
+	}
+
+	wasmSha256 := func(wasmFile string) string {
+		data, err := os.ReadFile(wasmFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash := sha256.Sum256(data)
+		return hex.EncodeToString(hash[:])
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: withWasm(wasmFile),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttrSet("ic_canister.test", "id"),
+					resource.TestCheckResourceAttr("ic_canister.test", "wasm_sha256", wasmSha256(wasmFile)),
+					resource.TestCheckResourceAttr("ic_canister.test", "controllers.#", "1"),
+				),
+			},
+			{
+				Config: withWasm(upgradedWasmFile),
+				Check:  resource.TestCheckResourceAttr("ic_canister.test", "wasm_sha256", wasmSha256(upgradedWasmFile)),
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
+}
+
+// Records the traffic of a canister's lifecycle on a mock:// network, and replays it.
+func TestCanisterResourceFixture(t *testing.T) {
+
+	dir := t.TempDir()
+	wasmFile := path.Join(dir, "canister.wasm")
+	fixture := path.Join(dir, "fixture.json")
+
+	err := os.WriteFile(wasmFile, wasmModuleWithCustomSections("icp:public git_commit_id"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := fmt.Sprintf(`
+provider "ic" {
+    endpoint = "mock://%s"
+    poll_interval = "10ms"
+}
+
+resource "ic_canister" "test" {
+            wasm_file = "%s"
+}
+`, strings.ToLower(t.Name()), wasmFile)
+
+	var canisterId string
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testFixtureProviderFactories(t, "", fixture),
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check: func(s *terraform.State) error {
+					canisterId = s.RootModule().Resources["ic_canister.test"].Primary.ID
+					return nil
+				},
+			},
+		},
+	})
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testFixtureProviderFactories(t, fixture, ""),
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check:  resource.TestCheckResourceAttrPtr("ic_canister.test", "id", &canisterId),
+			},
+		},
+	})
+}
+
+// Replays the refund of the ICP transferred to the CMC to create a canister on mainnet.
+func TestCanisterResourceCmcRefund(t *testing.T) {
+
+	rate, err := idl.Marshal([]any{cmc.IcpXdrConversionRateResponse{
+		Data:        cmc.IcpXdrConversionRate{XdrPermyriadPerIcp: 50_000, TimestampSeconds: 1_700_000_000},
+		HashTree:    []byte{},
+		Certificate: []byte{},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	transferBlock := uint64(42)
+	transfer, err := idl.Marshal([]any{ledger.TransferResult{Ok: &transferBlock}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refundBlock := uint64(43)
+	refund := cmc.NotifyError{Refunded: &struct {
+		Reason     string  `ic:"reason" json:"reason"`
+		BlockIndex *uint64 `ic:"block_index,omitempty" json:"block_index,omitempty"`
+	}{Reason: "No subnet available", BlockIndex: &refundBlock}}
+	notify, err := idl.Marshal([]any{cmc.NotifyCreateCanisterResult{Err: &refund}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(agentFixture{Interactions: []agentInteraction{
+		{Type: "query", CanisterId: ic.CYCLES_MINTING_PRINCIPAL.Encode(), Method: "get_icp_xdr_conversion_rate", Reply: rate},
+		{Type: "call", CanisterId: ic.LEDGER_PRINCIPAL.Encode(), Method: "transfer", Reply: transfer},
+		{Type: "call", CanisterId: ic.CYCLES_MINTING_PRINCIPAL.Encode(), Method: "notify_create_canister", Reply: notify},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := path.Join(t.TempDir(), "fixture.json")
+	if err := os.WriteFile(fixture, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testFixtureProviderFactories(t, fixture, ""),
+		Steps: []resource.TestStep{
+			{
+				Config: `
+provider "ic" {
+    allow_mainnet = true
+    poll_interval = "10ms"
+}
+
+resource "ic_canister" "test" {
+}
+`,
+				ExpectError: regexp.MustCompile(`CMC refunded`),
+			},
+		},
+	})
+}
+
+// Replays the refund of a pending claim, checking that the refund is kept in the apply
+// summary when the canister is replaced (and its cmc_refunds dropped).
+func TestCanisterResourceCmcRefundApplySummary(t *testing.T) {
+	refundBlock := uint64(43)
+	refund := cmc.NotifyError{Refunded: &struct {
+		Reason     string  `ic:"reason" json:"reason"`
+		BlockIndex *uint64 `ic:"block_index,omitempty" json:"block_index,omitempty"`
+	}{Reason: "No subnet available", BlockIndex: &refundBlock}}
+	notify, err := idl.Marshal([]any{cmc.NotifyCreateCanisterResult{Err: &refund}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := agentFixture{Interactions: []agentInteraction{
+		{Type: "call", CanisterId: ic.CYCLES_MINTING_PRINCIPAL.Encode(), Method: "notify_create_canister", Reply: notify},
+	}}
+	fixture.replayed = make([]bool, len(fixture.Interactions))
+	backend, err := newMockBackend("", mockState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.replay = &fixture
+	host, _ := url.Parse("mock://" + strings.ToLower(t.Name()))
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, func(http.RoundTripper) http.RoundTripper {
+		return &mockTransport{backend: backend}
+	}))
+
+	summaryFile := path.Join(t.TempDir(), "summary.json")
+	r := &CanisterResource{
+		config: &agent.Config{
+			ClientConfig: &agent.ClientConfig{Host: host},
+			Identity:     new(identity.AnonymousIdentity),
+			FetchRootKey: true,
+			PollDelay:    10 * time.Millisecond,
+		},
+		applySummary: NewApplySummary(summaryFile, "mainnet", principal.AnonymousID.Encode()),
+	}
+	ctx := context.Background()
+	private := testPrivateState{}
+	if diags := writePendingClaim(ctx, private, &PendingClaim{BlockIndex: 42, AmountE8s: 100_000, FeeE8s: 10_000}); diags.HasError() {
+		t.Fatal(diags)
+	}
+
+	data := CanisterResourceModel{CmcRefunds: types.ListNull(types.ObjectType{AttrTypes: cmcRefundAttrTypes})}
+	diags := r.resumePendingClaim(ctx, &data, private)
+	if diags.HasError() {
+		t.Fatal(diags)
+	}
+	if len(data.CmcRefunds.Elements()) != 1 {
+		t.Fatalf("expected the refund in cmc_refunds, got %s", data.CmcRefunds)
+	}
+
+	// The replacement only records its canister
+	if err := r.applySummary.RecordCanister(ApplySummaryCanister{Id: "ryjl3-tyaaa-aaaaa-aaaba-cai"}); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(summaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ApplySummaryManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	expected := ApplySummaryCmcRefund{TransferBlockIndex: 42, RefundBlockIndex: &refundBlock, RefundE8s: 90_000, Reason: "No subnet available"}
+	switch {
+	case len(manifest.CmcRefunds) != 1:
+		t.Fatalf("expected the refund in the apply summary, got %v", manifest.CmcRefunds)
+	case manifest.CmcRefunds[0].RefundedAt == "":
+		t.Error("expected the time of the refund")
+	}
+	manifest.CmcRefunds[0].RefundedAt = ""
+	if !reflect.DeepEqual(manifest.CmcRefunds[0], expected) {
+		t.Errorf("expected refund %+v, got %+v", expected, manifest.CmcRefunds[0])
+	}
+
+	// Recording the same refund again (e.g. from a retried claim) replaces it
+	if diags := r.appendCmcRefund(&data, "", CmcRefund{TransferBlockIndex: 42, RefundE8s: 90_000}); diags.HasError() {
+		t.Fatal(diags)
+	}
+	raw, _ = os.ReadFile(summaryFile)
+	manifest = ApplySummaryManifest{}
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.CmcRefunds) != 1 || len(manifest.Canisters) != 1 {
+		t.Errorf("expected one refund and one canister, got %v and %v", manifest.CmcRefunds, manifest.Canisters)
+	}
+}
+
+func TestCanisterResourceMockPublicMetadata(t *testing.T) {
+
+	wasmFile := path.Join(t.TempDir(), "canister.wasm")
+	err := os.WriteFile(wasmFile, wasmModuleWithCustomSections("icp:public name"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withMetadata := func(metadata string) string {
+		return fmt.Sprintf(`
+provider "ic" {
+    endpoint = "mock://%s"
+    poll_interval = "10ms"
+}
+
+resource "ic_canister" "test" {
+            wasm_file = "%s"
+            public_metadata = %s
+}
+
+data "ic_canister" "test" {
+            id = ic_canister.test.id
+            depends_on = [ ic_canister.test ]
+}
+`, strings.ToLower(t.Name()), wasmFile, metadata)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: withMetadata(`{ name = "Backend", description = "The backend of the app" }`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("data.ic_canister.test", "public_metadata.name", "Backend"),
+					resource.TestCheckResourceAttr("data.ic_canister.test", "public_metadata.description", "The backend of the app"),
+					resource.TestCheckNoResourceAttr("data.ic_canister.test", "public_metadata.logo"),
+				),
+			},
+			{
+				Config: withMetadata(`{ name = "Backend", logo = "https://example.com/logo.svg" }`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("data.ic_canister.test", "public_metadata.logo", "https://example.com/logo.svg"),
+					resource.TestCheckNoResourceAttr("data.ic_canister.test", "public_metadata.description"),
+				),
+			},
+		},
+	})
+}
+
+func TestCanisterDataSourceMockReadStrategy(t *testing.T) {
+
+	withReadStrategy := func(readStrategy string) string {
+		return fmt.Sprintf(`
+provider "ic" {
+    endpoint = "mock://%s"
+    poll_interval = "10ms"
+}
+
+resource "ic_canister" "test" {
+}
+
+data "ic_canister" "test" {
+            id = ic_canister.test.id
+            read_strategy = "%s"
+}
+`, strings.ToLower(t.Name()), readStrategy)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: withReadStrategy("certified"),
+				Check:  resource.TestCheckResourceAttrPair("data.ic_canister.test", "controllers.#", "ic_canister.test", "controllers.#"),
+			},
+			{
+				Config: withReadStrategy("query"),
+				Check:  resource.TestCheckResourceAttrPair("data.ic_canister.test", "controllers.0", "ic_canister.test", "controllers.0"),
+			},
+			{
+				Config:      withReadStrategy("replicated"),
+				ExpectError: regexp.MustCompile(`read_strategy`),
+			},
+		},
+	})
+}
+
+// Two values of each nat setting with a first-class attribute (see canisterNatSettings).
+var testCanisterNatSettingValues = map[string][2]uint64{
+	"freezing_threshold":    {7_776_000, 2_592_000},
+	"reserved_cycles_limit": {5_000_000_000_000, 0},
+	"wasm_memory_threshold": {100_000_000, 0},
+}
+
+// Returns the steps testing a nat setting with a first-class attribute of the canister
+// ic_canister.test of the config: setting it on creation, updating it, and detecting (with
+// a full refresh) a change made outside of Terraform with changeSetting, which the next
+// apply reverts.
+func testCanisterNatSettingSteps(t *testing.T, withValue func(value uint64) string, variables config.Variables, name string, changeSetting func(canisterId string, value uint64) error) []resource.TestStep {
+	values, ok := testCanisterNatSettingValues[name]
+	if !ok {
+		t.Fatalf("no test values for %s", name)
+	}
+
+	var canisterId string
+	check := func(value uint64) resource.TestCheckFunc {
+		return resource.ComposeAggregateTestCheckFunc(
+			resource.TestCheckResourceAttr("ic_canister.test", name, strconv.FormatUint(value, 10)),
+			func(s *terraform.State) error {
+				canisterId = s.RootModule().Resources["ic_canister.test"].Primary.ID
+				return nil
+			},
+		)
+	}
+
+	return []resource.TestStep{
+		{
+			ConfigVariables: variables,
+			Config:          withValue(values[0]),
+			Check:           check(values[0]),
+		},
+		{
+			ConfigVariables: variables,
+			Config:          withValue(values[1]),
+			Check:           check(values[1]),
+		},
+		{
+			PreConfig: func() {
+				if err := changeSetting(canisterId, values[0]); err != nil {
+					t.Fatalf("could not change %s of %s: %v", name, canisterId, err)
+				}
+			},
+			ConfigVariables:    variables,
+			Config:             withValue(values[1]),
+			PlanOnly:           true,
+			ExpectNonEmptyPlan: true,
+		},
+		{
+			ConfigVariables: variables,
+			Config:          withValue(values[1]),
+			Check:           check(values[1]),
+		},
+	}
+}
+
+// Checks the nat settings with a first-class attribute (see canisterNatSettings) against
+// the mock, whose state is changed directly to simulate changes made outside of Terraform.
+func TestCanisterResourceMockNatSettings(t *testing.T) {
+	for _, setting := range canisterNatSettings {
+		t.Run(setting.name, func(t *testing.T) {
+			host := strings.NewReplacer("/", "-", "_", "-").Replace(strings.ToLower(t.Name()))
+			withValue := func(value uint64) string {
+				return fmt.Sprintf(`
+provider "ic" {
+    endpoint = "mock://%s"
+    poll_interval = "10ms"
+    refresh_mode = "full"
+}
+
+resource "ic_canister" "test" {
+            %s = %d
+}
+`, host, setting.name, value)
+			}
+
+			changeSetting := func(canisterId string, value uint64) error {
+				backend, err := loadMockBackend(host)
+				if err != nil {
+					return err
+				}
+				backend.mu.Lock()
+				defer backend.mu.Unlock()
+				canister, ok := backend.State.Canisters[canisterId]
+				if !ok {
+					return fmt.Errorf("canister not found")
+				}
+				*canister.natSettings()[setting.name] = value
+				return backend.save()
+			}
+
+			resource.UnitTest(t, resource.TestCase{
+				ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+				Steps:                    testCanisterNatSettingSteps(t, withValue, nil, setting.name, changeSetting),
+			})
+		})
+	}
+}
+
+// Upgrades a fleet of canisters in waves of 2, one upgrade at a time.
+func TestCanisterResourceMockRollout(t *testing.T) {
+
+	dir := t.TempDir()
+	wasmFile := path.Join(dir, "canister.wasm")
+	upgradedWasmFile := path.Join(dir, "upgraded.wasm")
+
+	err := os.WriteFile(wasmFile, wasmModuleWithCustomSections("icp:public git_commit_id"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(upgradedWasmFile, wasmModuleWithCustomSections("icp:public git_commit_id", "icp:public candid:service"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withWasm := func(wasmFile string) string {
+		return fmt.Sprintf(`
+provider "ic" {
+    endpoint = "mock://%s"
+    poll_interval = "10ms"
+    upgrade_max_parallel = 1
+    upgrade_batch_size = 2
+    upgrade_batch_pause = "10ms"
+}
+
+resource "ic_canister" "test" {
+            count = 5
+            wasm_file = "%s"
+}
+`, strings.ToLower(t.Name()), wasmFile)
+	}
+
+	upgradedSha256 := sha256.Sum256(wasmModuleWithCustomSections("icp:public git_commit_id", "icp:public candid:service"))
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: withWasm(wasmFile),
+			},
+			{
+				Config: withWasm(upgradedWasmFile),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("ic_canister.test.0", "wasm_sha256", hex.EncodeToString(upgradedSha256[:])),
+					resource.TestCheckResourceAttr("ic_canister.test.4", "wasm_sha256", hex.EncodeToString(upgradedSha256[:])),
+				),
+			},
+		},
+	})
+}
+
+func TestCanisterResourceMockLogVisibility(t *testing.T) {
+
+	withLogVisibility := func(logVisibility string) string {
+		return fmt.Sprintf(`
+provider "ic" {
+    endpoint = "mock://%s"
+    poll_interval = "10ms"
+    refresh_mode = "full"
+}
+
+resource "ic_canister" "test" {
+            log_visibility = %s
+}
+`, strings.ToLower(t.Name()), logVisibility)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: withLogVisibility(`{ visibility = "public" }`),
+				Check:  resource.TestCheckResourceAttr("ic_canister.test", "log_visibility.visibility", "public"),
+			},
+			{
+				Config: withLogVisibility(`{ visibility = "allowed_viewers", allowed_viewers = ["2vxsx-fae"] }`),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("ic_canister.test", "log_visibility.visibility", "allowed_viewers"),
+					resource.TestCheckResourceAttr("ic_canister.test", "log_visibility.allowed_viewers.0", "2vxsx-fae"),
+				),
+			},
+			{
+				// Changed outside of Terraform
+				PreConfig: func() {
+					backend, err := loadMockBackend(strings.ToLower(t.Name()))
+					if err != nil {
+						t.Fatal(err)
+					}
+					backend.mu.Lock()
+					defer backend.mu.Unlock()
+					for _, canister := range backend.State.Canisters {
+						canister.LogVisibility, canister.LogAllowedViewers = logVisibilityPublic, nil
+					}
+				},
+				Config:             withLogVisibility(`{ visibility = "allowed_viewers", allowed_viewers = ["2vxsx-fae"] }`),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+			{
+				Config: withLogVisibility(`{ visibility = "allowed_viewers", allowed_viewers = ["2vxsx-fae"] }`),
+				Check:  resource.TestCheckResourceAttr("ic_canister.test", "log_visibility.visibility", "allowed_viewers"),
+			},
+			{
+				Config:      withLogVisibility(`{ visibility = "allowed_viewers" }`),
+				ExpectError: regexp.MustCompile(`Missing allowed viewers`),
+			},
+		},
+	})
+}
+
+func TestCanisterResourceMockInitialCycles(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+provider "ic" {
+    endpoint = "mock://%s"
+    poll_interval = "10ms"
+}
+
+resource "ic_canister" "test" {
+            initial_cycles = 3000000000000
+}
+
+data "ic_canister" "test" {
+            id = ic_canister.test.id
+            include_status = true
+}
+`, strings.ToLower(t.Name())),
+				Check: resource.TestCheckResourceAttr("data.ic_canister.test", "cycles", "3000000000000"),
+			},
+		},
+	})
+}
+
+// Checks that subnet_id can be set on an existing canister (e.g. after an import) to the
+// subnet the canister is on, and can be removed, without changing the canister.
+func TestCanisterResourceMockSubnetId(t *testing.T) {
+	backend, err := loadMockBackend(strings.ToLower(t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := func(subnetId string) string {
+		subnet := ""
+		if len(subnetId) > 0 {
+			subnet = fmt.Sprintf("subnet_id = %q", subnetId)
+		}
+		return fmt.Sprintf(`
+provider "ic" {
+    endpoint = "mock://%s"
+    poll_interval = "10ms"
+}
+
+resource "ic_canister" "test" {
+            %s
+}
+`, strings.ToLower(t.Name()), subnet)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(""),
+				Check:  resource.TestCheckNoResourceAttr("ic_canister.test", "subnet_id"),
+			},
+			{
+				Config: config(backend.subnetId.Encode()),
+				Check:  resource.TestCheckResourceAttr("ic_canister.test", "subnet_id", backend.subnetId.Encode()),
+			},
+			{
+				Config: config(""),
+				Check:  resource.TestCheckNoResourceAttr("ic_canister.test", "subnet_id"),
+			},
+		},
+	})
+}
+
+// Migrates a canister to another subnet: it is moved to a new canister with its module and
+// stable memory (copied in several chunks), and deleted. A failed migration restarts the
+// canister.
+func TestCanisterResourceMockSubnetMigration(t *testing.T) {
+	host := strings.ToLower(t.Name())
+	backend, err := loadMockBackend(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wasmFile := path.Join(t.TempDir(), "canister.wasm")
+	module := wasmModuleWithCustomSections("icp:public git_commit_id")
+	if err := os.WriteFile(wasmFile, module, 0644); err != nil {
+		t.Fatal(err)
+	}
+	moduleSha256 := sha256.Sum256(module)
+	stableMemory := make([]byte, 2*snapshotChunkSize+100)
+	for i := range stableMemory {
+		stableMemory[i] = byte(i % 251)
+	}
+	const otherSubnet = "pzp6e-ekpqk-3c5x7-2h6so-njoeq-mt45d-h3h6c-q3mxf-vpeq5-fk5o7-yae"
+
+	config := func(subnetId string) string {
+		subnet := ""
+		if len(subnetId) > 0 {
+			subnet = fmt.Sprintf("subnet_id = %q", subnetId)
+		}
+		return fmt.Sprintf(`
+provider "ic" {
+    endpoint = "mock://%s"
+    poll_interval = "10ms"
+}
+
+resource "ic_canister" "test" {
+            wasm_file = "%s"
+            # Below the margin of cycles withdrawals, which the mock can't execute
+            initial_cycles = 50000000000
+            %s
+}
+`, host, wasmFile, subnet)
+	}
+
+	// Runs f on the canister of the mock, by id
+	withCanister := func(id string, f func(*mockCanister) error) error {
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+		canister, ok := backend.State.Canisters[id]
+		if !ok {
+			return fmt.Errorf("canister %s not found", id)
+		}
+		return f(canister)
+	}
+
+	var sourceId string
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config(""),
+				Check: resource.TestCheckResourceAttrWith("ic_canister.test", "id", func(id string) error {
+					sourceId = id
+					return withCanister(id, func(canister *mockCanister) error {
+						canister.StableMemory = stableMemory
+						// The snapshots can't be taken
+						canister.Snapshots = map[string]*mockSnapshot{}
+						for i := 0; i < mockMaxSnapshots; i++ {
+							canister.Snapshots[strconv.Itoa(i)] = &mockSnapshot{}
+						}
+						return nil
+					})
+				}),
+			},
+			{
+				Config:      config(otherSubnet),
+				ExpectError: regexp.MustCompile(`maximum number of snapshots`),
+			},
+			{
+				PreConfig: func() {
+					err := withCanister(sourceId, func(canister *mockCanister) error {
+						if canister.Status != "running" {
+							return fmt.Errorf("expected the canister to be restarted, got %s", canister.Status)
+						}
+						canister.Snapshots = nil
+						return nil
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+				},
+				Config: config(otherSubnet),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("ic_canister.test", "subnet_id", otherSubnet),
+					resource.TestCheckResourceAttr("ic_canister.test", "wasm_sha256", hex.EncodeToString(moduleSha256[:])),
+					resource.TestCheckResourceAttrWith("ic_canister.test", "id", func(id string) error {
+						if id == sourceId {
+							return fmt.Errorf("expected a new canister, got %s", id)
+						}
+						backend.mu.Lock()
+						_, ok := backend.State.Canisters[sourceId]
+						backend.mu.Unlock()
+						if ok {
+							return fmt.Errorf("expected canister %s to be deleted", sourceId)
+						}
+						return withCanister(id, func(canister *mockCanister) error {
+							switch {
+							case canister.Status != "running":
+								return fmt.Errorf("expected the canister to be running, got %s", canister.Status)
+							case !bytes.Equal(canister.Module, module) || !bytes.Equal(canister.StableMemory, stableMemory):
+								return fmt.Errorf("expected the module and stable memory to be migrated")
+							case len(canister.Snapshots) > 0:
+								return fmt.Errorf("expected the loaded snapshot to be deleted, got %d snapshots", len(canister.Snapshots))
+							}
+							return nil
+						})
+					}),
+				),
+			},
+		},
+	})
+}
+
+func TestCanisterResourceMockTopUp(t *testing.T) {
+	config := func(minimumCycles, topUpTo string) string {
+		return fmt.Sprintf(`
+provider "ic" {
+    endpoint = "mock://%s"
+    poll_interval = "10ms"
+}
+
+resource "ic_canister" "test" {
+            initial_cycles = 1000000000000
+            minimum_cycles = %s
+            top_up_to = %s
+}
+`, strings.ToLower(t.Name()), minimumCycles, topUpTo)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: config("2000000000000", "5000000000000"),
+				Check:  resource.TestCheckResourceAttr("ic_canister.test", "cycles_balance", "5000000000000"),
+			},
+			{
+				// Raising the minimum above the balance tops the canister up again
+				Config: config("6000000000000", "8000000000000"),
+				Check:  resource.TestCheckResourceAttr("ic_canister.test", "cycles_balance", "8000000000000"),
+			},
+		},
+	})
+}
+
+// Replays top-ups through the CMC, checking that refunds are recorded in cmc_refunds, and
+// that top-ups which could not be notified are resumed rather than paid again.
+func TestCanisterResourceCmcTopUp(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	const canisterId = "ryjl3-tyaaa-aaaaa-aaaba-cai"
+
+	marshal := func(value any) []byte {
+		raw, err := idl.Marshal([]any{value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	status := func(cycles uint64) agentInteraction {
+		return agentInteraction{Type: "call", CanisterId: ic.MANAGEMENT_CANISTER_PRINCIPAL.Encode(), Method: "canister_status", Reply: marshal(struct {
+			Cycles idl.Nat `ic:"cycles"`
+		}{idl.NewNat(cycles)})}
+	}
+	transferBlock := uint64(42)
+	transfer := []agentInteraction{
+		{Type: "query", CanisterId: ic.CYCLES_MINTING_PRINCIPAL.Encode(), Method: "get_icp_xdr_conversion_rate", Reply: marshal(cmc.IcpXdrConversionRateResponse{
+			Data:        cmc.IcpXdrConversionRate{XdrPermyriadPerIcp: 10_000, TimestampSeconds: 1_700_000_000},
+			HashTree:    []byte{},
+			Certificate: []byte{},
+		})},
+		{Type: "call", CanisterId: ic.LEDGER_PRINCIPAL.Encode(), Method: "transfer", Reply: marshal(ledger.TransferResult{Ok: &transferBlock})},
+	}
+	notify := func(result cmc.NotifyTopUpResult) agentInteraction {
+		return agentInteraction{Type: "call", CanisterId: ic.CYCLES_MINTING_PRINCIPAL.Encode(), Method: "notify_top_up", Reply: marshal(result)}
+	}
+
+	// Returns the resource replaying the interactions (and nothing else), on a network of its
+	// own
+	networks := 0
+	replaying := func(t *testing.T, interactions ...agentInteraction) *CanisterResource {
+		networks++
+		fixture := agentFixture{Interactions: interactions}
+		fixture.replayed = make([]bool, len(fixture.Interactions))
+		backend, err := newMockBackend("", mockState{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend.replay = &fixture
+		host, _ := url.Parse(fmt.Sprintf("mock://%s-%d", strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-")), networks))
+		setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, func(http.RoundTripper) http.RoundTripper {
+			return &mockTransport{backend: backend}
+		}))
+		return &CanisterResource{
+			config: &agent.Config{
+				ClientConfig: &agent.ClientConfig{Host: host},
+				Identity:     new(identity.AnonymousIdentity),
+				FetchRootKey: true,
+				PollDelay:    10 * time.Millisecond,
+			},
+			cmcSettings: DefaultCmcSettings(),
+		}
+	}
+	// The canister has 1T cycles and is topped up to 3T, with 2e8 e8s at the rate of 10000
+	model := func() CanisterResourceModel {
+		return CanisterResourceModel{
+			MinimumCycles: types.Int64Value(2_000_000_000_000),
+			TopUpTo:       types.Int64Value(3_000_000_000_000),
+			TopUpSource:   types.StringValue(topUpSourceCmc),
+			CmcRefunds:    types.ListValueMust(types.ObjectType{AttrTypes: cmcRefundAttrTypes}, []attr.Value{}),
+		}
+	}
+	ctx := context.Background()
+
+	t.Run("refunded", func(t *testing.T) {
+		refundBlock := uint64(43)
+		r := replaying(t, append(transfer, status(1_000_000_000_000), notify(cmc.NotifyTopUpResult{Err: &cmc.NotifyError{Refunded: &struct {
+			Reason     string  `ic:"reason" json:"reason"`
+			BlockIndex *uint64 `ic:"block_index,omitempty" json:"block_index,omitempty"`
+		}{Reason: "Canister not found", BlockIndex: &refundBlock}}}))...)
+
+		data := model()
+		private := testPrivateState{}
+		diags := r.ensureCyclesBalance(ctx, &data, principal.MustDecode(canisterId), private)
+		if !diags.HasError() || !strings.Contains(diags.Errors()[0].Detail(), "block 42 (199990000 e8s refunded at block 43)") {
+			t.Fatalf("expected the refund to be reported with its blocks and amount, got %v", diags)
+		}
+		var refunds []struct {
+			TransferBlockIndex int64  `tfsdk:"transfer_block_index"`
+			RefundBlockIndex   int64  `tfsdk:"refund_block_index"`
+			RefundE8s          int64  `tfsdk:"refund_e8s"`
+			Reason             string `tfsdk:"reason"`
+		}
+		if diags := data.CmcRefunds.ElementsAs(ctx, &refunds, false); diags.HasError() {
+			t.Fatal(diags)
+		}
+		if len(refunds) != 1 || refunds[0].TransferBlockIndex != 42 || refunds[0].RefundBlockIndex != 43 || refunds[0].RefundE8s != 199_990_000 {
+			t.Errorf("expected the refund in cmc_refunds, got %+v", refunds)
+		}
+		if len(private) > 0 {
+			t.Errorf("expected no pending top-up, got %v", private)
+		}
+	})
+
+	t.Run("pending", func(t *testing.T) {
+		defer func(timeout time.Duration) { notifyRetryTimeout = timeout }(notifyRetryTimeout)
+		notifyRetryTimeout = 0
+
+		r := replaying(t, append(transfer, status(1_000_000_000_000), notify(cmc.NotifyTopUpResult{Err: &cmc.NotifyError{Processing: new(idl.Null)}}))...)
+		data := model()
+		private := testPrivateState{}
+		diags := r.ensureCyclesBalance(ctx, &data, principal.MustDecode(canisterId), private)
+		if !diags.HasError() || !strings.Contains(diags.Errors()[0].Detail(), "resumed by the next apply") {
+			t.Fatalf("expected the top-up to be pending, got %v", diags)
+		}
+		topUp, diags := readPendingTopUp(ctx, private)
+		if diags.HasError() || topUp == nil || topUp.BlockIndex != 42 || topUp.CanisterId != canisterId {
+			t.Fatalf("expected the pending top-up in the private state, got %+v (%v)", topUp, diags)
+		}
+
+		// The next apply notifies the transfer, which brings the balance above the minimum:
+		// the fixture has no transfer to replay, so paying again would fail
+		cycles := idl.NewNat(uint64(2_000_000_000_000))
+		r = replaying(t, status(3_000_000_000_000), notify(cmc.NotifyTopUpResult{Ok: &cycles}))
+		data = model()
+		diags = r.ensureCyclesBalance(ctx, &data, principal.MustDecode(canisterId), private)
+		if diags.HasError() || diags.WarningsCount() > 0 {
+			t.Fatal(diags)
+		}
+		if data.CyclesBalance.ValueInt64() != 3_000_000_000_000 {
+			t.Errorf("expected the balance of 3T cycles, got %s", data.CyclesBalance)
+		}
+		if len(private) > 0 {
+			t.Errorf("expected the pending top-up to be removed, got %v", private)
+		}
+	})
+}
+
+// Checks that the init arguments of imported canisters are read from their init_arg or
+// init_arg_sha256 metadata, if any.
+func TestCanisterResourceReadImportedArg(t *testing.T) {
+	name := strings.ToLower(t.Name())
+	host, _ := url.Parse("mock://" + name)
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, nil))
+	backend, err := loadMockBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arg := []byte("DIDL\x00\x01\x71\x05hello")
+	argSha256 := sha256.Sum256(arg)
+	canisters := map[string]map[string][]byte{
+		"rrkah-fqaaa-aaaaa-aaaaq-cai": {"icp:public init_arg": arg, "icp:public init_arg_sha256": []byte("ignored")},
+		"ryjl3-tyaaa-aaaaa-aaaba-cai": {"icp:public init_arg_sha256": []byte(" " + strings.ToUpper(hex.EncodeToString(argSha256[:])) + "\n")},
+		"r7inp-6aaaa-aaaaa-aaabq-cai": {"icp:private init_arg": arg},
+		"rkp4c-7iaaa-aaaaa-aaaca-cai": nil,
+	}
+	backend.mu.Lock()
+	for id, metadata := range canisters {
+		backend.State.Canisters[id] = &mockCanister{Controllers: []string{}, Status: "running", ModuleHash: argSha256[:], Metadata: metadata}
+	}
+	backend.mu.Unlock()
+
+	r := &CanisterResource{config: &agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		FetchRootKey: true,
+	}}
+
+	tests := []struct {
+		name      string
+		id        string
+		argHex    string
+		argSha256 string
+	}{
+		{name: "init_arg", id: "rrkah-fqaaa-aaaaa-aaaaq-cai", argHex: hex.EncodeToString(arg), argSha256: hex.EncodeToString(argSha256[:])},
+		{name: "init_arg_sha256", id: "ryjl3-tyaaa-aaaaa-aaaba-cai", argSha256: hex.EncodeToString(argSha256[:])},
+		{name: "private init_arg", id: "r7inp-6aaaa-aaaaa-aaabq-cai"},
+		{name: "no metadata", id: "rkp4c-7iaaa-aaaaa-aaaca-cai"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			argHex, argSha256 := r.ReadImportedArg(context.Background(), principal.MustDecode(test.id))
+			if argHex != test.argHex || argSha256 != test.argSha256 {
+				t.Fatalf("expected (%q, %q), got (%q, %q)", test.argHex, test.argSha256, argHex, argSha256)
+			}
+		})
+	}
+}
+
+func TestCanisterResourceCodeUnchanged(t *testing.T) {
+	argHex := "4449444c0001710568656c6c6f"
+	moduleSha256 := "7b5e5a9b3e3c1d4f5f1e2a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f"
+
+	tests := []struct {
+		name      string
+		data      CanisterResourceModel
+		state     CanisterResourceModel
+		argHex    string
+		unchanged bool
+	}{
+		{
+			name:      "same code",
+			data:      CanisterResourceModel{WasmFile: types.StringValue("a.wasm"), WasmSha256: types.StringValue(moduleSha256), ArgHex: types.StringValue(argHex)},
+			state:     CanisterResourceModel{WasmFile: types.StringValue("a.wasm"), WasmSha256: types.StringValue(moduleSha256), ArgHex: types.StringValue(argHex)},
+			argHex:    argHex,
+			unchanged: true,
+		},
+		{
+			name:   "other module",
+			data:   CanisterResourceModel{WasmFile: types.StringValue("a.wasm"), WasmSha256: types.StringValue(strings.Repeat("0", 64))},
+			state:  CanisterResourceModel{WasmFile: types.StringValue("a.wasm"), WasmSha256: types.StringValue(moduleSha256)},
+			argHex: "",
+		},
+		{
+			name:   "unknown module hash",
+			data:   CanisterResourceModel{WasmFile: types.StringValue("a.wasm"), WasmSha256: types.StringUnknown()},
+			state:  CanisterResourceModel{WasmFile: types.StringValue("a.wasm"), WasmSha256: types.StringValue(moduleSha256)},
+			argHex: "",
+		},
+		{
+			name:      "moved wasm_file",
+			data:      CanisterResourceModel{WasmFile: types.StringValue("b.wasm"), WasmSha256: types.StringValue(moduleSha256)},
+			state:     CanisterResourceModel{WasmFile: types.StringValue("a.wasm"), WasmSha256: types.StringValue(moduleSha256)},
+			argHex:    "",
+			unchanged: true,
+		},
+		{
+			name:      "imported with init_arg_sha256",
+			data:      CanisterResourceModel{WasmFile: types.StringValue("a.wasm"), WasmSha256: types.StringValue(moduleSha256), ArgHex: types.StringValue(argHex)},
+			state:     CanisterResourceModel{WasmSha256: types.StringValue(moduleSha256), ArgSha256: types.StringValue(ArgSha256(argHex))},
+			argHex:    argHex,
+			unchanged: true,
+		},
+		{
+			name:   "imported with other arguments",
+			data:   CanisterResourceModel{WasmFile: types.StringValue("a.wasm"), WasmSha256: types.StringValue(moduleSha256), ArgHex: types.StringValue("4449444c0000")},
+			state:  CanisterResourceModel{WasmSha256: types.StringValue(moduleSha256), ArgSha256: types.StringValue(ArgSha256(argHex))},
+			argHex: "4449444c0000",
+		},
+	}
+	// The attributes not set by the tests are null
+	withNulls := func(data CanisterResourceModel) *CanisterResourceModel {
+		data.Arg = types.DynamicNull()
+		data.Labels = types.MapNull(types.StringType)
+		data.PublicMetadata = types.ObjectNull(canisterPublicMetadataAttrTypes)
+		return &data
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if unchanged := withNulls(test.data).CodeUnchanged(context.Background(), withNulls(test.state), test.argHex); unchanged != test.unchanged {
+				t.Fatalf("expected %t, got %t", test.unchanged, unchanged)
+			}
+		})
+	}
+}
+
+// Check that switching to an equivalent argument (e.g. from arg_hex to arg) is not planned.
+func TestCanisterResourceMockArgEquivalent(t *testing.T) {
+
+	wasmFile := path.Join(t.TempDir(), "canister.wasm")
+	err := os.WriteFile(wasmFile, wasmModuleWithCustomSections(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withArg := func(arg string) string {
+		return fmt.Sprintf(`
+provider "ic" {
+    endpoint = "mock://%s"
+    poll_interval = "10ms"
+}
+
+resource "ic_canister" "test" {
+            wasm_file = "%s"
+            %s
+}
+`, strings.ToLower(t.Name()), wasmFile, arg)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: withArg(`arg_hex = "4449444c0001710568656c6c6f"`),
+				Check:  resource.TestCheckResourceAttr("ic_canister.test", "arg_hex", "4449444c0001710568656c6c6f"),
+			},
+			{
+				Config:   withArg(`arg = "hello"`),
+				PlanOnly: true,
+			},
+			{
+				Config:             withArg(`arg = "world"`),
+				PlanOnly:           true,
+				ExpectNonEmptyPlan: true,
+			},
+			{
+				Config: withArg(""),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckNoResourceAttr("ic_canister.test", "arg_hex"),
+					resource.TestCheckNoResourceAttr("ic_canister.test", "arg"),
+				),
+			},
+		},
+	})
+}
+
+// Checks that reading a canister refreshes its output values, and keeps them if the
+// query fails.
+func TestCanisterResourceRefreshOutputValues(t *testing.T) {
+	canisterId := "rrkah-fqaaa-aaaaa-aaaaq-cai"
+	recordType := idl.NewRecordType(map[string]idl.Type{
+		"key":     new(idl.TextType),
+		"version": new(idl.NatType),
+	})
+	reply, err := idl.Encode([]idl.Type{recordType}, []any{map[string]any{
+		"key":     "rotated",
+		"version": idl.NewNat(uint(2)),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := agentFixture{Interactions: []agentInteraction{
+		{Type: string(agent.RequestTypeQuery), CanisterId: canisterId, Method: "outputs", Reply: reply},
+		{Type: string(agent.RequestTypeQuery), CanisterId: canisterId, Method: "outputs", RejectCode: 5, RejectMessage: "canister stopped"},
+	}}
+	fixture.replayed = make([]bool, len(fixture.Interactions))
+
+	backend, err := newMockBackend("", mockState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.replay = &fixture
+
+	host, _ := url.Parse("mock://" + strings.ToLower(t.Name()))
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, func(http.RoundTripper) http.RoundTripper {
+		return &mockTransport{backend: backend}
+	}))
+	r := &CanisterResource{config: &agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		FetchRootKey: true,
+	}}
+
+	ctx := context.Background()
+	outputs, d := types.ObjectValue(
+		map[string]attr.Type{"method": types.StringType, "fields": types.ListType{ElemType: types.StringType}},
+		map[string]attr.Value{
+			"method": types.StringValue("outputs"),
+			"fields": types.ListValueMust(types.StringType, []attr.Value{types.StringValue("key"), types.StringValue("version")}),
+		},
+	)
+	if d.HasError() {
+		t.Fatal(d)
+	}
+	data := CanisterResourceModel{
+		Id:           types.StringValue(canisterId),
+		WasmFile:     types.StringValue("canister.wasm"),
+		Outputs:      outputs,
+		OutputValues: types.MapValueMust(types.StringType, map[string]attr.Value{"key": types.StringValue("initial"), "version": types.StringValue("1")}),
+	}
+	expectValues := func(expected map[string]string) {
+		t.Helper()
+		var values map[string]string
+		if d := data.OutputValues.ElementsAs(ctx, &values, false); d.HasError() {
+			t.Fatal(d)
+		}
+		if len(values) != len(expected) {
+			t.Fatalf("expected output values %v, got %v", expected, values)
+		}
+		for field, value := range expected {
+			if values[field] != value {
+				t.Fatalf("expected output values %v, got %v", expected, values)
+			}
+		}
+	}
+
+	if d := r.refreshOutputValues(ctx, &data); d.HasError() || d.WarningsCount() > 0 {
+		t.Fatal(d)
+	}
+	expectValues(map[string]string{"key": "rotated", "version": "2"})
+
+	// The query is rejected: the values are kept, with a warning
+	d = r.refreshOutputValues(ctx, &data)
+	if d.HasError() || d.WarningsCount() != 1 || !strings.Contains(d.Warnings()[0].Detail(), "canister stopped") {
+		t.Fatalf("expected a warning, got %v", d)
+	}
+	expectValues(map[string]string{"key": "rotated", "version": "2"})
+
+	// Without code, the canister isn't queried
+	data.WasmFile = types.StringNull()
+	if d := r.refreshOutputValues(ctx, &data); d.HasError() || d.WarningsCount() > 0 {
+		t.Fatal(d)
+	}
+	expectValues(map[string]string{"key": "rotated", "version": "2"})
+}
+
+// Returns the request creating a canister with the resource r, planned with the attributes
+// (the others being null), and the response to it.
+func testCanisterCreateRequest(t *testing.T, r *CanisterResource, attributes map[string]attr.Value) (fwresource.CreateRequest, *fwresource.CreateResponse) {
+	t.Helper()
+	ctx := context.Background()
+
+	var schemaResp fwresource.SchemaResponse
+	r.Schema(ctx, fwresource.SchemaRequest{}, &schemaResp)
+	if schemaResp.Diagnostics.HasError() {
+		t.Fatal(schemaResp.Diagnostics)
+	}
+	schema := schemaResp.Schema
+
+	plan := tfsdk.Plan{Schema: schema, Raw: tftypes.NewValue(schema.Type().TerraformType(ctx), nil)}
+	for name, value := range attributes {
+		if d := plan.SetAttribute(ctx, tfpath.Root(name), value); d.HasError() {
+			t.Fatal(d)
+		}
+	}
+
+	req := fwresource.CreateRequest{Plan: plan}
+	resp := &fwresource.CreateResponse{
+		State: tfsdk.State{Schema: schema, Raw: tftypes.NewValue(schema.Type().TerraformType(ctx), nil)},
+	}
+	// The type of the private state is internal to the framework
+	private := reflect.ValueOf(&resp.Private).Elem()
+	private.Set(reflect.New(private.Type().Elem()))
+	return req, resp
+}
+
+// Checks that invalid raw settings, only known at apply time, fail the creation before the
+// canister is created (and paid for).
+func TestCanisterResourceCreateInvalidRawSettings(t *testing.T) {
+	name := strings.ToLower(t.Name())
+	host, _ := url.Parse("mock://" + name)
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, nil))
+	backend, err := loadMockBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &CanisterResource{config: &agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		FetchRootKey: true,
+	}}
+
+	req, resp := testCanisterCreateRequest(t, r, map[string]attr.Value{
+		"raw_settings": types.MapValueMust(types.StringType, map[string]attr.Value{"wasm_memory_threshold": types.StringValue("not hex")}),
+	})
+	backend.mu.Lock()
+	nextCanister := backend.State.NextCanister
+	backend.mu.Unlock()
+
+	r.Create(context.Background(), req, resp)
+
+	if !resp.Diagnostics.HasError() || resp.Diagnostics.Errors()[0].Summary() != "Invalid raw setting" {
+		t.Fatalf("expected an invalid raw setting, got %v", resp.Diagnostics)
+	}
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if backend.State.NextCanister != nextCanister {
+		t.Fatal("expected no canister to be created")
+	}
+	if !resp.State.Raw.IsNull() {
+		t.Fatalf("expected no state, got %s", resp.State.Raw)
+	}
+}
+
+// Checks that quotas conflicting with raw settings, only known at apply time, fail the
+// creation before the canister is created (and paid for).
+func TestCanisterResourceCreateInvalidQuotas(t *testing.T) {
+	name := strings.ToLower(t.Name())
+	host, _ := url.Parse("mock://" + name)
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, nil))
+	backend, err := loadMockBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &CanisterResource{config: &agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		FetchRootKey: true,
+	}}
+
+	tests := []struct {
+		name   string
+		quotas map[string]attr.Value
+	}{
+		{name: "set in raw_settings", quotas: map[string]attr.Value{"wasm_memory_threshold": types.Int64Value(1)}},
+		{name: "negative", quotas: map[string]attr.Value{"compute_allocation": types.Int64Value(-1)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, resp := testCanisterCreateRequest(t, r, map[string]attr.Value{
+				// A nat
+				"raw_settings": types.MapValueMust(types.StringType, map[string]attr.Value{"wasm_memory_threshold": types.StringValue("4449444c00017d00")}),
+				"quotas":       types.MapValueMust(types.Int64Type, test.quotas),
+			})
+			backend.mu.Lock()
+			nextCanister := backend.State.NextCanister
+			backend.mu.Unlock()
+
+			r.Create(context.Background(), req, resp)
+
+			if !resp.Diagnostics.HasError() || resp.Diagnostics.Errors()[0].Summary() != "Invalid quota" {
+				t.Fatalf("expected an invalid quota, got %v", resp.Diagnostics)
+			}
+			backend.mu.Lock()
+			defer backend.mu.Unlock()
+			if backend.State.NextCanister != nextCanister {
+				t.Fatal("expected no canister to be created")
+			}
+			if !resp.State.Raw.IsNull() {
+				t.Fatalf("expected no state, got %s", resp.State.Raw)
+			}
+		})
+	}
+}
+
+func TestIsCanisterNotFound(t *testing.T) {
+	canisterId := principal.MustDecode("ryjl3-tyaaa-aaaaa-aaaba-cai")
+	reject := func(code uint64, message string) error {
+		return newRejectError(code, message, agent.RequestID{}, canisterId, canisterId, "stop_canister")
+	}
+
+	for _, test := range []struct {
+		name     string
+		err      error
+		notFound bool
+	}{
+		{"nil", nil, false},
+		{"reject", reject(3, "Canister ryjl3-tyaaa-aaaaa-aaaba-cai not found"), true},
+		{"reject with error code", &rejectError{RejectCode: 3, Message: "Canister ryjl3-tyaaa-aaaaa-aaaba-cai not found", ErrorCode: "IC0301"}, true},
+		{"wrapped reject", fmt.Errorf("could not stop canister: %w", reject(3, "Canister ryjl3-tyaaa-aaaaa-aaaba-cai not found: IC0301")), true},
+		{"agent-go reject", fmt.Errorf("(3) Canister ryjl3-tyaaa-aaaaa-aaaba-cai not found: IC0301"), true},
+		{"wallet", fmt.Errorf("rwlgt-iiaaa-aaaaa-aaaaa-cai could not call stop_canister: An error happened during the call: 3: Canister ryjl3-tyaaa-aaaaa-aaaba-cai not found"), true},
+		{"boundary node", fmt.Errorf("(400) 400 Bad Request: error: canister_not_found\ndetails: The specified canister does not exist."), true},
+
+		// Other errors mentioning canisters that are not found
+		{"other reject code", reject(5, "Canister ryjl3-tyaaa-aaaaa-aaaba-cai trapped: canister rdmx6-jaaaa-aaaaa-aaadq-cai not found"), false},
+		{"other error code", &rejectError{RejectCode: 3, Message: "Canister ryjl3-tyaaa-aaaaa-aaaba-cai has no query method 'not found'", ErrorCode: "IC0302"}, false},
+		{"other reject message", reject(3, "Subnet for canister ryjl3-tyaaa-aaaaa-aaaba-cai not found"), false},
+		{"canister trapped", fmt.Errorf("(5) Canister ryjl3-tyaaa-aaaaa-aaaba-cai trapped explicitly: IC0301 is not a valid argument"), false},
+		{"wallet error", fmt.Errorf("rwlgt-iiaaa-aaaaa-aaaaa-cai could not call stop_canister: An error happened during the call: 5: Canister rdmx6-jaaaa-aaaaa-aaadq-cai not found in the registry"), false},
+		{"boundary node error", fmt.Errorf("(503) 503 Service Unavailable: error: canister_not_found_in_cache"), false},
+		{"client error", fmt.Errorf("canister_not_found"), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if notFound := isCanisterNotFound(test.err); notFound != test.notFound {
+				t.Errorf("expected %t for %v, got %t", test.notFound, test.err, notFound)
+			}
+		})
+	}
+}
+
+// Returns the request deleting the canister with the resource r, and the response to it.
+func testCanisterDeleteRequest(t *testing.T, r *CanisterResource, canisterId string) (fwresource.DeleteRequest, *fwresource.DeleteResponse) {
+	t.Helper()
+	ctx := context.Background()
+
+	var schemaResp fwresource.SchemaResponse
+	r.Schema(ctx, fwresource.SchemaRequest{}, &schemaResp)
+	if schemaResp.Diagnostics.HasError() {
+		t.Fatal(schemaResp.Diagnostics)
+	}
+	schema := schemaResp.Schema
+
+	state := tfsdk.State{Schema: schema, Raw: tftypes.NewValue(schema.Type().TerraformType(ctx), nil)}
+	if d := state.SetAttribute(ctx, tfpath.Root("id"), types.StringValue(canisterId)); d.HasError() {
+		t.Fatal(d)
+	}
+	return fwresource.DeleteRequest{State: state}, &fwresource.DeleteResponse{State: state}
+}
+
+// Deletes canisters that were already deleted, either before they are stopped or between
+// their stop and their deletion, checking that they are removed from the state with a
+// warning.
+func TestCanisterResourceDeleteNotFound(t *testing.T) {
+	const canisterId = "ryjl3-tyaaa-aaaaa-aaaba-cai"
+	notFound := func(method string) agentInteraction {
+		return agentInteraction{Type: "call", CanisterId: "aaaaa-aa", Method: method, RejectCode: 3, RejectMessage: "Canister " + canisterId + " not found", ErrorCode: "IC0301"}
+	}
+	stopped := agentInteraction{Type: "call", CanisterId: "aaaaa-aa", Method: "stop_canister", Reply: []byte("DIDL\x00\x00")}
+
+	for _, test := range []struct {
+		name         string
+		interactions []agentInteraction
+		warning      string
+	}{
+		{"stop", []agentInteraction{notFound("stop_canister")}, "Canister already deleted"},
+		{"delete", []agentInteraction{stopped, notFound("delete_canister")}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fixture := agentFixture{Interactions: test.interactions}
+			fixture.replayed = make([]bool, len(fixture.Interactions))
+			backend, err := newMockBackend("", mockState{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			backend.replay = &fixture
+			host, _ := url.Parse("mock://" + strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-")))
+			setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, func(http.RoundTripper) http.RoundTripper {
+				return &mockTransport{backend: backend}
+			}))
+			r := &CanisterResource{config: &agent.Config{
+				ClientConfig: &agent.ClientConfig{Host: host},
+				Identity:     new(identity.AnonymousIdentity),
+				FetchRootKey: true,
+				PollDelay:    10 * time.Millisecond,
+			}}
+
+			req, resp := testCanisterDeleteRequest(t, r, canisterId)
+			r.Delete(context.Background(), req, resp)
+
+			if resp.Diagnostics.HasError() {
+				t.Fatal(resp.Diagnostics)
+			}
+			if len(test.warning) > 0 && (resp.Diagnostics.WarningsCount() != 1 || resp.Diagnostics.Warnings()[0].Summary() != test.warning) {
+				t.Errorf("expected the warning %q, got %v", test.warning, resp.Diagnostics)
+			}
+			for i, replayed := range fixture.replayed {
+				if !replayed {
+					t.Errorf("expected %s to be called", fixture.Interactions[i].Method)
+				}
+			}
+		})
+	}
+}
+
+// Creates canisters on mainnet whose creation fails after the ICP are transferred to the
+// CMC, checking that the failures are saved in the private state, and that the next apply
+// (once the resource is untainted) resumes the creation instead of paying again.
+func TestCanisterResourceResumeCreation(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	const canisterId = "rrkah-fqaaa-aaaaa-aaaaq-cai"
+	ctx := context.Background()
+
+	marshal := func(value any) []byte {
+		raw, err := idl.Marshal([]any{value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	transferBlock := uint64(42)
+	transfer := []agentInteraction{
+		{Type: "query", CanisterId: ic.CYCLES_MINTING_PRINCIPAL.Encode(), Method: "get_icp_xdr_conversion_rate", Reply: marshal(cmc.IcpXdrConversionRateResponse{
+			Data:        cmc.IcpXdrConversionRate{XdrPermyriadPerIcp: 10_000, TimestampSeconds: 1_700_000_000},
+			HashTree:    []byte{},
+			Certificate: []byte{},
+		})},
+		{Type: "call", CanisterId: ic.LEDGER_PRINCIPAL.Encode(), Method: "transfer", Reply: marshal(ledger.TransferResult{Ok: &transferBlock})},
+	}
+	notify := func(result cmc.NotifyCreateCanisterResult) agentInteraction {
+		return agentInteraction{Type: "call", CanisterId: ic.CYCLES_MINTING_PRINCIPAL.Encode(), Method: "notify_create_canister", Reply: marshal(result)}
+	}
+	created := notify(cmc.NotifyCreateCanisterResult{Ok: func() *principal.Principal { id := principal.MustDecode(canisterId); return &id }()})
+
+	// Returns the resource replaying the interactions (and nothing else) on mainnet, on a
+	// network of its own
+	networks := 0
+	replaying := func(t *testing.T, interactions ...agentInteraction) *CanisterResource {
+		networks++
+		fixture := agentFixture{Interactions: interactions}
+		fixture.replayed = make([]bool, len(fixture.Interactions))
+		backend, err := newMockBackend("", mockState{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend.replay = &fixture
+		host := withEndpointAlias(icpApi, fmt.Sprintf("%s-%d", strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-")), networks))
+		setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, func(http.RoundTripper) http.RoundTripper {
+			return &mockTransport{backend: backend}
+		}))
+		return &CanisterResource{
+			config: &agent.Config{
+				ClientConfig: &agent.ClientConfig{Host: host},
+				Identity:     new(identity.AnonymousIdentity),
+				FetchRootKey: true,
+				PollDelay:    10 * time.Millisecond,
+			},
+			cmcSettings: DefaultCmcSettings(),
+		}
+	}
+
+	// The planned attributes, which are otherwise null
+	attributes := map[string]attr.Value{
+		"controllers":    types.ListUnknown(types.StringType),
+		"wasm_sha256":    types.StringUnknown(),
+		"arg_sha256":     types.StringUnknown(),
+		"output_values":  types.MapUnknown(types.StringType),
+		"cycles_balance": types.Int64Unknown(),
+	}
+
+	t.Run("pending claim", func(t *testing.T) {
+		defer func(timeout time.Duration) { notifyRetryTimeout = timeout }(notifyRetryTimeout)
+		notifyRetryTimeout = 0
+
+		r := replaying(t, append(transfer, notify(cmc.NotifyCreateCanisterResult{Err: &cmc.NotifyError{Processing: new(idl.Null)}}))...)
+		req, resp := testCanisterCreateRequest(t, r, attributes)
+		r.Create(ctx, req, resp)
+		if !resp.Diagnostics.HasError() || !strings.Contains(resp.Diagnostics.Errors()[0].Detail(), "terraform untaint") {
+			t.Fatalf("expected the creation to be pending, got %v", resp.Diagnostics)
+		}
+		claim, diags := readPendingClaim(ctx, resp.Private)
+		if diags.HasError() || claim == nil || claim.BlockIndex != transferBlock {
+			t.Fatalf("expected the pending claim in the private state, got %+v (%v)", claim, diags)
+		}
+		var data CanisterResourceModel
+		if diags := resp.State.Get(ctx, &data); diags.HasError() {
+			t.Fatal(diags)
+		}
+		if !data.Id.IsNull() {
+			t.Fatalf("expected no canister in the state, got %s", data.Id)
+		}
+
+		// The claim is kept while the CMC is processing it
+		r = replaying(t, notify(cmc.NotifyCreateCanisterResult{Err: &cmc.NotifyError{Processing: new(idl.Null)}}))
+		diags = r.resumePendingClaim(ctx, &data, resp.Private)
+		if diags.HasError() || diags.WarningsCount() != 1 {
+			t.Fatalf("expected a warning, got %v", diags)
+		}
+		if claim, _ := readPendingClaim(ctx, resp.Private); claim == nil || claim.BlockIndex != transferBlock {
+			t.Fatalf("expected the pending claim to be kept, got %+v", claim)
+		}
+
+		// The next apply claims the canister: the fixture has no transfer to replay, so
+		// paying again would fail
+		r = replaying(t, created)
+		diags = r.resumePendingClaim(ctx, &data, resp.Private)
+		if diags.HasError() || diags.WarningsCount() > 0 {
+			t.Fatal(diags)
+		}
+		if data.Id.ValueString() != canisterId {
+			t.Errorf("expected canister %s to be claimed, got %s", canisterId, data.Id)
+		}
+		if claim, _ := readPendingClaim(ctx, resp.Private); claim != nil {
+			t.Errorf("expected the pending claim to be removed, got %+v", claim)
+		}
+	})
+
+	t.Run("checkpoint", func(t *testing.T) {
+		// The canister is claimed, but the fixture has none of the calls setting it up
+		r := replaying(t, append(transfer, created)...)
+		req, resp := testCanisterCreateRequest(t, r, attributes)
+		r.Create(ctx, req, resp)
+		if !resp.Diagnostics.HasError() || !strings.Contains(resp.Diagnostics.Errors()[0].Detail(), "terraform untaint") {
+			t.Fatalf("expected the creation to be checkpointed, got %v", resp.Diagnostics)
+		}
+		checkpoint, _ := resp.Private.GetKey(ctx, privateKeyCreationCheckpoint)
+		if string(checkpoint) != `{"canister_id":"`+canisterId+`"}` {
+			t.Fatalf("expected the checkpoint of canister %s in the private state, got %s", canisterId, checkpoint)
+		}
+		if claim, _ := readPendingClaim(ctx, resp.Private); claim != nil {
+			t.Errorf("expected no pending claim, got %+v", claim)
+		}
+		var data CanisterResourceModel
+		if diags := resp.State.Get(ctx, &data); diags.HasError() {
+			t.Fatal(diags)
+		}
+		if data.Id.ValueString() != canisterId || data.WasmSha256.ValueString() != "" || len(data.Controllers.Elements()) != 1 {
+			t.Fatalf("expected the checkpointed canister in the state, got %s", data)
+		}
+
+		// Once untainted, the next apply plans to resume the creation with an update, which
+		// sets the canister up without creating another one
+		name := strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-"))
+		host, _ := url.Parse("mock://" + name)
+		setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, nil))
+		backend, err := loadMockBackend(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend.mu.Lock()
+		backend.State.Canisters[canisterId] = &mockCanister{Controllers: []string{principal.AnonymousID.Encode()}, Status: "running", Cycles: 1_000_000_000_000}
+		nextCanister := backend.State.NextCanister
+		backend.mu.Unlock()
+		r.config.ClientConfig.Host = host
+
+		config := tfsdk.Config{Schema: req.Plan.Schema, Raw: req.Plan.Raw}
+		plan := tfsdk.Plan{Schema: req.Plan.Schema, Raw: resp.State.Raw}
+		planResp := &fwresource.ModifyPlanResponse{Plan: plan, Private: resp.Private}
+		r.ModifyPlan(ctx, fwresource.ModifyPlanRequest{Config: config, Plan: plan, State: resp.State, Private: resp.Private}, planResp)
+		if planResp.Diagnostics.HasError() {
+			t.Fatal(planResp.Diagnostics)
+		}
+		var planned CanisterResourceModel
+		if diags := planResp.Plan.Get(ctx, &planned); diags.HasError() {
+			t.Fatal(diags)
+		}
+		if !planned.OutputValues.IsUnknown() {
+			t.Errorf("expected the creation to be resumed, got %s", planned)
+		}
+
+		updateResp := &fwresource.UpdateResponse{State: resp.State, Private: resp.Private}
+		r.Update(ctx, fwresource.UpdateRequest{Config: config, Plan: planResp.Plan, State: resp.State, Private: resp.Private}, updateResp)
+		if updateResp.Diagnostics.HasError() {
+			t.Fatal(updateResp.Diagnostics)
+		}
+		if checkpoint, _ := resp.Private.GetKey(ctx, privateKeyCreationCheckpoint); checkpoint != nil {
+			t.Errorf("expected the checkpoint to be removed, got %s", checkpoint)
+		}
+		if diags := updateResp.State.Get(ctx, &data); diags.HasError() {
+			t.Fatal(diags)
+		}
+		if data.Id.ValueString() != canisterId {
+			t.Errorf("expected canister %s in the state, got %s", canisterId, data.Id)
+		}
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+		if backend.State.NextCanister != nextCanister {
+			t.Error("expected no canister to be created")
+		}
+	})
 }
@@ -0,0 +1,587 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/aviate-labs/agent-go/candid"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// Candid type codes, see https://github.com/dfinity/candid/blob/master/spec/Candid.md#binary-format
+const (
+	candidPrincipalType = -24
+	candidServiceType   = -23
+	candidFuncType      = -22
+	candidVariantType   = -21
+	candidRecordType    = -20
+	candidVecType       = -19
+	candidOptType       = -18
+)
+
+// Settings of update_settings managed by first-class attributes of ic_canister, which
+// can't be set through raw_settings.
+var firstClassCanisterSettings = []string{"controllers", "freezing_threshold", "reserved_cycles_limit", "wasm_memory_threshold", "log_visibility"}
+
+// canisterNatSetting is a nat setting of update_settings with a first-class (Number)
+// attribute of ic_canister, which is only set (and refreshed) when configured.
+type canisterNatSetting struct {
+	name      string
+	attribute func(data *CanisterResourceModel) *types.Int64
+}
+
+var canisterNatSettings = []canisterNatSetting{
+	{"freezing_threshold", func(data *CanisterResourceModel) *types.Int64 { return &data.FreezingThreshold }},
+	{"reserved_cycles_limit", func(data *CanisterResourceModel) *types.Int64 { return &data.ReservedCyclesLimit }},
+	{"wasm_memory_threshold", func(data *CanisterResourceModel) *types.Int64 { return &data.WasmMemoryThreshold }},
+}
+
+// Returns true if any of the nat settings with a first-class attribute is set.
+func (data *CanisterResourceModel) hasNatSettings() bool {
+	for _, setting := range canisterNatSettings {
+		if value := setting.attribute(data); !value.IsNull() && !value.IsUnknown() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the nat settings with a first-class attribute as raw settings (hex-encoded candid
+// nats), leaving out those that are not set, or that are unchanged from prior (unless nil).
+func (data *CanisterResourceModel) natRawSettings(prior *CanisterResourceModel) (map[string]string, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	settings := map[string]string{}
+	for _, setting := range canisterNatSettings {
+		value := setting.attribute(data)
+		if value.IsNull() || value.IsUnknown() || (prior != nil && value.Equal(*setting.attribute(prior))) {
+			continue
+		}
+		raw, err := idl.Marshal([]any{idl.NewNat(uint64(value.ValueInt64()))})
+		if err != nil {
+			diags.Append(clientErrorDiagnostic("Could not encode "+setting.name, err))
+			continue
+		}
+		settings[setting.name] = hex.EncodeToString(raw)
+	}
+
+	return settings, diags
+}
+
+// Updates the nat settings with a first-class attribute with the canister's actual ones,
+// given the decoded canister_status result. Settings that are not set are left as they are.
+func (data *CanisterResourceModel) refreshNatSettings(ctx context.Context, status any) {
+	for _, setting := range canisterNatSettings {
+		value := setting.attribute(data)
+		if value.IsNull() || value.IsUnknown() {
+			continue
+		}
+		current := candidNat(candidField(candidField(status, "settings"), setting.name))
+		if current == nil || !current.IsInt64() {
+			continue
+		}
+		if current.Int64() != value.ValueInt64() {
+			tflog.Info(ctx, fmt.Sprintf("Setting %s changed to %s", setting.name, current.String()))
+			*value = types.Int64Value(current.Int64())
+		}
+	}
+}
+
+// Returns the raw settings (nil if null or unknown).
+func (data *CanisterResourceModel) StringRawSettings(ctx context.Context) (map[string]string, diag.Diagnostics) {
+	if data.RawSettings.IsNull() || data.RawSettings.IsUnknown() {
+		return nil, nil
+	}
+
+	var settings map[string]string
+	diags := data.RawSettings.ElementsAs(ctx, &settings, false)
+	return settings, diags
+}
+
+// Returns the raw settings that differ from the prior ones (or that weren't set before).
+// Different encodings of the same value (see ArgsEquivalent) are not changes.
+func changedRawSettings(settings map[string]string, prior map[string]string) map[string]string {
+	changed := map[string]string{}
+	for name, value := range settings {
+		if priorValue, ok := prior[name]; !ok || !ArgsEquivalent(value, priorValue) {
+			changed[name] = value
+		}
+	}
+	return changed
+}
+
+// candidMessage is a candid message split into its type table, the types of its values and
+// the encoded values, so that values can be embedded in other messages as is. This is how
+// raw settings are passed to update_settings: agent-go can only encode the records and
+// variants it decodes under the hash of their field names, and would garble them.
+type candidMessage struct {
+	table  []candidTypeEntry
+	args   []int64 // indexes in table, or (negative) primitive type codes
+	values []byte
+}
+
+// A type table entry, with the references to other entries (which are shifted when the
+// table is embedded in another one) kept apart from the other bytes.
+type candidTypeEntry []candidTypePart
+
+type candidTypePart struct {
+	raw []byte
+	ref *int64 // set if the part is a type reference
+}
+
+// candidReader reads the LEB128-encoded numbers of a candid message.
+type candidReader struct {
+	raw []byte
+	pos int
+}
+
+var errCandidTooShort = errors.New("unexpected end of candid message")
+
+// Reads an unsigned LEB128 number, returning it along with its bytes.
+func (r *candidReader) uleb() (uint64, []byte, error) {
+	start := r.pos
+	var n uint64
+	for shift := 0; ; shift += 7 {
+		if r.pos >= len(r.raw) {
+			return 0, nil, errCandidTooShort
+		}
+		if shift > 63 {
+			return 0, nil, errors.New("LEB128 number too large")
+		}
+		b := r.raw[r.pos]
+		r.pos++
+		n |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return n, r.raw[start:r.pos], nil
+		}
+	}
+}
+
+// Reads a signed LEB128 number, returning it along with its bytes.
+func (r *candidReader) sleb() (int64, []byte, error) {
+	start := r.pos
+	var n int64
+	for shift := 0; ; shift += 7 {
+		if r.pos >= len(r.raw) {
+			return 0, nil, errCandidTooShort
+		}
+		if shift > 63 {
+			return 0, nil, errors.New("LEB128 number too large")
+		}
+		b := r.raw[r.pos]
+		r.pos++
+		n |= int64(b&0x7f) << shift
+		if b < 0x80 {
+			if b&0x40 != 0 && shift+7 < 64 {
+				n |= -1 << (shift + 7)
+			}
+			return n, r.raw[start:r.pos], nil
+		}
+	}
+}
+
+func candidUleb(n uint64) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func candidSleb(n int64) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if (n == 0 && c&0x40 == 0) || (n == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func parseCandidMessage(raw []byte) (*candidMessage, error) {
+	if !bytes.HasPrefix(raw, []byte("DIDL")) {
+		return nil, errors.New("not a candid message (no DIDL magic bytes)")
+	}
+	r := &candidReader{raw: raw, pos: 4}
+
+	tableLength, _, err := r.uleb()
+	if err != nil {
+		return nil, err
+	}
+
+	message := &candidMessage{}
+	for i := uint64(0); i < tableLength; i++ {
+		var entry candidTypeEntry
+		appendRaw := func() (uint64, error) {
+			n, b, err := r.uleb()
+			entry = append(entry, candidTypePart{raw: b})
+			return n, err
+		}
+		appendRef := func() error {
+			ref, _, err := r.sleb()
+			entry = append(entry, candidTypePart{ref: &ref})
+			return err
+		}
+
+		code, b, err := r.sleb()
+		if err != nil {
+			return nil, err
+		}
+		entry = append(entry, candidTypePart{raw: b})
+
+		switch code {
+		case candidOptType, candidVecType:
+			err = appendRef()
+		case candidRecordType, candidVariantType:
+			var n uint64
+			n, err = appendRaw()
+			for j := uint64(0); err == nil && j < n; j++ {
+				if _, err = appendRaw(); err == nil {
+					err = appendRef()
+				}
+			}
+		case candidFuncType:
+			for _, refs := range []bool{true, true, false} {
+				var n uint64
+				n, err = appendRaw()
+				for j := uint64(0); err == nil && j < n; j++ {
+					if refs {
+						err = appendRef()
+					} else if r.pos < len(r.raw) {
+						// Annotations (query, oneway...) are single bytes
+						entry = append(entry, candidTypePart{raw: r.raw[r.pos : r.pos+1]})
+						r.pos++
+					} else {
+						err = errCandidTooShort
+					}
+				}
+			}
+		case candidServiceType:
+			var n uint64
+			n, err = appendRaw()
+			for j := uint64(0); err == nil && j < n; j++ {
+				var length uint64
+				if length, err = appendRaw(); err != nil {
+					break
+				}
+				if uint64(len(r.raw)-r.pos) < length {
+					err = errCandidTooShort
+					break
+				}
+				entry = append(entry, candidTypePart{raw: r.raw[r.pos : r.pos+int(length)]})
+				r.pos += int(length)
+				err = appendRef()
+			}
+		default:
+			err = fmt.Errorf("unsupported type code %d in type table", code)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid type table: %w", err)
+		}
+
+		message.table = append(message.table, entry)
+	}
+
+	argsLength, _, err := r.uleb()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < argsLength; i++ {
+		arg, _, err := r.sleb()
+		if err != nil {
+			return nil, err
+		}
+		message.args = append(message.args, arg)
+	}
+
+	message.values = raw[r.pos:]
+
+	// The values are checked by decoding the whole message
+	if _, _, err := idl.Decode(raw); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// Returns the type reference, pointing into a table in which the entries of the message's
+// table start at offset.
+func shiftCandidRef(ref int64, offset int) int64 {
+	if ref < 0 {
+		return ref
+	}
+	return ref + int64(offset)
+}
+
+// Appends the entries of the message's table to table, with their references shifted.
+func (m *candidMessage) appendTable(table [][]byte) [][]byte {
+	offset := len(table)
+	for _, entry := range m.table {
+		var encoded []byte
+		for _, part := range entry {
+			if part.ref != nil {
+				encoded = append(encoded, candidSleb(shiftCandidRef(*part.ref, offset))...)
+			} else {
+				encoded = append(encoded, part.raw...)
+			}
+		}
+		table = append(table, encoded)
+	}
+	return table
+}
+
+// A field of a record type being encoded, by the hash of its name.
+type candidFieldRef struct {
+	hash uint64
+	ref  int64
+}
+
+// Returns the type table entry of the record with the fields.
+func candidRecordEntry(fields []candidFieldRef) []byte {
+	sort.Slice(fields, func(i, j int) bool { return fields[i].hash < fields[j].hash })
+
+	entry := candidSleb(candidRecordType)
+	entry = append(entry, candidUleb(uint64(len(fields)))...)
+	for _, field := range fields {
+		entry = append(entry, candidUleb(field.hash)...)
+		entry = append(entry, candidSleb(field.ref)...)
+	}
+	return entry
+}
+
+// Returns the raw setting (hex-encoded candid value), checking that it holds a single value.
+func parseRawSetting(name string, valueHex string) (*candidMessage, error) {
+	raw, err := hex.DecodeString(valueHex)
+	if err != nil {
+		return nil, fmt.Errorf("raw setting %s is not hex-encoded: %w", name, err)
+	}
+	message, err := parseCandidMessage(raw)
+	if err != nil {
+		return nil, fmt.Errorf("raw setting %s is not a candid value: %w", name, err)
+	}
+	if len(message.args) != 1 {
+		return nil, fmt.Errorf("raw setting %s must hold a single candid value, got %d", name, len(message.args))
+	}
+	return message, nil
+}
+
+// Returns the argument of update_settings setting the canister's settings to the raw
+// (hex-encoded candid) values, by name:
+//
+//	(record { canister_id : principal; settings : record { <name> : opt <value type>; ... } })
+//
+// Settings not listed are left out, and thus left unchanged by update_settings.
+func encodeRawUpdateSettings(canisterId principal.Principal, settings map[string]string) ([]byte, error) {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	// Values are encoded in the order of the fields, by hash
+	sort.Slice(names, func(i, j int) bool { return idl.Hash(names[i]).Cmp(idl.Hash(names[j])) < 0 })
+
+	var table [][]byte
+	var fields []candidFieldRef
+	var values []byte
+	for _, name := range names {
+		message, err := parseRawSetting(name, settings[name])
+		if err != nil {
+			return nil, err
+		}
+
+		offset := len(table)
+		table = message.appendTable(table)
+		table = append(table, append(candidSleb(candidOptType), candidSleb(shiftCandidRef(message.args[0], offset))...))
+
+		fields = append(fields, candidFieldRef{hash: idl.Hash(name).Uint64(), ref: int64(len(table) - 1)})
+		values = append(values, 0x01)
+		values = append(values, message.values...)
+	}
+
+	table = append(table, candidRecordEntry(fields))
+	table = append(table, candidRecordEntry([]candidFieldRef{
+		{hash: idl.Hash("canister_id").Uint64(), ref: candidPrincipalType},
+		{hash: idl.Hash("settings").Uint64(), ref: int64(len(table) - 1)},
+	}))
+
+	principalValue := append([]byte{0x01}, candidUleb(uint64(len(canisterId.Raw)))...)
+	principalValue = append(principalValue, canisterId.Raw...)
+	if idl.Hash("canister_id").Cmp(idl.Hash("settings")) < 0 {
+		values = append(principalValue, values...)
+	} else {
+		values = append(values, principalValue...)
+	}
+
+	arg := []byte("DIDL")
+	arg = append(arg, candidUleb(uint64(len(table)))...)
+	for _, entry := range table {
+		arg = append(arg, entry...)
+	}
+	arg = append(arg, candidUleb(1)...)
+	arg = append(arg, candidSleb(int64(len(table)-1))...)
+	arg = append(arg, values...)
+
+	return arg, nil
+}
+
+// Returns the type of the record's field (nil if the type is not a record with that field).
+func candidFieldType(ty idl.Type, name string) idl.Type {
+	record, ok := ty.(*idl.RecordType)
+	if !ok {
+		return nil
+	}
+	for _, field := range record.Fields {
+		if field.Name == name || field.Name == idl.HashString(name) {
+			return field.Type
+		}
+	}
+	return nil
+}
+
+// Whether the type contains records or variants, whose decoded values can't be encoded
+// again (see candidMessage).
+func candidHasFields(ty idl.Type) bool {
+	switch t := ty.(type) {
+	case *idl.RecordType, *idl.VariantType:
+		return true
+	case *idl.OptionalType:
+		return candidHasFields(t.Type)
+	case *idl.VectorType:
+		return candidHasFields(t.Type)
+	default:
+		return false
+	}
+}
+
+// Returns the current value of a raw setting, given the decoded canister_status result: the
+// configured value if equivalent, the current value (hex-encoded) otherwise, or the empty
+// string if the current value can't be encoded (but differs). ok is false if the
+// canister's settings don't include the setting.
+func currentRawSetting(statusType idl.Type, status any, name string, configured string) (_ string, ok bool) {
+	settingsType := candidFieldType(statusType, "settings")
+	ty := candidFieldType(settingsType, name)
+	if ty == nil {
+		return "", false
+	}
+	value := candidField(candidField(status, "settings"), name)
+
+	current, err := candid.DecodeValuesString([]idl.Type{ty}, []any{value})
+	if err != nil {
+		return "", false
+	}
+	if expected, err := canonicalArg(configured); err == nil && expected == "("+ty.String()+") "+current {
+		return configured, true
+	}
+
+	if candidHasFields(ty) {
+		return "", true
+	}
+	raw, err := idl.Encode([]idl.Type{ty}, []any{value})
+	if err != nil {
+		return "", true
+	}
+	return hex.EncodeToString(raw), true
+}
+
+// Returns the quotas (nil if null or unknown).
+func (data *CanisterResourceModel) Int64Quotas(ctx context.Context) (map[string]int64, diag.Diagnostics) {
+	if data.Quotas.IsNull() || data.Quotas.IsUnknown() {
+		return nil, nil
+	}
+
+	var quotas map[string]int64
+	diags := data.Quotas.ElementsAs(ctx, &quotas, false)
+	return quotas, diags
+}
+
+// Returns the quotas that differ from the prior ones (or that weren't set before).
+func changedQuotas(quotas map[string]int64, prior map[string]int64) map[string]int64 {
+	changed := map[string]int64{}
+	for name, value := range quotas {
+		if priorValue, ok := prior[name]; !ok || value != priorValue {
+			changed[name] = value
+		}
+	}
+	return changed
+}
+
+// Whether the network supports the setting, i.e. whether the settings of the canister_status
+// result include it.
+func canisterSettingSupported(statusType idl.Type, name string) bool {
+	return candidFieldType(candidFieldType(statusType, "settings"), name) != nil
+}
+
+// Returns the quotas as raw settings (hex-encoded candid nats), leaving out (and warning
+// about) the settings that the network doesn't support. A nil statusType means that support
+// is unknown, in which case all the quotas are returned.
+func quotaRawSettings(statusType idl.Type, quotas map[string]int64) (map[string]string, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	settings := map[string]string{}
+	var unsupported []string
+	for name, value := range quotas {
+		if statusType != nil && !canisterSettingSupported(statusType, name) {
+			unsupported = append(unsupported, name)
+			continue
+		}
+		raw, err := idl.Marshal([]any{idl.NewNat(uint64(value))})
+		if err != nil {
+			diags.Append(clientErrorDiagnostic("Could not encode quota "+name, err))
+			continue
+		}
+		settings[name] = hex.EncodeToString(raw)
+	}
+
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		diags.AddAttributeWarning(path.Root("quotas"), "Unsupported quotas",
+			fmt.Sprintf("The network doesn't support the settings %v yet (canister_status doesn't report them), so they are not set. "+
+				"They are set by the first apply after the network supports them.", unsupported))
+	}
+
+	return settings, diags
+}
+
+// Updates the quotas with the canister's actual ones, given the decoded canister_status
+// result. Quotas that the network doesn't support are left as they are.
+func (data *CanisterResourceModel) refreshQuotas(ctx context.Context, statusType idl.Type, status any) diag.Diagnostics {
+	quotas, diags := data.Int64Quotas(ctx)
+	if diags.HasError() || len(quotas) == 0 {
+		return diags
+	}
+
+	for name, value := range quotas {
+		if !canisterSettingSupported(statusType, name) {
+			continue
+		}
+		current := candidNat(candidField(candidField(status, "settings"), name))
+		if current == nil || !current.IsInt64() {
+			continue
+		}
+		if current.Int64() != value {
+			tflog.Info(ctx, fmt.Sprintf("Quota %s changed to %s", name, current.String()))
+			quotas[name] = current.Int64()
+		}
+	}
+
+	var d diag.Diagnostics
+	data.Quotas, d = types.MapValueFrom(ctx, types.Int64Type, quotas)
+	diags.Append(d...)
+	return diags
+}
@@ -0,0 +1,172 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Returns the candid message assembled again from its parts.
+func (m *candidMessage) encode() []byte {
+	table := m.appendTable(nil)
+	raw := append([]byte("DIDL"), candidUleb(uint64(len(table)))...)
+	for _, entry := range table {
+		raw = append(raw, entry...)
+	}
+	raw = append(raw, candidUleb(uint64(len(m.args)))...)
+	for _, arg := range m.args {
+		raw = append(raw, candidSleb(arg)...)
+	}
+	return append(raw, m.values...)
+}
+
+// Candid messages with records, variants and opt or nat fields, by name.
+func testCandidMessages(t *testing.T) map[string][]byte {
+	encode := func(types []idl.Type, values []any) []byte {
+		raw, err := idl.Encode(types, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	viewers := idl.NewRecordType(map[string]idl.Type{
+		"threshold": idl.NewOptionalType(new(idl.NatType)),
+		"viewers":   idl.NewVectorType(new(idl.PrincipalType)),
+	})
+	visibility := idl.NewVariantType(map[string]idl.Type{
+		"public":          new(idl.NullType),
+		"controllers":     new(idl.NullType),
+		"allowed_viewers": idl.NewVectorType(new(idl.PrincipalType)),
+	})
+	anonymous := principal.AnonymousID
+
+	return map[string][]byte{
+		"nat":          encode([]idl.Type{new(idl.NatType)}, []any{idl.NewNat(uint(1) << 40)}),
+		"opt nat":      encode([]idl.Type{idl.NewOptionalType(new(idl.NatType))}, []any{idl.NewNat(uint(42))}),
+		"opt nat null": encode([]idl.Type{idl.NewOptionalType(new(idl.NatType))}, []any{nil}),
+		"record": encode([]idl.Type{viewers}, []any{map[string]any{
+			"threshold": idl.NewNat(uint(3)),
+			"viewers":   []any{anonymous},
+		}}),
+		"opt record": encode([]idl.Type{idl.NewOptionalType(viewers)}, []any{map[string]any{
+			"threshold": nil,
+			"viewers":   []any{},
+		}}),
+		"variant": encode([]idl.Type{visibility}, []any{idl.Variant{Name: "allowed_viewers", Value: []any{anonymous}}}),
+		"two values": encode([]idl.Type{visibility, new(idl.NatType)}, []any{
+			idl.Variant{Name: "controllers"},
+			idl.NewNat(uint(7)),
+		}),
+	}
+}
+
+// Checks that parsed messages are encoded again as they were.
+func TestParseCandidMessage(t *testing.T) {
+	for name, raw := range testCandidMessages(t) {
+		t.Run(name, func(t *testing.T) {
+			message, err := parseCandidMessage(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encoded := message.encode(); !bytes.Equal(encoded, raw) {
+				t.Fatalf("expected %x, got %x", raw, encoded)
+			}
+
+			// Every truncation is rejected
+			for i := 0; i < len(raw); i++ {
+				if _, err := parseCandidMessage(raw[:i]); err == nil {
+					t.Fatalf("no error parsing the first %d bytes of %x", i, raw)
+				}
+			}
+		})
+	}
+
+	for name, raw := range map[string][]byte{
+		"no magic bytes":      []byte("DIDX\x00\x01\x7d\x01"),
+		"unknown type code":   []byte("DIDL\x01\x50\x01\x00"),
+		"value of wrong type": []byte("DIDL\x00\x01\x71\x05hi"),
+		"empty":               nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseCandidMessage(raw); err == nil {
+				t.Fatalf("no error parsing %x", raw)
+			}
+		})
+	}
+}
+
+// Checks that the argument of update_settings decodes to the raw settings, including
+// settings unknown to agent-go and records whose field names are only known by hash.
+func TestEncodeRawUpdateSettings(t *testing.T) {
+	canisterId := principal.MustDecode("ryjl3-tyaaa-aaaaa-aaaba-cai")
+	messages := testCandidMessages(t)
+
+	settings := map[string]string{}
+	for name, message := range map[string]string{
+		"freezing_threshold":    "nat",
+		"reserved_cycles_limit": "opt nat",
+		"future_setting":        "record",
+		"log_visibility":        "variant",
+		"wasm_memory_limit":     "opt record",
+	} {
+		settings[name] = hex.EncodeToString(messages[message])
+	}
+
+	arg, err := encodeRawUpdateSettings(canisterId, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, values, err := idl.Decode(arg)
+	if err != nil {
+		t.Fatalf("%s: %x", err, arg)
+	}
+	if len(values) != 1 {
+		t.Fatalf("expected a single value, got %d", len(values))
+	}
+
+	if id, ok := candidField(values[0], "canister_id").(principal.Principal); !ok || !id.Equal(canisterId) {
+		t.Errorf("expected canister_id %s, got %v", canisterId, candidField(values[0], "canister_id"))
+	}
+	decoded := candidField(values[0], "settings")
+	if fields, ok := decoded.(map[string]any); !ok || len(fields) != len(settings) {
+		t.Fatalf("expected %d settings, got %v", len(settings), decoded)
+	}
+
+	if n := candidNat(candidField(decoded, "freezing_threshold")); n == nil || n.Cmp(new(big.Int).Lsh(big.NewInt(1), 40)) != 0 {
+		t.Errorf("expected freezing_threshold 2^40, got %v", n)
+	}
+	if n := candidNat(candidField(decoded, "reserved_cycles_limit")); n == nil || n.Int64() != 42 {
+		t.Errorf("expected reserved_cycles_limit 42, got %v", n)
+	}
+	future := candidField(decoded, "future_setting")
+	if n := candidNat(candidField(future, "threshold")); n == nil || n.Int64() != 3 {
+		t.Errorf("expected future_setting.threshold 3, got %v", future)
+	}
+	if viewers, ok := candidField(future, "viewers").([]any); !ok || len(viewers) != 1 {
+		t.Errorf("expected a single viewer in future_setting, got %v", future)
+	}
+	if variant, ok := candidField(decoded, "log_visibility").(*idl.Variant); !ok || variant.Name != idl.HashString("allowed_viewers") && variant.Name != "allowed_viewers" {
+		t.Errorf("expected log_visibility allowed_viewers, got %v", candidField(decoded, "log_visibility"))
+	}
+
+	// Settings with no or several values, or which aren't candid, are rejected
+	for name, value := range map[string]string{
+		"two values": hex.EncodeToString(messages["two values"]),
+		"no value":   hex.EncodeToString([]byte("DIDL\x00\x00")),
+		"truncated":  hex.EncodeToString(messages["record"][:len(messages["record"])-1]),
+		"not hex":    "DIDL",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := encodeRawUpdateSettings(canisterId, map[string]string{"freezing_threshold": value}); err == nil {
+				t.Fatalf("no error encoding %s", value)
+			}
+		})
+	}
+}
@@ -0,0 +1,418 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic"
+	cmc "github.com/aviate-labs/agent-go/ic/cmc"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	ledger "github.com/aviate-labs/agent-go/ic/icpledger"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Sources of the cycles topping up canisters (see top_up_source).
+const (
+	topUpSourceCmc          = "cmc"           // ICP of the funding account, converted by the CMC
+	topUpSourceCyclesLedger = "cycles_ledger" // cycles of the identity on the cycles ledger
+	topUpSourceProvisional  = "provisional"   // minted, on test networks
+)
+
+var MEMO_TOP_UP_CANISTER uint64 = 0x50555054
+
+var cyclesLedgerPrincipal, _ = principal.Decode("um5iw-rqaaa-aaaaq-qaaba-cai")
+
+// Returns the source of the cycles topping up the canister: top_up_source if set, and
+// otherwise the CMC on mainnet and provisional top-ups elsewhere (like for creations).
+func (r *CanisterResource) topUpSource(data *CanisterResourceModel) string {
+	if !data.TopUpSource.IsNull() && !data.TopUpSource.IsUnknown() {
+		return data.TopUpSource.ValueString()
+	}
+	if r.config.ClientConfig != nil && withoutEndpointAlias(r.config.ClientConfig.Host).String() == icpApi.String() {
+		return topUpSourceCmc
+	}
+	return topUpSourceProvisional
+}
+
+// Returns the cycles balance of the canister, read with canister_status (through the
+// wallet or proxy canister if any).
+func (r *CanisterResource) readCyclesBalance(ctx context.Context, canisterId principal.Principal) (*big.Int, error) {
+	mgmtAgent, err := newManagementAgent(ctx, *r.config, r.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create agent: %w", err)
+	}
+
+	status, err := mgmtAgent.CanisterStatusRaw(canisterId)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read canister status: %w", err)
+	}
+	cycles := candidNat(candidField(status, "cycles"))
+	if cycles == nil {
+		return nil, fmt.Errorf("Could not read canister status: no cycles balance")
+	}
+	return cycles, nil
+}
+
+// Returns the balance as the value of cycles_balance (balances beyond the range of the
+// attribute are clamped).
+func cyclesBalanceValue(balance *big.Int) types.Int64 {
+	if !balance.IsInt64() {
+		return types.Int64Value(math.MaxInt64)
+	}
+	return types.Int64Value(balance.Int64())
+}
+
+// Updates cycles_balance with the canister's balance, if minimum_cycles is set.
+func (r *CanisterResource) refreshCyclesBalance(ctx context.Context, data *CanisterResourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if data.MinimumCycles.IsNull() {
+		return diags
+	}
+
+	canisterId, err := principal.Decode(data.Id.ValueString())
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not decode canister id", err))
+		return diags
+	}
+
+	balance, err := r.readCyclesBalance(ctx, canisterId)
+	if err != nil {
+		diags.AddWarning("Could not refresh cycles balance", fmt.Sprintf("Could not read the cycles balance of canister %s, it is not topped up: %s", canisterId.Encode(), err.Error()))
+		return diags
+	}
+	data.CyclesBalance = cyclesBalanceValue(balance)
+
+	return diags
+}
+
+// Plans cycles_balance: null unless minimum_cycles is set, and unknown (so that the update
+// tops the canister up) if the refreshed balance is below minimum_cycles.
+func (data *CanisterResourceModel) planCyclesBalance(ctx context.Context, state *CanisterResourceModel, plan *tfsdk.Plan) diag.Diagnostics {
+	if data.MinimumCycles.IsNull() {
+		return plan.SetAttribute(ctx, path.Root("cycles_balance"), types.Int64Null())
+	}
+	if state == nil || data.MinimumCycles.IsUnknown() || state.CyclesBalance.IsNull() || state.CyclesBalance.IsUnknown() {
+		return nil
+	}
+	if state.CyclesBalance.ValueInt64() < data.MinimumCycles.ValueInt64() {
+		tflog.Info(ctx, fmt.Sprintf("Balance of canister %s (%d cycles) is below minimum_cycles, planning a top-up", state.Id.ValueString(), state.CyclesBalance.ValueInt64()))
+		return plan.SetAttribute(ctx, path.Root("cycles_balance"), types.Int64Unknown())
+	}
+	return nil
+}
+
+// Tops the canister up to top_up_to if its balance is below minimum_cycles, and sets
+// cycles_balance to its balance (or to null if minimum_cycles is not set).
+func (r *CanisterResource) ensureCyclesBalance(ctx context.Context, data *CanisterResourceModel, canisterId principal.Principal, private privateState) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if data.MinimumCycles.IsNull() {
+		data.CyclesBalance = types.Int64Null()
+		return diags
+	}
+
+	// A top-up that was paid for but not notified is completed first, so that the canister
+	// is not topped up twice
+	diags.Append(r.resumePendingTopUp(ctx, data, private)...)
+	if diags.HasError() {
+		return diags
+	}
+
+	balance, err := r.readCyclesBalance(ctx, canisterId)
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not read cycles balance", err))
+		return diags
+	}
+
+	minimum := big.NewInt(data.MinimumCycles.ValueInt64())
+	if balance.Cmp(minimum) < 0 {
+		cycles := new(big.Int).Sub(big.NewInt(data.TopUpTo.ValueInt64()), balance).Uint64()
+		source := r.topUpSource(data)
+
+		tflog.Info(ctx, fmt.Sprintf("Topping up canister %s (balance %s) with %d cycles from %s", canisterId.Encode(), balance.String(), cycles, source))
+		err = r.topUpCanister(ctx, canisterId, source, cycles)
+
+		// As on creation, the transfer is recorded to be resumed, or its refund to be
+		// reconciled
+		var pendingTopUpErr *PendingTopUpError
+		if errors.As(err, &pendingTopUpErr) {
+			diags.Append(writePendingTopUp(ctx, private, &pendingTopUpErr.TopUp)...)
+		}
+		var refundErr *CmcRefundError
+		if errors.As(err, &refundErr) {
+			diags.Append(r.appendCmcRefund(data, canisterId.Encode(), refundErr.Refund)...)
+		}
+		if err != nil {
+			diags.Append(clientErrorDiagnostic(fmt.Sprintf("Could not top up canister %s", canisterId.Encode()), err))
+			return diags
+		}
+
+		balance, err = r.readCyclesBalance(ctx, canisterId)
+		if err != nil {
+			diags.Append(clientErrorDiagnostic("Could not read cycles balance", err))
+			return diags
+		}
+	}
+	data.CyclesBalance = cyclesBalanceValue(balance)
+
+	return diags
+}
+
+// Adds the cycles to the canister's balance, paying with the source.
+func (r *CanisterResource) topUpCanister(ctx context.Context, canisterId principal.Principal, source string, cycles uint64) (err error) {
+	defer r.metrics.Time(ctx, "top_up_canister", canisterId.Encode())(&err)
+
+	switch source {
+	case topUpSourceCmc:
+		return topUpCanisterCMC(ctx, *r.config, r.cmcSettings, canisterId, cycles)
+	case topUpSourceCyclesLedger:
+		return topUpCanisterCyclesLedger(*r.config, canisterId, cycles)
+	default:
+		return topUpCanisterProvisional(*r.config, canisterId, cycles)
+	}
+}
+
+func topUpCanisterProvisional(config agent.Config, canisterId principal.Principal, cycles uint64) error {
+	arg, err := idl.Marshal([]any{icMgmt.ProvisionalTopUpCanisterArgs{CanisterId: canisterId, Amount: idl.NewNat(cycles)}})
+	if err != nil {
+		return err
+	}
+	_, err = CallRawWithEffectiveId(config, canisterId, ic.MANAGEMENT_CANISTER_PRINCIPAL, "provisional_top_up_canister", arg)
+	return err
+}
+
+// Transfers the ICP worth the cycles to the CMC, and notifies the CMC to top the canister
+// up with notify_top_up.
+func topUpCanisterCMC(ctx context.Context, config agent.Config, settings CmcSettings, canisterId principal.Principal, cycles uint64) error {
+	nE8s, err := cmcCyclesAmountE8s(config, settings, cycles)
+	if err != nil {
+		return err
+	}
+
+	transferArgs := ledger.TransferArgs{
+		Amount: ledger.Tokens{E8s: nE8s},
+		Fee:    ledger.Tokens{E8s: settings.TransferFeeE8s},
+		To:     cmcTopUpAccount(canisterId).Bytes(),
+		Memo:   MEMO_TOP_UP_CANISTER,
+	}
+	if settings.FundingSubaccount != nil {
+		transferArgs.FromSubaccount = &settings.FundingSubaccount
+	}
+
+	// Tracked, so that a transfer that timed out is not made again when retried
+	var res ledger.TransferResult
+	err = callAndWait(config, ic.LEDGER_PRINCIPAL, "transfer", transferArgs, &res)
+	if err != nil {
+		return fmt.Errorf("Could not transfer funds to top up canister: %w", err)
+	}
+	if res.Ok == nil {
+		str, _ := json.Marshal(res.Err)
+		return fmt.Errorf("Error when transferring funds: %s", string(str))
+	}
+
+	return notifyTopUp(ctx, config, PendingTopUp{BlockIndex: *res.Ok, AmountE8s: nE8s, FeeE8s: settings.TransferFeeE8s, CanisterId: canisterId.Encode()})
+}
+
+// The private state key used to persist an ICP transfer to the CMC that was not yet turned
+// into cycles with notify_top_up.
+const privateKeyPendingTopUp = "cmc_pending_top_up"
+
+// An ICP transfer to the CMC topping up the canister that has not (yet) been notified with
+// notify_top_up.
+type PendingTopUp struct {
+	BlockIndex uint64 `json:"block_index"`
+	AmountE8s  uint64 `json:"amount_e8s"`
+	FeeE8s     uint64 `json:"fee_e8s"`
+	CanisterId string `json:"canister_id"`
+}
+
+// Returned when the ICP was transferred to the CMC but the top-up could not be notified
+// (yet). The top-up can be resumed later using the block index.
+type PendingTopUpError struct {
+	TopUp PendingTopUp
+	Err   error
+}
+
+func (e *PendingTopUpError) Error() string {
+	return fmt.Sprintf("the ICP were transferred to the CMC in block %d, but the top-up could not be notified (it is resumed by the next apply): %s", e.TopUp.BlockIndex, e.Err.Error())
+}
+
+func (e *PendingTopUpError) Unwrap() error {
+	return e.Err
+}
+
+// Reads the pending top-up (if any) from the private state.
+func readPendingTopUp(ctx context.Context, private privateState) (*PendingTopUp, diag.Diagnostics) {
+	data, diags := private.GetKey(ctx, privateKeyPendingTopUp)
+	if diags.HasError() || data == nil {
+		return nil, diags
+	}
+
+	var topUp PendingTopUp
+	err := json.Unmarshal(data, &topUp)
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not read pending top-up from private state", err))
+		return nil, diags
+	}
+
+	return &topUp, diags
+}
+
+// Writes the pending top-up to the private state. A nil top-up removes it.
+func writePendingTopUp(ctx context.Context, private privateState, topUp *PendingTopUp) diag.Diagnostics {
+	if topUp == nil {
+		return private.SetKey(ctx, privateKeyPendingTopUp, nil)
+	}
+
+	data, err := json.Marshal(topUp)
+	if err != nil {
+		var diags diag.Diagnostics
+		diags.Append(clientErrorDiagnostic("Could not write pending top-up to private state", err))
+		return diags
+	}
+
+	return private.SetKey(ctx, privateKeyPendingTopUp, data)
+}
+
+// Resumes the top-up stored in the private state (if any), before the balance is checked.
+// Failing to notify the top-up is only reported as a warning, and the top-up is kept to be
+// resumed by the next apply.
+func (r *CanisterResource) resumePendingTopUp(ctx context.Context, data *CanisterResourceModel, private privateState) diag.Diagnostics {
+	topUp, diags := readPendingTopUp(ctx, private)
+	if diags.HasError() || topUp == nil {
+		return diags
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("Resuming top-up of canister %s for block %d", topUp.CanisterId, topUp.BlockIndex))
+
+	err := notifyTopUp(ctx, *r.config, *topUp)
+
+	var refundErr *CmcRefundError
+	if errors.As(err, &refundErr) {
+		// The top-up is over, the ICP were refunded
+		diags.AddWarning("Client Warning", fmt.Sprintf("Could not resume the top-up of canister %s: %s", topUp.CanisterId, err.Error()))
+		diags.Append(r.appendCmcRefund(data, topUp.CanisterId, refundErr.Refund)...)
+		diags.Append(writePendingTopUp(ctx, private, nil)...)
+		return diags
+	}
+
+	if err != nil {
+		diags.AddWarning("Client Warning", fmt.Sprintf("Could not resume the top-up of canister %s: %s", topUp.CanisterId, err.Error()))
+		return diags
+	}
+
+	diags.Append(writePendingTopUp(ctx, private, nil)...)
+	return diags
+}
+
+// Notifies the CMC of the transfer topping up the canister, retrying (like for creations)
+// while the CMC is processing the notification. If the retries are exhausted, a
+// *PendingTopUpError is returned, and a *CmcRefundError if the CMC refunded the transfer.
+func notifyTopUp(ctx context.Context, config agent.Config, topUp PendingTopUp) error {
+	canisterId, err := principal.Decode(topUp.CanisterId)
+	if err != nil {
+		return fmt.Errorf("Could not decode canister id: %w", err)
+	}
+	blockIndex := topUp.BlockIndex
+
+	a, err := newAgent(config)
+	if err != nil {
+		return &PendingTopUpError{TopUp: topUp, Err: fmt.Errorf("Could not create CMC agent: %w", err)}
+	}
+	cmcAgent := &cmc.Agent{Agent: a, CanisterId: ic.CYCLES_MINTING_PRINCIPAL}
+
+	deadline := time.Now().Add(notifyRetryTimeout)
+	delay := notifyRetryBaseDelay
+
+	for {
+		var retryErr error
+
+		res, err := cmcAgent.NotifyTopUp(cmc.NotifyTopUpArg{BlockIndex: blockIndex, CanisterId: canisterId})
+		switch {
+		case err != nil:
+			// The CMC deduplicates on the block index, so retrying is safe
+			retryErr = fmt.Errorf("Could not notify the CMC: %w", err)
+		case res.Ok != nil:
+			return nil
+		case res.Err != nil && res.Err.Processing != nil:
+			retryErr = fmt.Errorf("CMC is still processing block %d", blockIndex)
+		case res.Err != nil && res.Err.Refunded != nil:
+			refundE8s := uint64(0)
+			if topUp.AmountE8s > topUp.FeeE8s {
+				refundE8s = topUp.AmountE8s - topUp.FeeE8s
+			}
+			return &CmcRefundError{Refund: CmcRefund{
+				TransferBlockIndex: blockIndex,
+				RefundBlockIndex:   res.Err.Refunded.BlockIndex,
+				RefundE8s:          refundE8s,
+				Reason:             res.Err.Refunded.Reason,
+			}}
+		default:
+			str, _ := json.Marshal(res.Err)
+			return fmt.Errorf("Error when topping up canister: %s", string(str))
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return &PendingTopUpError{TopUp: topUp, Err: retryErr}
+		}
+
+		tflog.Warn(ctx, fmt.Sprintf("Retrying notify_top_up in %s: %s", delay, retryErr.Error()))
+
+		select {
+		case <-ctx.Done():
+			return &PendingTopUpError{TopUp: topUp, Err: ctx.Err()}
+		case <-time.After(delay):
+		}
+
+		delay = min(2*delay, notifyRetryMaxDelay)
+	}
+}
+
+type cyclesLedgerWithdrawArgs struct {
+	Amount idl.Nat             `ic:"amount"`
+	To     principal.Principal `ic:"to"`
+}
+
+// Withdraws the cycles from the identity's (default) account on the cycles ledger to the
+// canister. The reply is decoded generically, since the agent-go (v0.4.4) bindings don't
+// cover the cycles ledger.
+func topUpCanisterCyclesLedger(config agent.Config, canisterId principal.Principal, cycles uint64) error {
+	arg, err := idl.Marshal([]any{cyclesLedgerWithdrawArgs{Amount: idl.NewNat(cycles), To: canisterId}})
+	if err != nil {
+		return err
+	}
+
+	raw, err := CallRaw(config, cyclesLedgerPrincipal, "withdraw", arg)
+	if err != nil {
+		return err
+	}
+
+	_, values, err := idl.Decode(raw)
+	if err != nil || len(values) == 0 {
+		return fmt.Errorf("could not decode the reply of withdraw: %v", err)
+	}
+	result, ok := values[0].(*idl.Variant)
+	if !ok {
+		return fmt.Errorf("unexpected reply of withdraw: %v", values[0])
+	}
+	if result.Name != "Ok" && result.Name != idl.HashString("Ok") {
+		return fmt.Errorf("the cycles ledger refused the withdrawal: %v", result.Value)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/certification"
+	"github.com/aviate-labs/agent-go/certification/hashtree"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// How far the time of a certificate may be from the local time, as in the other IC agents.
+const maxCertificateTimeOffset = 5 * time.Minute
+
+// Returns the module hash of the canister (nil if the canister is empty). If certified, it
+// is read from a certificate verified against the root key (see readCertifiedCanisterInfo).
+func readCanisterModuleHash(a *agent.Agent, canisterId principal.Principal, certified bool) ([]byte, error) {
+	if !certified {
+		return a.GetCanisterModuleHash(canisterId)
+	}
+
+	moduleHash, err := readCertifiedCanisterInfo(a, canisterId, "module_hash")
+	var lookupError hashtree.LookupError
+	if errors.As(err, &lookupError) && lookupError.Type == hashtree.LookupResultAbsent {
+		// Empty canisters have no module hash
+		return nil, nil
+	}
+	return moduleHash, err
+}
+
+// Returns the controllers of the canister. If certified, they are read from a certificate
+// verified against the root key (see readCertifiedCanisterInfo).
+func readCanisterControllers(a *agent.Agent, canisterId principal.Principal, certified bool) ([]principal.Principal, error) {
+	if !certified {
+		return a.GetCanisterControllers(canisterId)
+	}
+
+	data, err := readCertifiedCanisterInfo(a, canisterId, "controllers")
+	if err != nil {
+		return nil, err
+	}
+
+	var raw [][]byte
+	if err := cbor.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("could not decode controllers: %w", err)
+	}
+
+	controllers := make([]principal.Principal, len(raw))
+	for i, controller := range raw {
+		controllers[i] = principal.Principal{Raw: controller}
+	}
+	return controllers, nil
+}
+
+// Reads /canister/<canisterId>/<subPath> with read_state, and checks the certificate: its
+// signature (and delegation) against the agent's root key, and its time.
+//
+// NOTE: agent-go (v0.4.4) only verifies the certificates of request statuses: the canister
+// info it reads (GetCanisterInfo) is whatever the endpoint returns. Moreover, it doesn't
+// verify the signature of the delegation of certificates (which is a certificate signed
+// with the root key).
+func readCertifiedCanisterInfo(a *agent.Agent, canisterId principal.Principal, subPath string) ([]byte, error) {
+	path := []hashtree.Label{hashtree.Label("canister"), canisterId.Raw, hashtree.Label(subPath)}
+
+	// Canister info is public, so the request is anonymous
+	data, err := cbor.Marshal(agent.Envelope{
+		Content: agent.Request{
+			Type:          agent.RequestTypeReadState,
+			Sender:        principal.AnonymousID,
+			Paths:         [][]hashtree.Label{path},
+			IngressExpiry: uint64(time.Now().Add(maxCertificateTimeOffset).UnixNano()),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not encode read_state request: %w", err)
+	}
+
+	respData, err := a.Client().ReadState(canisterId, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp map[string][]byte
+	if err := cbor.Unmarshal(respData, &resp); err != nil {
+		return nil, fmt.Errorf("could not decode read_state response: %w", err)
+	}
+
+	rootKey := a.GetRootKey()
+	if len(rootKey) < blsPublicKeyLength {
+		return nil, fmt.Errorf("invalid root key")
+	}
+	rootKey = rootKey[len(rootKey)-blsPublicKeyLength:]
+
+	cert, err := certification.New(canisterId, rootKey, resp["certificate"])
+	if err != nil {
+		return nil, fmt.Errorf("could not decode certificate: %w", err)
+	}
+	if err := verifyCertificate(*cert, rootKey); err != nil {
+		return nil, fmt.Errorf("invalid certificate of %s: %w", canisterId.Encode(), err)
+	}
+
+	return cert.Cert.Tree.Lookup(path...)
+}
+
+// Verifies the signature of the certificate (and of its delegation, if any) and its time.
+func verifyCertificate(cert certification.Certificate, rootKey []byte) error {
+	if delegation := cert.Cert.Delegation; delegation != nil {
+		if delegation.Certificate.Cert.Delegation != nil {
+			return fmt.Errorf("the delegation has a delegation")
+		}
+		delegationCert := certification.Certificate{Cert: delegation.Certificate.Cert, RootKey: rootKey}
+		if err := delegationCert.Verify(); err != nil {
+			return fmt.Errorf("invalid delegation: %w", err)
+		}
+	}
+
+	if err := cert.Verify(); err != nil {
+		return err
+	}
+
+	encodedTime, err := cert.Cert.Tree.Lookup(hashtree.Label("time"))
+	if err != nil {
+		return fmt.Errorf("no time: %w", err)
+	}
+	nanos, n := binary.Uvarint(encodedTime) // LEB128
+	if n <= 0 {
+		return fmt.Errorf("invalid time")
+	}
+	certTime := time.Unix(0, int64(nanos))
+	if offset := time.Since(certTime).Abs(); offset > maxCertificateTimeOffset {
+		return fmt.Errorf("the certificate's time (%s) is more than %s away from the local time: the certificate is stale, or the local clock is wrong", certTime.UTC().Format(time.RFC3339), maxCertificateTimeOffset)
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &CkEthDepositDataSource{}
+
+func NewCkEthDepositDataSource() datasource.DataSource {
+	return &CkEthDepositDataSource{}
+}
+
+// CkEthDepositDataSource derives the information needed to deposit ETH for ckETH.
+type CkEthDepositDataSource struct {
+	config *agent.Config
+}
+
+// CkEthDepositDataSourceModel describes the data source data model.
+type CkEthDepositDataSourceModel struct {
+	MinterId              types.String `tfsdk:"minter_id"`
+	Principal             types.String `tfsdk:"principal"`
+	HelperContractAddress types.String `tfsdk:"helper_contract_address"`
+	PrincipalBytes32      types.String `tfsdk:"principal_bytes32"`
+	ReadStrategy          types.String `tfsdk:"read_strategy"`
+}
+
+func (d *CkEthDepositDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_cketh_deposit"
+}
+
+func (d *CkEthDepositDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Derives the information needed to deposit ETH and receive ckETH: ETH is deposited by calling the minter's helper contract with the principal receiving the ckETH, encoded as `bytes32`.",
+
+		Attributes: map[string]schema.Attribute{
+			"minter_id": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Canister identifier of the ckETH minter",
+			},
+			"principal": schema.StringAttribute{
+				Optional:            true,
+				Computed:            true,
+				MarkdownDescription: "Principal receiving the ckETH. Defaults to the principal used by the provider.",
+			},
+			"helper_contract_address": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Ethereum address of the minter's helper contract",
+			},
+			"read_strategy": readStrategyAttribute("How the helper contract address is read from the minter: `query` reads it with a query (faster, but answered by a single replica), `certified` with an update call, whose reply is certified by the subnet. Defaults to `query`."),
+			"principal_bytes32": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "The principal encoded as `bytes32` (hex, `0x`-prefixed), as expected by the helper contract's deposit function",
+			},
+		},
+	}
+}
+
+func (d *CkEthDepositDataSource) Configure(ctx context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.config = providerData.Config
+}
+
+func (d *CkEthDepositDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	// The provider is not configured yet if its configuration isn't known (e.g. while validating)
+	if d.config == nil {
+		resp.Diagnostics.AddError("Unconfigured provider", "The provider must be configured before reading this data source.")
+		return
+	}
+
+	var data CkEthDepositDataSourceModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if data.Principal.IsNull() {
+		data.Principal = types.StringValue(d.config.Identity.Sender().Encode())
+	}
+
+	p, err := principal.Decode(data.Principal.ValueString())
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode principal", err))
+		return
+	}
+
+	principalBytes32, err := PrincipalToBytes32(p)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("", err))
+		return
+	}
+
+	minterId, err := principal.Decode(data.MinterId.ValueString())
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode minter id", err))
+		return
+	}
+
+	minterAgent, err := newAgent(*d.config)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not create agent", err))
+		return
+	}
+
+	certified, diags := certifiedReadStrategy(ctx, "The minter "+minterId.Encode(), data.ReadStrategy, false)
+	resp.Diagnostics.Append(diags...)
+
+	var helperContractAddress string
+	if certified {
+		err = minterAgent.Call(minterId, "smart_contract_address", []any{}, []any{&helperContractAddress})
+	} else {
+		err = minterAgent.Query(minterId, "smart_contract_address", []any{}, []any{&helperContractAddress})
+	}
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not read helper contract address", err))
+		return
+	}
+
+	data.HelperContractAddress = types.StringValue(helperContractAddress)
+	data.PrincipalBytes32 = types.StringValue(principalBytes32)
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Encodes the principal as bytes32 like the ckETH helper contract expects: the length of
+// the principal, followed by the principal bytes, right-padded with zeros.
+func PrincipalToBytes32(p principal.Principal) (string, error) {
+	if len(p.Raw) > 29 {
+		return "", fmt.Errorf("principal %s is too long", p.Encode())
+	}
+
+	bytes32 := make([]byte, 32)
+	bytes32[0] = byte(len(p.Raw))
+	copy(bytes32[1:], p.Raw)
+
+	return "0x" + hex.EncodeToString(bytes32), nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Checks the encoding of principals expected by the ckETH helper contract: the length of
+// the principal, the principal and zeros up to 32 bytes.
+func TestPrincipalToBytes32(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal principal.Principal
+		bytes32   string // empty if invalid
+	}{
+		{
+			name:      "anonymous",
+			principal: principal.AnonymousID,
+			bytes32:   "0x0104000000000000000000000000000000000000000000000000000000000000",
+		},
+		{
+			name:      "canister",
+			principal: principal.MustDecode("ryjl3-tyaaa-aaaaa-aaaba-cai"),
+			bytes32:   "0x0a00000000000000020101000000000000000000000000000000000000000000",
+		},
+		{
+			name:      "self-authenticating",
+			principal: principal.MustDecode("pzp6e-ekpqk-3c5x7-2h6so-njoeq-mt45d-h3h6c-q3mxf-vpeq5-fk5o7-yae"),
+			bytes32:   "0x1d4f82b62edffa3fa4e6a5c48327ce8cfb3f850db2e5abc90e955d77f0020000",
+		},
+		{
+			name:      "management canister",
+			principal: principal.Principal{Raw: []byte{}},
+			bytes32:   "0x0000000000000000000000000000000000000000000000000000000000000000",
+		},
+		{
+			name:      "too long",
+			principal: principal.Principal{Raw: make([]byte, 30)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bytes32, err := PrincipalToBytes32(test.principal)
+			if len(test.bytes32) == 0 {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", bytes32)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes32 != test.bytes32 {
+				t.Fatalf("expected %s, got %s", test.bytes32, bytes32)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/numberplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	icrcLedger "github.com/aviate-labs/agent-go/ic/sns/ledger"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &CkEthWithdrawalResource{}
+
+func NewCkEthWithdrawalResource() resource.Resource {
+	return &CkEthWithdrawalResource{}
+}
+
+// CkEthWithdrawalResource withdraws ckETH to an Ethereum address through the ckETH minter.
+type CkEthWithdrawalResource struct {
+	config *agent.Config
+
+	readOnly readOnlyMode // read_only is set, or mainnet is not allowed
+}
+
+// CkEthWithdrawalResourceModel describes the resource data model.
+type CkEthWithdrawalResourceModel struct {
+	Id         types.String `tfsdk:"id"`
+	MinterId   types.String `tfsdk:"minter_id"`
+	LedgerId   types.String `tfsdk:"ledger_id"`
+	Amount     types.Number `tfsdk:"amount"`
+	Recipient  types.String `tfsdk:"recipient"`
+	BlockIndex types.String `tfsdk:"block_index"`
+}
+
+// The ckETH minter's withdraw_eth types
+type ckEthWithdrawalArg struct {
+	Recipient string  `ic:"recipient"`
+	Amount    idl.Nat `ic:"amount"`
+}
+
+type ckEthWithdrawalResult struct {
+	Ok *struct {
+		BlockIndex idl.Nat `ic:"block_index" json:"block_index"`
+	} `ic:"Ok,variant"`
+	Err *struct {
+		AmountTooLow *struct {
+			MinWithdrawalAmount idl.Nat `ic:"min_withdrawal_amount" json:"min_withdrawal_amount"`
+		} `ic:"AmountTooLow,variant" json:"AmountTooLow,omitempty"`
+		InsufficientFunds *struct {
+			Balance idl.Nat `ic:"balance" json:"balance"`
+		} `ic:"InsufficientFunds,variant" json:"InsufficientFunds,omitempty"`
+		InsufficientAllowance *struct {
+			Allowance idl.Nat `ic:"allowance" json:"allowance"`
+		} `ic:"InsufficientAllowance,variant" json:"InsufficientAllowance,omitempty"`
+		RecipientAddressBlocked *struct {
+			Address string `ic:"address" json:"address"`
+		} `ic:"RecipientAddressBlocked,variant" json:"RecipientAddressBlocked,omitempty"`
+		TemporarilyUnavailable *string `ic:"TemporarilyUnavailable,variant" json:"TemporarilyUnavailable,omitempty"`
+	} `ic:"Err,variant"`
+}
+
+func (r *CkEthWithdrawalResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_cketh_withdrawal"
+}
+
+func (r *CkEthWithdrawalResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Withdraws ckETH from the provider's account to an Ethereum address. The ckETH minter is first approved (ICRC-2) on the ckETH ledger to burn the amount, and the withdrawal is then requested from the minter. " +
+			"Withdrawals cannot be undone: destroying the resource only removes it from the state, and changing any attribute creates a new withdrawal.",
+
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Identifier of the withdrawal (`<minter_id>:<block_index>`)",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"minter_id": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Canister identifier of the ckETH minter",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"ledger_id": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Canister identifier of the ckETH ledger",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"amount": schema.NumberAttribute{
+				Required:            true,
+				MarkdownDescription: "Amount to withdraw, in wei",
+				PlanModifiers: []planmodifier.Number{
+					numberplanmodifier.RequiresReplace(),
+				},
+			},
+			"recipient": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Ethereum address (`0x...`) the ETH are sent to",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"block_index": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "ckETH ledger block index of the burn transaction",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+		},
+	}
+}
+
+func (r *CkEthWithdrawalResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	r.config = providerData.Config
+	r.readOnly = providerData.ReadOnly
+}
+
+func (r *CkEthWithdrawalResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data CkEthWithdrawalResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.readOnly != readWrite {
+		resp.Diagnostics.Append(r.readOnly.diagnostic("withdraw ckETH"))
+		return
+	}
+
+	minterId, err := principal.Decode(data.MinterId.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("minter_id"), "Client Error", "Could not decode minter id: "+err.Error())
+		return
+	}
+
+	ledgerId, err := principal.Decode(data.LedgerId.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("ledger_id"), "Client Error", "Could not decode ledger id: "+err.Error())
+		return
+	}
+
+	amount, accuracy := data.Amount.ValueBigFloat().Int(nil)
+	if accuracy != big.Exact || amount.Sign() <= 0 {
+		resp.Diagnostics.AddAttributeError(path.Root("amount"), "Client Error", fmt.Sprintf("Expected amount to be a positive integer, got %s", data.Amount.String()))
+		return
+	}
+
+	// The minter burns the ckETH with icrc2_transfer_from, so it must be approved first
+	a, err := newAgent(*r.config)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not create ledger agent", err))
+		return
+	}
+	ledgerAgent := &icrcLedger.Agent{Agent: a, CanisterId: ledgerId}
+
+	tflog.Info(ctx, fmt.Sprintf("Approving minter %s for %s wei", minterId.Encode(), amount.String()))
+
+	approveRes, err := ledgerAgent.Icrc2Approve(icrcLedger.ApproveArgs{
+		Spender: icrcLedger.Account{Owner: minterId},
+		Amount:  idl.NewBigNat(amount),
+	})
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not approve minter", err))
+		return
+	}
+
+	if approveRes.Err != nil {
+		str, _ := json.Marshal(approveRes.Err)
+		resp.Diagnostics.AddError("Client Error", fmt.Sprintf("Error when approving minter: %s", string(str)))
+		return
+	}
+
+	minterAgent, err := newAgent(*r.config)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not create agent", err))
+		return
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("Withdrawing %s wei to %s", amount.String(), data.Recipient.ValueString()))
+
+	var res ckEthWithdrawalResult
+	err = minterAgent.Call(minterId, "withdraw_eth", []any{ckEthWithdrawalArg{
+		Recipient: data.Recipient.ValueString(),
+		Amount:    idl.NewBigNat(amount),
+	}}, []any{&res})
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not withdraw", err))
+		return
+	}
+
+	if res.Ok == nil {
+		str, _ := json.Marshal(res.Err)
+		resp.Diagnostics.AddError("Client Error", fmt.Sprintf("Error when withdrawing: %s", string(str)))
+		return
+	}
+
+	data.BlockIndex = types.StringValue(res.Ok.BlockIndex.String())
+	data.Id = types.StringValue(minterId.Encode() + ":" + res.Ok.BlockIndex.String())
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *CkEthWithdrawalResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data CkEthWithdrawalResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Save updated data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// All attributes require replacement, so this only stores the planned data.
+func (r *CkEthWithdrawalResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data CkEthWithdrawalResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Withdrawals cannot be undone, so this only removes the resource from the state.
+func (r *CkEthWithdrawalResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	var data CkEthWithdrawalResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	tflog.Info(ctx, "Forgetting about withdrawal "+data.Id.ValueString())
+}
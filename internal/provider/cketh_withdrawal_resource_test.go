@@ -0,0 +1,113 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+
+	"github.com/aviate-labs/agent-go/candid/idl"
+	icrcLedger "github.com/aviate-labs/agent-go/ic/sns/ledger"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+)
+
+// Replays the approval of the ckETH minter and the withdrawal, on mainnet.
+func TestCkEthWithdrawalResource(t *testing.T) {
+
+	const minterId = "sv3dd-oaaaa-aaaar-qacoa-cai"
+	const ledgerId = "ss2fx-dyaaa-aaaar-qacoq-cai"
+
+	approveBlock := idl.NewNat(uint(10))
+	approve, err := idl.Marshal([]any{icrcLedger.ApproveResult{Ok: &approveBlock}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var withdrawn ckEthWithdrawalResult
+	withdrawn.Ok = &struct {
+		BlockIndex idl.Nat `ic:"block_index" json:"block_index"`
+	}{BlockIndex: idl.NewNat(uint(11))}
+	withdraw, err := idl.Marshal([]any{withdrawn})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tooLow ckEthWithdrawalResult
+	tooLow.Err = &struct {
+		AmountTooLow *struct {
+			MinWithdrawalAmount idl.Nat `ic:"min_withdrawal_amount" json:"min_withdrawal_amount"`
+		} `ic:"AmountTooLow,variant" json:"AmountTooLow,omitempty"`
+		InsufficientFunds *struct {
+			Balance idl.Nat `ic:"balance" json:"balance"`
+		} `ic:"InsufficientFunds,variant" json:"InsufficientFunds,omitempty"`
+		InsufficientAllowance *struct {
+			Allowance idl.Nat `ic:"allowance" json:"allowance"`
+		} `ic:"InsufficientAllowance,variant" json:"InsufficientAllowance,omitempty"`
+		RecipientAddressBlocked *struct {
+			Address string `ic:"address" json:"address"`
+		} `ic:"RecipientAddressBlocked,variant" json:"RecipientAddressBlocked,omitempty"`
+		TemporarilyUnavailable *string `ic:"TemporarilyUnavailable,variant" json:"TemporarilyUnavailable,omitempty"`
+	}{AmountTooLow: &struct {
+		MinWithdrawalAmount idl.Nat `ic:"min_withdrawal_amount" json:"min_withdrawal_amount"`
+	}{MinWithdrawalAmount: idl.NewNat(uint(30_000_000_000_000_000))}}
+	rejected, err := idl.Marshal([]any{tooLow})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Returns the fixture in which the minter replies to the withdrawal with reply
+	fixture := func(name string, reply []byte) string {
+		data, err := json.Marshal(agentFixture{Interactions: []agentInteraction{
+			{Type: "call", CanisterId: ledgerId, Method: "icrc2_approve", Reply: approve},
+			{Type: "call", CanisterId: minterId, Method: "withdraw_eth", Reply: reply},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := path.Join(t.TempDir(), name+".json")
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	config := `
+provider "ic" {
+    allow_mainnet = true
+    poll_interval = "10ms"
+}
+
+resource "ic_cketh_withdrawal" "test" {
+    minter_id = "` + minterId + `"
+    ledger_id = "` + ledgerId + `"
+    amount    = 50000000000000000
+    recipient = "0xb44B5e756A894775FC32EDdf3314Bb1B1944dC34"
+}
+`
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testFixtureProviderFactories(t, fixture("withdrawn", withdraw), ""),
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("ic_cketh_withdrawal.test", "block_index", "11"),
+					resource.TestCheckResourceAttr("ic_cketh_withdrawal.test", "id", minterId+":11"),
+				),
+			},
+		},
+	})
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testFixtureProviderFactories(t, fixture("too_low", rejected), ""),
+		Steps: []resource.TestStep{
+			{
+				Config:      config,
+				ExpectError: regexp.MustCompile(`AmountTooLow`),
+			},
+		},
+	})
+}
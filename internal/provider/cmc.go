@@ -0,0 +1,290 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/ic"
+	cmc "github.com/aviate-labs/agent-go/ic/cmc"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// How long we keep retrying notify_create_canister while the CMC is processing the
+// notification (or the network is flaky).
+var notifyRetryTimeout = 2 * time.Minute
+
+const notifyRetryBaseDelay = 2 * time.Second
+const notifyRetryMaxDelay = 16 * time.Second
+
+// Parameters used when interacting with the CMC & ledger. The defaults match mainnet,
+// but testnets with custom CMCs may need different values.
+type CmcSettings struct {
+	TransferFeeE8s     uint64
+	CreateCanisterMemo uint64
+	MinAmountE8s       uint64
+
+	// Subaccount of the identity's account funding the transfers, nil for the default
+	// subaccount
+	FundingSubaccount []byte
+}
+
+func DefaultCmcSettings() CmcSettings {
+	return CmcSettings{
+		TransferFeeE8s:     10_000,
+		CreateCanisterMemo: MEMO_CREATE_CANISTER,
+		MinAmountE8s:       0,
+	}
+}
+
+// The private state key used to persist an ICP transfer that was not yet turned into a
+// canister by the CMC.
+const privateKeyPendingClaim = "cmc_pending_claim"
+
+// An ICP transfer to the CMC that has not (yet) been claimed with notify_create_canister.
+type PendingClaim struct {
+	BlockIndex uint64  `json:"block_index"`
+	AmountE8s  uint64  `json:"amount_e8s"`
+	FeeE8s     uint64  `json:"fee_e8s"`
+	SubnetId   *string `json:"subnet_id,omitempty"`
+}
+
+// Returned when the ICP was transferred to the CMC but the canister could not be claimed
+// (yet). The claim can be resumed later using the block index.
+type PendingClaimError struct {
+	Claim PendingClaim
+	Err   error
+}
+
+func (e *PendingClaimError) Error() string {
+	return fmt.Sprintf("canister creation pending (ICP transfer at block %d not claimed yet): %s", e.Claim.BlockIndex, e.Err.Error())
+}
+
+func (e *PendingClaimError) Unwrap() error {
+	return e.Err
+}
+
+// A refund issued by the CMC after a failed operation.
+type CmcRefund struct {
+	TransferBlockIndex uint64  // the block of the original transfer to the CMC
+	RefundBlockIndex   *uint64 // the block of the refund, if known
+	RefundE8s          uint64  // the amount refunded (transferred amount minus the fee)
+	Reason             string
+}
+
+// Returned when the CMC refunded the ICP instead of performing the operation.
+type CmcRefundError struct {
+	Refund CmcRefund
+}
+
+func (e *CmcRefundError) Error() string {
+	refundBlock := "unknown block"
+	if e.Refund.RefundBlockIndex != nil {
+		refundBlock = fmt.Sprintf("block %d", *e.Refund.RefundBlockIndex)
+	}
+
+	return fmt.Sprintf("CMC refunded the ICP transfer at block %d (%d e8s refunded at %s): %s",
+		e.Refund.TransferBlockIndex, e.Refund.RefundE8s, refundBlock, e.Refund.Reason)
+}
+
+// The subset of the (framework) private state we use.
+type privateState interface {
+	GetKey(ctx context.Context, key string) ([]byte, diag.Diagnostics)
+	SetKey(ctx context.Context, key string, value []byte) diag.Diagnostics
+}
+
+// Reads the pending claim (if any) from the private state.
+func readPendingClaim(ctx context.Context, private privateState) (*PendingClaim, diag.Diagnostics) {
+	data, diags := private.GetKey(ctx, privateKeyPendingClaim)
+	if diags.HasError() || data == nil {
+		return nil, diags
+	}
+
+	var claim PendingClaim
+	err := json.Unmarshal(data, &claim)
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not read pending canister claim from private state", err))
+		return nil, diags
+	}
+
+	return &claim, diags
+}
+
+// Writes the pending claim to the private state. A nil claim removes it.
+func writePendingClaim(ctx context.Context, private privateState, claim *PendingClaim) diag.Diagnostics {
+	if claim == nil {
+		return private.SetKey(ctx, privateKeyPendingClaim, nil)
+	}
+
+	data, err := json.Marshal(claim)
+	if err != nil {
+		var diags diag.Diagnostics
+		diags.Append(clientErrorDiagnostic("Could not write pending canister claim to private state", err))
+		return diags
+	}
+
+	return private.SetKey(ctx, privateKeyPendingClaim, data)
+}
+
+// Decodes a hex-encoded (32 bytes) subaccount.
+func decodeSubaccount(subaccountHex string) ([]byte, error) {
+	subaccount, err := hex.DecodeString(subaccountHex)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(subaccount) != 32 {
+		return nil, fmt.Errorf("expected 32 bytes, got %d", len(subaccount))
+	}
+
+	return subaccount, nil
+}
+
+// Returns the identity's account funding the CMC transfers.
+func (s CmcSettings) FundingAccount(owner principal.Principal) principal.AccountIdentifier {
+	subaccount := principal.DefaultSubAccount
+	copy(subaccount[:], s.FundingSubaccount)
+	return principal.NewAccountID(owner, subaccount)
+}
+
+// Returns the CMC account to send ICP to in order to create canisters controlled by the
+// controller: the CMC's subaccount derived from the controller's principal.
+func cmcCreateCanisterAccount(controller principal.Principal) principal.AccountIdentifier {
+	return cmcPrincipalAccount(controller)
+}
+
+// Returns the CMC account to send ICP to in order to top up the canister: as for
+// creations, the CMC's subaccount derived from the canister's principal.
+func cmcTopUpAccount(canisterId principal.Principal) principal.AccountIdentifier {
+	return cmcPrincipalAccount(canisterId)
+}
+
+func cmcPrincipalAccount(p principal.Principal) principal.AccountIdentifier {
+	subaccount := [32]byte{}
+	subaccount[0] = byte(len(p.Raw))
+	copy(subaccount[1:], p.Raw)
+
+	return principal.NewAccountID(ic.CYCLES_MINTING_PRINCIPAL, subaccount)
+}
+
+// Cycles that canisters are created with by default (0.1T for the creation and 0.9T of
+// running costs).
+const defaultCreateCanisterCycles = 1_000_000_000_000
+
+// Returns the amount of ICP (in e8s) transferred to the CMC to create a canister with the
+// given cycles (0 for defaultCreateCanisterCycles).
+func cmcCreateCanisterAmountE8s(config agent.Config, settings CmcSettings, cycles uint64) (uint64, error) {
+	if cycles == 0 {
+		cycles = defaultCreateCanisterCycles
+	}
+	return cmcCyclesAmountE8s(config, settings, cycles)
+}
+
+// Returns the amount of ICP (in e8s) that the CMC converts to the given cycles, derived
+// from its cycles conversion rate (and at least the minimum amount of the settings).
+func cmcCyclesAmountE8s(config agent.Config, settings CmcSettings, cycles uint64) (uint64, error) {
+	a, err := newAgent(config)
+	if err != nil {
+		return 0, fmt.Errorf("Could not create CMC agent: %w", err)
+	}
+	cmcAgent := &cmc.Agent{Agent: a, CanisterId: ic.CYCLES_MINTING_PRINCIPAL}
+
+	conversionRate, err := cmcAgent.GetIcpXdrConversionRate()
+	if err != nil {
+		return 0, fmt.Errorf("Could not get cycles conversion rate from CMC: %w", err)
+	}
+
+	if conversionRate == nil {
+		return 0, fmt.Errorf("Got no conversion rate from CMC")
+	}
+
+	// XdrPermyriadPerIcp == price of 1e8s in cycles
+	// => price of cycles in 1e8s = 1 / XdrPermyriadPerIcp
+	nE8s := cycles / conversionRate.Data.XdrPermyriadPerIcp
+	return max(nE8s, settings.MinAmountE8s), nil
+}
+
+// Claims the canister paid for by the ICP transfer, following the CMC's retry protocol:
+// notify_create_canister is retried until the CMC either creates the canister or refunds
+// the transfer. If the retries are exhausted, a *PendingClaimError is returned.
+func notifyCreateCanister(ctx context.Context, config agent.Config, claim PendingClaim) (principal.Principal, error) {
+
+	a, err := newAgent(config)
+	if err != nil {
+		return principal.Principal{}, &PendingClaimError{Claim: claim, Err: fmt.Errorf("Could not create CMC agent: %w", err)}
+	}
+	cmcAgent := &cmc.Agent{Agent: a, CanisterId: ic.CYCLES_MINTING_PRINCIPAL}
+
+	notifyCreateCanisterArg := cmc.NotifyCreateCanisterArg{
+		BlockIndex: claim.BlockIndex,
+		Controller: config.Identity.Sender(),
+	}
+
+	if claim.SubnetId != nil {
+		subnetId, err := principal.Decode(*claim.SubnetId)
+		if err != nil {
+			return principal.Principal{}, fmt.Errorf("Could not decode subnet id: %w", err)
+		}
+
+		notifyCreateCanisterArg.SubnetSelection = &cmc.SubnetSelection{
+			Subnet: &struct {
+				Subnet principal.Principal `ic:"subnet" json:"subnet"`
+			}{Subnet: subnetId},
+		}
+	}
+
+	deadline := time.Now().Add(notifyRetryTimeout)
+	delay := notifyRetryBaseDelay
+
+	for {
+		var retryErr error
+
+		resCreate, err := cmcAgent.NotifyCreateCanister(notifyCreateCanisterArg)
+		switch {
+		case err != nil:
+			// Transport errors, timeouts, etc: the notification may or may not have gone
+			// through, retrying is safe since the CMC deduplicates on the block index.
+			retryErr = fmt.Errorf("Could not create canister on CMC: %w", err)
+		case resCreate.Ok != nil:
+			return *resCreate.Ok, nil
+		case resCreate.Err != nil && resCreate.Err.Processing != nil:
+			retryErr = fmt.Errorf("CMC is still processing block %d", claim.BlockIndex)
+		case resCreate.Err != nil && resCreate.Err.Refunded != nil:
+			refundE8s := uint64(0)
+			if claim.AmountE8s > claim.FeeE8s {
+				refundE8s = claim.AmountE8s - claim.FeeE8s
+			}
+			return principal.Principal{}, &CmcRefundError{Refund: CmcRefund{
+				TransferBlockIndex: claim.BlockIndex,
+				RefundBlockIndex:   resCreate.Err.Refunded.BlockIndex,
+				RefundE8s:          refundE8s,
+				Reason:             resCreate.Err.Refunded.Reason,
+			}}
+		default:
+			str, _ := json.Marshal(resCreate.Err)
+			return principal.Principal{}, fmt.Errorf("Error when creating canister: %s", string(str))
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return principal.Principal{}, &PendingClaimError{Claim: claim, Err: retryErr}
+		}
+
+		tflog.Warn(ctx, fmt.Sprintf("Retrying notify_create_canister in %s: %s", delay, retryErr.Error()))
+
+		select {
+		case <-ctx.Done():
+			return principal.Principal{}, &PendingClaimError{Claim: claim, Err: ctx.Err()}
+		case <-time.After(delay):
+		}
+
+		delay = min(2*delay, notifyRetryMaxDelay)
+	}
+}
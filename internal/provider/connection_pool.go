@@ -0,0 +1,43 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"net/http"
+	"time"
+)
+
+// Default connection pool (see max_idle_connections_per_host and max_connections_per_host).
+// The standard library only keeps 2 idle connections per host, so that applies with many
+// canisters, which poll read_state concurrently, keep opening connections (and doing TLS
+// handshakes).
+const (
+	defaultMaxIdleConnsPerHost = 32
+	defaultMaxConnsPerHost     = 0 // no limit
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// ConnectionPool describes the HTTP connections kept open to the IC.
+type ConnectionPool struct {
+	MaxIdleConnsPerHost int64 // connections kept open (and reused) per host once idle
+	MaxConnsPerHost     int64 // connections per host, 0 for no limit
+}
+
+func DefaultConnectionPool() ConnectionPool {
+	return ConnectionPool{
+		MaxIdleConnsPerHost: defaultMaxIdleConnsPerHost,
+		MaxConnsPerHost:     defaultMaxConnsPerHost,
+	}
+}
+
+// Returns a transport of the standard library (HTTP/2 when supported by the host, with
+// keep-alives) with the connection pool, for the requests to an endpoint.
+func (p ConnectionPool) transport() *http.Transport {
+	transport := defaultHTTPTransport.Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConns = 0 // only limited per host
+	transport.MaxIdleConnsPerHost = int(p.MaxIdleConnsPerHost)
+	transport.MaxConnsPerHost = int(p.MaxConnsPerHost)
+	transport.IdleConnTimeout = defaultIdleConnTimeout
+	return transport
+}
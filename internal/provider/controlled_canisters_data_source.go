@@ -0,0 +1,191 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Number of canisters fetched per dashboard API request
+const dashboardPageSize = 100
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &ControlledCanistersDataSource{}
+
+func NewControlledCanistersDataSource() datasource.DataSource {
+	return &ControlledCanistersDataSource{}
+}
+
+// ControlledCanistersDataSource lists the canisters controlled by a principal, as
+// indexed by the IC dashboard.
+type ControlledCanistersDataSource struct {
+	config *agent.Config
+}
+
+// ControlledCanistersDataSourceModel describes the data source data model.
+type ControlledCanistersDataSourceModel struct {
+	Controller  types.String `tfsdk:"controller"`
+	ApiUrl      types.String `tfsdk:"api_url"`
+	CanisterIds types.List   `tfsdk:"canister_ids"`
+}
+
+// A page of the dashboard API canister listing
+type dashboardCanisterPage struct {
+	Data           []dashboardCanister `json:"data"`
+	TotalCanisters int                 `json:"total_canisters"`
+}
+
+func (d *ControlledCanistersDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_controlled_canisters"
+}
+
+func (d *ControlledCanistersDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Lists the mainnet canisters controlled by a principal (by default the provider's principal), as indexed by the public IC dashboard API. " +
+			"This can be used to import canisters in bulk or to detect canisters created outside of Terraform. The data is indexed by the dashboard and may lag behind the state of the canisters.",
+
+		Attributes: map[string]schema.Attribute{
+			"controller": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Principal controlling the canisters. Defaults to the principal used by the provider.",
+			},
+			"api_url": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Base URL of the dashboard API. Defaults to `" + defaultDashboardApiUrl + "`.",
+			},
+			"canister_ids": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Identifiers of the canisters controlled by `controller`",
+			},
+		},
+	}
+}
+
+func (d *ControlledCanistersDataSource) Configure(ctx context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.config = providerData.Config
+}
+
+func (d *ControlledCanistersDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	// The provider is not configured yet if its configuration isn't known (e.g. while validating)
+	if d.config == nil {
+		resp.Diagnostics.AddError("Unconfigured provider", "The provider must be configured before reading this data source.")
+		return
+	}
+
+	var data ControlledCanistersDataSourceModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if data.Controller.IsNull() {
+		data.Controller = types.StringValue(d.config.Identity.Sender().Encode())
+	}
+
+	controller, err := principal.Decode(data.Controller.ValueString())
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode controller", err))
+		return
+	}
+
+	apiUrl := defaultDashboardApiUrl
+	if !data.ApiUrl.IsNull() {
+		apiUrl = data.ApiUrl.ValueString()
+	}
+
+	canisterIds, err := fetchDashboardControlledCanisters(ctx, apiUrl, controller)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not list canisters", err))
+		return
+	}
+
+	canisterIdsValue, diags := types.ListValueFrom(ctx, types.StringType, canisterIds)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	data.CanisterIds = canisterIdsValue
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Fetches all pages of canisters controlled by the controller.
+func fetchDashboardControlledCanisters(ctx context.Context, apiUrl string, controller principal.Principal) ([]string, error) {
+	endpoint, err := url.JoinPath(strings.TrimSuffix(apiUrl, "/"), "api", "v3", "canisters")
+	if err != nil {
+		return nil, err
+	}
+
+	canisterIds := []string{}
+	for offset := 0; ; offset += dashboardPageSize {
+		query := url.Values{}
+		query.Set("controller_id", controller.Encode())
+		query.Set("limit", strconv.Itoa(dashboardPageSize))
+		query.Set("offset", strconv.Itoa(offset))
+
+		pageUrl := endpoint + "?" + query.Encode()
+		tflog.Info(ctx, "Listing canisters: "+pageUrl)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		var page dashboardCanisterPage
+		if res.StatusCode == http.StatusOK {
+			err = json.NewDecoder(res.Body).Decode(&page)
+		} else {
+			err = fmt.Errorf("unexpected status: %s", res.Status)
+		}
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, canister := range page.Data {
+			canisterIds = append(canisterIds, canister.CanisterId)
+		}
+
+		if len(page.Data) < dashboardPageSize || len(canisterIds) >= page.TotalCanisters {
+			return canisterIds, nil
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+)
+
+func TestControlledCanistersDataSource(t *testing.T) {
+
+	// More than one page of canisters
+	total := dashboardPageSize + 5
+	controller := "r7inp-6aaaa-aaaaa-aaabq-cai"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/canisters" || r.URL.Query().Get("controller_id") != controller {
+			http.NotFound(w, r)
+			return
+		}
+
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+		page := dashboardCanisterPage{TotalCanisters: total}
+		for i := offset; i < min(offset+limit, total); i++ {
+			page.Data = append(page.Data, dashboardCanister{CanisterId: fmt.Sprintf("canister-%d", i)})
+		}
+
+		_ = json.NewEncoder(w).Encode(page)
+	}))
+	defer server.Close()
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+data "ic_controlled_canisters" "test" {
+    controller = "%s"
+    api_url = "%s"
+}
+`, controller, server.URL),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("data.ic_controlled_canisters.test", "canister_ids.#", strconv.Itoa(total)),
+					resource.TestCheckResourceAttr("data.ic_controlled_canisters.test", "canister_ids.0", "canister-0"),
+					resource.TestCheckResourceAttr("data.ic_controlled_canisters.test", "canister_ids.104", "canister-104"),
+				),
+			},
+		},
+	})
+}
@@ -0,0 +1,310 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework-validators/resourcevalidator"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/certification/hashtree"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &CustomSectionPolicyResource{}
+var _ resource.ResourceWithModifyPlan = &CustomSectionPolicyResource{}
+var _ resource.ResourceWithConfigValidators = &CustomSectionPolicyResource{}
+
+func NewCustomSectionPolicyResource() resource.Resource {
+	return &CustomSectionPolicyResource{}
+}
+
+// CustomSectionPolicyResource checks during plan that Wasm modules, local or installed on
+// canisters, contain the required custom sections. It does not manage anything on the IC.
+type CustomSectionPolicyResource struct {
+	config *agent.Config
+}
+
+// CustomSectionPolicyResourceModel describes the resource data model.
+type CustomSectionPolicyResourceModel struct {
+	Id               types.String `tfsdk:"id"`
+	WasmFiles        types.List   `tfsdk:"wasm_files"`
+	CanisterIds      types.List   `tfsdk:"canister_ids"`
+	RequiredSections types.List   `tfsdk:"required_sections"`
+}
+
+func (r *CustomSectionPolicyResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_custom_section_policy"
+}
+
+func (r *CustomSectionPolicyResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Enforces that Wasm modules contain the required custom sections (e.g. a git commit or an SBOM hash), be it local modules or the modules installed on canisters. " +
+			"The modules are checked on every plan and the plan fails if a section is missing. This resource does not manage anything on the IC.",
+
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Identifier of the policy (derived from the modules and sections)",
+			},
+			"wasm_files": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Optional:            true,
+				MarkdownDescription: "Paths to the (possibly gzipped) Wasm modules to check, e.g. the `wasm_file` of `ic_canister` resources",
+			},
+			"canister_ids": schema.ListAttribute{
+				ElementType: types.StringType,
+				Optional:    true,
+				MarkdownDescription: "Canisters whose installed modules are checked, e.g. canisters deployed outside of Terraform. " +
+					"The sections are read from the canisters' metadata, which only exposes the `icp:public` and `icp:private` sections (the latter only to controllers), " +
+					"without telling them apart: `icp:public git_commit_id` is satisfied by an `icp:private git_commit_id` section, and other custom sections are never found.",
+			},
+			"required_sections": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Required:            true,
+				MarkdownDescription: "Names of the custom sections the modules must contain. Names without an `icp:public ` or `icp:private ` prefix match either, e.g. `git_commit_id` matches `icp:public git_commit_id`.",
+			},
+		},
+	}
+}
+
+func (r CustomSectionPolicyResource) ConfigValidators(ctx context.Context) []resource.ConfigValidator {
+	return []resource.ConfigValidator{
+		resourcevalidator.AtLeastOneOf(
+			path.MatchRoot("wasm_files"),
+			path.MatchRoot("canister_ids"),
+		),
+	}
+}
+
+func (r *CustomSectionPolicyResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	r.config = providerData.Config
+}
+
+// Checks the modules and the canisters (with config). Unknown values (e.g. paths of
+// modules built during apply, or canisters created during apply) are checked during apply.
+func (data *CustomSectionPolicyResourceModel) Check(ctx context.Context, config *agent.Config) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if data.WasmFiles.IsUnknown() || data.CanisterIds.IsUnknown() || data.RequiredSections.IsUnknown() {
+		return diags
+	}
+
+	var wasmFiles []types.String
+	diags.Append(data.WasmFiles.ElementsAs(ctx, &wasmFiles, false)...)
+	var canisterIds []types.String
+	diags.Append(data.CanisterIds.ElementsAs(ctx, &canisterIds, false)...)
+	var requiredSections []types.String
+	diags.Append(data.RequiredSections.ElementsAs(ctx, &requiredSections, false)...)
+	if diags.HasError() {
+		return diags
+	}
+
+	for _, wasmFile := range wasmFiles {
+		if wasmFile.IsUnknown() {
+			continue
+		}
+
+		module, err := os.ReadFile(wasmFile.ValueString())
+		if err != nil {
+			diags.AddAttributeError(path.Root("wasm_files"), "Could not read module", err.Error())
+			continue
+		}
+
+		sections, err := wasmCustomSectionNames(module)
+		if err != nil {
+			diags.AddAttributeError(path.Root("wasm_files"), "Could not read module", fmt.Sprintf("%s: %s", wasmFile.ValueString(), err.Error()))
+			continue
+		}
+
+		for _, required := range requiredSections {
+			if required.IsUnknown() {
+				continue
+			}
+
+			if !hasCustomSection(sections, required.ValueString()) {
+				diags.AddAttributeError(path.Root("required_sections"), "Missing custom section",
+					fmt.Sprintf("Module %s does not contain the custom section %q", wasmFile.ValueString(), required.ValueString()))
+			}
+		}
+	}
+
+	if len(canisterIds) > 0 && config == nil {
+		diags.AddError("Unconfigured provider", "The provider must be configured to check the modules of canisters.")
+		return diags
+	}
+
+	for _, canisterId := range canisterIds {
+		if canisterId.IsUnknown() {
+			continue
+		}
+
+		id, err := principal.Decode(canisterId.ValueString())
+		if err != nil {
+			diags.AddAttributeError(path.Root("canister_ids"), "Could not decode canister id", fmt.Sprintf("%s: %s", canisterId.ValueString(), err.Error()))
+			continue
+		}
+
+		for _, required := range requiredSections {
+			if required.IsUnknown() {
+				continue
+			}
+
+			found, err := canisterHasCustomSection(ctx, *config, id, required.ValueString())
+			if err != nil {
+				diags.AddAttributeError(path.Root("canister_ids"), "Could not read canister metadata", fmt.Sprintf("%s: %s", id.Encode(), err.Error()))
+				continue
+			}
+
+			if !found {
+				diags.AddAttributeError(path.Root("required_sections"), "Missing custom section",
+					fmt.Sprintf("The module of canister %s does not contain the custom section %q", id.Encode(), required.ValueString()))
+			}
+		}
+	}
+
+	return diags
+}
+
+// Returns true if the module installed on the canister has the section, read from the
+// canister's metadata (whose paths are the names of the icp:public and icp:private
+// sections without their prefix).
+func canisterHasCustomSection(ctx context.Context, config agent.Config, canisterId principal.Principal, name string) (bool, error) {
+	a, err := newAgent(config)
+	if err != nil {
+		return false, err
+	}
+
+	metadataName := strings.TrimPrefix(strings.TrimPrefix(name, "icp:public "), "icp:private ")
+	tflog.Info(ctx, fmt.Sprintf("Reading metadata %s of canister %s", metadataName, canisterId.Encode()))
+
+	_, err = a.GetCanisterMetadata(canisterId, metadataName)
+	var lookupError hashtree.LookupError
+	if errors.As(err, &lookupError) && lookupError.Type == hashtree.LookupResultAbsent {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns true if the section is present, with or without an icp:public or icp:private prefix.
+func hasCustomSection(sections []string, name string) bool {
+	if slices.Contains(sections, name) {
+		return true
+	}
+
+	if strings.HasPrefix(name, "icp:") {
+		return false
+	}
+
+	return slices.Contains(sections, "icp:public "+name) || slices.Contains(sections, "icp:private "+name)
+}
+
+// Derives the identifier from the modules and sections.
+func (data *CustomSectionPolicyResourceModel) InferId() {
+	idData := data.WasmFiles.String() + data.RequiredSections.String()
+	// Unset canister_ids don't change the identifiers of existing policies
+	if !data.CanisterIds.IsNull() {
+		idData += data.CanisterIds.String()
+	}
+	id := sha256.Sum256([]byte(idData))
+	data.Id = types.StringValue(hex.EncodeToString(id[:]))
+}
+
+func (r *CustomSectionPolicyResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	var data *CustomSectionPolicyResourceModel
+
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Nothing to check on deletion
+	if data == nil {
+		return
+	}
+
+	resp.Diagnostics.Append(data.Check(ctx, r.config)...)
+}
+
+func (r *CustomSectionPolicyResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data CustomSectionPolicyResourceModel
+
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(data.Check(ctx, r.config)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	data.InferId()
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *CustomSectionPolicyResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data CustomSectionPolicyResourceModel
+
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *CustomSectionPolicyResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data CustomSectionPolicyResourceModel
+
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(data.Check(ctx, r.config)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	data.InferId()
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Nothing to delete, the resource is only removed from the state.
+func (r *CustomSectionPolicyResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+}
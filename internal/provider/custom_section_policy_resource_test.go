@@ -0,0 +1,150 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+)
+
+// Builds a minimal Wasm module with the given custom sections (names shorter than 128 bytes).
+func wasmModuleWithCustomSections(names ...string) []byte {
+	module := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+	for _, name := range names {
+		content := append([]byte{byte(len(name))}, []byte(name)...)
+		module = append(module, 0x00, byte(len(content)))
+		module = append(module, content...)
+	}
+	return module
+}
+
+func TestCustomSectionPolicyResource(t *testing.T) {
+
+	dir := t.TempDir()
+	compliant := path.Join(dir, "compliant.wasm")
+	nonCompliant := path.Join(dir, "non_compliant.wasm")
+
+	err := os.WriteFile(compliant, wasmModuleWithCustomSections("icp:public git_commit_id", "icp:private sbom_sha256"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(nonCompliant, wasmModuleWithCustomSections("icp:public candid:service"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := func(wasmFile string) string {
+		return fmt.Sprintf(`
+resource "ic_custom_section_policy" "test" {
+    wasm_files = ["%s"]
+    required_sections = ["git_commit_id", "icp:private sbom_sha256"]
+}
+`, wasmFile)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: policy(compliant),
+				Check:  resource.TestCheckResourceAttrSet("ic_custom_section_policy.test", "id"),
+			},
+			{
+				Config:      policy(nonCompliant),
+				ExpectError: regexp.MustCompile("does not contain the custom section \"git_commit_id\""),
+			},
+		},
+	})
+}
+
+// Checks the sections of deployed canisters, read from their metadata.
+func TestCustomSectionPolicyCanisters(t *testing.T) {
+	name := strings.ToLower(t.Name())
+	host, _ := url.Parse("mock://" + name)
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, nil))
+	backend, err := loadMockBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const compliant = "rrkah-fqaaa-aaaaa-aaaaq-cai"
+	const nonCompliant = "ryjl3-tyaaa-aaaaa-aaaba-cai"
+	const hidden = "r7inp-6aaaa-aaaaa-aaabq-cai"
+	canisters := map[string]*mockCanister{
+		compliant: {Controllers: []string{principal.AnonymousID.Encode()}, Metadata: map[string][]byte{
+			"icp:public git_commit_id": []byte("abc"),
+			"icp:private sbom_sha256":  []byte("def"),
+		}},
+		nonCompliant: {Controllers: []string{}, Metadata: map[string][]byte{"icp:public candid:service": []byte("service : {}")}},
+		// Private sections are only readable by controllers
+		hidden: {Controllers: []string{}, Metadata: map[string][]byte{
+			"icp:public git_commit_id": []byte("abc"),
+			"icp:private sbom_sha256":  []byte("def"),
+		}},
+	}
+	backend.mu.Lock()
+	for id, canister := range canisters {
+		canister.Status = "running"
+		canister.ModuleHash = make([]byte, 32)
+		backend.State.Canisters[id] = canister
+	}
+	backend.mu.Unlock()
+
+	config := &agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		FetchRootKey: true,
+	}
+	ctx := context.Background()
+
+	tests := []struct {
+		canisterId string
+		missing    []string
+	}{
+		{canisterId: compliant},
+		{canisterId: nonCompliant, missing: []string{"git_commit_id", "icp:private sbom_sha256"}},
+		{canisterId: hidden, missing: []string{"icp:private sbom_sha256"}},
+	}
+	for _, test := range tests {
+		t.Run(test.canisterId, func(t *testing.T) {
+			data := CustomSectionPolicyResourceModel{
+				WasmFiles:        types.ListNull(types.StringType),
+				CanisterIds:      types.ListValueMust(types.StringType, []attr.Value{types.StringValue(test.canisterId)}),
+				RequiredSections: types.ListValueMust(types.StringType, []attr.Value{types.StringValue("git_commit_id"), types.StringValue("icp:private sbom_sha256")}),
+			}
+			diags := data.Check(ctx, config)
+			if diags.ErrorsCount() != len(test.missing) {
+				t.Fatalf("expected %d missing sections, got %v", len(test.missing), diags)
+			}
+			for i, missing := range test.missing {
+				if detail := diags.Errors()[i].Detail(); !strings.Contains(detail, fmt.Sprintf("%q", missing)) {
+					t.Errorf("expected %s to be missing, got %s", missing, detail)
+				}
+			}
+		})
+	}
+
+	// Canisters can't be checked without a configured provider
+	data := CustomSectionPolicyResourceModel{
+		WasmFiles:        types.ListNull(types.StringType),
+		CanisterIds:      types.ListValueMust(types.StringType, []attr.Value{types.StringValue(compliant)}),
+		RequiredSections: types.ListValueMust(types.StringType, []attr.Value{types.StringValue("git_commit_id")}),
+	}
+	if diags := data.Check(ctx, nil); !diags.HasError() {
+		t.Fatal("expected an error without a configured provider")
+	}
+}
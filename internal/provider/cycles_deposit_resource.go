@@ -0,0 +1,226 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/numberplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic/wallet"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &CyclesDepositResource{}
+
+func NewCyclesDepositResource() resource.Resource {
+	return &CyclesDepositResource{}
+}
+
+// CyclesDepositResource moves cycles from a cycles wallet to a canister. Only a canister can
+// attach cycles to the management canister's deposit_cycles, so the cycles are sent by
+// the wallet (with wallet_send128).
+type CyclesDepositResource struct {
+	config *agent.Config
+
+	readOnly readOnlyMode // read_only is set, or mainnet is not allowed
+}
+
+// CyclesDepositResourceModel describes the resource data model.
+type CyclesDepositResourceModel struct {
+	Id           types.String `tfsdk:"id"`
+	FromWalletId types.String `tfsdk:"from_wallet_id"`
+	ToCanisterId types.String `tfsdk:"to_canister_id"`
+	Amount       types.Number `tfsdk:"amount"`
+}
+
+func (r *CyclesDepositResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_cycles_deposit"
+}
+
+func (r *CyclesDepositResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Deposits cycles to a canister, e.g. to balance cycles across a fleet of canisters. " +
+			"Controllers cannot move cycles out of a canister, so the cycles are sent from a [cycles wallet](https://github.com/dfinity/cycles-wallet) (with `wallet_send128`, which calls the management canister's `deposit_cycles`) that the provider's identity controls or is a custodian of. " +
+			"Deposits cannot be undone: destroying the resource only removes it from the state, and changing any attribute deposits cycles again.",
+
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Identifier of the deposit (`<from_wallet_id>:<to_canister_id>:<timestamp>`)",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"from_wallet_id": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Canister identifier of the cycles wallet the cycles are taken from",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"to_canister_id": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Canister identifier of the canister the cycles are deposited to",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"amount": schema.NumberAttribute{
+				Required:            true,
+				MarkdownDescription: "Amount of cycles to deposit",
+				PlanModifiers: []planmodifier.Number{
+					numberplanmodifier.RequiresReplace(),
+				},
+			},
+		},
+	}
+}
+
+func (r *CyclesDepositResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	r.config = providerData.Config
+	r.readOnly = providerData.ReadOnly
+}
+
+func (r *CyclesDepositResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data CyclesDepositResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.readOnly != readWrite {
+		resp.Diagnostics.Append(r.readOnly.diagnostic("deposit cycles"))
+		return
+	}
+
+	walletId, err := principal.Decode(data.FromWalletId.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("from_wallet_id"), "Client Error", "Could not decode wallet id: "+err.Error())
+		return
+	}
+
+	toCanisterId, err := principal.Decode(data.ToCanisterId.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("to_canister_id"), "Client Error", "Could not decode canister id: "+err.Error())
+		return
+	}
+
+	amount, accuracy := data.Amount.ValueBigFloat().Int(nil)
+	if accuracy != big.Exact || amount.Sign() <= 0 {
+		resp.Diagnostics.AddAttributeError(path.Root("amount"), "Client Error", fmt.Sprintf("Expected amount to be a positive integer, got %s", data.Amount.String()))
+		return
+	}
+
+	a, err := newAgent(*r.config)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not create wallet agent", err))
+		return
+	}
+	walletAgent := &wallet.Agent{Agent: a, CanisterId: walletId}
+
+	tflog.Info(ctx, fmt.Sprintf("Depositing %s cycles from wallet %s to canister %s", amount.String(), walletId.Encode(), toCanisterId.Encode()))
+
+	res, err := walletAgent.WalletSend128(struct {
+		Canister principal.Principal `ic:"canister" json:"canister"`
+		Amount   idl.Nat             `ic:"amount" json:"amount"`
+	}{
+		Canister: toCanisterId,
+		Amount:   idl.NewBigNat(amount),
+	})
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not deposit cycles", err))
+		return
+	}
+
+	if res.Err != nil {
+		resp.Diagnostics.AddError("Client Error", fmt.Sprintf("Error when depositing cycles: %s", *res.Err))
+		return
+	}
+
+	data.Id = types.StringValue(walletId.Encode() + ":" + toCanisterId.Encode() + ":" + strconv.FormatInt(time.Now().UnixNano(), 10))
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *CyclesDepositResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data CyclesDepositResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Save updated data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// All attributes require replacement, so this only stores the planned data.
+func (r *CyclesDepositResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data CyclesDepositResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Deposited cycles cannot be taken back, so this only removes the resource from the state.
+func (r *CyclesDepositResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	var data CyclesDepositResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	tflog.Info(ctx, "Forgetting about deposit "+data.Id.ValueString()+" (deposited cycles are not returned)")
+}
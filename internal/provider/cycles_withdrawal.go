@@ -0,0 +1,321 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Cycles left in the canister when withdrawing cycles before deletion. They pay for the
+// execution of the withdrawal (which is prepaid for the maximum number of instructions)
+// and for the deposit_cycles call.
+const cyclesWithdrawalMargin = 100_000_000_000
+
+// Withdraws the cycles of the (stopped) canister to the beneficiary canister, so that they
+// are not burned when the canister is deleted.
+//
+// Controllers cannot withdraw cycles from a canister, so this replaces the canister's code
+// with a module that forwards its balance to the beneficiary with the management canister's
+// deposit_cycles (see cyclesWithdrawalWasm) and calls it. The beneficiary is embedded in the
+// module, so that whoever calls the module while it runs can only send the cycles to the
+// beneficiary. The canister is stopped again afterwards, and its code is uninstalled if the
+// withdrawal fails. The management canister is called through proxy, unless it is nil.
+func withdrawCycles(ctx context.Context, config agent.Config, proxy *managementProxy, canisterId principal.Principal, beneficiary principal.Principal) (err error) {
+	mgmtAgent, err := newManagementAgent(ctx, config, proxy)
+	if err != nil {
+		return fmt.Errorf("Could not create agent: %w", err)
+	}
+
+	status, err := mgmtAgent.CanisterStatusRaw(canisterId)
+	if err != nil {
+		return fmt.Errorf("Could not read canister status: %w", err)
+	}
+	balance := candidNat(candidField(status, "cycles"))
+	if balance == nil {
+		return fmt.Errorf("Could not read canister status: no cycles balance")
+	}
+
+	if balance.Cmp(big.NewInt(cyclesWithdrawalMargin)) <= 0 {
+		tflog.Info(ctx, fmt.Sprintf("Not withdrawing cycles of canister %s, balance %s is below the withdrawal margin", canisterId.Encode(), balance.String()))
+		return nil
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("Withdrawing cycles of canister %s (balance %s) to %s", canisterId.Encode(), balance.String(), beneficiary.Encode()))
+
+	wasm, err := cyclesWithdrawalWasm(cyclesWithdrawalMargin, beneficiary)
+	if err != nil {
+		return fmt.Errorf("Could not build cycles withdrawal module: %w", err)
+	}
+
+	// Without freezing threshold, all cycles above the margin can be withdrawn
+	freezingThreshold := idl.NewNat(uint(0))
+	err = mgmtAgent.UpdateSettings(icMgmt.UpdateSettingsArgs{
+		CanisterId: canisterId,
+		Settings:   icMgmt.CanisterSettings{FreezingThreshold: &freezingThreshold},
+	})
+	if err != nil {
+		return fmt.Errorf("Could not reset freezing threshold: %w", err)
+	}
+
+	err = mgmtAgent.InstallCode(icMgmt.InstallCodeArgs{
+		Mode:       icMgmt.CanisterInstallMode{Reinstall: new(idl.Null)},
+		CanisterId: canisterId,
+		WasmModule: wasm,
+		Arg:        []byte{},
+	})
+	if err != nil {
+		return fmt.Errorf("Could not install cycles withdrawal module: %w", err)
+	}
+
+	// From here on, the canister must not be left running the withdrawal module
+	defer func() {
+		if err == nil {
+			return
+		}
+		tflog.Warn(ctx, fmt.Sprintf("Withdrawal from canister %s failed, stopping it and uninstalling the withdrawal module", canisterId.Encode()))
+		if errStop := mgmtAgent.StopCanister(icMgmt.StopCanisterArgs{CanisterId: canisterId}); errStop != nil {
+			err = fmt.Errorf("%w (and the canister could not be stopped: %s)", err, errStop.Error())
+		}
+		if errUninstall := mgmtAgent.UninstallCode(icMgmt.UninstallCodeArgs{CanisterId: canisterId}); errUninstall != nil {
+			err = fmt.Errorf("%w (and the withdrawal module could not be uninstalled: %s)", err, errUninstall.Error())
+		}
+	}()
+
+	err = mgmtAgent.StartCanister(icMgmt.StartCanisterArgs{CanisterId: canisterId})
+	if err != nil {
+		return fmt.Errorf("Could not start canister: %w", err)
+	}
+
+	a, err := newAgent(config)
+	if err != nil {
+		return fmt.Errorf("Could not create agent: %w", err)
+	}
+
+	err = a.Call(canisterId, "withdraw", []any{}, []any{})
+	if err != nil {
+		return fmt.Errorf("Could not withdraw cycles: %w", err)
+	}
+
+	err = mgmtAgent.StopCanister(icMgmt.StopCanisterArgs{CanisterId: canisterId})
+	if err != nil {
+		return fmt.Errorf("Could not stop canister after withdrawing cycles: %w", err)
+	}
+
+	return nil
+}
+
+// Builds a Wasm module exporting a single update method, "withdraw", which calls the
+// management canister's deposit_cycles for the beneficiary with all the canister's cycles
+// but margin attached. The argument of deposit_cycles is embedded in the module (at offset
+// 128), and the message's argument is ignored. The method replies (with an empty candid
+// tuple) or rejects when deposit_cycles does.
+//
+// The module is equivalent to the following WAT:
+//
+//	(module
+//	  (import "ic0" "canister_cycle_balance128" (func $canister_cycle_balance128 (param i32)))
+//	  (import "ic0" "call_new" (func $call_new (param i32 i32 i32 i32 i32 i32 i32 i32)))
+//	  (import "ic0" "call_data_append" (func $call_data_append (param i32 i32)))
+//	  (import "ic0" "call_cycles_add128" (func $call_cycles_add128 (param i64 i64)))
+//	  (import "ic0" "call_perform" (func $call_perform (result i32)))
+//	  (import "ic0" "msg_reply_data_append" (func $msg_reply_data_append (param i32 i32)))
+//	  (import "ic0" "msg_reply" (func $msg_reply))
+//	  (import "ic0" "msg_reject" (func $msg_reject (param i32 i32)))
+//	  (import "ic0" "msg_reject_msg_size" (func $msg_reject_msg_size (result i32)))
+//	  (import "ic0" "msg_reject_msg_copy" (func $msg_reject_msg_copy (param i32 i32 i32)))
+//	  (import "ic0" "trap" (func $trap (param i32 i32)))
+//	  (table 2 funcref)
+//	  (memory 1)
+//	  (elem (i32.const 0) $on_reply $on_reject)
+//	  (data (i32.const 32) "deposit_cycles")
+//	  (data (i32.const 48) "DIDL\00\00")
+//	  (data (i32.const 64) "not enough cycles")
+//	  (data (i32.const 96) "call_perform failed")
+//	  (data (i32.const 128) "<deposit_cycles argument>")
+//	  (func $withdraw (local $low i64) (local $high i64)
+//	    (call $canister_cycle_balance128 (i32.const 0))
+//	    (local.set $low (i64.load (i32.const 0)))
+//	    (local.set $high (i64.load offset=8 (i32.const 0)))
+//	    (if (i32.and (i64.eqz (local.get $high)) (i64.lt_u (local.get $low) (i64.const margin)))
+//	      (then (call $trap (i32.const 64) (i32.const 17))))
+//	    (call $call_new (i32.const 0) (i32.const 0) (i32.const 32) (i32.const 14)
+//	      (i32.const 0) (i32.const 0) (i32.const 1) (i32.const 0))
+//	    (call $call_data_append (i32.const 128) (i32.const <argument size>))
+//	    (call $call_cycles_add128
+//	      (i64.sub (local.get $high) (i64.extend_i32_u (i64.lt_u (local.get $low) (i64.const margin))))
+//	      (i64.sub (local.get $low) (i64.const margin)))
+//	    (if (call $call_perform) (then (call $trap (i32.const 96) (i32.const 19)))))
+//	  (func $on_reply (param $env i32)
+//	    (call $msg_reply_data_append (i32.const 48) (i32.const 6))
+//	    (call $msg_reply))
+//	  (func $on_reject (param $env i32) (local $size i32)
+//	    (local.set $size (call $msg_reject_msg_size))
+//	    (call $msg_reject_msg_copy (i32.const 4096) (i32.const 0) (local.get $size))
+//	    (call $msg_reject (i32.const 4096) (local.get $size)))
+//	  (export "canister_update withdraw" (func $withdraw)))
+func cyclesWithdrawalWasm(margin uint64, beneficiary principal.Principal) ([]byte, error) {
+	const (
+		i32 = 0x7f
+		i64 = 0x7e
+	)
+
+	depositArg, err := idl.Marshal([]any{icMgmt.DepositCyclesArgs{CanisterId: beneficiary}})
+	if err != nil {
+		return nil, err
+	}
+
+	// Function types
+	types := [][]byte{
+		wasmFuncType(nil, []byte{i32}),                                    // 0: () -> i32
+		wasmFuncType([]byte{i32, i32, i32}, nil),                          // 1: (i32, i32, i32) -> ()
+		wasmFuncType([]byte{i32}, nil),                                    // 2: (i32) -> ()
+		wasmFuncType([]byte{i32, i32, i32, i32, i32, i32, i32, i32}, nil), // 3: (i32 x 8) -> ()
+		wasmFuncType([]byte{i32, i32}, nil),                               // 4: (i32, i32) -> ()
+		wasmFuncType([]byte{i64, i64}, nil),                               // 5: (i64, i64) -> ()
+		wasmFuncType(nil, nil),                                            // 6: () -> ()
+	}
+
+	// Imported functions (indices 0 to 10) and their types
+	imports := []struct {
+		name    string
+		typeIdx byte
+	}{
+		{"canister_cycle_balance128", 2},
+		{"call_new", 3},
+		{"call_data_append", 4},
+		{"call_cycles_add128", 5},
+		{"call_perform", 0},
+		{"msg_reply_data_append", 4},
+		{"msg_reply", 6},
+		{"msg_reject", 4},
+		{"msg_reject_msg_size", 0},
+		{"msg_reject_msg_copy", 1},
+		{"trap", 4},
+	}
+	const (
+		canisterCycleBalance128 = iota
+		callNew
+		callDataAppend
+		callCyclesAdd128
+		callPerform
+		msgReplyDataAppend
+		msgReply
+		msgReject
+		msgRejectMsgSize
+		msgRejectMsgCopy
+		trap
+		withdrawFunc // defined functions
+		onReplyFunc
+		onRejectFunc
+	)
+
+	importEntries := [][]byte{}
+	for _, imp := range imports {
+		entry := append(wasmName("ic0"), wasmName(imp.name)...)
+		importEntries = append(importEntries, append(entry, 0x00, imp.typeIdx))
+	}
+
+	// Instructions
+	const (
+		opIf            = 0x04
+		opEnd           = 0x0b
+		opCall          = 0x10
+		opLocalGet      = 0x20
+		opLocalSet      = 0x21
+		opI64Load       = 0x29
+		opI32Const      = 0x41
+		opI64Const      = 0x42
+		opI64Eqz        = 0x50
+		opI64LtU        = 0x54
+		opI32And        = 0x71
+		opI64Sub        = 0x7d
+		opI64ExtendI32U = 0xad
+		blockEmpty      = 0x40
+	)
+	i32Const := func(v int64) []byte { return append([]byte{opI32Const}, wasmSleb(v)...) }
+	marginConst := append([]byte{opI64Const}, wasmSleb(int64(margin))...)
+	call := func(idx byte) []byte { return []byte{opCall, idx} }
+	code := func(parts ...[]byte) []byte {
+		result := []byte{}
+		for _, part := range parts {
+			result = append(result, part...)
+		}
+		return result
+	}
+
+	// locals: 0 low (i64), 1 high (i64)
+	withdraw := code(
+		[]byte{0x01, 0x02, i64},
+		i32Const(0), call(canisterCycleBalance128),
+		i32Const(0), []byte{opI64Load, 0x03, 0x00, opLocalSet, 0},
+		i32Const(0), []byte{opI64Load, 0x03, 0x08, opLocalSet, 1},
+		[]byte{opLocalGet, 1, opI64Eqz, opLocalGet, 0}, marginConst, []byte{opI64LtU, opI32And},
+		[]byte{opIf, blockEmpty}, i32Const(64), i32Const(17), call(trap), []byte{opEnd},
+		i32Const(0), i32Const(0), i32Const(32), i32Const(14),
+		i32Const(0), i32Const(0), i32Const(1), i32Const(0), call(callNew),
+		i32Const(128), i32Const(int64(len(depositArg))), call(callDataAppend),
+		[]byte{opLocalGet, 1, opLocalGet, 0}, marginConst, []byte{opI64LtU, opI64ExtendI32U, opI64Sub},
+		[]byte{opLocalGet, 0}, marginConst, []byte{opI64Sub},
+		call(callCyclesAdd128),
+		call(callPerform), []byte{opIf, blockEmpty}, i32Const(96), i32Const(19), call(trap), []byte{opEnd},
+		[]byte{opEnd},
+	)
+
+	// locals: 0 env (param)
+	onReply := code(
+		[]byte{0x00},
+		i32Const(48), i32Const(6), call(msgReplyDataAppend),
+		call(msgReply),
+		[]byte{opEnd},
+	)
+
+	// locals: 0 env (param), 1 size (i32)
+	onReject := code(
+		[]byte{0x01, 0x01, i32},
+		call(msgRejectMsgSize), []byte{opLocalSet, 1},
+		i32Const(4096), i32Const(0), []byte{opLocalGet, 1}, call(msgRejectMsgCopy),
+		i32Const(4096), []byte{opLocalGet, 1}, call(msgReject),
+		[]byte{opEnd},
+	)
+
+	dataSegment := func(offset int64, content string) []byte {
+		return code([]byte{0x00}, i32Const(offset), []byte{opEnd}, wasmName(content))
+	}
+
+	module := append([]byte{}, wasmMagic...)
+	module = append(module, 0x01, 0x00, 0x00, 0x00)
+	module = append(module, wasmSection(1, wasmVec(types))...)
+	module = append(module, wasmSection(2, wasmVec(importEntries))...)
+	module = append(module, wasmSection(3, wasmVec([][]byte{{6}, {2}, {2}}))...)
+	module = append(module, wasmSection(4, wasmVec([][]byte{{0x70, 0x00, 0x02}}))...)
+	module = append(module, wasmSection(5, wasmVec([][]byte{{0x00, 0x01}}))...)
+	module = append(module, wasmSection(7, wasmVec([][]byte{
+		append(wasmName("canister_update withdraw"), 0x00, withdrawFunc),
+	}))...)
+	module = append(module, wasmSection(9, wasmVec([][]byte{
+		code([]byte{0x00}, i32Const(0), []byte{opEnd}, wasmVec([][]byte{{onReplyFunc}, {onRejectFunc}})),
+	}))...)
+	module = append(module, wasmSection(10, wasmVec([][]byte{
+		wasmVecBytes(withdraw),
+		wasmVecBytes(onReply),
+		wasmVecBytes(onReject),
+	}))...)
+	module = append(module, wasmSection(11, wasmVec([][]byte{
+		dataSegment(32, "deposit_cycles"),
+		dataSegment(48, "DIDL\x00\x00"),
+		dataSegment(64, "not enough cycles"),
+		dataSegment(96, "call_perform failed"),
+		dataSegment(128, string(depositArg)),
+	}))...)
+
+	return module, nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/aviate-labs/agent-go/candid/idl"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Returns the content of the (non-custom) section of the module with the given id.
+func testWasmSection(t *testing.T, module []byte, id byte) *bytes.Reader {
+	sections, err := wasmSections(module)
+	if err != nil {
+		t.Fatalf("could not parse module: %v", err)
+	}
+	for _, section := range sections {
+		if section.Id == id {
+			reader := bytes.NewReader(section.Raw[1:])
+			if _, err := binary.ReadUvarint(reader); err != nil {
+				t.Fatalf("could not read size of section %d: %v", id, err)
+			}
+			return reader
+		}
+	}
+	t.Fatalf("module has no section %d", id)
+	return nil
+}
+
+func testWasmName(t *testing.T, reader *bytes.Reader) string {
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		t.Fatalf("could not read name size: %v", err)
+	}
+	name := make([]byte, size)
+	if _, err := io.ReadFull(reader, name); err != nil {
+		t.Fatalf("could not read name: %v", err)
+	}
+	return string(name)
+}
+
+func testWasmUleb(t *testing.T, reader *bytes.Reader) uint64 {
+	v, err := binary.ReadUvarint(reader)
+	if err != nil {
+		t.Fatalf("could not read integer: %v", err)
+	}
+	return v
+}
+
+// Decodes the cycles withdrawal module, and checks that it only exports withdraw, ignores
+// the message's argument, and sends the cycles to the embedded beneficiary.
+func TestCyclesWithdrawalWasm(t *testing.T) {
+	beneficiary, _ := principal.Decode("ryjl3-tyaaa-aaaaa-aaaba-cai")
+
+	module, err := cyclesWithdrawalWasm(cyclesWithdrawalMargin, beneficiary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(module, wasmMagic) {
+		t.Fatalf("module does not start with the Wasm magic")
+	}
+
+	// Imports: the module must not read the message's argument (or anything else
+	// attacker-controlled)
+	imports := testWasmSection(t, module, 2)
+	for n := testWasmUleb(t, imports); n > 0; n-- {
+		moduleName := testWasmName(t, imports)
+		name := testWasmName(t, imports)
+		if moduleName != "ic0" {
+			t.Errorf("unexpected import module %q", moduleName)
+		}
+		if name == "msg_arg_data_copy" || name == "msg_arg_data_size" {
+			t.Errorf("module imports %s, the beneficiary must not come from the message", name)
+		}
+		imports.ReadByte() // kind
+		testWasmUleb(t, imports)
+	}
+
+	exports := testWasmSection(t, module, 7)
+	exportNames := []string{}
+	for n := testWasmUleb(t, exports); n > 0; n-- {
+		exportNames = append(exportNames, testWasmName(t, exports))
+		exports.ReadByte() // kind
+		testWasmUleb(t, exports)
+	}
+	if len(exportNames) != 1 || exportNames[0] != "canister_update withdraw" {
+		t.Errorf("unexpected exports %v", exportNames)
+	}
+
+	// Data segments: the argument of deposit_cycles is embedded at offset 128
+	data := testWasmSection(t, module, 11)
+	segments := map[uint64][]byte{}
+	for n := testWasmUleb(t, data); n > 0; n-- {
+		header := make([]byte, 2)
+		io.ReadFull(data, header) // active segment of memory 0, i32.const
+		offset := testWasmUleb(t, data)
+		data.ReadByte() // end
+		segments[offset] = []byte(testWasmName(t, data))
+	}
+
+	var depositArgs icMgmt.DepositCyclesArgs
+	if err := idl.Unmarshal(segments[128], []any{&depositArgs}); err != nil {
+		t.Fatalf("could not decode the embedded deposit_cycles argument: %v", err)
+	}
+	if depositArgs.CanisterId.Encode() != beneficiary.Encode() {
+		t.Errorf("embedded beneficiary is %s, expected %s", depositArgs.CanisterId.Encode(), beneficiary.Encode())
+	}
+	if string(segments[32]) != "deposit_cycles" {
+		t.Errorf("unexpected method name %q", segments[32])
+	}
+
+	// The whole embedded argument is appended to the call
+	code := testWasmSection(t, module, 10)
+	appendArg := append([]byte{0x41}, wasmSleb(128)...)
+	appendArg = append(appendArg, 0x41)
+	appendArg = append(appendArg, wasmSleb(int64(len(segments[128])))...)
+	appendArg = append(appendArg, 0x10, 2) // call call_data_append
+	rest, _ := io.ReadAll(code)
+	if !bytes.Contains(rest, appendArg) {
+		t.Errorf("withdraw does not append the embedded argument to the call")
+	}
+
+	// Other beneficiaries get other modules
+	other, _ := principal.Decode("rrkah-fqaaa-aaaaa-aaaaq-cai")
+	otherModule, err := cyclesWithdrawalWasm(cyclesWithdrawalMargin, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(module, otherModule) {
+		t.Errorf("the module does not depend on the beneficiary")
+	}
+}
@@ -0,0 +1,709 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go/candid/idl"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &DappResource{}
+var _ resource.ResourceWithModifyPlan = &DappResource{}
+var _ resource.ResourceWithValidateConfig = &DappResource{}
+
+func NewDappResource() resource.Resource {
+	return &DappResource{}
+}
+
+// DappResource provisions the canisters of a multi-canister dapp (e.g. a frontend, a
+// backend and a ledger) as a unit. The canisters are managed like ic_canister manages
+// them, but the arguments of each canister may reference the ids of the others, which
+// are all created before any code is installed.
+type DappResource struct {
+	canisters CanisterResource
+}
+
+// DappResourceModel describes the resource data model.
+type DappResourceModel struct {
+	Id          types.String `tfsdk:"id"`
+	Canisters   types.Map    `tfsdk:"canisters"`    // of DappCanisterModel, by name
+	CanisterIds types.Map    `tfsdk:"canister_ids"` // by name
+}
+
+// DappCanisterModel describes a canister of the dapp.
+type DappCanisterModel struct {
+	WasmFile    types.String `tfsdk:"wasm_file"`
+	WasmSha256  types.String `tfsdk:"wasm_sha256"`
+	Arg         types.String `tfsdk:"arg"`         // JSON, with {{name}} placeholders
+	CandidFile  types.String `tfsdk:"candid_file"` // declares the types of the arguments
+	Controllers types.List   `tfsdk:"controllers"` // null for the provider's controller
+}
+
+// References to the ids of the other canisters of the dapp in arguments, e.g.
+// `{"ledger": "{{ledger}}"}`.
+var dappReferenceRegexp = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+func (r *DappResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_dapp"
+}
+
+func (r *DappResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Provisions the canisters of a multi-canister dapp (e.g. a frontend, a backend and a ledger) as a unit. " +
+			"All canisters are created first, and their code is then installed in dependency order, so that the argument of a canister can reference the ids of the other canisters with `{{<name>}}` placeholders " +
+			"(e.g. `jsonencode([{ ledger = \"{{ledger}}\" }])`) instead of wiring separate `ic_canister` resources together. " +
+			"Canisters removed from `canisters` are deleted, and canisters added to it are created. Use `ic_canister` for the settings `ic_dapp` does not manage.",
+
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Identifier of the dapp (hash of the ids of the canisters it was created with)",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"canisters": schema.MapNestedAttribute{
+				Required:            true,
+				MarkdownDescription: "Canisters of the dapp, by name. The names are used in the `{{<name>}}` placeholders of the arguments and as the keys of `canister_ids`.",
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"wasm_file": schema.StringAttribute{
+							Required:            true,
+							MarkdownDescription: "Path to the Wasm module to install",
+						},
+						"wasm_sha256": schema.StringAttribute{
+							Optional: true,
+							MarkdownDescription: "Sha256 sum of the Wasm module (hex encoded), checked before installing it. Recommended (e.g. with `filesha256`), since the code is only installed again when " +
+								"`wasm_file`, `wasm_sha256`, `arg` or `candid_file` change.",
+						},
+						"arg": schema.StringAttribute{
+							Optional: true,
+							MarkdownDescription: "JSON-encoded init & post_upgrade arguments of the canister (e.g. `jsonencode([{ ledger = \"{{ledger}}\" }])`), in which `{{<name>}}` is replaced with the id of the canister `<name>` of the dapp, whose code is installed first; references must not be circular. " +
+								"The value is encoded according to the init arguments of the service declared in `candid_file` (a list with one element per argument, see `ic_canister_call`'s `args`), which is required for principals. " +
+								"Without `candid_file`, the value is encoded with the heuristics of `ic_canister`'s `arg`. Defaults to the empty blob (and not for instance to a Candid `null`).",
+						},
+						"candid_file": schema.StringAttribute{
+							Optional:            true,
+							MarkdownDescription: "Path to the .did file of the canister, declaring the types of its init arguments (e.g. `service : (LedgerArg) -> { ... }`). Imports are not supported.",
+						},
+						"controllers": schema.ListAttribute{
+							ElementType: types.StringType,
+							Optional:    true,
+							MarkdownDescription: "Controllers of the canister, set after installing its code. Defaults to the principal used by the provider, which must remain a controller for the canister to be updated or deleted. " +
+								"Controllers must be valid principals in their canonical textual form.",
+							Validators: []validator.List{
+								controllersValidator{},
+							},
+						},
+					},
+				},
+			},
+			"canister_ids": schema.MapAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Ids of the canisters, by name",
+			},
+		},
+	}
+}
+
+func (r *DappResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	r.canisters.Configure(ctx, req, resp)
+}
+
+// Returns the canisters of the dapp by name, and false if they are not known yet.
+func (data *DappResourceModel) canisterModels(ctx context.Context) (map[string]DappCanisterModel, bool, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	if data.Canisters.IsNull() || data.Canisters.IsUnknown() {
+		return nil, false, diags
+	}
+
+	canisters := map[string]DappCanisterModel{}
+	diags.Append(data.Canisters.ElementsAs(ctx, &canisters, false)...)
+	return canisters, !diags.HasError(), diags
+}
+
+// Returns the names of the canisters referenced by the argument.
+func dappReferences(arg string) []string {
+	var names []string
+	for _, match := range dappReferenceRegexp.FindAllStringSubmatch(arg, -1) {
+		names = append(names, match[1])
+	}
+	return names
+}
+
+// Replaces the references to canisters in the argument with their ids.
+func resolveDappReferences(arg string, canisterIds map[string]string) string {
+	return dappReferenceRegexp.ReplaceAllStringFunc(arg, func(match string) string {
+		return canisterIds[dappReferenceRegexp.FindStringSubmatch(match)[1]]
+	})
+}
+
+// Returns the names of the canisters in the order their code is installed: canisters
+// referenced by the argument of another canister come first, and the others are sorted by
+// name.
+func dappInstallOrder(canisters map[string]DappCanisterModel) ([]string, error) {
+	dependencies := map[string][]string{}
+	for name, canister := range canisters {
+		for _, dependency := range dappReferences(canister.Arg.ValueString()) {
+			if _, ok := canisters[dependency]; !ok {
+				return nil, fmt.Errorf("the argument of %s references %s, which is not a canister of the dapp", name, dependency)
+			}
+			dependencies[name] = append(dependencies[name], dependency)
+		}
+	}
+
+	names := make([]string, 0, len(canisters))
+	for name := range canisters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var order []string
+	installed := map[string]bool{}
+	visiting := map[string]bool{}
+	var visit func(name string, chain []string) error
+	visit = func(name string, chain []string) error {
+		if installed[name] {
+			return nil
+		}
+		if visiting[name] {
+			return fmt.Errorf("the arguments of the canisters reference each other: %s", strings.Join(append(chain, name), " -> "))
+		}
+		visiting[name] = true
+		for _, dependency := range dependencies[name] {
+			if err := visit(dependency, append(chain, name)); err != nil {
+				return err
+			}
+		}
+		visiting[name] = false
+		installed[name] = true
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// Returns the hex-encoded argument of the canister, with the references resolved. The
+// JSON-encoded value is encoded according to the init arguments declared in candid_file if
+// set, and with the heuristics of the arg attribute of ic_canister otherwise.
+func (canister DappCanisterModel) argHex(canisterIds map[string]string) (string, error) {
+	if canister.Arg.IsNull() {
+		return "", nil
+	}
+
+	val, err := jsonToTFValue(resolveDappReferences(canister.Arg.ValueString(), canisterIds))
+	if err != nil {
+		return "", fmt.Errorf("arg is not valid JSON: %w", err)
+	}
+
+	var argRaw []byte
+	if !canister.CandidFile.IsNull() {
+		service, initArgs, err := readDidInitArgs(canister.CandidFile.ValueString())
+		if err != nil {
+			return "", err
+		}
+		argRaw, err = service.EncodeArgs(initArgs, val)
+		if err != nil {
+			return "", fmt.Errorf("Could not encode arg: %w", err)
+		}
+	} else {
+		didValue, err := TFValToCandid(val)
+		if err != nil {
+			return "", fmt.Errorf("Could not encode arg: %w", err)
+		}
+		argRaw, err = idl.Marshal([]any{didValue})
+		if err != nil {
+			return "", fmt.Errorf("Could not encode arg: %w", err)
+		}
+	}
+
+	return hex.EncodeToString(argRaw), nil
+}
+
+// Converts a JSON value (e.g. from jsonencode) to the Terraform value it encodes: objects
+// are converted to objects and arrays to tuples. Numbers are kept exact.
+func jsonToTFValue(raw string) (tftypes.Value, error) {
+	decoder := json.NewDecoder(strings.NewReader(raw))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return tftypes.Value{}, err
+	}
+	if decoder.More() {
+		return tftypes.Value{}, fmt.Errorf("unexpected data after the JSON value")
+	}
+
+	return jsonValueToTFValue(value)
+}
+
+func jsonValueToTFValue(value any) (tftypes.Value, error) {
+	switch value := value.(type) {
+	case nil:
+		return tftypes.NewValue(tftypes.DynamicPseudoType, nil), nil
+	case bool:
+		return tftypes.NewValue(tftypes.Bool, value), nil
+	case string:
+		return tftypes.NewValue(tftypes.String, value), nil
+	case json.Number:
+		number, ok := new(big.Float).SetString(value.String())
+		if !ok {
+			return tftypes.Value{}, fmt.Errorf("invalid number %s", value.String())
+		}
+		return tftypes.NewValue(tftypes.Number, number), nil
+	case []any:
+		elems := make([]tftypes.Value, len(value))
+		elemTypes := make([]tftypes.Type, len(value))
+		for i, elem := range value {
+			var err error
+			elems[i], err = jsonValueToTFValue(elem)
+			if err != nil {
+				return tftypes.Value{}, err
+			}
+			elemTypes[i] = elems[i].Type()
+		}
+		return tftypes.NewValue(tftypes.Tuple{ElementTypes: elemTypes}, elems), nil
+	case map[string]any:
+		attrs := map[string]tftypes.Value{}
+		attrTypes := map[string]tftypes.Type{}
+		for name, attr := range value {
+			var err error
+			attrs[name], err = jsonValueToTFValue(attr)
+			if err != nil {
+				return tftypes.Value{}, err
+			}
+			attrTypes[name] = attrs[name].Type()
+		}
+		return tftypes.NewValue(tftypes.Object{AttributeTypes: attrTypes}, attrs), nil
+	default:
+		return tftypes.Value{}, fmt.Errorf("unexpected JSON value %v", value)
+	}
+}
+
+// Checks that the references between canisters can be resolved, and that the arguments can
+// be encoded (with the management canister's id in place of the references). Arguments
+// typed by a candid_file that does not exist yet (e.g. because it is generated) are only
+// checked when installing the code.
+func (r DappResource) ValidateConfig(ctx context.Context, req resource.ValidateConfigRequest, resp *resource.ValidateConfigResponse) {
+	var data DappResourceModel
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	canisters, known, diags := data.canisterModels(ctx)
+	resp.Diagnostics.Append(diags...)
+	if !known {
+		return
+	}
+
+	for _, canister := range canisters {
+		if canister.Arg.IsUnknown() {
+			return
+		}
+	}
+
+	if _, err := dappInstallOrder(canisters); err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("canisters"), "Invalid canister references", err.Error())
+		return
+	}
+
+	placeholderIds := map[string]string{}
+	for name := range canisters {
+		placeholderIds[name] = principal.Principal{}.Encode()
+	}
+
+	for name, canister := range canisters {
+		if canister.CandidFile.IsUnknown() {
+			continue
+		}
+		if !canister.CandidFile.IsNull() {
+			if _, err := os.Stat(canister.CandidFile.ValueString()); err != nil {
+				continue
+			}
+		}
+		if _, err := canister.argHex(placeholderIds); err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("canisters").AtMapKey(name).AtName("arg"), "Invalid argument", err.Error())
+		}
+	}
+}
+
+// Plans the ids of the canisters as unknown when canisters are added or removed, and checks
+// the controllers of the canisters: the provider's controller must not be removed, and new
+// canisters must set them if required by the provider's require_explicit_controllers.
+func (r *DappResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	var data *DappResourceModel
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() || data == nil {
+		return
+	}
+
+	canisters, known, diags := data.canisterModels(ctx)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	var state *DappResourceModel
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	stateIds := map[string]string{}
+	if state != nil {
+		resp.Diagnostics.Append(state.CanisterIds.ElementsAs(ctx, &stateIds, false)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	if r.canisters.config != nil {
+		providerController := r.canisters.ProviderPrincipal()
+		for name, canister := range canisters {
+			controllersPath := path.Root("canisters").AtMapKey(name).AtName("controllers")
+			if _, ok := stateIds[name]; !ok {
+				resp.Diagnostics.Append(r.canisters.policy.CheckExplicitControllers(canister.Controllers, types.BoolNull(), controllersPath, providerController)...)
+			}
+
+			if canister.Controllers.IsNull() || canister.Controllers.IsUnknown() {
+				continue
+			}
+			var controllers []string
+			resp.Diagnostics.Append(canister.Controllers.ElementsAs(ctx, &controllers, true)...)
+			if resp.Diagnostics.HasError() {
+				return
+			}
+			if !slices.Contains(controllers, providerController) {
+				resp.Diagnostics.AddAttributeError(controllersPath, "Provider controller removed",
+					fmt.Sprintf("The controllers of %s do not include the provider's controller %s, which is required to update and delete the canisters of the dapp. Use ic_canister for canisters that the provider should not control.", name, providerController))
+			}
+		}
+	}
+
+	if state == nil {
+		return
+	}
+
+	sameNames := known && len(canisters) == len(stateIds)
+	for name := range canisters {
+		if _, ok := stateIds[name]; !ok {
+			sameNames = false
+		}
+	}
+
+	if sameNames {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("canister_ids"), state.CanisterIds)...)
+	}
+}
+
+func (r *DappResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data DappResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.canisters.readOnly != readWrite {
+		resp.Diagnostics.Append(r.canisters.readOnly.diagnostic("create the dapp's canisters"))
+		return
+	}
+
+	canisterIds := map[string]string{}
+	resp.Diagnostics.Append(r.apply(ctx, &data, canisterIds, nil)...)
+
+	id := sha256.New()
+	for _, name := range sortedKeys(canisterIds) {
+		id.Write([]byte(name + "=" + canisterIds[name] + "\n"))
+	}
+	data.Id = types.StringValue(hex.EncodeToString(id.Sum(nil)))
+
+	// The canisters created so far are saved even if the creation failed, so that they are
+	// deleted with the (tainted) resource
+	resp.Diagnostics.Append(data.setCanisterIds(canisterIds)...)
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (data *DappResourceModel) setCanisterIds(canisterIds map[string]string) diag.Diagnostics {
+	elements := map[string]attr.Value{}
+	for name, id := range canisterIds {
+		elements[name] = types.StringValue(id)
+	}
+
+	canisterIdsValue, diags := types.MapValue(types.StringType, elements)
+	data.CanisterIds = canisterIdsValue
+	return diags
+}
+
+// Creates the canisters that are not in canisterIds yet (adding them), and installs the
+// code and sets the controllers of the canisters that are new or changed since the prior
+// state (nil on creation).
+func (r *DappResource) apply(ctx context.Context, data *DappResourceModel, canisterIds map[string]string, state map[string]DappCanisterModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	canisters, _, d := data.canisterModels(ctx)
+	diags.Append(d...)
+	if diags.HasError() {
+		return diags
+	}
+
+	order, err := dappInstallOrder(canisters)
+	if err != nil {
+		diags.AddAttributeError(path.Root("canisters"), "Invalid canister references", err.Error())
+		return diags
+	}
+
+	created := map[string]bool{}
+	for _, name := range order {
+		if _, ok := canisterIds[name]; ok {
+			continue
+		}
+
+		canisterId, err := r.canisters.createCanister(ctx, nil, 0)
+		if err != nil {
+			diags.Append(clientErrorDiagnostic("Could not create canister "+name, err))
+			return diags
+		}
+		tflog.Info(ctx, "Created canister "+name+" of the dapp: "+canisterId.Encode())
+
+		canisterIds[name] = canisterId.Encode()
+		created[name] = true
+	}
+
+	for _, name := range order {
+		err := r.canisters.lock.Acquire(ctx, canisterIds[name])
+		if err != nil {
+			diags.Append(clientErrorDiagnostic("", err))
+			return diags
+		}
+
+		prior, existed := state[name]
+		diags.Append(r.applyCanister(ctx, name, canisters[name], prior, existed, created[name], canisterIds)...)
+		r.canisters.releaseLock(ctx, canisterIds[name], &diags)
+		if diags.HasError() {
+			return diags
+		}
+	}
+
+	return diags
+}
+
+// Installs the code and sets the controllers of the canister of the dapp if it is new
+// (created) or changed since the prior state (if it existed).
+func (r *DappResource) applyCanister(ctx context.Context, name string, canister DappCanisterModel, prior DappCanisterModel, existed bool, created bool, canisterIds map[string]string) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if created || !existed || !canister.WasmFile.Equal(prior.WasmFile) || !canister.WasmSha256.Equal(prior.WasmSha256) || !canister.Arg.Equal(prior.Arg) || !canister.CandidFile.Equal(prior.CandidFile) {
+		argHex, err := canister.argHex(canisterIds)
+		if err != nil {
+			diags.AddAttributeError(path.Root("canisters").AtMapKey(name).AtName("arg"), "Invalid argument", err.Error())
+			return diags
+		}
+
+		tflog.Info(ctx, "Installing code of canister "+name+" of the dapp: "+canisterIds[name])
+		err = r.canisters.setCanisterCode(ctx, canisterIds[name], argHex, canister.WasmFile.ValueString(), canister.WasmSha256.ValueString(), nil, nil)
+		if err != nil {
+			diags.Append(clientErrorDiagnostic("Could not install code of canister "+name, err))
+			return diags
+		}
+	}
+
+	if (created || !existed) && canister.Controllers.IsNull() {
+		// Canisters are created with the provider's controller
+		return diags
+	}
+	if existed && canister.Controllers.Equal(prior.Controllers) {
+		return diags
+	}
+
+	controllers := []string{r.canisters.ProviderPrincipal()}
+	if !canister.Controllers.IsNull() {
+		diags.Append(canister.Controllers.ElementsAs(ctx, &controllers, false)...)
+		if diags.HasError() {
+			return diags
+		}
+	}
+
+	err := r.canisters.setCanisterControllers(ctx, canisterIds[name], controllers)
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not set controllers of canister "+name, err))
+		return diags
+	}
+
+	return diags
+}
+
+// The canisters are not read back, since ic_dapp only manages their code and controllers.
+func (r *DappResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data DappResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Save updated data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *DappResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data DappResourceModel
+	var state DappResourceModel
+
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.canisters.readOnly != readWrite {
+		resp.Diagnostics.Append(r.canisters.readOnly.diagnostic("update the dapp's canisters"))
+		return
+	}
+
+	canisters, _, diags := data.canisterModels(ctx)
+	resp.Diagnostics.Append(diags...)
+	stateCanisters, _, diags := state.canisterModels(ctx)
+	resp.Diagnostics.Append(diags...)
+	canisterIds := map[string]string{}
+	resp.Diagnostics.Append(state.CanisterIds.ElementsAs(ctx, &canisterIds, false)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Canisters removed from the dapp are deleted first, so that they can't be referenced
+	for _, name := range sortedKeys(canisterIds) {
+		if _, ok := canisters[name]; ok {
+			continue
+		}
+
+		err := r.deleteLockedCanister(ctx, canisterIds[name], &resp.Diagnostics)
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not delete canister "+name, err))
+			break
+		}
+		delete(canisterIds, name)
+	}
+
+	if !resp.Diagnostics.HasError() {
+		resp.Diagnostics.Append(r.apply(ctx, &data, canisterIds, stateCanisters)...)
+	}
+
+	// As on creation, the canisters created so far are saved even if the update failed
+	resp.Diagnostics.Append(data.setCanisterIds(canisterIds)...)
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *DappResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	var data DappResourceModel
+
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.canisters.readOnly != readWrite {
+		resp.Diagnostics.Append(r.canisters.readOnly.diagnostic("delete the dapp's canisters"))
+		return
+	}
+
+	canisterIds := map[string]string{}
+	resp.Diagnostics.Append(data.CanisterIds.ElementsAs(ctx, &canisterIds, false)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	for _, name := range sortedKeys(canisterIds) {
+		err := r.deleteLockedCanister(ctx, canisterIds[name], &resp.Diagnostics)
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not delete canister "+name, err))
+		}
+	}
+}
+
+// Deletes the canister (see deleteCanister) holding its lock, if locking is enabled.
+func (r *DappResource) deleteLockedCanister(ctx context.Context, canisterId string, diags *diag.Diagnostics) error {
+	err := r.canisters.lock.Acquire(ctx, canisterId)
+	if err != nil {
+		return err
+	}
+	defer r.canisters.releaseLock(ctx, canisterId, diags)
+
+	return r.deleteCanister(ctx, canisterId)
+}
+
+// Stops and deletes the canister. Canisters that were already deleted are ignored.
+func (r *DappResource) deleteCanister(ctx context.Context, canisterIdS string) (err error) {
+	defer r.canisters.metrics.Time(ctx, "delete_canister", canisterIdS)(&err)
+
+	canisterId, err := principal.Decode(canisterIdS)
+	if err != nil {
+		return err
+	}
+
+	agent, err := newManagementAgent(ctx, *r.canisters.config, r.canisters.proxy)
+	if err != nil {
+		return err
+	}
+
+	err = agent.StopCanister(icMgmt.StopCanisterArgs{CanisterId: canisterId})
+	if err == nil {
+		err = agent.DeleteCanister(icMgmt.DeleteCanisterArgs{CanisterId: canisterId})
+	}
+	if isCanisterNotFound(err) {
+		tflog.Warn(ctx, "Canister "+canisterIdS+" was already deleted: "+err.Error())
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,102 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/terraform"
+
+	"terraform-provider-ic/acctest"
+)
+
+// The frontend greets with the id of the backend, which must be created (and installed)
+// first.
+func TestAccDappResource(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + `
+resource "ic_dapp" "test" {
+    canisters = {
+        backend = {
+            wasm_file = var.hello_world_wasm
+            wasm_sha256 = filesha256(var.hello_world_wasm)
+            arg = jsonencode("Hello")
+        }
+        frontend = {
+            wasm_file = var.hello_world_wasm
+            wasm_sha256 = filesha256(var.hello_world_wasm)
+            arg = jsonencode("{{backend}}")
+        }
+    }
+}
+`,
+				Check: func(s *terraform.State) error {
+					attributes := s.RootModule().Resources["ic_dapp.test"].Primary.Attributes
+
+					reply, err := callHello(attributes["canister_ids.frontend"])
+					if err != nil {
+						return err
+					}
+					if expected := attributes["canister_ids.backend"] + ", terraform!"; reply != expected {
+						return fmt.Errorf("Mismatched reply: %s != %s", reply, expected)
+					}
+					return nil
+				},
+			},
+		},
+	})
+}
+
+func callHello(canisterId string) (string, error) {
+	canisterIdP, err := principal.Decode(canisterId)
+	if err != nil {
+		return "", err
+	}
+
+	a, err := agent.New(acctest.LocalhostConfig(nil))
+	if err != nil {
+		return "", err
+	}
+
+	var reply string
+	err = a.Call(canisterIdP, "hello", []any{"terraform"}, []any{&reply})
+	return reply, err
+}
+
+func TestDappResourceCircularReferences(t *testing.T) {
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+resource "ic_dapp" "test" {
+    canisters = {
+        a = {
+            wasm_file = "a.wasm"
+            arg = jsonencode("{{b}}")
+        }
+        b = {
+            wasm_file = "b.wasm"
+            arg = jsonencode("{{a}}")
+        }
+    }
+}
+`,
+				PlanOnly:    true,
+				ExpectError: regexp.MustCompile(`reference each other: (a -> b -> a|b -> a -> b)`),
+			},
+		},
+	})
+}
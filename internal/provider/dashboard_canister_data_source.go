@@ -0,0 +1,353 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// The public IC dashboard API
+const defaultDashboardApiUrl = "https://ic-api.internetcomputer.org"
+
+// The number of changes canister_info returns at most
+const maxCanisterInfoChanges = 20
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &DashboardCanisterDataSource{}
+
+func NewDashboardCanisterDataSource() datasource.DataSource {
+	return &DashboardCanisterDataSource{}
+}
+
+// DashboardCanisterDataSource looks up canister metadata indexed by the IC dashboard, and
+// the history of the canister recorded by the IC (see canister_info).
+type DashboardCanisterDataSource struct {
+	config *agent.Config
+
+	// Calls canister_info, which only canisters can call; nil unless wallet_canister_id or
+	// proxy_canister_id is set
+	proxy *managementProxy
+}
+
+// DashboardCanisterDataSourceModel describes the data source data model.
+type DashboardCanisterDataSourceModel struct {
+	CanisterId  types.String `tfsdk:"canister_id"`
+	ApiUrl      types.String `tfsdk:"api_url"`
+	Name        types.String `tfsdk:"name"`
+	SubnetId    types.String `tfsdk:"subnet_id"`
+	Controllers types.List   `tfsdk:"controllers"`
+	ModuleHash  types.String `tfsdk:"module_hash"`
+	UpdatedAt   types.String `tfsdk:"updated_at"`
+
+	CreatedAt         types.String `tfsdk:"created_at"`
+	ControllerHistory types.List   `tfsdk:"controller_history"`
+	TotalNumChanges   types.Int64  `tfsdk:"total_num_changes"`
+}
+
+var controllerChangeAttrTypes = map[string]attr.Type{
+	"timestamp_nanos":  types.Int64Type,
+	"canister_version": types.Int64Type,
+	"controllers":      types.ListType{ElemType: types.StringType},
+}
+
+// A change of the controllers of a canister, including its creation.
+type controllerChange struct {
+	TimestampNanos  uint64
+	CanisterVersion uint64
+	Controllers     []string
+}
+
+// The (relevant part of the) dashboard API response for a canister
+type dashboardCanister struct {
+	CanisterId  string   `json:"canister_id"`
+	Name        *string  `json:"name"`
+	SubnetId    *string  `json:"subnet_id"`
+	Controllers []string `json:"controllers"`
+	ModuleHash  *string  `json:"module_hash"`
+	UpdatedAt   *string  `json:"updated_at"`
+}
+
+func (d *DashboardCanisterDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_dashboard_canister"
+}
+
+func (d *DashboardCanisterDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Looks up metadata about a mainnet canister indexed by the public IC dashboard API. " +
+			"This is meant to give context on imported or referenced canisters; the data is indexed by the dashboard and may lag behind the state of the canister. " +
+			"The creation time and the controller history of the canister are read from the IC with `canister_info`, which requires `wallet_canister_id` or `proxy_canister_id`.",
+
+		Attributes: map[string]schema.Attribute{
+			"canister_id": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Canister identifier",
+			},
+			"api_url": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Base URL of the dashboard API. Defaults to `" + defaultDashboardApiUrl + "`.",
+			},
+			"name": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Name of the canister, if known to the dashboard",
+			},
+			"subnet_id": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Subnet the canister is running on",
+			},
+			"controllers": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Controllers of the canister",
+			},
+			"module_hash": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Sha256 sum of the installed Wasm module (hex encoded), if any",
+			},
+			"updated_at": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Time the dashboard last updated the canister's data",
+			},
+			"created_at": schema.StringAttribute{
+				Computed: true,
+				MarkdownDescription: "Time the canister was created (RFC 3339), read with `canister_info` from the provider's endpoint. " +
+					"Null unless `wallet_canister_id` or `proxy_canister_id` is set (only canisters can call `canister_info`), or if the creation is not among the " + fmt.Sprint(maxCanisterInfoChanges) + " most recent changes of the canister.",
+			},
+			"controller_history": schema.ListNestedAttribute{
+				Computed: true,
+				MarkdownDescription: "Controllers set at the creation of the canister and by later changes, oldest first, read with `canister_info` from the provider's endpoint. " +
+					"The IC only keeps the " + fmt.Sprint(maxCanisterInfoChanges) + " most recent changes of a canister (see `total_num_changes`). Null unless `wallet_canister_id` or `proxy_canister_id` is set.",
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"timestamp_nanos": schema.Int64Attribute{
+							Computed:            true,
+							MarkdownDescription: "Time of the change, in nanoseconds since the epoch",
+						},
+						"canister_version": schema.Int64Attribute{
+							Computed:            true,
+							MarkdownDescription: "Version of the canister after the change",
+						},
+						"controllers": schema.ListAttribute{
+							ElementType:         types.StringType,
+							Computed:            true,
+							MarkdownDescription: "Controllers of the canister after the change",
+						},
+					},
+				},
+			},
+			"total_num_changes": schema.Int64Attribute{
+				Computed:            true,
+				MarkdownDescription: "Number of changes (creation, code deployments, controller changes...) of the canister since its creation. Null unless `wallet_canister_id` or `proxy_canister_id` is set.",
+			},
+		},
+	}
+}
+
+func (d *DashboardCanisterDataSource) Configure(ctx context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.config = providerData.Config
+	if providerData.ManagementProxy != nil && !providerData.ManagementProxy.Orbit {
+		d.proxy = providerData.ManagementProxy
+	}
+}
+
+func (d *DashboardCanisterDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data DashboardCanisterDataSourceModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	canisterId, err := principal.Decode(data.CanisterId.ValueString())
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode canister id", err))
+		return
+	}
+
+	apiUrl := defaultDashboardApiUrl
+	if !data.ApiUrl.IsNull() {
+		apiUrl = data.ApiUrl.ValueString()
+	}
+
+	canister, err := fetchDashboardCanister(ctx, apiUrl, canisterId)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not look up canister", err))
+		return
+	}
+
+	data.Name = types.StringPointerValue(canister.Name)
+	data.SubnetId = types.StringPointerValue(canister.SubnetId)
+	data.ModuleHash = types.StringPointerValue(canister.ModuleHash)
+	data.UpdatedAt = types.StringPointerValue(canister.UpdatedAt)
+
+	controllers, diags := types.ListValueFrom(ctx, types.StringType, canister.Controllers)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	data.Controllers = controllers
+
+	data.CreatedAt = types.StringNull()
+	data.ControllerHistory = types.ListNull(types.ObjectType{AttrTypes: controllerChangeAttrTypes})
+	data.TotalNumChanges = types.Int64Null()
+	if d.config != nil && d.proxy != nil {
+		resp.Diagnostics.Append(d.readHistory(ctx, canisterId, &data)...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Sets the creation time and the controller history of the canister from canister_info.
+func (d *DashboardCanisterDataSource) readHistory(ctx context.Context, canisterId principal.Principal, data *DashboardCanisterDataSourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	tflog.Info(ctx, "Reading the history of canister "+canisterId.Encode()+" through "+d.proxy.CanisterId.Encode())
+
+	a, err := newManagementAgent(ctx, *d.config, d.proxy)
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not create management agent", err))
+		return diags
+	}
+	numChanges := uint64(maxCanisterInfoChanges)
+	info, err := a.CanisterInfo(icMgmt.CanisterInfoArgs{CanisterId: canisterId, NumRequestedChanges: &numChanges})
+	if err != nil {
+		diags.Append(clientErrorDiagnostic("Could not read canister history", err))
+		return diags
+	}
+
+	createdAt, changes := canisterControllerHistory(info)
+	if createdAt != nil {
+		data.CreatedAt = types.StringValue(createdAt.UTC().Format(time.RFC3339Nano))
+	}
+	data.TotalNumChanges = types.Int64Value(int64(info.TotalNumChanges))
+
+	changeValues := make([]attr.Value, len(changes))
+	for i, change := range changes {
+		controllers, listDiags := types.ListValueFrom(ctx, types.StringType, change.Controllers)
+		diags.Append(listDiags...)
+		changeValue, objectDiags := types.ObjectValue(controllerChangeAttrTypes, map[string]attr.Value{
+			"timestamp_nanos":  types.Int64Value(int64(change.TimestampNanos)),
+			"canister_version": types.Int64Value(int64(change.CanisterVersion)),
+			"controllers":      controllers,
+		})
+		diags.Append(objectDiags...)
+		changeValues[i] = changeValue
+	}
+	if diags.HasError() {
+		return diags
+	}
+	history, listDiags := types.ListValue(types.ObjectType{AttrTypes: controllerChangeAttrTypes}, changeValues)
+	diags.Append(listDiags...)
+	data.ControllerHistory = history
+
+	return diags
+}
+
+// Returns the creation time of the canister (nil if the creation is not among the recent
+// changes) and the changes of its controllers, oldest first.
+func canisterControllerHistory(info *icMgmt.CanisterInfoResult) (*time.Time, []controllerChange) {
+	var createdAt *time.Time
+	changes := []controllerChange{}
+
+	for _, change := range info.RecentChanges {
+		var controllers []principal.Principal
+		switch {
+		case change.Details.Creation != nil:
+			created := time.Unix(0, int64(change.TimestampNanos))
+			createdAt = &created
+			controllers = change.Details.Creation.Controllers
+		case change.Details.ControllersChange != nil:
+			controllers = change.Details.ControllersChange.Controllers
+		default:
+			continue
+		}
+
+		controllerIds := make([]string, len(controllers))
+		for i, controller := range controllers {
+			controllerIds[i] = controller.Encode()
+		}
+		changes = append(changes, controllerChange{
+			TimestampNanos:  change.TimestampNanos,
+			CanisterVersion: change.CanisterVersion,
+			Controllers:     controllerIds,
+		})
+	}
+
+	return createdAt, changes
+}
+
+func fetchDashboardCanister(ctx context.Context, apiUrl string, canisterId principal.Principal) (*dashboardCanister, error) {
+	endpoint, err := url.JoinPath(strings.TrimSuffix(apiUrl, "/"), "api", "v3", "canisters", canisterId.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	tflog.Info(ctx, "Looking up canister: "+endpoint)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("canister %s not found", canisterId.Encode())
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", res.Status)
+	}
+
+	var canister dashboardCanister
+	err = json.NewDecoder(res.Body).Decode(&canister)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode response: %w", err)
+	}
+
+	if canister.Controllers == nil {
+		canister.Controllers = []string{}
+	}
+
+	return &canister, nil
+}
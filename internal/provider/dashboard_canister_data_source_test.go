@@ -0,0 +1,171 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	"github.com/aviate-labs/agent-go/ic/wallet"
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+)
+
+func TestDashboardCanisterDataSource(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/canisters/ryjl3-tyaaa-aaaaa-aaaba-cai" {
+			http.NotFound(w, r)
+			return
+		}
+
+		fmt.Fprint(w, `{
+  "canister_id": "ryjl3-tyaaa-aaaaa-aaaba-cai",
+  "controllers": ["r7inp-6aaaa-aaaaa-aaabq-cai"],
+  "module_hash": "abcd",
+  "name": "NNS ICP Ledger",
+  "subnet_id": "tdb26-jop6k-aogll-7ltgs-eruif-6kk7m-qpktf-gdiqx-mxtrf-vb5e6-eqe",
+  "updated_at": "2024-01-01T00:00:00"
+}`)
+	}))
+	defer server.Close()
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+data "ic_dashboard_canister" "ledger" {
+    canister_id = "ryjl3-tyaaa-aaaaa-aaaba-cai"
+    api_url = "%s"
+}
+`, server.URL),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("data.ic_dashboard_canister.ledger", "name", "NNS ICP Ledger"),
+					resource.TestCheckResourceAttr("data.ic_dashboard_canister.ledger", "subnet_id", "tdb26-jop6k-aogll-7ltgs-eruif-6kk7m-qpktf-gdiqx-mxtrf-vb5e6-eqe"),
+					resource.TestCheckResourceAttr("data.ic_dashboard_canister.ledger", "controllers.#", "1"),
+					resource.TestCheckResourceAttr("data.ic_dashboard_canister.ledger", "controllers.0", "r7inp-6aaaa-aaaaa-aaabq-cai"),
+					resource.TestCheckResourceAttr("data.ic_dashboard_canister.ledger", "module_hash", "abcd"),
+				),
+			},
+		},
+	})
+}
+
+// Checks that the creation time and the controller history are read with canister_info
+// through the wallet.
+func TestDashboardCanisterHistory(t *testing.T) {
+	const walletId = "rkp4c-7iaaa-aaaaa-aaaca-cai"
+	canisterId := principal.MustDecode("ryjl3-tyaaa-aaaaa-aaaba-cai")
+	creator := principal.MustDecode("r7inp-6aaaa-aaaaa-aaabq-cai")
+	controller := principal.MustDecode("rrkah-fqaaa-aaaaa-aaaaq-cai")
+
+	origin := icMgmt.ChangeOrigin{FromUser: &struct {
+		UserId principal.Principal `ic:"user_id" json:"user_id"`
+	}{UserId: creator}}
+	info := icMgmt.CanisterInfoResult{
+		TotalNumChanges: 4,
+		RecentChanges: []icMgmt.Change{
+			{TimestampNanos: 1_700_000_000_000_000_000, CanisterVersion: 0, Origin: origin, Details: icMgmt.ChangeDetails{Creation: &struct {
+				Controllers []principal.Principal `ic:"controllers" json:"controllers"`
+			}{Controllers: []principal.Principal{creator}}}},
+			{TimestampNanos: 1_700_000_001_000_000_000, CanisterVersion: 1, Origin: origin, Details: icMgmt.ChangeDetails{CodeUninstall: new(idl.Null)}},
+			{TimestampNanos: 1_700_000_002_000_000_000, CanisterVersion: 2, Origin: origin, Details: icMgmt.ChangeDetails{ControllersChange: &struct {
+				Controllers []principal.Principal `ic:"controllers" json:"controllers"`
+			}{Controllers: []principal.Principal{creator, controller}}}},
+		},
+		Controllers: []principal.Principal{creator, controller},
+	}
+	infoRaw, err := idl.Marshal([]any{info})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var forwarded wallet.WalletResultCall
+	forwarded.Ok = &struct {
+		Return []byte `ic:"return" json:"return"`
+	}{Return: infoRaw}
+	reply, err := idl.Marshal([]any{forwarded})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := agentFixture{Interactions: []agentInteraction{
+		{Type: string(agent.RequestTypeCall), CanisterId: walletId, Method: walletCallMethod, Reply: reply},
+	}}
+	fixture.replayed = make([]bool, len(fixture.Interactions))
+	backend, err := newMockBackend("", mockState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.replay = &fixture
+
+	host, _ := url.Parse("mock://" + strings.ToLower(t.Name()))
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, func(http.RoundTripper) http.RoundTripper {
+		return &mockTransport{backend: backend}
+	}))
+	d := &DashboardCanisterDataSource{
+		config: &agent.Config{
+			ClientConfig: &agent.ClientConfig{Host: host},
+			Identity:     new(identity.AnonymousIdentity),
+			FetchRootKey: true,
+			PollDelay:    10 * time.Millisecond,
+			PollTimeout:  time.Second,
+		},
+		proxy: &managementProxy{CanisterId: principal.MustDecode(walletId), Method: walletCallMethod, Wallet: true},
+	}
+
+	ctx := context.Background()
+	var data DashboardCanisterDataSourceModel
+	if diags := d.readHistory(ctx, canisterId, &data); diags.HasError() {
+		t.Fatal(diags)
+	}
+
+	if data.CreatedAt.ValueString() != "2023-11-14T22:13:20Z" {
+		t.Errorf("expected the creation time 2023-11-14T22:13:20Z, got %s", data.CreatedAt)
+	}
+	if data.TotalNumChanges.ValueInt64() != 4 {
+		t.Errorf("expected 4 changes, got %s", data.TotalNumChanges)
+	}
+
+	var history []struct {
+		TimestampNanos  int64    `tfsdk:"timestamp_nanos"`
+		CanisterVersion int64    `tfsdk:"canister_version"`
+		Controllers     []string `tfsdk:"controllers"`
+	}
+	if diags := data.ControllerHistory.ElementsAs(ctx, &history, false); diags.HasError() {
+		t.Fatal(diags)
+	}
+	// The code uninstall is not a change of controllers
+	if len(history) != 2 {
+		t.Fatalf("expected 2 controller changes, got %v", history)
+	}
+	if history[0].CanisterVersion != 0 || len(history[0].Controllers) != 1 || history[0].Controllers[0] != creator.Encode() {
+		t.Errorf("expected the creation by %s, got %v", creator, history[0])
+	}
+	if history[1].TimestampNanos != 1_700_000_002_000_000_000 || history[1].CanisterVersion != 2 || len(history[1].Controllers) != 2 || history[1].Controllers[1] != controller.Encode() {
+		t.Errorf("expected the addition of controller %s, got %v", controller, history[1])
+	}
+}
+
+func TestCanisterControllerHistory(t *testing.T) {
+	// Without the creation among the recent changes, the creation time is unknown
+	createdAt, changes := canisterControllerHistory(&icMgmt.CanisterInfoResult{
+		TotalNumChanges: 30,
+		RecentChanges: []icMgmt.Change{
+			{TimestampNanos: 1, CanisterVersion: 29, Details: icMgmt.ChangeDetails{CodeUninstall: new(idl.Null)}},
+		},
+	})
+	if createdAt != nil || len(changes) != 0 {
+		t.Fatalf("expected no creation time and no change, got %v and %v", createdAt, changes)
+	}
+}
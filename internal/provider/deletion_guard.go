@@ -0,0 +1,88 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// A deletion guard is a controller of the canister (deletion_guard) through which the
+// provider deletes it: the guard only deletes the canister once a deletion requested with
+// request_deletion has been time-locked for a delay of its choosing, so that deletions
+// (e.g. an unintended `terraform destroy` or replacement) can be noticed and cancelled
+// before they happen. Guards implement the following interface:
+//
+//	type deletion_args = record { canister_id : principal };
+//	service : {
+//	  // Starts the time lock of the deletion (unless already started), returning the time
+//	  // (in nanoseconds since the epoch) at which the canister can be deleted.
+//	  request_deletion : (deletion_args) -> (variant { Ok : record { unlocks_at : nat64 }; Err : text });
+//	  // Deletes the (stopped) canister with the management canister's delete_canister, if
+//	  // its deletion was requested and is unlocked.
+//	  delete_canister : (deletion_args) -> (variant { Ok; Err : text });
+//	}
+//
+// Cancelling a requested deletion is left to the guard (e.g. to a method only callable by
+// a different principal than the provider's).
+type deletionGuardArgs struct {
+	CanisterId principal.Principal `ic:"canister_id" json:"canister_id"`
+}
+
+type deletionGuardRequestResult struct {
+	Ok *struct {
+		UnlocksAt uint64 `ic:"unlocks_at" json:"unlocks_at"`
+	} `ic:"Ok,variant"`
+	Err *string `ic:"Err,variant"`
+}
+
+type deletionGuardDeleteResult struct {
+	Ok  *idl.Null `ic:"Ok,variant"`
+	Err *string   `ic:"Err,variant"`
+}
+
+// Requests the deletion of the canister from the guard, returning the time at which it is
+// unlocked. Requesting it again returns the time of the pending request.
+func requestGuardedDeletion(config agent.Config, guard principal.Principal, canisterId principal.Principal) (time.Time, error) {
+	a, err := newAgent(config)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var res deletionGuardRequestResult
+	err = a.Call(guard, "request_deletion", []any{deletionGuardArgs{CanisterId: canisterId}}, []any{&res})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if res.Err != nil {
+		return time.Time{}, fmt.Errorf("%s refused the deletion of %s: %s", guard.Encode(), canisterId.Encode(), *res.Err)
+	}
+	if res.Ok == nil {
+		return time.Time{}, fmt.Errorf("invalid reply of %s to request_deletion", guard.Encode())
+	}
+
+	return time.Unix(0, int64(res.Ok.UnlocksAt)), nil
+}
+
+// Deletes the canister through the guard, once its deletion is unlocked.
+func guardedDeleteCanister(config agent.Config, guard principal.Principal, canisterId principal.Principal) error {
+	a, err := newAgent(config)
+	if err != nil {
+		return err
+	}
+
+	var res deletionGuardDeleteResult
+	err = a.Call(guard, "delete_canister", []any{deletionGuardArgs{CanisterId: canisterId}}, []any{&res})
+	if err != nil {
+		return err
+	}
+	if res.Err != nil {
+		return fmt.Errorf("%s could not delete %s: %s", guard.Encode(), canisterId.Encode(), *res.Err)
+	}
+
+	return nil
+}
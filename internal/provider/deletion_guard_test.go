@@ -0,0 +1,89 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+func TestDeletionGuard(t *testing.T) {
+	guard := principal.MustDecode("rrkah-fqaaa-aaaaa-aaaaq-cai")
+	canisterId := principal.MustDecode("ryjl3-tyaaa-aaaaa-aaaba-cai")
+	unlocksAt := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+
+	reply := func(value any) hexBytes {
+		data, err := idl.Marshal([]any{value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	locked, unlocked := deletionGuardRequestResult{}, deletionGuardRequestResult{}
+	locked.Ok = &struct {
+		UnlocksAt uint64 `ic:"unlocks_at" json:"unlocks_at"`
+	}{UnlocksAt: uint64(unlocksAt.UnixNano())}
+	unlocked.Ok = &struct {
+		UnlocksAt uint64 `ic:"unlocks_at" json:"unlocks_at"`
+	}{UnlocksAt: uint64(unlocksAt.Add(-48 * time.Hour).UnixNano())}
+	refused := "deletion not requested"
+
+	data, err := json.Marshal(agentFixture{Interactions: []agentInteraction{
+		{Type: "call", CanisterId: guard.Encode(), Method: "request_deletion", Reply: reply(locked)},
+		{Type: "call", CanisterId: guard.Encode(), Method: "request_deletion", Reply: reply(unlocked)},
+		{Type: "call", CanisterId: guard.Encode(), Method: "delete_canister", Reply: reply(deletionGuardDeleteResult{Err: &refused})},
+		{Type: "call", CanisterId: guard.Encode(), Method: "delete_canister", Reply: reply(deletionGuardDeleteResult{Ok: new(idl.Null)})},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixture := path.Join(t.TempDir(), "fixture.json")
+	if err := os.WriteFile(fixture, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	host, _ := url.Parse("https://guard.test")
+	config := agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		PollDelay:    10 * time.Millisecond,
+		PollTimeout:  10 * time.Second,
+	}
+	cleanupAgentFixtures(t)
+	wrapBase, err := applyAgentFixtures(&config, fixture, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{retryPolicy: DefaultRetryPolicy()}, wrapBase))
+
+	at, err := requestGuardedDeletion(config, guard, canisterId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !at.Equal(unlocksAt) {
+		t.Fatalf("expected the deletion to be unlocked at %s, got %s", unlocksAt, at)
+	}
+	at, err = requestGuardedDeletion(config, guard, canisterId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !at.Before(time.Now()) {
+		t.Fatalf("expected the deletion to be unlocked, got %s", at)
+	}
+
+	if err := guardedDeleteCanister(config, guard, canisterId); err == nil {
+		t.Fatal("expected the guard to refuse the deletion")
+	}
+	if err := guardedDeleteCanister(config, guard, canisterId); err != nil {
+		t.Fatal(err)
+	}
+}
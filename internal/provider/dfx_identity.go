@@ -0,0 +1,128 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// The configuration of a dfx identity (identity.json)
+type dfxIdentityConfig struct {
+	Encryption *struct {
+		PwSalt    string `json:"pw_salt"`    // PHC (base64) encoded salt
+		FileNonce []int  `json:"file_nonce"` // AES-GCM nonce, serialized as an array of numbers
+	} `json:"encryption"`
+	KeyringIdentitySuffix *string `json:"keyring_identity_suffix"`
+}
+
+// Returns the directory where dfx stores its identities, i.e. ~/.config/dfx/identity
+// (or $DFX_CONFIG_ROOT/.config/dfx/identity if set).
+func dfxIdentitiesDir() (string, error) {
+	root := os.Getenv("DFX_CONFIG_ROOT")
+	if len(root) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		root = home
+	}
+
+	return filepath.Join(root, ".config", "dfx", "identity"), nil
+}
+
+// Reads the PEM file of the dfx identity with the given name. Encrypted identities are
+// decrypted with password. Identities stored in the system keyring are not supported.
+func readDfxIdentityPem(name string, password string) ([]byte, error) {
+	identitiesDir, err := dfxIdentitiesDir()
+	if err != nil {
+		return nil, fmt.Errorf("Could not find dfx identities: %w", err)
+	}
+
+	identityDir := filepath.Join(identitiesDir, name)
+
+	var config dfxIdentityConfig
+	configData, err := os.ReadFile(filepath.Join(identityDir, "identity.json"))
+	if err == nil {
+		err = json.Unmarshal(configData, &config)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read configuration of dfx identity %s: %w", name, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("Could not read configuration of dfx identity %s: %w", name, err)
+	}
+
+	if config.KeyringIdentitySuffix != nil {
+		return nil, fmt.Errorf("dfx identity %s is stored in the system keyring, which is not supported. "+
+			"Export it with `dfx identity export %s` and use `identity_pem` instead", name, name)
+	}
+
+	if config.Encryption == nil {
+		data, err := os.ReadFile(filepath.Join(identityDir, "identity.pem"))
+		if err != nil {
+			return nil, fmt.Errorf("Could not read dfx identity %s: %w", name, err)
+		}
+		return data, nil
+	}
+
+	if len(password) == 0 {
+		return nil, fmt.Errorf("dfx identity %s is encrypted, but no identity_password was specified", name)
+	}
+
+	encrypted, err := os.ReadFile(filepath.Join(identityDir, "identity.pem.encrypted"))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read dfx identity %s: %w", name, err)
+	}
+
+	nonce := make([]byte, len(config.Encryption.FileNonce))
+	for i, b := range config.Encryption.FileNonce {
+		nonce[i] = byte(b)
+	}
+
+	data, err := decryptDfxIdentityPem(encrypted, config.Encryption.PwSalt, nonce, password)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decrypt dfx identity %s: %w", name, err)
+	}
+
+	return data, nil
+}
+
+// Decrypts a PEM file encrypted by dfx: the key is derived from the password with Argon2id
+// (64000 KiB, 3 iterations, 1 lane) and the file is encrypted with AES-256-GCM.
+func decryptDfxIdentityPem(encrypted []byte, pwSalt string, nonce []byte, password string) ([]byte, error) {
+	salt, err := base64.RawStdEncoding.DecodeString(pwSalt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, 3, 64000, 1, 32)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("expected nonce of %d bytes, got %d", gcm.NonceSize(), len(nonce))
+	}
+
+	data, err := gcm.Open(nil, nonce, encrypted, nil)
+	if err != nil {
+		return nil, fmt.Errorf("wrong password or corrupted file")
+	}
+
+	return data, nil
+}
@@ -0,0 +1,652 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aviate-labs/agent-go/candid"
+	"github.com/aviate-labs/agent-go/candid/did"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
+)
+
+// The types and methods of a candid service, as described by a .did file. Unlike the
+// heuristics of TFValToCandid, Terraform values are converted to candid according to the
+// types declared in the .did file, so that e.g. Terraform numbers can be encoded as nat64
+// and Terraform objects as variants.
+type didService struct {
+	types   map[string]did.Data
+	methods map[string]did.Func
+}
+
+// Reads the service described by the .did file. Imports are not supported.
+func readDidService(didFile string) (*didService, error) {
+	raw, err := os.ReadFile(didFile)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read candid file: %w", err)
+	}
+
+	desc, err := parseDid(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse candid file %s: %w", didFile, err)
+	}
+
+	service, err := newDidTypes(desc, didFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(desc.Services) == 0 {
+		return nil, fmt.Errorf("candid file %s does not declare a service", didFile)
+	}
+
+	actor := desc.Services[0]
+	if actor.MethodId != nil {
+		ref, ok := service.types[*actor.MethodId]
+		if !ok {
+			return nil, fmt.Errorf("unknown service type %s", *actor.MethodId)
+		}
+		s, ok := ref.(did.Service)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a service type", *actor.MethodId)
+		}
+		actor = s
+	}
+
+	for _, method := range actor.Methods {
+		if method.Func != nil {
+			service.methods[method.Name] = *method.Func
+			continue
+		}
+
+		ref, ok := service.types[*method.ID]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %s of method %s", *method.ID, method.Name)
+		}
+		f, ok := ref.(did.Func)
+		if !ok {
+			return nil, fmt.Errorf("type %s of method %s is not a function type", *method.ID, method.Name)
+		}
+		service.methods[method.Name] = f
+	}
+
+	return service, nil
+}
+
+// Name of the function type holding the init arguments of the service (see
+// readDidInitArgs), which can't clash with the names of the .did file.
+const didInitArgsType = "__init_args"
+
+// The start of the init arguments of the service, e.g. `service : (InitArgs) -> {`.
+var didServiceArgsRegexp = regexp.MustCompile(`(?m)^[ \t]*service[ \t]*(?:[A-Za-z_][A-Za-z0-9_]*[ \t]*)?:\s*\(`)
+
+// Reads the types of the .did file and the init arguments of its service (e.g. the argument
+// of `service : (LedgerArg) -> { ... }`), as the arguments of a method. Services without
+// init arguments take none.
+//
+// NOTE: the candid parser of agent-go (v0.4.4) drops the init arguments of services, so
+// they are extracted from the source and declared as a function type.
+func readDidInitArgs(didFile string) (*didService, did.Func, error) {
+	raw, err := os.ReadFile(didFile)
+	if err != nil {
+		return nil, did.Func{}, fmt.Errorf("Could not read candid file: %w", err)
+	}
+
+	src := string(raw)
+	args := "()"
+	if loc := didServiceArgsRegexp.FindStringIndex(src); loc != nil {
+		end, err := didTupleEnd(src, loc[1]-1)
+		if err != nil {
+			return nil, did.Func{}, fmt.Errorf("Could not parse candid file %s: %w", didFile, err)
+		}
+		args = src[loc[1]-1 : end]
+		src = src[:loc[0]] + "\ntype " + didInitArgsType + " = func " + args + " -> ();\n" + src[loc[0]:]
+	} else {
+		src = "type " + didInitArgsType + " = func " + args + " -> ();\n" + src
+	}
+
+	desc, err := parseDid([]byte(src))
+	if err != nil {
+		return nil, did.Func{}, fmt.Errorf("Could not parse candid file %s: %w", didFile, err)
+	}
+
+	service, err := newDidTypes(desc, didFile)
+	if err != nil {
+		return nil, did.Func{}, err
+	}
+
+	initArgs, ok := service.types[didInitArgsType].(did.Func)
+	if !ok {
+		return nil, did.Func{}, fmt.Errorf("Could not parse the init arguments %s of candid file %s", args, didFile)
+	}
+
+	return service, initArgs, nil
+}
+
+// Returns the index following the parenthesis closing the one at start, skipping text
+// literals and comments.
+func didTupleEnd(src string, start int) (int, error) {
+	depth := 0
+	for i := start; i < len(src); i++ {
+		switch {
+		case src[i] == '"':
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case src[i] == '(':
+			depth++
+		case src[i] == ')':
+			depth--
+			if depth == 0 {
+				return i + 1, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unbalanced parentheses in the init arguments of the service")
+}
+
+// Returns a service with the type definitions of the candid description (from source) but
+// no methods.
+func newDidTypes(desc did.Description, source string) (*didService, error) {
+	service := &didService{
+		types:   map[string]did.Data{},
+		methods: map[string]did.Func{},
+	}
+
+	for _, def := range desc.Definitions {
+		switch def := def.(type) {
+		case did.Type:
+			service.types[def.Id] = def.Data
+		case did.Import:
+			return nil, fmt.Errorf("candid file %s has imports, which are not supported", source)
+		}
+	}
+
+	return service, nil
+}
+
+// The candid parser panics on some invalid inputs; panics are turned into errors.
+func parseDid(raw []byte) (desc did.Description, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("invalid candid: %v", r)
+		}
+	}()
+
+	return candid.ParseDID(raw)
+}
+
+// Returns a canonical representation of the candid interface, in which type definitions and
+// methods are sorted and formatting is normalized. Interfaces that cannot be parsed are only normalized
+// for whitespace.
+func canonicalDid(raw []byte) string {
+	desc, err := parseDid(raw)
+	if err != nil {
+		return strings.Join(strings.Fields(string(raw)), " ")
+	}
+
+	defs := make([]string, len(desc.Definitions))
+	for i, def := range desc.Definitions {
+		defs[i] = def.String()
+	}
+	sort.Strings(defs)
+
+	services := make([]string, len(desc.Services))
+	for i, service := range desc.Services {
+		methods := append([]did.Method{}, service.Methods...)
+		sort.Slice(methods, func(a, b int) bool { return methods[a].Name < methods[b].Name })
+		service.Methods = methods
+		services[i] = service.String()
+	}
+
+	return strings.Join(defs, ";\n") + "\n" + strings.Join(services, ";\n")
+}
+
+// Returns the method with the given name.
+func (s *didService) Method(name string) (did.Func, error) {
+	method, ok := s.methods[name]
+	if !ok {
+		return did.Func{}, fmt.Errorf("method %s is not declared in the candid file", name)
+	}
+
+	return method, nil
+}
+
+// Encodes the Terraform value (a list or tuple with one element per argument) as the
+// arguments of the method.
+func (s *didService) EncodeArgs(method did.Func, val tftypes.Value) ([]byte, error) {
+	var elems []tftypes.Value
+	if !val.IsNull() {
+		err := val.As(&elems)
+		if err != nil {
+			return nil, fmt.Errorf("arguments must be a list, with one element per argument")
+		}
+	}
+
+	if len(elems) != len(method.ArgTypes) {
+		return nil, fmt.Errorf("expected %d arguments (%s), got %d", len(method.ArgTypes), method.ArgTypes.String(), len(elems))
+	}
+
+	tys := make([]idl.Type, len(elems))
+	values := make([]any, len(elems))
+	for i, arg := range method.ArgTypes {
+		var err error
+		tys[i], err = s.idlType(arg.Data, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i], err = s.candidValue(arg.Data, elems[i])
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", i, err)
+		}
+	}
+
+	return idl.Encode(tys, values)
+}
+
+// Follows type references. Cycles are reported as errors.
+func (s *didService) resolve(data did.Data) (did.Data, error) {
+	seen := map[did.DataId]bool{}
+	for {
+		id, ok := data.(did.DataId)
+		if !ok {
+			return data, nil
+		}
+
+		if seen[id] {
+			return nil, fmt.Errorf("type %s is defined in terms of itself", id)
+		}
+		seen[id] = true
+
+		data, ok = s.types[string(id)]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %s", id)
+		}
+	}
+}
+
+// Returns the name of the record or variant field. Only named fields are supported, since
+// agent-go identifies fields by the hash of their name.
+func didFieldName(field did.Field) (string, error) {
+	var name string
+	switch {
+	case field.Name != nil:
+		name = *field.Name
+	case field.NameData != nil:
+		name = *field.NameData
+	default:
+		return "", fmt.Errorf("fields without names are not supported")
+	}
+
+	return strings.Trim(name, `"`), nil
+}
+
+// Returns the type of the field's value (null for variant cases without value).
+// NOTE: the parser stores type references in NameData, like the names of variant cases
+// without value.
+func didFieldData(field did.Field) did.Data {
+	switch {
+	case field.Data != nil:
+		return *field.Data
+	case field.Name != nil && field.NameData != nil:
+		return did.DataId(*field.NameData)
+	default:
+		return did.Primitive("null")
+	}
+}
+
+// Converts the declared type to an agent-go type. visiting holds the type references
+// being converted, since recursive types cannot be encoded.
+func (s *didService) idlType(data did.Data, visiting map[did.DataId]bool) (idl.Type, error) {
+	if id, ok := data.(did.DataId); ok {
+		if visiting[id] {
+			return nil, fmt.Errorf("recursive type %s is not supported", id)
+		}
+
+		next := map[did.DataId]bool{id: true}
+		for v := range visiting {
+			next[v] = true
+		}
+		visiting = next
+	}
+
+	data, err := s.resolve(data)
+	if err != nil {
+		return nil, err
+	}
+
+	switch data := data.(type) {
+	case did.Primitive:
+		return idlPrimitiveType(string(data))
+	case did.Principal:
+		return new(idl.PrincipalType), nil
+	case did.Blob:
+		return idl.NewVectorType(idl.Nat8Type()), nil
+	case did.Optional:
+		ty, err := s.idlType(data.Data, visiting)
+		if err != nil {
+			return nil, err
+		}
+		return idl.NewOptionalType(ty), nil
+	case did.Vector:
+		ty, err := s.idlType(data.Data, visiting)
+		if err != nil {
+			return nil, err
+		}
+		return idl.NewVectorType(ty), nil
+	case did.Record:
+		fields := map[string]idl.Type{}
+		for _, field := range data {
+			name, err := didFieldName(field)
+			if err != nil {
+				return nil, err
+			}
+			fields[name], err = s.idlType(didFieldData(field), visiting)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return idl.NewRecordType(fields), nil
+	case did.Variant:
+		fields := map[string]idl.Type{}
+		for _, field := range data {
+			name, err := didFieldName(field)
+			if err != nil {
+				return nil, err
+			}
+			fields[name], err = s.idlType(didFieldData(field), visiting)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return idl.NewVariantType(fields), nil
+	default:
+		return nil, fmt.Errorf("type %s is not supported", data.String())
+	}
+}
+
+func idlPrimitiveType(name string) (idl.Type, error) {
+	switch name {
+	case "nat":
+		return new(idl.NatType), nil
+	case "nat8":
+		return idl.Nat8Type(), nil
+	case "nat16":
+		return idl.Nat16Type(), nil
+	case "nat32":
+		return idl.Nat32Type(), nil
+	case "nat64":
+		return idl.Nat64Type(), nil
+	case "int":
+		return new(idl.IntType), nil
+	case "int8":
+		return idl.Int8Type(), nil
+	case "int16":
+		return idl.Int16Type(), nil
+	case "int32":
+		return idl.Int32Type(), nil
+	case "int64":
+		return idl.Int64Type(), nil
+	case "float32":
+		return idl.Float32Type(), nil
+	case "float64":
+		return idl.Float64Type(), nil
+	case "bool":
+		return new(idl.BoolType), nil
+	case "text":
+		return new(idl.TextType), nil
+	case "null":
+		return new(idl.NullType), nil
+	case "reserved":
+		return new(idl.ReservedType), nil
+	default:
+		return nil, fmt.Errorf("type %s is not supported", name)
+	}
+}
+
+// Converts the Terraform value to a value of the declared type:
+//   - numbers are read from Terraform numbers or (for large values) decimal strings
+//   - principals are read from their textual representation
+//   - blobs are read from hex strings or from did_blob_file values
+//   - opts are none when the value is null
+//   - vecs are read from lists, tuples and sets
+//   - records are read from objects and maps; missing fields must be opts
+//   - variants are read from objects with a single attribute, the case, or from strings
+//     for cases without value
+func (s *didService) candidValue(data did.Data, val tftypes.Value) (any, error) {
+	data, err := s.resolve(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if opt, ok := data.(did.Optional); ok {
+		if val.IsNull() {
+			return nil, nil
+		}
+		return s.candidValue(opt.Data, val)
+	}
+
+	if prim, ok := data.(did.Primitive); ok && (prim == "null" || prim == "reserved") {
+		if prim == "null" {
+			return idl.Null{}, nil
+		}
+		return idl.Reserved{}, nil
+	}
+
+	if val.IsNull() {
+		return nil, fmt.Errorf("expected %s, got null", data.String())
+	}
+
+	switch data := data.(type) {
+	case did.Primitive:
+		return candidPrimitiveValue(string(data), val)
+	case did.Principal:
+		var str string
+		if err := val.As(&str); err != nil {
+			return nil, fmt.Errorf("expected a principal, got %s", val.Type().String())
+		}
+		return principal.Decode(str)
+	case did.Blob:
+		if blob, err := readWrappedValue(val); err == nil {
+			if blob, ok := blob.([]byte); ok {
+				return blob, nil
+			}
+		}
+		var str string
+		if err := val.As(&str); err != nil {
+			return nil, fmt.Errorf("expected a hex-encoded blob, got %s", val.Type().String())
+		}
+		return hex.DecodeString(str)
+	case did.Vector:
+		var elems []tftypes.Value
+		if err := val.As(&elems); err != nil {
+			return nil, fmt.Errorf("expected a list for %s, got %s", data.String(), val.Type().String())
+		}
+		values := make([]any, len(elems))
+		for i, elem := range elems {
+			values[i], err = s.candidValue(data.Data, elem)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		return values, nil
+	case did.Record:
+		var attrs map[string]tftypes.Value
+		if err := val.As(&attrs); err != nil {
+			return nil, fmt.Errorf("expected an object for a record, got %s", val.Type().String())
+		}
+		values := map[string]any{}
+		for _, field := range data {
+			name, err := didFieldName(field)
+			if err != nil {
+				return nil, err
+			}
+			attr, ok := attrs[name]
+			if !ok {
+				attr = tftypes.NewValue(tftypes.DynamicPseudoType, nil)
+			}
+			values[name], err = s.candidValue(didFieldData(field), attr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			delete(attrs, name)
+		}
+		for name := range attrs {
+			return nil, fmt.Errorf("unknown record field %s", name)
+		}
+		return values, nil
+	case did.Variant:
+		return s.candidVariantValue(data, val)
+	default:
+		return nil, fmt.Errorf("type %s is not supported", data.String())
+	}
+}
+
+func (s *didService) candidVariantValue(variant did.Variant, val tftypes.Value) (any, error) {
+	var tag string
+	var value tftypes.Value
+
+	var attrs map[string]tftypes.Value
+	if err := val.As(&tag); err == nil {
+		value = tftypes.NewValue(tftypes.DynamicPseudoType, nil)
+	} else if err := val.As(&attrs); err == nil && len(attrs) == 1 {
+		for name, attr := range attrs {
+			tag, value = name, attr
+		}
+	} else {
+		return nil, fmt.Errorf("expected a case name or an object with a single attribute for a variant, got %s", val.Type().String())
+	}
+
+	for _, field := range variant {
+		name, err := didFieldName(field)
+		if err != nil {
+			return nil, err
+		}
+		if name != tag {
+			continue
+		}
+		v, err := s.candidValue(didFieldData(field), value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", tag, err)
+		}
+		return idl.Variant{Name: tag, Value: v}, nil
+	}
+
+	return nil, fmt.Errorf("unknown variant case %s", tag)
+}
+
+func candidPrimitiveValue(name string, val tftypes.Value) (any, error) {
+	switch name {
+	case "bool":
+		var b bool
+		if err := val.As(&b); err != nil {
+			return nil, fmt.Errorf("expected a bool, got %s", val.Type().String())
+		}
+		return b, nil
+	case "text":
+		var str string
+		if err := val.As(&str); err != nil {
+			return nil, fmt.Errorf("expected a string, got %s", val.Type().String())
+		}
+		return str, nil
+	case "float32", "float64":
+		var f big.Float
+		if err := val.As(&f); err != nil {
+			return nil, fmt.Errorf("expected a number, got %s", val.Type().String())
+		}
+		if name == "float32" {
+			v, _ := f.Float32()
+			return v, nil
+		}
+		v, _ := f.Float64()
+		return v, nil
+	}
+
+	n, err := tfValueToBigInt(val)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bounds of the fixed-size types
+	bits := map[string]uint{"nat8": 8, "nat16": 16, "nat32": 32, "nat64": 64, "int8": 8, "int16": 16, "int32": 32, "int64": 64}
+
+	switch {
+	case name == "nat":
+		if n.Sign() < 0 {
+			return nil, fmt.Errorf("expected a nat, got %s", n.String())
+		}
+		return idl.NewBigNat(n), nil
+	case name == "int":
+		return idl.NewBigInt(n), nil
+	case strings.HasPrefix(name, "nat"):
+		if n.Sign() < 0 || n.BitLen() > int(bits[name]) {
+			return nil, fmt.Errorf("%s does not fit in %s", n.String(), name)
+		}
+		switch name {
+		case "nat8":
+			return uint8(n.Uint64()), nil
+		case "nat16":
+			return uint16(n.Uint64()), nil
+		case "nat32":
+			return uint32(n.Uint64()), nil
+		default:
+			return n.Uint64(), nil
+		}
+	case strings.HasPrefix(name, "int"):
+		if !n.IsInt64() || n.Int64() < -(1<<(bits[name]-1)) || n.Int64() > 1<<(bits[name]-1)-1 {
+			return nil, fmt.Errorf("%s does not fit in %s", n.String(), name)
+		}
+		switch name {
+		case "int8":
+			return int8(n.Int64()), nil
+		case "int16":
+			return int16(n.Int64()), nil
+		case "int32":
+			return int32(n.Int64()), nil
+		default:
+			return n.Int64(), nil
+		}
+	default:
+		return nil, fmt.Errorf("type %s is not supported", name)
+	}
+}
+
+// Reads an integer from a Terraform number or a decimal string (Terraform numbers lose
+// precision beyond 2^53 in some contexts, e.g. when computed in HCL).
+func tfValueToBigInt(val tftypes.Value) (*big.Int, error) {
+	var str string
+	if err := val.As(&str); err == nil {
+		n, ok := new(big.Int).SetString(str, 10)
+		if !ok {
+			return nil, fmt.Errorf("expected an integer, got %q", str)
+		}
+		return n, nil
+	}
+
+	var f big.Float
+	if err := val.As(&f); err != nil {
+		return nil, fmt.Errorf("expected an integer, got %s", val.Type().String())
+	}
+
+	if !f.IsInt() {
+		return nil, fmt.Errorf("expected an integer, got %s", f.String())
+	}
+
+	n, _ := f.Int(nil)
+	return n, nil
+}
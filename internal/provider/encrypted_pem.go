@@ -0,0 +1,255 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	oidPbes2            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPbkdf2           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHmacWithSha1     = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHmacWithSha224   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHmacWithSha256   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHmacWithSha384   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHmacWithSha512   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAes128Cbc        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAes192Cbc        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAes256Cbc        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	errNoPemPassphrase  = errors.New("the PEM file is encrypted, but no passphrase was specified (identity_pem_passphrase or the IC_PEM_PASSPHRASE environment variable)")
+	errWrongPassphrase  = errors.New("wrong passphrase or corrupted PEM file")
+	errUnsupportedPkcs8 = errors.New("unsupported encryption of the PEM file: only PBES2 with PBKDF2 and AES-CBC (the default of `openssl pkcs8 -topk8`) is supported")
+)
+
+// ASN.1 structures of encrypted PKCS#8 keys (RFC 5208 and RFC 8018).
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	Prf            pkix.AlgorithmIdentifier `asn1:"optional"` // hmacWithSHA1 if absent
+}
+
+// ASN.1 structures of (unencrypted) PKCS#8 and SEC 1 EC keys.
+type pkcs8PrivateKey struct {
+	Version    int
+	Algorithm  pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+type sec1PrivateKey struct {
+	Version       int
+	PrivateKey    []byte
+	NamedCurveOID asn1.ObjectIdentifier `asn1:"optional,explicit,tag:0"`
+	PublicKey     asn1.BitString        `asn1:"optional,explicit,tag:1"`
+}
+
+// Decrypts the encrypted keys of a PEM file with the passphrase, so that NewIdentityFromPEM
+// can read it: legacy encrypted EC keys (with a `Proc-Type: 4,ENCRYPTED` header, as written
+// by `openssl ec -aes256`) and encrypted PKCS#8 keys (`ENCRYPTED PRIVATE KEY`, as written by
+// `openssl pkcs8 -topk8`). PEM files without encrypted keys are returned as is.
+func decryptIdentityPem(data []byte, passphrase string) ([]byte, error) {
+	var blocks []*pem.Block
+	encrypted := false
+
+	for rest := data; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		//nolint:staticcheck // legacy PEM encryption is insecure, but still written by OpenSSL
+		if x509.IsEncryptedPEMBlock(block) {
+			encrypted = true
+			if len(passphrase) == 0 {
+				return nil, errNoPemPassphrase
+			}
+			//nolint:staticcheck
+			der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+			if err != nil {
+				return nil, errWrongPassphrase
+			}
+			blocks = append(blocks, &pem.Block{Type: block.Type, Bytes: der})
+			continue
+		}
+
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			encrypted = true
+			if len(passphrase) == 0 {
+				return nil, errNoPemPassphrase
+			}
+			der, err := decryptPkcs8(block.Bytes, passphrase)
+			if err != nil {
+				return nil, err
+			}
+			keyBlocks, err := pkcs8IdentityBlocks(der)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, keyBlocks...)
+			continue
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	if !encrypted {
+		return data, nil
+	}
+
+	var out bytes.Buffer
+	for _, block := range blocks {
+		if err := pem.Encode(&out, block); err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// Decrypts an encrypted PKCS#8 key, returning the DER-encoded PKCS#8 key.
+func decryptPkcs8(der []byte, passphrase string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("invalid encrypted private key: %w", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPbes2) {
+		return nil, errUnsupportedPkcs8
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("invalid encryption parameters: %w", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPbkdf2) {
+		return nil, errUnsupportedPkcs8
+	}
+
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("invalid key derivation parameters: %w", err)
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case kdf.Prf.Algorithm == nil || kdf.Prf.Algorithm.Equal(oidHmacWithSha1):
+		prf = sha1.New
+	case kdf.Prf.Algorithm.Equal(oidHmacWithSha224):
+		prf = sha256.New224
+	case kdf.Prf.Algorithm.Equal(oidHmacWithSha256):
+		prf = sha256.New
+	case kdf.Prf.Algorithm.Equal(oidHmacWithSha384):
+		prf = sha512.New384
+	case kdf.Prf.Algorithm.Equal(oidHmacWithSha512):
+		prf = sha512.New
+	default:
+		return nil, errUnsupportedPkcs8
+	}
+
+	var keyLength int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAes128Cbc):
+		keyLength = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAes192Cbc):
+		keyLength = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAes256Cbc):
+		keyLength = 32
+	default:
+		return nil, errUnsupportedPkcs8
+	}
+	if kdf.KeyLength != 0 && kdf.KeyLength != keyLength {
+		return nil, fmt.Errorf("invalid key derivation parameters: key length %d, expected %d", kdf.KeyLength, keyLength)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("invalid encryption parameters: %w", err)
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(passphrase), kdf.Salt, kdf.IterationCount, keyLength, prf))
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, errWrongPassphrase
+	}
+
+	data := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, info.EncryptedData)
+
+	// PKCS#7 padding, which is garbage when the passphrase is wrong
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, errWrongPassphrase
+	}
+	for _, b := range data[len(data)-padding:] {
+		if int(b) != padding {
+			return nil, errWrongPassphrase
+		}
+	}
+
+	return data[:len(data)-padding], nil
+}
+
+// Returns the PEM blocks of a PKCS#8 key as NewIdentityFromPEM reads them: Ed25519 keys
+// stay PKCS#8, while EC keys are converted to SEC 1 (preceded by their parameters for
+// secp256k1, like the keys generated by dfx).
+func pkcs8IdentityBlocks(der []byte) ([]*pem.Block, error) {
+	var key pkcs8PrivateKey
+	if _, err := asn1.Unmarshal(der, &key); err != nil {
+		return nil, errWrongPassphrase
+	}
+	if !key.Algorithm.Algorithm.Equal(oidEcPublicKey) {
+		return []*pem.Block{{Type: "PRIVATE KEY", Bytes: der}}, nil
+	}
+
+	var curve asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(key.Algorithm.Parameters.FullBytes, &curve); err != nil {
+		return nil, fmt.Errorf("invalid EC key parameters: %w", err)
+	}
+
+	// The curve is part of the PKCS#8 algorithm, and usually omitted from the SEC 1 key
+	var ecKey sec1PrivateKey
+	if _, err := asn1.Unmarshal(key.PrivateKey, &ecKey); err != nil {
+		return nil, fmt.Errorf("invalid EC key: %w", err)
+	}
+	ecKey.NamedCurveOID = curve
+	ecDer, err := asn1.Marshal(ecKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if !curve.Equal(oidSecp256k1) {
+		return []*pem.Block{{Type: "EC PRIVATE KEY", Bytes: ecDer}}, nil
+	}
+
+	curveDer, err := asn1.Marshal(curve)
+	if err != nil {
+		return nil, err
+	}
+	return []*pem.Block{{Type: "EC PARAMETERS", Bytes: curveDer}, {Type: "EC PRIVATE KEY", Bytes: ecDer}}, nil
+}
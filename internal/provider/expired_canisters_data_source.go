@@ -0,0 +1,147 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &ExpiredCanistersDataSource{}
+
+func NewExpiredCanistersDataSource() datasource.DataSource {
+	return &ExpiredCanistersDataSource{}
+}
+
+// ExpiredCanistersDataSource lists the canisters whose expires_at is in the past,
+// according to apply summaries.
+type ExpiredCanistersDataSource struct{}
+
+// ExpiredCanistersDataSourceModel describes the data source data model.
+type ExpiredCanistersDataSourceModel struct {
+	ApplySummaryFiles types.List   `tfsdk:"apply_summary_files"`
+	At                types.String `tfsdk:"at"`
+	CanisterIds       types.List   `tfsdk:"canister_ids"`
+}
+
+func (d *ExpiredCanistersDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_expired_canisters"
+}
+
+func (d *ExpiredCanistersDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Lists the canisters that have expired, i.e. whose `expires_at` is in the past, according to the apply summaries (see the provider's `apply_summary_file`) written by the applies that manage them. " +
+			"This can be used to sweep ephemeral environments, e.g. per-PR deployments. Missing apply summaries are ignored.",
+
+		Attributes: map[string]schema.Attribute{
+			"apply_summary_files": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Required:            true,
+				MarkdownDescription: "Paths to the apply summaries to read",
+			},
+			"at": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Time (RFC 3339) at which canisters are considered expired. Defaults to the current time.",
+				Validators: []validator.String{
+					rfc3339Validator{},
+				},
+			},
+			"canister_ids": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Identifiers of the expired canisters",
+			},
+		},
+	}
+}
+
+func (d *ExpiredCanistersDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data ExpiredCanistersDataSourceModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	at := time.Now()
+	if !data.At.IsNull() {
+		var err error
+		at, err = time.Parse(time.RFC3339, data.At.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("at"), "Client Error", "Could not parse time: "+err.Error())
+			return
+		}
+	}
+
+	var files []string
+	resp.Diagnostics.Append(data.ApplySummaryFiles.ElementsAs(ctx, &files, false)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	canisterIds := []string{}
+	for _, file := range files {
+		expired, err := readExpiredCanisters(file, at)
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("", err))
+			return
+		}
+		canisterIds = append(canisterIds, expired...)
+	}
+	sort.Strings(canisterIds)
+
+	canisterIdsValue, diags := types.ListValueFrom(ctx, types.StringType, canisterIds)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	data.CanisterIds = canisterIdsValue
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Returns the canisters of the apply summary that expired before the given time.
+func readExpiredCanisters(file string, at time.Time) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read apply summary: %w", err)
+	}
+
+	var manifest ApplySummaryManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse apply summary %s: %w", file, err)
+	}
+
+	expired := []string{}
+	for id, canister := range manifest.Canisters {
+		if len(canister.ExpiresAt) == 0 {
+			continue
+		}
+
+		expiresAt, err := time.Parse(time.RFC3339, canister.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("Could not parse expiry of canister %s in %s: %w", id, file, err)
+		}
+
+		if !expiresAt.After(at) {
+			expired = append(expired, id)
+		}
+	}
+
+	return expired, nil
+}
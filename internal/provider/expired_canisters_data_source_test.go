@@ -0,0 +1,50 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+)
+
+func TestExpiredCanistersDataSource(t *testing.T) {
+
+	dir := t.TempDir()
+	summary := path.Join(dir, "summary.json")
+
+	err := os.WriteFile(summary, []byte(`{
+  "network": "http://localhost:4943",
+  "identity": "2vxsx-fae",
+  "updated_at": "2024-01-01T00:00:00Z",
+  "canisters": {
+    "ryjl3-tyaaa-aaaaa-aaaba-cai": { "id": "ryjl3-tyaaa-aaaaa-aaaba-cai", "expires_at": "2024-01-02T00:00:00Z" },
+    "r7inp-6aaaa-aaaaa-aaabq-cai": { "id": "r7inp-6aaaa-aaaaa-aaabq-cai", "expires_at": "2024-02-01T00:00:00Z" },
+    "rrkah-fqaaa-aaaaa-aaaaq-cai": { "id": "rrkah-fqaaa-aaaaa-aaaaq-cai" }
+  }
+}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+data "ic_expired_canisters" "expired" {
+    apply_summary_files = [ "%s", "%s" ]
+    at = "2024-01-15T00:00:00Z"
+}
+`, summary, path.Join(dir, "missing.json")),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("data.ic_expired_canisters.expired", "canister_ids.#", "1"),
+					resource.TestCheckResourceAttr("data.ic_expired_canisters.expired", "canister_ids.0", "ryjl3-tyaaa-aaaaa-aaaba-cai"),
+				),
+			},
+		},
+	})
+}
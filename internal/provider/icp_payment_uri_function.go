@@ -0,0 +1,85 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-framework/function"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+const icpPaymentUriSummary = "Render an ICP payment URI"
+
+const icpPaymentUriDescription = "The `icp_payment_uri` function renders a payment URI for an ICP account identifier, e.g. `icp:<account_id>?amount=1.5`, which wallets can open and which can be encoded as is in a QR code. " +
+	"This makes the funding steps of runbooks generated from Terraform outputs (e.g. topping up the account funding canister creations) directly actionable.\n\n" +
+	"The amount is given in e8s (1 ICP = 100000000 e8s) and rendered in ICP; if it is `null`, the URI only contains the account identifier. " +
+	"An error is raised if the account identifier is invalid (see `account_id_validate`)."
+
+// Ensure the implementation satisfies the desired interfaces.
+var _ function.Function = &IcpPaymentUriFunction{}
+
+type IcpPaymentUriFunction struct{}
+
+func (f *IcpPaymentUriFunction) Metadata(ctx context.Context, req function.MetadataRequest, resp *function.MetadataResponse) {
+	resp.Name = "icp_payment_uri"
+}
+
+func (f *IcpPaymentUriFunction) Definition(ctx context.Context, req function.DefinitionRequest, resp *function.DefinitionResponse) {
+
+	resp.Definition = function.Definition{
+		Summary:             icpPaymentUriSummary,
+		Description:         icpPaymentUriDescription,
+		MarkdownDescription: icpPaymentUriDescription,
+
+		Parameters: []function.Parameter{
+			function.StringParameter{
+				Name:        "account_id",
+				Description: "The hex-encoded account identifier to pay",
+			},
+			function.Int64Parameter{
+				Name:           "amount_e8s",
+				Description:    "The amount to pay in e8s, or null",
+				AllowNullValue: true,
+			},
+		},
+		Return: function.StringReturn{},
+	}
+}
+
+// Renders an amount of e8s in ICP, without trailing zeros (e.g. 150000000 -> "1.5").
+func formatPaymentAmount(e8s uint64) string {
+	return strings.TrimSuffix(strings.TrimRight(formatE8s(e8s), "0"), ".")
+}
+
+func (f *IcpPaymentUriFunction) Run(ctx context.Context, req function.RunRequest, resp *function.RunResponse) {
+	var input string
+	var amountE8s types.Int64
+
+	// Read Terraform argument data into the variables
+	resp.Error = function.ConcatFuncErrors(resp.Error, req.Arguments.Get(ctx, &input, &amountE8s))
+	if resp.Error != nil {
+		return
+	}
+
+	accountId, err := principal.DecodeAccountID(strings.ToLower(input))
+	if err != nil {
+		resp.Error = function.NewArgumentFuncError(0, fmt.Sprintf("Invalid account identifier %q: %s", input, err.Error()))
+		return
+	}
+
+	uri := "icp:" + accountId.Encode()
+
+	if !amountE8s.IsNull() {
+		if amountE8s.ValueInt64() < 0 {
+			resp.Error = function.NewArgumentFuncError(1, fmt.Sprintf("Expected a non-negative amount, got %d", amountE8s.ValueInt64()))
+			return
+		}
+		uri += "?amount=" + formatPaymentAmount(uint64(amountE8s.ValueInt64()))
+	}
+
+	resp.Error = function.ConcatFuncErrors(resp.Error, resp.Result.Set(ctx, uri))
+}
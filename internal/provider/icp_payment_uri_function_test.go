@@ -0,0 +1,53 @@
+package provider
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/knownvalue"
+	"github.com/hashicorp/terraform-plugin-testing/statecheck"
+	"github.com/hashicorp/terraform-plugin-testing/tfversion"
+)
+
+func TestIcpPaymentUriFunction(t *testing.T) {
+	t.Parallel()
+
+	accountId := principal.NewAccountID(principal.MustDecode("aaaaa-aa"), principal.DefaultSubAccount).Encode()
+
+	resource.UnitTest(t, resource.TestCase{
+		TerraformVersionChecks: []tfversion.TerraformVersionCheck{
+			// Provider functions are only supports in 1.8.0+
+			tfversion.SkipBelow(tfversion.Version1_8_0),
+		},
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::icp_payment_uri("` + accountId + `", 150000000)
+                }`,
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownOutputValue("test", knownvalue.StringExact("icp:"+accountId+"?amount=1.5")),
+				},
+			},
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::icp_payment_uri("` + accountId + `", null)
+                }`,
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownOutputValue("test", knownvalue.StringExact("icp:"+accountId)),
+				},
+			},
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::icp_payment_uri("abcd", 1)
+                }`,
+				ExpectError: regexp.MustCompile("invalid length"),
+			},
+		},
+	})
+}
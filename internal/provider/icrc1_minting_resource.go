@@ -0,0 +1,292 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/numberplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic/icrc1"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &Icrc1MintingResource{}
+
+func NewIcrc1MintingResource() resource.Resource {
+	return &Icrc1MintingResource{}
+}
+
+// Icrc1MintingResource mints ICRC-1 tokens, i.e. transfers tokens from the ledger's
+// minting account (which must be the provider's identity) to an account.
+type Icrc1MintingResource struct {
+	config *agent.Config
+
+	readOnly readOnlyMode // read_only is set, or mainnet is not allowed
+}
+
+// Icrc1MintingResourceModel describes the resource data model.
+type Icrc1MintingResourceModel struct {
+	Id           types.String `tfsdk:"id"`
+	LedgerId     types.String `tfsdk:"ledger_id"`
+	ToOwner      types.String `tfsdk:"to_owner"`
+	ToSubaccount types.String `tfsdk:"to_subaccount"` // hex encoded
+	Amount       types.Number `tfsdk:"amount"`
+	Memo         types.String `tfsdk:"memo"` // hex encoded
+	BlockIndex   types.String `tfsdk:"block_index"`
+}
+
+func (r *Icrc1MintingResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_icrc1_minting"
+}
+
+func (r *Icrc1MintingResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Mints ICRC-1 tokens to an account. The provider's identity must be the ledger's minting account, which is typically only the case for ledgers deployed locally for testing. " +
+			"Minting cannot be undone: destroying the resource only removes it from the state, and changing any attribute mints new tokens.",
+
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Identifier of the mint (`<ledger_id>:<block_index>`)",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"ledger_id": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Canister identifier of the ICRC-1 ledger",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"to_owner": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Principal owning the account the tokens are minted to",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"to_subaccount": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Subaccount (hex encoded, 32 bytes) of the account the tokens are minted to. Defaults to the default subaccount.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"amount": schema.NumberAttribute{
+				Required:            true,
+				MarkdownDescription: "Amount of tokens to mint, in the ledger's smallest unit (e.g. e8s)",
+				PlanModifiers: []planmodifier.Number{
+					numberplanmodifier.RequiresReplace(),
+				},
+			},
+			"memo": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Memo (hex encoded) attached to the mint transaction",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"block_index": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Ledger block index of the mint transaction",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+		},
+	}
+}
+
+func (r *Icrc1MintingResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	r.config = providerData.Config
+	r.readOnly = providerData.ReadOnly
+}
+
+// Builds the icrc1_transfer arguments for the mint.
+func (data *Icrc1MintingResourceModel) TransferArgs() (icrc1.TransferArgs, error) {
+	owner, err := principal.Decode(data.ToOwner.ValueString())
+	if err != nil {
+		return icrc1.TransferArgs{}, fmt.Errorf("Could not decode to_owner: %w", err)
+	}
+
+	to := icrc1.Account{Owner: owner}
+
+	if !data.ToSubaccount.IsNull() {
+		subaccount, err := hex.DecodeString(data.ToSubaccount.ValueString())
+		if err != nil {
+			return icrc1.TransferArgs{}, fmt.Errorf("Could not decode to_subaccount: %w", err)
+		}
+
+		if len(subaccount) != 32 {
+			return icrc1.TransferArgs{}, fmt.Errorf("Expected to_subaccount to be 32 bytes, got %d", len(subaccount))
+		}
+
+		to.Subaccount = &subaccount
+	}
+
+	amount, accuracy := data.Amount.ValueBigFloat().Int(nil)
+	if accuracy != big.Exact || amount.Sign() < 0 {
+		return icrc1.TransferArgs{}, fmt.Errorf("Expected amount to be a non-negative integer, got %s", data.Amount.String())
+	}
+
+	transferArgs := icrc1.TransferArgs{
+		To:     to,
+		Amount: idl.NewBigNat(amount),
+	}
+
+	if !data.Memo.IsNull() {
+		memo, err := hex.DecodeString(data.Memo.ValueString())
+		if err != nil {
+			return icrc1.TransferArgs{}, fmt.Errorf("Could not decode memo: %w", err)
+		}
+		transferArgs.Memo = &memo
+	}
+
+	return transferArgs, nil
+}
+
+func (r *Icrc1MintingResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data Icrc1MintingResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.readOnly != readWrite {
+		resp.Diagnostics.Append(r.readOnly.diagnostic("mint tokens"))
+		return
+	}
+
+	ledgerId, err := principal.Decode(data.LedgerId.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(path.Root("ledger_id"), "Client Error", "Could not decode ledger id: "+err.Error())
+		return
+	}
+
+	transferArgs, err := data.TransferArgs()
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("", err))
+		return
+	}
+
+	a, err := newAgent(*r.config)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not create ledger agent", err))
+		return
+	}
+	ledgerAgent := &icrc1.Agent{Agent: a, CanisterId: ledgerId}
+
+	// Only the minting account can mint, so check that upfront for a helpful error message
+	mintingAccount, err := ledgerAgent.Icrc1MintingAccount()
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not read minting account", err))
+		return
+	}
+
+	sender := r.config.Identity.Sender()
+	if mintingAccount == nil || *mintingAccount == nil || !(*mintingAccount).Owner.Equal(sender) {
+		resp.Diagnostics.AddError("Client Error", fmt.Sprintf("The provider principal %s is not the minting account of ledger %s", sender.Encode(), ledgerId.Encode()))
+		return
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("Minting %s tokens on ledger %s", transferArgs.Amount.String(), ledgerId.Encode()))
+
+	// Tracked, so that a mint that timed out is not made again when retried
+	var res struct {
+		Ok  *idl.Nat             `ic:"Ok,variant"`
+		Err *icrc1.TransferError `ic:"Err,variant"`
+	}
+	err = callAndWait(*r.config, ledgerId, "icrc1_transfer", transferArgs, &res)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not mint tokens", err))
+		return
+	}
+
+	if res.Ok == nil {
+		str, _ := json.Marshal(res.Err)
+		resp.Diagnostics.AddError("Client Error", fmt.Sprintf("Error when minting tokens: %s", string(str)))
+		return
+	}
+
+	data.BlockIndex = types.StringValue(res.Ok.String())
+	data.Id = types.StringValue(ledgerId.Encode() + ":" + res.Ok.String())
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *Icrc1MintingResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data Icrc1MintingResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Save updated data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// All attributes require replacement, so this only stores the planned data.
+func (r *Icrc1MintingResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data Icrc1MintingResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Minted tokens cannot be "unminted", so this only removes the resource from the state.
+func (r *Icrc1MintingResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	var data Icrc1MintingResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	tflog.Info(ctx, "Forgetting about mint "+data.Id.ValueString()+" (minted tokens are not burned)")
+}
@@ -0,0 +1,193 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/json"
+	"math/big"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic/icrc1"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+)
+
+// Replays the mint of tokens by the (anonymous) provider identity, and the errors when it
+// isn't the minting account or the ledger rejects the transfer.
+func TestIcrc1MintingResource(t *testing.T) {
+
+	const ledgerId = "mxzaz-hqaaa-aaaar-qaada-cai"
+
+	mintingAccount := func(owner principal.Principal) []byte {
+		account := &icrc1.Account{Owner: owner}
+		reply, err := idl.Marshal([]any{account})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	var minted, duplicate struct {
+		Ok  *idl.Nat             `ic:"Ok,variant"`
+		Err *icrc1.TransferError `ic:"Err,variant"`
+	}
+	block := idl.NewNat(uint(7))
+	minted.Ok = &block
+	duplicate.Err = &icrc1.TransferError{Duplicate: &struct {
+		DuplicateOf idl.Nat `ic:"duplicate_of" json:"duplicate_of"`
+	}{DuplicateOf: idl.NewNat(uint(6))}}
+	transferReply := func(result any) []byte {
+		reply, err := idl.Marshal([]any{result})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	// Returns the fixture in which the ledger has the minting account owned by owner, and
+	// replies to the transfer with reply
+	fixture := func(name string, owner principal.Principal, reply []byte) string {
+		data, err := json.Marshal(agentFixture{Interactions: []agentInteraction{
+			{Type: "query", CanisterId: ledgerId, Method: "icrc1_minting_account", Reply: mintingAccount(owner)},
+			{Type: "call", CanisterId: ledgerId, Method: "icrc1_transfer", Reply: reply},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := path.Join(t.TempDir(), name+".json")
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	config := `
+provider "ic" {
+    allow_mainnet = true
+    poll_interval = "10ms"
+}
+
+resource "ic_icrc1_minting" "test" {
+    ledger_id = "` + ledgerId + `"
+    to_owner  = "rrkah-fqaaa-aaaaa-aaaaq-cai"
+    amount    = 100000000
+    memo      = "0102"
+}
+`
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testFixtureProviderFactories(t, fixture("minted", principal.AnonymousID, transferReply(minted)), ""),
+		Steps: []resource.TestStep{
+			{
+				Config: config,
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("ic_icrc1_minting.test", "block_index", "7"),
+					resource.TestCheckResourceAttr("ic_icrc1_minting.test", "id", ledgerId+":7"),
+				),
+			},
+		},
+	})
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testFixtureProviderFactories(t, fixture("not_minting_account", principal.MustDecode("aaaaa-aa"), transferReply(minted)), ""),
+		Steps: []resource.TestStep{
+			{
+				Config:      config,
+				ExpectError: regexp.MustCompile(`is not the minting account`),
+			},
+		},
+	})
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testFixtureProviderFactories(t, fixture("duplicate", principal.AnonymousID, transferReply(duplicate)), ""),
+		Steps: []resource.TestStep{
+			{
+				Config:      config,
+				ExpectError: regexp.MustCompile(`Duplicate`),
+			},
+		},
+	})
+}
+
+func TestIcrc1MintingTransferArgs(t *testing.T) {
+	owner := "rrkah-fqaaa-aaaaa-aaaaq-cai"
+	subaccount := strings.Repeat("01", 32)
+
+	tests := []struct {
+		name string
+		data Icrc1MintingResourceModel
+		err  string
+	}{
+		{
+			name: "default subaccount",
+			data: Icrc1MintingResourceModel{ToOwner: types.StringValue(owner), ToSubaccount: types.StringNull(), Amount: types.NumberValue(big.NewFloat(1e8)), Memo: types.StringNull()},
+		},
+		{
+			name: "subaccount and memo",
+			data: Icrc1MintingResourceModel{ToOwner: types.StringValue(owner), ToSubaccount: types.StringValue(subaccount), Amount: types.NumberValue(big.NewFloat(0)), Memo: types.StringValue("cafe")},
+		},
+		{
+			name: "invalid owner",
+			data: Icrc1MintingResourceModel{ToOwner: types.StringValue("not a principal"), ToSubaccount: types.StringNull(), Amount: types.NumberValue(big.NewFloat(1)), Memo: types.StringNull()},
+			err:  "Could not decode to_owner",
+		},
+		{
+			name: "short subaccount",
+			data: Icrc1MintingResourceModel{ToOwner: types.StringValue(owner), ToSubaccount: types.StringValue("01"), Amount: types.NumberValue(big.NewFloat(1)), Memo: types.StringNull()},
+			err:  "Expected to_subaccount to be 32 bytes",
+		},
+		{
+			name: "fractional amount",
+			data: Icrc1MintingResourceModel{ToOwner: types.StringValue(owner), ToSubaccount: types.StringNull(), Amount: types.NumberValue(big.NewFloat(1.5)), Memo: types.StringNull()},
+			err:  "non-negative integer",
+		},
+		{
+			name: "negative amount",
+			data: Icrc1MintingResourceModel{ToOwner: types.StringValue(owner), ToSubaccount: types.StringNull(), Amount: types.NumberValue(big.NewFloat(-1)), Memo: types.StringNull()},
+			err:  "non-negative integer",
+		},
+		{
+			name: "invalid memo",
+			data: Icrc1MintingResourceModel{ToOwner: types.StringValue(owner), ToSubaccount: types.StringNull(), Amount: types.NumberValue(big.NewFloat(1)), Memo: types.StringValue("xyz")},
+			err:  "Could not decode memo",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args, err := test.data.TransferArgs()
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !args.To.Owner.Equal(principal.MustDecode(owner)) {
+				t.Errorf("expected owner %s, got %s", owner, args.To.Owner)
+			}
+			if test.data.ToSubaccount.IsNull() != (args.To.Subaccount == nil) {
+				t.Errorf("expected subaccount %s, got %v", test.data.ToSubaccount, args.To.Subaccount)
+			}
+			if test.data.Memo.IsNull() != (args.Memo == nil) {
+				t.Errorf("expected memo %s, got %v", test.data.Memo, args.Memo)
+			}
+			amount, _ := test.data.Amount.ValueBigFloat().Int(nil)
+			if args.Amount.BigInt().Cmp(amount) != 0 {
+				t.Errorf("expected amount %s, got %s", amount, args.Amount)
+			}
+			// Fees are not charged for mints
+			if args.Fee != nil {
+				t.Errorf("expected no fee, got %s", args.Fee)
+			}
+		})
+	}
+}
@@ -3,14 +3,29 @@
 package provider
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"math/big"
+	"os"
 
 	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
 )
 
-// NewIdentityFromPEM reads a PEM file and tries to create an Identity from it.
+// NewIdentityFromPEM reads a PEM file and tries to create an Identity from it. Encrypted
+// keys are decrypted with the passphrase from the IC_PEM_PASSPHRASE environment variable.
 func NewIdentityFromPEM(data []byte) (identity.Identity, error) {
 
+	data, err := decryptIdentityPem(data, os.Getenv("IC_PEM_PASSPHRASE"))
+	if err != nil {
+		return nil, err
+	}
+
 	var errs []error
 
 	ed25519Identity, err := identity.NewEd25519IdentityFromPEM(data)
@@ -33,3 +48,99 @@ func NewIdentityFromPEM(data []byte) (identity.Identity, error) {
 
 	return nil, errors.Join(errs...)
 }
+
+// Signer signs messages with a key that is not held by the provider, e.g. a key in an HSM.
+type Signer interface {
+	// PublicKey returns the DER-encoded public key of the signing key.
+	PublicKey() ([]byte, error)
+	// Sign signs the message in the format expected by the IC for the key's algorithm,
+	// e.g. r || s of the sha256 of the message for ECDSA.
+	Sign(msg []byte) ([]byte, error)
+}
+
+// SignerIdentity is an identity backed by a Signer.
+type SignerIdentity struct {
+	signer    Signer
+	publicKey []byte
+
+	// The context signing failures are logged with (agent-go doesn't pass contexts to the
+	// identity)
+	ctx context.Context
+}
+
+// The message signed when the identity is created. It doesn't start with the domain
+// separator of requests, so its signature doesn't authorize anything.
+var signerProbeMessage = []byte("terraform-provider-ic signer probe")
+
+// NewSignerIdentity creates an identity backed by the signer. The public key is read once,
+// and a probe message is signed (and, for ECDSA keys, verified), so that a signer that can't
+// sign (e.g. missing permissions, or a locked token) fails the configuration of the
+// provider rather than its requests.
+func NewSignerIdentity(ctx context.Context, signer Signer) (*SignerIdentity, error) {
+	publicKey, err := signer.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("Could not read public key: %w", err)
+	}
+
+	id := &SignerIdentity{signer: signer, publicKey: publicKey, ctx: context.WithoutCancel(ctx)}
+
+	sig, err := signer.Sign(signerProbeMessage)
+	if err != nil {
+		return nil, fmt.Errorf("Could not sign with the key: %w", err)
+	}
+	if len(sig) == 0 {
+		return nil, errors.New("Could not sign with the key: the signature is empty")
+	}
+	if _, ok := id.ecdsaPublicKey(); ok && !id.Verify(signerProbeMessage, sig) {
+		return nil, errors.New("The signature of the key does not match its public key")
+	}
+
+	return id, nil
+}
+
+func (id SignerIdentity) Sender() principal.Principal {
+	return principal.NewSelfAuthenticating(id.publicKey)
+}
+
+// Sign signs the message with the signer. The identity interface doesn't allow returning
+// errors, so failures are logged and result in an empty signature, which the IC rejects
+// (signing was checked when the identity was created, see NewSignerIdentity).
+func (id SignerIdentity) Sign(msg []byte) []byte {
+	sig, err := id.signer.Sign(msg)
+	if err != nil {
+		tflog.Error(id.ctx, fmt.Sprintf("Could not sign message: %s", err.Error()))
+		return nil
+	}
+	return sig
+}
+
+func (id SignerIdentity) PublicKey() []byte {
+	return id.publicKey
+}
+
+// Returns the public key of the identity, if it is an ECDSA key the standard library
+// supports (e.g. prime256v1, but not secp256k1).
+func (id SignerIdentity) ecdsaPublicKey() (*ecdsa.PublicKey, bool) {
+	publicKey, err := x509.ParsePKIXPublicKey(id.publicKey)
+	if err != nil {
+		return nil, false
+	}
+	ecdsaKey, ok := publicKey.(*ecdsa.PublicKey)
+	return ecdsaKey, ok
+}
+
+// Verify verifies ECDSA (r || s over the sha256 of the message) signatures. Signatures of
+// other key types are not verified.
+func (id SignerIdentity) Verify(msg, sig []byte) bool {
+	ecdsaKey, ok := id.ecdsaPublicKey()
+	if !ok || len(sig) != 64 {
+		return false
+	}
+
+	hash := sha256.Sum256(msg)
+	return ecdsa.Verify(ecdsaKey, hash[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+}
+
+func (id SignerIdentity) ToPEM() ([]byte, error) {
+	return nil, errors.New("the private key of the identity is not available")
+}
@@ -0,0 +1,83 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testSigner signs with a prime256v1 key held in memory.
+type testSigner struct {
+	key       *ecdsa.PrivateKey
+	publicKey *ecdsa.PublicKey // the public key returned, if not the key's
+	err       error
+}
+
+func (s testSigner) PublicKey() ([]byte, error) {
+	publicKey := &s.key.PublicKey
+	if s.publicKey != nil {
+		publicKey = s.publicKey
+	}
+	return x509.MarshalPKIXPublicKey(publicKey)
+}
+
+func (s testSigner) Sign(msg []byte) ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	hash := sha256.Sum256(msg)
+	r, sigS, err := ecdsa.Sign(rand.Reader, s.key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	sigS.FillBytes(sig[32:])
+	return sig, nil
+}
+
+// Checks that identities whose signer can't sign are rejected when they are created.
+func TestNewSignerIdentity(t *testing.T) {
+	newKey := func() *ecdsa.PrivateKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	tests := []struct {
+		name   string
+		signer testSigner
+		err    string
+	}{
+		{name: "valid", signer: testSigner{key: newKey()}},
+		{name: "failing", signer: testSigner{key: newKey(), err: errors.New("token locked")}, err: "token locked"},
+		{name: "other key", signer: testSigner{key: newKey(), publicKey: &newKey().PublicKey}, err: "does not match"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id, err := NewSignerIdentity(context.Background(), test.signer)
+			if len(test.err) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if msg := []byte("message"); !id.Verify(msg, id.Sign(msg)) {
+					t.Error("the signature of the identity is not valid")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	oidPrime256v1 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidSecp256k1  = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+)
+
+// The order of the secp256k1 curve (which the standard library doesn't implement).
+var secp256k1N, _ = new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+
+// Returns the order of the curve of a DER-encoded (SubjectPublicKeyInfo) ECDSA public key,
+// which must be a prime256v1 or secp256k1 key.
+func ecdsaCurveOrder(publicKey []byte) (*big.Int, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	rest, err := asn1.Unmarshal(publicKey, &spki)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	var curve asn1.ObjectIdentifier
+	_, err = asn1.Unmarshal(spki.Algorithm.Parameters.FullBytes, &curve)
+	if err != nil {
+		return nil, fmt.Errorf("not an ECDSA public key")
+	}
+
+	switch {
+	case curve.Equal(oidPrime256v1):
+		return elliptic.P256().Params().N, nil
+	case curve.Equal(oidSecp256k1):
+		return secp256k1N, nil
+	default:
+		return nil, fmt.Errorf("unsupported curve %s, expected a prime256v1 or secp256k1 key", curve.String())
+	}
+}
+
+// Converts a DER-encoded ECDSA signature to r || s, as expected by the IC, with s normalized
+// to the lower half of the curve order n (both forms are valid, the low one is canonical).
+func ecdsaSignatureFromDER(der []byte, n *big.Int) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(der, &sig)
+	if err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("invalid ECDSA signature")
+	}
+	if sig.R.Sign() <= 0 || sig.R.Cmp(n) >= 0 || sig.S.Sign() <= 0 || sig.S.Cmp(n) >= 0 {
+		return nil, fmt.Errorf("invalid ECDSA signature: r and s must be in [1, n-1]")
+	}
+
+	if sig.S.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		sig.S.Sub(n, sig.S)
+	}
+
+	raw := make([]byte, 64)
+	sig.R.FillBytes(raw[:32])
+	sig.S.FillBytes(raw[32:])
+	return raw, nil
+}
+
+// Runs a cloud provider's CLI, returning its output.
+//
+// The CLIs have no long-running mode, so each signature starts a process (which loads the
+// CLI's credentials and calls the KMS). Every request is signed, including the read_state
+// requests polling the status of calls, so a run signs at least twice per call.
+func runKmsCommand(name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+// AwsKmsSigner signs messages with an asymmetric ECC_NIST_P256 or ECC_SECG_P256K1 key of
+// AWS KMS, so that the key never leaves the KMS and every signature is audited.
+//
+// The KMS is accessed through the AWS CLI, which must be installed, so that the provider
+// uses the CLI's credentials (e.g. the instance role of a CI runner).
+type AwsKmsSigner struct {
+	KeyId  string // key id, ARN or alias
+	Region string // empty for the CLI's default region
+
+	publicKey []byte
+}
+
+func (s *AwsKmsSigner) run(args ...string) ([]byte, error) {
+	args = append(args, "--key-id", s.KeyId, "--output", "json")
+	if len(s.Region) > 0 {
+		args = append(args, "--region", s.Region)
+	}
+	return runKmsCommand("aws", append([]string{"kms"}, args...)...)
+}
+
+func (s *AwsKmsSigner) PublicKey() ([]byte, error) {
+	out, err := s.run("get-public-key")
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		PublicKey []byte `json:"PublicKey"` // base64-encoded
+	}
+	err = json.Unmarshal(out, &res)
+	if err != nil {
+		return nil, fmt.Errorf("could not read public key of %s: %w", s.KeyId, err)
+	}
+
+	_, err = ecdsaCurveOrder(res.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", s.KeyId, err)
+	}
+
+	s.publicKey = res.PublicKey
+	return res.PublicKey, nil
+}
+
+// Signs the sha256 of the message with ECDSA_SHA_256.
+func (s *AwsKmsSigner) Sign(msg []byte) ([]byte, error) {
+	n, err := ecdsaCurveOrder(s.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "terraform-provider-ic-kms-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "hash")
+	hash := sha256.Sum256(msg)
+	err = os.WriteFile(input, hash[:], 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := s.run("sign", "--message", "fileb://"+input, "--message-type", "DIGEST", "--signing-algorithm", "ECDSA_SHA_256")
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Signature string `json:"Signature"` // base64-encoded DER
+	}
+	err = json.Unmarshal(out, &res)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signature: %w", err)
+	}
+
+	der, err := base64.StdEncoding.DecodeString(res.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signature: %w", err)
+	}
+
+	return ecdsaSignatureFromDER(der, n)
+}
+
+// GcpKmsSigner signs messages with an EC_SIGN_P256_SHA256 or EC_SIGN_SECP256K1_SHA256 key
+// version of Google Cloud KMS, so that the key never leaves the KMS (or its HSMs) and every
+// signature is audited.
+//
+// The KMS is accessed through the gcloud CLI, which must be installed, so that the provider
+// uses the CLI's credentials (e.g. the service account of a CI runner).
+type GcpKmsSigner struct {
+	// projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>/cryptoKeyVersions/<version>
+	KeyVersion string
+
+	publicKey []byte
+}
+
+// Returns the key and the version of the key version's resource name.
+func (s *GcpKmsSigner) keyAndVersion() (string, string, error) {
+	key, version, ok := strings.Cut(s.KeyVersion, "/cryptoKeyVersions/")
+	if !ok || !strings.HasPrefix(key, "projects/") || len(version) == 0 {
+		return "", "", fmt.Errorf("expected a key version like projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>/cryptoKeyVersions/<version>, got %s", s.KeyVersion)
+	}
+	return key, version, nil
+}
+
+func (s *GcpKmsSigner) PublicKey() ([]byte, error) {
+	key, version, err := s.keyAndVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := runKmsCommand("gcloud", "kms", "keys", "versions", "get-public-key", version, "--key", key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(out)
+	if block == nil {
+		return nil, fmt.Errorf("could not read public key of %s", s.KeyVersion)
+	}
+
+	_, err = ecdsaCurveOrder(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", s.KeyVersion, err)
+	}
+
+	s.publicKey = block.Bytes
+	return block.Bytes, nil
+}
+
+// Signs the message; gcloud computes its sha256.
+func (s *GcpKmsSigner) Sign(msg []byte) ([]byte, error) {
+	n, err := ecdsaCurveOrder(s.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key, version, err := s.keyAndVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "terraform-provider-ic-kms-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "message")
+	output := filepath.Join(dir, "signature")
+
+	err = os.WriteFile(input, msg, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = runKmsCommand("gcloud", "kms", "asymmetric-sign", "--version", version, "--key", key,
+		"--digest-algorithm", "sha256", "--input-file", input, "--signature-file", output)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := os.ReadFile(output)
+	if err != nil {
+		return nil, err
+	}
+
+	return ecdsaSignatureFromDER(der, n)
+}
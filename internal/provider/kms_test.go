@@ -0,0 +1,144 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+)
+
+func TestEcdsaCurveOrder(t *testing.T) {
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := x509.MarshalPKIXPublicKey(&p256Key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The standard library doesn't implement secp256k1, so its key is encoded by hand
+	curve, _ := asn1.Marshal(oidSecp256k1)
+	secp256k1, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1},
+			Parameters: asn1.RawValue{FullBytes: curve},
+		},
+		PublicKey: asn1.BitString{Bytes: append([]byte{4}, make([]byte, 64)...), BitLength: 65 * 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ed25519Public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed25519Key, err := x509.MarshalPKIXPublicKey(ed25519Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		publicKey []byte
+		n         *big.Int // nil if invalid
+	}{
+		{name: "prime256v1", publicKey: p256, n: elliptic.P256().Params().N},
+		{name: "secp256k1", publicKey: secp256k1, n: secp256k1N},
+		{name: "ed25519", publicKey: ed25519Key},
+		{name: "trailing data", publicKey: append(bytes.Clone(p256), 0)},
+		{name: "truncated", publicKey: p256[:len(p256)-1]},
+		{name: "empty"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n, err := ecdsaCurveOrder(test.publicKey)
+			if test.n == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n.Cmp(test.n) != 0 {
+				t.Fatalf("expected %s, got %s", test.n, n)
+			}
+		})
+	}
+}
+
+func TestEcdsaSignatureFromDER(t *testing.T) {
+	n := secp256k1N
+	halfN := new(big.Int).Rsh(n, 1)
+
+	der := func(r, s *big.Int) []byte {
+		data, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	raw := func(r, s *big.Int) []byte {
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	}
+
+	// r with its high bit set, which DER pads with a leading zero byte
+	highR := new(big.Int).Sub(n, big.NewInt(2))
+	smallR := big.NewInt(0x1234)
+	lowS := big.NewInt(42)
+	highS := new(big.Int).Sub(n, lowS)
+
+	tests := []struct {
+		name string
+		der  []byte
+		sig  []byte // nil if invalid
+	}{
+		{name: "low s", der: der(smallR, lowS), sig: raw(smallR, lowS)},
+		{name: "half n", der: der(smallR, halfN), sig: raw(smallR, halfN)},
+		{name: "high s", der: der(smallR, highS), sig: raw(smallR, lowS)},
+		{name: "half n plus one", der: der(smallR, new(big.Int).Add(halfN, big.NewInt(1))), sig: raw(smallR, halfN)},
+		{name: "padded r", der: der(highR, lowS), sig: raw(highR, lowS)},
+		{name: "zero r", der: der(big.NewInt(0), lowS)},
+		{name: "negative s", der: der(smallR, big.NewInt(-1))},
+		{name: "r not below n", der: der(n, lowS)},
+		{name: "r longer than 32 bytes", der: der(new(big.Int).Lsh(big.NewInt(1), 300), lowS)},
+		{name: "trailing data", der: append(der(smallR, lowS), 0)},
+		{name: "truncated", der: der(smallR, lowS)[:5]},
+		{name: "not a sequence", der: []byte{0x02, 0x01, 0x01}},
+		{name: "empty"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sig, err := ecdsaSignatureFromDER(test.der, n)
+			if test.sig == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %x", sig)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(sig, test.sig) {
+				t.Fatalf("expected %x, got %x", test.sig, sig)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+const (
+	// How long a lock is held at most, in case the holder crashes before releasing it
+	lockTtl = 15 * time.Minute
+
+	// How long to wait for a lock held by someone else
+	lockWaitTimeout = 5 * time.Minute
+	lockRetryDelay  = 5 * time.Second
+)
+
+// AdvisoryLock acquires locks on canisters from a lock canister, so that concurrent
+// applies don't race on the same canister. The lock canister must implement:
+//
+//	acquire : (record { key : text; holder : text; ttl_seconds : nat64 }) -> (variant { Ok; Err : text });
+//	release : (record { key : text; holder : text }) -> (variant { Ok; Err : text });
+//
+// where acquire fails if the key is held by another holder and the lock has not expired.
+type AdvisoryLock struct {
+	config     *agent.Config
+	canisterId principal.Principal
+	holder     string // unique per provider instance
+
+	// How long to wait for a lock held by someone else, and how often to try acquiring it
+	waitTimeout time.Duration
+	retryDelay  time.Duration
+}
+
+type lockAcquireArgs struct {
+	Key        string `ic:"key"`
+	Holder     string `ic:"holder"`
+	TtlSeconds uint64 `ic:"ttl_seconds"`
+}
+
+type lockReleaseArgs struct {
+	Key    string `ic:"key"`
+	Holder string `ic:"holder"`
+}
+
+type lockResult struct {
+	Ok  *idl.Null `ic:"Ok,variant"`
+	Err *string   `ic:"Err,variant"`
+}
+
+func NewAdvisoryLock(config *agent.Config, canisterId principal.Principal) (*AdvisoryLock, error) {
+	nonce := make([]byte, 8)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	holder := config.Identity.Sender().Encode() + ":" + hex.EncodeToString(nonce)
+	return &AdvisoryLock{
+		config:      config,
+		canisterId:  canisterId,
+		holder:      holder,
+		waitTimeout: lockWaitTimeout,
+		retryDelay:  lockRetryDelay,
+	}, nil
+}
+
+// Acquires the lock for the key, waiting if it is held by someone else. This is a no-op
+// if locking is disabled (nil receiver).
+func (l *AdvisoryLock) Acquire(ctx context.Context, key string) error {
+	if l == nil {
+		return nil
+	}
+
+	a, err := newAgent(*l.config)
+	if err != nil {
+		return fmt.Errorf("could not create agent: %w", err)
+	}
+
+	args := lockAcquireArgs{Key: key, Holder: l.holder, TtlSeconds: uint64(lockTtl.Seconds())}
+
+	deadline := time.Now().Add(l.waitTimeout)
+	for {
+		var res lockResult
+		err = a.Call(l.canisterId, "acquire", []any{args}, []any{&res})
+		if err != nil {
+			return fmt.Errorf("could not acquire lock for %s: %w", key, err)
+		}
+
+		if res.Err == nil {
+			tflog.Info(ctx, fmt.Sprintf("Acquired lock for %s as %s", key, l.holder))
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("could not acquire lock for %s: %s", key, *res.Err)
+		}
+
+		tflog.Info(ctx, fmt.Sprintf("Lock for %s is held (%s), retrying", key, *res.Err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.retryDelay):
+		}
+	}
+}
+
+// Releases the lock for the key. This is a no-op if locking is disabled (nil receiver).
+func (l *AdvisoryLock) Release(ctx context.Context, key string) error {
+	if l == nil {
+		return nil
+	}
+
+	a, err := newAgent(*l.config)
+	if err != nil {
+		return fmt.Errorf("could not create agent: %w", err)
+	}
+
+	var res lockResult
+	err = a.Call(l.canisterId, "release", []any{lockReleaseArgs{Key: key, Holder: l.holder}}, []any{&res})
+	if err != nil {
+		return fmt.Errorf("could not release lock for %s: %w", key, err)
+	}
+
+	if res.Err != nil {
+		return fmt.Errorf("could not release lock for %s: %s", key, *res.Err)
+	}
+
+	tflog.Info(ctx, "Released lock for "+key)
+	return nil
+}
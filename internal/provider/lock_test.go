@@ -0,0 +1,147 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// testLockCanister serves the calls of a mock backend like a lock canister (see
+// AdvisoryLock), without expiry.
+type testLockCanister struct {
+	sync.Mutex
+	holders map[string]string // by key
+}
+
+func (c *testLockCanister) outcome(request mockRequest) *mockRequestStatus {
+	c.Lock()
+	defer c.Unlock()
+
+	var args lockReleaseArgs
+	var err error
+	switch request.MethodName {
+	case "acquire":
+		var acquire lockAcquireArgs
+		err = idl.Unmarshal(request.Arg, []any{&acquire})
+		args = lockReleaseArgs{Key: acquire.Key, Holder: acquire.Holder}
+	case "release":
+		err = idl.Unmarshal(request.Arg, []any{&args})
+	default:
+		return mockReject(3, "Unknown method %s", request.MethodName)
+	}
+	if err != nil {
+		return mockReject(4, "Could not decode the argument of %s: %s", request.MethodName, err)
+	}
+
+	var res lockResult
+	holder, held := c.holders[args.Key]
+	switch {
+	case held && holder != args.Holder:
+		message := "held by " + holder
+		res.Err = &message
+	case request.MethodName == "acquire":
+		c.holders[args.Key] = args.Holder
+		res.Ok = new(idl.Null)
+	default:
+		delete(c.holders, args.Key)
+		res.Ok = new(idl.Null)
+	}
+
+	reply, err := idl.Marshal([]any{res})
+	if err != nil {
+		return mockReject(5, "Could not encode the result: %s", err)
+	}
+	return &mockRequestStatus{Reply: reply}
+}
+
+func (c *testLockCanister) value(canisterId string, path string) []byte {
+	return nil
+}
+
+// Checks that a lock held by one provider instance is not acquired by another one until
+// it is released.
+func TestAdvisoryLock(t *testing.T) {
+	backend, err := newMockBackend("", mockState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.replay = &testLockCanister{holders: map[string]string{}}
+
+	host, _ := url.Parse("mock://" + strings.ToLower(t.Name()))
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, func(http.RoundTripper) http.RoundTripper {
+		return &mockTransport{backend: backend}
+	}))
+	config := &agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		FetchRootKey: true,
+		PollDelay:    10 * time.Millisecond,
+		PollTimeout:  time.Second,
+	}
+
+	lockCanisterId := principal.MustDecode("ryjl3-tyaaa-aaaaa-aaaba-cai")
+	newLock := func() *AdvisoryLock {
+		lock, err := NewAdvisoryLock(config, lockCanisterId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.waitTimeout = 50 * time.Millisecond
+		lock.retryDelay = 10 * time.Millisecond
+		return lock
+	}
+	first, second := newLock(), newLock()
+	if first.holder == second.holder {
+		t.Fatalf("both locks are held as %s", first.holder)
+	}
+
+	ctx := context.Background()
+	key := "rrkah-fqaaa-aaaaa-aaaaq-cai"
+
+	if err := first.Acquire(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	// Acquiring a lock again is allowed for its holder
+	if err := first.Acquire(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	err = second.Acquire(ctx, key)
+	if err == nil || !strings.Contains(err.Error(), "held by "+first.holder) {
+		t.Fatalf("expected the second holder to be rejected, got %v", err)
+	}
+	if err := second.Release(ctx, key); err == nil {
+		t.Fatal("expected the second holder not to release the lock of the first one")
+	}
+
+	// Other keys are not locked
+	if err := second.Acquire(ctx, "r7inp-6aaaa-aaaaa-aaabq-cai"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Release(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Acquire(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// A nil lock (locking disabled) never blocks
+	var disabled *AdvisoryLock
+	if err := disabled.Acquire(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := disabled.Release(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	"github.com/aviate-labs/agent-go/ic/wallet"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Cycles attached to canisters created through a cycles wallet or a proxy canister, unless
+// configured otherwise.
+const defaultWalletCreateCanisterCycles = 3_000_000_000_000
+
+// The method of cycles wallets (and, by default, of proxy canisters) forwarding calls.
+const walletCallMethod = "wallet_call"
+
+// managementProxy is a canister calling the management canister on behalf of the provider,
+// and controlling the canisters managed by the provider: either a cycles wallet
+// (wallet_canister_id), a proxy canister (proxy_canister_id), e.g. an ops canister
+// recording every change on-chain, or an Orbit station (orbit_station_id).
+//
+// Calls are forwarded with a method with the interface of the wallet's wallet_call:
+//
+//	(record { canister : principal; method_name : text; args : blob; cycles : nat64 })
+//	  -> (variant { Ok : record { return : blob }; Err : text })
+type managementProxy struct {
+	CanisterId principal.Principal
+	Method     string
+
+	// Whether the proxy is a cycles wallet, which creates canisters with
+	// wallet_create_canister rather than by forwarding create_canister
+	Wallet bool
+
+	// Whether the proxy is an Orbit station (orbit_station_id), to which calls are submitted
+	// as requests executed once approved (see orbitCall) rather than forwarded with Method
+	Orbit           bool
+	ApprovalTimeout time.Duration
+}
+
+// managementAgent calls the management canister, either directly or through a proxy.
+// Canisters controlled by a wallet (e.g. created with dfx) or by a proxy canister can only
+// be managed through it.
+type managementAgent struct {
+	*icMgmt.Agent
+
+	proxy  *managementProxy // nil to call the management canister directly
+	config agent.Config
+
+	// The context of the operation, which cancels the calls waiting for Orbit requests to be
+	// approved
+	ctx context.Context
+}
+
+// Creates an agent calling the management canister through proxy, or directly if proxy is
+// nil, for the operation of ctx.
+func newManagementAgent(ctx context.Context, config agent.Config, proxy *managementProxy) (*managementAgent, error) {
+	a, err := newAgent(config)
+	if err != nil {
+		return nil, err
+	}
+	mgmtAgent := &icMgmt.Agent{Agent: a, CanisterId: ic.MANAGEMENT_CANISTER_PRINCIPAL}
+
+	return &managementAgent{Agent: mgmtAgent, proxy: proxy, config: config, ctx: ctx}, nil
+}
+
+// Calls method of the management canister with arg (and cycles attached) through the
+// proxy. The reply is decoded into result, unless result is nil.
+func (a *managementAgent) proxyCall(method string, arg any, cycles uint64, result any) error {
+	argRaw, err := idl.Marshal([]any{arg})
+	if err != nil {
+		return err
+	}
+
+	reply, err := a.proxyCallRaw(method, argRaw, cycles)
+	if err != nil {
+		return err
+	}
+
+	if result == nil || reply == nil {
+		return nil
+	}
+
+	return idl.Unmarshal(reply, []any{result})
+}
+
+// Same as proxyCall, with an encoded argument, returning the reply.
+func (a *managementAgent) proxyCallRaw(method string, argRaw []byte, cycles uint64) ([]byte, error) {
+	if a.proxy.Orbit {
+		return orbitCall(a.ctx, a.config, *a.proxy, method, argRaw, cycles)
+	}
+	return a.walletCall(method, argRaw, cycles)
+}
+
+// Forwards the call with the proxy's wallet_call-like method, returning the reply.
+func (a *managementAgent) walletCall(method string, argRaw []byte, cycles uint64) ([]byte, error) {
+	forwarded := struct {
+		Canister   principal.Principal `ic:"canister" json:"canister"`
+		MethodName string              `ic:"method_name" json:"method_name"`
+		Args       []byte              `ic:"args" json:"args"`
+		Cycles     uint64              `ic:"cycles" json:"cycles"`
+	}{
+		Canister:   ic.MANAGEMENT_CANISTER_PRINCIPAL,
+		MethodName: method,
+		Args:       argRaw,
+		Cycles:     cycles,
+	}
+
+	// Tracked like the calls made directly, so that a forwarded call that timed out is not
+	// forwarded again when retried
+	var res wallet.WalletResultCall
+	err := callAndWait(a.config, a.proxy.CanisterId, a.proxy.Method, forwarded, &res)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Err != nil {
+		return nil, fmt.Errorf("%s could not call %s: %s", a.proxy.CanisterId.Encode(), method, *res.Err)
+	}
+
+	if res.Ok == nil {
+		return nil, nil
+	}
+
+	return res.Ok.Return, nil
+}
+
+// Calls method of the management canister with arg for the canister, directly or through
+// the proxy, returning the encoded reply. Direct calls are made with CallRawWithEffectiveId,
+// so that a call that timed out (e.g. installing code) is not submitted again when retried
+// (see trackedCall).
+func (a *managementAgent) callManagement(canisterId principal.Principal, method string, arg any) ([]byte, error) {
+	argRaw, err := idl.Marshal([]any{arg})
+	if err != nil {
+		return nil, err
+	}
+	if a.proxy == nil {
+		return CallRawWithEffectiveId(a.config, canisterId, ic.MANAGEMENT_CANISTER_PRINCIPAL, method, argRaw)
+	}
+	return a.proxyCallRaw(method, argRaw, 0)
+}
+
+func (a *managementAgent) InstallCode(arg icMgmt.InstallCodeArgs) error {
+	_, err := a.callManagement(arg.CanisterId, "install_code", arg)
+	return err
+}
+
+func (a *managementAgent) UninstallCode(arg icMgmt.UninstallCodeArgs) error {
+	_, err := a.callManagement(arg.CanisterId, "uninstall_code", arg)
+	return err
+}
+
+func (a *managementAgent) UpdateSettings(arg icMgmt.UpdateSettingsArgs) error {
+	_, err := a.callManagement(arg.CanisterId, "update_settings", arg)
+	return err
+}
+
+// Same as UpdateSettings, with an encoded argument (see encodeRawUpdateSettings) for the
+// settings that icMgmt.CanisterSettings lacks.
+func (a *managementAgent) UpdateSettingsRaw(canisterId principal.Principal, argRaw []byte) error {
+	if a.proxy == nil {
+		_, err := CallRawWithEffectiveId(a.config, canisterId, ic.MANAGEMENT_CANISTER_PRINCIPAL, "update_settings", argRaw)
+		return err
+	}
+	_, err := a.proxyCallRaw("update_settings", argRaw, 0)
+	return err
+}
+
+func (a *managementAgent) StartCanister(arg icMgmt.StartCanisterArgs) error {
+	_, err := a.callManagement(arg.CanisterId, "start_canister", arg)
+	return err
+}
+
+func (a *managementAgent) StopCanister(arg icMgmt.StopCanisterArgs) error {
+	_, err := a.callManagement(arg.CanisterId, "stop_canister", arg)
+	return err
+}
+
+func (a *managementAgent) DeleteCanister(arg icMgmt.DeleteCanisterArgs) error {
+	_, err := a.callManagement(arg.CanisterId, "delete_canister", arg)
+	return err
+}
+
+// Reads the history of the canister. Only canisters can call canister_info, so this
+// requires a wallet or proxy canister: Orbit stations would submit the call as a request
+// to approve.
+func (a *managementAgent) CanisterInfo(arg icMgmt.CanisterInfoArgs) (*icMgmt.CanisterInfoResult, error) {
+	if a.proxy == nil {
+		return a.Agent.CanisterInfo(arg)
+	}
+	if a.proxy.Orbit {
+		return nil, fmt.Errorf("canister_info cannot be called through Orbit station %s", a.proxy.CanisterId.Encode())
+	}
+	var res icMgmt.CanisterInfoResult
+	if err := a.proxyCall("canister_info", arg, 0, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Reads the status of the canister, decoded generically: agent-go (v0.4.4) fails to decode
+// the statuses with fields added to canister_status after its release (e.g.
+// wasm_memory_threshold) into icMgmt.CanisterStatusResult.
+func (a *managementAgent) CanisterStatusRaw(canisterId principal.Principal) (any, error) {
+	if a.proxy != nil && a.proxy.Orbit {
+		// Reading the status doesn't require approval
+		status, err := orbitCanisterStatus(a.Agent.Agent, a.proxy.CanisterId, canisterId)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := idl.Marshal([]any{status})
+		if err != nil {
+			return nil, err
+		}
+		_, values, err := idl.Decode(raw)
+		if err != nil {
+			return nil, err
+		}
+		return values[0], nil
+	}
+
+	arg, err := idl.Marshal([]any{icMgmt.CanisterStatusArgs{CanisterId: canisterId}})
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	if a.proxy == nil {
+		raw, err = CallRawWithEffectiveId(a.config, canisterId, ic.MANAGEMENT_CANISTER_PRINCIPAL, "canister_status", arg)
+	} else {
+		raw, err = a.walletCall("canister_status", arg, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, values, err := idl.Decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("empty canister_status result")
+	}
+	return values[0], nil
+}
+
+// Creates a canister controlled by the proxy, paying for it with cycles of the proxy: with
+// wallet_create_canister for wallets, and by forwarding create_canister otherwise.
+func createCanisterProxy(ctx context.Context, config agent.Config, proxy managementProxy, cycles uint64) (principal.Principal, error) {
+	controllers := []principal.Principal{proxy.CanisterId}
+
+	if !proxy.Wallet {
+		a, err := newManagementAgent(ctx, config, &proxy)
+		if err != nil {
+			return principal.Principal{}, fmt.Errorf("Could not create agent: %w", err)
+		}
+
+		var res icMgmt.CreateCanisterResult
+		err = a.proxyCall("create_canister", icMgmt.CreateCanisterArgs{
+			Settings: &icMgmt.CanisterSettings{Controllers: &controllers},
+		}, cycles, &res)
+		if err != nil {
+			return principal.Principal{}, fmt.Errorf("Could not create canister with proxy %s: %w", proxy.CanisterId.Encode(), err)
+		}
+
+		return res.CanisterId, nil
+	}
+
+	a, err := newAgent(config)
+	if err != nil {
+		return principal.Principal{}, fmt.Errorf("Could not create wallet agent: %w", err)
+	}
+	walletAgent := &wallet.Agent{Agent: a, CanisterId: proxy.CanisterId}
+
+	res, err := walletAgent.WalletCreateCanister(wallet.CreateCanisterArgs{
+		Cycles:   cycles,
+		Settings: wallet.CanisterSettings{Controllers: &controllers},
+	})
+	if err != nil {
+		return principal.Principal{}, fmt.Errorf("Could not create canister with wallet %s: %w", proxy.CanisterId.Encode(), err)
+	}
+
+	if res.Err != nil {
+		return principal.Principal{}, fmt.Errorf("Wallet %s could not create canister: %s", proxy.CanisterId.Encode(), *res.Err)
+	}
+
+	return res.Ok.CanisterId, nil
+}
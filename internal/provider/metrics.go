@@ -0,0 +1,99 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// Metrics records the duration of the provider's operations on canisters (creation, code
+// installation, settings updates, reads, deletion), so that deploy latency can be
+// monitored across releases of the provider.
+// Every operation is logged with structured fields (e.g. with `TF_LOG=INFO`); if a file
+// is set, the operations are also appended to it as JSON lines. A nil *Metrics only logs.
+type Metrics struct {
+	mu      sync.Mutex
+	path    string
+	version string
+}
+
+// An operation, as written to the metrics file.
+type MetricsEvent struct {
+	Time            string `json:"time"` // RFC 3339, end of the operation
+	Operation       string `json:"operation"`
+	CanisterId      string `json:"canister_id,omitempty"`
+	DurationMs      int64  `json:"duration_ms"`
+	Error           string `json:"error,omitempty"`
+	ProviderVersion string `json:"provider_version"`
+}
+
+func NewMetrics(path string, version string) *Metrics {
+	return &Metrics{path: path, version: version}
+}
+
+// Starts timing the operation. The returned function records the operation and its
+// outcome, and is meant to be deferred with a pointer to the function's (named) error:
+//
+//	defer r.metrics.Time(ctx, "install_code", canisterId)(&err)
+func (m *Metrics) Time(ctx context.Context, operation string, canisterId string) func(err *error) {
+	start := time.Now()
+
+	return func(err *error) {
+		end := time.Now()
+		event := MetricsEvent{
+			Time:       end.UTC().Format(time.RFC3339Nano),
+			Operation:  operation,
+			CanisterId: canisterId,
+			DurationMs: end.Sub(start).Milliseconds(),
+		}
+		if err != nil && *err != nil {
+			event.Error = (*err).Error()
+		}
+
+		tflog.Info(ctx, fmt.Sprintf("%s took %dms", operation, event.DurationMs), map[string]any{
+			"operation":   event.Operation,
+			"canister_id": event.CanisterId,
+			"duration_ms": event.DurationMs,
+			"error":       event.Error,
+		})
+
+		if m == nil {
+			return
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		event.ProviderVersion = m.version
+		recordErr := m.append(event)
+		if recordErr != nil {
+			tflog.Warn(ctx, "Could not write metrics: "+recordErr.Error())
+		}
+	}
+}
+
+func (m *Metrics) append(event MetricsEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(data, '\n'))
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
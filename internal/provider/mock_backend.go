@@ -0,0 +1,1101 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/certification"
+	"github.com/aviate-labs/agent-go/certification/bls"
+	"github.com/aviate-labs/agent-go/certification/hashtree"
+	"github.com/aviate-labs/agent-go/ic"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// The scheme of the endpoints of the in-memory backend, e.g. `mock://` or `mock://ci`.
+const mockScheme = "mock"
+
+// Cycles of the canisters created without an amount, as with provisional creation on
+// local replicas.
+const mockDefaultCycles = 100_000_000_000_000
+
+// Returns true if the endpoint is served by the in-memory backend (see mockTransport).
+func isMockEndpoint(u *url.URL) bool {
+	return u != nil && u.Scheme == mockScheme
+}
+
+// mockTransport serves the requests to mock:// endpoints with an in-memory backend
+// simulating the management canister (creating canisters, installing code, settings,
+// status and snapshots), so that modules can be tested (e.g. with `terraform test`) without a replica.
+// It is the base of the transport of mock:// endpoints (see endpointTransport).
+//
+// The backend certifies its state (with its own root key) and signs its query responses
+// like a replica, so the provider's reads go through the same checks as on a real network.
+// It doesn't execute canister code: calls and queries to canisters are rejected, except the
+// registry's get_subnet_for_canister (all canisters are on the backend's subnet). Tests can
+// also serve an endpoint with a backend replaying recorded traffic (see mockReplay).
+type mockTransport struct {
+	backend *mockBackend // nil to serve each request with the backend of its host
+}
+
+func (t *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backend := t.backend
+	if backend == nil {
+		var err error
+		backend, err = loadMockBackend(req.URL.Host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	status, body := backend.serve(req)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/cbor"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// The state of a mock:// network. It is kept in memory, and saved in the temporary
+// directory so that subsequent runs (e.g. plan, then apply) see the same canisters.
+type mockBackend struct {
+	mu   sync.Mutex
+	file string
+
+	State mockState
+
+	rootKey    *bls.SecretKey
+	nodeKey    ed25519.PrivateKey
+	nodeId     principal.Principal
+	subnetId   principal.Principal
+	derRootKey []byte
+
+	// Outcome of the calls, by request id (calls are executed as soon as they are submitted)
+	requests map[agent.RequestID]mockRequestStatus
+
+	// The recorded traffic served instead of the simulated state, if any
+	replay mockReplay
+}
+
+// mockReplay is recorded traffic, which a backend serves instead of its simulated state
+// (e.g. the fixtures of the tests).
+type mockReplay interface {
+	// Returns the recorded outcome of the call or query.
+	outcome(request mockRequest) *mockRequestStatus
+	// Returns the recorded value of the path of the canister (nil if absent, or not recorded).
+	value(canisterId string, path string) []byte
+}
+
+type mockState struct {
+	RootKey      []byte                   `json:"root_key"` // BLS secret key
+	NodeKey      []byte                   `json:"node_key"` // Ed25519 seed
+	NextCanister uint64                   `json:"next_canister"`
+	Canisters    map[string]*mockCanister `json:"canisters"`
+}
+
+type mockCanister struct {
+	Controllers         []string          `json:"controllers"`
+	Status              string            `json:"status"` // running, stopped
+	ModuleHash          []byte            `json:"module_hash,omitempty"`
+	Metadata            map[string][]byte `json:"metadata,omitempty"` // custom sections of the module, by name
+	Cycles              uint64            `json:"cycles"`
+	ComputeAllocation   uint64            `json:"compute_allocation"`
+	MemoryAllocation    uint64            `json:"memory_allocation"`
+	FreezingThreshold   uint64            `json:"freezing_threshold"`
+	ReservedCyclesLimit uint64            `json:"reserved_cycles_limit"`
+	WasmMemoryThreshold uint64            `json:"wasm_memory_threshold"`
+	LogVisibility       string            `json:"log_visibility,omitempty"`      // controllers (if empty), public or allowed_viewers
+	LogAllowedViewers   []string          `json:"log_allowed_viewers,omitempty"` // if allowed_viewers
+
+	// The installed module, and the stable memory (set by tests, the code isn't executed)
+	Module       []byte `json:"module,omitempty"`
+	StableMemory []byte `json:"stable_memory,omitempty"`
+
+	Snapshots    map[string]*mockSnapshot `json:"snapshots,omitempty"` // by hex-encoded id
+	NextSnapshot uint64                   `json:"next_snapshot,omitempty"`
+}
+
+// mockSnapshot is a snapshot of a canister, taken or being uploaded.
+type mockSnapshot struct {
+	TakenAt      uint64 `json:"taken_at"`
+	Module       []byte `json:"module,omitempty"`
+	MainMemory   []byte `json:"main_memory,omitempty"`
+	StableMemory []byte `json:"stable_memory,omitempty"`
+}
+
+// The maximum number of snapshots of a canister.
+const mockMaxSnapshots = 10
+
+type mockRequestStatus struct {
+	Reply         []byte
+	RejectCode    uint64
+	RejectMessage string
+	ErrorCode     string
+}
+
+// The content of the requests (see agent.Request, which can't be decoded).
+type mockRequest struct {
+	Type          string     `cbor:"request_type"`
+	Sender        []byte     `cbor:"sender"`
+	Nonce         []byte     `cbor:"nonce"`
+	IngressExpiry uint64     `cbor:"ingress_expiry"`
+	CanisterId    []byte     `cbor:"canister_id"`
+	MethodName    string     `cbor:"method_name"`
+	Arg           []byte     `cbor:"arg"`
+	Paths         [][][]byte `cbor:"paths"`
+}
+
+// Backends by host (the name of the network, e.g. `ci` for `mock://ci`).
+var mockBackends = struct {
+	sync.Mutex
+	backends map[string]*mockBackend
+}{backends: map[string]*mockBackend{}}
+
+// Returns the path of the file in which the state of the mock:// network is saved.
+func mockBackendFile(host string) string {
+	hash := sha256.Sum256([]byte(host))
+	return filepath.Join(os.TempDir(), "terraform-provider-ic-mock-"+hex.EncodeToString(hash[:8])+".json")
+}
+
+// Returns the backend of the host, with the state saved by previous runs (if any).
+func loadMockBackend(host string) (*mockBackend, error) {
+	mockBackends.Lock()
+	defer mockBackends.Unlock()
+
+	if backend, ok := mockBackends.backends[host]; ok {
+		return backend, nil
+	}
+
+	file := mockBackendFile(host)
+	var state mockState
+	data, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the state of mock://%s from %s (delete it to start from a blank network): %w", host, file, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	backend, err := newMockBackend(file, state)
+	if err != nil {
+		return nil, fmt.Errorf("could not set up mock://%s: %w", host, err)
+	}
+	if err := backend.save(); err != nil {
+		return nil, err
+	}
+
+	mockBackends.backends[host] = backend
+	return backend, nil
+}
+
+// Returns a backend with the state (and its keys, generated if missing), saved in file
+// (unless empty).
+func newMockBackend(file string, state mockState) (*mockBackend, error) {
+	backend := &mockBackend{file: file, State: state, requests: map[agent.RequestID]mockRequestStatus{}}
+
+	if len(backend.State.RootKey) == 0 {
+		backend.State.RootKey = bls.NewSecretKeyByCSPRNG().Serialize()
+	}
+	if len(backend.State.NodeKey) == 0 {
+		backend.State.NodeKey = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(backend.State.NodeKey); err != nil {
+			return nil, err
+		}
+	}
+	if backend.State.Canisters == nil {
+		backend.State.Canisters = map[string]*mockCanister{}
+	}
+
+	backend.rootKey = new(bls.SecretKey)
+	if err := backend.rootKey.Deserialize(backend.State.RootKey); err != nil {
+		return nil, fmt.Errorf("invalid root key: %w", err)
+	}
+	derPrefix := mainnetRootKey[:len(mainnetRootKey)-blsPublicKeyLength]
+	backend.derRootKey = append(slices.Clone(derPrefix), backend.rootKey.GetPublicKey().Serialize()...)
+	backend.subnetId = principal.NewSelfAuthenticating(backend.derRootKey)
+
+	backend.nodeKey = ed25519.NewKeyFromSeed(backend.State.NodeKey)
+	derNodeKey, err := x509.MarshalPKIXPublicKey(backend.nodeKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	backend.nodeId = principal.NewSelfAuthenticating(derNodeKey)
+
+	return backend, nil
+}
+
+// Saves the state, so that subsequent runs see the same canisters.
+func (b *mockBackend) save() error {
+	if len(b.file) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(b.State)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(b.file, data, 0600)
+}
+
+// Serves the request, returning the status code and body of the response.
+func (b *mockBackend) serve(req *http.Request) (int, []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if req.Method == http.MethodGet && req.URL.Path == "/api/v2/status" {
+		data, err := cbor.Marshal(&agent.Status{
+			Version: "0.18.0",
+			Impl:    &agent.Implementation{Source: "terraform-provider-ic", Version: "mock"},
+			RootKey: b.derRootKey,
+		})
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
+		}
+		return http.StatusOK, data
+	}
+
+	segments := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v2/canister/"), "/")
+	if req.Method != http.MethodPost || !strings.HasPrefix(req.URL.Path, "/api/v2/canister/") || len(segments) != 2 {
+		return http.StatusNotFound, []byte("not found")
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return http.StatusBadRequest, []byte(err.Error())
+	}
+	var envelope struct {
+		Content mockRequest `cbor:"content"`
+	}
+	if err := cbor.Unmarshal(body, &envelope); err != nil {
+		return http.StatusBadRequest, []byte("could not decode request: " + err.Error())
+	}
+	request := envelope.Content
+	if request.CanisterId == nil {
+		request.CanisterId = []byte{} // the management canister
+	}
+
+	var data []byte
+	switch segments[1] {
+	case "call":
+		b.call(request)
+		return http.StatusAccepted, nil
+	case "query":
+		data, err = b.query(request)
+	case "read_state":
+		data, err = b.readState(request)
+	default:
+		return http.StatusNotFound, []byte("not found")
+	}
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	return http.StatusOK, data
+}
+
+// Returns the id of the request, as computed by the agent.
+func (r mockRequest) id() agent.RequestID {
+	return agent.NewRequestID(agent.Request{
+		Type:          r.Type,
+		Sender:        principal.Principal{Raw: r.Sender},
+		Nonce:         r.Nonce,
+		IngressExpiry: r.IngressExpiry,
+		CanisterID:    principal.Principal{Raw: r.CanisterId},
+		MethodName:    r.MethodName,
+		Arguments:     r.Arg,
+	})
+}
+
+func mockReject(code uint64, format string, a ...any) *mockRequestStatus {
+	return &mockRequestStatus{RejectCode: code, RejectMessage: fmt.Sprintf(format, a...)}
+}
+
+// Executes the call (once), recording its outcome for read_state.
+func (b *mockBackend) call(request mockRequest) {
+	requestId := request.id()
+	if _, ok := b.requests[requestId]; ok {
+		return
+	}
+
+	var status *mockRequestStatus
+	if b.replay != nil {
+		status = b.replay.outcome(request)
+	} else if len(request.CanisterId) > 0 {
+		status = b.canisterReject(principal.Principal{Raw: request.CanisterId}, request.MethodName)
+	} else {
+		status = b.executeManagement(principal.Principal{Raw: request.Sender}, request.MethodName, request.Arg)
+	}
+	b.requests[requestId] = *status
+}
+
+// Returns the rejection of a call to a canister, whose code is not executed.
+func (b *mockBackend) canisterReject(canisterId principal.Principal, methodName string) *mockRequestStatus {
+	canister, ok := b.State.Canisters[canisterId.Encode()]
+	switch {
+	case !ok:
+		status := mockReject(3, "Canister %s not found", canisterId.Encode())
+		status.ErrorCode = "IC0301"
+		return status
+	case canister.ModuleHash == nil:
+		return mockReject(5, "Canister %s has no module installed", canisterId.Encode())
+	default:
+		return mockReject(5, "Canister %s cannot execute %s: the mock backend doesn't execute canister code", canisterId.Encode(), methodName)
+	}
+}
+
+// Returns the canister if the sender controls it, and the rejection of the call otherwise.
+func (b *mockBackend) controlledCanister(sender principal.Principal, canisterId principal.Principal) (*mockCanister, *mockRequestStatus) {
+	canister, ok := b.State.Canisters[canisterId.Encode()]
+	if !ok {
+		status := mockReject(3, "Canister %s not found", canisterId.Encode())
+		status.ErrorCode = "IC0301"
+		return nil, status
+	}
+	if !slices.Contains(canister.Controllers, sender.Encode()) {
+		return nil, mockReject(5, "Only the controllers of the canister %s can control it. Canister's controllers: %s. Sender's ID: %s",
+			canisterId.Encode(), strings.Join(canister.Controllers, " "), sender.Encode())
+	}
+	return canister, nil
+}
+
+// Executes the method of the management canister, returning the reply or rejection.
+func (b *mockBackend) executeManagement(sender principal.Principal, method string, arg []byte) *mockRequestStatus {
+	var reply []any
+
+	switch method {
+	case "provisional_create_canister_with_cycles":
+		// Decoded generically, since the settings may include settings unknown to agent-go
+		_, values, err := idl.Decode(arg)
+		if err != nil || len(values) == 0 {
+			return mockReject(4, "Could not decode the argument of %s: %v", method, err)
+		}
+
+		canisterId := principal.Principal{Raw: binary.BigEndian.AppendUint64(nil, b.State.NextCanister)}
+		canisterId.Raw = append(canisterId.Raw, 0x01, 0x01)
+		b.State.NextCanister++
+
+		canister := &mockCanister{Status: "running", Cycles: mockDefaultCycles, Controllers: []string{sender.Encode()}}
+		if amount, ok := candidField(values[0], "amount").(idl.Nat); ok {
+			canister.Cycles = amount.BigInt().Uint64()
+		}
+		canister.updateSettings(candidField(values[0], "settings"))
+		b.State.Canisters[canisterId.Encode()] = canister
+
+		reply = []any{icMgmt.ProvisionalCreateCanisterWithCyclesResult{CanisterId: canisterId}}
+
+	case "install_code":
+		var args icMgmt.InstallCodeArgs
+		if err := idl.Unmarshal(arg, []any{&args}); err != nil {
+			return mockReject(4, "Could not decode the argument of %s: %s", method, err)
+		}
+		canister, reject := b.controlledCanister(sender, args.CanisterId)
+		if reject != nil {
+			return reject
+		}
+		if args.Mode.Install != nil && canister.ModuleHash != nil {
+			return mockReject(5, "Canister %s cannot be installed because the canister is not empty. Try installing with mode='reinstall' instead.", args.CanisterId.Encode())
+		}
+		if args.Mode.Upgrade != nil && canister.ModuleHash == nil {
+			return mockReject(5, "Canister %s is empty", args.CanisterId.Encode())
+		}
+
+		metadata, err := mockModuleMetadata(args.WasmModule)
+		if err != nil {
+			return mockReject(5, "Error from Canister %s: Canister's Wasm module is not valid: %s", args.CanisterId.Encode(), err)
+		}
+		moduleHash := sha256.Sum256(args.WasmModule)
+		canister.ModuleHash = moduleHash[:]
+		canister.Metadata = metadata
+		canister.Module = args.WasmModule
+		if args.Mode.Upgrade == nil {
+			canister.StableMemory = nil
+		}
+
+	case "uninstall_code":
+		var args icMgmt.UninstallCodeArgs
+		if err := idl.Unmarshal(arg, []any{&args}); err != nil {
+			return mockReject(4, "Could not decode the argument of %s: %s", method, err)
+		}
+		canister, reject := b.controlledCanister(sender, args.CanisterId)
+		if reject != nil {
+			return reject
+		}
+		canister.ModuleHash = nil
+		canister.Metadata = nil
+		canister.Module = nil
+		canister.StableMemory = nil
+
+	case "update_settings":
+		// Decoded generically, since the settings may include settings unknown to agent-go
+		// (see raw_settings), which are ignored
+		_, values, err := idl.Decode(arg)
+		if err != nil || len(values) == 0 {
+			return mockReject(4, "Could not decode the argument of %s: %v", method, err)
+		}
+		canisterId, ok := candidField(values[0], "canister_id").(principal.Principal)
+		if !ok {
+			return mockReject(4, "Could not decode the argument of %s: no canister_id", method)
+		}
+		canister, reject := b.controlledCanister(sender, canisterId)
+		if reject != nil {
+			return reject
+		}
+		canister.updateSettings(candidField(values[0], "settings"))
+
+	case "canister_status":
+		var args icMgmt.CanisterStatusArgs
+		if err := idl.Unmarshal(arg, []any{&args}); err != nil {
+			return mockReject(4, "Could not decode the argument of %s: %s", method, err)
+		}
+		canister, reject := b.controlledCanister(sender, args.CanisterId)
+		if reject != nil {
+			return reject
+		}
+		reply = []any{canister.status()}
+
+	case "start_canister", "stop_canister", "delete_canister":
+		var args icMgmt.CanisterStatusArgs // same argument as the other methods
+		if err := idl.Unmarshal(arg, []any{&args}); err != nil {
+			return mockReject(4, "Could not decode the argument of %s: %s", method, err)
+		}
+		canister, reject := b.controlledCanister(sender, args.CanisterId)
+		if reject != nil {
+			return reject
+		}
+		switch method {
+		case "start_canister":
+			canister.Status = "running"
+		case "stop_canister":
+			canister.Status = "stopped"
+		default:
+			if canister.Status != "stopped" {
+				return mockReject(5, "Canister %s must be stopped before it is deleted.", args.CanisterId.Encode())
+			}
+			delete(b.State.Canisters, args.CanisterId.Encode())
+		}
+
+	case "take_canister_snapshot", "list_canister_snapshots", "delete_canister_snapshot", "load_canister_snapshot",
+		"read_canister_snapshot_metadata", "read_canister_snapshot_data", "upload_canister_snapshot_metadata", "upload_canister_snapshot_data":
+		var status *mockRequestStatus
+		reply, status = b.executeSnapshotMethod(sender, method, arg)
+		if status != nil {
+			return status
+		}
+
+	case "provisional_top_up_canister":
+		var args icMgmt.ProvisionalTopUpCanisterArgs
+		if err := idl.Unmarshal(arg, []any{&args}); err != nil {
+			return mockReject(4, "Could not decode the argument of %s: %s", method, err)
+		}
+		canister, ok := b.State.Canisters[args.CanisterId.Encode()]
+		if !ok {
+			status := mockReject(3, "Canister %s not found", args.CanisterId.Encode())
+			status.ErrorCode = "IC0301"
+			return status
+		}
+		canister.Cycles += args.Amount.BigInt().Uint64()
+
+	default:
+		return mockReject(3, "The mock backend doesn't implement the %s method of the management canister", method)
+	}
+
+	if err := b.save(); err != nil {
+		return mockReject(5, "Could not save the state of the mock backend: %s", err)
+	}
+
+	encoded, err := idl.Marshal(reply)
+	if err != nil {
+		return mockReject(5, "Could not encode the reply of %s: %s", method, err)
+	}
+	return &mockRequestStatus{Reply: encoded, RejectCode: 0}
+}
+
+// Executes the snapshot method of the management canister, returning the reply or the
+// rejection.
+func (b *mockBackend) executeSnapshotMethod(sender principal.Principal, method string, arg []byte) ([]any, *mockRequestStatus) {
+	// All the methods take the canister_id (and most the snapshot_id), decoded generically
+	_, values, err := idl.Decode(arg)
+	if err != nil || len(values) == 0 {
+		return nil, mockReject(4, "Could not decode the argument of %s: %v", method, err)
+	}
+	canisterId, ok := candidField(values[0], "canister_id").(principal.Principal)
+	if !ok {
+		return nil, mockReject(4, "Could not decode the argument of %s: no canister_id", method)
+	}
+	canister, reject := b.controlledCanister(sender, canisterId)
+	if reject != nil {
+		return nil, reject
+	}
+	snapshotIdArg := candidBlob(candidField(values[0], "snapshot_id"))
+	snapshot := canister.Snapshots[hex.EncodeToString(snapshotIdArg)]
+	if snapshot == nil && snapshotIdArg != nil {
+		return nil, mockReject(4, "Could not find the snapshot ID %x for canister %s", snapshotIdArg, canisterId.Encode())
+	}
+
+	// Snapshots are replaced (or added) with the snapshot_id
+	newSnapshot := func(replace any) ([]byte, *mockRequestStatus) {
+		if replace := candidBlob(replace); replace != nil {
+			if canister.Snapshots[hex.EncodeToString(replace)] == nil {
+				return nil, mockReject(4, "Could not find the snapshot ID %x for canister %s", replace, canisterId.Encode())
+			}
+			delete(canister.Snapshots, hex.EncodeToString(replace))
+		}
+		if len(canister.Snapshots) >= mockMaxSnapshots {
+			return nil, mockReject(4, "Canister %s has reached the maximum number of snapshots allowed: %d", canisterId.Encode(), mockMaxSnapshots)
+		}
+		if canister.Snapshots == nil {
+			canister.Snapshots = map[string]*mockSnapshot{}
+		}
+		id := binary.BigEndian.AppendUint64(slices.Clone(canisterId.Raw), canister.NextSnapshot)
+		canister.NextSnapshot++
+		canister.Snapshots[hex.EncodeToString(id)] = &mockSnapshot{TakenAt: uint64(time.Now().UnixNano())}
+		return id, nil
+	}
+	type snapshotResult struct {
+		Id               []byte `ic:"id"`
+		TakenAtTimestamp uint64 `ic:"taken_at_timestamp"`
+		TotalSize        uint64 `ic:"total_size"`
+	}
+	snapshotReply := func(id []byte, snapshot *mockSnapshot) snapshotResult {
+		return snapshotResult{id, snapshot.TakenAt, uint64(len(snapshot.Module) + len(snapshot.MainMemory) + len(snapshot.StableMemory))}
+	}
+
+	switch method {
+	case "take_canister_snapshot":
+		id, reject := newSnapshot(candidField(values[0], "replace_snapshot"))
+		if reject != nil {
+			return nil, reject
+		}
+		snapshot := canister.Snapshots[hex.EncodeToString(id)]
+		snapshot.Module, snapshot.StableMemory = canister.Module, canister.StableMemory
+		return []any{snapshotReply(id, snapshot)}, nil
+
+	case "list_canister_snapshots":
+		snapshots := []snapshotResult{}
+		for id, snapshot := range canister.Snapshots {
+			idBytes, _ := hex.DecodeString(id)
+			snapshots = append(snapshots, snapshotReply(idBytes, snapshot))
+		}
+		return []any{snapshots}, nil
+
+	case "delete_canister_snapshot":
+		delete(canister.Snapshots, hex.EncodeToString(snapshotIdArg))
+		return nil, nil
+
+	case "load_canister_snapshot":
+		if len(snapshot.Module) == 0 {
+			canister.Module, canister.ModuleHash, canister.Metadata = nil, nil, nil
+			canister.StableMemory = snapshot.StableMemory
+			return nil, nil
+		}
+		metadata, err := mockModuleMetadata(snapshot.Module)
+		if err != nil {
+			return nil, mockReject(5, "Error from Canister %s: Canister's Wasm module is not valid: %s", canisterId.Encode(), err)
+		}
+		moduleHash := sha256.Sum256(snapshot.Module)
+		canister.Module, canister.ModuleHash, canister.Metadata = snapshot.Module, moduleHash[:], metadata
+		canister.StableMemory = snapshot.StableMemory
+		return nil, nil
+
+	case "read_canister_snapshot_metadata":
+		return []any{struct {
+			TakenAtTimestamp uint64              `ic:"taken_at_timestamp"`
+			WasmModuleSize   uint64              `ic:"wasm_module_size"`
+			ExportedGlobals  []snapshotGlobal    `ic:"exported_globals"`
+			WasmMemorySize   uint64              `ic:"wasm_memory_size"`
+			StableMemorySize uint64              `ic:"stable_memory_size"`
+			WasmChunkStore   []snapshotChunkHash `ic:"wasm_chunk_store"`
+			CanisterVersion  uint64              `ic:"canister_version"`
+			CertifiedData    []byte              `ic:"certified_data"`
+		}{
+			TakenAtTimestamp: snapshot.TakenAt,
+			WasmModuleSize:   uint64(len(snapshot.Module)),
+			ExportedGlobals:  []snapshotGlobal{},
+			WasmMemorySize:   uint64(len(snapshot.MainMemory)),
+			StableMemorySize: uint64(len(snapshot.StableMemory)),
+			WasmChunkStore:   []snapshotChunkHash{},
+			CertifiedData:    []byte{},
+		}}, nil
+
+	case "read_canister_snapshot_data":
+		var args readSnapshotDataArgs
+		if err := idl.Unmarshal(arg, []any{&args}); err != nil {
+			return nil, mockReject(4, "Could not decode the argument of %s: %s", method, err)
+		}
+		var data []byte
+		var dataRange *snapshotDataRange
+		switch {
+		case args.Kind.WasmModule != nil:
+			data, dataRange = snapshot.Module, args.Kind.WasmModule
+		case args.Kind.MainMemory != nil:
+			data, dataRange = snapshot.MainMemory, args.Kind.MainMemory
+		case args.Kind.StableMemory != nil:
+			data, dataRange = snapshot.StableMemory, args.Kind.StableMemory
+		default:
+			return nil, mockReject(4, "The mock backend doesn't implement the wasm chunk store")
+		}
+		if dataRange.Offset+dataRange.Size > uint64(len(data)) {
+			return nil, mockReject(4, "Invalid snapshot data range: offset %d and size %d exceed %d bytes", dataRange.Offset, dataRange.Size, len(data))
+		}
+		return []any{struct {
+			Chunk []byte `ic:"chunk"`
+		}{data[dataRange.Offset : dataRange.Offset+dataRange.Size]}}, nil
+
+	case "upload_canister_snapshot_metadata":
+		// Only the sizes are used, allocating the data uploaded afterwards
+		sizes := map[string]uint64{}
+		for _, name := range []string{"wasm_module_size", "wasm_memory_size", "stable_memory_size"} {
+			size := candidNat(candidField(values[0], name))
+			if size == nil || !size.IsUint64() {
+				return nil, mockReject(4, "Could not decode the argument of %s: no %s", method, name)
+			}
+			sizes[name] = size.Uint64()
+		}
+		id, reject := newSnapshot(candidField(values[0], "replace_snapshot"))
+		if reject != nil {
+			return nil, reject
+		}
+		snapshot := canister.Snapshots[hex.EncodeToString(id)]
+		snapshot.Module = make([]byte, sizes["wasm_module_size"])
+		snapshot.MainMemory = make([]byte, sizes["wasm_memory_size"])
+		snapshot.StableMemory = make([]byte, sizes["stable_memory_size"])
+		return []any{struct {
+			SnapshotId []byte `ic:"snapshot_id"`
+		}{id}}, nil
+
+	default: // upload_canister_snapshot_data
+		var args uploadSnapshotDataArgs
+		if err := idl.Unmarshal(arg, []any{&args}); err != nil {
+			return nil, mockReject(4, "Could not decode the argument of %s: %s", method, err)
+		}
+		var data []byte
+		var offset *snapshotDataOffset
+		switch {
+		case args.Kind.WasmModule != nil:
+			data, offset = snapshot.Module, args.Kind.WasmModule
+		case args.Kind.MainMemory != nil:
+			data, offset = snapshot.MainMemory, args.Kind.MainMemory
+		case args.Kind.StableMemory != nil:
+			data, offset = snapshot.StableMemory, args.Kind.StableMemory
+		default:
+			return nil, mockReject(4, "The mock backend doesn't implement the wasm chunk store")
+		}
+		if offset.Offset+uint64(len(args.Chunk)) > uint64(len(data)) {
+			return nil, mockReject(4, "Invalid snapshot data: offset %d and %d bytes exceed %d bytes", offset.Offset, len(args.Chunk), len(data))
+		}
+		copy(data[offset.Offset:], args.Chunk)
+		return nil, nil
+	}
+}
+
+// Returns the nat settings of the canister, by name.
+func (c *mockCanister) natSettings() map[string]*uint64 {
+	return map[string]*uint64{
+		"compute_allocation":    &c.ComputeAllocation,
+		"memory_allocation":     &c.MemoryAllocation,
+		"freezing_threshold":    &c.FreezingThreshold,
+		"reserved_cycles_limit": &c.ReservedCyclesLimit,
+		"wasm_memory_threshold": &c.WasmMemoryThreshold,
+	}
+}
+
+// Updates the settings set in the (decoded) canister_settings record, if any.
+func (c *mockCanister) updateSettings(settings any) {
+	if controllers, ok := candidField(settings, "controllers").([]any); ok {
+		c.Controllers = make([]string, 0, len(controllers))
+		for _, controller := range controllers {
+			if p, ok := controller.(principal.Principal); ok {
+				c.Controllers = append(c.Controllers, p.Encode())
+			}
+		}
+	}
+
+	for name, setting := range c.natSettings() {
+		if value, ok := candidField(settings, name).(idl.Nat); ok {
+			*setting = value.BigInt().Uint64()
+		}
+	}
+
+	if visibility, ok := candidField(settings, "log_visibility").(*idl.Variant); ok {
+		c.LogVisibility, c.LogAllowedViewers = "", nil
+		for _, name := range []string{logVisibilityControllers, logVisibilityPublic, logVisibilityAllowedViewers} {
+			if visibility.Name == name || visibility.Name == idl.HashString(name) {
+				c.LogVisibility = name
+			}
+		}
+		viewers, _ := visibility.Value.([]any)
+		for _, viewer := range viewers {
+			if p, ok := viewer.(principal.Principal); ok {
+				c.LogAllowedViewers = append(c.LogAllowedViewers, p.Encode())
+			}
+		}
+	}
+}
+
+// The result of canister_status, with the settings agent-go (v0.4.4) predates.
+type mockCanisterStatusResult struct {
+	Status struct {
+		Running  *idl.Null `ic:"running,variant"`
+		Stopping *idl.Null `ic:"stopping,variant"`
+		Stopped  *idl.Null `ic:"stopped,variant"`
+	} `ic:"status"`
+	Settings struct {
+		Controllers         []principal.Principal `ic:"controllers"`
+		ComputeAllocation   idl.Nat               `ic:"compute_allocation"`
+		MemoryAllocation    idl.Nat               `ic:"memory_allocation"`
+		FreezingThreshold   idl.Nat               `ic:"freezing_threshold"`
+		ReservedCyclesLimit idl.Nat               `ic:"reserved_cycles_limit"`
+		WasmMemoryThreshold idl.Nat               `ic:"wasm_memory_threshold"`
+		LogVisibility       struct {
+			Controllers    *idl.Null              `ic:"controllers,variant"`
+			Public         *idl.Null              `ic:"public,variant"`
+			AllowedViewers *[]principal.Principal `ic:"allowed_viewers,variant"`
+		} `ic:"log_visibility"`
+	} `ic:"settings"`
+	ModuleHash             *[]byte `ic:"module_hash,omitempty"`
+	MemorySize             idl.Nat `ic:"memory_size"`
+	Cycles                 idl.Nat `ic:"cycles"`
+	ReservedCycles         idl.Nat `ic:"reserved_cycles"`
+	IdleCyclesBurnedPerDay idl.Nat `ic:"idle_cycles_burned_per_day"`
+	QueryStats             struct {
+		NumCallsTotal             idl.Nat `ic:"num_calls_total"`
+		NumInstructionsTotal      idl.Nat `ic:"num_instructions_total"`
+		RequestPayloadBytesTotal  idl.Nat `ic:"request_payload_bytes_total"`
+		ResponsePayloadBytesTotal idl.Nat `ic:"response_payload_bytes_total"`
+	} `ic:"query_stats"`
+}
+
+func (c *mockCanister) status() mockCanisterStatusResult {
+	var status mockCanisterStatusResult
+	if c.Status == "stopped" {
+		status.Status.Stopped = new(idl.Null)
+	} else {
+		status.Status.Running = new(idl.Null)
+	}
+
+	for _, controller := range c.Controllers {
+		p, _ := principal.Decode(controller)
+		status.Settings.Controllers = append(status.Settings.Controllers, p)
+	}
+	status.Settings.ComputeAllocation = idl.NewNat(c.ComputeAllocation)
+	status.Settings.MemoryAllocation = idl.NewNat(c.MemoryAllocation)
+	status.Settings.FreezingThreshold = idl.NewNat(c.FreezingThreshold)
+	status.Settings.ReservedCyclesLimit = idl.NewNat(c.ReservedCyclesLimit)
+	status.Settings.WasmMemoryThreshold = idl.NewNat(c.WasmMemoryThreshold)
+	switch c.LogVisibility {
+	case logVisibilityPublic:
+		status.Settings.LogVisibility.Public = new(idl.Null)
+	case logVisibilityAllowedViewers:
+		viewers := []principal.Principal{}
+		for _, viewer := range c.LogAllowedViewers {
+			p, _ := principal.Decode(viewer)
+			viewers = append(viewers, p)
+		}
+		status.Settings.LogVisibility.AllowedViewers = &viewers
+	default:
+		status.Settings.LogVisibility.Controllers = new(idl.Null)
+	}
+
+	if c.ModuleHash != nil {
+		moduleHash := slices.Clone(c.ModuleHash)
+		status.ModuleHash = &moduleHash
+	}
+	status.Cycles = idl.NewNat(c.Cycles)
+	status.MemorySize = idl.NewNat(uint64(0))
+	status.ReservedCycles = idl.NewNat(uint64(0))
+	status.IdleCyclesBurnedPerDay = idl.NewNat(uint64(0))
+	status.QueryStats.NumCallsTotal = idl.NewNat(uint64(0))
+	status.QueryStats.NumInstructionsTotal = idl.NewNat(uint64(0))
+	status.QueryStats.RequestPayloadBytesTotal = idl.NewNat(uint64(0))
+	status.QueryStats.ResponsePayloadBytesTotal = idl.NewNat(uint64(0))
+	return status
+}
+
+// Returns the icp:public and icp:private custom sections of the (possibly gzipped) module.
+func mockModuleMetadata(module []byte) (map[string][]byte, error) {
+	module, err := decompressWasmModule(module)
+	if err != nil {
+		return nil, err
+	}
+
+	sections, err := wasmSections(module)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string][]byte{}
+	for _, section := range sections {
+		if section.Id == 0 && (strings.HasPrefix(section.Name, "icp:public ") || strings.HasPrefix(section.Name, "icp:private ")) {
+			metadata[section.Name] = section.Content
+		}
+	}
+	return metadata, nil
+}
+
+// Answers the query: only fetch_canister_logs (without logs), since canister code isn't
+// executed. The response is signed by the node of the backend.
+func (b *mockBackend) query(request mockRequest) ([]byte, error) {
+	if b.replay != nil {
+		return b.signedQueryResponse(request, b.replay.outcome(request))
+	}
+
+	status := &mockRequestStatus{}
+	if len(request.CanisterId) == 0 && request.MethodName == "fetch_canister_logs" {
+		var args fetchCanisterLogsArgs
+		if err := idl.Unmarshal(request.Arg, []any{&args}); err != nil {
+			status = mockReject(4, "Could not decode the argument of fetch_canister_logs: %s", err)
+		} else if _, reject := b.controlledCanister(principal.Principal{Raw: request.Sender}, args.CanisterId); reject != nil {
+			status = reject
+		} else if status.Reply, err = idl.Marshal([]any{fetchCanisterLogsResult{CanisterLogRecords: []canisterLogRecord{}}}); err != nil {
+			return nil, err
+		}
+	} else if len(request.CanisterId) == 0 {
+		status = mockReject(3, "The mock backend doesn't implement the %s query of the management canister", request.MethodName)
+	} else if canisterId := (principal.Principal{Raw: request.CanisterId}); canisterId.Equal(ic.REGISTRY_PRINCIPAL) && request.MethodName == "get_subnet_for_canister" {
+		// All canisters are on the subnet of the backend
+		var args getSubnetForCanisterRequest
+		var res getSubnetForCanisterResult
+		if err := idl.Unmarshal(request.Arg, []any{&args}); err != nil || args.Principal == nil {
+			status = mockReject(4, "Could not decode the argument of get_subnet_for_canister")
+		} else if _, ok := b.State.Canisters[args.Principal.Encode()]; !ok {
+			message := "Canister " + args.Principal.Encode() + " not found"
+			res.Err = &message
+		} else {
+			res.Ok = &struct {
+				SubnetId *principal.Principal `ic:"subnet_id,omitempty"`
+			}{SubnetId: &b.subnetId}
+		}
+		if status.RejectCode == 0 {
+			reply, err := idl.Marshal([]any{res})
+			if err != nil {
+				return nil, err
+			}
+			status.Reply = reply
+		}
+	} else {
+		status = b.canisterReject(principal.Principal{Raw: request.CanisterId}, request.MethodName)
+	}
+
+	return b.signedQueryResponse(request, status)
+}
+
+// Returns the response to the query with the outcome, signed by the node of the backend.
+func (b *mockBackend) signedQueryResponse(request mockRequest, status *mockRequestStatus) ([]byte, error) {
+	resp := queryResponse{Status: "replied", Reply: map[string][]byte{"arg": status.Reply}}
+	if status.RejectCode != 0 {
+		resp = queryResponse{Status: "rejected", RejectCode: status.RejectCode, RejectMessage: status.RejectMessage, ErrorCode: status.ErrorCode}
+	}
+
+	timestamp := uint64(time.Now().UnixNano())
+	hash := resp.signedHash(request.id(), timestamp)
+	resp.Signatures = []queryResponseSignature{{
+		Timestamp: timestamp,
+		Signature: ed25519.Sign(b.nodeKey, append(slices.Clone(queryResponseDomainSeparator), hash[:]...)),
+		Identity:  b.nodeId.Raw,
+	}}
+
+	return cbor.Marshal(resp)
+}
+
+// Returns a certificate of the whole state of the backend, signed with its root key. The
+// private metadata of canisters is only included for their controllers.
+func (b *mockBackend) readState(request mockRequest) ([]byte, error) {
+	if b.replay != nil {
+		return b.replayReadState(request)
+	}
+
+	sender := principal.Principal{Raw: request.Sender}
+
+	canisters := map[string]hashtree.Node{}
+	for id, canister := range b.State.Canisters {
+		canisterId, err := principal.Decode(id)
+		if err != nil {
+			return nil, err
+		}
+
+		controllers := make([][]byte, len(canister.Controllers))
+		for i, controller := range canister.Controllers {
+			p, err := principal.Decode(controller)
+			if err != nil {
+				return nil, err
+			}
+			controllers[i] = p.Raw
+		}
+		encodedControllers, err := cbor.Marshal(controllers)
+		if err != nil {
+			return nil, err
+		}
+
+		info := map[string]hashtree.Node{"controllers": hashtree.Leaf(encodedControllers)}
+		if canister.ModuleHash != nil {
+			info["module_hash"] = hashtree.Leaf(canister.ModuleHash)
+		}
+		metadata := map[string]hashtree.Node{}
+		for name, content := range canister.Metadata {
+			if public, ok := strings.CutPrefix(name, "icp:public "); ok {
+				metadata[public] = hashtree.Leaf(content)
+			} else if private, ok := strings.CutPrefix(name, "icp:private "); ok && slices.Contains(canister.Controllers, sender.Encode()) {
+				metadata[private] = hashtree.Leaf(content)
+			}
+		}
+		if len(metadata) > 0 {
+			info["metadata"] = mockLabeledTree(metadata)
+		}
+
+		canisters[string(canisterId.Raw)] = mockLabeledTree(info)
+	}
+
+	return b.certificate(map[string]hashtree.Node{"canister": mockLabeledTree(canisters)})
+}
+
+// Returns the read_state response with a certificate of the nodes, along with the status
+// of the requests, the subnet (with the node of the backend) and the time, signed with the
+// root key of the backend.
+func (b *mockBackend) certificate(nodes map[string]hashtree.Node) ([]byte, error) {
+	requests := map[string]hashtree.Node{}
+	for requestId, status := range b.requests {
+		fields := map[string]hashtree.Node{"status": hashtree.Leaf("replied"), "reply": hashtree.Leaf(status.Reply)}
+		if status.RejectCode != 0 {
+			fields = map[string]hashtree.Node{
+				"status":         hashtree.Leaf("rejected"),
+				"reject_code":    hashtree.Leaf(candidUleb(status.RejectCode)),
+				"reject_message": hashtree.Leaf(status.RejectMessage),
+			}
+			if len(status.ErrorCode) > 0 {
+				fields["error_code"] = hashtree.Leaf(status.ErrorCode)
+			}
+		}
+		requests[string(requestId[:])] = mockLabeledTree(fields)
+	}
+
+	derNodeKey, err := x509.MarshalPKIXPublicKey(b.nodeKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	canisterRanges, err := cbor.Marshal([][][]byte{{{}, bytes.Repeat([]byte{0xff}, 10)}})
+	if err != nil {
+		return nil, err
+	}
+	subnet := mockLabeledTree(map[string]hashtree.Node{
+		"canister_ranges": hashtree.Leaf(canisterRanges),
+		"public_key":      hashtree.Leaf(b.derRootKey),
+		"node": mockLabeledTree(map[string]hashtree.Node{
+			string(b.nodeId.Raw): mockLabeledTree(map[string]hashtree.Node{"public_key": hashtree.Leaf(derNodeKey)}),
+		}),
+	})
+
+	nodes = maps.Clone(nodes)
+	nodes["request_status"] = mockLabeledTree(requests)
+	nodes["subnet"] = mockLabeledTree(map[string]hashtree.Node{string(b.subnetId.Raw): subnet})
+	nodes["time"] = hashtree.Leaf(candidUleb(uint64(time.Now().UnixNano())))
+	tree := hashtree.NewHashTree(mockLabeledTree(nodes))
+
+	rootHash := tree.Digest()
+	signature := b.rootKey.SignByte(append(hashtree.DomainSeparator("ic-state-root"), rootHash[:]...))
+
+	certificate, err := cbor.Marshal(certification.Cert{Tree: tree, Signature: signature.Serialize()})
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(map[string][]byte{"certificate": certificate})
+}
+
+// Returns the tree of the labeled nodes, whose labels are sorted as required for lookups.
+func mockLabeledTree(nodes map[string]hashtree.Node) hashtree.Node {
+	labels := make([]string, 0, len(nodes))
+	for label := range nodes {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var fork func(labels []string) hashtree.Node
+	fork = func(labels []string) hashtree.Node {
+		switch len(labels) {
+		case 0:
+			return hashtree.Empty{}
+		case 1:
+			return hashtree.Labeled{Label: hashtree.Label(labels[0]), Tree: nodes[labels[0]]}
+		default:
+			return hashtree.Fork{LeftTree: fork(labels[:len(labels)/2]), RightTree: fork(labels[len(labels)/2:])}
+		}
+	}
+	return fork(labels)
+}
+
+// Returns a certificate of the recorded values of the canister paths read by the request
+// (along with the status of the replayed calls).
+func (b *mockBackend) replayReadState(request mockRequest) ([]byte, error) {
+	var paths [][][]byte
+	var values [][]byte
+	for _, path := range request.Paths {
+		if len(path) < 3 || string(path[0]) != "canister" {
+			continue
+		}
+		labels := make([]string, len(path)-2)
+		for i, label := range path[2:] {
+			labels[i] = string(label)
+		}
+		if value := b.replay.value(principal.Principal{Raw: path[1]}.Encode(), strings.Join(labels, "/")); value != nil {
+			paths = append(paths, path[1:])
+			values = append(values, value)
+		}
+	}
+
+	nodes := map[string]hashtree.Node{}
+	if len(paths) > 0 {
+		nodes["canister"] = mockPathsTree(paths, values)
+	}
+	return b.certificate(nodes)
+}
+
+// Returns the tree of the values at the paths.
+func mockPathsTree(paths [][][]byte, values [][]byte) hashtree.Node {
+	nodes := map[string]hashtree.Node{}
+	children := map[string][]int{}
+	for i, path := range paths {
+		if len(path) == 1 {
+			nodes[string(path[0])] = hashtree.Leaf(values[i])
+		} else {
+			children[string(path[0])] = append(children[string(path[0])], i)
+		}
+	}
+	for label, indexes := range children {
+		subpaths := make([][][]byte, len(indexes))
+		subvalues := make([][]byte, len(indexes))
+		for j, i := range indexes {
+			subpaths[j], subvalues[j] = paths[i][1:], values[i]
+		}
+		nodes[label] = mockPathsTree(subpaths, subvalues)
+	}
+	return mockLabeledTree(nodes)
+}
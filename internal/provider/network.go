@@ -0,0 +1,93 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The endpoint of the local replica when dfx doesn't configure another one.
+const localEndpoint = "http://127.0.0.1:4943"
+
+// A network of dfx's networks.json, e.g. { "providers": ["https://..."] } or, for
+// local replicas, { "bind": "127.0.0.1:4943" }.
+type dfxNetwork struct {
+	Providers []string `json:"providers"`
+	Bind      string   `json:"bind"`
+}
+
+// Returns the path of dfx's (shared) networks configuration, i.e. ~/.config/dfx/networks.json
+// (or $DFX_CONFIG_ROOT/.config/dfx/networks.json if set).
+func dfxNetworksFile() (string, error) {
+	identitiesDir, err := dfxIdentitiesDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(identitiesDir), "networks.json"), nil
+}
+
+// Reads the networks defined in dfx's networks.json; no networks are defined if the file
+// doesn't exist.
+func readDfxNetworks() (map[string]dfxNetwork, error) {
+	networks := map[string]dfxNetwork{}
+
+	file, err := dfxNetworksFile()
+	if err != nil {
+		return nil, fmt.Errorf("Could not find dfx networks: %w", err)
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return networks, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read dfx networks: %w", err)
+	}
+
+	err = json.Unmarshal(data, &networks)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read dfx networks from %s: %w", file, err)
+	}
+
+	return networks, nil
+}
+
+// Returns the endpoint of a named network: "mainnet" (or "ic", as named by dfx), "local",
+// or a network defined in dfx's networks.json. "local" can be redefined in networks.json
+// and otherwise is the default endpoint of dfx's local replica.
+func networkEndpoint(name string) (string, error) {
+	if name == "mainnet" || name == "ic" {
+		return icpApi.String(), nil
+	}
+
+	networks, err := readDfxNetworks()
+	if err != nil {
+		return "", err
+	}
+
+	network, ok := networks[name]
+	if !ok {
+		if name == "local" {
+			return localEndpoint, nil
+		}
+		return "", fmt.Errorf("Unknown network %s: expected \"mainnet\", \"local\" or a network defined in dfx's networks.json", name)
+	}
+
+	if len(network.Providers) > 0 {
+		return network.Providers[0], nil
+	}
+
+	if len(network.Bind) > 0 {
+		if strings.Contains(network.Bind, "://") {
+			return network.Bind, nil
+		}
+		return "http://" + network.Bind, nil
+	}
+
+	return "", fmt.Errorf("Network %s of dfx's networks.json has neither providers nor bind address", name)
+}
@@ -0,0 +1,221 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic"
+	icMgmt "github.com/aviate-labs/agent-go/ic/ic"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// How long to wait for Orbit requests to be approved and executed, unless configured
+// otherwise (see orbit_approval_timeout).
+const defaultOrbitApprovalTimeout = 24 * time.Hour
+
+// Interval at which the status of Orbit requests is polled.
+const orbitPollInterval = 10 * time.Second
+
+// Statuses of Orbit requests
+const (
+	orbitStatusCompleted = "Completed"
+	orbitStatusRejected  = "Rejected"
+	orbitStatusCancelled = "Cancelled"
+	orbitStatusFailed    = "Failed"
+)
+
+type orbitCanisterMethod struct {
+	CanisterId principal.Principal `ic:"canister_id" json:"canister_id"`
+	MethodName string              `ic:"method_name" json:"method_name"`
+}
+
+type orbitCallExternalCanisterInput struct {
+	ValidationMethod      *orbitCanisterMethod `ic:"validation_method,omitempty" json:"validation_method,omitempty"`
+	ExecutionMethod       orbitCanisterMethod  `ic:"execution_method" json:"execution_method"`
+	Arg                   *[]byte              `ic:"arg,omitempty" json:"arg,omitempty"`
+	ExecutionMethodCycles *uint64              `ic:"execution_method_cycles,omitempty" json:"execution_method_cycles,omitempty"`
+}
+
+// The input of an Orbit station's create_request for a CallExternalCanister operation, see
+// https://github.com/dfinity/orbit/blob/main/core/station/api/spec.did
+type orbitCreateRequestInput struct {
+	Operation struct {
+		CallExternalCanister *orbitCallExternalCanisterInput `ic:"CallExternalCanister,variant"`
+	} `ic:"operation" json:"operation"`
+	Title         *string `ic:"title,omitempty" json:"title,omitempty"`
+	Summary       *string `ic:"summary,omitempty" json:"summary,omitempty"`
+	ExecutionPlan *struct {
+		Immediate *idl.Null `ic:"Immediate,variant"`
+	} `ic:"execution_plan,omitempty" json:"execution_plan,omitempty"`
+}
+
+// Calls method of the management canister with arg (and cycles attached) through the Orbit
+// station: the call is submitted as a CallExternalCanister request, which is executed by
+// the station once approved according to its policies. Returns the reply of the call.
+func orbitCall(ctx context.Context, config agent.Config, station managementProxy, method string, arg []byte, cycles uint64) ([]byte, error) {
+	var input orbitCreateRequestInput
+	input.Operation.CallExternalCanister = &orbitCallExternalCanisterInput{
+		ExecutionMethod: orbitCanisterMethod{CanisterId: ic.MANAGEMENT_CANISTER_PRINCIPAL, MethodName: method},
+		Arg:             &arg,
+	}
+	if cycles > 0 {
+		input.Operation.CallExternalCanister.ExecutionMethodCycles = &cycles
+	}
+	title := "Terraform: " + method
+	summary := fmt.Sprintf("Call %s of the management canister, submitted by the Terraform IC provider.", method)
+	input.Title = &title
+	input.Summary = &summary
+	input.ExecutionPlan = &struct {
+		Immediate *idl.Null `ic:"Immediate,variant"`
+	}{Immediate: new(idl.Null)}
+
+	inputRaw, err := idl.Marshal([]any{input})
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := CallRaw(config, station.CanisterId, "create_request", inputRaw)
+	if err != nil {
+		return nil, fmt.Errorf("could not submit Orbit request: %w", err)
+	}
+
+	request, err := orbitRequestResult(raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not submit Orbit request: %w", err)
+	}
+
+	requestId, _ := candidField(request, "id").(string)
+	tflog.Info(ctx, fmt.Sprintf("Submitted Orbit request %s to call %s, waiting for it to be approved and executed", requestId, method))
+
+	timeout := station.ApprovalTimeout
+	if timeout == 0 {
+		timeout = defaultOrbitApprovalTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		status, ok := candidField(request, "status").(*idl.Variant)
+		if !ok {
+			return nil, fmt.Errorf("unexpected Orbit request %v", request)
+		}
+
+		switch status.Name {
+		case idl.HashString(orbitStatusCompleted):
+			operation, ok := candidField(request, "operation").(*idl.Variant)
+			if !ok || operation.Name != idl.HashString("CallExternalCanister") {
+				return nil, fmt.Errorf("unexpected operation of Orbit request %s", requestId)
+			}
+			return candidBlob(candidField(operation.Value, "execution_method_reply")), nil
+		case idl.HashString(orbitStatusRejected):
+			return nil, fmt.Errorf("Orbit request %s was rejected", requestId)
+		case idl.HashString(orbitStatusCancelled), idl.HashString(orbitStatusFailed):
+			reason, _ := candidField(status.Value, "reason").(string)
+			return nil, fmt.Errorf("Orbit request %s was cancelled or failed: %s", requestId, reason)
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Orbit request %s was not executed within %s, it can still be approved in the station", requestId, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("stopped waiting for Orbit request %s, it can still be approved in the station: %w", requestId, ctx.Err())
+		case <-time.After(orbitPollInterval):
+		}
+
+		getRaw, err := idl.Marshal([]any{struct {
+			RequestId string `ic:"request_id" json:"request_id"`
+		}{RequestId: requestId}})
+		if err != nil {
+			return nil, err
+		}
+
+		raw, err := QueryRaw(config, station.CanisterId, "get_request", getRaw)
+		if err != nil {
+			return nil, fmt.Errorf("could not read Orbit request %s: %w", requestId, err)
+		}
+
+		request, err = orbitRequestResult(raw)
+		if err != nil {
+			return nil, fmt.Errorf("could not read Orbit request %s: %w", requestId, err)
+		}
+	}
+}
+
+// Returns the request of the result of create_request or get_request, i.e.
+// variant { Ok : record { request : Request; ... }; Err : Error }.
+func orbitRequestResult(raw []byte) (any, error) {
+	_, values, err := idl.Decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("no result returned")
+	}
+
+	result, ok := values[0].(*idl.Variant)
+	if !ok {
+		return nil, fmt.Errorf("unexpected result %v", values[0])
+	}
+	if result.Name != idl.HashString("Ok") {
+		code, _ := candidField(result.Value, "code").(string)
+		message, _ := candidField(result.Value, "message").(string)
+		return nil, fmt.Errorf("%s", strings.TrimSuffix(code+": "+message, ": "))
+	}
+
+	return candidField(result.Value, "request"), nil
+}
+
+// Returns a generically decoded candid blob (nil if not a blob).
+func candidBlob(value any) []byte {
+	if b, ok := value.([]byte); ok {
+		return b
+	}
+
+	values, ok := value.([]any)
+	if !ok {
+		return nil
+	}
+	blob := make([]byte, 0, len(values))
+	for _, v := range values {
+		b, ok := v.(uint8)
+		if !ok {
+			return nil
+		}
+		blob = append(blob, b)
+	}
+	return blob
+}
+
+// Reads the status of a canister controlled by the Orbit station with its canister_status.
+func orbitCanisterStatus(a *agent.Agent, stationId principal.Principal, canisterId principal.Principal) (*icMgmt.CanisterStatusResult, error) {
+	var res struct {
+		Ok  *icMgmt.CanisterStatusResult `ic:"Ok,variant"`
+		Err *map[string]any              `ic:"Err,variant"`
+	}
+	err := a.Call(stationId, "canister_status", []any{struct {
+		CanisterId principal.Principal `ic:"canister_id" json:"canister_id"`
+	}{CanisterId: canisterId}}, []any{&res})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Ok == nil {
+		var errRecord any
+		if res.Err != nil {
+			errRecord = *res.Err
+		}
+		code, _ := candidField(errRecord, "code").(string)
+		message, _ := candidField(errRecord, "message").(string)
+		return nil, fmt.Errorf("Orbit station %s could not read the status of %s: %s", stationId.Encode(), canisterId.Encode(), strings.TrimSuffix(code+": "+message, ": "))
+	}
+
+	return res.Ok, nil
+}
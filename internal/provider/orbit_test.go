@@ -0,0 +1,78 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Replays an Orbit request that is never approved, checking that cancelling the operation
+// stops waiting for it.
+func TestOrbitCallCancelled(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	const stationId = "ryjl3-tyaaa-aaaaa-aaaba-cai"
+
+	type request struct {
+		Id     string `ic:"id"`
+		Status struct {
+			Created *idl.Null `ic:"Created,variant"`
+		} `ic:"status"`
+	}
+	var created struct {
+		Ok *struct {
+			Request request `ic:"request"`
+		} `ic:"Ok,variant"`
+		Err *struct {
+			Code string `ic:"code"`
+		} `ic:"Err,variant"`
+	}
+	created.Ok = &struct {
+		Request request `ic:"request"`
+	}{Request: request{Id: "0e7e1b5d"}}
+	created.Ok.Request.Status.Created = new(idl.Null)
+	reply, err := idl.Marshal([]any{created})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixture := agentFixture{Interactions: []agentInteraction{
+		{Type: "call", CanisterId: stationId, Method: "create_request", Reply: reply},
+	}}
+	fixture.replayed = make([]bool, len(fixture.Interactions))
+	backend, err := newMockBackend("", mockState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.replay = &fixture
+	host, _ := url.Parse("mock://" + strings.ToLower(t.Name()))
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, func(http.RoundTripper) http.RoundTripper {
+		return &mockTransport{backend: backend}
+	}))
+	config := agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		FetchRootKey: true,
+		PollDelay:    10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = orbitCall(ctx, config, managementProxy{CanisterId: principal.MustDecode(stationId), Orbit: true}, "start_canister", []byte("DIDL\x00\x00"), 0)
+	if err == nil || !strings.Contains(err.Error(), "stopped waiting for Orbit request 0e7e1b5d") {
+		t.Fatalf("expected the wait to be cancelled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= orbitPollInterval {
+		t.Errorf("expected the wait to stop when cancelled, took %s", elapsed)
+	}
+}
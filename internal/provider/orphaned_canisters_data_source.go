@@ -0,0 +1,404 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// The ICP index canister (mainnet)
+var icpIndexPrincipal, _ = principal.Decode("qhbym-qaaaa-aaaaa-aaafq-cai")
+
+// Number of transactions fetched per index canister request, and scanned by default
+const (
+	indexPageSize             = 100
+	defaultMaxTransactionScan = 1000
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &OrphanedCanistersDataSource{}
+
+func NewOrphanedCanistersDataSource() datasource.DataSource {
+	return &OrphanedCanistersDataSource{}
+}
+
+// OrphanedCanistersDataSource lists the canisters controlled by a principal that are not
+// recorded in any apply summary, e.g. canisters created by applies that crashed before
+// saving their state, as well as the ICP transfers made to the CMC to create canisters.
+type OrphanedCanistersDataSource struct {
+	config *agent.Config
+
+	cmcSettings CmcSettings
+}
+
+// OrphanedCanistersDataSourceModel describes the data source data model.
+type OrphanedCanistersDataSourceModel struct {
+	ApplySummaryFiles types.List   `tfsdk:"apply_summary_files"`
+	Controller        types.String `tfsdk:"controller"`
+	ApiUrl            types.String `tfsdk:"api_url"`
+	ScanTransfers     types.Bool   `tfsdk:"scan_transfers"`
+	IndexCanisterId   types.String `tfsdk:"index_canister_id"`
+	MaxTransactions   types.Int64  `tfsdk:"max_transactions"`
+	ReadStrategy      types.String `tfsdk:"read_strategy"`
+	CanisterIds       types.List   `tfsdk:"canister_ids"`
+	CreateTransfers   types.List   `tfsdk:"create_transfers"`
+}
+
+var createTransferAttrTypes = map[string]attr.Type{
+	"block_index":     types.Int64Type,
+	"amount_e8s":      types.Int64Type,
+	"timestamp_nanos": types.Int64Type,
+}
+
+// An ICP transfer to the CMC for the creation of a canister, as listed by the index.
+type createTransfer struct {
+	BlockIndex     uint64
+	AmountE8s      uint64
+	TimestampNanos uint64
+}
+
+func (d *OrphanedCanistersDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_orphaned_canisters"
+}
+
+func (d *OrphanedCanistersDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Lists the mainnet canisters controlled by a principal (by default the provider's principal) that are not recorded in any of the apply summaries (see the provider's `apply_summary_file`), " +
+			"e.g. canisters created by applies that were interrupted before the canister was saved in the state. The controlled canisters are listed with the public IC dashboard API, which may lag behind the state of the canisters. " +
+			"Optionally, the ICP transfers made to the cycles minting canister (CMC) to create canisters are listed as well, so that transfers that were never turned into a canister can be recovered by calling the CMC's `notify_create_canister` with their block index.",
+
+		Attributes: map[string]schema.Attribute{
+			"apply_summary_files": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Required:            true,
+				MarkdownDescription: "Paths to the apply summaries of all the configurations using the principal. Missing apply summaries are ignored.",
+			},
+			"controller": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Principal controlling (and creating) the canisters. Defaults to the principal used by the provider.",
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"api_url": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Base URL of the dashboard API. Defaults to `" + defaultDashboardApiUrl + "`.",
+			},
+			"scan_transfers": schema.BoolAttribute{
+				Optional:            true,
+				MarkdownDescription: "Whether to list the ICP transfers made by the principal (from its default account) to the CMC to create canisters, i.e. with the provider's `cmc_create_canister_memo`. Defaults to `false`.",
+			},
+			"index_canister_id": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "ICP index canister used to list the transfers. Defaults to the mainnet index canister (`" + icpIndexPrincipal.Encode() + "`).",
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"max_transactions": schema.Int64Attribute{
+				Optional:            true,
+				MarkdownDescription: fmt.Sprintf("Maximum number of the principal's (most recent) transactions scanned for transfers to the CMC. Defaults to %d.", defaultMaxTransactionScan),
+				Validators: []validator.Int64{
+					int64validator.AtLeast(1),
+				},
+			},
+			"read_strategy": readStrategyAttribute("How the transactions are read from the index canister when `scan_transfers` is set: `query` reads them with queries (faster, but answered by a single replica), `certified` with update calls, whose replies are certified by the subnet. Defaults to `query`."),
+			"canister_ids": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Identifiers of the canisters controlled by `controller` that are not recorded in the apply summaries",
+			},
+			"create_transfers": schema.ListNestedAttribute{
+				Computed:            true,
+				MarkdownDescription: "ICP transfers made by `controller` to the CMC to create canisters, most recent first. Null unless `scan_transfers` is set.",
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"block_index": schema.Int64Attribute{
+							Computed:            true,
+							MarkdownDescription: "Ledger block index of the transfer",
+						},
+						"amount_e8s": schema.Int64Attribute{
+							Computed:            true,
+							MarkdownDescription: "Amount transferred, in e8s",
+						},
+						"timestamp_nanos": schema.Int64Attribute{
+							Computed:            true,
+							MarkdownDescription: "Time of the transfer, in nanoseconds since the epoch",
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func (d *OrphanedCanistersDataSource) Configure(ctx context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.config = providerData.Config
+	d.cmcSettings = providerData.Cmc
+}
+
+func (d *OrphanedCanistersDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data OrphanedCanistersDataSourceModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if data.Controller.IsNull() {
+		data.Controller = types.StringValue(d.config.Identity.Sender().Encode())
+	}
+
+	controller, err := principal.Decode(data.Controller.ValueString())
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode controller", err))
+		return
+	}
+
+	var files []string
+	resp.Diagnostics.Append(data.ApplySummaryFiles.ElementsAs(ctx, &files, false)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	known := map[string]bool{}
+	for _, file := range files {
+		canisterIds, err := readApplySummaryCanisterIds(file)
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("", err))
+			return
+		}
+		for _, canisterId := range canisterIds {
+			known[canisterId] = true
+		}
+	}
+
+	apiUrl := defaultDashboardApiUrl
+	if !data.ApiUrl.IsNull() {
+		apiUrl = data.ApiUrl.ValueString()
+	}
+
+	controlled, err := fetchDashboardControlledCanisters(ctx, apiUrl, controller)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not list canisters", err))
+		return
+	}
+
+	canisterIds := []string{}
+	for _, canisterId := range controlled {
+		if !known[canisterId] {
+			canisterIds = append(canisterIds, canisterId)
+		}
+	}
+	sort.Strings(canisterIds)
+
+	canisterIdsValue, diags := types.ListValueFrom(ctx, types.StringType, canisterIds)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	data.CanisterIds = canisterIdsValue
+
+	data.CreateTransfers = types.ListNull(types.ObjectType{AttrTypes: createTransferAttrTypes})
+	if data.ScanTransfers.ValueBool() {
+		indexId := icpIndexPrincipal
+		if !data.IndexCanisterId.IsNull() {
+			indexId, err = principal.Decode(data.IndexCanisterId.ValueString())
+			if err != nil {
+				resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode index canister id", err))
+				return
+			}
+		}
+
+		maxTransactions := uint64(defaultMaxTransactionScan)
+		if !data.MaxTransactions.IsNull() {
+			maxTransactions = uint64(data.MaxTransactions.ValueInt64())
+		}
+
+		certified, diags := certifiedReadStrategy(ctx, "The index canister "+indexId.Encode(), data.ReadStrategy, false)
+		resp.Diagnostics.Append(diags...)
+
+		transfers, err := fetchCreateTransfers(ctx, *d.config, certified, indexId, controller, d.cmcSettings.CreateCanisterMemo, maxTransactions)
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not list transfers to the CMC", err))
+			return
+		}
+
+		transferValues := []attr.Value{}
+		for _, transfer := range transfers {
+			transferValue, diags := types.ObjectValue(createTransferAttrTypes, map[string]attr.Value{
+				"block_index":     types.Int64Value(int64(transfer.BlockIndex)),
+				"amount_e8s":      types.Int64Value(int64(transfer.AmountE8s)),
+				"timestamp_nanos": types.Int64Value(int64(transfer.TimestampNanos)),
+			})
+			resp.Diagnostics.Append(diags...)
+			if resp.Diagnostics.HasError() {
+				return
+			}
+			transferValues = append(transferValues, transferValue)
+		}
+
+		data.CreateTransfers, diags = types.ListValue(types.ObjectType{AttrTypes: createTransferAttrTypes}, transferValues)
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Returns the ids of the canisters recorded in the apply summary, or nil if the apply
+// summary does not exist.
+func readApplySummaryCanisterIds(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not read apply summary: %w", err)
+	}
+
+	var manifest ApplySummaryManifest
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse apply summary %s: %w", file, err)
+	}
+
+	canisterIds := []string{}
+	for id := range manifest.Canisters {
+		canisterIds = append(canisterIds, id)
+	}
+
+	return canisterIds, nil
+}
+
+type getAccountIdentifierTransactionsArgs struct {
+	MaxResults        uint64  `ic:"max_results"`
+	Start             *uint64 `ic:"start,omitempty"`
+	AccountIdentifier string  `ic:"account_identifier"`
+}
+
+// Lists the transfers from the controller's default account to the CMC account used to
+// create canisters controlled by the controller, with the given memo. At most
+// maxTransactions of the controller's transactions are scanned, most recent first, with
+// queries or (if certified) update calls.
+// NOTE: the reply of the index canister's get_account_identifier_transactions is decoded
+// generically, since the agent-go (v0.4.4) bindings don't cover the index canister.
+func fetchCreateTransfers(ctx context.Context, config agent.Config, certified bool, indexId principal.Principal, controller principal.Principal, memo uint64, maxTransactions uint64) ([]createTransfer, error) {
+	from := principal.NewAccountID(controller, [32]byte{}).Encode()
+	to := cmcCreateCanisterAccount(controller).Encode()
+
+	transfers := []createTransfer{}
+	var start *uint64
+	for scanned := uint64(0); scanned < maxTransactions; {
+		arg, err := idl.Marshal([]any{getAccountIdentifierTransactionsArgs{
+			MaxResults:        min(indexPageSize, maxTransactions-scanned),
+			Start:             start,
+			AccountIdentifier: from,
+		}})
+		if err != nil {
+			return nil, err
+		}
+
+		tflog.Info(ctx, fmt.Sprintf("Listing transactions of %s (%d scanned)", from, scanned))
+		raw, err := readCanisterRaw(config, certified, indexId, "get_account_identifier_transactions", arg)
+		if err != nil {
+			return nil, err
+		}
+
+		_, values, err := idl.Decode(raw)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode transactions: %w", err)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("no transactions returned")
+		}
+
+		result, ok := values[0].(*idl.Variant)
+		if !ok {
+			return nil, fmt.Errorf("unexpected reply %v", values[0])
+		}
+		if result.Name != idl.HashString("Ok") {
+			return nil, fmt.Errorf("index error: %v", candidField(result.Value, "message"))
+		}
+
+		transactions, _ := candidField(result.Value, "transactions").([]any)
+		for _, tx := range transactions {
+			id, _ := candidField(tx, "id").(uint64)
+			start = &id
+
+			transaction := candidField(tx, "transaction")
+			if txMemo, _ := candidField(transaction, "memo").(uint64); txMemo != memo {
+				continue
+			}
+
+			operation, ok := candidField(transaction, "operation").(*idl.Variant)
+			if !ok || operation.Name != idl.HashString("Transfer") {
+				continue
+			}
+			if candidField(operation.Value, "from") != from || candidField(operation.Value, "to") != to {
+				continue
+			}
+
+			amountE8s, _ := candidField(candidField(operation.Value, "amount"), "e8s").(uint64)
+			timestampNanos, _ := candidField(candidField(transaction, "timestamp"), "timestamp_nanos").(uint64)
+			transfers = append(transfers, createTransfer{BlockIndex: id, AmountE8s: amountE8s, TimestampNanos: timestampNanos})
+		}
+
+		scanned += uint64(len(transactions))
+		if len(transactions) == 0 {
+			break
+		}
+	}
+
+	return transfers, nil
+}
+
+// Returns the field of a generically decoded candid record (nil if absent).
+func candidField(record any, name string) any {
+	fields, ok := record.(map[string]any)
+	if !ok {
+		return nil
+	}
+
+	value, ok := fields[idl.HashString(name)]
+	if !ok {
+		value = fields[name]
+	}
+	return value
+}
@@ -0,0 +1,71 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+)
+
+func TestOrphanedCanistersDataSource(t *testing.T) {
+
+	controller := "r7inp-6aaaa-aaaaa-aaabq-cai"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v3/canisters" || r.URL.Query().Get("controller_id") != controller {
+			http.NotFound(w, r)
+			return
+		}
+
+		page := dashboardCanisterPage{TotalCanisters: 3, Data: []dashboardCanister{
+			{CanisterId: "ryjl3-tyaaa-aaaaa-aaaba-cai"},
+			{CanisterId: "rrkah-fqaaa-aaaaa-aaaaq-cai"},
+			{CanisterId: "rkp4c-7iaaa-aaaaa-aaaca-cai"},
+		}}
+		_ = json.NewEncoder(w).Encode(page)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	summary := path.Join(dir, "summary.json")
+
+	err := os.WriteFile(summary, []byte(`{
+  "network": "https://icp-api.io/",
+  "identity": "r7inp-6aaaa-aaaaa-aaabq-cai",
+  "updated_at": "2024-01-01T00:00:00Z",
+  "canisters": {
+    "ryjl3-tyaaa-aaaaa-aaaba-cai": { "id": "ryjl3-tyaaa-aaaaa-aaaba-cai" }
+  }
+}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: fmt.Sprintf(`
+data "ic_orphaned_canisters" "test" {
+    apply_summary_files = [ "%s", "%s" ]
+    controller = "%s"
+    api_url = "%s"
+}
+`, summary, path.Join(dir, "missing.json"), controller, server.URL),
+				Check: resource.ComposeAggregateTestCheckFunc(
+					resource.TestCheckResourceAttr("data.ic_orphaned_canisters.test", "canister_ids.#", "2"),
+					resource.TestCheckResourceAttr("data.ic_orphaned_canisters.test", "canister_ids.0", "rkp4c-7iaaa-aaaaa-aaaca-cai"),
+					resource.TestCheckResourceAttr("data.ic_orphaned_canisters.test", "canister_ids.1", "rrkah-fqaaa-aaaaa-aaaaq-cai"),
+					resource.TestCheckNoResourceAttr("data.ic_orphaned_canisters.test", "create_transfers"),
+				),
+			},
+		},
+	})
+}
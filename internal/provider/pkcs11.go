@@ -0,0 +1,135 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// Environment variable holding the PIN of the PKCS#11 token
+const pkcs11PinEnv = "IC_PKCS11_PIN"
+
+// Pkcs11Signer signs messages with a prime256v1 (P-256) key of a PKCS#11 token (e.g. an HSM).
+//
+// The token is accessed through OpenSC's pkcs11-tool, which must be installed, so that the
+// provider doesn't need to load the PKCS#11 module itself. The PIN is read by pkcs11-tool
+// from the IC_PKCS11_PIN environment variable (and never appears on the command line).
+//
+// Each signature starts a pkcs11-tool process, which loads the module and logs in to the
+// token (pkcs11-tool can't keep a session open across processes). Every request is signed,
+// including the read_state requests polling the status of calls, so a run signs at least
+// twice per call: raise poll_interval to sign less often with slow tokens.
+type Pkcs11Signer struct {
+	Module   string // path to the PKCS#11 module (shared library)
+	Slot     int64  // slot of the token
+	KeyLabel string // label of the key pair
+}
+
+func (s Pkcs11Signer) run(args ...string) ([]byte, error) {
+	if len(os.Getenv(pkcs11PinEnv)) == 0 {
+		return nil, fmt.Errorf("%s is not set", pkcs11PinEnv)
+	}
+
+	args = append([]string{
+		"--module", s.Module,
+		"--slot", strconv.FormatInt(s.Slot, 10),
+		"--label", s.KeyLabel,
+		"--login", "--pin", "env:" + pkcs11PinEnv,
+	}, args...)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("pkcs11-tool", args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("pkcs11-tool failed: %w: %s", err, stderr.String())
+	}
+
+	return out, nil
+}
+
+// Reads the public key of the key pair, which pkcs11-tool returns either as a (DER-encoded)
+// SubjectPublicKeyInfo or as an EC point.
+func (s Pkcs11Signer) PublicKey() ([]byte, error) {
+	der, err := s.run("--read-object", "--type", "pubkey")
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(der)
+	if err == nil {
+		if key, ok := publicKey.(*ecdsa.PublicKey); !ok || key.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("key %s is not a prime256v1 key", s.KeyLabel)
+		}
+		return der, nil
+	}
+
+	// The EC point may be wrapped in an octet string
+	point := der
+	var unwrapped []byte
+	if rest, err := asn1.Unmarshal(der, &unwrapped); err == nil && len(rest) == 0 {
+		point = unwrapped
+	}
+
+	x, y := elliptic.Unmarshal(elliptic.P256(), point)
+	if x == nil {
+		return nil, fmt.Errorf("key %s is not a prime256v1 key", s.KeyLabel)
+	}
+
+	return x509.MarshalPKIXPublicKey(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y})
+}
+
+// Signs the sha256 of the message with the ECDSA mechanism, which returns r || s.
+func (s Pkcs11Signer) Sign(msg []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "terraform-provider-ic-pkcs11-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "hash")
+	output := filepath.Join(dir, "signature")
+
+	hash := sha256.Sum256(msg)
+	err = os.WriteFile(input, hash[:], 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.run("--sign", "--mechanism", "ECDSA", "--input-file", input, "--output-file", output)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := os.ReadFile(output)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sig) != 64 {
+		return nil, fmt.Errorf("expected a 64 bytes signature, got %d bytes", len(sig))
+	}
+
+	// Normalize s to the lower half of the curve order (both forms are valid, the low one
+	// is canonical)
+	n := elliptic.P256().Params().N
+	sigS := new(big.Int).SetBytes(sig[32:])
+	if sigS.Cmp(new(big.Int).Rsh(n, 1)) > 0 {
+		sigS.Sub(n, sigS)
+		sigS.FillBytes(sig[32:])
+	}
+
+	return sig, nil
+}
@@ -0,0 +1,240 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The network (see network) of a PocketIC instance.
+const pocketIcNetwork = "pocketic"
+
+// How long a PocketIC server launched by the provider keeps running without requests, so
+// that subsequent runs (e.g. plan, then apply) use the same server and instance.
+const pocketIcServerTtl = time.Hour
+
+// How long to wait for a PocketIC server launched by the provider to start.
+const pocketIcStartTimeout = 30 * time.Second
+
+var pocketIcClient = &http.Client{Timeout: 5 * time.Minute}
+
+// A PocketIC instance (and its HTTP gateway) created by the provider, recorded so that
+// subsequent runs use the same instance rather than starting from a blank network.
+type pocketIcInstance struct {
+	ServerUrl  string `json:"server_url"`
+	InstanceId uint64 `json:"instance_id"`
+	GatewayUrl string `json:"gateway_url"`
+}
+
+// Returns the path of a file of the provider shared by runs, in the temporary directory.
+func pocketIcFile(name string) string {
+	return filepath.Join(os.TempDir(), "terraform-provider-ic-pocketic-"+name)
+}
+
+// Returns the endpoint of the HTTP gateway of a PocketIC instance, creating the instance
+// on the server at serverUrl, or, if serverUrl is empty, on a server launched with the
+// PocketIC binary (unless a server launched by a previous run is still running).
+//
+// The instance has an NNS and an application subnet, and its time progresses automatically.
+// It is reused by subsequent runs as long as its server is running.
+func pocketIcEndpoint(serverUrl string, binary string) (string, error) {
+	if len(serverUrl) == 0 {
+		var err error
+		serverUrl, err = startPocketIcServer(binary)
+		if err != nil {
+			return "", err
+		}
+	}
+	serverUrl = strings.TrimSuffix(serverUrl, "/")
+
+	serverHash := sha256.Sum256([]byte(serverUrl))
+	instanceFile := pocketIcFile(hex.EncodeToString(serverHash[:8]) + ".json")
+
+	if data, err := os.ReadFile(instanceFile); err == nil {
+		var instance pocketIcInstance
+		if json.Unmarshal(data, &instance) == nil && pocketIcAlive(instance.GatewayUrl+"/api/v2/status") {
+			return instance.GatewayUrl, nil
+		}
+	}
+
+	instance, err := createPocketIcInstance(serverUrl)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return "", err
+	}
+	err = os.WriteFile(instanceFile, data, 0600)
+	if err != nil {
+		return "", fmt.Errorf("Could not record PocketIC instance: %w", err)
+	}
+
+	return instance.GatewayUrl, nil
+}
+
+// Whether a GET request to the URL succeeds.
+func pocketIcAlive(url string) bool {
+	res, err := (&http.Client{Timeout: 5 * time.Second}).Get(url)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusOK
+}
+
+// Returns the URL of the PocketIC server launched by the provider, launching it if it
+// isn't running. The server stops after pocketIcServerTtl without requests.
+func startPocketIcServer(binary string) (string, error) {
+	portFile := pocketIcFile("server.port")
+
+	readServerUrl := func() (string, bool) {
+		data, err := os.ReadFile(portFile)
+		if err != nil {
+			return "", false
+		}
+		port, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 16)
+		if err != nil {
+			return "", false
+		}
+		url := fmt.Sprintf("http://127.0.0.1:%d", port)
+		return url, pocketIcAlive(url + "/status")
+	}
+
+	if url, ok := readServerUrl(); ok {
+		return url, nil
+	}
+
+	// The server writes its port once it is ready
+	err := os.Remove(portFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	cmd := exec.Command(binary, "--port-file", portFile, "--ttl", strconv.Itoa(int(pocketIcServerTtl.Seconds())))
+	err = cmd.Start()
+	if err != nil {
+		return "", fmt.Errorf("Could not launch PocketIC server %s (set pocketic_bin or POCKET_IC_BIN to the PocketIC binary): %w", binary, err)
+	}
+	// The server outlives the provider, until its TTL expires
+	go func() { _ = cmd.Wait() }()
+
+	deadline := time.Now().Add(pocketIcStartTimeout)
+	for time.Now().Before(deadline) {
+		if url, ok := readServerUrl(); ok {
+			return url, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return "", fmt.Errorf("PocketIC server %s did not start within %s", binary, pocketIcStartTimeout)
+}
+
+// Sends a request to the PocketIC server's REST API and decodes the JSON response, either
+// { "Created": ... } (decoded into result) or { "Error": { "message": ... } }.
+func pocketIcRequest(url string, body any, result any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	res, err := pocketIcClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err = io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s: %s: %s", url, res.Status, strings.TrimSpace(string(data)))
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	var response struct {
+		Created json.RawMessage `json:"Created"`
+		Error   *struct {
+			Message string `json:"message"`
+		} `json:"Error"`
+	}
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return fmt.Errorf("%s: unexpected response %s", url, string(data))
+	}
+	if response.Error != nil {
+		return fmt.Errorf("%s: %s", url, response.Error.Message)
+	}
+
+	return json.Unmarshal(response.Created, result)
+}
+
+// Creates an instance with an NNS and an application subnet on the PocketIC server, makes
+// its time progress automatically and creates an HTTP gateway for it.
+func createPocketIcInstance(serverUrl string) (pocketIcInstance, error) {
+	subnet := map[string]any{"state_config": "New", "instruction_config": "Production", "dts_flag": "Enabled"}
+
+	var created struct {
+		InstanceId uint64 `json:"instance_id"`
+	}
+	err := pocketIcRequest(serverUrl+"/instances", map[string]any{
+		"subnet_config_set": map[string]any{
+			"nns":                  subnet,
+			"sns":                  nil,
+			"ii":                   nil,
+			"fiduciary":            nil,
+			"bitcoin":              nil,
+			"system":               []any{},
+			"application":          []any{subnet},
+			"verified_application": []any{},
+		},
+		"nonmainnet_features": false,
+	}, &created)
+	if err != nil {
+		return pocketIcInstance{}, fmt.Errorf("Could not create PocketIC instance: %w", err)
+	}
+
+	err = pocketIcRequest(fmt.Sprintf("%s/instances/%d/auto_progress", serverUrl, created.InstanceId), map[string]any{"artificial_delay_ms": nil}, nil)
+	if err != nil {
+		return pocketIcInstance{}, fmt.Errorf("Could not make PocketIC instance %d progress: %w", created.InstanceId, err)
+	}
+
+	var gateway struct {
+		Port uint16 `json:"port"`
+	}
+	err = pocketIcRequest(serverUrl+"/http_gateway", map[string]any{
+		"ip_addr":      nil,
+		"port":         nil,
+		"forward_to":   map[string]any{"PocketIcInstance": created.InstanceId},
+		"domains":      nil,
+		"https_config": nil,
+	}, &gateway)
+	if err != nil {
+		return pocketIcInstance{}, fmt.Errorf("Could not create HTTP gateway of PocketIC instance %d: %w", created.InstanceId, err)
+	}
+
+	return pocketIcInstance{
+		ServerUrl:  serverUrl,
+		InstanceId: created.InstanceId,
+		GatewayUrl: fmt.Sprintf("http://127.0.0.1:%d", gateway.Port),
+	}, nil
+}
@@ -0,0 +1,87 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// CanisterPolicy describes the guardrails enforced on every ic_canister when planning
+// (required_labels, forbidden_controllers, require_explicit_controllers), e.g. set by
+// platform teams in shared provider configurations.
+type CanisterPolicy struct {
+	RequiredLabels             []string // label keys every canister must set
+	ForbiddenControllers       []string // principals that must not control any canister
+	RequireExplicitControllers bool     // new canisters must set their controllers
+}
+
+// Checks that the canister's labels (if known) include the required labels.
+func (p CanisterPolicy) CheckLabels(ctx context.Context, data *CanisterResourceModel) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if len(p.RequiredLabels) == 0 || data.Labels.IsUnknown() {
+		return diags
+	}
+
+	labels := map[string]string{}
+	if !data.Labels.IsNull() {
+		diags.Append(data.Labels.ElementsAs(ctx, &labels, true)...)
+		if diags.HasError() {
+			return diags
+		}
+	}
+
+	var missing []string
+	for _, key := range p.RequiredLabels {
+		if _, ok := labels[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) > 0 {
+		diags.AddAttributeError(path.Root("labels"), "Missing required labels",
+			fmt.Sprintf("The provider's required_labels policy requires every canister to set the labels %s, missing: %s.", strings.Join(p.RequiredLabels, ", "), strings.Join(missing, ", ")))
+	}
+
+	return diags
+}
+
+// Checks that none of the (resulting) controllers of the canister is forbidden.
+func (p CanisterPolicy) CheckControllers(controllers []string) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	for _, controller := range controllers {
+		if slices.Contains(p.ForbiddenControllers, controller) {
+			diags.AddAttributeError(path.Root("controllers"), "Forbidden controller",
+				fmt.Sprintf("%s must not control canisters, as per the provider's forbidden_controllers policy.", controller))
+		}
+	}
+
+	return diags
+}
+
+// Checks that a new canister sets its controllers (configControllers being null) if
+// required, rather than defaulting to providerController. The canister's own setting
+// (if not null) overrides the policy.
+func (p CanisterPolicy) CheckExplicitControllers(configControllers types.List, require types.Bool, attributePath path.Path, providerController string) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	required := p.RequireExplicitControllers
+	if !require.IsNull() && !require.IsUnknown() {
+		required = require.ValueBool()
+	}
+
+	if required && configControllers.IsNull() {
+		diags.AddAttributeError(attributePath, "Missing controllers",
+			fmt.Sprintf("Controllers must be set explicitly, as per require_explicit_controllers, instead of defaulting to the provider's principal %s.", providerController))
+	}
+
+	return diags
+}
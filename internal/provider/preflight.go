@@ -0,0 +1,151 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/ic"
+	ledger "github.com/aviate-labs/agent-go/ic/icpledger"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Preflight checks, when planning, that an apply can succeed before anything is mutated:
+// that the identity can pay for the canisters created (on mainnet) and that it controls
+// the canisters modified or deleted. Every resource is checked when it is planned, so
+// all the failures are reported by the plan instead of one at a time midway through an
+// apply.
+//
+// The ICP needed by all the creations planned so far is accumulated (per funding account)
+// and compared with the balance of the account, which is read once.
+type Preflight struct {
+	mu sync.Mutex
+
+	costE8s map[uint64]uint64 // ICP needed per creation (incl. the transfer fee), by cycles
+
+	balanceE8s map[string]uint64 // by funding account
+	plannedE8s map[string]uint64 // by funding account
+	creations  map[string]uint64 // by funding account
+}
+
+func NewPreflight() *Preflight {
+	return &Preflight{
+		costE8s:    map[uint64]uint64{},
+		balanceE8s: map[string]uint64{},
+		plannedE8s: map[string]uint64{},
+		creations:  map[string]uint64{},
+	}
+}
+
+// Checks that the funding account holds enough ICP to create a canister with the given
+// cycles (0 for the default amount) as well as all the other canisters planned so far.
+// Only CMC creations (on mainnet) cost ICP.
+func (p *Preflight) CheckCreation(ctx context.Context, config agent.Config, settings CmcSettings, cycles uint64) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if config.ClientConfig == nil || withoutEndpointAlias(config.ClientConfig.Host).String() != icpApi.String() {
+		return diags
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	costE8s, ok := p.costE8s[cycles]
+	if !ok {
+		amountE8s, err := cmcCreateCanisterAmountE8s(config, settings, cycles)
+		if err != nil {
+			diags.AddWarning("Preflight check skipped", "Could not estimate the cost of canister creation: "+err.Error())
+			return diags
+		}
+		costE8s = amountE8s + settings.TransferFeeE8s
+		p.costE8s[cycles] = costE8s
+	}
+
+	account := settings.FundingAccount(config.Identity.Sender())
+	key := account.String()
+
+	balance, ok := p.balanceE8s[key]
+	if !ok {
+		var err error
+		balance, err = icpBalanceE8s(config, account)
+		if err != nil {
+			diags.AddWarning("Preflight check skipped", "Could not read the ICP balance: "+err.Error())
+			return diags
+		}
+		p.balanceE8s[key] = balance
+	}
+
+	p.creations[key]++
+	p.plannedE8s[key] += costE8s
+
+	tflog.Info(ctx, fmt.Sprintf("Preflight: %d canister creations funded by %s need about %s ICP, balance is %s ICP",
+		p.creations[key], key, formatE8s(p.plannedE8s[key]), formatE8s(balance)))
+
+	if p.plannedE8s[key] > balance {
+		diags.AddError("Preflight check failed",
+			fmt.Sprintf("The %d canister creations planned so far cost about %s ICP (at the current conversion rate, including transfer fees), "+
+				"but the account %s only holds %s ICP.",
+				p.creations[key], formatE8s(p.plannedE8s[key]), key, formatE8s(balance)))
+	}
+
+	return diags
+}
+
+// Checks that controller (the identity's principal, or its cycles wallet) controls the
+// canister, i.e. that the canister can be modified or deleted.
+func (p *Preflight) CheckControl(ctx context.Context, config agent.Config, canisterId string, controller string) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	id, err := principal.Decode(canisterId)
+	if err != nil {
+		diags.AddError("Preflight check failed", fmt.Sprintf("Invalid canister id %s: %s", canisterId, err.Error()))
+		return diags
+	}
+
+	a, err := newAgent(config)
+	if err != nil {
+		diags.AddWarning("Preflight check skipped", "Could not create agent: "+err.Error())
+		return diags
+	}
+
+	controllers, err := a.GetCanisterControllers(id)
+	if err != nil {
+		diags.AddWarning("Preflight check skipped", fmt.Sprintf("Could not read the controllers of %s: %s", canisterId, err.Error()))
+		return diags
+	}
+
+	if !slices.ContainsFunc(controllers, func(c principal.Principal) bool { return c.Encode() == controller }) {
+		diags.AddError("Preflight check failed",
+			fmt.Sprintf("%s is not a controller of canister %s, so the canister cannot be modified or deleted.", controller, canisterId))
+	}
+
+	return diags
+}
+
+// Returns the balance of the ICP account.
+func icpBalanceE8s(config agent.Config, account principal.AccountIdentifier) (uint64, error) {
+	a, err := newAgent(config)
+	if err != nil {
+		return 0, err
+	}
+	ledgerAgent := &ledger.Agent{Agent: a, CanisterId: ic.LEDGER_PRINCIPAL}
+
+	balance, err := ledgerAgent.AccountBalance(ledger.AccountBalanceArgs{Account: account.Bytes()})
+	if err != nil {
+		return 0, err
+	}
+
+	return balance.E8s, nil
+}
+
+// Formats an amount of e8s as ICP, e.g. 150000000 -> "1.50000000".
+func formatE8s(e8s uint64) string {
+	return fmt.Sprintf("%d.%08d", e8s/100_000_000, e8s%100_000_000)
+}
@@ -0,0 +1,128 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/hashicorp/terraform-plugin-framework/function"
+)
+
+const principalFromPublicKeySummary = "Derive a self-authenticating principal from a public key"
+
+const principalFromPublicKeyDescription = "The `principal_from_public_key` function computes the self-authenticating principal of a DER-encoded (SubjectPublicKeyInfo) public key. " +
+	"The key can be given either hex-encoded or as a PEM block (`-----BEGIN PUBLIC KEY-----`). " +
+	"Ed25519, secp256k1 and prime256v1 (P-256) keys are supported."
+
+var (
+	oidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+	oidEcPublicKey     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidCurveSecp256k1  = asn1.ObjectIdentifier{1, 3, 132, 0, 10}
+	oidCurvePrime256v1 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+)
+
+// The DER layout of a public key (RFC 5280 SubjectPublicKeyInfo).
+type subjectPublicKeyInfo struct {
+	Algorithm struct {
+		Algorithm  asn1.ObjectIdentifier
+		Parameters asn1.RawValue `asn1:"optional"`
+	}
+	PublicKey asn1.BitString
+}
+
+// Ensure the implementation satisfies the desired interfaces.
+var _ function.Function = &PrincipalFromPublicKeyFunction{}
+
+type PrincipalFromPublicKeyFunction struct{}
+
+func (f *PrincipalFromPublicKeyFunction) Metadata(ctx context.Context, req function.MetadataRequest, resp *function.MetadataResponse) {
+	resp.Name = "principal_from_public_key"
+}
+
+func (f *PrincipalFromPublicKeyFunction) Definition(ctx context.Context, req function.DefinitionRequest, resp *function.DefinitionResponse) {
+
+	resp.Definition = function.Definition{
+		Summary:             principalFromPublicKeySummary,
+		Description:         principalFromPublicKeyDescription,
+		MarkdownDescription: principalFromPublicKeyDescription,
+
+		Parameters: []function.Parameter{
+			function.StringParameter{
+				Name:        "public_key",
+				Description: "The DER-encoded public key, hex-encoded or PEM-wrapped",
+			},
+		},
+		Return: function.StringReturn{},
+	}
+}
+
+func (f *PrincipalFromPublicKeyFunction) Run(ctx context.Context, req function.RunRequest, resp *function.RunResponse) {
+	var input string
+
+	// Read Terraform argument data into the variable
+	resp.Error = function.ConcatFuncErrors(resp.Error, req.Arguments.Get(ctx, &input))
+	if resp.Error != nil {
+		return
+	}
+
+	der, err := readPublicKeyDER(input)
+	if err != nil {
+		resp.Error = function.NewArgumentFuncError(0, err.Error())
+		return
+	}
+
+	resp.Error = function.ConcatFuncErrors(resp.Error, resp.Result.Set(ctx, principal.NewSelfAuthenticating(der).Encode()))
+}
+
+// Reads a (hex or PEM encoded) public key and returns the DER bytes, after checking
+// that the key type is supported.
+func readPublicKeyDER(input string) ([]byte, error) {
+	var der []byte
+
+	trimmed := strings.TrimSpace(input)
+	if strings.HasPrefix(trimmed, "-----BEGIN") {
+		block, _ := pem.Decode([]byte(trimmed))
+		if block == nil {
+			return nil, fmt.Errorf("could not decode PEM block")
+		}
+		der = block.Bytes
+	} else {
+		var err error
+		der, err = hex.DecodeString(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("public key is neither PEM nor hex: %w", err)
+		}
+	}
+
+	var spki subjectPublicKeyInfo
+	rest, err := asn1.Unmarshal(der, &spki)
+	if err != nil {
+		return nil, fmt.Errorf("not a DER-encoded public key: %w", err)
+	}
+
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("trailing data after DER-encoded public key")
+	}
+
+	switch {
+	case spki.Algorithm.Algorithm.Equal(oidEd25519):
+		return der, nil
+	case spki.Algorithm.Algorithm.Equal(oidEcPublicKey):
+		var curve asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(spki.Algorithm.Parameters.FullBytes, &curve); err != nil {
+			return nil, fmt.Errorf("could not read EC curve: %w", err)
+		}
+		if curve.Equal(oidCurveSecp256k1) || curve.Equal(oidCurvePrime256v1) {
+			return der, nil
+		}
+		return nil, fmt.Errorf("unsupported EC curve %s", curve.String())
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm %s", spki.Algorithm.Algorithm.String())
+	}
+}
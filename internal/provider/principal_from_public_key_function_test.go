@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/knownvalue"
+	"github.com/hashicorp/terraform-plugin-testing/statecheck"
+	"github.com/hashicorp/terraform-plugin-testing/tfversion"
+)
+
+// Checks that the principal derived from the public key matches the agent-go
+// identity's principal, for all supported key types.
+func TestPrincipalFromPublicKeyFunction(t *testing.T) {
+	t.Parallel()
+
+	ed25519Id, err := identity.NewRandomEd25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secp256k1Id, err := identity.NewRandomSecp256k1Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prime256v1Id, err := identity.NewRandomPrime256v1Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []identity.Identity{ed25519Id, secp256k1Id, prime256v1Id}
+
+	testSteps := make([]resource.TestStep, len(ids))
+	for i := 0; i < len(ids); i++ {
+		testSteps[i] = resource.TestStep{
+			Config: fmt.Sprintf(`
+                output "test" {
+                    value = provider::ic::principal_from_public_key("%s")
+                }`,
+				hex.EncodeToString(ids[i].PublicKey()),
+			),
+			ConfigStateChecks: []statecheck.StateCheck{
+				statecheck.ExpectKnownOutputValue("test", knownvalue.StringExact(ids[i].Sender().Encode())),
+			},
+		}
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		TerraformVersionChecks: []tfversion.TerraformVersionCheck{
+			// Provider functions are only supports in 1.8.0+
+			tfversion.SkipBelow(tfversion.Version1_8_0),
+		},
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps:                    testSteps,
+	})
+}
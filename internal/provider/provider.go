@@ -5,25 +5,39 @@ package provider
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/listvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/providervalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
 	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/function"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/provider"
 	"github.com/hashicorp/terraform-plugin-framework/provider/schema"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-log/tflog"
 
 	"github.com/aviate-labs/agent-go"
 	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
 )
 
 // Ensure IcProvider satisfies various provider interfaces.
 var _ provider.Provider = &IcProvider{}
 var _ provider.ProviderWithFunctions = &IcProvider{}
+var _ provider.ProviderWithConfigValidators = &IcProvider{}
 
 // icp-api is the default api for the Internet Computer.
 var icpApi, _ = url.Parse("https://icp-api.io/")
@@ -34,22 +48,512 @@ type IcProvider struct {
 	// provider is built and ran locally, and "test" when running acceptance
 	// testing.
 	version string
+
+	// agentFixture is set by the tests recording or replaying the traffic of the agents
+	// (see testFixtureProviderFactories), and returns the wrapper of the transport sending
+	// the requests of the endpoint. nil otherwise.
+	agentFixture func(config *agent.Config) (func(http.RoundTripper) http.RoundTripper, error)
+
+	// endpointAlias tells the requests of this instance apart from those of other instances
+	// configured with the same endpoint (see withEndpointAlias), set when first configured.
+	endpointAlias string
 }
 
 // IcProviderModel describes the provider data model.
 type IcProviderModel struct {
-	Endpoint types.String `tfsdk:"endpoint"`
+	Endpoint         types.String `tfsdk:"endpoint"`
+	Network          types.String `tfsdk:"network"`
+	FetchRootKey     types.Bool   `tfsdk:"fetch_root_key"`
+	RootKey          types.String `tfsdk:"root_key"`
+	CaCertificatePem types.String `tfsdk:"ca_certificate_pem"`
+	Insecure         types.Bool   `tfsdk:"insecure"`
+	ApplySummaryFile types.String `tfsdk:"apply_summary_file"`
+	MetricsFile      types.String `tfsdk:"metrics_file"`
+
+	CertifiedReads        types.Bool `tfsdk:"certified_reads"`
+	VerifyQuerySignatures types.Bool `tfsdk:"verify_query_signatures"`
+
+	PocketIcServerUrl types.String `tfsdk:"pocketic_server_url"`
+	PocketIcBin       types.String `tfsdk:"pocketic_bin"`
+
+	LedgerTransferFeeE8s  types.Int64 `tfsdk:"ledger_transfer_fee_e8s"`
+	CmcCreateCanisterMemo types.Int64 `tfsdk:"cmc_create_canister_memo"`
+	CmcMinAmountE8s       types.Int64 `tfsdk:"cmc_min_amount_e8s"`
+
+	FundingSubaccount types.String `tfsdk:"funding_subaccount"`
+
+	MaxInlineArgSize types.Int64 `tfsdk:"max_inline_arg_size"`
+
+	RequiredLabels       types.List `tfsdk:"required_labels"`
+	ForbiddenControllers types.List `tfsdk:"forbidden_controllers"`
+
+	RequireExplicitControllers types.Bool `tfsdk:"require_explicit_controllers"`
+
+	LockCanisterId types.String `tfsdk:"lock_canister_id"`
+
+	StreamCanisterLogs types.Bool `tfsdk:"stream_canister_logs"`
+
+	PreflightChecks types.Bool `tfsdk:"preflight_checks"`
+
+	UpgradeMaxParallel       types.Int64  `tfsdk:"upgrade_max_parallel"`
+	UpgradeBatchSize         types.Int64  `tfsdk:"upgrade_batch_size"`
+	UpgradeBatchPause        types.String `tfsdk:"upgrade_batch_pause"`
+	UpgradeHealthCheckMethod types.String `tfsdk:"upgrade_health_check_method"`
+
+	ReadOnly     types.Bool `tfsdk:"read_only"`
+	AllowMainnet types.Bool `tfsdk:"allow_mainnet"`
+
+	RefreshMode types.String `tfsdk:"refresh_mode"`
+
+	CallTimeout  types.String `tfsdk:"call_timeout"`
+	PollInterval types.String `tfsdk:"poll_interval"`
+
+	IngressExpiry types.String `tfsdk:"ingress_expiry"`
+
+	TraceRequests types.Bool `tfsdk:"trace_requests"`
+
+	UserAgentSuffix types.String `tfsdk:"user_agent_suffix"`
+
+	MaxRetries     types.Int64  `tfsdk:"max_retries"`
+	RetryBaseDelay types.String `tfsdk:"retry_base_delay"`
+	RetryMaxDelay  types.String `tfsdk:"retry_max_delay"`
+
+	MaxIdleConnectionsPerHost types.Int64 `tfsdk:"max_idle_connections_per_host"`
+	MaxConnectionsPerHost     types.Int64 `tfsdk:"max_connections_per_host"`
+
+	ManagementEffectiveCanisterId types.String `tfsdk:"management_effective_canister_id"`
+
+	WalletCanisterId           types.String `tfsdk:"wallet_canister_id"`
+	WalletCreateCanisterCycles types.Int64  `tfsdk:"wallet_create_canister_cycles"`
+
+	ProxyCanisterId types.String `tfsdk:"proxy_canister_id"`
+	ProxyMethod     types.String `tfsdk:"proxy_method"`
+
+	OrbitStationId       types.String `tfsdk:"orbit_station_id"`
+	OrbitApprovalTimeout types.String `tfsdk:"orbit_approval_timeout"`
+
+	IdentityPem     types.String `tfsdk:"identity_pem"`
+	IdentityPemFile types.String `tfsdk:"identity_pem_file"`
+
+	IdentityName          types.String `tfsdk:"identity_name"`
+	IdentityPassword      types.String `tfsdk:"identity_password"`
+	IdentityPemPassphrase types.String `tfsdk:"identity_pem_passphrase"`
+
+	Pkcs11Module   types.String `tfsdk:"pkcs11_module"`
+	Pkcs11Slot     types.Int64  `tfsdk:"pkcs11_slot"`
+	Pkcs11KeyLabel types.String `tfsdk:"pkcs11_key_label"`
+
+	AwsKmsKeyId  types.String `tfsdk:"aws_kms_key_id"`
+	AwsKmsRegion types.String `tfsdk:"aws_kms_region"`
+
+	GcpKmsKeyVersion types.String `tfsdk:"gcp_kms_key_version"`
+
+	VaultAddress     types.String `tfsdk:"vault_address"`
+	VaultSecretPath  types.String `tfsdk:"vault_secret_path"`
+	VaultSecretField types.String `tfsdk:"vault_secret_field"`
+	VaultToken       types.String `tfsdk:"vault_token"`
+	VaultRoleId      types.String `tfsdk:"vault_role_id"`
+	VaultSecretId    types.String `tfsdk:"vault_secret_id"`
 }
 
-func (p IcProviderModel) InferConfig() (agent.Config, error) {
-	if p.Endpoint.IsUnknown() || p.Endpoint.IsNull() {
-		return MainnetConfig()
-	} else {
-		return EndpointConfig(p.Endpoint.ValueString())
+// Returns the Vault secret holding the identity (vault_secret_path), using the VAULT_*
+// environment variables for the settings that are not set.
+func (p IcProviderModel) InferVaultSecret() VaultSecret {
+	field := defaultVaultSecretField
+	if !p.VaultSecretField.IsNull() {
+		field = p.VaultSecretField.ValueString()
+	}
+
+	secret := VaultSecret{
+		Address:   stringOrEnv(p.VaultAddress.ValueString(), "VAULT_ADDR"),
+		Path:      p.VaultSecretPath.ValueString(),
+		Field:     field,
+		RoleId:    p.VaultRoleId.ValueString(),
+		SecretId:  p.VaultSecretId.ValueString(),
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+	}
+
+	// AppRole takes precedence over VAULT_TOKEN
+	if p.VaultRoleId.IsNull() {
+		secret.Token = stringOrEnv(p.VaultToken.ValueString(), "VAULT_TOKEN")
+	}
+
+	return secret
+}
+
+// Returns the CMC settings, using the mainnet defaults for the values that are not set.
+func (p IcProviderModel) InferCmcSettings() CmcSettings {
+	settings := DefaultCmcSettings()
+
+	if !p.LedgerTransferFeeE8s.IsNull() && !p.LedgerTransferFeeE8s.IsUnknown() {
+		settings.TransferFeeE8s = uint64(p.LedgerTransferFeeE8s.ValueInt64())
+	}
+
+	if !p.CmcCreateCanisterMemo.IsNull() && !p.CmcCreateCanisterMemo.IsUnknown() {
+		settings.CreateCanisterMemo = uint64(p.CmcCreateCanisterMemo.ValueInt64())
+	}
+
+	if !p.CmcMinAmountE8s.IsNull() && !p.CmcMinAmountE8s.IsUnknown() {
+		settings.MinAmountE8s = uint64(p.CmcMinAmountE8s.ValueInt64())
+	}
+
+	if !p.FundingSubaccount.IsNull() && !p.FundingSubaccount.IsUnknown() {
+		// Checked by the validator
+		settings.FundingSubaccount, _ = decodeSubaccount(p.FundingSubaccount.ValueString())
+	}
+
+	return settings
+}
+
+// Returns the retry policy, using the defaults for the values that are not set.
+func (p IcProviderModel) InferRetryPolicy() (RetryPolicy, diag.Diagnostics) {
+	var diags diag.Diagnostics
+	policy := DefaultRetryPolicy()
+
+	if !p.MaxRetries.IsNull() && !p.MaxRetries.IsUnknown() {
+		policy.MaxRetries = p.MaxRetries.ValueInt64()
+	}
+
+	if !p.RetryBaseDelay.IsNull() && !p.RetryBaseDelay.IsUnknown() {
+		delay, err := time.ParseDuration(p.RetryBaseDelay.ValueString())
+		if err != nil {
+			diags.AddAttributeError(path.Root("retry_base_delay"), "Invalid duration", err.Error())
+		}
+		policy.BaseDelay = delay
+	}
+
+	if !p.RetryMaxDelay.IsNull() && !p.RetryMaxDelay.IsUnknown() {
+		delay, err := time.ParseDuration(p.RetryMaxDelay.ValueString())
+		if err != nil {
+			diags.AddAttributeError(path.Root("retry_max_delay"), "Invalid duration", err.Error())
+		}
+		policy.MaxDelay = delay
+	}
+
+	return policy, diags
+}
+
+func (p IcProviderModel) InferConnectionPool() ConnectionPool {
+	pool := DefaultConnectionPool()
+
+	if !p.MaxIdleConnectionsPerHost.IsNull() && !p.MaxIdleConnectionsPerHost.IsUnknown() {
+		pool.MaxIdleConnsPerHost = p.MaxIdleConnectionsPerHost.ValueInt64()
+	}
+
+	if !p.MaxConnectionsPerHost.IsNull() && !p.MaxConnectionsPerHost.IsUnknown() {
+		pool.MaxConnsPerHost = p.MaxConnectionsPerHost.ValueInt64()
+	}
+
+	return pool
+}
+
+// Sets the agent's poll timeout and poll delay from call_timeout and poll_interval (if set).
+func applyPollingSettings(config *agent.Config, callTimeout types.String, pollInterval types.String) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if !callTimeout.IsNull() && !callTimeout.IsUnknown() {
+		timeout, err := time.ParseDuration(callTimeout.ValueString())
+		if err != nil {
+			diags.AddAttributeError(path.Root("call_timeout"), "Invalid duration", err.Error())
+		}
+		config.PollTimeout = timeout
+	}
+
+	if !pollInterval.IsNull() && !pollInterval.IsUnknown() {
+		interval, err := time.ParseDuration(pollInterval.ValueString())
+		if err != nil {
+			diags.AddAttributeError(path.Root("poll_interval"), "Invalid duration", err.Error())
+		}
+		config.PollDelay = interval
+	}
+
+	return diags
+}
+
+// The IC rejects requests expiring more than 5 minutes in the future.
+const maxIngressExpiry = 5 * time.Minute
+
+// Sets how long the agent's requests are valid (ingress_expiry, if set).
+func (p IcProviderModel) applyIngressExpiry(config *agent.Config) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if p.IngressExpiry.IsNull() || p.IngressExpiry.IsUnknown() {
+		return diags
+	}
+
+	expiry, err := time.ParseDuration(p.IngressExpiry.ValueString())
+	if err != nil {
+		diags.AddAttributeError(path.Root("ingress_expiry"), "Invalid duration", err.Error())
+		return diags
+	}
+
+	if expiry > maxIngressExpiry {
+		diags.AddAttributeError(path.Root("ingress_expiry"), "Invalid ingress expiry",
+			fmt.Sprintf("The ingress expiry must be at most %s, got %s", maxIngressExpiry, expiry))
+		return diags
+	}
+
+	config.IngressExpiry = expiry
+
+	return diags
+}
+
+// Sets whether the agent fetches the root key from the endpoint (fetch_root_key, by default
+// only for networks other than mainnet) and pins the root key (root_key, if set) in the
+// transport of the endpoint.
+func (p IcProviderModel) applyRootKeySettings(config *agent.Config, transport *transportSettings) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if config.ClientConfig == nil || config.ClientConfig.Host == nil {
+		return diags
+	}
+
+	config.FetchRootKey = config.ClientConfig.Host.String() != icpApi.String()
+	if !p.FetchRootKey.IsNull() && !p.FetchRootKey.IsUnknown() {
+		config.FetchRootKey = p.FetchRootKey.ValueBool()
+	}
+
+	if p.RootKey.IsNull() || p.RootKey.IsUnknown() {
+		if config.FetchRootKey && !isLoopbackHost(config.ClientConfig.Host.Hostname()) && !isMockEndpoint(config.ClientConfig.Host) {
+			diags.AddAttributeWarning(path.Root("root_key"), "Unverified root key",
+				fmt.Sprintf("The root key is fetched from %s without being checked, so certified responses are only as trustworthy as the endpoint. Set root_key to the root key of the network.", config.ClientConfig.Host.Host))
+		}
+		return diags
 	}
+
+	rootKey, err := decodeRootKey(p.RootKey.ValueString())
+	if err != nil {
+		diags.AddAttributeError(path.Root("root_key"), "Invalid root key", err.Error())
+		return diags
+	}
+
+	if !config.FetchRootKey {
+		// The agent uses the mainnet root key
+		if !sameRootKey(rootKey, mainnetRootKey) {
+			diags.AddAttributeError(path.Root("root_key"), "Invalid root key",
+				"root_key is not the mainnet root key, which is used when the root key is not fetched: set fetch_root_key = true")
+		}
+		return diags
+	}
+
+	transport.rootKey = rootKey
+
+	return diags
+}
+
+// Sets the TLS settings of the transport of the endpoint: the CA certificates it is
+// verified against (ca_certificate_pem) or whether it isn't verified at all (insecure).
+func (p IcProviderModel) applyTLSSettings(config *agent.Config, transport *transportSettings) diag.Diagnostics {
+	var diags diag.Diagnostics
+
+	if config.ClientConfig == nil || config.ClientConfig.Host == nil {
+		return diags
+	}
+
+	insecure := !p.Insecure.IsNull() && p.Insecure.ValueBool()
+	if p.CaCertificatePem.IsNull() && !insecure {
+		return diags
+	}
+
+	host := config.ClientConfig.Host
+	if insecure && !isLoopbackHost(host.Hostname()) {
+		diags.AddAttributeWarning(path.Root("insecure"), "Unverified TLS certificate",
+			fmt.Sprintf("The TLS certificate of %s is not verified, so anyone on the network path can impersonate it. Only use insecure with local gateways, or set ca_certificate_pem instead.", host.Host))
+	}
+
+	tlsConfig, err := newTLSConfig(p.CaCertificatePem.ValueString(), insecure)
+	if err != nil {
+		diags.AddAttributeError(path.Root("ca_certificate_pem"), "Invalid CA certificate", err.Error())
+		return diags
+	}
+
+	transport.tlsConfig = tlsConfig
+
+	return diags
+}
+
+// Amount of network reads performed when refreshing resources (refresh_mode)
+const (
+	// Reads the canisters' controllers and module hashes to detect drift
+	refreshModeFull = "full"
+	// Only performs the reads needed to keep the state consistent (e.g. resuming
+	// canister claims) or that are cheap (e.g. registry records)
+	refreshModeFast = "fast"
+	// Performs no network reads at all
+	refreshModeOff = "off"
+)
+
+// IcProviderData is the data shared by the provider with resources.
+type IcProviderData struct {
+	Config *agent.Config
+
+	// nil unless apply_summary_file is set
+	ApplySummary *ApplySummary
+
+	// nil unless metrics_file is set
+	Metrics *Metrics
+
+	// nil unless preflight_checks is set
+	Preflight *Preflight
+
+	// nil unless any of the upgrade_* rollout controls is set
+	Rollout *Rollout
+
+	// Whether (and why) state-changing operations fail (read_only, allow_mainnet)
+	ReadOnly readOnlyMode
+
+	Cmc CmcSettings
+
+	// Maximum size (in bytes) of arguments stored in the state; 0 means no limit
+	MaxInlineArgSize int64
+
+	CanisterPolicy CanisterPolicy
+
+	// Whether the module hashes and controllers of canisters are read from verified certificates
+	CertifiedReads bool
+
+	// nil unless lock_canister_id is set
+	Lock *AdvisoryLock
+
+	StreamCanisterLogs bool
+
+	// One of the refreshMode* values
+	RefreshMode string
+
+	// nil unless management_effective_canister_id is set
+	ManagementEffectiveCanisterId *principal.Principal
+
+	// nil unless wallet_canister_id, proxy_canister_id or orbit_station_id is set
+	ManagementProxy *managementProxy
+
+	// Cycles attached to canisters created through ManagementProxy
+	ProxyCreateCanisterCycles uint64
+
+	// Registry values read by the resources, for the lifetime of the provider instance
+	Registry *registryCache
+}
+
+// Why state-changing operations fail, if they do.
+type readOnlyMode int
+
+const (
+	readWrite          readOnlyMode = iota
+	readOnlyConfigured              // read_only is set
+	readOnlyMainnet                 // the endpoint is mainnet, and allow_mainnet is not set
+)
+
+// Hosts of mainnet's API boundary nodes.
+var mainnetHosts = []string{"icp-api.io", "icp0.io", "ic0.app"}
+
+// Whether the host is one of mainnet's API domains.
+func isMainnetHost(hostname string) bool {
+	return slices.Contains(mainnetHosts, strings.TrimSuffix(strings.ToLower(hostname), "."))
+}
+
+// The error reported when a state-changing operation (e.g. "create canister") is attempted
+// while the provider is read-only.
+func (m readOnlyMode) diagnostic(operation string) diag.Diagnostic {
+	if m == readOnlyMainnet {
+		return diag.NewErrorDiagnostic("Mainnet not allowed",
+			fmt.Sprintf("Could not %s: the provider targets mainnet, where state-changing operations require allow_mainnet = true (or the IC_ALLOW_MAINNET environment variable). If you meant to target a local replica, set endpoint or network.", operation))
+	}
+	return diag.NewErrorDiagnostic("Read-only provider",
+		fmt.Sprintf("Could not %s: the provider is read-only (read_only = true), so only reads are allowed. Plans can be computed, but applying changes requires unsetting read_only.", operation))
 }
 
-func EndpointConfig(endpoint string) (agent.Config, error) {
+// Returns the PEM-encoded identity from identity_pem, identity_pem_file, identity_name or
+// vault_secret_path, or the empty string if none of them is set.
+func (p IcProviderModel) InferIdentityPem() (string, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	if !p.VaultSecretPath.IsNull() {
+		data, err := p.InferVaultSecret().ReadIdentityPem()
+		if err != nil {
+			diags.AddAttributeError(path.Root("vault_secret_path"), "Could not read identity from Vault", err.Error())
+			return "", diags
+		}
+		return data, diags
+	}
+
+	if !p.IdentityName.IsNull() {
+		data, err := readDfxIdentityPem(p.IdentityName.ValueString(), p.IdentityPassword.ValueString())
+		if err != nil {
+			diags.AddAttributeError(path.Root("identity_name"), "Could not read dfx identity", err.Error())
+			return "", diags
+		}
+		return string(data), diags
+	}
+
+	passphrase := stringOrEnv(p.IdentityPemPassphrase.ValueString(), "IC_PEM_PASSPHRASE")
+
+	if p.IdentityPemFile.IsNull() {
+		data, err := decryptIdentityPem([]byte(p.IdentityPem.ValueString()), passphrase)
+		if err != nil {
+			diags.AddAttributeError(path.Root("identity_pem"), "Could not decrypt identity_pem", err.Error())
+			return "", diags
+		}
+		return string(data), diags
+	}
+
+	data, err := os.ReadFile(p.IdentityPemFile.ValueString())
+	if err != nil {
+		diags.AddAttributeError(path.Root("identity_pem_file"), "Could not read identity PEM file", err.Error())
+		return "", diags
+	}
+
+	data, err = decryptIdentityPem(data, passphrase)
+	if err != nil {
+		diags.AddAttributeError(path.Root("identity_pem_file"), "Could not decrypt identity PEM file", err.Error())
+		return "", diags
+	}
+
+	_, err = NewIdentityFromPEM(data)
+	if err != nil {
+		diags.AddAttributeError(path.Root("identity_pem_file"), "Invalid identity PEM file",
+			fmt.Sprintf("Could not read an Ed25519, secp256k1 or prime256v1 identity from %s: %s", p.IdentityPemFile.ValueString(), err.Error()))
+		return "", diags
+	}
+
+	return string(data), diags
+}
+
+// Returns the endpoint from endpoint, network or the IC_ENDPOINT environment variable (in
+// that order), defaulting to mainnet.
+func (p IcProviderModel) InferEndpoint() (string, error) {
+	if !p.Endpoint.IsUnknown() && !p.Endpoint.IsNull() {
+		return p.Endpoint.ValueString(), nil
+	}
+
+	if !p.Network.IsUnknown() && !p.Network.IsNull() {
+		if p.Network.ValueString() == pocketIcNetwork {
+			binary := stringOrEnv(p.PocketIcBin.ValueString(), "POCKET_IC_BIN")
+			if len(binary) == 0 {
+				binary = "pocket-ic"
+			}
+			return pocketIcEndpoint(p.PocketIcServerUrl.ValueString(), binary)
+		}
+		return networkEndpoint(p.Network.ValueString())
+	}
+
+	if endpoint := os.Getenv("IC_ENDPOINT"); len(endpoint) > 0 {
+		return endpoint, nil
+	}
+
+	return icpApi.String(), nil
+}
+
+func (p IcProviderModel) InferConfig(identityPem string) (agent.Config, error) {
+	endpoint, err := p.InferEndpoint()
+	if err != nil {
+		return agent.Config{}, err
+	}
+	return EndpointConfig(endpoint, identityPem)
+}
+
+// The configuration for the given endpoint. The identity is read from identityPem if
+// not empty, and otherwise from IC_PEM_IDENTITY or the file at IC_PEM_IDENTITY_PATH (if set,
+// in that order).
+func EndpointConfig(endpoint string, identityPem string) (agent.Config, error) {
 
 	// If IC_PEM_IDENTITY_PATH is provided, read the file as the identity
 	pemPath := os.Getenv("IC_PEM_IDENTITY_PATH")
@@ -57,7 +561,22 @@ func EndpointConfig(endpoint string) (agent.Config, error) {
 	var id identity.Identity
 	var config agent.Config
 
-	if len(pemPath) > 0 {
+	if len(identityPem) > 0 {
+		var err error
+		id, err = NewIdentityFromPEM([]byte(identityPem))
+
+		if err != nil {
+			return config, fmt.Errorf("Could not read identity_pem: %w", err)
+		}
+	} else if envPem := os.Getenv("IC_PEM_IDENTITY"); len(envPem) > 0 {
+		// The PEM contents, e.g. injected by a CI secret store
+		var err error
+		id, err = NewIdentityFromPEM([]byte(envPem))
+
+		if err != nil {
+			return config, fmt.Errorf("Could not read IC_PEM_IDENTITY: %w", err)
+		}
+	} else if len(pemPath) > 0 {
 
 		data, err := os.ReadFile(pemPath)
 
@@ -88,8 +607,8 @@ func EndpointConfig(endpoint string) (agent.Config, error) {
 }
 
 // The configuration using the official (mainnet) IC API.
-func MainnetConfig() (agent.Config, error) {
-	return EndpointConfig(icpApi.String())
+func MainnetConfig(identityPem string) (agent.Config, error) {
+	return EndpointConfig(icpApi.String(), identityPem)
 }
 
 func (p *IcProvider) Metadata(ctx context.Context, req provider.MetadataRequest, resp *provider.MetadataResponse) {
@@ -101,20 +620,463 @@ func (p *IcProvider) Schema(ctx context.Context, req provider.SchemaRequest, res
 	resp.Schema = schema.Schema{
 		Attributes: map[string]schema.Attribute{
 			"endpoint": schema.StringAttribute{
-				MarkdownDescription: "The endpoint to use, defaults to icp-api.io (mainnet).",
+				MarkdownDescription: "The endpoint to use. Conflicts with `network`, and takes precedence over the `IC_ENDPOINT` environment variable. Defaults to icp-api.io (mainnet) if none of them is set. " +
+					"`mock://` (or `mock://<name>`, for separate networks) selects an in-memory fake network simulating the management canister (creating canisters, installing code, settings and status) without a replica, e.g. to run `terraform test` in CI: canister code is not executed, and the state is saved in the temporary directory so that subsequent runs see the same canisters.",
+				Optional: true,
+			},
+			"network": schema.StringAttribute{
+				MarkdownDescription: "Name of the network to use instead of an `endpoint`: `mainnet` (or `ic`), `local` (dfx's local replica, `http://127.0.0.1:4943` unless redefined), `pocketic` (a PocketIC instance, see `pocketic_server_url`), or a network defined in dfx's `~/.config/dfx/networks.json` (or `$DFX_CONFIG_ROOT/.config/dfx/networks.json`), whose first provider (or bind address) is used. " +
+					"Conflicts with `endpoint`, and takes precedence over the `IC_ENDPOINT` environment variable.",
+				Optional: true,
+			},
+			"pocketic_server_url": schema.StringAttribute{
+				MarkdownDescription: "URL of the PocketIC server on which the instance of the `pocketic` network is created, e.g. `http://127.0.0.1:8080`. " +
+					"Defaults to a server launched with `pocketic_bin`, which keeps running for an hour after its last request. " +
+					"The instance (with an NNS and an application subnet, and time progressing automatically) is accessed through an HTTP gateway, and is reused by subsequent runs as long as its server is running.",
+				Optional: true,
+			},
+			"pocketic_bin": schema.StringAttribute{
+				MarkdownDescription: "Path to the PocketIC server binary launched for the `pocketic` network when `pocketic_server_url` is not set. Defaults to the `POCKET_IC_BIN` environment variable, or to `pocket-ic` (in the `PATH`).",
+				Optional:            true,
+			},
+			"fetch_root_key": schema.BoolAttribute{
+				MarkdownDescription: "Whether the root key (used to verify certified responses) is fetched from the endpoint rather than set to the mainnet root key. " +
+					"Fetching the root key is only safe when the endpoint is trusted (e.g. a local replica), unless `root_key` is set. Defaults to `false` for mainnet, and to `true` otherwise.",
+				Optional: true,
+			},
+			"root_key": schema.StringAttribute{
+				MarkdownDescription: "Hex or base64-encoded root key (DER-encoded as returned by the status endpoint, or the raw BLS public key) expected from the endpoint, e.g. the root key of a local replica or PocketIC instance, so that certified responses are verified against a known key instead of whatever key the endpoint returns. " +
+					"When the root key is fetched, requests fail if the endpoint returns another root key; otherwise `root_key` must be the mainnet root key.",
+				Optional: true,
+			},
+			"certified_reads": schema.BoolAttribute{
+				MarkdownDescription: "Whether the module hashes and controllers of canisters stored in the state are read from certificates verified against the root key. " +
+					"Setting it to `false` skips the verification (the values are whatever the endpoint returns), which is only meant to speed up local networks. Defaults to `true`.",
+				Optional: true,
+			},
+			"verify_query_signatures": schema.BoolAttribute{
+				MarkdownDescription: "Whether the replies of the queries made to read canister data (e.g. `outputs`, query calls of `ic_canister_call`, and `ic_wait` queries) must be signed by nodes of the canister's subnet, as certified by the subnet (whose node keys are read once per run). " +
+					"Setting it to `false` accepts unsigned replies, e.g. from replicas that don't sign query responses. Defaults to `true`.",
+				Optional: true,
+			},
+			"ca_certificate_pem": schema.StringAttribute{
+				MarkdownDescription: "PEM-encoded CA certificates the TLS certificate of the endpoint is verified against, in addition to the system's, e.g. the CA of a local gateway with a self-signed certificate.",
+				Optional:            true,
+			},
+			"insecure": schema.BoolAttribute{
+				MarkdownDescription: "Whether the TLS certificate of the endpoint is not verified at all, as an escape hatch for local gateways with self-signed certificates. Prefer `ca_certificate_pem`. Defaults to `false`.",
+				Optional:            true,
+			},
+			"identity_pem": schema.StringAttribute{
+				MarkdownDescription: "PEM-encoded private key (Ed25519, secp256k1 or prime256v1) of the identity to use, e.g. read from a secret store. Conflicts with `identity_pem_file` and `identity_name`, and takes precedence over the `IC_PEM_IDENTITY` and `IC_PEM_IDENTITY_PATH` environment variables. Defaults to the anonymous identity if none of them is set.",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"identity_pem_passphrase": schema.StringAttribute{
+				MarkdownDescription: "Passphrase of the encrypted key in `identity_pem` or `identity_pem_file`, either a legacy encrypted EC key (`Proc-Type: 4,ENCRYPTED`) or an encrypted PKCS#8 key (`ENCRYPTED PRIVATE KEY`, with PBES2). Defaults to the `IC_PEM_PASSPHRASE` environment variable, which also decrypts the identities of `IC_PEM_IDENTITY` and `IC_PEM_IDENTITY_PATH` and the `identity_pem_file` of canisters.",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"identity_pem_file": schema.StringAttribute{
+				MarkdownDescription: "Path to a PEM file with the private key (Ed25519, secp256k1 or prime256v1) of the identity to use. Conflicts with `identity_pem` and `identity_name`, and takes precedence over the `IC_PEM_IDENTITY` and `IC_PEM_IDENTITY_PATH` environment variables. Defaults to the anonymous identity if none of them is set.",
+				Optional:            true,
+			},
+			"identity_name": schema.StringAttribute{
+				MarkdownDescription: "Name of a dfx identity to use, read from `~/.config/dfx/identity/<name>` (or `$DFX_CONFIG_ROOT/.config/dfx/identity/<name>`). Encrypted identities are decrypted with `identity_password`; identities stored in the system keyring are not supported. " +
+					"Conflicts with `identity_pem` and `identity_pem_file`, and takes precedence over the `IC_PEM_IDENTITY` and `IC_PEM_IDENTITY_PATH` environment variables.",
+				Optional: true,
+			},
+			"identity_password": schema.StringAttribute{
+				MarkdownDescription: "Password of the (encrypted) dfx identity `identity_name`.",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"pkcs11_module": schema.StringAttribute{
+				MarkdownDescription: "Path to a PKCS#11 module (e.g. of an HSM) holding the identity's key, which must be a prime256v1 (P-256) key. " +
+					"The token is accessed with OpenSC's `pkcs11-tool`, which must be installed, and its PIN is read from the `" + pkcs11PinEnv + "` environment variable. " +
+					"Each signature starts a `pkcs11-tool` process (every request is signed, including the requests polling the status of calls, and a probe message is signed when the provider is configured), so consider raising `poll_interval` with slow tokens. " +
+					"Requires `pkcs11_slot` and `pkcs11_key_label`, conflicts with the other identity attributes and takes precedence over the `IC_PEM_IDENTITY` and `IC_PEM_IDENTITY_PATH` environment variables.",
+				Optional: true,
+			},
+			"pkcs11_slot": schema.Int64Attribute{
+				MarkdownDescription: "Slot of the PKCS#11 token holding the identity's key (see `pkcs11_module`).",
+				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"pkcs11_key_label": schema.StringAttribute{
+				MarkdownDescription: "Label of the identity's key pair on the PKCS#11 token (see `pkcs11_module`).",
+				Optional:            true,
+			},
+			"aws_kms_key_id": schema.StringAttribute{
+				MarkdownDescription: "Id, ARN or alias of an asymmetric AWS KMS key (`ECC_NIST_P256` or `ECC_SECG_P256K1`) signing requests on behalf of the identity, so that the key lives in the KMS (with audit logs of every signature) and never on the machine running Terraform. " +
+					"The KMS is accessed with the AWS CLI, which must be installed, using its credentials and configuration (e.g. `AWS_PROFILE`). " +
+					"Each signature starts an `aws` process (every request is signed, including the requests polling the status of calls), so consider raising `poll_interval`. " +
+					"Conflicts with the other identity attributes and takes precedence over the `IC_PEM_IDENTITY` and `IC_PEM_IDENTITY_PATH` environment variables.",
+				Optional: true,
+			},
+			"aws_kms_region": schema.StringAttribute{
+				MarkdownDescription: "Region of the AWS KMS key `aws_kms_key_id`. Defaults to the AWS CLI's region (e.g. `AWS_REGION`).",
+				Optional:            true,
+			},
+			"gcp_kms_key_version": schema.StringAttribute{
+				MarkdownDescription: "Resource name of a Google Cloud KMS key version (`EC_SIGN_P256_SHA256` or `EC_SIGN_SECP256K1_SHA256`) signing requests on behalf of the identity, e.g. `projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>/cryptoKeyVersions/1`, so that the key lives in the KMS (with audit logs of every signature) and never on the machine running Terraform. " +
+					"The KMS is accessed with the gcloud CLI, which must be installed, using its credentials. " +
+					"Each signature starts a `gcloud` process (every request is signed, including the requests polling the status of calls), so consider raising `poll_interval`. " +
+					"Conflicts with the other identity attributes and takes precedence over the `IC_PEM_IDENTITY` and `IC_PEM_IDENTITY_PATH` environment variables.",
+				Optional: true,
+			},
+			"vault_secret_path": schema.StringAttribute{
+				MarkdownDescription: "API path (without `/v1/`) of a HashiCorp Vault secret holding the identity's key, which is read when the provider is configured so that the key never touches the disk, e.g. `secret/data/ic/deployer` for a KV v2 secret. " +
+					"The field `vault_secret_field` of the secret holds either a PEM-encoded key (Ed25519, secp256k1 or prime256v1) or a raw Ed25519 key (32-byte seed or 64-byte private key, hex or base64-encoded). " +
+					"The secret is read with `vault_token`, or with a token obtained by logging in with AppRole (`vault_role_id` and `vault_secret_id`); the `VAULT_NAMESPACE` environment variable is honored. " +
+					"Conflicts with the other identity attributes and takes precedence over the `IC_PEM_IDENTITY` and `IC_PEM_IDENTITY_PATH` environment variables.",
+				Optional: true,
+			},
+			"vault_secret_field": schema.StringAttribute{
+				MarkdownDescription: "Field of the Vault secret `vault_secret_path` holding the identity's key. Defaults to `" + defaultVaultSecretField + "`.",
+				Optional:            true,
+			},
+			"vault_address": schema.StringAttribute{
+				MarkdownDescription: "Address of the Vault server (see `vault_secret_path`), e.g. `https://vault.example.com:8200`. Defaults to the `VAULT_ADDR` environment variable.",
+				Optional:            true,
+			},
+			"vault_token": schema.StringAttribute{
+				MarkdownDescription: "Vault token to read `vault_secret_path` with. Defaults to the `VAULT_TOKEN` environment variable, unless `vault_role_id` is set. Conflicts with `vault_role_id`.",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"vault_role_id": schema.StringAttribute{
+				MarkdownDescription: "Role ID to log in to Vault with AppRole (at `auth/approle`) before reading `vault_secret_path`, e.g. on CI runners. Requires `vault_secret_id`.",
+				Optional:            true,
+			},
+			"vault_secret_id": schema.StringAttribute{
+				MarkdownDescription: "Secret ID to log in to Vault with AppRole (see `vault_role_id`).",
+				Optional:            true,
+				Sensitive:           true,
+			},
+			"apply_summary_file": schema.StringAttribute{
+				MarkdownDescription: "Path to a JSON manifest describing the managed canisters (ids, controllers, module and arg hashes) as well as the network and identity principal used. The manifest is updated whenever a canister is created, updated or deleted, for consumption by release tooling and audit trails. It also lists the refunds issued by the CMC (`cmc_refunds`), which are kept when the canisters are replaced or deleted.",
+				Optional:            true,
+			},
+			"metrics_file": schema.StringAttribute{
+				MarkdownDescription: "Path to a file to which the duration of canister operations (creation, code installation, settings updates, reads and deletion) is appended as JSON lines, e.g. to monitor deploy latency across releases of the provider. " +
+					"The operations are also logged with structured fields (`operation`, `canister_id`, `duration_ms` and `error`) whether this is set or not, e.g. with `TF_LOG=INFO`.",
+				Optional: true,
+			},
+			"ledger_transfer_fee_e8s": schema.Int64Attribute{
+				MarkdownDescription: "The ICP ledger transfer fee (in e8s) used when funding the cycles minting canister (CMC). Defaults to the mainnet fee of 10000 e8s. Useful for testnets with custom ledgers.",
+				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"cmc_create_canister_memo": schema.Int64Attribute{
+				MarkdownDescription: "The memo used on ICP transfers to the CMC for canister creation. Defaults to the mainnet value (`0x41455243`, i.e. `CREA`).",
+				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"lock_canister_id": schema.StringAttribute{
+				MarkdownDescription: "Canister used to acquire advisory locks on canisters while they are being created, updated or deleted (by `ic_canister` and `ic_dapp`), so that concurrent applies (e.g. from two pipelines) don't race on the same canister. " +
+					"The canister must implement `acquire : (record { key : text; holder : text; ttl_seconds : nat64 }) -> (variant { Ok; Err : text })` and `release : (record { key : text; holder : text }) -> (variant { Ok; Err : text })`. " +
+					"By default no locks are acquired.",
+				Optional: true,
+			},
+			"stream_canister_logs": schema.BoolAttribute{
+				MarkdownDescription: "Debugging option: while code is being installed, periodically fetch the canister's logs and mirror them to the provider logs (e.g. with `TF_LOG=INFO`), which helps diagnosing traps during init or upgrades. Defaults to `false`.",
+				Optional:            true,
+			},
+			"preflight_checks": schema.BoolAttribute{
+				MarkdownDescription: "Check when planning that the apply can succeed, before anything is mutated: that the ICP account funding canister creations (see `funding_subaccount`) holds enough ICP to create all the planned canisters (on mainnet, at the current conversion rate) " +
+					"and that the identity controls the canisters that are updated or deleted. All the failed checks are reported by the plan, instead of the apply failing midway. " +
+					"This reads the controllers of every updated or deleted canister. Defaults to `false`.",
+				Optional: true,
+			},
+			"upgrade_max_parallel": schema.Int64Attribute{
+				MarkdownDescription: "Maximum number of canister code upgrades (of `ic_canister`) running at the same time, e.g. when a Wasm change fans out to the canisters of a `count` or `for_each`. " +
+					"The first failed upgrade halts the rollout: the upgrades that haven't started yet fail instead of being attempted. By default the upgrades are only limited by Terraform's `-parallelism`.",
+				Optional: true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(1),
+				},
+			},
+			"upgrade_batch_size": schema.Int64Attribute{
+				MarkdownDescription: "Number of canisters upgraded per wave: the upgrades of the next wave only start once all the upgrades of the current wave completed (see also `upgrade_batch_pause` and `upgrade_health_check_method`), so that a faulty module doesn't reach all the canisters (and subnets) at once. " +
+					"As with `upgrade_max_parallel`, the first failed upgrade halts the rollout. By default all the upgrades belong to a single wave.",
+				Optional: true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(1),
+				},
+			},
+			"upgrade_batch_pause": schema.StringAttribute{
+				MarkdownDescription: "How long to wait between waves of upgrades (see `upgrade_batch_size`), e.g. `5m` to let metrics and alerts catch up with the upgraded canisters. Defaults to no pause.",
+				Optional:            true,
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"upgrade_health_check_method": schema.StringAttribute{
+				MarkdownDescription: "Query method (without arguments) called on every canister of a wave of upgrades (see `upgrade_batch_size`) before the next wave starts: if it fails (or rejects) for any canister, the rollout is halted. The canisters of the last wave are not checked.",
+				Optional:            true,
+			},
+			"read_only": schema.BoolAttribute{
+				MarkdownDescription: "Make the provider read-only: state-changing operations (creating, updating and deleting canisters, installing code, transfers, canister calls, registry mutations, etc.) fail with an error, while reads (refreshes, data sources, queries and the checks performed when planning) are allowed. " +
+					"This makes it safe to compute plans, e.g. in CI, with credentials that can modify production canisters. Defaults to `false`.",
+				Optional: true,
+			},
+			"allow_mainnet": schema.BoolAttribute{
+				MarkdownDescription: "Whether state-changing operations are allowed on mainnet (`icp-api.io`, `icp0.io` or `ic0.app`). Unless set, the provider is read-only on mainnet (see `read_only`), so that configurations accidentally missing a local `endpoint` cannot modify (or delete) production canisters. " +
+					"Defaults to the `IC_ALLOW_MAINNET` environment variable (e.g. `IC_ALLOW_MAINNET=true`), and otherwise to `false`.",
+				Optional: true,
+			},
+			"refresh_mode": schema.StringAttribute{
+				MarkdownDescription: "How much network reading is performed when refreshing resources: " +
+					"`full` also reads the controllers and module hash of every canister, so that changes made outside of Terraform are detected (and reverted on apply); " +
+					"`fast` only performs the reads needed to keep the state consistent (e.g. resuming canister claims) and cheap reads (e.g. registry records); " +
+					"`off` performs no network reads at all, e.g. for quick structural plans of large fleets. Defaults to `fast`.",
+				Optional: true,
+				Validators: []validator.String{
+					stringvalidator.OneOf(refreshModeFull, refreshModeFast, refreshModeOff),
+				},
+			},
+			"call_timeout": schema.StringAttribute{
+				MarkdownDescription: "How long to wait for update calls (e.g. canister creation, code installation or deletion) to complete, e.g. `10m` for long installs. Can be overridden per canister. Defaults to `60s`. Update calls that time out (e.g. code installations, ledger transfers and canister calls) are not submitted again when applying again (within a few minutes, on the same machine): the status of the original request, recorded in the user's cache directory, is polled instead, so that they are not executed twice. Concurrent runs with the same identity making the same call may resume each other's call.",
+				Optional:            true,
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"poll_interval": schema.StringAttribute{
+				MarkdownDescription: "Interval at which the status of update calls is polled while waiting for them to complete. Can be overridden per canister. Defaults to `1s`.",
+				Optional:            true,
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"trace_requests": schema.BoolAttribute{
+				MarkdownDescription: "Whether every request to the IC (calls, queries and status reads) is logged at `TRACE` level (e.g. with `TF_LOG_PROVIDER=TRACE`), with its canister, method, request id, argument size, latency and reject code, to debug slow or failing applies. " +
+					"Once enabled by a provider configuration, requests of all configurations are traced. Defaults to `false`.",
+				Optional: true,
+			},
+			"user_agent_suffix": schema.StringAttribute{
+				MarkdownDescription: "Appended to the User-Agent of the provider's HTTP requests, e.g. the name of the team or pipeline, so that boundary node operators and support can attribute the traffic. " +
+					"The User-Agent always starts with the provider's exact version and Terraform's, e.g. `terraform-provider-ic/1.2.3 Terraform/1.9.0 <suffix>`. With several provider configurations, the suffix of the last configured one is used.",
+				Optional: true,
+				Validators: []validator.String{
+					stringvalidator.RegexMatches(regexp.MustCompile(`^[^\r\n]*$`), "must be a single line"),
+				},
+			},
+			"ingress_expiry": schema.StringAttribute{
+				MarkdownDescription: "How long requests (calls, queries and status reads) are valid after being signed, e.g. `2m` for slow local replicas or test networks whose clocks drift, or `5s` to limit how long signed requests can be replayed. " +
+					"At most `5m`. Defaults to `10s`.",
+				Optional: true,
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"max_retries": schema.Int64Attribute{
+				MarkdownDescription: "Maximum number of times a request to the IC (e.g. installing code, updating settings, ledger transfers or CMC notifications) is retried when it fails with a 429 or 5xx status or a transient transport error. " +
+					"Retried requests are the same signed requests, which the IC executes at most once. Defaults to 3; 0 disables retries.",
+				Optional: true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"retry_base_delay": schema.StringAttribute{
+				MarkdownDescription: "Delay before the first retry of a failed request (e.g. `500ms`), doubled on every retry up to `retry_max_delay`. Defaults to `500ms`.",
+				Optional:            true,
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"retry_max_delay": schema.StringAttribute{
+				MarkdownDescription: "Maximum delay between retries of a failed request (e.g. `10s`), also capping the delay requested by the IC with `Retry-After`. Defaults to `10s`.",
+				Optional:            true,
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"max_idle_connections_per_host": schema.Int64Attribute{
+				MarkdownDescription: "Maximum number of idle HTTP connections kept open per host, which are reused by subsequent requests (e.g. the `read_state` polls of calls) rather than opening new connections and doing new TLS handshakes. " +
+					"Connections use HTTP/2 when the host supports it. Defaults to 32.",
+				Optional: true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"max_connections_per_host": schema.Int64Attribute{
+				MarkdownDescription: "Maximum number of HTTP connections per host, e.g. to stay below the rate limits of a gateway; further requests wait for a connection to be available. Defaults to 0 (no limit).",
+				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"management_effective_canister_id": schema.StringAttribute{
+				MarkdownDescription: "Effective canister id used to route management canister calls that don't target an existing canister (i.e. provisional canister creation on non-mainnet endpoints). " +
+					"By default the management canister (`aaaaa-aa`) is used, which some endpoints (e.g. PocketIC) cannot route; set this to a canister id in the range of the target subnet. " +
+					"Calls targeting an existing canister always use that canister as effective canister id.",
+				Optional: true,
+			},
+			"wallet_canister_id": schema.StringAttribute{
+				MarkdownDescription: "Cycles wallet through which canisters are managed, for canisters controlled by a wallet rather than by the identity (e.g. canisters created with dfx). " +
+					"Management canister calls (installing code, updating settings, stopping and deleting canisters) are routed through the wallet's `wallet_call`, and canisters are created with its `wallet_create_canister`, paying with the wallet's cycles (see `wallet_create_canister_cycles`). " +
+					"The wallet, rather than the identity, is then the default controller of created canisters. The identity must be a custodian or controller of the wallet. Conflicts with `proxy_canister_id` and `orbit_station_id`.",
+				Optional: true,
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"orbit_station_id": schema.StringAttribute{
+				MarkdownDescription: "Orbit station (multi-approval wallet) through which canisters are managed, for teams gating changes behind Orbit approvals. " +
+					"Management canister calls (installing code, updating settings, stopping and deleting canisters, and creating canisters with `wallet_create_canister_cycles` attached) are submitted as `CallExternalCanister` requests of the station, and the provider waits until they are approved and executed (see `orbit_approval_timeout`). " +
+					"The station must control the canisters, and the identity must be a user of the station allowed to create such requests. The station, rather than the identity, is then the default controller of created canisters. " +
+					"Conflicts with `wallet_canister_id` and `proxy_canister_id`.",
+				Optional: true,
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"orbit_approval_timeout": schema.StringAttribute{
+				MarkdownDescription: "How long to wait for requests submitted to the Orbit station (see `orbit_station_id`) to be approved and executed, e.g. `30m`. Requests that time out fail the apply, but can still be approved in the station. Defaults to `24h`.",
+				Optional:            true,
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"proxy_canister_id": schema.StringAttribute{
+				MarkdownDescription: "Proxy (e.g. ops) canister through which canisters are managed, for setups where the canisters are only controlled by the proxy, human keys only hold rights on the proxy, and every change is recorded on-chain. " +
+					"Management canister calls (installing code, updating settings, stopping and deleting canisters, and creating canisters with `wallet_create_canister_cycles` attached) are forwarded to the proxy's `proxy_method`, which must have the interface of the cycles wallet's `wallet_call`: " +
+					"`(record { canister : principal; method_name : text; args : blob; cycles : nat64 }) -> (variant { Ok : record { return : blob }; Err : text })`. " +
+					"The proxy, rather than the identity, is then the default controller of created canisters. Conflicts with `wallet_canister_id` and `orbit_station_id`.",
+				Optional: true,
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"proxy_method": schema.StringAttribute{
+				MarkdownDescription: "Method of the proxy canister (see `proxy_canister_id`) forwarding calls to the management canister. Defaults to `" + walletCallMethod + "`.",
+				Optional:            true,
+			},
+			"wallet_create_canister_cycles": schema.Int64Attribute{
+				MarkdownDescription: "Cycles attached by the wallet (see `wallet_canister_id`), the proxy canister (see `proxy_canister_id`) or the Orbit station (see `orbit_station_id`) to the canisters it creates. Defaults to 3T (3000000000000) cycles.",
 				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"max_inline_arg_size": schema.Int64Attribute{
+				MarkdownDescription: "The maximum size (in bytes) of candid-encoded canister arguments specified inline with `arg` or `arg_hex`, which are stored in the Terraform state. Larger arguments should be read from a file with `arg_file`, in which case only the path and the hash of the argument are stored. Defaults to no limit.",
+				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"required_labels": schema.ListAttribute{
+				ElementType:         types.StringType,
+				MarkdownDescription: "Policy: keys of the `labels` every `ic_canister` must set, e.g. `[\"team\", \"environment\"]`. Canisters missing any of them fail when planning.",
+				Optional:            true,
+			},
+			"forbidden_controllers": schema.ListAttribute{
+				ElementType:         types.StringType,
+				MarkdownDescription: "Policy: principals that must not control any `ic_canister`, e.g. personal identities in production. Canisters whose (resulting) controllers include any of them fail when planning.",
+				Optional:            true,
+				Validators: []validator.List{
+					listvalidator.ValueStringsAre(principalValidator{}),
+				},
+			},
+			"require_explicit_controllers": schema.BoolAttribute{
+				MarkdownDescription: "Policy: whether new canisters must set `controllers` explicitly, instead of defaulting to the provider's principal. Canisters created without `controllers` (by `ic_canister`, or in `ic_dapp`) then fail when planning. `ic_canister` may override it with its own `require_explicit_controllers`. Defaults to `false`.",
+				Optional:            true,
+			},
+			"cmc_min_amount_e8s": schema.Int64Attribute{
+				MarkdownDescription: "The minimum amount of ICP (in e8s) transferred to the CMC when creating a canister. By default the amount is derived from the CMC conversion rate only.",
+				Optional:            true,
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
+			},
+			"funding_subaccount": schema.StringAttribute{
+				MarkdownDescription: "Subaccount (hex encoded, 32 bytes) of the identity's ICP account that funds the transfers to the CMC when creating canisters, e.g. to isolate deployment funds. Refunds from the CMC are sent back to this subaccount. Can be overridden per canister. Defaults to the default subaccount.",
+				Optional:            true,
+				Validators: []validator.String{
+					subaccountValidator{},
+				},
 			},
 		},
 	}
 }
 
+func (p *IcProvider) ConfigValidators(ctx context.Context) []provider.ConfigValidator {
+	return []provider.ConfigValidator{
+		providervalidator.Conflicting(
+			path.MatchRoot("endpoint"),
+			path.MatchRoot("network"),
+		),
+		providervalidator.Conflicting(
+			path.MatchRoot("identity_pem"),
+			path.MatchRoot("identity_pem_file"),
+			path.MatchRoot("identity_name"),
+			path.MatchRoot("pkcs11_module"),
+			path.MatchRoot("vault_secret_path"),
+			path.MatchRoot("aws_kms_key_id"),
+			path.MatchRoot("gcp_kms_key_version"),
+		),
+		providervalidator.Conflicting(
+			path.MatchRoot("vault_token"),
+			path.MatchRoot("vault_role_id"),
+		),
+		providervalidator.Conflicting(
+			path.MatchRoot("wallet_canister_id"),
+			path.MatchRoot("proxy_canister_id"),
+			path.MatchRoot("orbit_station_id"),
+		),
+		providervalidator.RequiredTogether(
+			path.MatchRoot("vault_role_id"),
+			path.MatchRoot("vault_secret_id"),
+		),
+		providervalidator.RequiredTogether(
+			path.MatchRoot("pkcs11_module"),
+			path.MatchRoot("pkcs11_slot"),
+			path.MatchRoot("pkcs11_key_label"),
+		),
+	}
+}
+
 func (p *IcProvider) Configure(ctx context.Context, req provider.ConfigureRequest, resp *provider.ConfigureResponse) {
 
 	var data IcProviderModel
 
 	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
 
-	config, err := data.InferConfig()
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	identityPem, diags := data.InferIdentityPem()
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	retryPolicy, diags := data.InferRetryPolicy()
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	transport := transportSettings{
+		retryPolicy: retryPolicy,
+		userAgent:   providerUserAgent(p.version, req.TerraformVersion, data.UserAgentSuffix.ValueString()),
+		pool:        data.InferConnectionPool(),
+		logCtx:      ctx,
+	}
+	if data.TraceRequests.ValueBool() {
+		transport.traceCtx = ctx
+	}
+
+	config, err := data.InferConfig(identityPem)
 	if err != nil {
 		resp.Diagnostics.AddError(
 			"Could not set up IC agent",
@@ -122,6 +1084,61 @@ func (p *IcProvider) Configure(ctx context.Context, req provider.ConfigureReques
 		)
 	}
 
+	resp.Diagnostics.Append(applyPollingSettings(&config, data.CallTimeout, data.PollInterval)...)
+	resp.Diagnostics.Append(data.applyIngressExpiry(&config)...)
+	resp.Diagnostics.Append(data.applyRootKeySettings(&config, &transport)...)
+	resp.Diagnostics.Append(data.applyTLSSettings(&config, &transport)...)
+	var wrapBase func(http.RoundTripper) http.RoundTripper
+	if p.agentFixture != nil {
+		wrapBase, err = p.agentFixture(&config)
+		if err != nil {
+			resp.Diagnostics.AddError("Could not set up agent fixture", err.Error())
+		}
+	}
+	if config.ClientConfig != nil && config.ClientConfig.Host != nil {
+		// Each provider instance (e.g. each alias) sends its requests through its own
+		// transport, even if other instances are configured with the same endpoint
+		if len(p.endpointAlias) == 0 {
+			p.endpointAlias = newEndpointAlias()
+		}
+		config.ClientConfig.Host = withEndpointAlias(config.ClientConfig.Host, p.endpointAlias)
+		setEndpointTransport(config.ClientConfig.Host, newEndpointTransport(config.ClientConfig.Host, transport, wrapBase))
+	}
+
+	if !data.Pkcs11Module.IsNull() {
+		id, err := NewSignerIdentity(ctx, Pkcs11Signer{
+			Module:   data.Pkcs11Module.ValueString(),
+			Slot:     data.Pkcs11Slot.ValueInt64(),
+			KeyLabel: data.Pkcs11KeyLabel.ValueString(),
+		})
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("pkcs11_module"), "Could not set up PKCS#11 identity", err.Error())
+		} else {
+			config.Identity = id
+		}
+	}
+
+	if !data.AwsKmsKeyId.IsNull() {
+		id, err := NewSignerIdentity(ctx, &AwsKmsSigner{
+			KeyId:  data.AwsKmsKeyId.ValueString(),
+			Region: data.AwsKmsRegion.ValueString(),
+		})
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("aws_kms_key_id"), "Could not set up AWS KMS identity", err.Error())
+		} else {
+			config.Identity = id
+		}
+	}
+
+	if !data.GcpKmsKeyVersion.IsNull() {
+		id, err := NewSignerIdentity(ctx, &GcpKmsSigner{KeyVersion: data.GcpKmsKeyVersion.ValueString()})
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("gcp_kms_key_version"), "Could not set up Google Cloud KMS identity", err.Error())
+		} else {
+			config.Identity = id
+		}
+	}
+
 	if resp.Diagnostics.HasError() {
 		return
 	}
@@ -129,17 +1146,185 @@ func (p *IcProvider) Configure(ctx context.Context, req provider.ConfigureReques
 	// XXX: identity may not be defined (NPE)
 	tflog.Info(ctx, fmt.Sprintf("Using identity: %s", config.Identity.Sender().Encode()))
 
-	resp.ResourceData = &config
+	providerData := &IcProviderData{Config: &config, Cmc: data.InferCmcSettings(), Registry: newRegistryCache()}
+
+	if !data.MaxInlineArgSize.IsNull() {
+		providerData.MaxInlineArgSize = data.MaxInlineArgSize.ValueInt64()
+	}
+
+	if !data.RequiredLabels.IsNull() {
+		resp.Diagnostics.Append(data.RequiredLabels.ElementsAs(ctx, &providerData.CanisterPolicy.RequiredLabels, false)...)
+	}
+	if !data.ForbiddenControllers.IsNull() {
+		resp.Diagnostics.Append(data.ForbiddenControllers.ElementsAs(ctx, &providerData.CanisterPolicy.ForbiddenControllers, false)...)
+	}
+	providerData.CanisterPolicy.RequireExplicitControllers = data.RequireExplicitControllers.ValueBool()
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if !data.ApplySummaryFile.IsNull() {
+		providerData.ApplySummary = NewApplySummary(
+			data.ApplySummaryFile.ValueString(),
+			withoutEndpointAlias(config.ClientConfig.Host).String(),
+			config.Identity.Sender().Encode(),
+		)
+	}
+
+	if !data.MetricsFile.IsNull() {
+		providerData.Metrics = NewMetrics(data.MetricsFile.ValueString(), p.version)
+	}
+
+	providerData.CertifiedReads = data.CertifiedReads.IsNull() || data.CertifiedReads.ValueBool()
+	if !providerData.CertifiedReads && config.ClientConfig != nil && config.ClientConfig.Host != nil && !isLoopbackHost(config.ClientConfig.Host.Hostname()) {
+		resp.Diagnostics.AddAttributeWarning(path.Root("certified_reads"), "Uncertified reads",
+			fmt.Sprintf("The module hashes and controllers of canisters are read from %s without verifying their certificates, so the state is only as trustworthy as the endpoint.", config.ClientConfig.Host.Host))
+	}
+
+	if config.ClientConfig != nil && config.ClientConfig.Host != nil {
+		verifyQuerySignatures := data.VerifyQuerySignatures.IsNull() || data.VerifyQuerySignatures.ValueBool()
+		setVerifyQuerySignatures(config.ClientConfig.Host.Host, verifyQuerySignatures)
+		if !verifyQuerySignatures && !isLoopbackHost(config.ClientConfig.Host.Hostname()) {
+			resp.Diagnostics.AddAttributeWarning(path.Root("verify_query_signatures"), "Unverified queries",
+				fmt.Sprintf("The query replies of %s are not verified, so the canister data read with queries is only as trustworthy as the endpoint.", config.ClientConfig.Host.Host))
+		}
+	}
+
+	providerData.StreamCanisterLogs = data.StreamCanisterLogs.ValueBool()
+
+	if data.PreflightChecks.ValueBool() {
+		providerData.Preflight = NewPreflight()
+	}
+
+	if !data.UpgradeMaxParallel.IsNull() || !data.UpgradeBatchSize.IsNull() || !data.UpgradeBatchPause.IsNull() || !data.UpgradeHealthCheckMethod.IsNull() {
+		var batchPause time.Duration
+		if !data.UpgradeBatchPause.IsNull() {
+			batchPause, err = time.ParseDuration(data.UpgradeBatchPause.ValueString())
+			if err != nil {
+				resp.Diagnostics.AddAttributeError(path.Root("upgrade_batch_pause"), "Invalid duration", err.Error())
+				return
+			}
+		}
+		if !data.UpgradeHealthCheckMethod.IsNull() && data.UpgradeBatchSize.IsNull() {
+			resp.Diagnostics.AddAttributeWarning(path.Root("upgrade_health_check_method"), "Health checks skipped",
+				"The health checks are performed between waves of upgrades, so they are skipped unless upgrade_batch_size is set.")
+		}
+		providerData.Rollout = NewRollout(config, int(data.UpgradeMaxParallel.ValueInt64()), int(data.UpgradeBatchSize.ValueInt64()), batchPause, data.UpgradeHealthCheckMethod.ValueString())
+	}
+
+	if data.ReadOnly.ValueBool() {
+		providerData.ReadOnly = readOnlyConfigured
+	} else if config.ClientConfig != nil && config.ClientConfig.Host != nil && isMainnetHost(config.ClientConfig.Host.Hostname()) {
+		allowMainnet := data.AllowMainnet.ValueBool()
+		if data.AllowMainnet.IsNull() {
+			allowMainnet, _ = strconv.ParseBool(os.Getenv("IC_ALLOW_MAINNET"))
+		}
+		if !allowMainnet {
+			providerData.ReadOnly = readOnlyMainnet
+		}
+	}
+
+	providerData.RefreshMode = refreshModeFast
+	if !data.RefreshMode.IsNull() {
+		providerData.RefreshMode = data.RefreshMode.ValueString()
+	}
+
+	if !data.ManagementEffectiveCanisterId.IsNull() {
+		effectiveCanisterId, err := principal.Decode(data.ManagementEffectiveCanisterId.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("management_effective_canister_id"), "Invalid effective canister id", err.Error())
+			return
+		}
+		providerData.ManagementEffectiveCanisterId = &effectiveCanisterId
+	}
+
+	if !data.WalletCanisterId.IsNull() {
+		walletCanisterId, err := principal.Decode(data.WalletCanisterId.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("wallet_canister_id"), "Invalid wallet canister", err.Error())
+			return
+		}
+		providerData.ManagementProxy = &managementProxy{CanisterId: walletCanisterId, Method: walletCallMethod, Wallet: true}
+	}
+
+	if !data.ProxyCanisterId.IsNull() {
+		proxyCanisterId, err := principal.Decode(data.ProxyCanisterId.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("proxy_canister_id"), "Invalid proxy canister", err.Error())
+			return
+		}
+		providerData.ManagementProxy = &managementProxy{CanisterId: proxyCanisterId, Method: walletCallMethod}
+		if !data.ProxyMethod.IsNull() {
+			providerData.ManagementProxy.Method = data.ProxyMethod.ValueString()
+		}
+	}
+
+	if !data.OrbitStationId.IsNull() {
+		stationId, err := principal.Decode(data.OrbitStationId.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("orbit_station_id"), "Invalid Orbit station", err.Error())
+			return
+		}
+		providerData.ManagementProxy = &managementProxy{CanisterId: stationId, Orbit: true, ApprovalTimeout: defaultOrbitApprovalTimeout}
+		if !data.OrbitApprovalTimeout.IsNull() {
+			timeout, err := time.ParseDuration(data.OrbitApprovalTimeout.ValueString())
+			if err != nil {
+				resp.Diagnostics.AddAttributeError(path.Root("orbit_approval_timeout"), "Invalid duration", err.Error())
+				return
+			}
+			providerData.ManagementProxy.ApprovalTimeout = timeout
+		}
+	}
+
+	providerData.ProxyCreateCanisterCycles = defaultWalletCreateCanisterCycles
+	if !data.WalletCreateCanisterCycles.IsNull() {
+		providerData.ProxyCreateCanisterCycles = uint64(data.WalletCreateCanisterCycles.ValueInt64())
+	}
+
+	if !data.LockCanisterId.IsNull() {
+		lockCanisterId, err := principal.Decode(data.LockCanisterId.ValueString())
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(path.Root("lock_canister_id"), "Invalid lock canister", err.Error())
+			return
+		}
+
+		providerData.Lock, err = NewAdvisoryLock(&config, lockCanisterId)
+		if err != nil {
+			resp.Diagnostics.AddError("Could not set up locking", err.Error())
+			return
+		}
+	}
+
+	resp.ResourceData = providerData
+	resp.DataSourceData = providerData
 }
 
 func (p *IcProvider) Resources(ctx context.Context) []func() resource.Resource {
 	return []func() resource.Resource{
 		NewCanisterResource,
+		NewIcrc1MintingResource,
+		NewCustomSectionPolicyResource,
+		NewCkEthWithdrawalResource,
+		NewCyclesDepositResource,
+		NewCanisterCallResource,
+		NewRegistryRecordResource,
+		NewWaitResource,
+		NewSnsDeploymentResource,
+		NewDappResource,
 	}
 }
 
 func (p *IcProvider) DataSources(ctx context.Context) []func() datasource.DataSource {
-	return []func() datasource.DataSource{}
+	return []func() datasource.DataSource{
+		NewDashboardCanisterDataSource,
+		NewControlledCanistersDataSource,
+		NewCkEthDepositDataSource,
+		NewExpiredCanistersDataSource,
+		NewCanisterDataSource,
+		NewOrphanedCanistersDataSource,
+		NewSnsWasmDataSource,
+		NewSelfDataSource,
+	}
 }
 
 func (p *IcProvider) Functions(ctx context.Context) []func() function.Function {
@@ -153,6 +1338,27 @@ func (p *IcProvider) Functions(ctx context.Context) []func() function.Function {
 		func() function.Function {
 			return &ArgEncodeFunction{}
 		},
+		func() function.Function {
+			return &ArgDecodeFunction{}
+		},
+		func() function.Function {
+			return &ArgMergeFunction{}
+		},
+		func() function.Function {
+			return &ArgBlobFileFunction{}
+		},
+		func() function.Function {
+			return &AccountIdValidateFunction{}
+		},
+		func() function.Function {
+			return &IcpPaymentUriFunction{}
+		},
+		func() function.Function {
+			return &PrincipalFromPublicKeyFunction{}
+		},
+		func() function.Function {
+			return &WasmModuleHashFileFunction{}
+		},
 	}
 }
 
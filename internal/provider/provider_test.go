@@ -3,20 +3,38 @@
 package provider
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"testing"
 
-	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go"
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	tfpath "github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/provider"
 	"github.com/hashicorp/terraform-plugin-framework/providerserver"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-go/tfprotov6"
+	"github.com/hashicorp/terraform-plugin-go/tftypes"
 	"github.com/hashicorp/terraform-plugin-testing/config"
 	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/knownvalue"
+	"github.com/hashicorp/terraform-plugin-testing/statecheck"
+	"github.com/hashicorp/terraform-plugin-testing/terraform"
+	"github.com/hashicorp/terraform-plugin-testing/tfjsonpath"
+
+	"terraform-provider-ic/acctest"
 )
 
 // testAccProtoV6ProviderFactories are used to instantiate a provider during
@@ -27,6 +45,22 @@ var testAccProtoV6ProviderFactories = map[string]func() (tfprotov6.ProviderServe
 	"ic": providerserver.NewProtocol6WithError(New("test")()),
 }
 
+// Runs the acceptance tests against a PocketIC instance (see the pocketic network) instead
+// of the local replica if IC_TEST_NETWORK is "pocketic".
+func TestMain(m *testing.M) {
+	if os.Getenv("TF_ACC") != "" && os.Getenv("IC_TEST_NETWORK") == pocketIcNetwork {
+		endpoint, err := IcProviderModel{Network: types.StringValue(pocketIcNetwork)}.InferEndpoint()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not set up PocketIC: %s\n", err.Error())
+			os.Exit(1)
+		}
+		acctest.UseEndpoint(endpoint)
+		ProviderConfig = acctest.ProviderConfig
+	}
+
+	os.Exit(m.Run())
+}
+
 // Makes sure specific examples can be tf applied.
 func TestAccExamples(t *testing.T) {
 
@@ -50,11 +84,149 @@ func TestAccExamples(t *testing.T) {
 	})
 }
 
+// Check that the identity can be read from identity_pem_file.
+// Check that the controllers of canisters are read with and without certified reads.
+func TestAccProviderCertifiedReads(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	providerConfig := func(certifiedReads bool) string {
+		return fmt.Sprintf(`
+provider "ic" {
+    endpoint = "%s"
+    identity_pem_file = "%s"
+    certified_reads = %t
+}
+
+resource "ic_canister" "test" {}
+`, acctest.LocalEndpoint, testEnv.PemPath, certifiedReads)
+	}
+
+	controllersCheck := statecheck.ExpectKnownValue(
+		"ic_canister.test",
+		tfjsonpath.New("controllers"),
+		knownvalue.ListExact([]knownvalue.Check{knownvalue.StringExact(testEnv.Identity.Sender().Encode())}),
+	)
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config:            providerConfig(true),
+				ConfigStateChecks: []statecheck.StateCheck{controllersCheck},
+			},
+			{
+				Config:            providerConfig(false),
+				ConfigStateChecks: []statecheck.StateCheck{controllersCheck},
+			},
+		},
+	})
+}
+
+func TestAccProviderIdentityPemFile(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	invalidPemPath := path.Join(t.TempDir(), "invalid.pem")
+	err := os.WriteFile(invalidPemPath, []byte("not a PEM file"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	providerConfig := func(pemPath string) string {
+		return `
+provider "ic" {
+    endpoint = "` + acctest.LocalEndpoint + `"
+    identity_pem_file = "` + pemPath + `"
+}
+
+resource "ic_canister" "test" {}
+`
+	}
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config:      providerConfig(path.Join(t.TempDir(), "missing.pem")),
+				ExpectError: regexp.MustCompile("Could not read identity PEM file"),
+			},
+			{
+				Config:      providerConfig(invalidPemPath),
+				ExpectError: regexp.MustCompile("Invalid identity PEM file"),
+			},
+			{
+				Config: providerConfig(testEnv.PemPath),
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownValue(
+						"ic_canister.test",
+						tfjsonpath.New("controllers"),
+						knownvalue.ListExact([]knownvalue.Check{knownvalue.StringExact(testEnv.Identity.Sender().Encode())}),
+					),
+					statecheck.ExpectKnownValue(
+						"ic_canister.test",
+						tfjsonpath.New("created_by"),
+						knownvalue.StringExact(testEnv.Identity.Sender().Encode()),
+					),
+				},
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
+}
+
+// Check that dfx identities can be used by name.
+func TestAccProviderIdentityName(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	dfxConfigRoot := t.TempDir()
+	t.Setenv("DFX_CONFIG_ROOT", dfxConfigRoot)
+
+	identityDir := path.Join(dfxConfigRoot, ".config", "dfx", "identity", "terraform")
+	err := os.MkdirAll(identityDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pem, err := os.ReadFile(testEnv.PemPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(path.Join(identityDir, "identity.pem"), pem, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+provider "ic" {
+    endpoint = "` + acctest.LocalEndpoint + `"
+    identity_name = "terraform"
+}
+
+resource "ic_canister" "test" {}
+`,
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownValue(
+						"ic_canister.test",
+						tfjsonpath.New("created_by"),
+						knownvalue.StringExact(testEnv.Identity.Sender().Encode()),
+					),
+				},
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
+}
+
 // Struct carrying test-related data.
 type TestEnv struct {
-	PemPath              string
-	Identity             identity.Identity
-	ConfigVariables      map[string]config.Variable
+	acctest.TestEnv
 	HelloWorldWasmPath   string
 	HelloWorldWasmSha256 string
 }
@@ -64,19 +236,11 @@ type TestEnv struct {
 // (which is accessible from the TestEnv struct).
 func NewTestEnv(t *testing.T) TestEnv {
 
-	pemPath, id := CreateTestPEM(t)
-
-	t.Setenv("IC_PEM_IDENTITY_PATH", pemPath)
-
-	configVariables := map[string]config.Variable{}
+	testEnv := acctest.NewTestEnv(t)
 
 	// The path to the test canister used in the terraforming
 	helloWorldWasm := GetHelloWorldWasmPath(t)
-	configVariables["hello_world_wasm"] = config.StringVariable(helloWorldWasm)
-
-	// Use a temporary PEM as identity and inject it into the terraform config
-	providerController := id.Sender().Encode()
-	configVariables["provider_controller"] = config.StringVariable(providerController)
+	testEnv.ConfigVariables["hello_world_wasm"] = config.StringVariable(helloWorldWasm)
 
 	wasmModule, err := os.ReadFile(helloWorldWasm)
 	if err != nil {
@@ -86,55 +250,21 @@ func NewTestEnv(t *testing.T) TestEnv {
 	wasmSha256Raw := sha256.Sum256(wasmModule)
 	wasmSha256 := hex.EncodeToString(wasmSha256Raw[:])
 	return TestEnv{
-		PemPath:              pemPath,
-		Identity:             id,
-		ConfigVariables:      configVariables,
+		TestEnv:              testEnv,
 		HelloWorldWasmPath:   helloWorldWasm,
 		HelloWorldWasmSha256: wasmSha256,
 	}
 }
 
 // Variables set by `NewTestEnv`.
-var VariablesConfig = `
+var VariablesConfig = acctest.VariablesConfig + `
 variable "hello_world_wasm" {
     type = string
 }
-
-variable "provider_controller" {
-    type = string
-}
 `
 
 // Provider config with local replica.
-var ProviderConfig = `
-provider "ic" {
-    endpoint = "http://localhost:4943"
-}
-`
-
-// Creates a PEM file in a temporary directory.
-func CreateTestPEM(t *testing.T) (string, identity.Identity) {
-
-	id, err := identity.NewRandomEd25519Identity()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	tmpdir := t.TempDir()
-	pemPath := path.Join(tmpdir, "pem")
-
-	data, err := id.ToPEM()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	err = os.WriteFile(pemPath, data, 0644)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	return pemPath, id
-}
+var ProviderConfig = acctest.ProviderConfig
 
 // Returns the root of the repo.
 func GetRepoRoot(t *testing.T) string {
@@ -158,3 +288,109 @@ func GetHelloWorldWasmPath(t *testing.T) string {
 
 	return helloWorldWasm
 }
+
+// Check that the HTTP requests of the provider identify it, with the user_agent_suffix.
+func TestProviderUserAgent(t *testing.T) {
+
+	var userAgents sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents.Store(r.UserAgent(), true)
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+	}))
+	defer server.Close()
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+provider "ic" {
+    user_agent_suffix = "team-a/deploy"
+}
+
+resource "ic_wait" "headers" {
+    canister_id = "ryjl3-tyaaa-aaaaa-aaaba-cai"
+    security_headers = {
+        url = "` + server.URL + `"
+    }
+}
+`,
+				Check: func(s *terraform.State) error {
+					userAgentRegexp := regexp.MustCompile(`^terraform-provider-ic/test Terraform/\S+ team-a/deploy$`)
+					var err error = fmt.Errorf("no request")
+					userAgents.Range(func(ua any, _ any) bool {
+						if !userAgentRegexp.MatchString(ua.(string)) {
+							err = fmt.Errorf("unexpected User-Agent %q", ua)
+							return false
+						}
+						err = nil
+						return true
+					})
+					return err
+				},
+			},
+		},
+	})
+}
+
+// Configures two provider instances (like two aliases) with the same endpoint but different
+// settings, checking that each sends its requests through its own transport.
+func TestProviderEndpointAliases(t *testing.T) {
+	ctx := context.Background()
+
+	var userAgents sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		suffix := r.UserAgent()[strings.LastIndex(r.UserAgent(), " ")+1:]
+		userAgents.Store(suffix, true)
+	}))
+	defer server.Close()
+
+	// Returns the agent configuration of a provider instance configured with the attributes
+	configure := func(p *IcProvider, attributes map[string]attr.Value) agent.Config {
+		t.Helper()
+		var schemaResp provider.SchemaResponse
+		p.Schema(ctx, provider.SchemaRequest{}, &schemaResp)
+		schema := schemaResp.Schema
+
+		plan := tfsdk.Plan{Schema: schema, Raw: tftypes.NewValue(schema.Type().TerraformType(ctx), nil)}
+		for name, value := range attributes {
+			if d := plan.SetAttribute(ctx, tfpath.Root(name), value); d.HasError() {
+				t.Fatal(d)
+			}
+		}
+
+		var resp provider.ConfigureResponse
+		p.Configure(ctx, provider.ConfigureRequest{Config: tfsdk.Config{Schema: schema, Raw: plan.Raw}}, &resp)
+		if resp.Diagnostics.HasError() {
+			t.Fatal(resp.Diagnostics)
+		}
+		return *resp.ResourceData.(*IcProviderData).Config
+	}
+
+	var configs []agent.Config
+	for _, suffix := range []string{"alias-a", "alias-b"} {
+		configs = append(configs, configure(&IcProvider{version: "test"}, map[string]attr.Value{
+			"endpoint":          types.StringValue(server.URL),
+			"fetch_root_key":    types.BoolValue(false),
+			"user_agent_suffix": types.StringValue(suffix),
+		}))
+	}
+
+	for i, config := range configs {
+		if withoutEndpointAlias(config.ClientConfig.Host).String() != server.URL {
+			t.Errorf("expected endpoint %s, got %s", server.URL, withoutEndpointAlias(config.ClientConfig.Host))
+		}
+		a, err := agent.New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = a.Client().Status()
+		if _, ok := userAgents.Load([]string{"alias-a", "alias-b"}[i]); !ok {
+			t.Errorf("expected the request of provider %d to be sent with its user agent", i)
+		}
+	}
+	if configs[0].ClientConfig.Host.String() == configs[1].ClientConfig.Host.String() {
+		t.Error("expected the endpoints of the providers to have different aliases")
+	}
+}
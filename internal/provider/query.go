@@ -0,0 +1,258 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/certification/hashtree"
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Performs a query call and returns the raw (candid-encoded) reply.
+// NOTE: agent-go only exposes queries that decode the reply into known Go types, which
+// does not work when the reply type is not known in advance.
+func QueryRaw(config agent.Config, canisterId principal.Principal, methodName string, arg []byte) ([]byte, error) {
+	return QueryRawWithEffectiveId(config, canisterId, canisterId, methodName, arg)
+}
+
+// Same as QueryRaw, but with an explicit effective canister id (e.g. the target canister
+// for queries to the management canister).
+func QueryRawWithEffectiveId(config agent.Config, effectiveCanisterId principal.Principal, canisterId principal.Principal, methodName string, arg []byte) ([]byte, error) {
+
+	a, err := newAgent(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create agent: %w", err)
+	}
+
+	var id identity.Identity = identity.AnonymousIdentity{}
+	if config.Identity != nil {
+		id = config.Identity
+	}
+
+	if len(arg) == 0 {
+		// Default to the empty Candid argument list.
+		arg = []byte{'D', 'I', 'D', 'L', 0, 0}
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	ingressExpiry := config.IngressExpiry
+	if ingressExpiry == 0 {
+		ingressExpiry = 10 * time.Second
+	}
+
+	request := agent.Request{
+		Type:          agent.RequestTypeQuery,
+		Sender:        id.Sender(),
+		CanisterID:    canisterId,
+		MethodName:    methodName,
+		Arguments:     arg,
+		IngressExpiry: uint64(time.Now().Add(ingressExpiry).UnixNano()),
+		Nonce:         nonce,
+	}
+
+	requestId := agent.NewRequestID(request)
+	data, err := cbor.Marshal(agent.Envelope{
+		Content:      request,
+		SenderPubKey: id.PublicKey(),
+		SenderSig:    requestId.Sign(id),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not encode query: %w", err)
+	}
+
+	respData, err := a.Client().Query(effectiveCanisterId, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp queryResponse
+	err = cbor.Unmarshal(respData, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode query response: %w", err)
+	}
+
+	if host, verify := verifiesQuerySignatures(config); verify && (resp.Status == "replied" || resp.Status == "rejected") {
+		err = verifyQueryResponse(a, host, effectiveCanisterId, requestId, &resp)
+		if err != nil {
+			return nil, fmt.Errorf("could not verify the response of %s: %w", methodName, err)
+		}
+	}
+
+	switch resp.Status {
+	case "replied":
+		return resp.Reply["arg"], nil
+	case "rejected":
+		return nil, newRejectError(resp.RejectCode, resp.RejectMessage, requestId, effectiveCanisterId, canisterId, methodName)
+	default:
+		return nil, fmt.Errorf("unexpected query status: %s", resp.Status)
+	}
+}
+
+// Performs an update call and returns the raw (candid-encoded) reply, polling the request
+// status until the call completes. If a previous identical call timed out, its request is
+// polled instead of submitting the call again (see trackedCall).
+// NOTE: like for queries, agent-go only exposes calls whose arguments are encoded from Go
+// values, which loses the types declared in .did files (e.g. nat64 vs nat).
+func CallRaw(config agent.Config, canisterId principal.Principal, methodName string, arg []byte) ([]byte, error) {
+	return CallRawWithEffectiveId(config, canisterId, canisterId, methodName, arg)
+}
+
+// Same as CallRaw, with the argument encoded from a Go value and the reply decoded into
+// result (unless nil), like the calls of agent-go, so that calls such as ledger transfers
+// are tracked (see trackedCall).
+func callAndWait(config agent.Config, canisterId principal.Principal, methodName string, arg any, result any) error {
+	argRaw, err := idl.Marshal([]any{arg})
+	if err != nil {
+		return err
+	}
+	reply, err := CallRaw(config, canisterId, methodName, argRaw)
+	if err != nil || result == nil {
+		return err
+	}
+	return idl.Unmarshal(reply, []any{result})
+}
+
+// Same as CallRaw, but with an explicit effective canister id (e.g. the target canister
+// for calls to the management canister).
+func CallRawWithEffectiveId(config agent.Config, effectiveCanisterId principal.Principal, canisterId principal.Principal, methodName string, arg []byte) ([]byte, error) {
+
+	a, err := newAgent(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not create agent: %w", err)
+	}
+
+	var id identity.Identity = identity.AnonymousIdentity{}
+	if config.Identity != nil {
+		id = config.Identity
+	}
+
+	if len(arg) == 0 {
+		// Default to the empty Candid argument list.
+		arg = []byte{'D', 'I', 'D', 'L', 0, 0}
+	}
+
+	// A previous identical call whose outcome is unknown is polled rather than submitted again
+	fingerprint := callFingerprint(id.Sender(), effectiveCanisterId, canisterId, methodName, arg)
+	defer lockTrackedCall(fingerprint)()
+	requestId, expiry, resumed := resumeTrackedCall(fingerprint)
+	if resumed && time.Now().After(expiry) {
+		// Calls that the IC didn't receive before their expiry will never be executed
+		status, _, err := a.RequestStatus(effectiveCanisterId, requestId)
+		if err == nil && status == nil {
+			forgetTrackedCall(fingerprint)
+			resumed = false
+		}
+	}
+
+	if resumed {
+		tflog.Info(endpointLogContext(config), fmt.Sprintf("Resuming call to %s of %s (request 0x%x) instead of submitting it again", methodName, canisterId.Encode(), requestId[:]))
+	} else {
+		nonce := make([]byte, 16)
+		_, err = rand.Read(nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		ingressExpiry := config.IngressExpiry
+		if ingressExpiry == 0 {
+			ingressExpiry = 10 * time.Second
+		}
+		expiry = time.Now().Add(ingressExpiry)
+
+		request := agent.Request{
+			Type:          agent.RequestTypeCall,
+			Sender:        id.Sender(),
+			CanisterID:    canisterId,
+			MethodName:    methodName,
+			Arguments:     arg,
+			IngressExpiry: uint64(expiry.UnixNano()),
+			Nonce:         nonce,
+		}
+
+		requestId = agent.NewRequestID(request)
+		data, err := cbor.Marshal(agent.Envelope{
+			Content:      request,
+			SenderPubKey: id.PublicKey(),
+			SenderSig:    requestId.Sign(id),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not encode call: %w", err)
+		}
+
+		trackCall(fingerprint, requestId, expiry)
+
+		_, err = a.Client().Call(effectiveCanisterId, data)
+		if err != nil {
+			// Transient errors are already retried with the same request (see retryTransport)
+			forgetTrackedCall(fingerprint)
+			return nil, err
+		}
+	}
+
+	pollDelay := config.PollDelay
+	if pollDelay == 0 {
+		pollDelay = time.Second
+	}
+
+	pollTimeout := config.PollTimeout
+	if pollTimeout == 0 {
+		pollTimeout = 10 * time.Second
+	}
+
+	path := []hashtree.Label{hashtree.Label("request_status"), requestId[:]}
+	deadline := time.Now().Add(pollTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(pollDelay)
+
+		status, node, err := a.RequestStatus(effectiveCanisterId, requestId)
+		if err != nil {
+			return nil, err
+		}
+
+		tree := hashtree.NewHashTree(node)
+		switch string(status) {
+		case "replied":
+			forgetTrackedCall(fingerprint)
+			reply, err := tree.Lookup(append(path, hashtree.Label("reply"))...)
+			if err != nil {
+				return nil, fmt.Errorf("no reply found: %w", err)
+			}
+			return reply, nil
+		case "rejected":
+			forgetTrackedCall(fingerprint)
+			code, err := tree.Lookup(append(path, hashtree.Label("reject_code"))...)
+			if err != nil {
+				return nil, err
+			}
+			message, err := tree.Lookup(append(path, hashtree.Label("reject_message"))...)
+			if err != nil {
+				return nil, err
+			}
+			reject := newRejectError(new(big.Int).SetBytes(code).Uint64(), string(message), requestId, effectiveCanisterId, canisterId, methodName)
+			if errorCode, err := tree.Lookup(append(path, hashtree.Label("error_code"))...); err == nil {
+				reject.ErrorCode = string(errorCode)
+			}
+			return nil, reject
+		case "done":
+			forgetTrackedCall(fingerprint)
+			return nil, fmt.Errorf("the reply of the call was already pruned")
+		}
+	}
+
+	return nil, fmt.Errorf("timed out waiting for the reply of %s (request 0x%x), which is polled again rather than submitted again when the call is retried", methodName, requestId[:])
+}
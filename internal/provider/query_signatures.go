@@ -0,0 +1,233 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/certification"
+	"github.com/aviate-labs/agent-go/certification/hashtree"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Domain separator of the node signatures of query responses.
+var queryResponseDomainSeparator = []byte("\x0Bic-response")
+
+// queryResponse is the response of a query, including the signatures of the replica nodes.
+// NOTE: agent-go (v0.4.4) neither decodes nor verifies the signatures of query responses.
+type queryResponse struct {
+	Status        string                   `cbor:"status"`
+	Reply         map[string][]byte        `cbor:"reply"`
+	RejectCode    uint64                   `cbor:"reject_code"`
+	RejectMessage string                   `cbor:"reject_message"`
+	ErrorCode     string                   `cbor:"error_code"`
+	Signatures    []queryResponseSignature `cbor:"signatures"`
+}
+
+type queryResponseSignature struct {
+	Timestamp uint64 `cbor:"timestamp"`
+	Signature []byte `cbor:"signature"`
+	Identity  []byte `cbor:"identity"` // principal of the node
+}
+
+// Hosts whose query responses are not verified (verify_query_signatures = false).
+var unverifiedQueryHosts sync.Map
+
+// Sets whether the signatures of the query responses of the host are verified.
+func setVerifyQuerySignatures(host string, verify bool) {
+	if verify {
+		unverifiedQueryHosts.Delete(host)
+	} else {
+		unverifiedQueryHosts.Store(host, true)
+	}
+}
+
+// Returns the host of the agent's endpoint, and whether the signatures of its query
+// responses are verified.
+func verifiesQuerySignatures(config agent.Config) (string, bool) {
+	if config.ClientConfig == nil || config.ClientConfig.Host == nil {
+		return icpApi.Host, true
+	}
+	host := config.ClientConfig.Host.Host
+	_, unverified := unverifiedQueryHosts.Load(host)
+	return host, !unverified
+}
+
+// Returns the representation-independent hash of the response that the nodes sign, see
+// https://internetcomputer.org/docs/current/references/ic-interface-spec#http-query
+func (resp *queryResponse) signedHash(requestId agent.RequestID, timestamp uint64) [32]byte {
+	fields := map[string]any{
+		"status":     resp.Status,
+		"timestamp":  timestamp,
+		"request_id": requestId[:],
+	}
+	if resp.Status == "replied" {
+		fields["reply"] = map[string]any{"arg": resp.Reply["arg"]}
+	} else {
+		fields["reject_code"] = resp.RejectCode
+		fields["reject_message"] = resp.RejectMessage
+		if len(resp.ErrorCode) > 0 {
+			fields["error_code"] = resp.ErrorCode
+		}
+	}
+	return representationIndependentHash(fields)
+}
+
+// Returns the representation-independent hash of the map, whose values are strings, blobs,
+// nats or maps.
+func representationIndependentHash(fields map[string]any) [32]byte {
+	pairs := make([][]byte, 0, len(fields))
+	for key, value := range fields {
+		keyHash := sha256.Sum256([]byte(key))
+
+		var valueHash [32]byte
+		switch v := value.(type) {
+		case string:
+			valueHash = sha256.Sum256([]byte(v))
+		case []byte:
+			valueHash = sha256.Sum256(v)
+		case uint64:
+			valueHash = sha256.Sum256(candidUleb(v))
+		case map[string]any:
+			valueHash = representationIndependentHash(v)
+		}
+
+		pairs = append(pairs, append(keyHash[:], valueHash[:]...))
+	}
+	sort.Slice(pairs, func(i, j int) bool { return bytes.Compare(pairs[i], pairs[j]) < 0 })
+
+	return sha256.Sum256(bytes.Join(pairs, nil))
+}
+
+// The certified subnet tree (node keys) of a subnet, read through one of its canisters.
+type subnetTree struct {
+	id   principal.Principal
+	tree hashtree.HashTree
+}
+
+// Subnet trees by host and effective canister id, read once per run.
+var subnetTrees sync.Map
+
+// Returns the certified tree of the subnet of the canister, read with read_state (unless
+// refresh is false and the tree was read before). The certificate is verified against the
+// agent's root key.
+func readSubnetTree(a *agent.Agent, host string, canisterId principal.Principal, refresh bool) (*subnetTree, error) {
+	key := host + "/" + canisterId.Encode()
+	if cached, ok := subnetTrees.Load(key); ok && !refresh {
+		return cached.(*subnetTree), nil
+	}
+
+	data, err := cbor.Marshal(agent.Envelope{
+		Content: agent.Request{
+			Type:          agent.RequestTypeReadState,
+			Sender:        principal.AnonymousID,
+			Paths:         [][]hashtree.Label{{hashtree.Label("subnet")}},
+			IngressExpiry: uint64(time.Now().Add(maxCertificateTimeOffset).UnixNano()),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not encode read_state request: %w", err)
+	}
+
+	respData, err := a.Client().ReadState(canisterId, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the subnet of %s: %w", canisterId.Encode(), err)
+	}
+
+	var resp map[string][]byte
+	if err := cbor.Unmarshal(respData, &resp); err != nil {
+		return nil, fmt.Errorf("could not decode read_state response: %w", err)
+	}
+
+	rootKey := a.GetRootKey()
+	if len(rootKey) < blsPublicKeyLength {
+		return nil, fmt.Errorf("invalid root key")
+	}
+
+	cert, err := certification.New(canisterId, rootKey[len(rootKey)-blsPublicKeyLength:], resp["certificate"])
+	if err != nil {
+		return nil, fmt.Errorf("could not decode certificate: %w", err)
+	}
+	if err := verifyCertificate(*cert, cert.RootKey); err != nil {
+		return nil, fmt.Errorf("invalid certificate of the subnet of %s: %w", canisterId.Encode(), err)
+	}
+
+	// Canisters of the root subnet are certified by the root key, without delegation
+	subnet := &subnetTree{id: principal.NewSelfAuthenticating(rootKey), tree: cert.Cert.Tree}
+	if cert.Cert.Delegation != nil {
+		subnet.id = cert.Cert.Delegation.SubnetId
+	}
+
+	subnetTrees.Store(key, subnet)
+	return subnet, nil
+}
+
+// Returns the public key of the node of the subnet.
+func (s *subnetTree) nodePublicKey(nodeId []byte) (ed25519.PublicKey, error) {
+	der, err := s.tree.Lookup(hashtree.Label("subnet"), s.id.Raw, hashtree.Label("node"), nodeId, hashtree.Label("public_key"))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an Ed25519 public key, got %T", key)
+	}
+	return edKey, nil
+}
+
+// Verifies that the response is signed by nodes of the subnet of the (effective) canister,
+// with recent signatures.
+func verifyQueryResponse(a *agent.Agent, host string, effectiveCanisterId principal.Principal, requestId agent.RequestID, resp *queryResponse) error {
+	if len(resp.Signatures) == 0 {
+		return fmt.Errorf("the query response is not signed (verify_query_signatures can be disabled for replicas that don't sign query responses)")
+	}
+
+	subnet, err := readSubnetTree(a, host, effectiveCanisterId, false)
+	if err != nil {
+		return err
+	}
+
+	for _, signature := range resp.Signatures {
+		node := principal.Principal{Raw: signature.Identity}
+
+		publicKey, err := subnet.nodePublicKey(node.Raw)
+		if err != nil {
+			// The node may have joined the subnet since the subnet was read
+			subnet, err = readSubnetTree(a, host, effectiveCanisterId, true)
+			if err != nil {
+				return err
+			}
+			publicKey, err = subnet.nodePublicKey(node.Raw)
+			if err != nil {
+				return fmt.Errorf("the query response is signed by %s, which is not a node of subnet %s", node.Encode(), subnet.id.Encode())
+			}
+		}
+
+		signedTime := time.Unix(0, int64(signature.Timestamp))
+		if time.Since(signedTime).Abs() > maxCertificateTimeOffset {
+			return fmt.Errorf("the query response was signed by %s at %s, more than %s away from the local time", node.Encode(), signedTime.UTC().Format(time.RFC3339), maxCertificateTimeOffset)
+		}
+
+		hash := resp.signedHash(requestId, signature.Timestamp)
+		message := append(append([]byte{}, queryResponseDomainSeparator...), hash[:]...)
+		if !ed25519.Verify(publicKey, message, signature.Signature) {
+			return fmt.Errorf("invalid signature of the query response by node %s", node.Encode())
+		}
+	}
+
+	return nil
+}
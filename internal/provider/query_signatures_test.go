@@ -0,0 +1,153 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Checks the hashes against the examples of request ids of the interface spec, see
+// https://internetcomputer.org/docs/current/references/ic-interface-spec#request-id
+func TestRepresentationIndependentHash(t *testing.T) {
+	canisterId := []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x04, 0xD2}
+
+	tests := []struct {
+		name   string
+		fields map[string]any
+		hash   string
+	}{
+		{
+			name: "call",
+			fields: map[string]any{
+				"request_type": "call",
+				"canister_id":  canisterId,
+				"method_name":  "hello",
+				"arg":          []byte("DIDL\x00\xFD*"),
+			},
+			hash: "8781291c347db32a9d8c10eb62b710fce5a93be676474c42babc74c51858f94b",
+		},
+		{
+			name: "signed call",
+			fields: map[string]any{
+				"request_type":   "call",
+				"sender":         []byte{0x04},
+				"ingress_expiry": uint64(1685570400000000000),
+				"canister_id":    canisterId,
+				"method_name":    "hello",
+				"arg":            []byte("DIDL\x00\xFD*"),
+			},
+			hash: "1d1091364d6bb8a6c16b203ee75467d59ead468f523eb058880ae8ec80e2b101",
+		},
+		{
+			name:   "empty",
+			fields: map[string]any{},
+			hash:   "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hash := representationIndependentHash(test.fields)
+			if hex.EncodeToString(hash[:]) != test.hash {
+				t.Fatalf("expected %s, got %x", test.hash, hash)
+			}
+		})
+	}
+
+	// The signed hash of query responses covers the time of the signature
+	resp := queryResponse{Status: "replied", Reply: map[string][]byte{"arg": []byte("DIDL\x00\x00")}}
+	if resp.signedHash(agent.RequestID{1}, 1) == resp.signedHash(agent.RequestID{1}, 2) {
+		t.Error("the signed hash doesn't depend on the timestamp")
+	}
+}
+
+// Checks the verification of query responses signed by the node of the mock backend.
+func TestVerifyQueryResponse(t *testing.T) {
+	name := strings.ToLower(t.Name())
+	host, _ := url.Parse("mock://" + name)
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, nil))
+	backend, err := loadMockBackend(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := newAgent(agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		FetchRootKey: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	canisterId := principal.MustDecode("ryjl3-tyaaa-aaaaa-aaaba-cai")
+	requestId := agent.RequestID{1, 2, 3}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Returns a reply signed with the key at the time, as the node
+	signed := func(reply []byte, key ed25519.PrivateKey, node principal.Principal, at time.Time) *queryResponse {
+		resp := &queryResponse{Status: "replied", Reply: map[string][]byte{"arg": reply}}
+		timestamp := uint64(at.UnixNano())
+		hash := resp.signedHash(requestId, timestamp)
+		resp.Signatures = []queryResponseSignature{{
+			Timestamp: timestamp,
+			Signature: ed25519.Sign(key, append(slices.Clone(queryResponseDomainSeparator), hash[:]...)),
+			Identity:  node.Raw,
+		}}
+		return resp
+	}
+	reply := []byte("DIDL\x00\x01\x71\x05hello")
+
+	tampered := signed(reply, backend.nodeKey, backend.nodeId, time.Now())
+	tampered.Reply["arg"] = []byte("DIDL\x00\x01\x71\x05HELLO")
+	rejected := signed(reply, backend.nodeKey, backend.nodeId, time.Now())
+	rejected.Status, rejected.RejectCode, rejected.RejectMessage = "rejected", 5, "forged"
+
+	tests := []struct {
+		name      string
+		resp      *queryResponse
+		requestId agent.RequestID // requestId if zero
+		err       string          // empty if valid
+	}{
+		{name: "valid", resp: signed(reply, backend.nodeKey, backend.nodeId, time.Now())},
+		{name: "tampered reply", resp: tampered, err: "invalid signature"},
+		{name: "tampered status", resp: rejected, err: "invalid signature"},
+		{name: "other request", resp: signed(reply, backend.nodeKey, backend.nodeId, time.Now()), requestId: agent.RequestID{4, 5, 6}, err: "invalid signature"},
+		{name: "wrong node key", resp: signed(reply, otherKey, backend.nodeId, time.Now()), err: "invalid signature"},
+		{name: "unknown node", resp: signed(reply, otherKey, principal.NewSelfAuthenticating(otherKey.Public().(ed25519.PublicKey)), time.Now()), err: "not a node of subnet"},
+		{name: "expired", resp: signed(reply, backend.nodeKey, backend.nodeId, time.Now().Add(-2*maxCertificateTimeOffset)), err: "away from the local time"},
+		{name: "from the future", resp: signed(reply, backend.nodeKey, backend.nodeId, time.Now().Add(2*maxCertificateTimeOffset)), err: "away from the local time"},
+		{name: "unsigned", resp: &queryResponse{Status: "replied", Reply: map[string][]byte{"arg": reply}}, err: "not signed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := requestId
+			if test.requestId != (agent.RequestID{}) {
+				id = test.requestId
+			}
+			err := verifyQueryResponse(a, host.Host, canisterId, id, test.resp)
+			if len(test.err) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
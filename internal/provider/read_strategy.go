@@ -0,0 +1,75 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// The read_strategy of data sources trades the integrity of the data they read for speed:
+//   - query: best-effort reads, i.e. queries (and read_state requests) answered by a single
+//     replica, whose results aren't certified by the subnet.
+//   - certified: reads whose results are certified by the subnet, i.e. read_state requests
+//     whose certificates are verified, or update calls (executed by all the replicas).
+const (
+	readStrategyQuery     = "query"
+	readStrategyCertified = "certified"
+)
+
+// Returns the read_strategy attribute of data sources, described by what the strategies
+// mean for the data source.
+func readStrategyAttribute(description string) schema.StringAttribute {
+	return schema.StringAttribute{
+		Optional:            true,
+		MarkdownDescription: description,
+		Validators: []validator.String{
+			stringvalidator.OneOf(readStrategyQuery, readStrategyCertified),
+		},
+	}
+}
+
+// Returns whether the reads of the data source are certified, given its read_strategy (or
+// the default if unset). The choice is logged, and recorded as a warning if the data
+// source explicitly opts out of certification.
+func certifiedReadStrategy(ctx context.Context, dataSource string, readStrategy types.String, certifiedByDefault bool) (bool, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	certified := certifiedByDefault
+	if !readStrategy.IsNull() && !readStrategy.IsUnknown() {
+		certified = readStrategy.ValueString() == readStrategyCertified
+	}
+
+	strategy := readStrategyQuery
+	if certified {
+		strategy = readStrategyCertified
+	}
+	tflog.Info(ctx, fmt.Sprintf("Reading %s with the %s read strategy", dataSource, strategy))
+
+	if !certified && !readStrategy.IsNull() {
+		diags.AddAttributeWarning(path.Root("read_strategy"), "Uncertified reads",
+			fmt.Sprintf("%s is read with best-effort queries answered by a single replica, so it is only as trustworthy as that replica. Use the %q read strategy for production refreshes.", dataSource, readStrategyCertified))
+	}
+
+	return certified, diags
+}
+
+// Reads data from the canister with the given read strategy: a query, or (if certified)
+// an update call, whose reply is certified by the subnet.
+func readCanisterRaw(config agent.Config, certified bool, canisterId principal.Principal, methodName string, arg []byte) ([]byte, error) {
+	if certified {
+		return CallRaw(config, canisterId, methodName, arg)
+	}
+	return QueryRaw(config, canisterId, methodName, arg)
+}
@@ -0,0 +1,286 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/ic"
+	"github.com/aviate-labs/agent-go/principal"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Error code returned by the registry when a key does not exist
+const registryErrorKeyNotPresent = 1
+
+// Types of registry mutations (RegistryMutation.Type)
+const (
+	registryMutationInsert = 0
+	registryMutationUpdate = 1
+	registryMutationDelete = 2
+)
+
+// NOTE: the agent-go (v0.4.4) registry bindings have a broken field tag for this type
+type getSubnetForCanisterRequest struct {
+	Principal *principal.Principal `ic:"principal,omitempty"`
+}
+
+type getSubnetForCanisterResult struct {
+	Ok *struct {
+		SubnetId *principal.Principal `ic:"subnet_id,omitempty"`
+	} `ic:"Ok,variant"`
+	Err *string `ic:"Err,variant"`
+}
+
+// Returns the subnet the canister is running on, according to the registry.
+func subnetForCanister(config agent.Config, canisterId principal.Principal) (principal.Principal, error) {
+	a, err := newAgent(config)
+	if err != nil {
+		return principal.Principal{}, fmt.Errorf("could not create agent: %w", err)
+	}
+
+	var res getSubnetForCanisterResult
+	err = a.Query(ic.REGISTRY_PRINCIPAL, "get_subnet_for_canister", []any{getSubnetForCanisterRequest{Principal: &canisterId}}, []any{&res})
+	if err != nil {
+		return principal.Principal{}, err
+	}
+
+	if res.Err != nil {
+		return principal.Principal{}, fmt.Errorf("%s", *res.Err)
+	}
+
+	if res.Ok == nil || res.Ok.SubnetId == nil {
+		return principal.Principal{}, fmt.Errorf("no subnet found for canister %s", canisterId.Encode())
+	}
+
+	return *res.Ok.SubnetId, nil
+}
+
+// Reads the (protobuf-encoded) value of a registry key, at the latest version. Returns
+// nil if the key does not exist.
+// NOTE: the registry's get_value uses protobuf (not candid) for both the request and the
+// response, which we encode and decode by hand.
+func fetchRegistryValue(config agent.Config, key string) ([]byte, error) {
+	return fetchRegistryValueFrom(config, ic.REGISTRY_PRINCIPAL, key)
+}
+
+// Same as fetchRegistryValue, but with an explicit registry canister (e.g. on private
+// networks).
+func fetchRegistryValueFrom(config agent.Config, registryId principal.Principal, key string) ([]byte, error) {
+	// RegistryGetValueRequest { bytes key = 2; }
+	request := protowire.AppendTag(nil, 2, protowire.BytesType)
+	request = protowire.AppendBytes(request, []byte(key))
+
+	response, err := QueryRaw(config, registryId, "get_value", request)
+	if err != nil {
+		return nil, err
+	}
+
+	// RegistryGetValueResponse { RegistryError error = 1; uint64 version = 2; bytes value = 3; }
+	fields, err := readProtoFields(response)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode registry response: %w", err)
+	}
+
+	for _, registryError := range fields[1] {
+		// RegistryError { int32 code = 1; string reason = 2; }
+		errorFields, err := readProtoFields(registryError)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode registry error: %w", err)
+		}
+
+		code, _ := protowire.ConsumeVarint(firstOrEmpty(errorFields[1]))
+		if code == registryErrorKeyNotPresent {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("registry error (%d): %s", code, string(firstOrEmpty(errorFields[2])))
+	}
+
+	return firstOrEmpty(fields[3]), nil
+}
+
+// Applies a single mutation of the key (a registryMutation* type) with the registry's
+// atomic_mutate and returns the new registry version. The value is ignored for deletions.
+// NOTE: the registry only accepts mutations from the governance canister, except in test
+// builds (e.g. on private networks used for system testing).
+func mutateRegistry(config agent.Config, registryId principal.Principal, mutationType uint64, key string, value []byte) (uint64, error) {
+	// RegistryMutation { int32 mutation_type = 1; bytes key = 2; bytes value = 3; }
+	mutation := protowire.AppendTag(nil, 1, protowire.VarintType)
+	mutation = protowire.AppendVarint(mutation, mutationType)
+	mutation = protowire.AppendTag(mutation, 2, protowire.BytesType)
+	mutation = protowire.AppendBytes(mutation, []byte(key))
+	if mutationType != registryMutationDelete {
+		mutation = protowire.AppendTag(mutation, 3, protowire.BytesType)
+		mutation = protowire.AppendBytes(mutation, value)
+	}
+
+	// RegistryAtomicMutateRequest { repeated RegistryMutation mutations = 1; }
+	request := protowire.AppendTag(nil, 1, protowire.BytesType)
+	request = protowire.AppendBytes(request, mutation)
+
+	response, err := CallRaw(config, registryId, "atomic_mutate", request)
+	if err != nil {
+		return 0, err
+	}
+
+	// RegistryAtomicMutateResponse { repeated RegistryError errors = 1; uint64 version = 2; }
+	fields, err := readProtoFields(response)
+	if err != nil {
+		return 0, fmt.Errorf("could not decode registry response: %w", err)
+	}
+
+	for _, registryError := range fields[1] {
+		errorFields, err := readProtoFields(registryError)
+		if err != nil {
+			return 0, fmt.Errorf("could not decode registry error: %w", err)
+		}
+
+		code, _ := protowire.ConsumeVarint(firstOrEmpty(errorFields[1]))
+		return 0, fmt.Errorf("registry error (%d): %s", code, string(firstOrEmpty(errorFields[2])))
+	}
+
+	version, _ := protowire.ConsumeVarint(firstOrEmpty(fields[2]))
+	return version, nil
+}
+
+// Returns the subnets on which the threshold key (e.g. "ecdsa:Secp256k1:key_1") is
+// enabled.
+func chainKeyEnabledSubnets(config agent.Config, keyId string) ([]principal.Principal, error) {
+	value, err := fetchRegistryValue(config, "chain_key_enabled_subnet_list_"+keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	// ChainKeyEnabledSubnetList { repeated SubnetId subnets = 1; }
+	fields, err := readProtoFields(value)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode subnet list: %w", err)
+	}
+
+	subnets := []principal.Principal{}
+	for _, subnetId := range fields[1] {
+		// SubnetId { PrincipalId principal_id = 1; } & PrincipalId { bytes raw = 1; }
+		subnetIdFields, err := readProtoFields(subnetId)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode subnet id: %w", err)
+		}
+
+		principalIdFields, err := readProtoFields(firstOrEmpty(subnetIdFields[1]))
+		if err != nil {
+			return nil, fmt.Errorf("could not decode subnet id: %w", err)
+		}
+
+		subnets = append(subnets, principal.Principal{Raw: firstOrEmpty(principalIdFields[1])})
+	}
+
+	return subnets, nil
+}
+
+// registryCache keeps the registry values read by a provider instance, which would
+// otherwise be read again for every canister (e.g. the subnets of the threshold keys, see
+// CanisterResource.checkThresholdKeys). Lookups that fail are not cached. A nil cache
+// doesn't cache anything.
+type registryCache struct {
+	sync.Mutex
+	chainKeySubnets map[string][]principal.Principal
+	canisterSubnets map[string]principal.Principal
+}
+
+func newRegistryCache() *registryCache {
+	return &registryCache{
+		chainKeySubnets: map[string][]principal.Principal{},
+		canisterSubnets: map[string]principal.Principal{},
+	}
+}
+
+// Same as chainKeyEnabledSubnets, read once per cache.
+func (c *registryCache) chainKeyEnabledSubnets(config agent.Config, keyId string) ([]principal.Principal, error) {
+	if c == nil {
+		return chainKeyEnabledSubnets(config, keyId)
+	}
+
+	c.Lock()
+	subnets, ok := c.chainKeySubnets[keyId]
+	c.Unlock()
+	if ok {
+		return subnets, nil
+	}
+
+	subnets, err := chainKeyEnabledSubnets(config, keyId)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	c.chainKeySubnets[keyId] = subnets
+	c.Unlock()
+	return subnets, nil
+}
+
+// Same as subnetForCanister, read once per cache.
+func (c *registryCache) subnetForCanister(config agent.Config, canisterId principal.Principal) (principal.Principal, error) {
+	if c == nil {
+		return subnetForCanister(config, canisterId)
+	}
+
+	c.Lock()
+	subnetId, ok := c.canisterSubnets[canisterId.Encode()]
+	c.Unlock()
+	if ok {
+		return subnetId, nil
+	}
+
+	subnetId, err := subnetForCanister(config, canisterId)
+	if err != nil {
+		return principal.Principal{}, err
+	}
+
+	c.Lock()
+	c.canisterSubnets[canisterId.Encode()] = subnetId
+	c.Unlock()
+	return subnetId, nil
+}
+
+// Reads the fields of a protobuf message, by field number. Varint fields are returned
+// varint-encoded.
+func readProtoFields(message []byte) (map[protowire.Number][][]byte, error) {
+	fields := map[protowire.Number][][]byte{}
+	for len(message) > 0 {
+		num, typ, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		message = message[n:]
+
+		var value []byte
+		switch typ {
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(message)
+		case protowire.VarintType:
+			_, n = protowire.ConsumeVarint(message)
+			if n >= 0 {
+				value = message[:n]
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, message)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		message = message[n:]
+
+		fields[num] = append(fields[num], value)
+	}
+
+	return fields, nil
+}
+
+func firstOrEmpty(values [][]byte) []byte {
+	if len(values) == 0 {
+		return []byte{}
+	}
+	return values[0]
+}
@@ -0,0 +1,277 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/ic"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &RegistryRecordResource{}
+var _ resource.ResourceWithImportState = &RegistryRecordResource{}
+
+func NewRegistryRecordResource() resource.Resource {
+	return &RegistryRecordResource{}
+}
+
+// RegistryRecordResource manages a record of the registry canister of a (private) IC
+// instance.
+type RegistryRecordResource struct {
+	config *agent.Config
+
+	readOnly readOnlyMode // read_only is set, or mainnet is not allowed
+
+	refreshMode string
+}
+
+// RegistryRecordResourceModel describes the resource data model.
+type RegistryRecordResourceModel struct {
+	Id                 types.String `tfsdk:"id"`
+	RegistryCanisterId types.String `tfsdk:"registry_canister_id"`
+	Key                types.String `tfsdk:"key"`
+	ValueHex           types.String `tfsdk:"value_hex"`
+	Version            types.Int64  `tfsdk:"version"`
+}
+
+func (r *RegistryRecordResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_registry_record"
+}
+
+func (r *RegistryRecordResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Escape hatch managing a record of the registry canister, for teams running their own IC instances (system testing, private networks), e.g. to add nodes or change subnet records. " +
+			"Records are written with the registry's `atomic_mutate` (inserted on creation, updated on changes and deleted on destruction), which only accepts mutations from the governance canister except in test builds of the registry: this resource cannot be used on mainnet. " +
+			"Values are protobuf-encoded registry records, which the provider does not interpret.",
+
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Identifier of the record (its key)",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"registry_canister_id": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Registry canister. Defaults to `" + ic.REGISTRY_PRINCIPAL.Encode() + "`.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"key": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Key of the record, e.g. `subnet_record_<subnet id>`",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"value_hex": schema.StringAttribute{
+				Required:            true,
+				MarkdownDescription: "Hex representation of the protobuf-encoded value of the record",
+			},
+			"version": schema.Int64Attribute{
+				Computed:            true,
+				MarkdownDescription: "Registry version at which the record was last written by the provider (null for imported records)",
+			},
+		},
+	}
+}
+
+func (r *RegistryRecordResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	r.config = providerData.Config
+	r.readOnly = providerData.ReadOnly
+	r.refreshMode = providerData.RefreshMode
+}
+
+// Returns the registry canister to use.
+func (data *RegistryRecordResourceModel) RegistryId() (principal.Principal, error) {
+	if data.RegistryCanisterId.IsNull() {
+		return ic.REGISTRY_PRINCIPAL, nil
+	}
+
+	return principal.Decode(data.RegistryCanisterId.ValueString())
+}
+
+// Writes the record with the given mutation type and sets the resulting version.
+func (r *RegistryRecordResource) write(ctx context.Context, data *RegistryRecordResourceModel, mutationType uint64) error {
+	registryId, err := data.RegistryId()
+	if err != nil {
+		return fmt.Errorf("Could not decode registry canister id: %w", err)
+	}
+
+	value, err := hex.DecodeString(data.ValueHex.ValueString())
+	if err != nil {
+		return fmt.Errorf("Could not decode value_hex: %w", err)
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("Writing registry record %s on %s", data.Key.ValueString(), registryId.Encode()))
+
+	version, err := mutateRegistry(*r.config, registryId, mutationType, data.Key.ValueString(), value)
+	if err != nil {
+		return fmt.Errorf("Could not write registry record %s: %w", data.Key.ValueString(), err)
+	}
+
+	data.Id = data.Key
+	data.Version = types.Int64Value(int64(version))
+
+	return nil
+}
+
+func (r *RegistryRecordResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data RegistryRecordResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.readOnly != readWrite {
+		resp.Diagnostics.Append(r.readOnly.diagnostic("insert registry record " + data.Key.ValueString()))
+		return
+	}
+
+	// Inserting fails if the record exists, in which case it should be imported
+	err := r.write(ctx, &data, registryMutationInsert)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("", err))
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *RegistryRecordResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data RegistryRecordResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.refreshMode == refreshModeOff {
+		resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+		return
+	}
+
+	registryId, err := data.RegistryId()
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode registry canister id", err))
+		return
+	}
+
+	value, err := fetchRegistryValueFrom(*r.config, registryId, data.Key.ValueString())
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not read registry record", err))
+		return
+	}
+
+	if value == nil {
+		tflog.Info(ctx, "Registry record "+data.Key.ValueString()+" does not exist anymore")
+		resp.State.RemoveResource(ctx)
+		return
+	}
+
+	data.Id = data.Key
+	data.ValueHex = types.StringValue(hex.EncodeToString(value))
+
+	// Save updated data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *RegistryRecordResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data RegistryRecordResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.readOnly != readWrite {
+		resp.Diagnostics.Append(r.readOnly.diagnostic("update registry record " + data.Key.ValueString()))
+		return
+	}
+
+	err := r.write(ctx, &data, registryMutationUpdate)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("", err))
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *RegistryRecordResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	var data RegistryRecordResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.readOnly != readWrite {
+		resp.Diagnostics.Append(r.readOnly.diagnostic("delete registry record " + data.Key.ValueString()))
+		return
+	}
+
+	registryId, err := data.RegistryId()
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode registry canister id", err))
+		return
+	}
+
+	tflog.Info(ctx, fmt.Sprintf("Deleting registry record %s on %s", data.Key.ValueString(), registryId.Encode()))
+
+	_, err = mutateRegistry(*r.config, registryId, registryMutationDelete, data.Key.ValueString(), nil)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic(fmt.Sprintf("Could not delete registry record %s", data.Key.ValueString()), err))
+		return
+	}
+}
+
+// Records of the default registry canister can be imported by their key.
+func (r *RegistryRecordResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("key"), req.ID)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("id"), req.ID)...)
+}
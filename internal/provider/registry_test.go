@@ -0,0 +1,232 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/ic"
+	"github.com/aviate-labs/agent-go/identity"
+	"github.com/aviate-labs/agent-go/principal"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// get_value responses of the registry (RegistryGetValueResponse), hex-encoded.
+const (
+	// version 51000, the value being a ChainKeyEnabledSubnetList of pzp6e-...-yae
+	registryResponseOneSubnet = "10b88e031a230a210a1f0a1d4f82b62edffa3fa4e6a5c48327ce8cfb3f850db2e5abc90e955d77f002"
+	// version 51000, the value being a ChainKeyEnabledSubnetList of pzp6e-...-yae and uzr34-...-oqe
+	registryResponseTwoSubnets = "10b88e031a460a210a1f0a1d4f82b62edffa3fa4e6a5c48327ce8cfb3f850db2e5abc90e955d77f0020a210a1f0a1d43dcaf1180db82fda708ce3ac7a03a6060abde13e9546c60e8cce65d02"
+	// version 51000, the value being an empty ChainKeyEnabledSubnetList
+	registryResponseNoSubnet = "10b88e031a00"
+	// error KEY_NOT_PRESENT (1)
+	registryResponseKeyNotPresent = "0a3608011232636861696e5f6b65795f656e61626c65645f7375626e65745f6c6973745f65636473613a536563703235366b313a6e6f7065"
+	// error MALFORMED_MESSAGE (2)
+	registryResponseMalformed = "0a110802120d6d616c666f726d6564206b6579"
+)
+
+const (
+	testSubnetFiduciary = "pzp6e-ekpqk-3c5x7-2h6so-njoeq-mt45d-h3h6c-q3mxf-vpeq5-fk5o7-yae"
+	testSubnetII        = "uzr34-akd3s-xrdag-3ql62-ocgoh-ld2ao-tamcv-54e7j-krwgb-2gm4z-oqe"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Returns the configuration of an agent whose requests to the registry are answered with
+// the recorded get_value responses, by key (see agentFixture).
+func testRegistryConfig(t *testing.T, responses map[string][]string) agent.Config {
+	var fixture agentFixture
+	for key, keyResponses := range responses {
+		request := protowire.AppendTag(nil, 2, protowire.BytesType)
+		request = protowire.AppendBytes(request, []byte(key))
+		for _, response := range keyResponses {
+			fixture.Interactions = append(fixture.Interactions, agentInteraction{
+				Type:       string(agent.RequestTypeQuery),
+				CanisterId: ic.REGISTRY_PRINCIPAL.Encode(),
+				Method:     "get_value",
+				Arg:        request,
+				Reply:      mustDecodeHex(t, response),
+			})
+		}
+	}
+	fixture.replayed = make([]bool, len(fixture.Interactions))
+
+	backend, err := newMockBackend("", mockState{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.replay = &fixture
+
+	host, _ := url.Parse("mock://" + strings.ToLower(strings.ReplaceAll(t.Name(), "/", "-")))
+	setEndpointTransport(host, newEndpointTransport(host, transportSettings{}, func(http.RoundTripper) http.RoundTripper {
+		return &mockTransport{backend: backend}
+	}))
+
+	return agent.Config{
+		ClientConfig: &agent.ClientConfig{Host: host},
+		Identity:     new(identity.AnonymousIdentity),
+		FetchRootKey: true,
+	}
+}
+
+func TestReadProtoFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		fields  map[protowire.Number][]string // nil if invalid
+	}{
+		{
+			name:    "get_value response",
+			message: registryResponseOneSubnet,
+			fields: map[protowire.Number][]string{
+				2: {"b88e03"},
+				3: {"0a210a1f0a1d4f82b62edffa3fa4e6a5c48327ce8cfb3f850db2e5abc90e955d77f002"},
+			},
+		},
+		{
+			name:    "repeated field",
+			message: "0a01010a0102",
+			fields:  map[protowire.Number][]string{1: {"01", "02"}},
+		},
+		{
+			name:    "empty bytes",
+			message: registryResponseNoSubnet,
+			fields:  map[protowire.Number][]string{2: {"b88e03"}, 3: {""}},
+		},
+		{
+			name:    "fixed64 field skipped",
+			message: "0901020304050607081001",
+			fields:  map[protowire.Number][]string{1: {""}, 2: {"01"}},
+		},
+		{
+			name:   "empty",
+			fields: map[protowire.Number][]string{},
+		},
+		{name: "truncated bytes", message: registryResponseOneSubnet[:len(registryResponseOneSubnet)-2]},
+		{name: "truncated varint", message: "10b8"},
+		{name: "invalid field number", message: "00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fields, err := readProtoFields(mustDecodeHex(t, test.message))
+			if test.fields == nil {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", fields)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fields) != len(test.fields) {
+				t.Fatalf("expected fields %v, got %v", test.fields, fields)
+			}
+			for num, values := range test.fields {
+				if len(fields[num]) != len(values) {
+					t.Fatalf("expected %d values of field %d, got %d", len(values), num, len(fields[num]))
+				}
+				for i, value := range values {
+					if hex.EncodeToString(fields[num][i]) != value {
+						t.Errorf("expected %s as value %d of field %d, got %x", value, i, num, fields[num][i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestChainKeyEnabledSubnets(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		subnets  []string
+		err      string
+	}{
+		{name: "one subnet", response: registryResponseOneSubnet, subnets: []string{testSubnetFiduciary}},
+		{name: "two subnets", response: registryResponseTwoSubnets, subnets: []string{testSubnetFiduciary, testSubnetII}},
+		{name: "no subnet", response: registryResponseNoSubnet, subnets: []string{}},
+		{name: "key not present", response: registryResponseKeyNotPresent, subnets: []string{}},
+		{name: "registry error", response: registryResponseMalformed, err: "registry error (2): malformed key"},
+		{name: "invalid value", response: "1a03" + "0a05", err: "could not decode"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyId := "ecdsa:Secp256k1:key_1"
+			config := testRegistryConfig(t, map[string][]string{"chain_key_enabled_subnet_list_" + keyId: {test.response}})
+
+			subnets, err := chainKeyEnabledSubnets(config, keyId)
+			if len(test.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(subnets) != len(test.subnets) {
+				t.Fatalf("expected subnets %v, got %v", test.subnets, subnets)
+			}
+			for i, subnet := range subnets {
+				if subnet.Encode() != test.subnets[i] {
+					t.Errorf("expected subnet %s, got %s", test.subnets[i], subnet)
+				}
+			}
+		})
+	}
+}
+
+// Checks that the registry is read once per cache, unless the lookup fails.
+func TestRegistryCache(t *testing.T) {
+	keyId := "ecdsa:Secp256k1:key_1"
+	failingKeyId := "ecdsa:Secp256k1:test_key_1"
+	config := testRegistryConfig(t, map[string][]string{
+		// The responses are replayed in order, so reading the registry again would return
+		// the second one
+		"chain_key_enabled_subnet_list_" + keyId:        {registryResponseOneSubnet, registryResponseTwoSubnets},
+		"chain_key_enabled_subnet_list_" + failingKeyId: {registryResponseMalformed, registryResponseOneSubnet},
+	})
+
+	cache := newRegistryCache()
+	for i := 0; i < 2; i++ {
+		subnets, err := cache.chainKeyEnabledSubnets(config, keyId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(subnets) != 1 || subnets[0].Encode() != testSubnetFiduciary {
+			t.Fatalf("expected the subnets read first, got %v", subnets)
+		}
+	}
+
+	if _, err := cache.chainKeyEnabledSubnets(config, failingKeyId); err == nil {
+		t.Fatal("expected the registry error")
+	}
+	subnets, err := cache.chainKeyEnabledSubnets(config, failingKeyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subnets) != 1 {
+		t.Fatalf("expected the lookup to be retried, got %v", subnets)
+	}
+
+	// Without a cache, the registry is read every time
+	var noCache *registryCache
+	subnets, err = noCache.chainKeyEnabledSubnets(config, keyId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subnets) != 2 || !subnets[1].Equal(principal.MustDecode(testSubnetII)) {
+		t.Fatalf("expected the subnets read last, got %v", subnets)
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/certification/hashtree"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+)
+
+// Names of the reject codes, see
+// https://internetcomputer.org/docs/current/references/ic-interface-spec#reject-codes
+var rejectCodeNames = map[uint64]string{
+	1: "SYS_FATAL",
+	2: "SYS_TRANSIENT",
+	3: "DESTINATION_INVALID",
+	4: "CANISTER_REJECT",
+	5: "CANISTER_ERROR",
+	6: "SYS_UNKNOWN",
+}
+
+// Rejects as formatted by agent-go, "(<reject code>) <message>", possibly wrapped.
+var rejectRegex = regexp.MustCompile(`\(([1-6])\) (.+)`)
+
+// Error codes of the IC (e.g. IC0537, no Wasm module), found in reject messages.
+var errorCodeRegex = regexp.MustCompile(`\bIC\d{4}\b`)
+
+// rejectError is a request rejected by the IC or by a canister.
+type rejectError struct {
+	RejectCode uint64
+	Message    string
+	ErrorCode  string // e.g. IC0537, if known
+
+	RequestId           string // hex-encoded, if known
+	CanisterId          string // if known
+	EffectiveCanisterId string // if known and not the canister id (e.g. for the management canister)
+	Method              string // if known
+}
+
+// Formatted like the rejects of agent-go, so that messages are unchanged.
+func (e *rejectError) Error() string {
+	if len(e.ErrorCode) > 0 && !strings.Contains(e.Message, e.ErrorCode) {
+		return fmt.Sprintf("(%d) %s: %s", e.RejectCode, e.Message, e.ErrorCode)
+	}
+	return fmt.Sprintf("(%d) %s", e.RejectCode, e.Message)
+}
+
+// Rejects seen by rejectTransport, by request id.
+var rejectedRequests sync.Map
+
+// The targets of calls seen by rejectTransport whose status is not known yet, by request id.
+var pendingCalls sync.Map
+
+// A reject seen by rejectTransport.
+type rejectedRequest struct {
+	reject *rejectError
+	at     time.Time
+}
+
+// rejectTransport records the requests rejected by the IC, so that the errors reported by
+// agent-go (which only carry the reject code and message) can be reported with the id of
+// the request and the canister it targeted.
+//
+// NOTE: agent-go (v0.4.4) doesn't expose request ids, so rejects are recorded in the
+// transport of the endpoint (see endpointTransport).
+type rejectTransport struct {
+	base http.RoundTripper
+}
+
+func (t *rejectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || !strings.HasPrefix(req.URL.Path, "/api/v2/canister/") || req.GetBody == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	envelope, ok := readRequestEnvelope(req)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	content := envelope.Content
+	target := &rejectError{
+		CanisterId: principal.Principal{Raw: content.CanisterId}.Encode(),
+		Method:     content.MethodName,
+	}
+	// /api/v2/canister/<effective canister id>/<call, query or read_state>
+	if segments := strings.Split(req.URL.Path, "/"); len(segments) == 6 && segments[4] != target.CanisterId {
+		target.EffectiveCanisterId = segments[4]
+	}
+
+	statusIds := envelope.requestStatusIds()
+	if content.RequestType == agent.RequestTypeReadState && len(statusIds) == 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	if content.RequestType == agent.RequestTypeCall || content.RequestType == agent.RequestTypeQuery {
+		target.RequestId = envelope.requestId()
+	}
+	if content.RequestType == agent.RequestTypeCall {
+		pendingCalls.Store(target.RequestId, target)
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		return res, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+
+	switch content.RequestType {
+	case agent.RequestTypeCall, agent.RequestTypeQuery:
+		// Calls are accepted with 202, or rejected synchronously with 200
+		var response struct {
+			RejectCode    uint64 `cbor:"reject_code"`
+			RejectMessage string `cbor:"reject_message"`
+			ErrorCode     string `cbor:"error_code"`
+		}
+		if cbor.Unmarshal(body, &response) == nil && response.RejectCode != 0 {
+			pendingCalls.Delete(target.RequestId)
+			target.RejectCode, target.Message, target.ErrorCode = response.RejectCode, response.RejectMessage, response.ErrorCode
+			recordReject(target)
+		}
+	case agent.RequestTypeReadState:
+		for _, requestId := range statusIds {
+			recordRequestStatus(requestId, body)
+		}
+	}
+
+	return res, nil
+}
+
+// Records the reject of the call, if the response to the read_state request reports that
+// it was rejected.
+func recordRequestStatus(requestId string, body []byte) {
+	tree, ok := readStateTree(body)
+	if !ok {
+		return
+	}
+
+	id, _ := hex.DecodeString(requestId)
+	lookup := func(label string) []byte {
+		value, _ := tree.Lookup(hashtree.Label("request_status"), id, hashtree.Label(label))
+		return value
+	}
+
+	switch string(lookup("status")) {
+	case "rejected":
+		reject := &rejectError{RequestId: requestId}
+		if pending, ok := pendingCalls.LoadAndDelete(requestId); ok {
+			reject = pending.(*rejectError)
+		}
+		reject.RejectCode = new(big.Int).SetBytes(lookup("reject_code")).Uint64()
+		reject.Message = string(lookup("reject_message"))
+		reject.ErrorCode = string(lookup("error_code"))
+		recordReject(reject)
+	case "replied", "done":
+		pendingCalls.Delete(requestId)
+	}
+}
+
+// Returns the reject of the request to the canister (through the effective canister).
+func newRejectError(code uint64, message string, requestId agent.RequestID, effectiveCanisterId principal.Principal, canisterId principal.Principal, method string) *rejectError {
+	reject := &rejectError{
+		RejectCode: code,
+		Message:    message,
+		ErrorCode:  errorCodeRegex.FindString(message),
+		RequestId:  hex.EncodeToString(requestId[:]),
+		CanisterId: canisterId.Encode(),
+		Method:     method,
+	}
+	if !effectiveCanisterId.Equal(canisterId) {
+		reject.EffectiveCanisterId = effectiveCanisterId.Encode()
+	}
+	return reject
+}
+
+func recordReject(reject *rejectError) {
+	if len(reject.ErrorCode) == 0 {
+		reject.ErrorCode = errorCodeRegex.FindString(reject.Message)
+	}
+	rejectedRequests.Store(reject.RequestId, rejectedRequest{reject: reject, at: time.Now()})
+}
+
+// Returns the reject the error reports, if any: either a rejectError, or a reject formatted
+// by agent-go, in which case the details recorded by rejectTransport are added.
+func findReject(err error) *rejectError {
+	var reject *rejectError
+	if errors.As(err, &reject) {
+		// e.g. the error codes of queries, which agent.Response does not decode
+		if recorded, ok := rejectedRequests.Load(reject.RequestId); ok && len(reject.ErrorCode) == 0 {
+			reject.ErrorCode = recorded.(rejectedRequest).reject.ErrorCode
+		}
+		return reject
+	}
+
+	m := rejectRegex.FindStringSubmatch(err.Error())
+	if m == nil {
+		return nil
+	}
+
+	// The latest recorded reject with that message
+	var latest rejectedRequest
+	rejectedRequests.Range(func(_, value any) bool {
+		rejected := value.(rejectedRequest)
+		if len(rejected.reject.Message) > 0 && strings.Contains(m[2], rejected.reject.Message) && rejected.at.After(latest.at) {
+			latest = rejected
+		}
+		return true
+	})
+	if latest.reject != nil {
+		return latest.reject
+	}
+
+	code, _ := strconv.ParseUint(m[1], 10, 64)
+	return &rejectError{
+		RejectCode: code,
+		Message:    m[2],
+		ErrorCode:  errorCodeRegex.FindString(m[2]),
+	}
+}
+
+// rejectDiagnostic is the error diagnostic of an operation that failed because a request was
+// rejected, with the details of the reject.
+type rejectDiagnostic struct {
+	detail string
+	Reject rejectError
+}
+
+var _ diag.Diagnostic = rejectDiagnostic{}
+
+// Returns the error diagnostic of the operation that failed with err, e.g.
+// clientErrorDiagnostic("Could not create canister", err), or with an empty detail if err
+// describes the operation. Rejects are reported with their reject code, error code, request
+// id and canister, other errors as client errors.
+func clientErrorDiagnostic(detail string, err error) diag.Diagnostic {
+	if len(detail) > 0 {
+		detail += ": " + err.Error()
+	} else {
+		detail = err.Error()
+	}
+
+	if reject := findReject(err); reject != nil {
+		return rejectDiagnostic{detail: detail, Reject: *reject}
+	}
+
+	return diag.NewErrorDiagnostic("Client Error", detail)
+}
+
+func (d rejectDiagnostic) Severity() diag.Severity {
+	return diag.SeverityError
+}
+
+func (d rejectDiagnostic) Summary() string {
+	summary := "Request Rejected"
+	if name, ok := rejectCodeNames[d.Reject.RejectCode]; ok {
+		summary += " (" + name
+		if len(d.Reject.ErrorCode) > 0 {
+			summary += ", " + d.Reject.ErrorCode
+		}
+		summary += ")"
+	}
+	return summary
+}
+
+func (d rejectDiagnostic) Detail() string {
+	reject := d.Reject
+	lines := []string{d.detail, ""}
+
+	code := strconv.FormatUint(reject.RejectCode, 10)
+	if name, ok := rejectCodeNames[reject.RejectCode]; ok {
+		code += " (" + name + ")"
+	}
+	lines = append(lines, "Reject code: "+code)
+
+	if len(reject.ErrorCode) > 0 {
+		lines = append(lines, "Error code: "+reject.ErrorCode)
+	}
+	if len(reject.RequestId) > 0 {
+		lines = append(lines, "Request ID: 0x"+reject.RequestId)
+	}
+	if len(reject.CanisterId) > 0 {
+		canister := reject.CanisterId
+		if len(reject.EffectiveCanisterId) > 0 {
+			canister += " (effective canister ID " + reject.EffectiveCanisterId + ")"
+		}
+		lines = append(lines, "Canister ID: "+canister)
+	}
+	if len(reject.Method) > 0 {
+		lines = append(lines, "Method: "+reject.Method)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (d rejectDiagnostic) Equal(other diag.Diagnostic) bool {
+	o, ok := other.(rejectDiagnostic)
+	return ok && o == d
+}
+
+// Returns the tree of the certificate of the response to a read_state request, without
+// verifying it (which is done by the agent).
+func readStateTree(body []byte) (hashtree.HashTree, bool) {
+	var response struct {
+		Certificate []byte `cbor:"certificate"`
+	}
+	if cbor.Unmarshal(body, &response) != nil {
+		return hashtree.HashTree{}, false
+	}
+
+	var certificate map[string]any
+	if cbor.Unmarshal(response.Certificate, &certificate) != nil {
+		return hashtree.HashTree{}, false
+	}
+	tree, ok := certificate["tree"].([]any)
+	if !ok {
+		return hashtree.HashTree{}, false
+	}
+	node, err := hashtree.DeserializeNode(tree)
+	if err != nil {
+		return hashtree.HashTree{}, false
+	}
+	return hashtree.NewHashTree(node), true
+}
@@ -0,0 +1,126 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// Default retry policy (see max_retries, retry_base_delay and retry_max_delay)
+const (
+	defaultMaxRetries     = 3
+	defaultRetryBaseDelay = 500 * time.Millisecond
+	defaultRetryMaxDelay  = 10 * time.Second
+)
+
+// RetryPolicy describes how failed HTTP requests to the IC are retried.
+type RetryPolicy struct {
+	MaxRetries int64
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: defaultMaxRetries,
+		BaseDelay:  defaultRetryBaseDelay,
+		MaxDelay:   defaultRetryMaxDelay,
+	}
+}
+
+// Returns the delay before the given retry (starting at 0): the base delay, doubled on
+// every retry and capped at the max delay.
+func (p RetryPolicy) Delay(retry int64) time.Duration {
+	delay := p.BaseDelay
+	for i := int64(0); i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// retryTransport retries requests that failed with 429, a 5xx status or a transient
+// transport error, with exponential backoff. It wraps all the agent calls (queries, calls,
+// read_state) to the provider's endpoint (see endpointTransport). Submitting a call again
+// is safe: the request is signed once, and the IC ignores requests with an id it has
+// already seen.
+//
+// NOTE: agent-go (v0.4.4) doesn't pass contexts to its requests, so the retries are logged
+// with the context the provider was configured with.
+type retryTransport struct {
+	base   http.RoundTripper
+	policy RetryPolicy
+	ctx    context.Context
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for retry := int64(0); ; retry++ {
+		res, err := t.base.RoundTrip(req)
+
+		if retry >= t.policy.MaxRetries || !isRetryable(res, err) {
+			return res, err
+		}
+
+		// The body can only be sent again if it can be rewound
+		if req.Body != nil && req.GetBody == nil {
+			return res, err
+		}
+
+		delay := t.policy.Delay(retry)
+		if res != nil {
+			tflog.Info(t.ctx, fmt.Sprintf("%s %s failed with status %d, retrying in %s", req.Method, req.URL, res.StatusCode, delay))
+			delay = max(delay, retryAfter(res, t.policy.MaxDelay))
+			_, _ = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		} else {
+			tflog.Info(t.ctx, fmt.Sprintf("%s %s failed (%s), retrying in %s", req.Method, req.URL, err.Error(), delay))
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// Returns true if the request may succeed when sent again.
+func isRetryable(res *http.Response, err error) bool {
+	if err != nil {
+		// Timeouts and connections closed or refused by the boundary nodes
+		var netErr net.Error
+		return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	}
+
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+// Returns the delay requested by the response's Retry-After header (in seconds), capped
+// at maxDelay, or 0 if there is none.
+func retryAfter(res *http.Response, maxDelay time.Duration) time.Duration {
+	seconds, err := strconv.ParseInt(res.Header.Get("Retry-After"), 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	return min(time.Duration(seconds)*time.Second, maxDelay)
+}
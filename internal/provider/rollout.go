@@ -0,0 +1,139 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Rollout paces the code upgrades of canisters, e.g. when a single Wasm change fans out to
+// the many canisters of a count or for_each, so that a faulty module doesn't reach the
+// whole fleet at once:
+//   - at most maxParallel upgrades run at the same time;
+//   - the upgrades are grouped in waves of batchSize canisters: the next wave only starts
+//     once all the upgrades of the current one completed, after batchPause, and once all
+//     the canisters of the current wave answer the healthCheck query.
+//
+// The first failed upgrade (or health check) halts the rollout: the upgrades that haven't
+// started yet fail instead of being attempted.
+type Rollout struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	config agent.Config // used for the health checks
+
+	maxParallel int           // 0 means no limit
+	batchSize   int           // 0 means a single wave
+	batchPause  time.Duration // between waves
+	healthCheck string        // query method, "" to skip the health checks
+
+	wave      []principal.Principal // canisters of the current wave
+	running   int
+	completed int  // upgrades of the current wave that completed
+	advancing bool // whether the next wave is being prepared (pause and health checks)
+	halted    error
+}
+
+func NewRollout(config agent.Config, maxParallel int, batchSize int, batchPause time.Duration, healthCheck string) *Rollout {
+	r := &Rollout{
+		config:      config,
+		maxParallel: maxParallel,
+		batchSize:   batchSize,
+		batchPause:  batchPause,
+		healthCheck: healthCheck,
+	}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// Runs the upgrade of the canister once the rollout lets it start, waiting for a slot in
+// the current wave (or for the next wave) as needed.
+func (r *Rollout) Upgrade(ctx context.Context, canisterId principal.Principal, upgrade func() error) error {
+	r.mu.Lock()
+	for {
+		if r.halted != nil {
+			r.mu.Unlock()
+			return fmt.Errorf("the rollout was halted, %s was not upgraded: %w", canisterId.Encode(), r.halted)
+		}
+
+		if r.batchSize > 0 && len(r.wave) >= r.batchSize {
+			if r.completed < len(r.wave) || r.advancing {
+				r.cond.Wait()
+				continue
+			}
+
+			// The current wave is complete, this upgrade starts the next one
+			r.advancing = true
+			wave := r.wave
+			r.mu.Unlock()
+			err := r.advance(ctx, wave)
+			r.mu.Lock()
+			r.advancing = false
+			if err != nil {
+				r.halted = err
+			} else {
+				r.wave = nil
+				r.completed = 0
+			}
+			r.cond.Broadcast()
+			continue
+		}
+
+		if r.maxParallel > 0 && r.running >= r.maxParallel {
+			r.cond.Wait()
+			continue
+		}
+
+		break
+	}
+	r.wave = append(r.wave, canisterId)
+	r.running++
+	tflog.Info(ctx, fmt.Sprintf("Upgrading %s (%d upgrade(s) running)", canisterId.Encode(), r.running))
+	r.mu.Unlock()
+
+	err := upgrade()
+
+	r.mu.Lock()
+	r.running--
+	r.completed++
+	if err != nil && r.halted == nil {
+		r.halted = fmt.Errorf("the upgrade of %s failed", canisterId.Encode())
+	}
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	return err
+}
+
+// Waits for the pause between waves, and checks the health of the canisters of the
+// completed wave.
+func (r *Rollout) advance(ctx context.Context, wave []principal.Principal) error {
+	if r.batchPause > 0 {
+		tflog.Info(ctx, fmt.Sprintf("Pausing the rollout for %s after a wave of %d upgrade(s)", r.batchPause, len(wave)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.batchPause):
+		}
+	}
+
+	if r.healthCheck == "" {
+		return nil
+	}
+	for _, canisterId := range wave {
+		tflog.Info(ctx, fmt.Sprintf("Checking the health of %s with %s", canisterId.Encode(), r.healthCheck))
+		_, err := QueryRaw(r.config, canisterId, r.healthCheck, nil)
+		if err != nil {
+			return fmt.Errorf("the health check (%s) of %s failed: %w", r.healthCheck, canisterId.Encode(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/certification"
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Length of a raw BLS public key; DER-encoded root keys end with the raw key.
+const blsPublicKeyLength = 96
+
+// The root key of mainnet (DER-encoded), used by agents that don't fetch the root key.
+var mainnetRootKey, _ = hex.DecodeString(certification.RootKey)
+
+// Decodes a hex or base64-encoded root key, either DER-encoded (as returned by the status
+// endpoint) or raw. Surrounding whitespace is ignored, e.g. for keys read with file().
+func decodeRootKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+
+	rootKey, err := hex.DecodeString(encoded)
+	if err != nil {
+		var errBase64 error
+		rootKey, errBase64 = base64.StdEncoding.DecodeString(encoded)
+		if errBase64 != nil {
+			rootKey, errBase64 = base64.RawStdEncoding.DecodeString(encoded)
+		}
+		if errBase64 != nil {
+			return nil, fmt.Errorf("neither a hex-encoded (%w) nor a base64-encoded (%w) key", err, errBase64)
+		}
+	}
+
+	if len(rootKey) < blsPublicKeyLength {
+		return nil, fmt.Errorf("expected a DER-encoded or raw BLS public key (at least %d bytes), got %d bytes", blsPublicKeyLength, len(rootKey))
+	}
+
+	return rootKey, nil
+}
+
+// Returns true if both root keys (DER-encoded or raw) are the same BLS public key.
+func sameRootKey(a []byte, b []byte) bool {
+	if len(a) < blsPublicKeyLength || len(b) < blsPublicKeyLength {
+		return false
+	}
+	return bytes.Equal(a[len(a)-blsPublicKeyLength:], b[len(b)-blsPublicKeyLength:])
+}
+
+// Returns true for local replicas (and PocketIC instances), which are trusted.
+func isLoopbackHost(hostname string) bool {
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+// rootKeyTransport checks the root key returned by the status endpoint against the pinned
+// root key, so that agents fetching the root key fail instead of verifying certificates
+// against an unexpected key.
+//
+// NOTE: agent-go (v0.4.4) doesn't allow setting the root key of its agents (agents either
+// fetch it from the status endpoint or use the mainnet key), so the check is done in the
+// transport of the endpoint (see endpointTransport).
+type rootKeyTransport struct {
+	base    http.RoundTripper
+	rootKey []byte
+}
+
+func (t *rootKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil || req.URL.Path != "/api/v2/status" || res.StatusCode != http.StatusOK {
+		return res, err
+	}
+
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var status agent.Status
+	err = cbor.Unmarshal(body, &status)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the status of %s: %w", req.URL.Host, err)
+	}
+
+	if !sameRootKey(status.RootKey, t.rootKey) {
+		return nil, fmt.Errorf("the root key of %s (%x) is not the pinned root_key", req.URL.Host, status.RootKey)
+	}
+
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
@@ -0,0 +1,84 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Security headers required by default: the content security policy and HSTS.
+var defaultSecurityHeaders = []string{"content-security-policy", "strict-transport-security"}
+
+// How long to wait for the response of the gateway.
+const securityHeadersRequestTimeout = 30 * time.Second
+
+// Returns the URL at which the asset at assetPath of the canister is served: through the
+// icp0.io gateway on mainnet, and with the canisterId query parameter (as understood by the
+// gateways of dfx and PocketIC) otherwise.
+func assetUrl(config agent.Config, canisterId principal.Principal, assetPath string) string {
+	if !strings.HasPrefix(assetPath, "/") {
+		assetPath = "/" + assetPath
+	}
+
+	if config.ClientConfig == nil || config.ClientConfig.Host == nil || isMainnetHost(config.ClientConfig.Host.Hostname()) {
+		return "https://" + canisterId.Encode() + ".icp0.io" + assetPath
+	}
+
+	u := *config.ClientConfig.Host
+	u.Path = assetPath
+	u.RawQuery = url.Values{"canisterId": {canisterId.Encode()}}.Encode()
+	return u.String()
+}
+
+// Requests the URL, returning the status code and headers of the response.
+func fetchHeaders(ctx context.Context, assetUrl string) (int, http.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, securityHeadersRequestTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, assetUrl, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	res.Body.Close()
+
+	return res.StatusCode, res.Header, nil
+}
+
+// Returns a description of each header that is missing from the response (required) or
+// whose value differs from the expected one, sorted by header name.
+func securityHeaderViolations(header http.Header, required []string, expected map[string]string) []string {
+	var violations []string
+
+	for _, name := range required {
+		if _, ok := expected[name]; !ok && len(header.Values(name)) == 0 {
+			violations = append(violations, name+" (missing)")
+		}
+	}
+
+	for name, value := range expected {
+		values := header.Values(name)
+		switch {
+		case len(values) == 0:
+			violations = append(violations, name+" (missing)")
+		case strings.Join(values, ", ") != value:
+			violations = append(violations, fmt.Sprintf("%s (expected %q, got %q)", name, value, strings.Join(values, ", ")))
+		}
+	}
+
+	sort.Strings(violations)
+	return violations
+}
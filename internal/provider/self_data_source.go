@@ -0,0 +1,106 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+
+	"github.com/aviate-labs/agent-go"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &SelfDataSource{}
+
+func NewSelfDataSource() datasource.DataSource {
+	return &SelfDataSource{}
+}
+
+// SelfDataSource reads the principals the provider acts as, e.g. for modules that grant
+// them access to canisters. (Provider functions can't read the provider's configuration,
+// hence a data source.)
+type SelfDataSource struct {
+	config *agent.Config
+	proxy  *managementProxy
+	cmc    CmcSettings
+}
+
+// SelfDataSourceModel describes the data source data model.
+type SelfDataSourceModel struct {
+	Principal        types.String `tfsdk:"principal"`
+	Controller       types.String `tfsdk:"controller"`
+	FundingAccountId types.String `tfsdk:"funding_account_id"`
+}
+
+func (d *SelfDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_self"
+}
+
+func (d *SelfDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Reads the principal of the provider's identity, and the principal controlling the canisters it creates, without creating a canister. " +
+			"This allows modules to grant the provider access to canisters, e.g. as an allowed viewer of their logs or as the minting account of a ledger. No request is made to the IC.",
+
+		Attributes: map[string]schema.Attribute{
+			"principal": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Principal of the provider's identity, which signs the requests",
+			},
+			"controller": schema.StringAttribute{
+				Computed: true,
+				MarkdownDescription: "Principal the provider manages canisters as, which `ic_canister` sets as controller by default: the cycles wallet, proxy canister or Orbit station " +
+					"(`wallet_canister_id`, `proxy_canister_id` or `orbit_station_id`) if set, and `principal` otherwise",
+			},
+			"funding_account_id": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "ICP ledger account (hex-encoded account identifier) of `principal` funding the creation of canisters through the CMC, i.e. with the provider's `funding_subaccount`",
+			},
+		},
+	}
+}
+
+func (d *SelfDataSource) Configure(ctx context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.config = providerData.Config
+	d.proxy = providerData.ManagementProxy
+	d.cmc = providerData.Cmc
+}
+
+func (d *SelfDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data SelfDataSourceModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	sender := d.config.Identity.Sender()
+
+	data.Principal = types.StringValue(sender.Encode())
+	data.Controller = data.Principal
+	if d.proxy != nil {
+		data.Controller = types.StringValue(d.proxy.CanisterId.Encode())
+	}
+	data.FundingAccountId = types.StringValue(d.cmc.FundingAccount(sender).String())
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
@@ -0,0 +1,279 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic/sns"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &SnsDeploymentResource{}
+var _ resource.ResourceWithModifyPlan = &SnsDeploymentResource{}
+
+func NewSnsDeploymentResource() resource.Resource {
+	return &SnsDeploymentResource{}
+}
+
+// SnsDeploymentResource deploys a new SNS with the SNS-W canister's deploy_new_sns.
+type SnsDeploymentResource struct {
+	config *agent.Config
+
+	readOnly readOnlyMode // read_only is set, or mainnet is not allowed
+}
+
+// SnsDeploymentResourceModel describes the resource data model.
+type SnsDeploymentResourceModel struct {
+	Id                   types.String `tfsdk:"id"`
+	SnsWasmCanisterId    types.String `tfsdk:"sns_wasm_canister_id"`
+	ArgHex               types.String `tfsdk:"arg_hex"`
+	RootCanisterId       types.String `tfsdk:"root_canister_id"`
+	GovernanceCanisterId types.String `tfsdk:"governance_canister_id"`
+	LedgerCanisterId     types.String `tfsdk:"ledger_canister_id"`
+	SwapCanisterId       types.String `tfsdk:"swap_canister_id"`
+	IndexCanisterId      types.String `tfsdk:"index_canister_id"`
+	SubnetId             types.String `tfsdk:"subnet_id"`
+}
+
+func (r *SnsDeploymentResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_sns_deployment"
+}
+
+func (r *SnsDeploymentResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	computedId := func(description string) schema.StringAttribute {
+		return schema.StringAttribute{
+			Computed:            true,
+			MarkdownDescription: description,
+			PlanModifiers: []planmodifier.String{
+				stringplanmodifier.UseStateForUnknown(),
+			},
+		}
+	}
+
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Deploys a new SNS at the latest blessed version (see `ic_sns_wasm`) with the SNS-W canister's `deploy_new_sns`. " +
+			"On mainnet, SNSes are only deployed by the NNS governance canister (following a `CreateServiceNervousSystem` proposal): this resource is meant for testnets and private networks, " +
+			"where the provider's principal is one of the SNS-W canister's allowed principals (which is checked when planning). " +
+			"SNSes cannot be deleted: destroying the resource only removes it from the Terraform state.",
+
+		Attributes: map[string]schema.Attribute{
+			"id": computedId("Identifier of the SNS (its root canister)"),
+			"sns_wasm_canister_id": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "SNS-W canister. Defaults to the NNS SNS-W canister (`qaa6y-5yaaa-aaaaa-aaafa-cai`).",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"arg_hex": schema.StringAttribute{
+				Required: true,
+				MarkdownDescription: "Hex representation of the candid-encoded argument of `deploy_new_sns`, i.e. `(record { sns_init_payload = opt record { ... } })`, " +
+					"e.g. produced from an SNS configuration with `didc` or with `did_encode`.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"root_canister_id":       computedId("Root canister of the SNS"),
+			"governance_canister_id": computedId("Governance canister of the SNS"),
+			"ledger_canister_id":     computedId("Ledger canister of the SNS"),
+			"swap_canister_id":       computedId("Swap canister of the SNS"),
+			"index_canister_id":      computedId("Index canister of the SNS"),
+			"subnet_id":              computedId("Subnet on which the SNS was deployed"),
+		},
+	}
+}
+
+func (r *SnsDeploymentResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	r.config = providerData.Config
+	r.readOnly = providerData.ReadOnly
+}
+
+// Previews the deployment: checks that the argument can be decoded and that the provider's
+// principal is allowed to deploy SNSes.
+func (r *SnsDeploymentResource) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	// Nothing to preview when destroying or updating
+	if req.Plan.Raw.IsNull() || !req.State.Raw.IsNull() {
+		return
+	}
+
+	var data SnsDeploymentResourceModel
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() || data.ArgHex.IsUnknown() || data.SnsWasmCanisterId.IsUnknown() || r.config == nil {
+		return
+	}
+
+	arg, err := hex.DecodeString(data.ArgHex.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddError("Invalid argument", "Could not decode arg_hex: "+err.Error())
+		return
+	}
+
+	_, _, err = idl.Decode(arg)
+	if err != nil {
+		resp.Diagnostics.AddError("Invalid argument", "arg_hex is not a candid value: "+err.Error())
+		return
+	}
+
+	canisterId, err := snsWasmCanisterId(data.SnsWasmCanisterId)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode SNS-W canister id", err))
+		return
+	}
+
+	a, err := newAgent(*r.config)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not create agent", err))
+		return
+	}
+	snsw := &sns.Agent{Agent: a, CanisterId: canisterId}
+
+	allowed, err := snsw.GetAllowedPrincipals(struct{}{})
+	if err != nil {
+		resp.Diagnostics.AddWarning("Could not read allowed principals", err.Error())
+		return
+	}
+
+	sender := r.config.Identity.Sender().Encode()
+	for _, p := range allowed.AllowedPrincipals {
+		if p.Encode() == sender {
+			return
+		}
+	}
+
+	resp.Diagnostics.AddWarning("Principal not allowed to deploy SNSes",
+		fmt.Sprintf("The provider's principal %s is not one of the principals allowed to deploy SNSes by %s, so the deployment will likely be rejected.", sender, canisterId.Encode()))
+}
+
+func (r *SnsDeploymentResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data SnsDeploymentResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if r.readOnly != readWrite {
+		resp.Diagnostics.Append(r.readOnly.diagnostic("deploy the SNS"))
+		return
+	}
+
+	canisterId, err := snsWasmCanisterId(data.SnsWasmCanisterId)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode SNS-W canister id", err))
+		return
+	}
+
+	arg, err := hex.DecodeString(data.ArgHex.ValueString())
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode arg_hex", err))
+		return
+	}
+
+	raw, err := CallRaw(*r.config, canisterId, "deploy_new_sns", arg)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not deploy SNS", err))
+		return
+	}
+
+	var result sns.DeployNewSnsResponse
+	err = idl.Unmarshal(raw, []any{&result})
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode deploy_new_sns response", err))
+		return
+	}
+
+	if result.Error != nil {
+		resp.Diagnostics.AddError("Client Error", "Could not deploy SNS: "+result.Error.Message)
+		return
+	}
+
+	if result.Canisters == nil || result.Canisters.Root == nil {
+		resp.Diagnostics.AddError("Client Error", "deploy_new_sns did not return the SNS canisters")
+		return
+	}
+
+	data.Id = types.StringValue(result.Canisters.Root.Encode())
+	data.RootCanisterId = optPrincipalString(result.Canisters.Root)
+	data.GovernanceCanisterId = optPrincipalString(result.Canisters.Governance)
+	data.LedgerCanisterId = optPrincipalString(result.Canisters.Ledger)
+	data.SwapCanisterId = optPrincipalString(result.Canisters.Swap)
+	data.IndexCanisterId = optPrincipalString(result.Canisters.Index)
+	data.SubnetId = optPrincipalString(result.SubnetId)
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *SnsDeploymentResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data SnsDeploymentResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Save updated data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// All attributes require replacement, so this only stores the planned data.
+func (r *SnsDeploymentResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data SnsDeploymentResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// SNSes cannot be deleted, the resource is only removed from the state.
+func (r *SnsDeploymentResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	var data SnsDeploymentResourceModel
+
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.AddWarning("SNS not deleted",
+		fmt.Sprintf("The SNS %s was removed from the Terraform state, but its canisters still exist.", data.Id.ValueString()))
+}
@@ -0,0 +1,297 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/datasource"
+	"github.com/hashicorp/terraform-plugin-framework/datasource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic"
+	"github.com/aviate-labs/agent-go/ic/sns"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ datasource.DataSource = &SnsWasmDataSource{}
+
+func NewSnsWasmDataSource() datasource.DataSource {
+	return &SnsWasmDataSource{}
+}
+
+// SnsWasmDataSource reads the blessed SNS versions and the deployed SNSes from the SNS-W
+// canister.
+type SnsWasmDataSource struct {
+	config *agent.Config
+}
+
+// SnsWasmDataSourceModel describes the data source data model.
+type SnsWasmDataSourceModel struct {
+	SnsWasmCanisterId       types.String `tfsdk:"sns_wasm_canister_id"`
+	SnsGovernanceCanisterId types.String `tfsdk:"sns_governance_canister_id"`
+	LatestVersion           types.Map    `tfsdk:"latest_version"`
+	NextVersion             types.Map    `tfsdk:"next_version"`
+	DeployedSnses           types.List   `tfsdk:"deployed_snses"`
+	SnsSubnetIds            types.List   `tfsdk:"sns_subnet_ids"`
+	AllowedPrincipals       types.List   `tfsdk:"allowed_principals"`
+}
+
+var deployedSnsAttrTypes = map[string]attr.Type{
+	"root_canister_id":       types.StringType,
+	"governance_canister_id": types.StringType,
+	"ledger_canister_id":     types.StringType,
+	"swap_canister_id":       types.StringType,
+	"index_canister_id":      types.StringType,
+}
+
+func (d *SnsWasmDataSource) Metadata(ctx context.Context, req datasource.MetadataRequest, resp *datasource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_sns_wasm"
+}
+
+func (d *SnsWasmDataSource) Schema(ctx context.Context, req datasource.SchemaRequest, resp *datasource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Reads the SNS versions blessed by the NNS and the deployed SNSes from the SNS-W canister, e.g. to check the module hashes of SNS canisters " +
+			"against blessed versions when coordinating SNS launches and upgrades (see also `ic_sns_deployment`). " +
+			"Versions are maps from the SNS canister types (`root`, `governance`, `ledger`, `swap`, `archive` and `index`) to the (hex-encoded) module hashes.",
+
+		Attributes: map[string]schema.Attribute{
+			"sns_wasm_canister_id": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "SNS-W canister, e.g. on private networks. Defaults to the NNS SNS-W canister (`qaa6y-5yaaa-aaaaa-aaafa-cai`).",
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"sns_governance_canister_id": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Governance canister of a deployed SNS, to read the version it can be upgraded to (`next_version`)",
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"latest_version": schema.MapAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Latest blessed SNS version, used for new SNSes",
+			},
+			"next_version": schema.MapAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Next version of the SNS of `sns_governance_canister_id` on its upgrade path. Null if `sns_governance_canister_id` is not set or if the SNS is up to date.",
+			},
+			"deployed_snses": schema.ListNestedAttribute{
+				Computed:            true,
+				MarkdownDescription: "SNSes deployed by the SNS-W canister",
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"root_canister_id": schema.StringAttribute{
+							Computed:            true,
+							MarkdownDescription: "Root canister of the SNS",
+						},
+						"governance_canister_id": schema.StringAttribute{
+							Computed:            true,
+							MarkdownDescription: "Governance canister of the SNS",
+						},
+						"ledger_canister_id": schema.StringAttribute{
+							Computed:            true,
+							MarkdownDescription: "Ledger canister of the SNS",
+						},
+						"swap_canister_id": schema.StringAttribute{
+							Computed:            true,
+							MarkdownDescription: "Swap canister of the SNS",
+						},
+						"index_canister_id": schema.StringAttribute{
+							Computed:            true,
+							MarkdownDescription: "Index canister of the SNS",
+						},
+					},
+				},
+			},
+			"sns_subnet_ids": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Subnets on which SNSes are deployed",
+			},
+			"allowed_principals": schema.ListAttribute{
+				ElementType:         types.StringType,
+				Computed:            true,
+				MarkdownDescription: "Principals allowed to deploy SNSes besides the NNS governance canister (only used on testnets)",
+			},
+		},
+	}
+}
+
+func (d *SnsWasmDataSource) Configure(ctx context.Context, req datasource.ConfigureRequest, resp *datasource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Data Source Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	d.config = providerData.Config
+}
+
+// Returns the SNS-W canister, defaulting to the NNS SNS-W canister.
+func snsWasmCanisterId(canisterId types.String) (principal.Principal, error) {
+	if canisterId.IsNull() || canisterId.IsUnknown() {
+		return ic.SNS_WASM_PRINCIPAL, nil
+	}
+	return principal.Decode(canisterId.ValueString())
+}
+
+// Returns the key of an SNS canister type, as named by get_latest_sns_version_pretty
+// (e.g. "Ledger Archive" -> "archive").
+func snsCanisterTypeKey(name string) string {
+	key := strings.ToLower(name)
+	key = strings.TrimPrefix(key, "ledger ")
+	return strings.ReplaceAll(key, " ", "_")
+}
+
+func snsVersionMap(version sns.SnsVersion) map[string]string {
+	return map[string]string{
+		"root":       hex.EncodeToString(version.RootWasmHash),
+		"governance": hex.EncodeToString(version.GovernanceWasmHash),
+		"ledger":     hex.EncodeToString(version.LedgerWasmHash),
+		"swap":       hex.EncodeToString(version.SwapWasmHash),
+		"archive":    hex.EncodeToString(version.ArchiveWasmHash),
+		"index":      hex.EncodeToString(version.IndexWasmHash),
+	}
+}
+
+func principalStrings(principals []principal.Principal) []string {
+	strs := []string{}
+	for _, p := range principals {
+		strs = append(strs, p.Encode())
+	}
+	return strs
+}
+
+func optPrincipalString(p *principal.Principal) types.String {
+	if p == nil {
+		return types.StringNull()
+	}
+	return types.StringValue(p.Encode())
+}
+
+func (d *SnsWasmDataSource) Read(ctx context.Context, req datasource.ReadRequest, resp *datasource.ReadResponse) {
+	var data SnsWasmDataSourceModel
+
+	resp.Diagnostics.Append(req.Config.Get(ctx, &data)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	canisterId, err := snsWasmCanisterId(data.SnsWasmCanisterId)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode SNS-W canister id", err))
+		return
+	}
+
+	a, err := newAgent(*d.config)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not create agent", err))
+		return
+	}
+	snsw := &sns.Agent{Agent: a, CanisterId: canisterId}
+
+	latest, err := snsw.GetLatestSnsVersionPretty(idl.Null{})
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not read latest SNS version", err))
+		return
+	}
+
+	latestVersion := map[string]string{}
+	for _, entry := range *latest {
+		latestVersion[snsCanisterTypeKey(entry.Field0)] = entry.Field1
+	}
+
+	var diags diag.Diagnostics
+	data.LatestVersion, diags = types.MapValueFrom(ctx, types.StringType, latestVersion)
+	resp.Diagnostics.Append(diags...)
+
+	data.NextVersion = types.MapNull(types.StringType)
+	if !data.SnsGovernanceCanisterId.IsNull() {
+		governanceId, err := principal.Decode(data.SnsGovernanceCanisterId.ValueString())
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not decode SNS governance canister id", err))
+			return
+		}
+
+		next, err := snsw.GetNextSnsVersion(sns.GetNextSnsVersionRequest{GovernanceCanisterId: &governanceId})
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("Could not read next SNS version", err))
+			return
+		}
+
+		if next.NextVersion != nil {
+			data.NextVersion, diags = types.MapValueFrom(ctx, types.StringType, snsVersionMap(*next.NextVersion))
+			resp.Diagnostics.Append(diags...)
+		}
+	}
+
+	deployed, err := snsw.ListDeployedSnses(struct{}{})
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not list deployed SNSes", err))
+		return
+	}
+
+	deployedSnses := []attr.Value{}
+	for _, instance := range deployed.Instances {
+		deployedSns, diags := types.ObjectValue(deployedSnsAttrTypes, map[string]attr.Value{
+			"root_canister_id":       optPrincipalString(instance.RootCanisterId),
+			"governance_canister_id": optPrincipalString(instance.GovernanceCanisterId),
+			"ledger_canister_id":     optPrincipalString(instance.LedgerCanisterId),
+			"swap_canister_id":       optPrincipalString(instance.SwapCanisterId),
+			"index_canister_id":      optPrincipalString(instance.IndexCanisterId),
+		})
+		resp.Diagnostics.Append(diags...)
+		deployedSnses = append(deployedSnses, deployedSns)
+	}
+
+	data.DeployedSnses, diags = types.ListValue(types.ObjectType{AttrTypes: deployedSnsAttrTypes}, deployedSnses)
+	resp.Diagnostics.Append(diags...)
+
+	subnets, err := snsw.GetSnsSubnetIds(struct{}{})
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not read SNS subnets", err))
+		return
+	}
+
+	data.SnsSubnetIds, diags = types.ListValueFrom(ctx, types.StringType, principalStrings(subnets.SnsSubnetIds))
+	resp.Diagnostics.Append(diags...)
+
+	allowed, err := snsw.GetAllowedPrincipals(struct{}{})
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("Could not read allowed principals", err))
+		return
+	}
+
+	data.AllowedPrincipals, diags = types.ListValueFrom(ctx, types.StringType, principalStrings(allowed.AllowedPrincipals))
+	resp.Diagnostics.Append(diags...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
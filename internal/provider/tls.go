@@ -0,0 +1,33 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// Returns the TLS configuration trusting the PEM-encoded CA certificates (in addition to
+// the system's), or skipping the verification of certificates altogether if insecure.
+func newTLSConfig(caCertificatePem string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure,
+	}
+
+	if len(caCertificatePem) == 0 {
+		return config, nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM([]byte(caCertificatePem)) {
+		return nil, fmt.Errorf("no PEM-encoded certificate found")
+	}
+	config.RootCAs = pool
+
+	return config, nil
+}
@@ -0,0 +1,147 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/principal"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// tracingTransport logs every request to the IC's HTTP interface (calls, queries and
+// read_state requests) at TRACE level (see trace_requests): the canister, the method, the
+// request id, the size of the argument, the latency and the reject code, if any.
+//
+// NOTE: agent-go (v0.4.4) doesn't pass contexts to its requests, so, like retryTransport,
+// tracing logs with the context the provider was configured with.
+type tracingTransport struct {
+	base http.RoundTripper
+	ctx  context.Context
+}
+
+// The content of the envelope of a request (see agent.Request).
+type requestEnvelope struct {
+	Content struct {
+		RequestType   agent.RequestType `cbor:"request_type"`
+		Sender        []byte            `cbor:"sender"`
+		Nonce         []byte            `cbor:"nonce"`
+		IngressExpiry uint64            `cbor:"ingress_expiry"`
+		CanisterId    []byte            `cbor:"canister_id"`
+		MethodName    string            `cbor:"method_name"`
+		Arg           []byte            `cbor:"arg"`
+		Paths         [][][]byte        `cbor:"paths"`
+	} `cbor:"content"`
+}
+
+// Reads the envelope of a request to the IC's HTTP interface, without consuming its body.
+func readRequestEnvelope(req *http.Request) (requestEnvelope, bool) {
+	var envelope requestEnvelope
+
+	body, err := req.GetBody()
+	if err != nil {
+		return envelope, false
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return envelope, false
+	}
+
+	return envelope, cbor.Unmarshal(data, &envelope) == nil
+}
+
+// Returns the (hex-encoded) id of a call or query.
+func (e requestEnvelope) requestId() string {
+	content := e.Content
+	requestId := agent.NewRequestID(agent.Request{
+		Type:          content.RequestType,
+		Sender:        principal.Principal{Raw: content.Sender},
+		Nonce:         content.Nonce,
+		IngressExpiry: content.IngressExpiry,
+		CanisterID:    principal.Principal{Raw: content.CanisterId},
+		MethodName:    content.MethodName,
+		Arguments:     content.Arg,
+	})
+	return hex.EncodeToString(requestId[:])
+}
+
+// Returns the (hex-encoded) ids of the requests whose status is read by a read_state request.
+func (e requestEnvelope) requestStatusIds() []string {
+	var ids []string
+	for _, path := range e.Content.Paths {
+		if len(path) >= 2 && string(path[0]) == "request_status" {
+			ids = append(ids, hex.EncodeToString(path[1]))
+		}
+	}
+	return ids
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || !strings.HasPrefix(req.URL.Path, "/api/v2/canister/") || req.GetBody == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	fields := map[string]any{
+		"url": req.URL.String(),
+	}
+
+	if envelope, ok := readRequestEnvelope(req); ok {
+		content := envelope.Content
+		fields["request_type"] = string(content.RequestType)
+		fields["canister_id"] = principal.Principal{Raw: content.CanisterId}.Encode()
+		if len(content.MethodName) > 0 {
+			fields["method"] = content.MethodName
+			fields["arg_size"] = len(content.Arg)
+		}
+
+		switch content.RequestType {
+		case agent.RequestTypeCall, agent.RequestTypeQuery:
+			fields["request_id"] = envelope.requestId()
+		case agent.RequestTypeReadState:
+			// Polling the status of a call
+			for _, requestId := range envelope.requestStatusIds() {
+				fields["request_id"] = requestId
+			}
+		}
+	}
+
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	fields["latency_ms"] = time.Since(start).Milliseconds()
+
+	if err != nil {
+		fields["error"] = err.Error()
+		tflog.Trace(t.ctx, "IC request failed", fields)
+		return res, err
+	}
+
+	fields["status"] = res.StatusCode
+
+	// Queries and synchronously rejected calls are answered with their reject code
+	if res.StatusCode == http.StatusOK && !strings.HasSuffix(req.URL.Path, "/read_state") {
+		data, readErr := io.ReadAll(res.Body)
+		res.Body.Close()
+		if readErr != nil {
+			return nil, readErr
+		}
+		res.Body = io.NopCloser(bytes.NewReader(data))
+
+		var response agent.Response
+		if cbor.Unmarshal(data, &response) == nil && response.RejectCode != 0 {
+			fields["reject_code"] = response.RejectCode
+			fields["reject_message"] = response.RejectMsg
+		}
+	}
+
+	tflog.Trace(t.ctx, "IC request", fields)
+	return res, err
+}
@@ -0,0 +1,180 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/aviate-labs/agent-go"
+)
+
+// The transport of the standard library, which the transports of the endpoints are cloned
+// from (see ConnectionPool.transport).
+var defaultHTTPTransport = http.DefaultTransport.(*http.Transport)
+
+// transportSettings are the settings of the HTTP requests a provider sends to its endpoint.
+type transportSettings struct {
+	retryPolicy RetryPolicy
+	userAgent   string
+	pool        ConnectionPool
+	tlsConfig   *tls.Config     // nil to verify the endpoint against the system's CAs
+	rootKey     []byte          // root key pinned with root_key, nil if not pinned
+	traceCtx    context.Context // context to trace the requests with (trace_requests), nil to not trace them
+	logCtx      context.Context // context to log retries and agent calls with (see endpointLogContext)
+}
+
+// endpointTransport is the chain of transports of the requests of a provider to its
+// endpoint, from the outermost:
+//   - retryTransport, so that every attempt goes through the transports below;
+//   - userAgentTransport;
+//   - rootKeyTransport, if the root key is pinned;
+//   - tracingTransport, if the requests are traced;
+//   - rejectTransport;
+//   - the network (with the connection pool and TLS settings of the provider), or the
+//     in-memory backend of mock:// endpoints.
+type endpointTransport struct {
+	http.RoundTripper
+
+	network *http.Transport // nil for mock:// endpoints
+	logCtx  context.Context // context to log with outside of requests of Terraform
+	agents  *agentCache     // agents of the provider instance (see newAgent)
+}
+
+// Returns the chain of transports of the requests to the endpoint with the settings. The
+// transport sending the requests (to the network or the mock:// backend) is wrapped with
+// wrapBase, unless nil.
+func newEndpointTransport(endpoint *url.URL, settings transportSettings, wrapBase func(http.RoundTripper) http.RoundTripper) *endpointTransport {
+	t := &endpointTransport{agents: newAgentCache()}
+
+	var base http.RoundTripper
+	if isMockEndpoint(endpoint) {
+		base = &mockTransport{}
+	} else {
+		t.network = settings.pool.transport()
+		if settings.tlsConfig != nil {
+			t.network.TLSClientConfig = settings.tlsConfig
+		}
+		base = t.network
+	}
+	if wrapBase != nil {
+		base = wrapBase(base)
+	}
+
+	var rt http.RoundTripper = &rejectTransport{base: base}
+	if settings.traceCtx != nil {
+		rt = &tracingTransport{base: rt, ctx: context.WithoutCancel(settings.traceCtx)}
+	}
+	if settings.rootKey != nil {
+		rt = &rootKeyTransport{base: rt, rootKey: settings.rootKey}
+	}
+	if len(settings.userAgent) > 0 {
+		rt = &userAgentTransport{base: rt, userAgent: settings.userAgent}
+	}
+	logCtx := context.Background()
+	if settings.logCtx != nil {
+		logCtx = context.WithoutCancel(settings.logCtx)
+	}
+	t.RoundTripper = &retryTransport{base: rt, policy: settings.retryPolicy, ctx: logCtx}
+	t.logCtx = logCtx
+
+	return t
+}
+
+// Transports of the endpoints of the configured providers, by endpoint (see endpointKey).
+var endpointTransports sync.Map
+
+var installEndpointRouterOnce sync.Once
+
+// endpointRouter sends the requests to the endpoints of the configured providers through
+// their chain of transports (see endpointTransport), and all other requests (e.g. of other
+// HTTP clients of the plugin) as is.
+//
+// NOTE: agent-go (v0.4.4) doesn't allow configuring the HTTP client of its agents, whose
+// clients use http.DefaultTransport, so the router is installed there, once. Providers
+// (e.g. aliases) configured with the same endpoint are told apart by the alias of their
+// endpoint (see withEndpointAlias).
+type endpointRouter struct {
+	base http.RoundTripper
+}
+
+// Aliases given to the endpoints of the configured providers, see withEndpointAlias.
+var endpointAliases atomic.Uint64
+
+// Returns a new alias for the endpoint of a provider instance.
+func newEndpointAlias() string {
+	return "provider-" + strconv.FormatUint(endpointAliases.Add(1), 10)
+}
+
+// Returns the endpoint with the alias of a provider instance as its fragment, so that the
+// requests of the agents created with it (which build their URLs from the endpoint) are sent
+// through the transport of that instance. Fragments are not sent in requests.
+func withEndpointAlias(endpoint *url.URL, alias string) *url.URL {
+	u := *endpoint
+	u.Fragment, u.RawFragment = alias, ""
+	return &u
+}
+
+// Returns the endpoint without the alias of its provider instance, e.g. to compare it.
+func withoutEndpointAlias(endpoint *url.URL) *url.URL {
+	return withEndpointAlias(endpoint, "")
+}
+
+// Returns the scheme, host and alias of the endpoint, which identify its transport.
+func endpointKey(endpoint *url.URL) string {
+	key := endpoint.Scheme + "://" + endpoint.Host
+	if len(endpoint.Fragment) > 0 {
+		key += "#" + endpoint.Fragment
+	}
+	return key
+}
+
+// Sends the requests to the endpoint through the transport, replacing the transport of a
+// previous configuration of the endpoint (with the same alias).
+func setEndpointTransport(endpoint *url.URL, transport *endpointTransport) {
+	installEndpointRouterOnce.Do(func() {
+		http.DefaultTransport = &endpointRouter{base: http.DefaultTransport}
+	})
+
+	previous, ok := endpointTransports.Swap(endpointKey(endpoint), transport)
+	if ok && previous.(*endpointTransport).network != nil {
+		previous.(*endpointTransport).network.CloseIdleConnections()
+	}
+}
+
+// Returns the transport of the endpoint of the agent configuration, if configured.
+func configuredEndpointTransport(config agent.Config) (*endpointTransport, bool) {
+	if config.ClientConfig == nil || config.ClientConfig.Host == nil {
+		return nil, false
+	}
+	transport, ok := endpointTransports.Load(endpointKey(config.ClientConfig.Host))
+	if !ok {
+		return nil, false
+	}
+	return transport.(*endpointTransport), true
+}
+
+// Returns the context to log with for the endpoint of the agent configuration, for the code
+// running without the context of a Terraform request (e.g. agent calls).
+func endpointLogContext(config agent.Config) context.Context {
+	if transport, ok := configuredEndpointTransport(config); ok {
+		return transport.logCtx
+	}
+	return context.Background()
+}
+
+func (t *endpointRouter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if transport, ok := endpointTransports.Load(endpointKey(req.URL)); ok {
+		return transport.(*endpointTransport).RoundTrip(req)
+	}
+	// e.g. agents created for a mock:// endpoint before the provider is configured
+	if req.URL.Scheme == mockScheme {
+		return (&mockTransport{}).RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
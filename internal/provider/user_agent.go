@@ -0,0 +1,45 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// userAgentTransport identifies the provider (and its exact version) in the User-Agent of
+// its requests to the IC, e.g. so that boundary node operators can trace its traffic.
+//
+// NOTE: agent-go (v0.4.4) doesn't set the User-Agent of its requests, so it is set in the
+// transport of the endpoint (see endpointTransport).
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+// Returns the User-Agent of the provider: its version and Terraform's, followed by the
+// suffix (if any), e.g. `terraform-provider-ic/1.2.3 Terraform/1.9.0 team-a/deploy`.
+func providerUserAgent(version string, terraformVersion string, suffix string) string {
+	ua := fmt.Sprintf("terraform-provider-ic/%s", version)
+	if len(terraformVersion) > 0 {
+		ua += " Terraform/" + terraformVersion
+	}
+	if len(suffix) > 0 {
+		ua += " " + suffix
+	}
+	return ua
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ua := t.userAgent
+
+	// Requests must not be modified by transports; the User-Agent of clients that set
+	// their own is kept after the provider's
+	req = req.Clone(req.Context())
+	if existing := req.Header.Get("User-Agent"); len(existing) > 0 {
+		ua += " " + existing
+	}
+	req.Header.Set("User-Agent", ua)
+
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,168 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+
+	"github.com/aviate-labs/agent-go/ic"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+var _ validator.List = controllersValidator{}
+
+// controllersValidator checks that all (known) controllers are valid principals in
+// their canonical textual form, and warns about principals that are (almost certainly)
+// not meant to control a canister.
+type controllersValidator struct{}
+
+func (v controllersValidator) Description(ctx context.Context) string {
+	return "controllers must be valid principals; warns about the anonymous principal and the management canister"
+}
+
+func (v controllersValidator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v controllersValidator) ValidateList(ctx context.Context, req validator.ListRequest, resp *validator.ListResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+
+	for i, elem := range req.ConfigValue.Elements() {
+		controller, ok := elem.(types.String)
+		if !ok || controller.IsNull() || controller.IsUnknown() {
+			continue
+		}
+
+		elemPath := req.Path.AtListIndex(i)
+		text := controller.ValueString()
+
+		p, err := principal.Decode(text)
+		if err != nil {
+			resp.Diagnostics.AddAttributeError(elemPath, "Invalid controller", fmt.Sprintf("Could not decode principal %q: %s", text, err.Error()))
+			continue
+		}
+
+		if p.Encode() != text {
+			resp.Diagnostics.AddAttributeError(elemPath, "Invalid controller", fmt.Sprintf("Principal %q is not in canonical form, expected %q", text, p.Encode()))
+			continue
+		}
+
+		if p.IsAnonymous() {
+			resp.Diagnostics.AddAttributeWarning(elemPath, "Anonymous controller",
+				fmt.Sprintf("The anonymous principal %s is a controller, which means that anyone can control the canister (e.g. upgrade it or delete it). This is almost certainly a mistake.", text))
+		}
+
+		if p.Equal(ic.MANAGEMENT_CANISTER_PRINCIPAL) {
+			resp.Diagnostics.AddAttributeWarning(elemPath, "Management canister controller",
+				fmt.Sprintf("The management canister %s is a controller, which has no effect since it cannot make calls. This is almost certainly a mistake.", text))
+		}
+	}
+}
+
+var _ validator.String = principalValidator{}
+
+// principalValidator checks that the (known) value is a valid principal.
+type principalValidator struct{}
+
+func (v principalValidator) Description(ctx context.Context) string {
+	return "value must be a valid principal"
+}
+
+func (v principalValidator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v principalValidator) ValidateString(ctx context.Context, req validator.StringRequest, resp *validator.StringResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+
+	_, err := principal.Decode(req.ConfigValue.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(req.Path, "Invalid principal", fmt.Sprintf("Could not decode principal %q: %s", req.ConfigValue.ValueString(), err.Error()))
+	}
+}
+
+var _ validator.String = rfc3339Validator{}
+
+// rfc3339Validator checks that the (known) value is an RFC 3339 timestamp.
+type rfc3339Validator struct{}
+
+func (v rfc3339Validator) Description(ctx context.Context) string {
+	return "value must be an RFC 3339 timestamp, e.g. 2024-01-31T12:00:00Z"
+}
+
+func (v rfc3339Validator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v rfc3339Validator) ValidateString(ctx context.Context, req validator.StringRequest, resp *validator.StringResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+
+	_, err := time.Parse(time.RFC3339, req.ConfigValue.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(req.Path, "Invalid timestamp", fmt.Sprintf("Could not parse RFC 3339 timestamp %q: %s", req.ConfigValue.ValueString(), err.Error()))
+	}
+}
+
+var _ validator.String = durationValidator{}
+
+// durationValidator checks that the (known) value is a positive Go duration.
+type durationValidator struct{}
+
+func (v durationValidator) Description(ctx context.Context) string {
+	return "value must be a positive duration, e.g. 500ms or 10s"
+}
+
+func (v durationValidator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v durationValidator) ValidateString(ctx context.Context, req validator.StringRequest, resp *validator.StringResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+
+	d, err := time.ParseDuration(req.ConfigValue.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(req.Path, "Invalid duration", fmt.Sprintf("Could not parse duration %q: %s", req.ConfigValue.ValueString(), err.Error()))
+		return
+	}
+
+	if d <= 0 {
+		resp.Diagnostics.AddAttributeError(req.Path, "Invalid duration", fmt.Sprintf("Duration %q must be positive", req.ConfigValue.ValueString()))
+	}
+}
+
+var _ validator.String = subaccountValidator{}
+
+// subaccountValidator checks that the (known) value is a hex-encoded 32-byte subaccount.
+type subaccountValidator struct{}
+
+func (v subaccountValidator) Description(ctx context.Context) string {
+	return "value must be a hex-encoded subaccount (32 bytes)"
+}
+
+func (v subaccountValidator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v subaccountValidator) ValidateString(ctx context.Context, req validator.StringRequest, resp *validator.StringResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+
+	_, err := decodeSubaccount(req.ConfigValue.ValueString())
+	if err != nil {
+		resp.Diagnostics.AddAttributeError(req.Path, "Invalid subaccount", fmt.Sprintf("Could not decode subaccount %q: %s", req.ConfigValue.ValueString(), err.Error()))
+	}
+}
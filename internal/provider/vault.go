@@ -0,0 +1,198 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aviate-labs/agent-go/identity"
+)
+
+// The field of the Vault secret holding the identity, unless configured otherwise.
+const defaultVaultSecretField = "pem"
+
+// VaultSecret is a secret holding the identity's key in HashiCorp Vault. The secret is
+// read with a Vault token, or with a token obtained by logging in with AppRole.
+type VaultSecret struct {
+	Address string // e.g. https://vault.example.com:8200
+	Path    string // API path of the secret, e.g. secret/data/ic/deployer (KV v2)
+	Field   string // field of the secret holding the key
+
+	Token string // empty to log in with AppRole
+
+	RoleId   string
+	SecretId string
+
+	Namespace string // Vault Enterprise namespace, empty if not used
+}
+
+var vaultClient = &http.Client{Timeout: 30 * time.Second}
+
+// Sends a request to the Vault API and decodes the JSON response into result.
+func (s VaultSecret) request(method string, apiPath string, token string, body any, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	url := strings.TrimSuffix(s.Address, "/") + "/v1/" + strings.TrimPrefix(apiPath, "/")
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		return err
+	}
+	if len(token) > 0 {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if len(s.Namespace) > 0 {
+		req.Header.Set("X-Vault-Namespace", s.Namespace)
+	}
+
+	res, err := vaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		var errs struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &errs) == nil && len(errs.Errors) > 0 {
+			return fmt.Errorf("%s %s: %s (%s)", method, apiPath, strings.Join(errs.Errors, ", "), res.Status)
+		}
+		return fmt.Errorf("%s %s: %s", method, apiPath, res.Status)
+	}
+
+	return json.Unmarshal(data, result)
+}
+
+// Returns the token to read the secret with, logging in with AppRole if no token is set.
+func (s VaultSecret) token() (string, error) {
+	if len(s.Token) > 0 {
+		return s.Token, nil
+	}
+
+	if len(s.RoleId) == 0 {
+		return "", fmt.Errorf("No Vault token: set vault_token (or VAULT_TOKEN), or vault_role_id and vault_secret_id")
+	}
+
+	var login struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	err := s.request(http.MethodPost, "auth/approle/login", "", map[string]string{"role_id": s.RoleId, "secret_id": s.SecretId}, &login)
+	if err != nil {
+		return "", fmt.Errorf("Could not log in to Vault with AppRole: %w", err)
+	}
+
+	return login.Auth.ClientToken, nil
+}
+
+// Reads the identity's key from the secret, returned PEM-encoded. The field of the secret
+// holds either a PEM-encoded key or a raw (hex or base64-encoded) Ed25519 key.
+func (s VaultSecret) ReadIdentityPem() (string, error) {
+	if len(s.Address) == 0 {
+		return "", fmt.Errorf("No Vault address: set vault_address (or VAULT_ADDR)")
+	}
+
+	token, err := s.token()
+	if err != nil {
+		return "", err
+	}
+
+	// KV v1 secrets are the data itself, while KV v2 secrets wrap it with metadata
+	var secret struct {
+		Data map[string]any `json:"data"`
+	}
+	err = s.request(http.MethodGet, s.Path, token, nil, &secret)
+	if err != nil {
+		return "", fmt.Errorf("Could not read secret: %w", err)
+	}
+
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	value, ok := data[s.Field].(string)
+	if !ok {
+		return "", fmt.Errorf("Secret %s has no field %s", s.Path, s.Field)
+	}
+
+	return identityPemFromKey(value)
+}
+
+// Returns the PEM-encoded identity from a PEM-encoded key (Ed25519, secp256k1 or
+// prime256v1), or from a raw Ed25519 key (32-byte seed or 64-byte private key) encoded
+// in hex or base64.
+func identityPemFromKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+
+	if strings.HasPrefix(key, "-----BEGIN") {
+		_, err := NewIdentityFromPEM([]byte(key + "\n"))
+		if err != nil {
+			return "", fmt.Errorf("Could not read an Ed25519, secp256k1 or prime256v1 identity from the PEM-encoded key: %w", err)
+		}
+		return key + "\n", nil
+	}
+
+	raw, err := hex.DecodeString(key)
+	if err != nil {
+		raw, err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return "", fmt.Errorf("Expected a PEM-encoded key, or a hex or base64-encoded Ed25519 key")
+		}
+	}
+
+	var privateKey ed25519.PrivateKey
+	switch len(raw) {
+	case ed25519.SeedSize:
+		privateKey = ed25519.NewKeyFromSeed(raw)
+	case ed25519.PrivateKeySize:
+		privateKey = ed25519.PrivateKey(raw)
+	default:
+		return "", fmt.Errorf("Expected a raw Ed25519 key of %d or %d bytes, got %d bytes", ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+	}
+
+	id, err := identity.NewEd25519Identity(privateKey.Public().(ed25519.PublicKey), privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := id.ToPEM()
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// Returns the value of the attribute, or of the environment variable if not set.
+func stringOrEnv(value string, env string) string {
+	if len(value) > 0 {
+		return value
+	}
+	return os.Getenv(env)
+}
@@ -0,0 +1,536 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework-validators/resourcevalidator"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/mapplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/objectplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+
+	"github.com/aviate-labs/agent-go"
+	"github.com/aviate-labs/agent-go/candid"
+	"github.com/aviate-labs/agent-go/candid/idl"
+	"github.com/aviate-labs/agent-go/ic"
+	"github.com/aviate-labs/agent-go/principal"
+)
+
+// Default timeout and interval of ic_wait
+const (
+	defaultWaitTimeout  = 5 * time.Minute
+	defaultWaitInterval = 5 * time.Second
+)
+
+// Ensure provider defined types fully satisfy framework interfaces.
+var _ resource.Resource = &WaitResource{}
+var _ resource.ResourceWithConfigValidators = &WaitResource{}
+
+func NewWaitResource() resource.Resource {
+	return &WaitResource{}
+}
+
+// WaitResource waits for an on-chain condition when it is created, e.g. to sequence
+// rollouts across canisters that need to converge first.
+type WaitResource struct {
+	config *agent.Config
+}
+
+// WaitResourceModel describes the resource data model.
+type WaitResourceModel struct {
+	Id             types.String `tfsdk:"id"`
+	CanisterId     types.String `tfsdk:"canister_id"`
+	ModuleHash     types.String `tfsdk:"module_hash"`
+	Query          types.Object `tfsdk:"query"`
+	Headers        types.Object `tfsdk:"security_headers"`
+	ProposalId     types.Int64  `tfsdk:"proposal_id"`
+	GovernanceId   types.String `tfsdk:"governance_canister_id"`
+	Timeout        types.String `tfsdk:"timeout"`
+	Interval       types.String `tfsdk:"interval"`
+	Triggers       types.Map    `tfsdk:"triggers"`
+	SatisfiedAfter types.String `tfsdk:"satisfied_after"`
+}
+
+// WaitSecurityHeadersModel describes the security headers condition.
+type WaitSecurityHeadersModel struct {
+	Path     types.String `tfsdk:"path"`
+	Url      types.String `tfsdk:"url"`
+	Required types.List   `tfsdk:"required"`
+	Expected types.Map    `tfsdk:"expected"`
+}
+
+// WaitQueryModel describes the query condition.
+type WaitQueryModel struct {
+	Method   types.String `tfsdk:"method"`
+	ArgHex   types.String `tfsdk:"arg_hex"`
+	Expected types.String `tfsdk:"expected"`
+}
+
+func (r *WaitResource) Metadata(ctx context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
+	resp.TypeName = req.ProviderTypeName + "_wait"
+}
+
+func (r *WaitResource) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+	resp.Schema = schema.Schema{
+		MarkdownDescription: "Waits for an on-chain condition when created: a canister's module hash, the reply of a query, the execution of an NNS proposal, or the security headers of the assets served by an asset canister. " +
+			"This can be used to sequence rollouts across canisters, e.g. by making the resources of a second wave depend on the wait. " +
+			"Exactly one of `module_hash`, `query`, `proposal_id` and `security_headers` must be set. The condition is only checked when the resource is created: any change (e.g. of `triggers`) creates it again.",
+
+		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "Identifier of the wait",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"canister_id": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Canister whose module hash, query or assets are checked. Required with `module_hash`, `query` and `security_headers`.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"module_hash": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Waits until the canister's module hash (hex encoded) is equal to this value, e.g. until an upgrade made by a proposal or another configuration was applied.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+			},
+			"query": schema.SingleNestedAttribute{
+				Optional:            true,
+				MarkdownDescription: "Waits until the reply of a query method of the canister is equal to `expected`",
+				PlanModifiers: []planmodifier.Object{
+					objectplanmodifier.RequiresReplace(),
+				},
+				Attributes: map[string]schema.Attribute{
+					"method": schema.StringAttribute{
+						Required:            true,
+						MarkdownDescription: "Name of the query method",
+					},
+					"arg_hex": schema.StringAttribute{
+						Optional:            true,
+						MarkdownDescription: "Hex representation of the candid-encoded arguments (e.g. from `did_encode`). Defaults to no arguments.",
+					},
+					"expected": schema.StringAttribute{
+						Required:            true,
+						MarkdownDescription: "Expected reply, in the candid textual representation, e.g. `(variant { Ready })` or `(42 : nat64)`. The reply and the expected value are compared once candid-encoded, so numbers must be annotated with their type (unless they are `int`).",
+					},
+				},
+			},
+			"security_headers": schema.SingleNestedAttribute{
+				Optional: true,
+				MarkdownDescription: "Waits until the asset canister serves an asset through the HTTP gateway (e.g. once the assets are synced), then fails if the response lacks security headers, " +
+					"which catches misconfigured `.ic-assets.json` files before they are released. Make the wait depend on the sync of the assets, and set `triggers` (e.g. to the hash of the assets) to check the headers after each sync.",
+				PlanModifiers: []planmodifier.Object{
+					objectplanmodifier.RequiresReplace(),
+				},
+				Attributes: map[string]schema.Attribute{
+					"path": schema.StringAttribute{
+						Optional:            true,
+						MarkdownDescription: "Path of the asset to request. Defaults to `/`.",
+					},
+					"url": schema.StringAttribute{
+						Optional: true,
+						MarkdownDescription: "URL to request instead of the asset's URL derived from the endpoint (`https://<canister_id>.icp0.io<path>` on mainnet, and `<endpoint><path>?canisterId=<canister_id>` otherwise), " +
+							"e.g. the custom domain of the frontend.",
+					},
+					"required": schema.ListAttribute{
+						ElementType:         types.StringType,
+						Optional:            true,
+						MarkdownDescription: "Headers the response must have, with any value. Defaults to `content-security-policy` and `strict-transport-security` (HSTS).",
+					},
+					"expected": schema.MapAttribute{
+						ElementType:         types.StringType,
+						Optional:            true,
+						MarkdownDescription: "Headers the response must have with the given value, e.g. `{ x-frame-options = \"DENY\" }`, in addition to `required`.",
+					},
+				},
+			},
+			"proposal_id": schema.Int64Attribute{
+				Optional:            true,
+				MarkdownDescription: "Waits until the NNS proposal is executed. Fails early if the proposal fails to execute.",
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.RequiresReplace(),
+				},
+			},
+			"governance_canister_id": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Governance canister of `proposal_id`, e.g. on private networks. Defaults to the NNS governance canister.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+				Validators: []validator.String{
+					principalValidator{},
+				},
+			},
+			"timeout": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "How long to wait for the condition before failing, e.g. `30m`. Defaults to `5m`.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"interval": schema.StringAttribute{
+				Optional:            true,
+				MarkdownDescription: "Interval at which the condition is checked. Defaults to `5s`.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplace(),
+				},
+				Validators: []validator.String{
+					durationValidator{},
+				},
+			},
+			"triggers": schema.MapAttribute{
+				ElementType:         types.StringType,
+				Optional:            true,
+				MarkdownDescription: "Arbitrary values that cause the wait to be done again when they change, e.g. the module hash of an upgraded canister",
+				PlanModifiers: []planmodifier.Map{
+					mapplanmodifier.RequiresReplace(),
+				},
+			},
+			"satisfied_after": schema.StringAttribute{
+				Computed:            true,
+				MarkdownDescription: "How long it took for the condition to be satisfied, e.g. `1m30s`",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+		},
+	}
+}
+
+func (r WaitResource) ConfigValidators(ctx context.Context) []resource.ConfigValidator {
+	return []resource.ConfigValidator{
+		resourcevalidator.ExactlyOneOf(
+			path.MatchRoot("module_hash"),
+			path.MatchRoot("query"),
+			path.MatchRoot("proposal_id"),
+			path.MatchRoot("security_headers"),
+		),
+		resourcevalidator.Conflicting(
+			path.MatchRoot("canister_id"),
+			path.MatchRoot("proposal_id"),
+		),
+		resourcevalidator.RequiredTogether(
+			path.MatchRoot("governance_canister_id"),
+			path.MatchRoot("proposal_id"),
+		),
+	}
+}
+
+func (r *WaitResource) Configure(ctx context.Context, req resource.ConfigureRequest, resp *resource.ConfigureResponse) {
+	// Prevent panic if the provider has not been configured.
+	if req.ProviderData == nil {
+		return
+	}
+
+	providerData, ok := req.ProviderData.(*IcProviderData)
+
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *IcProviderData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+
+		return
+	}
+
+	r.config = providerData.Config
+}
+
+// Returns a function checking the condition: it returns true once the condition is
+// satisfied, and an error if it never will be (or cannot be checked).
+func (data *WaitResourceModel) Condition(ctx context.Context, config agent.Config) (func() (bool, error), error) {
+	if !data.ProposalId.IsNull() {
+		governanceId := ic.GOVERNANCE_PRINCIPAL
+		if !data.GovernanceId.IsNull() {
+			var err error
+			governanceId, err = principal.Decode(data.GovernanceId.ValueString())
+			if err != nil {
+				return nil, fmt.Errorf("Could not decode governance canister id: %w", err)
+			}
+		}
+
+		proposalId := uint64(data.ProposalId.ValueInt64())
+		return func() (bool, error) {
+			return proposalExecuted(config, governanceId, proposalId)
+		}, nil
+	}
+
+	if data.CanisterId.IsNull() {
+		return nil, fmt.Errorf("canister_id is required with module_hash, query and security_headers")
+	}
+
+	canisterId, err := principal.Decode(data.CanisterId.ValueString())
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode canister id: %w", err)
+	}
+
+	if !data.ModuleHash.IsNull() {
+		expected := strings.ToLower(data.ModuleHash.ValueString())
+		return func() (bool, error) {
+			a, err := newAgent(config)
+			if err != nil {
+				return false, fmt.Errorf("could not create agent: %w", err)
+			}
+
+			moduleHash, err := a.GetCanisterModuleHash(canisterId)
+			if err != nil {
+				return false, fmt.Errorf("could not get canister module hash: %w", err)
+			}
+
+			tflog.Info(ctx, fmt.Sprintf("Module hash of %s is %x", canisterId.Encode(), moduleHash))
+			return hex.EncodeToString(moduleHash) == expected, nil
+		}, nil
+	}
+
+	if !data.Headers.IsNull() {
+		return data.securityHeadersCondition(ctx, config, canisterId)
+	}
+
+	var query WaitQueryModel
+	diags := data.Query.As(ctx, &query, basetypes.ObjectAsOptions{})
+	if diags.HasError() {
+		return nil, fmt.Errorf("Could not read query")
+	}
+
+	arg, err := hex.DecodeString(query.ArgHex.ValueString())
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode query arg_hex: %w", err)
+	}
+
+	expectedRaw, err := candid.EncodeValueString(query.Expected.ValueString())
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode expected reply: %w", err)
+	}
+	expected, err := candid.DecodeValueString(expectedRaw)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode expected reply: %w", err)
+	}
+
+	method := query.Method.ValueString()
+	return func() (bool, error) {
+		raw, err := QueryRaw(config, canisterId, method, arg)
+		if err != nil {
+			return false, fmt.Errorf("could not query %s: %w", method, err)
+		}
+
+		reply, err := candid.DecodeValueString(raw)
+		if err != nil {
+			return false, fmt.Errorf("could not decode reply of %s: %w", method, err)
+		}
+
+		tflog.Info(ctx, fmt.Sprintf("%s replied %s", method, reply))
+		return reply == expected, nil
+	}, nil
+}
+
+// Returns a function checking the security headers of the asset: it returns false until the
+// asset is served, and an error if the response lacks security headers.
+func (data *WaitResourceModel) securityHeadersCondition(ctx context.Context, config agent.Config, canisterId principal.Principal) (func() (bool, error), error) {
+	var headers WaitSecurityHeadersModel
+	diags := data.Headers.As(ctx, &headers, basetypes.ObjectAsOptions{})
+	if diags.HasError() {
+		return nil, fmt.Errorf("Could not read security_headers")
+	}
+
+	required := slices.Clone(defaultSecurityHeaders)
+	if !headers.Required.IsNull() {
+		required = nil
+		diags = headers.Required.ElementsAs(ctx, &required, false)
+		if diags.HasError() {
+			return nil, fmt.Errorf("Could not read security_headers.required")
+		}
+	}
+	for i, name := range required {
+		required[i] = strings.ToLower(name)
+	}
+
+	expected := map[string]string{}
+	if !headers.Expected.IsNull() {
+		var values map[string]string
+		diags = headers.Expected.ElementsAs(ctx, &values, false)
+		if diags.HasError() {
+			return nil, fmt.Errorf("Could not read security_headers.expected")
+		}
+		for name, value := range values {
+			expected[strings.ToLower(name)] = value
+		}
+	}
+
+	assetPath := "/"
+	if !headers.Path.IsNull() {
+		assetPath = headers.Path.ValueString()
+	}
+	url := assetUrl(config, canisterId, assetPath)
+	if !headers.Url.IsNull() {
+		url = headers.Url.ValueString()
+	}
+
+	return func() (bool, error) {
+		status, header, err := fetchHeaders(ctx, url)
+		if err != nil {
+			tflog.Info(ctx, fmt.Sprintf("Could not request %s: %s", url, err.Error()))
+			return false, nil
+		}
+
+		// The assets may not be served yet
+		if status >= 400 {
+			tflog.Info(ctx, fmt.Sprintf("%s responded with status %d", url, status))
+			return false, nil
+		}
+
+		if violations := securityHeaderViolations(header, required, expected); len(violations) > 0 {
+			return false, fmt.Errorf("the response of %s lacks security headers: %s", url, strings.Join(violations, ", "))
+		}
+		return true, nil
+	}, nil
+}
+
+// Returns true if the proposal was executed, and an error if it failed or doesn't exist.
+// NOTE: the reply of get_proposal_info is decoded generically, since decoding the whole
+// proposal with the agent-go (v0.4.4) governance bindings is brittle.
+func proposalExecuted(config agent.Config, governanceId principal.Principal, proposalId uint64) (bool, error) {
+	arg, err := idl.Marshal([]any{proposalId})
+	if err != nil {
+		return false, err
+	}
+
+	raw, err := QueryRaw(config, governanceId, "get_proposal_info", arg)
+	if err != nil {
+		return false, fmt.Errorf("could not get proposal info: %w", err)
+	}
+
+	_, values, err := idl.Decode(raw)
+	if err != nil {
+		return false, fmt.Errorf("could not decode proposal info: %w", err)
+	}
+
+	if len(values) == 0 || values[0] == nil {
+		return false, fmt.Errorf("proposal %d not found", proposalId)
+	}
+
+	if failed, _ := candidField(values[0], "failed_timestamp_seconds").(uint64); failed != 0 {
+		return false, fmt.Errorf("proposal %d failed to execute", proposalId)
+	}
+
+	executed, _ := candidField(values[0], "executed_timestamp_seconds").(uint64)
+	return executed != 0, nil
+}
+
+func (r *WaitResource) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data WaitResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	timeout := defaultWaitTimeout
+	if !data.Timeout.IsNull() {
+		timeout, _ = time.ParseDuration(data.Timeout.ValueString())
+	}
+
+	interval := defaultWaitInterval
+	if !data.Interval.IsNull() {
+		interval, _ = time.ParseDuration(data.Interval.ValueString())
+	}
+
+	condition, err := data.Condition(ctx, *r.config)
+	if err != nil {
+		resp.Diagnostics.Append(clientErrorDiagnostic("", err))
+		return
+	}
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+	for {
+		satisfied, err := condition()
+		if err != nil {
+			resp.Diagnostics.Append(clientErrorDiagnostic("", err))
+			return
+		}
+
+		if satisfied {
+			break
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			resp.Diagnostics.AddError("Client Error", fmt.Sprintf("Condition not satisfied after %s", timeout))
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			resp.Diagnostics.AddError("Client Error", ctx.Err().Error())
+			return
+		case <-time.After(interval):
+		}
+	}
+
+	elapsed := time.Since(start).Round(time.Second)
+	tflog.Info(ctx, fmt.Sprintf("Condition satisfied after %s", elapsed))
+
+	data.Id = types.StringValue(strconv.FormatInt(time.Now().UnixNano(), 10))
+	data.SatisfiedAfter = types.StringValue(elapsed.String())
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+func (r *WaitResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data WaitResourceModel
+
+	// Read Terraform prior state data into the model
+	resp.Diagnostics.Append(req.State.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	// Save updated data into Terraform state
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// All attributes require replacement, so this only stores the planned data.
+func (r *WaitResource) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data WaitResourceModel
+
+	// Read Terraform plan data into the model
+	resp.Diagnostics.Append(req.Plan.Get(ctx, &data)...)
+
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+}
+
+// Nothing to undo, the resource is only removed from the state.
+func (r *WaitResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+}
@@ -0,0 +1,109 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+)
+
+// Check that the conditions on the module hash and on a query reply are awaited, and that
+// unsatisfied conditions time out.
+func TestAccWaitResource(t *testing.T) {
+
+	testEnv := NewTestEnv(t)
+
+	canister := `
+resource "ic_canister" "test" {
+            wasm_file = var.hello_world_wasm
+            wasm_sha256 = filesha256(var.hello_world_wasm)
+}
+`
+
+	resource.Test(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + canister + `
+resource "ic_wait" "module_hash" {
+            canister_id = ic_canister.test.id
+            module_hash = ic_canister.test.wasm_sha256
+}
+
+resource "ic_wait" "query" {
+            canister_id = ic_canister.test.id
+            query = {
+                method = "hello"
+                arg_hex = "4449444c016e71010000"
+                expected = "(\"Hello, World!\")"
+            }
+}
+`,
+				Check: resource.ComposeTestCheckFunc(
+					resource.TestCheckResourceAttrSet("ic_wait.module_hash", "satisfied_after"),
+					resource.TestCheckResourceAttrSet("ic_wait.query", "satisfied_after"),
+				),
+			},
+			{
+				ConfigVariables: testEnv.ConfigVariables,
+				Config: ProviderConfig + VariablesConfig + canister + `
+resource "ic_wait" "module_hash" {
+            canister_id = ic_canister.test.id
+            module_hash = "00"
+            timeout = "2s"
+            interval = "1s"
+}
+`,
+				ExpectError: regexp.MustCompile("Condition not satisfied after 2s"),
+			},
+			// Delete testing automatically occurs in TestCase
+		},
+	})
+}
+
+// Check that the security headers condition fails when the response lacks security headers.
+func TestWaitResourceSecurityHeaders(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		if r.URL.Path == "/secure" {
+			w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		}
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	}))
+	defer server.Close()
+
+	withHeaders := func(path string, expected string) string {
+		return fmt.Sprintf(`
+resource "ic_wait" "headers" {
+            canister_id = "ryjl3-tyaaa-aaaaa-aaaba-cai"
+            security_headers = {
+                url = "%s%s"
+                expected = %s
+            }
+            timeout = "2s"
+            interval = "1s"
+}
+`, server.URL, path, expected)
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: withHeaders("/secure", `{ x-frame-options = "SAMEORIGIN" }`),
+				Check:  resource.TestCheckResourceAttrSet("ic_wait.headers", "satisfied_after"),
+			},
+			{
+				Config:      withHeaders("/", `{ x-frame-options = "DENY" }`),
+				ExpectError: regexp.MustCompile(`strict-transport-security \(missing\), x-frame-options \(expected "DENY", got "SAMEORIGIN"\)`),
+			},
+		},
+	})
+}
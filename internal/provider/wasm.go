@@ -0,0 +1,220 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The magic bytes at the start of Wasm modules
+var wasmMagic = []byte{0x00, 'a', 's', 'm'}
+
+// Returns the Wasm module, decompressing it if it is gzipped.
+func decompressWasmModule(module []byte) ([]byte, error) {
+	if bytes.HasPrefix(module, wasmMagic) {
+		return module, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(module))
+	if err != nil {
+		return nil, fmt.Errorf("not a Wasm module or a gzipped Wasm module")
+	}
+	defer reader.Close()
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress module: %w", err)
+	}
+
+	if !bytes.HasPrefix(decompressed, wasmMagic) {
+		return nil, fmt.Errorf("gzipped file is not a Wasm module")
+	}
+
+	return decompressed, nil
+}
+
+// A section of a Wasm module
+type wasmModuleSection struct {
+	Id      byte
+	Name    string // only set for custom sections
+	Content []byte // only set for custom sections: the section content following the name
+	Raw     []byte // the encoded section, including id and size
+}
+
+// Splits the (uncompressed) Wasm module into its sections.
+func wasmSections(module []byte) ([]wasmModuleSection, error) {
+	// Skip magic & version
+	if len(module) < 8 {
+		return nil, fmt.Errorf("module is truncated")
+	}
+	reader := bytes.NewReader(module[8:])
+
+	sections := []wasmModuleSection{}
+	for reader.Len() > 0 {
+		start := len(module) - reader.Len()
+
+		sectionId, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		sectionSize, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, fmt.Errorf("could not read section size: %w", err)
+		}
+
+		if sectionSize > uint64(reader.Len()) {
+			return nil, fmt.Errorf("section exceeds module size")
+		}
+
+		section := make([]byte, sectionSize)
+		_, err = io.ReadFull(reader, section)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed := wasmModuleSection{Id: sectionId, Raw: module[start : len(module)-reader.Len()]}
+
+		// Only custom sections (id 0) have names
+		if sectionId == 0 {
+			sectionReader := bytes.NewReader(section)
+			nameSize, err := binary.ReadUvarint(sectionReader)
+			if err != nil || nameSize > uint64(sectionReader.Len()) {
+				return nil, fmt.Errorf("invalid custom section name")
+			}
+
+			name := make([]byte, nameSize)
+			_, err = io.ReadFull(sectionReader, name)
+			if err != nil {
+				return nil, err
+			}
+
+			parsed.Name = string(name)
+			parsed.Content = section[len(section)-sectionReader.Len():]
+		}
+
+		sections = append(sections, parsed)
+	}
+
+	return sections, nil
+}
+
+// Returns the names of the custom sections of the (possibly gzipped) Wasm module, e.g.
+// "icp:public candid:service".
+func wasmCustomSectionNames(module []byte) ([]string, error) {
+	module, err := decompressWasmModule(module)
+	if err != nil {
+		return nil, err
+	}
+
+	sections, err := wasmSections(module)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, section := range sections {
+		if section.Id == 0 {
+			names = append(names, section.Name)
+		}
+	}
+
+	return names, nil
+}
+
+// Returns the content of the custom section of the (possibly gzipped) Wasm module, or nil
+// if the module has no such section.
+func wasmCustomSection(module []byte, name string) ([]byte, error) {
+	module, err := decompressWasmModule(module)
+	if err != nil {
+		return nil, err
+	}
+
+	sections, err := wasmSections(module)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, section := range sections {
+		if section.Id == 0 && section.Name == name {
+			return section.Content, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Returns the (possibly gzipped) Wasm module, uncompressed, with the custom section set to
+// content. Existing custom sections with the same name are removed.
+func wasmWithCustomSection(module []byte, name string, content []byte) ([]byte, error) {
+	module, err := decompressWasmModule(module)
+	if err != nil {
+		return nil, err
+	}
+
+	sections, err := wasmSections(module)
+	if err != nil {
+		return nil, err
+	}
+
+	result := append([]byte{}, module[:8]...)
+	for _, section := range sections {
+		if section.Id == 0 && section.Name == name {
+			continue
+		}
+		result = append(result, section.Raw...)
+	}
+
+	return append(result, wasmSection(0, append(wasmName(name), content...))...), nil
+}
+
+// Encodes an unsigned integer as LEB128.
+func wasmUleb(v uint64) []byte {
+	return binary.AppendUvarint(nil, v)
+}
+
+// Encodes a signed integer as (signed) LEB128.
+func wasmSleb(v int64) []byte {
+	result := []byte{}
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(result, b)
+		}
+		result = append(result, b|0x80)
+	}
+}
+
+// Encodes a vector of already encoded entries (prefixed with their count).
+func wasmVec(entries [][]byte) []byte {
+	result := wasmUleb(uint64(len(entries)))
+	for _, entry := range entries {
+		result = append(result, entry...)
+	}
+	return result
+}
+
+// Encodes bytes prefixed with their length.
+func wasmVecBytes(content []byte) []byte {
+	return append(wasmUleb(uint64(len(content))), content...)
+}
+
+// Encodes a name (or any string) prefixed with its length.
+func wasmName(name string) []byte {
+	return wasmVecBytes([]byte(name))
+}
+
+func wasmSection(id byte, content []byte) []byte {
+	return append([]byte{id}, wasmVecBytes(content)...)
+}
+
+func wasmFuncType(params []byte, results []byte) []byte {
+	result := []byte{0x60}
+	result = append(result, wasmVecBytes(params)...)
+	return append(result, wasmVecBytes(results)...)
+}
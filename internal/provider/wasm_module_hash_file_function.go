@@ -0,0 +1,76 @@
+// Copyright (c) DFINITY Foundation
+
+package provider
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/terraform-plugin-framework/function"
+)
+
+const wasmModuleHashFileSummary = "Compute the module hash of a Wasm module file"
+
+const wasmModuleHashFileDescription = "The `wasm_module_hash_file` function computes the (hex-encoded) hash of a Wasm module file as reported by the IC (e.g. in `canister_status`) once the module is installed with `wasm_file`. " +
+	"The file may be a plain Wasm module or a gzipped Wasm module. The IC hashes the module as it is installed, i.e. gzipped modules are hashed without decompressing them; the function checks that the file (after decompression) is a Wasm module and raises an error otherwise.\n\n" +
+	"The result can be used for `wasm_sha256`."
+
+// Ensure the implementation satisfies the desired interfaces.
+var _ function.Function = &WasmModuleHashFileFunction{}
+
+type WasmModuleHashFileFunction struct{}
+
+func (f *WasmModuleHashFileFunction) Metadata(ctx context.Context, req function.MetadataRequest, resp *function.MetadataResponse) {
+	resp.Name = "wasm_module_hash_file"
+}
+
+func (f *WasmModuleHashFileFunction) Definition(ctx context.Context, req function.DefinitionRequest, resp *function.DefinitionResponse) {
+
+	resp.Definition = function.Definition{
+		Summary:             wasmModuleHashFileSummary,
+		Description:         wasmModuleHashFileDescription,
+		MarkdownDescription: wasmModuleHashFileDescription,
+
+		Parameters: []function.Parameter{
+			function.StringParameter{
+				Name:        "path",
+				Description: "Path to the (possibly gzipped) Wasm module",
+			},
+		},
+		Return: function.StringReturn{},
+	}
+}
+
+func (f *WasmModuleHashFileFunction) Run(ctx context.Context, req function.RunRequest, resp *function.RunResponse) {
+	var path string
+
+	// Read Terraform argument data into the variable
+	resp.Error = function.ConcatFuncErrors(resp.Error, req.Arguments.Get(ctx, &path))
+	if resp.Error != nil {
+		return
+	}
+
+	module, err := os.ReadFile(path)
+	if err != nil {
+		resp.Error = function.NewArgumentFuncError(0, fmt.Sprintf("Could not read module: %s", err.Error()))
+		return
+	}
+
+	err = checkWasmModule(module)
+	if err != nil {
+		resp.Error = function.NewArgumentFuncError(0, fmt.Sprintf("Invalid module %q: %s", path, err.Error()))
+		return
+	}
+
+	moduleHash := sha256.Sum256(module)
+	resp.Error = function.ConcatFuncErrors(resp.Error, resp.Result.Set(ctx, hex.EncodeToString(moduleHash[:])))
+}
+
+// Returns an error if the module is neither a Wasm module nor a gzipped Wasm module.
+func checkWasmModule(module []byte) error {
+	_, err := decompressWasmModule(module)
+	return err
+}
@@ -0,0 +1,90 @@
+package provider
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-testing/helper/resource"
+	"github.com/hashicorp/terraform-plugin-testing/knownvalue"
+	"github.com/hashicorp/terraform-plugin-testing/statecheck"
+	"github.com/hashicorp/terraform-plugin-testing/tfversion"
+)
+
+func TestWasmModuleHashFileFunction(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	// The smallest valid Wasm module (magic & version)
+	module := []byte{0x00, 'a', 's', 'm', 0x01, 0x00, 0x00, 0x00}
+
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	_, err := writer.Write(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{
+		"module.wasm":    module,
+		"module.wasm.gz": gzipped.Bytes(),
+		"invalid.wasm":   []byte("not wasm"),
+	}
+	for name, content := range files {
+		err = os.WriteFile(path.Join(dir, name), content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sha256Hex := func(content []byte) string {
+		sum := sha256.Sum256(content)
+		return hex.EncodeToString(sum[:])
+	}
+
+	resource.UnitTest(t, resource.TestCase{
+		TerraformVersionChecks: []tfversion.TerraformVersionCheck{
+			// Provider functions are only supports in 1.8.0+
+			tfversion.SkipBelow(tfversion.Version1_8_0),
+		},
+		ProtoV6ProviderFactories: testAccProtoV6ProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::wasm_module_hash_file("` + path.Join(dir, "module.wasm") + `")
+                }`,
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownOutputValue("test", knownvalue.StringExact(sha256Hex(module))),
+				},
+			},
+			{
+				// Gzipped modules are hashed as is
+				Config: `
+                output "test" {
+                    value = provider::ic::wasm_module_hash_file("` + path.Join(dir, "module.wasm.gz") + `")
+                }`,
+				ConfigStateChecks: []statecheck.StateCheck{
+					statecheck.ExpectKnownOutputValue("test", knownvalue.StringExact(sha256Hex(gzipped.Bytes()))),
+				},
+			},
+			{
+				Config: `
+                output "test" {
+                    value = provider::ic::wasm_module_hash_file("` + path.Join(dir, "invalid.wasm") + `")
+                }`,
+				ExpectError: regexp.MustCompile("not a Wasm module"),
+			},
+		},
+	})
+}